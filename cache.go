@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strconv"
+
+	"DockerS3LogDriver/pkg/s3log"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/daemon/logger/local"
+)
+
+// localStore is a cache store written and rotated by the daemon's local
+// driver.
+type localStore struct {
+	l logger.Logger
+}
+
+// openCacheStore opens the local driver's files at path.
+func openCacheStore(path string, maxSize int64, files int) (s3log.CacheStore, error) {
+	l, err := local.New(logger.Info{
+		LogPath: path,
+		Config: map[string]string{
+			"max-size": strconv.FormatInt(maxSize, 10),
+			"max-file": strconv.Itoa(files),
+			"compress": "false",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &localStore{l: l}, nil
+}
+
+// Log writes msg as a line. It is copied, since the local driver recycles
+// the messages it is given. The line goes in without a newline, which the
+// local driver adds back as it reads the line.
+func (s *localStore) Log(msg *s3log.Message) error {
+	m := logger.NewMessage()
+	m.Line = append(m.Line[:0], msg.Line...)
+	m.Source = msg.Source
+	m.Timestamp = msg.Timestamp
+	return s.l.Log(m)
+}
+
+// ReadLogs reads the local driver's lines back, converting each message.
+func (s *localStore) ReadLogs(config s3log.ReadConfig) *s3log.LogWatcher {
+	src := s.l.(logger.LogReader).ReadLogs(logger.ReadConfig(config))
+	watcher := s3log.NewLogWatcher()
+	go func() {
+		defer close(watcher.Msg)
+		defer src.ConsumerGone()
+		for {
+			select {
+			case msg, ok := <-src.Msg:
+				if !ok {
+					return
+				}
+				select {
+				case watcher.Msg <- fromDockerMessage(msg):
+				case <-watcher.WatchConsumerGone():
+					return
+				}
+			case err := <-src.Err:
+				watcher.Err <- err
+				return
+			case <-watcher.WatchConsumerGone():
+				return
+			}
+		}
+	}()
+	return watcher
+}
+
+func (s *localStore) Close() error {
+	return s.l.Close()
+}
+
+// fromDockerMessage converts a message of the daemon's into the driver's.
+func fromDockerMessage(msg *logger.Message) *s3log.Message {
+	m := &s3log.Message{
+		Line:      msg.Line,
+		Source:    msg.Source,
+		Timestamp: msg.Timestamp,
+		Err:       msg.Err,
+	}
+	for _, a := range msg.Attrs {
+		m.Attrs = append(m.Attrs, s3log.LogAttr(a))
+	}
+	if msg.PLogMetaData != nil {
+		p := s3log.PartialLogMetaData(*msg.PLogMetaData)
+		m.PLogMetaData = &p
+	}
+	return m
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"DockerS3LogDriver/pkg/s3log"
+)
+
+func TestCacheStoreRoundTrip(t *testing.T) {
+	// Lines read back from the local driver's files are those logged, with
+	// the one newline docker logs prints after each, whether they were
+	// written before the read or while following.
+	tests := []struct {
+		name   string
+		follow bool
+	}{
+		{name: "read"},
+		{name: "follow", follow: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := openCacheStore(filepath.Join(t.TempDir(), "container.log"), 1<<20, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			now := time.Now().UTC()
+			logged := []*s3log.Message{
+				{Line: []byte("hello"), Source: "stdout", Timestamp: now},
+				{Line: []byte(`{"level":"error"}`), Source: "stderr", Timestamp: now.Add(time.Millisecond)},
+				{Line: []byte(""), Source: "stdout", Timestamp: now.Add(2 * time.Millisecond)},
+			}
+			write := func() {
+				for _, msg := range logged {
+					if err := store.Log(msg); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if !tt.follow {
+				write()
+			}
+			w := store.ReadLogs(s3log.ReadConfig{Tail: -1, Follow: tt.follow})
+			defer w.ConsumerGone()
+			if tt.follow {
+				write()
+			}
+
+			timeout := time.After(5 * time.Second)
+			for i, want := range logged {
+				select {
+				case msg, ok := <-w.Msg:
+					if !ok {
+						t.Fatalf("read back %d lines, want %d", i, len(logged))
+					}
+					if wantLine := append(slices.Clip(want.Line), '\n'); string(msg.Line) != string(wantLine) {
+						t.Errorf("line %d read back as %q, want %q", i+1, msg.Line, wantLine)
+					}
+					if msg.Source != want.Source || !msg.Timestamp.Equal(want.Timestamp) {
+						t.Errorf("line %d read back from %s at %s, want %s at %s", i+1, msg.Source, msg.Timestamp, want.Source, want.Timestamp)
+					}
+				case err := <-w.Err:
+					t.Fatal(err)
+				case <-timeout:
+					t.Fatalf("read back %d lines, want %d", i, len(logged))
+				}
+			}
+			if tt.follow {
+				return
+			}
+			select {
+			case msg, ok := <-w.Msg:
+				if ok {
+					t.Errorf("read back %q after the lines logged", msg.Line)
+				}
+			case <-timeout:
+				t.Error("read didn't end after the lines logged")
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Command s3pipe uploads the lines it reads on stdin to S3 with the plugin's
+// pipeline, as an example of embedding pkg/s3log outside Docker:
+//
+//	journalctl -f -o cat | s3pipe --id journald-$(hostname) --log-opt s3-bucket=logs
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"DockerS3LogDriver/pkg/s3log"
+)
+
+// logOpts collects repeated --log-opt key=value flags.
+type logOpts map[string]string
+
+func (o logOpts) String() string { return fmt.Sprint(map[string]string(o)) }
+
+func (o logOpts) Set(v string) error {
+	k, value, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("%q is not key=value", v)
+	}
+	o[k] = value
+	return nil
+}
+
+func main() {
+	id := flag.String("id", "", "identity the objects are keyed by, at least 12 characters")
+	name := flag.String("name", "", "name of the source, for key templates")
+	opts := logOpts{}
+	flag.Var(opts, "log-opt", "log-opt, as key=value; may be repeated")
+	flag.Parse()
+
+	l, err := s3log.New(s3log.DefaultOptions(), s3log.Info{
+		ContainerID:   *id,
+		ContainerName: *name,
+		Config:        opts,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	sc := bufio.NewScanner(os.Stdin)
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for sc.Scan() {
+		// The line is copied by WriteMessage, so the scanner's buffer can be
+		// reused.
+		msg := s3log.Message{Line: sc.Bytes(), Source: "stdout", Timestamp: time.Now()}
+		if err := l.WriteMessage(msg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if err := l.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
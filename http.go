@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 
+	"DockerS3LogDriver/pkg/s3log"
 	"github.com/docker/docker/daemon/logger"
 	"github.com/docker/docker/pkg/ioutils"
 	"github.com/docker/go-plugins-helpers/sdk"
@@ -30,7 +31,9 @@ type ReadLogsRequest struct {
 	Config logger.ReadConfig
 }
 
-func handlers(h *sdk.Handler, d *driver) {
+// handlers registers the log driver API on h, converting the daemon's types
+// into the driver's.
+func handlers(h *sdk.Handler, d *s3log.Driver) {
 	h.HandleFunc("/LogDriver.StartLogging", func(w http.ResponseWriter, r *http.Request) {
 		var req StartLoggingRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -38,12 +41,12 @@ func handlers(h *sdk.Handler, d *driver) {
 			return
 		}
 		if req.Info.ContainerID == "" {
-			respond(errors.New("must provide container id in log context"), w)
+			s3log.Respond(errors.New("must provide container id in log context"), w)
 			return
 		}
 
-		err := d.StartLogging(req.File, req.Info)
-		respond(err, w)
+		err := d.StartLogging(req.File, s3log.Info(req.Info))
+		s3log.Respond(err, w)
 	})
 
 	h.HandleFunc("/LogDriver.StopLogging", func(w http.ResponseWriter, r *http.Request) {
@@ -53,7 +56,7 @@ func handlers(h *sdk.Handler, d *driver) {
 			return
 		}
 		err := d.StopLogging(req.File)
-		respond(err, w)
+		s3log.Respond(err, w)
 	})
 
 	h.HandleFunc("/LogDriver.Capabilities", func(w http.ResponseWriter, r *http.Request) {
@@ -69,7 +72,7 @@ func handlers(h *sdk.Handler, d *driver) {
 			return
 		}
 
-		stream, err := d.ReadLogs(req.Info, req.Config)
+		stream, err := d.ReadLogs(s3log.Info(req.Info), s3log.ReadConfig(req.Config))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -81,15 +84,3 @@ func handlers(h *sdk.Handler, d *driver) {
 		io.Copy(wf, stream)
 	})
 }
-
-type response struct {
-	Err string
-}
-
-func respond(err error, w http.ResponseWriter) {
-	var res response
-	if err != nil {
-		res.Err = err.Error()
-	}
-	json.NewEncoder(w).Encode(&res)
-}
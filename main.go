@@ -1,35 +1,61 @@
+// Command docker-log-driver is the Docker log driver plugin: an adapter
+// serving the daemon's log driver API with the uploader in pkg/s3log, which
+// also runs the plugin's commands.
 package main
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strings"
 
-	"github.com/Sirupsen/logrus"
+	"DockerS3LogDriver/pkg/s3log"
 	"github.com/docker/go-plugins-helpers/sdk"
 )
 
-var logLevels = map[string]logrus.Level{
-	"debug": logrus.DebugLevel,
-	"info":  logrus.InfoLevel,
-	"warn":  logrus.WarnLevel,
-	"error": logrus.ErrorLevel,
-}
-
 func main() {
-	levelVal := os.Getenv("LOG_LEVEL")
-	if levelVal == "" {
-		levelVal = "info"
+	cmd, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
 	}
-	if level, exists := logLevels[levelVal]; exists {
-		logrus.SetLevel(level)
-	} else {
-		fmt.Fprintln(os.Stderr, "invalid log level: ", levelVal)
-		os.Exit(1)
+	switch cmd {
+	case "", "serve":
+		serve(args)
+	case "version":
+		s3log.RunVersion(args)
+	case "selftest":
+		os.Exit(s3log.RunSelftest(args))
+	case "query":
+		os.Exit(s3log.RunQuery(args))
+	case "package":
+		os.Exit(s3log.RunPackage(args))
+	case "backfill":
+		os.Exit(s3log.RunBackfill(args))
+	case "config":
+		os.Exit(s3log.RunConfig(args))
+	case "update":
+		os.Exit(s3log.RunUpdate(args))
+	case "validate":
+		os.Exit(s3log.RunValidate(args))
+	case "schema":
+		os.Exit(s3log.RunSchema(args))
+	case "policy":
+		os.Exit(s3log.RunPolicy(args))
+	case "replay":
+		os.Exit(s3log.RunReplay(args))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q: want serve, version, selftest, query, package, backfill, config, update, validate, schema, policy or replay\n", cmd)
+		os.Exit(2)
 	}
+}
 
-	h := sdk.NewHandler(`{"Implements": ["LoggingDriver"]}`)
-	handlers(&h, newDriver())
-	if err := h.ServeUnix("jsonfile", 0); err != nil {
-		panic(err)
-	}
+// serve runs the plugin, serving the log driver API on its socket until it
+// is told to exit.
+func serve(args []string) {
+	s3log.Serve(args, openCacheStore, func(d *s3log.Driver, l net.Listener) error {
+		h := sdk.NewHandler(`{"Implements": ["LoggingDriver"]}`)
+		handlers(&h, d)
+		d.Handle(&h)
+		return h.Serve(l)
+	})
 }
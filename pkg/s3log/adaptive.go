@@ -0,0 +1,84 @@
+package s3log
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	adaptiveFlushKey    = "adaptive-flush"
+	adaptiveFlushMinKey = "adaptive-flush-min-bytes"
+	adaptiveFlushMaxKey = "adaptive-flush-max-bytes"
+
+	defaultAdaptiveFlushMin = 64 << 10
+	defaultAdaptiveFlushMax = 8 << 20
+
+	// flushRateSample is how long bytes are counted for before they are
+	// folded into the rate, and flushRateWindow the time constant of the
+	// moving average they are folded into.
+	flushRateSample = time.Second
+	flushRateWindow = time.Minute
+)
+
+// flushSizer picks the buffered bytes that trigger a flush from the rate
+// lines arrive at: what the container logs in a flush-interval, between min
+// and max. A quiet container is flushed in small objects soon after it logs,
+// and a loud one in large objects, instead of flushing whenever a fixed size
+// fills up. The rate is an exponentially weighted moving average over about
+// a minute, so a burst moves the target gradually.
+type flushSizer struct {
+	min, max int
+	interval time.Duration
+
+	rate  float64   // bytes per second
+	start time.Time // start of the sample being counted
+	bytes int       // bytes counted since start
+}
+
+func newFlushSizer(min, max int, interval time.Duration) *flushSizer {
+	return &flushSizer{min: min, max: max, interval: interval}
+}
+
+// add counts n bytes arriving at now, folding the bytes counted so far into
+// the rate once a sample's worth of time has passed. A gap with nothing
+// logged counts as a long sample with nothing in it.
+func (s *flushSizer) add(n int, now time.Time) {
+	if s.start.IsZero() {
+		s.start = now
+	}
+	if dt := now.Sub(s.start); dt >= flushRateSample {
+		s.sample(float64(s.bytes)/dt.Seconds(), dt)
+		s.start, s.bytes = now, 0
+	}
+	s.bytes += n
+}
+
+// sample folds a rate observed over dt into the average, weighting it by how
+// much of the window dt covers.
+func (s *flushSizer) sample(rate float64, dt time.Duration) {
+	w := math.Exp(-dt.Seconds() / flushRateWindow.Seconds())
+	s.rate = s.rate*w + rate*(1-w)
+}
+
+// target returns the buffered bytes that trigger a flush.
+func (s *flushSizer) target() int {
+	n := s.rate * s.interval.Seconds()
+	if n >= float64(s.max) {
+		return s.max
+	}
+	return max(int(n), s.min)
+}
+
+// flushBytes returns the buffered bytes that trigger a flush, raised by
+// startupFlushFactor, up to max-buffer-size, during startup-grace. Callers
+// must hold l.mu.
+func (l *S3Logger) flushBytes() int {
+	n := l.opts.FlushBytes
+	if l.sizer != nil {
+		n = l.sizer.target()
+	}
+	if l.inStartupGrace() {
+		n = min(n*startupFlushFactor, l.opts.MaxBufferSize)
+	}
+	return n
+}
@@ -0,0 +1,127 @@
+package s3log
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// feed adds rate bytes a second to s in a line every tick for d from start,
+// returning when it stopped.
+func feed(s *flushSizer, start time.Time, rate int, tick, d time.Duration) time.Time {
+	n := int(float64(rate) * tick.Seconds())
+	now := start
+	for end := start.Add(d); now.Before(end); now = now.Add(tick) {
+		s.add(n, now)
+	}
+	return now
+}
+
+func TestFlushSizer(t *testing.T) {
+	const min, max = 64 << 10, 8 << 20
+	interval := 5 * time.Second
+	tests := []struct {
+		name     string
+		run      func(s *flushSizer, start time.Time) // feeds the sizer
+		low, top int                                  // the target is within [low, top]
+	}{
+		{
+			name: "nothing logged",
+			run:  func(*flushSizer, time.Time) {},
+			low:  min,
+			top:  min,
+		},
+		{
+			// 10 lines of 100 bytes a minute.
+			name: "quiet",
+			run: func(s *flushSizer, start time.Time) {
+				feed(s, start, 1000/60, 6*time.Second, 10*time.Minute)
+			},
+			low: min,
+			top: min,
+		},
+		{
+			name: "loud",
+			run: func(s *flushSizer, start time.Time) {
+				feed(s, start, 10<<20, 10*time.Millisecond, 5*time.Minute)
+			},
+			low: max,
+			top: max,
+		},
+		{
+			// A steady 100KB/s settles on what arrives in a flush-interval.
+			name: "steady",
+			run: func(s *flushSizer, start time.Time) {
+				feed(s, start, 100<<10, 10*time.Millisecond, 10*time.Minute)
+			},
+			low: 5 * 100 << 10 * 95 / 100,
+			top: 5 * 100 << 10 * 105 / 100,
+		},
+		{
+			// Two seconds' burst after a quiet minute moves the target only
+			// part of the way.
+			name: "burst",
+			run: func(s *flushSizer, start time.Time) {
+				now := feed(s, start, 1<<10, 100*time.Millisecond, time.Minute)
+				feed(s, now, 10<<20, 10*time.Millisecond, 2*time.Second)
+			},
+			low: min * 2,
+			top: max / 2,
+		},
+		{
+			// Once a loud container goes quiet the target decays back.
+			name: "loud then quiet",
+			run: func(s *flushSizer, start time.Time) {
+				now := feed(s, start, 10<<20, 10*time.Millisecond, 5*time.Minute)
+				feed(s, now, 1<<10, time.Second, 10*time.Minute)
+			},
+			low: min,
+			top: 2 * min,
+		},
+		{
+			// Silence is a long sample with nothing in it.
+			name: "loud then silent",
+			run: func(s *flushSizer, start time.Time) {
+				now := feed(s, start, 10<<20, 10*time.Millisecond, 5*time.Minute)
+				s.add(1, now.Add(10*time.Minute))
+			},
+			low: min,
+			top: 2 * min,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFlushSizer(min, max, interval)
+			tt.run(s, time.Unix(1700000000, 0))
+			if got := s.target(); got < tt.low || got > tt.top {
+				t.Errorf("target %d at %.0f bytes/s, want within [%d, %d]", got, s.rate, tt.low, tt.top)
+			}
+		})
+	}
+}
+
+func TestAdaptiveFlushStats(t *testing.T) {
+	fake := newFakeS3()
+	d := newTestDriver(t, fake, nil)
+	c := startContainer(t, d, map[string]string{
+		adaptiveFlushKey:    "true",
+		adaptiveFlushMinKey: "4096",
+		adaptiveFlushMaxKey: "1048576",
+		startupGraceKey:     "0s",
+	})
+	defer c.stop(t, d)
+	c.write(t, entry("stdout", "one line", time.Now()))
+	waitFor(t, "the line to be logged", func() bool { return metricValue(c.l.metrics.received) == 1 })
+	var buf bytes.Buffer
+	if err := d.dumpStats(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var snap statsSnapshot
+	if err := json.Unmarshal(buf.Bytes(), &snap); err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Containers) != 1 || snap.Containers[0].FlushTargetBytes != 4096 {
+		t.Errorf("stats %s, want a flush target of the minimum 4096", buf.Bytes())
+	}
+}
@@ -0,0 +1,36 @@
+//go:build !race
+
+package s3log
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The race detector allocates on its own and empties pools at random, so
+// allocations are only counted without it.
+
+func TestLogAllocs(t *testing.T) {
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, map[string]string{flushIntervalKey: "1h", maxBufferSizeKey: "16777216", flushBytesKey: "16777216"})
+	msg := &Message{Line: []byte(strings.Repeat("x", 200)), Source: "stdout", Timestamp: time.Now()}
+	// Grow the buffer first.
+	for range 10000 {
+		l.Log(msg)
+	}
+	if allocs := testing.AllocsPerRun(1000, func() { l.Log(msg) }); allocs > 0 {
+		t.Errorf("%v allocations per line, want none", allocs)
+	}
+}
+
+func TestSealBufferAllocs(t *testing.T) {
+	data := []byte(strings.Repeat("x", 64<<10))
+	allocs := testing.AllocsPerRun(100, func() {
+		releaseBatches([]sealedBatch{{data: sealBuffer(data)}})
+	})
+	// Only the pointer put back with the buffer is allocated.
+	if allocs > 1 {
+		t.Errorf("%v allocations per batch sealed, want the buffer reused", allocs)
+	}
+}
@@ -0,0 +1,111 @@
+package s3log
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	stripANSIKey = "strip-ansi"
+	skipEmptyKey = "skip-empty"
+)
+
+// ansiSequence returns the length of the ANSI escape sequence p starts with,
+// or 0 if it doesn't start with one: a CSI sequence such as a color or cursor
+// movement (ESC [ params final), an OSC sequence such as a window title,
+// ended by BEL or ESC \, or another escape followed by its intermediate and
+// final bytes. An unterminated sequence runs to the end of p.
+func ansiSequence(p []byte) int {
+	if len(p) < 2 || p[0] != 0x1b {
+		return 0
+	}
+	switch p[1] {
+	case '[':
+		for i := 2; i < len(p); i++ {
+			if p[i] >= 0x40 && p[i] <= 0x7e {
+				return i + 1
+			}
+			if p[i] < 0x20 || p[i] > 0x3f {
+				return i
+			}
+		}
+		return len(p)
+	case ']':
+		for i := 2; i < len(p); i++ {
+			if p[i] == 0x07 {
+				return i + 1
+			}
+			if p[i] == 0x1b && i+1 < len(p) && p[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return len(p)
+	}
+	i := 1
+	for i < len(p) && p[i] >= 0x20 && p[i] <= 0x2f {
+		i++
+	}
+	if i < len(p) && p[i] >= 0x30 && p[i] <= 0x7e {
+		return i + 1
+	}
+	return i
+}
+
+// stripANSI returns line without its ANSI escape sequences, and whether it
+// had any. A line without any is returned as it is.
+func stripANSI(line []byte) ([]byte, bool) {
+	i := 0
+	for i < len(line) && ansiSequence(line[i:]) == 0 {
+		i++
+	}
+	if i == len(line) {
+		return line, false
+	}
+	out := append([]byte(nil), line[:i]...)
+	for i < len(line) {
+		if n := ansiSequence(line[i:]); n > 0 {
+			i += n
+			continue
+		}
+		out = append(out, line[i])
+		i++
+	}
+	return out, true
+}
+
+// isBlank reports whether line holds nothing but whitespace, including the
+// bare carriage returns of progress bars, and ANSI escape sequences.
+func isBlank(line []byte) bool {
+	for len(line) > 0 {
+		if n := ansiSequence(line); n > 0 {
+			line = line[n:]
+			continue
+		}
+		r, size := utf8.DecodeRune(line)
+		if !unicode.IsSpace(r) {
+			return false
+		}
+		line = line[size:]
+	}
+	return true
+}
+
+// clean strips the ANSI escape sequences of msg's line with strip-ansi, and
+// reports whether the line is left blank and dropped with skip-empty,
+// counting the lines it changes. It sees complete lines, after partial
+// lines have been reassembled. Callers must hold l.mu.
+func (l *S3Logger) clean(msg *Message) (*Message, bool) {
+	if l.opts.StripANSI {
+		if line, ok := stripANSI(msg.Line); ok {
+			stripped := *msg
+			stripped.Line = line
+			msg = &stripped
+			l.metrics.stripped.Inc()
+		}
+	}
+	if l.opts.SkipEmpty && isBlank(msg.Line) {
+		l.metrics.skipped.Inc()
+		return msg, false
+	}
+	return msg, true
+}
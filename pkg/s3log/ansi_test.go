@@ -0,0 +1,127 @@
+package s3log
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestStripANSI(t *testing.T) {
+	tests := []struct {
+		name, line, want string
+	}{
+		{"plain", "plain line", "plain line"},
+		{"color", "\x1b[32mok\x1b[0m", "ok"},
+		{"256 color", "\x1b[38;5;208mwarn\x1b[m", "warn"},
+		// npm's progress bar: erase the line, back to column 1, redraw.
+		{"npm progress", "\x1b[2K\x1b[1G⸨░░░░░░⸩ ⠙ idealTree: timing", "⸨░░░░░░⸩ ⠙ idealTree: timing"},
+		{"cursor up", "\x1b[1A\x1b[2Klast", "last"},
+		// pip hides the cursor while drawing its bar.
+		{"pip progress", "\x1b[?25l   ━━━━━━━━ 1.2/3.4 MB 5.6 MB/s eta 0:00:01\x1b[?25h", "   ━━━━━━━━ 1.2/3.4 MB 5.6 MB/s eta 0:00:01"},
+		{"window title ended by BEL", "\x1b]0;npm install\x07done", "done"},
+		{"window title ended by ST", "\x1b]2;build\x1b\\done", "done"},
+		{"charset switch", "\x1b(Bbox", "box"},
+		{"unterminated", "text\x1b[31", "text"},
+		{"lone escape", "a\x1bz", "a"},
+	}
+	for _, tt := range tests {
+		got, stripped := stripANSI([]byte(tt.line))
+		if string(got) != tt.want || stripped != (tt.line != tt.want) {
+			t.Errorf("%s: stripANSI(%q) = %q, %v, want %q", tt.name, tt.line, got, stripped, tt.want)
+		}
+	}
+}
+
+func TestIsBlank(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"", true},
+		{"   \t", true},
+		{"\r", true},
+		{"\r\r\r", true},
+		// What a progress bar leaves once it is done.
+		{"\x1b[2K\x1b[1G\r", true},
+		{"\x1b[?25l\x1b[?25h", true},
+		{" ", true},
+		{"\x1b[32m.\x1b[0m", false},
+		{"x", false},
+	}
+	for _, tt := range tests {
+		if got := isBlank([]byte(tt.line)); got != tt.want {
+			t.Errorf("isBlank(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestCleanLines(t *testing.T) {
+	msgs := []*Message{
+		{Line: []byte("\x1b[32mok\x1b[0m"), Source: "stdout"},
+		{Line: []byte("\r"), Source: "stdout"},
+		{Line: []byte("\x1b[2K\x1b[1G"), Source: "stdout"},
+		{Line: []byte(""), Source: "stdout"},
+		// A color split across partials is judged on the whole line.
+		part("a", 1, false, "stdout", "\x1b[3"),
+		part("a", 2, true, "stdout", "1merror\x1b[0m"),
+		// As is a blank line in parts, one ending in a bare escape.
+		part("b", 1, false, "stdout", "  \x1b"),
+		part("b", 2, true, "stdout", "[K "),
+		{Line: []byte("plain"), Source: "stdout"},
+	}
+	tests := []struct {
+		name              string
+		cfg               map[string]string
+		want              []string
+		stripped, skipped float64
+	}{
+		{
+			name: "neither",
+			want: []string{"\x1b[32mok\x1b[0m", "\r", "\x1b[2K\x1b[1G", "", "\x1b[31merror\x1b[0m", "  \x1b[K ", "plain"},
+		},
+		{
+			name:     "strip-ansi",
+			cfg:      map[string]string{stripANSIKey: "true"},
+			want:     []string{"ok", "\r", "", "", "error", "   ", "plain"},
+			stripped: 4,
+		},
+		{
+			name:    "skip-empty",
+			cfg:     map[string]string{skipEmptyKey: "true"},
+			want:    []string{"\x1b[32mok\x1b[0m", "\x1b[31merror\x1b[0m", "plain"},
+			skipped: 4,
+		},
+		{
+			name:     "both",
+			cfg:      map[string]string{stripANSIKey: "true", skipEmptyKey: "true"},
+			want:     []string{"ok", "error", "plain"},
+			stripped: 4,
+			skipped:  4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			cfg := map[string]string{formatKey: formatJSONL}
+			maps.Copy(cfg, tt.cfg)
+			l := newTestLogger(t, fake, cfg)
+			for _, msg := range msgs {
+				if err := l.Log(msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := uploadedLines(t, fake, l); !slices.Equal(got, tt.want) {
+				t.Errorf("uploaded %q, want %q", got, tt.want)
+			}
+			if got := metricValue(l.metrics.stripped); got != tt.stripped {
+				t.Errorf("%v lines counted as stripped, want %v", got, tt.stripped)
+			}
+			if got := metricValue(l.metrics.skipped); got != tt.skipped {
+				t.Errorf("%v lines counted as skipped, want %v", got, tt.skipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package s3log
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultDockerRoot is where the daemon keeps containers' json-file logs
+// unless its data-root is elsewhere.
+const defaultDockerRoot = "/var/lib/docker"
+
+// jsonFileRecord is a line of a json-file log. A line the daemon split
+// because it was too long, or that the container wrote without a newline,
+// is recorded without one at the end of log.
+type jsonFileRecord struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// RunBackfill runs the backfill command, which uploads the json-file logs a
+// container wrote before it was switched to this driver, as the plugin would
+// have uploaded them. It takes the same log-opt flags as the plugin, so that
+// the objects land where the plugin puts the container's, and returns the
+// exit status.
+func RunBackfill(args []string) int {
+	var opts LogOption
+	fs := flag.NewFlagSet(driverName+" backfill", flag.ExitOnError)
+	containerID := fs.String("container-id", "", "ID, or unique ID prefix, of the container whose logs are backfilled")
+	containerName := fs.String("container-name", "", "name of the container, read from its config under --docker-root if unset")
+	jsonFilePath := fs.String("json-file-path", "", "json-file log to backfill, along with its rotated files, found under --docker-root if unset")
+	dockerRoot := fs.String("docker-root", defaultDockerRoot, "data-root of the daemon whose containers are backfilled")
+	allowInsecure := fs.Bool(allowInsecureKey, false, "allow "+insecureSkipVerifyKey)
+	levelVal := fs.String("log-level", "warn", "level of the plugin's own logs while backfilling")
+	optionFlags(fs, &opts)
+	fs.Parse(args)
+
+	setLogLevel(*levelVal)
+	if *containerID == "" {
+		fmt.Fprintln(os.Stderr, "--container-id is required")
+		return 2
+	}
+	info, err := containerInfo(*dockerRoot, *containerID)
+	if err != nil && *jsonFilePath == "" {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err != nil {
+		info = Info{ContainerID: *containerID}
+	}
+	if *containerName != "" {
+		info.ContainerName = *containerName
+	}
+	info.Config = map[string]string{}
+	if *jsonFilePath == "" {
+		*jsonFilePath = filepath.Join(*dockerRoot, "containers", info.ContainerID, info.ContainerID+"-json.log")
+	}
+	files, err := jsonFiles(*jsonFilePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	opts, err = parseLogOpts(opts, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, newOpError(opParseOptions, "", err))
+		return 1
+	}
+	// The manifest is what an interrupted backfill resumes from. Nothing is
+	// journaled, and no line is dropped for want of buffer space.
+	opts.Manifest = true
+	opts.WAL = false
+	opts.Mode, opts.StdoutMode, opts.StderrMode = modeBlocking, modeBlocking, modeBlocking
+	opts.backfill = true
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	clients := newClientFactory(loadAWSConfig(), opts.Concurrency, *allowInsecure)
+	l, err := newLogger(clients, nil, nil, opts, info, nil, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var loggers []*S3Logger
+	switch l := l.(type) {
+	case *S3Logger:
+		loggers = append(loggers, l)
+	case *splitLogger:
+		loggers = append(loggers, l.loggers[:]...)
+	}
+	// Only the json-file's own span of time is looked for in the manifests,
+	// which go on to list the objects the plugin uploads once the container
+	// logs through it.
+	var end time.Time
+	if err := readJSONFiles(ctx, files, io.Discard, func(msg *Message) error {
+		end = msg.Timestamp
+		return nil
+	}); err != nil {
+		l.Close()
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resume := make([]time.Time, len(loggers))
+	for i, sl := range loggers {
+		var seq int64
+		if resume[i], seq, err = sl.backfilled(ctx, end); err != nil {
+			l.Close()
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		// Lines go on being numbered from the last one uploaded.
+		sl.mu.Lock()
+		sl.lineSeq = max(sl.lineSeq, seq)
+		sl.mu.Unlock()
+	}
+
+	lines, skipped := 0, 0
+	err = readJSONFiles(ctx, files, os.Stderr, func(msg *Message) error {
+		i := 0
+		if len(loggers) > 1 && msg.Source == splitStreams[1] {
+			i = 1
+		}
+		if !msg.Timestamp.After(resume[i]) {
+			skipped++
+			return nil
+		}
+		if err := l.Log(msg); err != nil {
+			return err
+		}
+		lines++
+		if lines%1000 == 0 && failedBatches(loggers) > 0 {
+			return errors.New("a batch failed to upload, stopping")
+		}
+		return nil
+	})
+	if cerr := l.Close(); err == nil {
+		err = cerr
+	}
+	for _, sl := range loggers {
+		sl.closeManifest()
+	}
+	if err == nil && failedBatches(loggers) > 0 {
+		err = errors.New("a batch failed to upload")
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d lines already backfilled\n", skipped)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error backfilling %s after %d lines: %v\n", info.ContainerID, lines, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "backfilled %d lines of %s from %d files\n", lines, info.ContainerID, len(files))
+	return 0
+}
+
+// backfilled returns the time and sequence number of the last line an
+// earlier backfill of lines logged until end uploaded and listed in the
+// manifest, or zero if there is none. Lines logged at the same time as that
+// one are taken to have been uploaded along with it.
+func (l *S3Logger) backfilled(ctx context.Context, end time.Time) (time.Time, int64, error) {
+	m, _, err := readManifest(ctx, l.s3Client, l.bucket, l.manifestPath(), l.opts.RequestPayer)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	var last time.Time
+	var seq int64
+	for _, o := range m.Objects {
+		if !o.FirstTimestamp.After(end) && o.LastTimestamp.After(last) {
+			last, seq = o.LastTimestamp, o.LastSequence
+		}
+	}
+	return last, seq, nil
+}
+
+// failedBatches returns how many batches loggers have dropped after their
+// uploads failed.
+func failedBatches(loggers []*S3Logger) int {
+	n := 0
+	for _, l := range loggers {
+		for _, t := range l.targets {
+			n += int(metricValue(t.metrics.failed))
+		}
+	}
+	return n
+}
+
+// containerInfo returns what the daemon under root knows of the container
+// whose ID is, or starts with, id.
+func containerInfo(root, id string) (Info, error) {
+	dirs, err := filepath.Glob(filepath.Join(root, "containers", id+"*"))
+	if err != nil || len(dirs) == 0 {
+		return Info{}, fmt.Errorf("no container %q under %s, set --json-file-path", id, root)
+	}
+	if len(dirs) > 1 {
+		return Info{}, fmt.Errorf("container ID prefix %q is ambiguous: %d containers match", id, len(dirs))
+	}
+	info := Info{ContainerID: filepath.Base(dirs[0])}
+	data, err := os.ReadFile(filepath.Join(dirs[0], "config.v2.json"))
+	if err != nil {
+		return info, nil
+	}
+	var cfg struct {
+		Name    string
+		Created time.Time
+		Config  struct {
+			Image  string
+			Labels map[string]string
+		}
+	}
+	if json.Unmarshal(data, &cfg) == nil {
+		info.ContainerName = cfg.Name
+		info.ContainerCreated = cfg.Created
+		info.ContainerImageName = cfg.Config.Image
+		info.ContainerLabels = cfg.Config.Labels
+	}
+	return info, nil
+}
+
+// jsonFiles returns the json-file log at path and the files rotated out of
+// it, path.1 being the newest and each of them perhaps gzipped, oldest
+// first.
+func jsonFiles(path string) ([]string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	type rotated struct {
+		path string
+		n    int
+	}
+	var files []rotated
+	for _, m := range matches {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".gz"))
+		if err == nil && n > 0 {
+			files = append(files, rotated{m, n})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].n > files[j].n })
+	paths := make([]string, 0, len(files)+1)
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	return append(paths, path), nil
+}
+
+// readJSONFiles passes each line of files, in order, to fn as a message,
+// joining the records of lines the daemon split. fn's error stops reading.
+// A record that can't be parsed is skipped with a warning written to warn.
+func readJSONFiles(ctx context.Context, files []string, warn io.Writer, fn func(*Message) error) error {
+	var pending *Message
+	for _, path := range files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		var r io.Reader = f
+		if strings.HasSuffix(path, ".gz") {
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("failed to decompress %s: %v", path, err)
+			}
+			r = zr
+		}
+		err = readJSONFile(ctx, bufio.NewReader(r), path, warn, &pending, fn)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if pending != nil {
+		return fn(pending)
+	}
+	return nil
+}
+
+// readJSONFile reads the records of a single json-file log from r. pending
+// holds a line whose end is still to come, perhaps in the next file.
+func readJSONFile(ctx context.Context, r *bufio.Reader, path string, warn io.Writer, pending **Message, fn func(*Message) error) error {
+	var line []byte
+	for n := 1; ; n++ {
+		var err error
+		line, err = readLine(r, line[:0])
+		if len(line) > 0 {
+			var rec jsonFileRecord
+			if jerr := json.Unmarshal(line, &rec); jerr != nil {
+				fmt.Fprintf(warn, "skipping line %d of %s: %v\n", n, path, jerr)
+			} else {
+				msg := *pending
+				if msg == nil || msg.Source != rec.Stream {
+					if msg != nil {
+						if ferr := fn(msg); ferr != nil {
+							return ferr
+						}
+					}
+					msg = &Message{Source: rec.Stream, Timestamp: rec.Time}
+				}
+				text, complete := strings.CutSuffix(rec.Log, "\n")
+				msg.Line = append(msg.Line, text...)
+				*pending = msg
+				if complete {
+					*pending = nil
+					if ferr := fn(msg); ferr != nil {
+						return ferr
+					}
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		if n%1000 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package s3log
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	breakerThresholdKey = "breaker-threshold"
+	breakerCooldownKey  = "breaker-cooldown"
+
+	defaultBreakerThreshold = 10
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// errBreakerOpen is returned instead of attempting an upload while the
+// bucket's circuit breaker is open.
+var errBreakerOpen = errors.New("circuit breaker open, not attempting upload")
+
+// breakerState is the state of a circuit breaker, as exported by the
+// circuit_breaker_state metric.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+var breakerStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: driverName,
+	Name:      "circuit_breaker_state",
+	Help:      "State of the bucket's circuit breaker: 0 closed, 1 open, 2 half-open.",
+}, []string{"bucket"})
+
+func init() {
+	metricsRegistry.MustRegister(breakerStateGauge)
+}
+
+// circuitBreaker stops every container on the host uploading to a bucket
+// that has failed threshold uploads in a row. While open, uploads fail at
+// once with errBreakerOpen so that their batches go to the spool. After
+// cooldown a single probe upload is let through: if it succeeds the breaker
+// closes, otherwise it opens again.
+type circuitBreaker struct {
+	bucket    string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	until    time.Time // when an open breaker lets a probe through
+	opened   time.Time // when the breaker last opened from closed
+}
+
+// breaker returns the circuit breaker shared by uploads to bucket, or nil if
+// the pool has none.
+func (p *uploadPool) breaker(bucket string) *circuitBreaker {
+	if p == nil || p.breakerThreshold <= 0 {
+		return nil
+	}
+	p.breakersMu.Lock()
+	defer p.breakersMu.Unlock()
+	b, ok := p.breakers[bucket]
+	if !ok {
+		b = &circuitBreaker{bucket: bucket, threshold: p.breakerThreshold, cooldown: p.breakerCooldown}
+		p.breakers[bucket] = b
+		breakerStateGauge.WithLabelValues(bucket).Set(float64(breakerClosed))
+	}
+	return b
+}
+
+// allow reports whether an upload may be attempted, returning errBreakerOpen
+// if not. A nil breaker allows every upload.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Now().Before(b.until) {
+			return errBreakerOpen
+		}
+		b.set(breakerHalfOpen)
+		return nil
+	case breakerHalfOpen:
+		// The probe is still in flight.
+		return errBreakerOpen
+	}
+	return nil
+}
+
+// record counts the outcome of an upload that allow let through.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.set(breakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		now := time.Now()
+		if b.state == breakerClosed {
+			b.opened = now
+		}
+		b.until = now.Add(b.cooldown)
+		b.set(breakerOpen)
+	}
+}
+
+// set moves the breaker to state s. Callers must hold b.mu.
+func (b *circuitBreaker) set(s breakerState) {
+	log := logrus.WithField("bucket", b.bucket).WithField("from", b.state).WithField("to", s)
+	switch s {
+	case breakerOpen:
+		log.WithField("failures", b.failures).Warnf("circuit breaker opened, pausing uploads for %s", b.cooldown)
+	case breakerHalfOpen:
+		log.Info("circuit breaker half-open, probing bucket")
+	default:
+		log.Info("circuit breaker closed, resuming uploads")
+	}
+	b.state = s
+	breakerStateGauge.WithLabelValues(b.bucket).Set(float64(s))
+}
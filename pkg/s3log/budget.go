@@ -0,0 +1,211 @@
+package s3log
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	maxTotalBufferKey = "max-total-buffer-bytes"
+
+	defaultMaxTotalBuffer = 256 << 20
+)
+
+var (
+	totalBufferedBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: driverName,
+		Name:      "total_buffered_bytes",
+		Help:      "Bytes buffered across all containers, counted against max-total-buffer-bytes.",
+	})
+	budgetDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "budget_dropped_lines_total",
+		Help:      "Buffered lines dropped because max-total-buffer-bytes was exceeded.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(totalBufferedBytes, budgetDropped)
+}
+
+// memoryBudget caps the bytes buffered across every container on the host,
+// counting lines waiting to be flushed along with the parts of partial lines
+// and the multiline records still being assembled. Once the cap is exceeded
+// loggers with a spool write their next batches straight to it, and the
+// oldest batches of those without one are dropped until the host is back
+// under the cap. Loggers shed on their own way out of Log as well as in the
+// background, so that a burst can't outrun the reclaimer.
+type memoryBudget struct {
+	limit int64
+	used  atomic.Int64
+	kick  chan struct{}
+
+	shedMu  sync.Mutex // one enforce at a time, so batches aren't shed twice over
+	mu      sync.Mutex
+	loggers map[*S3Logger]struct{}
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	b := &memoryBudget{
+		limit:   limit,
+		kick:    make(chan struct{}, 1),
+		loggers: make(map[*S3Logger]struct{}),
+	}
+	go b.reclaim()
+	return b
+}
+
+func (b *memoryBudget) register(l *S3Logger) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.loggers[l] = struct{}{}
+}
+
+func (b *memoryBudget) unregister(l *S3Logger) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.loggers, l)
+}
+
+// add charges n bytes, which may be negative, to the budget, waking the
+// reclaimer if that takes it over the cap.
+func (b *memoryBudget) add(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	used := b.used.Add(n)
+	totalBufferedBytes.Set(float64(used))
+	if used > b.limit {
+		select {
+		case b.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// over reports whether the budget is exceeded.
+func (b *memoryBudget) over() bool {
+	return b != nil && b.used.Load() > b.limit
+}
+
+// reclaim enforces the budget each time it is exceeded.
+func (b *memoryBudget) reclaim() {
+	for range b.kick {
+		b.enforce()
+	}
+}
+
+// enforce drops the oldest batch buffered by a logger without a spool until
+// the budget is no longer exceeded or there is nothing left to drop. Callers
+// must not hold the mutex of any logger.
+func (b *memoryBudget) enforce() {
+	if !b.over() {
+		return
+	}
+	b.shedMu.Lock()
+	defer b.shedMu.Unlock()
+	for b.over() {
+		l := b.oldest()
+		if l == nil || !l.shed() {
+			break
+		}
+	}
+}
+
+// oldest returns the logger without a spool whose oldest buffered line was
+// logged the longest time ago, or nil if none has anything buffered.
+func (b *memoryBudget) oldest() *S3Logger {
+	b.mu.Lock()
+	loggers := make([]*S3Logger, 0, len(b.loggers))
+	for l := range b.loggers {
+		if l.spool == nil {
+			loggers = append(loggers, l)
+		}
+	}
+	b.mu.Unlock()
+
+	var oldest *S3Logger
+	var oldestTime time.Time
+	for _, l := range loggers {
+		l.mu.Lock()
+		t, ok := l.oldestBuffered()
+		l.mu.Unlock()
+		if ok && (oldest == nil || t.Before(oldestTime)) {
+			oldest, oldestTime = l, t
+		}
+	}
+	return oldest
+}
+
+// oldestBuffered returns when the logger's oldest buffered line was logged.
+// Callers must hold l.mu.
+func (l *S3Logger) oldestBuffered() (time.Time, bool) {
+	if len(l.sealed) > 0 {
+		return l.sealed[0].time, true
+	}
+	if l.buf.Len() > 0 {
+		return l.bufTime, true
+	}
+	return time.Time{}, false
+}
+
+// shed drops the logger's oldest buffered batch to bring the host back under
+// max-total-buffer-bytes, reporting whether there was one.
+func (l *S3Logger) shed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var data []byte
+	var first int64
+	switch {
+	case len(l.sealed) > 0:
+		data, first = l.sealed[0].data, l.sealed[0].firstSeq
+		defer releaseBatches(l.sealed[:1])
+		l.sealed = l.sealed[1:]
+	case l.buf.Len() > 0:
+		data, first = l.buf.Bytes(), l.bufSeq
+		l.buf.Reset()
+	default:
+		return false
+	}
+	n := bytes.Count(data, []byte{'\n'})
+	l.dropped.Add(int64(n))
+	l.metrics.dropped.Add(float64(n))
+	budgetDropped.Add(float64(n))
+	l.noteGap(gapBudget, int64(n), first-1, first+int64(n))
+	l.log().WithField("lines", n).Warnf("%s exceeded, dropped %d buffered bytes", maxTotalBufferKey, len(data))
+	l.metrics.buffered.Set(float64(l.bufferedLen()))
+	l.charge()
+	l.space.Broadcast()
+	return true
+}
+
+// charge brings what the logger has charged to the host's budget up to date
+// with what it holds in memory, waking the flusher to divert its buffer to
+// the spool if that takes the host over the cap. Callers must hold l.mu.
+func (l *S3Logger) charge() {
+	if l.budget == nil {
+		return
+	}
+	n := int64(l.bufferedLen())
+	for _, p := range l.partials {
+		n += int64(len(p.line))
+	}
+	for _, g := range l.groups {
+		n += int64(len(g.line))
+	}
+	l.budget.add(n - l.charged)
+	l.charged = n
+	if l.spool != nil && l.budget.over() && n > 0 {
+		l.wake()
+	}
+}
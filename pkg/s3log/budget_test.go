@@ -0,0 +1,160 @@
+package s3log
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	const (
+		containers = 20
+		lines      = 200
+		limit      = 64 << 10
+	)
+	fake := newFakeS3()
+	release := stallPuts(fake, "")
+	defer release()
+	opts, err := parseLogOpts(DefaultOptions(), testLogOpts(t, map[string]string{
+		maxBufferSizeKey: "1048576",
+		flushBytesKey:    "1048576",
+		flushIntervalKey: "1h",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	budget := newMemoryBudget(limit)
+	d := newDriver(newTestClients(fake), newUploadPool(4, defaultBreakerThreshold, defaultBreakerCooldown, 0), budget, opts)
+	t.Cleanup(d.cancel)
+
+	var loggers []*S3Logger
+	for i := range containers {
+		id := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprint(t.Name(), i))))
+		l, err := newLogger(d.clients, d.pool, budget, opts, Info{ContainerID: id, ContainerName: fmt.Sprintf("/c%d", i)}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loggers = append(loggers, s3Loggers(l)...)
+	}
+
+	// Each container buffers well within its own max-buffer-size, but all
+	// of them together far exceed the host's cap.
+	stop := make(chan struct{})
+	peak := make(chan int64)
+	go func() {
+		var max int64
+		for {
+			select {
+			case <-stop:
+				peak <- max
+				return
+			default:
+			}
+			if used := budget.used.Load(); used > max {
+				max = used
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	line := strings.Repeat("x", 1024)
+	var wg sync.WaitGroup
+	for _, l := range loggers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range lines {
+				if err := l.Log(&Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "the host to be back under its budget", func() bool { return !budget.over() })
+	close(stop)
+	// Lines are charged as they are logged and shed behind them, so each
+	// container may be a line or two ahead of the reclaimer.
+	if max := <-peak; max > limit+containers*4*int64(len(line)) {
+		t.Errorf("buffered up to %d bytes across containers, want about %d", max, limit)
+	}
+	var dropped int64
+	for _, l := range loggers {
+		dropped += l.dropped.Load()
+	}
+	if dropped == 0 {
+		t.Error("no lines dropped over the budget")
+	}
+
+	release()
+	for _, l := range loggers {
+		l.Close()
+	}
+	if used := budget.used.Load(); used != 0 {
+		t.Errorf("%d bytes still charged with every container stopped", used)
+	}
+}
+
+func TestMemoryBudgetCharges(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		msgs []*Message
+		want int64
+	}{
+		{
+			name: "buffered lines",
+			msgs: []*Message{{Line: []byte("one"), Source: "stdout"}, {Line: []byte("two"), Source: "stdout"}},
+		},
+		{
+			name: "partial parts",
+			msgs: []*Message{
+				part("a", 1, false, "stdout", "12345"),
+				part("a", 2, false, "stdout", "67890"),
+				part("b", 1, false, "stderr", "abc"),
+			},
+			want: 13,
+		},
+		{
+			name: "multiline records",
+			cfg:  map[string]string{multilinePatternKey: `^\S`},
+			msgs: []*Message{
+				{Line: []byte("panic: boom"), Source: "stdout"},
+				{Line: []byte("\tgoroutine 1"), Source: "stdout"},
+			},
+			want: int64(len("panic: boom\n\tgoroutine 1")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			if tt.cfg == nil {
+				tt.cfg = map[string]string{}
+			}
+			tt.cfg[flushIntervalKey] = "1h"
+			l := newTestLogger(t, fake, tt.cfg)
+			for _, msg := range tt.msgs {
+				msg.Timestamp = time.Now()
+				if err := l.Log(msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			l.mu.Lock()
+			charged, buffered := l.charged, int64(l.bufferedLen())
+			l.mu.Unlock()
+			if want := buffered + tt.want; charged != want {
+				t.Errorf("charged %d bytes, want %d buffered and %d staged", charged, buffered, tt.want)
+			}
+			used := l.budget.used.Load()
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := l.budget.used.Load(); got != used-charged {
+				t.Errorf("%d bytes charged after stopping, want %d", got, used-charged)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package s3log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	cacheDisabledKey = "cache-disabled"
+	cacheMaxSizeKey  = "cache-max-size"
+	cacheDirKey      = "cache-dir"
+
+	defaultCacheMaxSize = 20 << 20
+
+	// cacheFiles is how many files a cache is rotated across. Once they are
+	// all full the oldest is removed, so a cache holds between three
+	// quarters of cache-max-size and all of it.
+	cacheFiles = 4
+
+	cacheFileName = "container.log"
+)
+
+// CacheStore writes a cache's lines to rotated files and reads them back.
+// The plugin's is the Docker daemon's local driver, which the package leaves
+// to it so as not to depend on the daemon.
+type CacheStore interface {
+	// Log writes msg, which the caller may reuse once it returns, as a
+	// line.
+	Log(msg *Message) error
+	ReadLogs(ReadConfig) *LogWatcher
+	Close() error
+}
+
+// OpenCacheStore opens the CacheStore writing to path, rotated across files
+// files of up to maxSize bytes each.
+type OpenCacheStore func(path string, maxSize int64, files int) (CacheStore, error)
+
+// logCache keeps the most recent lines of a running container in files on
+// the host, written and rotated by a CacheStore, so that docker logs is read
+// from disk instead of S3. It holds the lines as they are uploaded, after
+// filtering, sampling and redaction, and is removed once the container
+// stops, after which docker logs reads S3 again.
+type logCache struct {
+	l        CacheStore
+	dir      string
+	location string // s3:// URL of the container's objects, for the note
+	id       string
+	failed   atomic.Bool
+}
+
+// newLogCache opens the cache of the container in a directory of its own
+// under cache-dir, keeping lines from a previous run of the plugin.
+func newLogCache(open OpenCacheStore, opts LogOption, info Info) (*logCache, error) {
+	if open == nil {
+		return nil, fmt.Errorf("%s=false needs a cache store, which only the plugin has", cacheDisabledKey)
+	}
+	dir := filepath.Join(opts.CacheDir, info.ContainerID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating %s %q: %v", cacheDirKey, dir, err)
+	}
+	l, err := open(filepath.Join(dir, cacheFileName), max(opts.CacheMaxSize/cacheFiles, 1), cacheFiles)
+	if err != nil {
+		return nil, fmt.Errorf("error opening log cache in %q: %v", dir, err)
+	}
+	return &logCache{
+		l:        l,
+		dir:      dir,
+		location: "s3://" + opts.S3Bucket + "/" + opts.S3Prefix,
+		id:       info.ContainerID,
+	}, nil
+}
+
+// log writes a line to the cache. A nil cache ignores it.
+func (c *logCache) log(msg *Message) {
+	if c == nil {
+		return
+	}
+	if err := c.l.Log(msg); err != nil && !c.failed.Swap(true) {
+		logrus.WithField("id", c.id).WithError(err).Warn("error writing to log cache, docker logs may miss lines")
+	}
+}
+
+// truncated reports whether the cache has filled every one of its files, so
+// that its oldest lines may have been rotated away and only be in S3.
+func (c *logCache) truncated() bool {
+	_, err := os.Stat(filepath.Join(c.dir, cacheFileName+"."+strconv.Itoa(cacheFiles-1)))
+	return err == nil
+}
+
+// ReadLogs streams back the container's lines from the cache. Reading the
+// whole history of a container whose cache may have been truncated starts
+// with a note saying where the older lines are.
+func (c *logCache) ReadLogs(config ReadConfig) *LogWatcher {
+	src := c.l.ReadLogs(config)
+	if config.Tail >= 0 || !config.Since.IsZero() || !c.truncated() {
+		return src
+	}
+	watcher := NewLogWatcher()
+	go func() {
+		defer close(watcher.Msg)
+		defer src.ConsumerGone()
+		noted := false
+		for {
+			select {
+			case msg, ok := <-src.Msg:
+				if !ok {
+					return
+				}
+				if !noted {
+					noted = true
+					note := &Message{
+						Line:      []byte(fmt.Sprintf("[%s] older lines may only be in %s\n", driverName, c.location)),
+						Source:    "stderr",
+						Timestamp: msg.Timestamp,
+					}
+					select {
+					case watcher.Msg <- note:
+					case <-watcher.WatchConsumerGone():
+						return
+					}
+				}
+				select {
+				case watcher.Msg <- msg:
+				case <-watcher.WatchConsumerGone():
+					return
+				}
+			case err := <-src.Err:
+				watcher.Err <- err
+				return
+			case <-watcher.WatchConsumerGone():
+				return
+			}
+		}
+	}()
+	return watcher
+}
+
+// close closes the cache's files, leaving them for the next run of the
+// plugin. A nil cache is ignored.
+func (c *logCache) close() {
+	if c == nil {
+		return
+	}
+	if err := c.l.Close(); err != nil {
+		logrus.WithField("id", c.id).WithError(err).Warn("error closing log cache")
+	}
+}
+
+// remove closes the cache and deletes its files, once the container has
+// stopped. A nil cache is ignored.
+func (c *logCache) remove() {
+	if c == nil {
+		return
+	}
+	c.close()
+	if err := os.RemoveAll(c.dir); err != nil {
+		logrus.WithField("id", c.id).WithError(err).Warn("error removing log cache")
+	}
+}
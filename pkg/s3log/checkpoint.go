@@ -0,0 +1,127 @@
+package s3log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+)
+
+const (
+	checkpointName = "checkpoint.json"
+
+	// dedupeHintKey is the metadata on each object holding the sequence
+	// numbers of its first and last lines. An object uploaded again after a
+	// crash, as a journal replay may do, carries the same range as the first
+	// copy, so consumers can drop it without reading either.
+	dedupeHintKey = "dedupe-hint"
+)
+
+// journalCheckpoint is the last journal record whose line has been uploaded
+// or spooled, kept in the journal's directory so that a replay after a crash
+// skips records uploaded before it even if their segments were never
+// deleted. Records are located by their segment and how many records of it
+// come before and including them, since indexes only number the records of a
+// single run. LineSequence is the sequence number of the last line uploaded,
+// from which the replayed lines are numbered again, so that a batch uploaded
+// in the window between its upload and the checkpoint is numbered the same
+// when it is uploaded a second time.
+type journalCheckpoint struct {
+	Segment      int64 `json:"segment"`
+	Records      int64 `json:"records"`
+	LineSequence int64 `json:"line_sequence"`
+}
+
+// loadCheckpoint reads the checkpoint in dir. A missing one isn't an error;
+// the zero checkpoint is returned along with false.
+func loadCheckpoint(dir string) (journalCheckpoint, bool, error) {
+	var cp journalCheckpoint
+	path := filepath.Join(dir, checkpointName)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cp, false, nil
+	}
+	if err != nil {
+		return cp, false, err
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, false, fmt.Errorf("invalid journal checkpoint %q: %v", path, err)
+	}
+	return cp, true, nil
+}
+
+// saveCheckpoint writes cp to dir, replacing the file atomically so a crash
+// never leaves it half written, and syncing it before the segments it
+// releases are deleted.
+func saveCheckpoint(dir string, cp journalCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, checkpointName)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// position returns the segment holding record i and how many of its records
+// come before and including it. Callers must hold j.mu.
+func (j *journal) position(i int64) (int64, int64, bool) {
+	for _, s := range j.segs {
+		if s.first <= i && i <= s.last {
+			return s.num, i - s.first + 1, true
+		}
+	}
+	if j.f != nil && j.fFirst <= i && i < j.next {
+		return j.segNum, i - j.fFirst + 1, true
+	}
+	return 0, 0, false
+}
+
+// checkpoint records that every record up to i has been uploaded, along
+// with lineSeq, the sequence number of the last line they held. Callers
+// must hold j.mu.
+func (j *journal) checkpoint(i, lineSeq int64) {
+	seg, n, ok := j.position(i)
+	if !ok {
+		return
+	}
+	cp := journalCheckpoint{Segment: seg, Records: n, LineSequence: lineSeq}
+	if cp == j.cp {
+		return
+	}
+	if err := saveCheckpoint(j.dir, cp); err != nil {
+		j.log.WithError(err).Warn("error saving journal checkpoint, a crash may upload lines twice")
+		return
+	}
+	j.cp = cp
+}
+
+// withDedupeHint returns metadata with the dedupe-hint of an object whose
+// lines are numbered first to last. metadata itself is shared by every
+// object and left alone.
+func withDedupeHint(metadata map[string]string, first, last int64) map[string]string {
+	m := make(map[string]string, len(metadata)+1)
+	maps.Copy(m, metadata)
+	m[dedupeHintKey] = fmt.Sprintf(lineSequenceFormat+"-"+lineSequenceFormat, first, last)
+	return m
+}
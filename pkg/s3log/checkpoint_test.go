@@ -0,0 +1,218 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// snapshotDir returns a function that puts the files of dir that match
+// accepts back as they were when snapshotDir was called, removing those made
+// since, as a crash would leave them had it come before they were changed.
+func snapshotDir(t *testing.T, dir string, match func(name string) bool) (restore func()) {
+	t.Helper()
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !match(d.Name()) {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		files[path] = data
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		t.Helper()
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !match(d.Name()) {
+				return err
+			}
+			if _, ok := files[path]; !ok {
+				return os.Remove(path)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for path, data := range files {
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// uploadedRange is an object's dedupe-hint, with the sequence numbers and
+// lines of its records.
+type uploadedRange struct {
+	hint  string
+	seqs  []int64
+	lines []string
+}
+
+func uploadedRanges(t *testing.T, fake *fakeS3) []uploadedRange {
+	t.Helper()
+	var ranges []uploadedRange
+	for _, key := range fake.logKeys(testBucket) {
+		o, _ := fake.object(testBucket, key)
+		r := uploadedRange{hint: o.metadata[dedupeHintKey]}
+		for _, line := range strings.Split(strings.TrimSpace(string(o.data)), "\n") {
+			var rec record
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatal(err)
+			}
+			r.seqs = append(r.seqs, rec.Seq)
+			r.lines = append(r.lines, strings.TrimSuffix(rec.Log, "\n"))
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+func TestCheckpointCrashWindow(t *testing.T) {
+	all := func(string) bool { return true }
+	segments := func(name string) bool { return strings.HasSuffix(name, walSegmentSuffix) }
+	tests := []struct {
+		name string
+		// uploaded is logged and flushed before the crash, pending logged
+		// and flushed in its window.
+		uploaded, pending []string
+		// restored are the files put back as they were before the last
+		// flush.
+		restored func(string) bool
+		// twice are the lines uploaded a second time after the restart.
+		twice []string
+	}{
+		{
+			// The segments outlived the checkpoint: nothing is uploaded
+			// twice.
+			name:     "after the checkpoint",
+			pending:  []string{"one", "two", "three"},
+			restored: segments,
+		},
+		{
+			// Neither the checkpoint nor the state were saved: the batch is
+			// uploaded again, numbered as before.
+			name:     "before the checkpoint",
+			pending:  []string{"one", "two", "three"},
+			restored: all,
+			twice:    []string{"one", "two", "three"},
+		},
+		{
+			name:     "before the second checkpoint",
+			uploaded: []string{"one", "two"},
+			pending:  []string{"three", "four"},
+			restored: all,
+			twice:    []string{"three", "four"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			walDir, stateDir := t.TempDir(), t.TempDir()
+			cfg := map[string]string{
+				walKey:             "true",
+				walDirKey:          walDir,
+				walSyncIntervalKey: "0",
+				stateDirKey:        stateDir,
+				flushIntervalKey:   "1h",
+			}
+			before := newTestLogger(t, fake, cfg)
+			if len(tt.uploaded) > 0 {
+				logLines(t, before, time.Now(), tt.uploaded...)
+				if err := before.flush(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			logLines(t, before, time.Now(), tt.pending...)
+			restoreWAL := snapshotDir(t, walDir, tt.restored)
+			restoreState := snapshotDir(t, stateDir, tt.restored)
+			if err := before.flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			before.abandon()
+			restoreWAL()
+			restoreState()
+
+			after := newTestLogger(t, fake, cfg)
+			if err := after.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			seen := make(map[string]uploadedRange)
+			var lines, again []string
+			for _, r := range uploadedRanges(t, fake) {
+				if r.hint != fmt.Sprintf(lineSequenceFormat+"-"+lineSequenceFormat, r.seqs[0], r.seqs[len(r.seqs)-1]) {
+					t.Errorf("object of lines %v has dedupe-hint %q", r.seqs, r.hint)
+				}
+				first, ok := seen[r.hint]
+				if !ok {
+					seen[r.hint] = r
+					lines = append(lines, r.lines...)
+					continue
+				}
+				// A copy must be of the same lines, numbered the same, for
+				// its hint to tell consumers to drop it.
+				if !slices.Equal(r.seqs, first.seqs) || !slices.Equal(r.lines, first.lines) {
+					t.Errorf("copy of %s holds %q numbered %v, first uploaded as %q numbered %v", r.hint, r.lines, r.seqs, first.lines, first.seqs)
+				}
+				again = append(again, r.lines...)
+			}
+			var seqs []int64
+			for _, r := range seen {
+				for _, s := range r.seqs {
+					if slices.Contains(seqs, s) {
+						t.Errorf("line %d uploaded under two dedupe-hints", s)
+					}
+					seqs = append(seqs, s)
+				}
+			}
+			want := append(slices.Clone(tt.uploaded), tt.pending...)
+			slices.Sort(lines)
+			slices.Sort(want)
+			if !slices.Equal(lines, want) {
+				t.Errorf("uploaded %q, want %q", lines, want)
+			}
+			if !slices.Equal(again, tt.twice) {
+				t.Errorf("uploaded %q twice, want %q", again, tt.twice)
+			}
+		})
+	}
+}
+
+func TestCheckpointSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	if _, ok, err := loadCheckpoint(dir); ok || err != nil {
+		t.Fatalf("loaded a checkpoint from an empty directory: %v", err)
+	}
+	want := journalCheckpoint{Segment: 3, Records: 17, LineSequence: 42}
+	if err := saveCheckpoint(dir, want); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := loadCheckpoint(dir)
+	if err != nil || !ok || got != want {
+		t.Errorf("loaded %+v, %v, %v, want %+v", got, ok, err, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, checkpointName+".tmp")); err == nil {
+		t.Error("temporary checkpoint left behind")
+	}
+	if err := os.WriteFile(filepath.Join(dir, checkpointName), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadCheckpoint(dir); err == nil {
+		t.Error("loaded a corrupt checkpoint")
+	}
+}
@@ -0,0 +1,21 @@
+package s3log
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+const disableChecksumsKey = "disable-checksums"
+
+// setChecksum has S3 verify b's body against a SHA-256 checksum so that a
+// payload corrupted in transit is rejected rather than stored. A body that is
+// uploaded in a single PUT carries the checksum computed here; the parts of a
+// multipart upload are each checksummed by the SDK as they are sent, since S3
+// only accepts a checksum of the part checksums for the whole object.
+func setChecksum(b *batch, partSize int64) {
+	b.ChecksumAlgorithm = "SHA256"
+	if int64(len(b.body)) < partSize {
+		sum := sha256.Sum256(b.body)
+		b.ChecksumSHA256 = base64.StdEncoding.EncodeToString(sum[:])
+	}
+}
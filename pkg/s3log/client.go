@@ -0,0 +1,385 @@
+package s3log
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	s3RegionKey       = "s3-region"
+	endpointURLKey    = "endpoint-url"
+	forcePathStyleKey = "force-path-style"
+	disableSSLKey     = "disable-ssl"
+	accelerateKey     = "use-accelerate-endpoint"
+	dualstackKey      = "use-dualstack-endpoint"
+	fipsKey           = "use-fips-endpoint"
+	assumeRoleARNKey  = "assume-role-arn"
+	externalIDKey     = "external-id"
+	roleSessionKey    = "role-session-name"
+	accessKeyIDKey    = "aws-access-key-id"
+	secretKeyKey      = "aws-secret-access-key"
+	sessionTokenKey   = "aws-session-token"
+	profileKey        = "aws-profile"
+
+	defaultRoleSessionName = driverName
+)
+
+// s3API is the part of the S3 API the logger uses. *s3.Client satisfies it;
+// anything else, such as a fake that records calls, can stand in for it.
+type s3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	SelectObjectContent(ctx context.Context, params *s3.SelectObjectContentInput, optFns ...func(*s3.Options)) (*s3.SelectObjectContentOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	ListParts(ctx context.Context, params *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error)
+	ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error)
+}
+
+// objectUploader uploads a single object, splitting it into parts as needed.
+// *manager.Uploader satisfies it.
+type objectUploader interface {
+	Upload(ctx context.Context, input *s3.PutObjectInput, opts ...func(*manager.Uploader)) (*manager.UploadOutput, error)
+}
+
+var (
+	_ s3API          = (*s3.Client)(nil)
+	_ objectUploader = (*manager.Uploader)(nil)
+)
+
+// clientConfig is the part of a container's options that determines which S3
+// client its batches are uploaded with. It is stored with spooled batches so
+// they are drained against the same endpoint.
+type clientConfig struct {
+	Region         string           `json:"region,omitempty"`
+	Endpoint       string           `json:"endpoint,omitempty"`
+	ForcePathStyle bool             `json:"force_path_style,omitempty"`
+	DisableSSL     bool             `json:"disable_ssl,omitempty"`
+	Accelerate     bool             `json:"accelerate,omitempty"`
+	Dualstack      bool             `json:"dualstack,omitempty"`
+	FIPS           bool             `json:"fips,omitempty"`
+	HTTP           httpConfig       `json:"http,omitempty"`
+	Role           roleConfig       `json:"role,omitempty"`
+	Credentials    credentialConfig `json:"credentials,omitempty"`
+	Presign        presignConfig    `json:"presign,omitempty"`
+}
+
+// credentialConfig names the credentials used instead of the plugin's
+// default chain. Explicit keys take precedence over a credentials file, and
+// that over the profile, which then names its section. The secret
+// parts are never written to disk: a spooled batch only records the access
+// key ID, and is uploaded with whatever secret a running container last
+// provided for it.
+type credentialConfig struct {
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"-"`
+	SessionToken    string `json:"-"`
+	Profile         string `json:"profile,omitempty"`
+	File            string `json:"file,omitempty"`
+}
+
+// roleConfig names a role to assume before talking to S3.
+type roleConfig struct {
+	ARN         string `json:"arn,omitempty"`
+	ExternalID  string `json:"external_id,omitempty"`
+	SessionName string `json:"session_name,omitempty"`
+}
+
+func (o LogOption) clientConfig() clientConfig {
+	cfg := clientConfig{
+		Region:         o.S3Region,
+		Endpoint:       o.EndpointURL,
+		ForcePathStyle: o.ForcePathStyle,
+		DisableSSL:     o.DisableSSL,
+		Accelerate:     o.Accelerate,
+		Dualstack:      o.Dualstack,
+		FIPS:           o.FIPS && o.EndpointURL == "",
+		HTTP: httpConfig{
+			CACertFile:         o.CACertFile,
+			InsecureSkipVerify: o.InsecureSkipVerify,
+			ProxyURL:           o.ProxyURL,
+			Proxy:              redactURL(o.ProxyURL),
+			NoProxy:            o.NoProxy,
+		},
+		Role: roleConfig{
+			ARN:         o.AssumeRoleARN,
+			ExternalID:  o.ExternalID,
+			SessionName: o.RoleSessionName,
+		},
+		Credentials: credentialConfig{
+			AccessKeyID:     o.AccessKeyID,
+			SecretAccessKey: o.SecretAccessKey,
+			SessionToken:    o.SessionToken,
+			Profile:         o.Profile,
+			File:            o.CredentialsFile,
+		},
+	}
+	if o.UploadMode == uploadModePresigned {
+		cfg.Presign = presignConfig{Endpoint: o.PresignEndpoint, TokenFile: o.PresignTokenFile}
+	}
+	return cfg
+}
+
+// clientFactory builds S3 clients on top of the plugin's AWS config so that
+// containers can target different regions and endpoints. Clients and bucket
+// regions are cached so that starting a container doesn't load credentials
+// or look up its bucket every time.
+type clientFactory struct {
+	cfg           aws.Config
+	idleConns     int
+	allowInsecure bool
+
+	// newClient builds an S3 client from the plugin's config and the options
+	// a clientConfig resolves to. It is s3.NewFromConfig outside of tests.
+	newClient func(cfg aws.Config, optFns ...func(*s3.Options)) s3API
+	// newSTS builds the client roles are assumed with. It is
+	// sts.NewFromConfig outside of tests.
+	newSTS func(cfg aws.Config) stscreds.AssumeRoleAPIClient
+
+	mu      sync.Mutex
+	clients map[clientConfig]s3API
+	regions map[string]string
+	creds   map[credentialKey]aws.CredentialsProvider
+	secrets map[string]credentialConfig
+	valid   map[validationKey]bool
+
+	httpClients map[httpConfig]aws.HTTPClient
+	proxies     map[string]string
+
+	snsClients map[clientConfig]*sns.Client
+	sqsClients map[clientConfig]*sqs.Client
+}
+
+func newS3Client(cfg aws.Config, optFns ...func(*s3.Options)) s3API {
+	return s3.NewFromConfig(cfg, optFns...)
+}
+
+func newSTSClient(cfg aws.Config) stscreds.AssumeRoleAPIClient {
+	return sts.NewFromConfig(cfg)
+}
+
+type credentialKey struct {
+	role  roleConfig
+	creds credentialConfig
+}
+
+// newClientFactory returns a factory building clients on top of cfg.
+// idleConns is how many idle connections to keep per host, and allowInsecure
+// lets containers skip certificate verification.
+func newClientFactory(cfg aws.Config, idleConns int, allowInsecure bool) *clientFactory {
+	return &clientFactory{
+		cfg:           cfg,
+		idleConns:     idleConns,
+		allowInsecure: allowInsecure,
+		newClient:     newS3Client,
+		newSTS:        newSTSClient,
+
+		clients: make(map[clientConfig]s3API),
+		regions: make(map[string]string),
+		creds:   make(map[credentialKey]aws.CredentialsProvider),
+		secrets: make(map[string]credentialConfig),
+		valid:   make(map[validationKey]bool),
+
+		httpClients: make(map[httpConfig]aws.HTTPClient),
+		proxies:     make(map[string]string),
+
+		snsClients: make(map[clientConfig]*sns.Client),
+		sqsClients: make(map[clientConfig]*sqs.Client),
+	}
+}
+
+// resolve fills in the region of bucket when cfg doesn't name one, and checks
+// that a configured region is the one the bucket lives in. Custom endpoints
+// are taken as they are, since S3-compatible stores rarely care about
+// regions. Configured credentials are retrieved right away, so that a role
+// that can't be assumed or a missing profile fails the container start
+// instead of every upload; so does a default chain that yields none.
+// Uploads to presigned URLs need neither credentials nor the region.
+func (f *clientFactory) resolve(ctx context.Context, bucket string, cfg clientConfig) (clientConfig, error) {
+	if _, err := f.httpClient(cfg.HTTP); err != nil {
+		return cfg, err
+	}
+	if cfg.Presign.Endpoint != "" {
+		return cfg, nil
+	}
+	creds, err := f.credentials(ctx, cfg)
+	if err != nil {
+		return cfg, err
+	}
+	if creds != nil {
+		if _, err := creds.Retrieve(ctx); err != nil {
+			if cfg.Role.ARN != "" {
+				return cfg, newOpError(fmt.Sprintf("%s %q", opAssumeRole, cfg.Role.ARN), "", err)
+			}
+			return cfg, newOpError(opLoadCreds, "", fmt.Errorf("configured credentials: %w", err))
+		}
+	} else if f.cfg.Credentials != nil {
+		if _, err := f.cfg.Credentials.Retrieve(ctx); err != nil {
+			return cfg, newOpError(opLoadCreds, "", err)
+		}
+	}
+	if cfg.Endpoint != "" {
+		return cfg, nil
+	}
+	region, err := f.bucketRegion(ctx, bucket, cfg, creds)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.Region != "" && cfg.Region != region {
+		return cfg, fmt.Errorf("bucket %q is in region %q, not the configured %s %q", bucket, region, s3RegionKey, cfg.Region)
+	}
+	cfg.Region = region
+	return cfg, nil
+}
+
+func (f *clientFactory) bucketRegion(ctx context.Context, bucket string, cfg clientConfig, creds aws.CredentialsProvider) (string, error) {
+	f.mu.Lock()
+	region, ok := f.regions[bucket]
+	f.mu.Unlock()
+	if ok {
+		return region, nil
+	}
+
+	httpClient, err := f.httpClient(cfg.HTTP)
+	if err != nil {
+		return "", err
+	}
+	client := f.newClient(f.cfg, func(o *s3.Options) {
+		if cfg.Region != "" {
+			o.Region = cfg.Region
+		}
+		if o.Region == "" {
+			o.Region = "us-east-1"
+		}
+		if creds != nil {
+			o.Credentials = creds
+		}
+		if httpClient != nil {
+			o.HTTPClient = httpClient
+		}
+		if cfg.FIPS {
+			o.EndpointOptions.UseFIPSEndpoint = aws.FIPSEndpointStateEnabled
+		}
+	})
+	region, err = manager.GetBucketRegion(ctx, client, bucket)
+	if err != nil {
+		return "", newOpError(opBucketRegion, bucket, err)
+	}
+
+	f.mu.Lock()
+	f.regions[bucket] = region
+	f.mu.Unlock()
+	return region, nil
+}
+
+// credentials returns the credentials configured by cfg, or nil if the
+// plugin's default chain should be used. Assumed roles refresh themselves by
+// assuming the role again before the credentials expire.
+func (f *clientFactory) credentials(ctx context.Context, cfg clientConfig) (aws.CredentialsProvider, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	static := cfg.Credentials
+	if static.AccessKeyID != "" {
+		if static.SecretAccessKey != "" {
+			f.secrets[static.AccessKeyID] = static
+		} else if known, ok := f.secrets[static.AccessKeyID]; ok {
+			static = known
+		}
+	}
+	key := credentialKey{role: cfg.Role, creds: static}
+	if creds, ok := f.creds[key]; ok {
+		return creds, nil
+	}
+
+	base := f.cfg.Copy()
+	switch {
+	case static.AccessKeyID != "" && static.SecretAccessKey != "":
+		base.Credentials = credentials.NewStaticCredentialsProvider(static.AccessKeyID, static.SecretAccessKey, static.SessionToken)
+	case static.File != "":
+		base.Credentials = newFileCredentials(static.File, static.Profile)
+	case static.Profile != "":
+		profileCfg, err := config.LoadDefaultConfig(ctx, config.WithSharedConfigProfile(static.Profile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s %q: %v", profileKey, static.Profile, err)
+		}
+		base.Credentials = profileCfg.Credentials
+	case cfg.Role.ARN == "":
+		return nil, nil
+	}
+
+	creds := base.Credentials
+	if cfg.Role.ARN != "" {
+		role := cfg.Role
+		creds = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(f.newSTS(base), role.ARN, func(o *stscreds.AssumeRoleOptions) {
+			if role.ExternalID != "" {
+				o.ExternalID = aws.String(role.ExternalID)
+			}
+			o.RoleSessionName = role.SessionName
+			if o.RoleSessionName == "" {
+				o.RoleSessionName = defaultRoleSessionName
+			}
+		}))
+	}
+	f.creds[key] = creds
+	return creds, nil
+}
+
+func (f *clientFactory) client(cfg clientConfig) (s3API, error) {
+	creds, err := f.credentials(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := f.httpClient(cfg.HTTP)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.clients[cfg]; ok {
+		return c, nil
+	}
+	client := f.newClient(f.cfg, func(o *s3.Options) {
+		if creds != nil {
+			o.Credentials = creds
+		}
+		if httpClient != nil {
+			o.HTTPClient = httpClient
+		}
+		if cfg.Region != "" {
+			o.Region = cfg.Region
+		}
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		o.UsePathStyle = cfg.ForcePathStyle
+		o.EndpointOptions.DisableHTTPS = cfg.DisableSSL
+		o.UseAccelerate = cfg.Accelerate
+		if cfg.Dualstack {
+			o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateEnabled
+		}
+		if cfg.FIPS {
+			o.EndpointOptions.UseFIPSEndpoint = aws.FIPSEndpointStateEnabled
+		}
+	})
+	f.clients[cfg] = client
+	return client, nil
+}
@@ -0,0 +1,408 @@
+package s3log
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestClientFactoryClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfgs    []clientConfig
+		clients int
+		check   func(t *testing.T, o s3.Options)
+	}{
+		{
+			name:    "plugin region",
+			cfgs:    []clientConfig{{}},
+			clients: 1,
+			check: func(t *testing.T, o s3.Options) {
+				if o.Region != "us-east-1" {
+					t.Errorf("region = %q, want the plugin's us-east-1", o.Region)
+				}
+			},
+		},
+		{
+			name:    "container region",
+			cfgs:    []clientConfig{{Region: "eu-west-1"}},
+			clients: 1,
+			check: func(t *testing.T, o s3.Options) {
+				if o.Region != "eu-west-1" {
+					t.Errorf("region = %q, want eu-west-1", o.Region)
+				}
+			},
+		},
+		{
+			name:    "custom endpoint",
+			cfgs:    []clientConfig{{Endpoint: "http://minio:9000", ForcePathStyle: true, DisableSSL: true}},
+			clients: 1,
+			check: func(t *testing.T, o s3.Options) {
+				if aws.ToString(o.BaseEndpoint) != "http://minio:9000" {
+					t.Errorf("endpoint = %q, want http://minio:9000", aws.ToString(o.BaseEndpoint))
+				}
+				if !o.UsePathStyle || !o.EndpointOptions.DisableHTTPS {
+					t.Errorf("path style %v, HTTPS disabled %v, want both", o.UsePathStyle, o.EndpointOptions.DisableHTTPS)
+				}
+			},
+		},
+		{
+			name:    "dualstack and fips",
+			cfgs:    []clientConfig{{Dualstack: true, FIPS: true}},
+			clients: 1,
+			check: func(t *testing.T, o s3.Options) {
+				if o.EndpointOptions.UseDualStackEndpoint != aws.DualStackEndpointStateEnabled || o.EndpointOptions.UseFIPSEndpoint != aws.FIPSEndpointStateEnabled {
+					t.Errorf("endpoint options = %+v, want dualstack and FIPS", o.EndpointOptions)
+				}
+			},
+		},
+		{
+			name:    "static credentials",
+			cfgs:    []clientConfig{{Credentials: credentialConfig{AccessKeyID: "AKIDCONTAINER", SecretAccessKey: "s"}}},
+			clients: 1,
+			check: func(t *testing.T, o s3.Options) {
+				creds, err := o.Credentials.Retrieve(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if creds.AccessKeyID != "AKIDCONTAINER" {
+					t.Errorf("access key = %q, want the container's", creds.AccessKeyID)
+				}
+			},
+		},
+		{
+			name:    "same config shares a client",
+			cfgs:    []clientConfig{{Region: "eu-west-1"}, {Region: "eu-west-1"}},
+			clients: 1,
+		},
+		{
+			name:    "different configs",
+			cfgs:    []clientConfig{{Region: "eu-west-1"}, {Region: "eu-west-2"}, {Endpoint: "http://minio:9000"}},
+			clients: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestClients(newFakeS3())
+			var built []s3.Options
+			f.newClient = func(cfg aws.Config, optFns ...func(*s3.Options)) s3API {
+				o := s3.Options{Region: cfg.Region, Credentials: cfg.Credentials}
+				for _, fn := range optFns {
+					fn(&o)
+				}
+				built = append(built, o)
+				return newFakeS3()
+			}
+			first := make(map[clientConfig]s3API)
+			for _, cfg := range tt.cfgs {
+				c, err := f.client(cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if prev, ok := first[cfg]; ok && prev != c {
+					t.Errorf("client for %+v built again", cfg)
+				}
+				first[cfg] = c
+			}
+			if len(built) != tt.clients {
+				t.Fatalf("built %d clients, want %d", len(built), tt.clients)
+			}
+			if tt.check != nil {
+				tt.check(t, built[0])
+			}
+		})
+	}
+}
+
+func TestClientFactoryUploader(t *testing.T) {
+	f := newTestClients(newFakeS3())
+	client, err := f.client(clientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := f.uploader(clientConfig{}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := u.(*presignUploader); ok {
+		t.Error("uploader without a presign endpoint uploads to presigned URLs")
+	}
+	cfg := clientConfig{Presign: presignConfig{Endpoint: "http://signer"}}
+	if u, err = f.uploader(cfg, client); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := u.(*presignUploader); !ok {
+		t.Errorf("uploader with a presign endpoint is a %T", u)
+	}
+}
+
+func TestEndpointURL(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		host string
+		path string
+	}{
+		{
+			name: "path style",
+			cfg:  map[string]string{endpointURLKey: "http://minio.test:9000", forcePathStyleKey: "true"},
+			host: "minio.test:9000",
+			path: "/" + testBucket + "/key",
+		},
+		{
+			name: "virtual hosted",
+			cfg:  map[string]string{endpointURLKey: "http://minio.test:9000"},
+			host: testBucket + ".minio.test:9000",
+			path: "/key",
+		},
+		{
+			name: "disable ssl",
+			cfg:  map[string]string{endpointURLKey: "", disableSSLKey: "true"},
+			host: testBucket + ".s3.us-east-1.amazonaws.com",
+			path: "/key",
+		},
+		{
+			name: "accelerate",
+			cfg:  map[string]string{endpointURLKey: "", disableSSLKey: "true", accelerateKey: "true"},
+			host: testBucket + ".s3-accelerate.amazonaws.com",
+			path: "/key",
+		},
+		{
+			name: "dualstack",
+			cfg:  map[string]string{endpointURLKey: "", disableSSLKey: "true", dualstackKey: "true"},
+			host: testBucket + ".s3.dualstack.us-east-1.amazonaws.com",
+			path: "/key",
+		},
+		{
+			name: "accelerate and dualstack",
+			cfg:  map[string]string{endpointURLKey: "", disableSSLKey: "true", accelerateKey: "true", dualstackKey: "true"},
+			host: testBucket + ".s3-accelerate.dualstack.amazonaws.com",
+			path: "/key",
+		},
+		{
+			name: "fips",
+			cfg:  map[string]string{endpointURLKey: "", disableSSLKey: "true", fipsKey: "true"},
+			host: testBucket + ".s3-fips.us-east-1.amazonaws.com",
+			path: "/key",
+		},
+		{
+			name: "fips and dualstack",
+			cfg:  map[string]string{endpointURLKey: "", disableSSLKey: "true", fipsKey: "true", dualstackKey: "true"},
+			host: testBucket + ".s3-fips.dualstack.us-east-1.amazonaws.com",
+			path: "/key",
+		},
+		{
+			name: "govcloud",
+			cfg:  map[string]string{endpointURLKey: "", disableSSLKey: "true", s3RegionKey: "us-gov-east-1"},
+			host: testBucket + ".s3.us-gov-east-1.amazonaws.com",
+			path: "/key",
+		},
+		{
+			name: "govcloud fips",
+			cfg:  map[string]string{endpointURLKey: "", disableSSLKey: "true", s3RegionKey: "us-gov-west-1", fipsKey: "true"},
+			host: testBucket + ".s3-fips.us-gov-west-1.amazonaws.com",
+			path: "/key",
+		},
+		{
+			name: "iso partition",
+			cfg:  map[string]string{endpointURLKey: "", disableSSLKey: "true", s3RegionKey: "us-iso-east-1"},
+			host: testBucket + ".s3.us-iso-east-1.c2s.ic.gov",
+			path: "/key",
+		},
+		{
+			name: "endpoint-url over fips",
+			cfg:  map[string]string{endpointURLKey: "http://minio.test:9000", forcePathStyleKey: "true", fipsKey: "true"},
+			host: "minio.test:9000",
+			path: "/" + testBucket + "/key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var host, path string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				host, path = r.Host, r.URL.Path
+				mu.Unlock()
+			}))
+			defer srv.Close()
+
+			f := newTestClients(nil)
+			f.newClient = newS3Client
+			// Every host resolves to the stub.
+			f.cfg.HTTPClient = &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, srv.Listener.Addr().String())
+				},
+			}}
+			// An empty endpoint-url leaves the one testLogOpts sets out,
+			// for AWS's.
+			cfg := testLogOpts(t, tt.cfg)
+			if cfg[endpointURLKey] == "" {
+				delete(cfg, endpointURLKey)
+			}
+			opts, err := parseLogOpts(DefaultOptions(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := f.client(opts.clientConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.PutObject(context.Background(), &s3.PutObjectInput{Bucket: aws.String(testBucket), Key: aws.String("key"), Body: strings.NewReader("line\n")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if host != tt.host || path != tt.path {
+				t.Errorf("request to %s%s, want %s%s", host, path, tt.host, tt.path)
+			}
+		})
+	}
+}
+
+// fakeSTS is an stscreds.AssumeRoleAPIClient recording the roles assumed
+// with it. Credentials it hands out expire after expiry.
+type fakeSTS struct {
+	mu     sync.Mutex
+	inputs []*sts.AssumeRoleInput
+	err    error
+	expiry time.Duration
+}
+
+func (f *fakeSTS) AssumeRole(_ context.Context, in *sts.AssumeRoleInput, _ ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inputs = append(f.inputs, in)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &sts.AssumeRoleOutput{Credentials: &ststypes.Credentials{
+		AccessKeyId:     aws.String(fmt.Sprintf("AKIDROLE%d", len(f.inputs))),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(f.expiry)),
+	}}, nil
+}
+
+func TestAssumeRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		role    roleConfig
+		err     error
+		wantErr string
+		session string
+	}{
+		{
+			name:    "role and external ID",
+			role:    roleConfig{ARN: "arn:aws:iam::123456789012:role/logs", ExternalID: "ext"},
+			session: defaultRoleSessionName,
+		},
+		{
+			name:    "session name",
+			role:    roleConfig{ARN: "arn:aws:iam::123456789012:role/logs", SessionName: "host-1"},
+			session: "host-1",
+		},
+		{
+			name:    "role can't be assumed",
+			role:    roleConfig{ARN: "arn:aws:iam::123456789012:role/logs"},
+			err:     fakeStatusError(http.StatusForbidden, "AccessDenied"),
+			wantErr: opAssumeRole + ` "arn:aws:iam::123456789012:role/logs"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stsClient := &fakeSTS{err: tt.err, expiry: time.Hour}
+			f := newTestClients(newFakeS3())
+			f.newSTS = func(aws.Config) stscreds.AssumeRoleAPIClient { return stsClient }
+
+			// The role is assumed when the container starts.
+			cfg := clientConfig{Endpoint: "http://s3.test", Role: tt.role}
+			_, err := f.resolve(context.Background(), testBucket, cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolve: %v, want an error naming %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stsClient.inputs) != 1 {
+				t.Fatalf("assumed the role %d times, want once", len(stsClient.inputs))
+			}
+			in := stsClient.inputs[0]
+			if aws.ToString(in.RoleArn) != tt.role.ARN || aws.ToString(in.RoleSessionName) != tt.session {
+				t.Errorf("assumed %q as %q, want %q as %q", aws.ToString(in.RoleArn), aws.ToString(in.RoleSessionName), tt.role.ARN, tt.session)
+			}
+			if tt.role.ExternalID != "" && aws.ToString(in.ExternalId) != tt.role.ExternalID {
+				t.Errorf("external ID = %q, want %q", aws.ToString(in.ExternalId), tt.role.ExternalID)
+			}
+		})
+	}
+}
+
+func TestAssumeRoleRefresh(t *testing.T) {
+	stsClient := &fakeSTS{expiry: time.Millisecond}
+	f := newTestClients(newFakeS3())
+	f.newSTS = func(aws.Config) stscreds.AssumeRoleAPIClient { return stsClient }
+	creds, err := f.credentials(context.Background(), clientConfig{Role: roleConfig{ARN: "arn:aws:iam::123456789012:role/logs"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := creds.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	second, err := creds.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.AccessKeyID == second.AccessKeyID {
+		t.Errorf("expired credentials %s weren't refreshed", first.AccessKeyID)
+	}
+}
+
+func TestAccelerateWithEndpoint(t *testing.T) {
+	_, err := parseLogOpts(DefaultOptions(), map[string]string{s3BucketKey: testBucket, endpointURLKey: "http://minio.test:9000", accelerateKey: "true"})
+	if err == nil || !strings.Contains(err.Error(), accelerateKey) || !strings.Contains(err.Error(), endpointURLKey) {
+		t.Errorf("parseLogOpts: %v, want an error naming %s and %s", err, accelerateKey, endpointURLKey)
+	}
+}
+
+func TestFIPSWithEndpointURLWarns(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	fake := newFakeS3()
+	d := newTestDriver(t, fake, nil)
+	c := startContainer(t, d, map[string]string{fipsKey: "true"})
+	c.stop(t, d)
+	if cfg := c.l.targets[0].cfg; cfg.FIPS {
+		t.Errorf("client for %s resolves FIPS endpoints", cfg.Endpoint)
+	}
+	var warned bool
+	for _, e := range hook.AllEntries() {
+		warned = warned || (e.Level == logrus.WarnLevel && strings.Contains(e.Message, fipsKey))
+	}
+	if !warned {
+		t.Errorf("no warning that %s is ignored with %s", fipsKey, endpointURLKey)
+	}
+}
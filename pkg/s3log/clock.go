@@ -0,0 +1,48 @@
+package s3log
+
+import "time"
+
+// The wall clock can be stepped back, as NTP does to a VM that has run
+// ahead, so decisions that must only ever move forward don't rest on it
+// alone: intervals are measured on the monotonic clock, and partitions and
+// key timestamps are held to the latest already used.
+
+// sinceFlush returns how long ago the logger last flushed, or started if it
+// hasn't, on the monotonic clock.
+func (l *S3Logger) sinceFlush() time.Duration {
+	return time.Since(l.started) - time.Duration(l.flushedAt.Load())
+}
+
+// markFlushed records a flush at now for sinceFlush.
+func (l *S3Logger) markFlushed(now time.Time) {
+	l.flushedAt.Store(int64(now.Sub(l.started)))
+}
+
+// partitionTime returns the time the partition of a line logged at t is
+// picked by: t, unless an earlier line was logged later, in which case it is
+// that line's time, so that a clock stepped back never reopens a partition
+// the logger has moved on from. The line keeps its own timestamp. Callers
+// must hold l.mu.
+func (l *S3Logger) partitionTime(t time.Time) time.Time {
+	// Compared on the wall clock, which is what partitions follow.
+	t = t.Round(0)
+	if t.Before(l.partMark) {
+		return l.partMark
+	}
+	l.partMark = t
+	return t
+}
+
+// keyStamp returns t, the time an object is stamped with in its key, or a
+// nanosecond past the stamp of the logger's last object if t isn't after it,
+// so that the keys of a container sort in the order they were uploaded even
+// if the clock isn't monotonic. The latest stamp is kept as the state's
+// LastFlush, so a restart carries it on. Callers must hold l.flushMu.
+func (l *S3Logger) keyStamp(t time.Time) time.Time {
+	t = t.Round(0)
+	if !t.After(l.state.LastFlush) {
+		t = l.state.LastFlush.Add(1)
+	}
+	l.state.LastFlush = t
+	return t
+}
@@ -0,0 +1,138 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPartitionTime(t *testing.T) {
+	at := func(m int) time.Time { return time.Date(2024, 5, 1, 10, m, 0, 0, time.UTC) }
+	l := &S3Logger{}
+	for i, tt := range []struct{ t, want time.Time }{
+		{at(58), at(58)},
+		{at(61), at(61)},
+		// Stepped back across the hour: held to the latest.
+		{at(59), at(61)},
+		{at(61), at(61)},
+		{at(62), at(62)},
+	} {
+		if got := l.partitionTime(tt.t); !got.Equal(tt.want) {
+			t.Errorf("line %d at %v partitioned by %v, want %v", i, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestKeyStamp(t *testing.T) {
+	at := func(s int) time.Time { return time.Date(2024, 5, 1, 10, 0, s, 0, time.UTC) }
+	l := &S3Logger{}
+	for i, tt := range []struct{ t, want time.Time }{
+		{at(10), at(10)},
+		{at(20), at(20)},
+		{at(5), at(20).Add(1)},
+		{at(20), at(20).Add(2)},
+		{at(21), at(21)},
+	} {
+		if got := l.keyStamp(tt.t); !got.Equal(tt.want) {
+			t.Errorf("object %d at %v stamped %v, want %v", i, tt.t, got, tt.want)
+		}
+		if !l.state.LastFlush.Equal(tt.want) {
+			t.Errorf("object %d left LastFlush at %v, want %v", i, l.state.LastFlush, tt.want)
+		}
+	}
+}
+
+func TestClockSteppedBack(t *testing.T) {
+	// The clock is stepped back across an hour mid-batch: lines logged after
+	// it stay in the partition the logger moved on to, stamped with their
+	// own time.
+	hour := time.Now().UTC().Truncate(time.Hour)
+	before := "dt=" + hour.Add(-time.Hour).Format(partitionDayFormat) + "/hour=" + hour.Add(-time.Hour).Format(partitionHourFormat) + "/"
+	after := "dt=" + hour.Format(partitionDayFormat) + "/hour=" + hour.Format(partitionHourFormat) + "/"
+	burst := []struct {
+		line string
+		t    time.Time
+	}{
+		{"before 1", hour.Add(-2 * time.Second)},
+		{"after 1", hour.Add(time.Second)},
+		{"stepped back 1", hour.Add(-time.Second)},
+		{"stepped back 2", hour.Add(-500 * time.Millisecond)},
+		{"after 2", hour.Add(2 * time.Second)},
+	}
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, map[string]string{partitionByKey: partitionHour, flushIntervalKey: "1h"})
+	l.partitionLoc = time.UTC
+	for _, b := range burst {
+		if err := l.Log(&Message{Line: []byte(b.line), Source: "stdout", Timestamp: b.t}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	logged := make(map[string]time.Time)
+	for _, b := range burst {
+		logged[b.line] = b.t
+	}
+	got := make(map[string][]string)
+	for _, key := range fake.logKeys(testBucket) {
+		i := strings.Index(key, "dt=")
+		if i < 0 {
+			t.Fatalf("key %q isn't partitioned", key)
+		}
+		part := key[i : i+len(after)]
+		o, _ := fake.object(testBucket, key)
+		for _, line := range strings.Split(strings.TrimSpace(string(o.data)), "\n") {
+			var rec record
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatal(err)
+			}
+			got[part] = append(got[part], rec.Log)
+			checkStamp(t, rec, logged[rec.Log], false)
+		}
+	}
+	want := map[string][]string{
+		before: {"before 1"},
+		after:  {"after 1", "stepped back 1", "stepped back 2", "after 2"},
+	}
+	if !maps.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("partitioned lines as %q, want %q", got, want)
+	}
+}
+
+func TestKeysSortAfterClockSteppedBack(t *testing.T) {
+	// The last flush, as a restart finds it in the state, was stamped an
+	// hour ahead of the clock, which has since been stepped back. The keys
+	// of later flushes still sort after it, in the order they were
+	// uploaded.
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, map[string]string{flushIntervalKey: "1h"})
+	ahead := time.Now().Add(time.Hour).UTC()
+	l.flushMu.Lock()
+	l.state.LastFlush = ahead
+	l.flushMu.Unlock()
+
+	want := []string{"first", "second", "third"}
+	for _, line := range want {
+		if err := l.Log(&Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := uploadedLines(t, fake, l); !slices.Equal(got, want) {
+		t.Errorf("keys sort the lines as %q, want %q", got, want)
+	}
+	l.flushMu.Lock()
+	last := l.state.LastFlush
+	l.flushMu.Unlock()
+	if want := ahead.Add(3); !last.Equal(want) {
+		t.Errorf("LastFlush %v, want %v", last, want)
+	}
+}
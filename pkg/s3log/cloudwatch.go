@@ -0,0 +1,259 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	cloudWatchGroupKey          = "cloudwatch-group"
+	cloudWatchStreamTemplateKey = "cloudwatch-stream-template"
+	cloudWatchFilterKey         = "cloudwatch-filter-pattern"
+
+	defaultCloudWatchStreamTemplate = "{{.ContainerName}}/{{.ContainerID}}"
+	defaultCloudWatchFilter         = ".*"
+
+	// PutLogEvents takes at most 10,000 events and 1MiB per call, counting
+	// 26 bytes for each event on top of its message.
+	cloudWatchMaxEvents     = 10000
+	cloudWatchMaxBatchBytes = 1 << 20
+	cloudWatchEventOverhead = 26
+	cloudWatchMaxEventBytes = 256<<10 - cloudWatchEventOverhead
+
+	cloudWatchFlushInterval = 5 * time.Second
+	cloudWatchQueueSize     = 10000
+	cloudWatchMaxAttempts   = 3
+	cloudWatchRetryDelay    = 5 * time.Second
+	cloudWatchCloseTimeout  = 5 * time.Second
+)
+
+func init() {
+	mirroring := func(s permissionScope) bool { return s.opts.CloudWatchGroup != "" }
+	requirePermissions(
+		permission{"logs:CreateLogStream", onLogGroup, cloudWatchGroupKey, mirroring},
+		permission{"logs:PutLogEvents", onLogGroup, cloudWatchGroupKey, mirroring},
+	)
+}
+
+// cloudWatchAPI is the part of the CloudWatch Logs client the mirror uses.
+type cloudWatchAPI interface {
+	CreateLogStream(context.Context, *cloudwatchlogs.CreateLogStreamInput, ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogStreamOutput, error)
+	PutLogEvents(context.Context, *cloudwatchlogs.PutLogEventsInput, ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error)
+}
+
+// cloudWatch returns a CloudWatch Logs client with the same credentials as
+// the S3 client for cfg, in the bucket's region.
+func (f *clientFactory) cloudWatch(cfg clientConfig) (*cloudwatchlogs.Client, error) {
+	creds, err := f.credentials(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cloudwatchlogs.NewFromConfig(f.cfg, func(o *cloudwatchlogs.Options) {
+		if creds != nil {
+			o.Credentials = creds
+		}
+		if cfg.Region != "" {
+			o.Region = cfg.Region
+		}
+	}), nil
+}
+
+// newCloudWatchMirrorFor returns the mirror for a logger, or nil if no
+// cloudwatch-group is set. Each stream of a split container gets its own log
+// stream.
+func newCloudWatchMirrorFor(clients *clientFactory, opts LogOption, cfg clientConfig, data keyData, routines *routines, log *logrus.Entry) (*cloudWatchMirror, error) {
+	if opts.CloudWatchGroup == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New(cloudWatchStreamTemplateKey).Parse(opts.CloudWatchStreamTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", cloudWatchStreamTemplateKey, opts.CloudWatchStreamTemplate, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", cloudWatchStreamTemplateKey, opts.CloudWatchStreamTemplate, err)
+	}
+	stream := buf.String()
+	if opts.stream != "" {
+		stream += "/" + opts.stream
+	}
+	client, err := clients.cloudWatch(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// Validated by parseLogOpts.
+	filter := regexp.MustCompile(opts.CloudWatchFilter)
+	return newCloudWatchMirror(client, opts.CloudWatchGroup, stream, filter, routines, log), nil
+}
+
+// cloudWatchMirror copies the lines matching its filter to a CloudWatch Logs
+// stream so that recent errors can be searched without waiting for S3. It
+// is strictly best effort: lines are queued without blocking and dropped if
+// the queue is full, and a batch CloudWatch keeps rejecting is dropped after
+// a few attempts, so the S3 path never waits on it.
+type cloudWatchMirror struct {
+	client cloudWatchAPI
+	group  string
+	stream string
+	filter *regexp.Regexp
+	log    *logrus.Entry
+
+	events  chan types.InputLogEvent
+	dropped atomic.Int64
+	token   *string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newCloudWatchMirror(client cloudWatchAPI, group, stream string, filter *regexp.Regexp, routines *routines, log *logrus.Entry) *cloudWatchMirror {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &cloudWatchMirror{
+		client: client,
+		group:  group,
+		stream: stream,
+		filter: filter,
+		log:    log.WithField("group", group).WithField("stream", stream),
+		events: make(chan types.InputLogEvent, cloudWatchQueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	routines.start("cloudwatch", m.run)
+	return m
+}
+
+// send queues msg if it matches the filter. Lines longer than CloudWatch
+// accepts are truncated.
+func (m *cloudWatchMirror) send(msg *Message) {
+	if !m.filter.Match(msg.Line) {
+		return
+	}
+	line := msg.Line
+	if len(line) > cloudWatchMaxEventBytes {
+		line = line[:cloudWatchMaxEventBytes]
+	}
+	ev := types.InputLogEvent{
+		Message:   aws.String(string(bytes.ToValidUTF8(line, []byte("�")))),
+		Timestamp: aws.Int64(msg.Timestamp.UnixMilli()),
+	}
+	select {
+	case m.events <- ev:
+	default:
+		m.dropped.Add(1)
+	}
+}
+
+// close sends whatever is queued, giving up after cloudWatchCloseTimeout.
+func (m *cloudWatchMirror) close() {
+	close(m.events)
+	t := time.AfterFunc(cloudWatchCloseTimeout, m.cancel)
+	<-m.done
+	t.Stop()
+	m.cancel()
+	if n := m.dropped.Load(); n > 0 {
+		m.log.WithField("dropped", n).Warn("lines were not mirrored to CloudWatch")
+	}
+}
+
+// run batches queued events into PutLogEvents calls, sending a batch when it
+// is full or every cloudWatchFlushInterval.
+func (m *cloudWatchMirror) run() {
+	defer close(m.done)
+	m.createStream()
+
+	t := time.NewTicker(cloudWatchFlushInterval)
+	defer t.Stop()
+	var batch []types.InputLogEvent
+	size := 0
+	for {
+		select {
+		case ev, ok := <-m.events:
+			if !ok {
+				m.put(batch)
+				return
+			}
+			n := len(*ev.Message) + cloudWatchEventOverhead
+			if len(batch) == cloudWatchMaxEvents || size+n > cloudWatchMaxBatchBytes {
+				m.put(batch)
+				batch, size = nil, 0
+			}
+			batch = append(batch, ev)
+			size += n
+		case <-t.C:
+			m.put(batch)
+			batch, size = nil, 0
+		}
+	}
+}
+
+func (m *cloudWatchMirror) createStream() {
+	_, err := m.client.CreateLogStream(m.ctx, &cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String(m.group),
+		LogStreamName: aws.String(m.stream),
+	})
+	var exists *types.ResourceAlreadyExistsException
+	if err != nil && !errors.As(err, &exists) {
+		m.log.WithError(err).Warn("error creating CloudWatch log stream")
+	}
+}
+
+// put sends a batch, following the sequence token CloudWatch expects. A batch
+// that still fails after cloudWatchMaxAttempts is dropped.
+func (m *cloudWatchMirror) put(batch []types.InputLogEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	// Events in a call must be in chronological order.
+	sort.SliceStable(batch, func(i, j int) bool {
+		return *batch[i].Timestamp < *batch[j].Timestamp
+	})
+
+	var err error
+	for attempt := 0; attempt < cloudWatchMaxAttempts && m.ctx.Err() == nil; attempt++ {
+		var out *cloudwatchlogs.PutLogEventsOutput
+		out, err = m.client.PutLogEvents(m.ctx, &cloudwatchlogs.PutLogEventsInput{
+			LogGroupName:  aws.String(m.group),
+			LogStreamName: aws.String(m.stream),
+			LogEvents:     batch,
+			SequenceToken: m.token,
+		})
+		var invalid *types.InvalidSequenceTokenException
+		var accepted *types.DataAlreadyAcceptedException
+		var missing *types.ResourceNotFoundException
+		switch {
+		case err == nil:
+			m.token = out.NextSequenceToken
+			if out.RejectedLogEventsInfo != nil {
+				m.log.Warn("CloudWatch rejected some mirrored lines as too old or too new")
+			}
+			return
+		case errors.As(err, &accepted):
+			m.token = accepted.ExpectedSequenceToken
+			return
+		case errors.As(err, &invalid):
+			m.token = invalid.ExpectedSequenceToken
+			continue
+		case errors.As(err, &missing):
+			m.createStream()
+		}
+		select {
+		case <-m.ctx.Done():
+		case <-time.After(backoff(attempt, cloudWatchRetryDelay)):
+		}
+	}
+	m.dropped.Add(int64(len(batch)))
+	m.log.WithError(err).Warnf("dropped %d lines mirrored to CloudWatch", len(batch))
+}
@@ -0,0 +1,95 @@
+package s3log
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	coalesceWindowKey = "coalesce-window"
+
+	defaultCoalesceWindow = 250 * time.Millisecond
+)
+
+var (
+	flushesCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "coalesced_flushes_total",
+		Help:      "Flushes held until coalesce-window after their container's previous one, so that what arrived meanwhile went into one object.",
+	})
+	putsPerSecond = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: driverName,
+		Name:      "puts_per_second",
+		Help:      "Objects of log lines uploaded across all containers in each second that had any, observed once the next second has one.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(flushesCoalesced, putsPerSecond)
+}
+
+// putSeconds counts the objects uploaded in the current second for
+// putsPerSecond.
+var putSeconds struct {
+	sync.Mutex
+	second int64
+	n      float64
+}
+
+// countPut counts an object uploaded at now in putsPerSecond, observing the
+// count of the last second that had any once now is past it.
+func countPut(now time.Time) {
+	putSeconds.Lock()
+	defer putSeconds.Unlock()
+	if s := now.Unix(); s != putSeconds.second {
+		if putSeconds.n > 0 {
+			putsPerSecond.Observe(putSeconds.n)
+		}
+		putSeconds.second, putSeconds.n = s, 0
+	}
+	putSeconds.n++
+}
+
+// flushJitter returns how much sooner than flush-interval a logger's first
+// idle flush fires, picked at random across the interval, so that the
+// timers of containers started together, as after a deploy, don't fire
+// together from then on.
+func flushJitter(interval time.Duration) time.Duration {
+	if interval <= 1 {
+		return 0
+	}
+	return rand.N(interval)
+}
+
+// coalesce holds a flush that comes within coalesce-window of the logger's
+// previous one until the window has passed, taking in the flushes triggered
+// meanwhile and the lines they would have uploaded, so that they go into
+// one object. Batches still never straddle a partition or exceed
+// max-object-size, as the flush splits them. A buffer that fills past
+// flush-bytes ends the wait, as does the logger closing, when it returns
+// false.
+func (l *S3Logger) coalesce() bool {
+	wait := l.opts.CoalesceWindow - l.sinceFlush()
+	if wait <= 0 || l.overFlushBytes() {
+		return true
+	}
+	flushesCoalesced.Inc()
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.done:
+			return false
+		case <-l.kick:
+			if l.overFlushBytes() {
+				return true
+			}
+		case <-t.C:
+			return true
+		}
+	}
+}
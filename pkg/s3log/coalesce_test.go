@@ -0,0 +1,245 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// herdCeiling is the most PUTs any second may see once the idle flushes of
+// 200 containers started together are spread across a 5s flush-interval,
+// twice as many as an even spread gives.
+const herdCeiling = 80
+
+// putsOver returns how many seconds putsPerSecond has observed with more
+// than n PUTs, n being one of its buckets' bounds.
+func putsOver(t *testing.T, n float64) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := putsPerSecond.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	h := m.GetHistogram()
+	for _, b := range h.GetBucket() {
+		if b.GetUpperBound() == n {
+			return h.GetSampleCount() - b.GetCumulativeCount()
+		}
+	}
+	t.Fatalf("puts_per_second has no bucket of %v", n)
+	return 0
+}
+
+func TestFlushHerd(t *testing.T) {
+	// On a fake clock, 200 containers started by the same deploy each flush
+	// first at their jittered point of the interval and every interval from
+	// then on, as flushLoop has them. The PUTs a second stay under the
+	// ceiling, unlike those of timers without jitter, and puts_per_second
+	// shows which.
+	const (
+		containers = 200
+		interval   = 5 * time.Second
+		run        = time.Minute
+	)
+	tests := []struct {
+		name     string
+		jitter   func(time.Duration) time.Duration
+		wantHerd bool
+	}{
+		{name: "jittered", jitter: flushJitter},
+		{name: "synchronized", jitter: func(time.Duration) time.Duration { return 0 }, wantHerd: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Seconds of the fake clock are apart from those of the real
+			// one, which other tests' PUTs are counted in.
+			deploy := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+			var puts []time.Time
+			for range containers {
+				for at := deploy.Add(interval - tt.jitter(interval)); at.Before(deploy.Add(run)); at = at.Add(interval) {
+					puts = append(puts, at)
+				}
+			}
+			perSecond := map[int64]int{}
+			for _, at := range puts {
+				perSecond[at.Unix()]++
+			}
+			busiest := 0
+			for _, n := range perSecond {
+				busiest = max(busiest, n)
+			}
+			if herd := busiest > herdCeiling; herd != tt.wantHerd {
+				t.Errorf("at most %d PUTs a second, over the ceiling of %d = %v, want %v", busiest, herdCeiling, herd, tt.wantHerd)
+			}
+
+			over := putsOver(t, 128)
+			slices.SortFunc(puts, time.Time.Compare)
+			for _, at := range puts {
+				countPut(at)
+			}
+			// A second is observed once the next has a PUT.
+			countPut(deploy.Add(run + time.Hour))
+			if herd := putsOver(t, 128) > over; herd != tt.wantHerd {
+				t.Errorf("puts_per_second observed a second of over 128 PUTs = %v, want %v", herd, tt.wantHerd)
+			}
+		})
+	}
+}
+
+func TestFlushJitterSpreads(t *testing.T) {
+	// 200 containers started together and each logging a line have their
+	// first idle flushes spread across the interval rather than all at
+	// once.
+	const (
+		containers = 200
+		interval   = time.Second
+		slot       = interval / 10
+	)
+	fake := newFakeS3()
+	var mu sync.Mutex
+	var starts []time.Time
+	fake.before = func(_ context.Context, op, _, _ string) error {
+		if op == "PutObject" {
+			mu.Lock()
+			starts = append(starts, time.Now())
+			mu.Unlock()
+		}
+		return nil
+	}
+	cfg := testLogOpts(t, map[string]string{flushIntervalKey: interval.String()})
+	deploy := time.Now()
+	for i := range containers {
+		l, _ := newTestDriverLogger(t, fake, Info{Config: cfg, ContainerID: fmt.Sprintf("%064x", i), ContainerName: fmt.Sprintf("/c%d", i)})
+		logLines(t, l, time.Now(), "started")
+	}
+	waitFor(t, "every container's first flush", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(starts) == containers
+	})
+	slots := map[int]int{}
+	for _, at := range starts {
+		slots[int(at.Sub(deploy)/slot)]++
+	}
+	busiest := 0
+	for _, n := range slots {
+		busiest = max(busiest, n)
+	}
+	// Even spread puts 20 in each slot; the slack is for a busy machine's
+	// timers firing late together.
+	if busiest > containers/2 {
+		t.Errorf("%d of %d first flushes within %s of each other, want them spread across %s: %v", busiest, containers, slot, interval, slots)
+	}
+	if ideal := math.Ceil(float64(containers) * float64(slot) / float64(interval)); busiest < int(ideal) {
+		t.Fatalf("busiest slot has %d flushes, fewer than the %v of an even spread", busiest, ideal)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	// Flushes woken within coalesce-window of the previous flush wait out
+	// the window and go up together, with each partition still in objects
+	// of its own of at most max-object-size.
+	const window = 300 * time.Millisecond
+	tests := []struct {
+		name          string
+		cfg           map[string]string
+		lines         []string // "<hour> <line>", logged after the first flush
+		wantObjects   []string // the lines of each object after the first
+		wantCoalesced bool
+	}{
+		{
+			name:          "partitions",
+			cfg:           map[string]string{coalesceWindowKey: window.String()},
+			lines:         []string{"10 b", "11 c", "11 d", "12 e"},
+			wantObjects:   []string{"b", "c,d", "e"},
+			wantCoalesced: true,
+		},
+		{
+			name:          "max object size",
+			cfg:           map[string]string{coalesceWindowKey: window.String(), maxObjectSizeKey: "500"},
+			lines:         []string{"10 b", "11 c", "11 d", "11 f", "11 g", "12 e"},
+			wantObjects:   []string{"b", "c,d", "f,g", "e"},
+			wantCoalesced: true,
+		},
+		{
+			name:        "disabled",
+			cfg:         map[string]string{coalesceWindowKey: "0"},
+			lines:       []string{"10 b", "11 c"},
+			wantObjects: []string{"b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			var mu sync.Mutex
+			var puts []time.Time
+			fake.before = func(_ context.Context, op, _, _ string) error {
+				if op == "PutObject" {
+					mu.Lock()
+					puts = append(puts, time.Now())
+					mu.Unlock()
+				}
+				return nil
+			}
+			tt.cfg[partitionByKey], tt.cfg[flushIntervalKey] = partitionHour, "1h"
+			l := newTestLogger(t, fake, tt.cfg)
+			day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+			logLines(t, l, day.Add(10*time.Hour), "a")
+			if err := l.flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			flushed := time.Now()
+			coalesced := metricValue(flushesCoalesced)
+			for _, line := range tt.lines {
+				hour, text, _ := strings.Cut(line, " ")
+				var h int
+				fmt.Sscan(hour, &h)
+				// Padded to records of 231 bytes, two to an object of 500.
+				logLines(t, l, day.Add(time.Duration(h)*time.Hour), text+strings.Repeat(" ", 60))
+			}
+			waitFor(t, "the coalesced flush", func() bool { return len(fake.logKeys(testBucket)) > len(tt.wantObjects) })
+
+			mu.Lock()
+			first := puts[1]
+			mu.Unlock()
+			if held := first.Sub(flushed) >= window-20*time.Millisecond; held != tt.wantCoalesced {
+				t.Errorf("flushed %s after the previous flush, held for the window = %v, want %v", first.Sub(flushed), held, tt.wantCoalesced)
+			}
+			if got := metricValue(flushesCoalesced) - coalesced; (got > 0) != tt.wantCoalesced {
+				t.Errorf("%v flushes counted coalesced", got)
+			}
+			if !tt.wantCoalesced {
+				return
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, key := range fake.logKeys(testBucket)[1:] {
+				o, _ := fake.object(testBucket, key)
+				if size := len(o.data); tt.cfg[maxObjectSizeKey] != "" && size > 500 {
+					t.Errorf("object %s of %d bytes, over max-object-size", key, size)
+				}
+				var lines []string
+				for _, line := range strings.Split(strings.TrimSpace(string(o.data)), "\n") {
+					var rec record
+					if err := json.Unmarshal([]byte(line), &rec); err != nil {
+						t.Fatal(err)
+					}
+					lines = append(lines, strings.TrimSpace(rec.Log))
+				}
+				got = append(got, strings.Join(lines, ","))
+			}
+			if strings.Join(got, " ") != strings.Join(tt.wantObjects, " ") {
+				t.Errorf("uploaded objects of %q, want %q", got, tt.wantObjects)
+			}
+		})
+	}
+}
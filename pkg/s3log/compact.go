@@ -0,0 +1,394 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	compactIntervalKey   = "compact-interval"
+	compactWindowKey     = "compact-window"
+	compactMinObjectsKey = "compact-min-objects"
+
+	defaultCompactWindow     = time.Hour
+	defaultCompactMinObjects = 10
+
+	// compactedSuffix marks the key of a merged object, so that it isn't
+	// merged again.
+	compactedSuffix = "compacted"
+
+	// maxDeleteObjects is how many keys a DeleteObjects request may name.
+	maxDeleteObjects = 1000
+)
+
+var compactedObjects = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: driverName,
+	Name:      "compacted_objects_total",
+	Help:      "Objects of stopped containers deleted after being merged into larger ones.",
+})
+
+func init() {
+	metricsRegistry.MustRegister(compactedObjects)
+	compacting := func(s permissionScope) bool { return s.compact }
+	requirePermissions(
+		permission{"s3:ListBucket", onBucket, "compaction", compacting},
+		permission{"s3:GetObject", onObjects, "compaction", compacting},
+		permission{"s3:GetObjectVersion", onObjects, "compaction", compacting},
+		permission{"s3:PutObject", onObjects, "compaction", compacting},
+		permission{"s3:DeleteObject", onObjects, "compaction", compacting},
+		permission{"s3:AbortMultipartUpload", onObjects, "compaction", func(s permissionScope) bool {
+			return s.compact && int64(s.opts.MaxObjectSize) >= s.opts.PartSize
+		}},
+		permission{"kms:Decrypt", onKMSKey, "compaction", func(s permissionScope) bool { return s.compact && s.opts.SSEKMSKeyID != "" }},
+	)
+}
+
+// compactor merges the small objects of stopped containers into larger ones.
+// Containers are queued as they stop and compacted every interval, unless
+// they have started logging again in the meantime. Containers stopped before
+// the plugin was last restarted aren't compacted.
+type compactor struct {
+	d          *Driver
+	interval   time.Duration
+	window     time.Duration
+	minObjects int
+
+	mu      sync.Mutex
+	pending map[string]Info
+
+	// stop ends run, which closes stopped as it returns.
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+// startCompactor starts compacting containers as they stop, every interval.
+func (d *Driver) startCompactor(interval, window time.Duration, minObjects int) {
+	d.compactor = &compactor{
+		d:          d,
+		interval:   interval,
+		window:     window,
+		minObjects: minObjects,
+		pending:    make(map[string]Info),
+		stopped:    make(chan struct{}),
+	}
+	ctx, stop := context.WithCancel(d.ctx)
+	d.compactor.stop = stop
+	go func() {
+		defer close(d.compactor.stopped)
+		d.compactor.run(ctx)
+	}()
+}
+
+// close stops the compactor, waiting until ctx is done for a compaction
+// under way to give up, and returns how many stopped containers were still
+// waiting to be compacted. A nil compactor has none.
+func (c *compactor) close(ctx context.Context) int {
+	if c == nil {
+		return 0
+	}
+	c.stop()
+	select {
+	case <-c.stopped:
+	case <-ctx.Done():
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// add queues a stopped container to be compacted. A nil compactor ignores it.
+func (c *compactor) add(info Info) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[info.ContainerID] = info
+}
+
+func (c *compactor) run(ctx context.Context) {
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		c.mu.Lock()
+		pending := c.pending
+		c.pending = make(map[string]Info)
+		c.mu.Unlock()
+		for _, info := range pending {
+			if ctx.Err() != nil {
+				return
+			}
+			c.compact(ctx, info)
+		}
+	}
+}
+
+// compact merges the objects of a stopped container. One that is logging
+// again is left alone; it is queued again when it next stops.
+func (c *compactor) compact(ctx context.Context, info Info) {
+	log := logrus.WithField("id", info.ContainerID)
+	c.d.mu.Lock()
+	_, running := c.d.idx[info.ContainerID]
+	c.d.mu.Unlock()
+	if running {
+		log.Debug("container is logging again, not compacting it")
+		return
+	}
+
+	opts, err := c.d.tenantOptions(c.d.defaults(), info, info.Config)
+	if err != nil {
+		log.WithError(err).Warn("error parsing log-opts, not compacting container")
+		return
+	}
+	opts.WAL = false
+	// Only the stopped run is compacted, never the runs before it.
+	opts.ReadPriorRuns = false
+	l, err := newLogger(c.d.clients, c.d.pool, nil, opts, info, nil, nil)
+	if err != nil {
+		log.WithError(err).Warn("error creating logger, not compacting container")
+		return
+	}
+	defer l.Close()
+
+	loggers := []*S3Logger{}
+	switch l := l.(type) {
+	case *S3Logger:
+		loggers = append(loggers, l)
+	case *splitLogger:
+		loggers = append(loggers, l.loggers[:]...)
+	}
+	for _, l := range loggers {
+		n, err := l.compact(ctx, c.window, c.minObjects)
+		if n > 0 {
+			l.log().WithField("objects", n).Info("compacted objects")
+		}
+		if err != nil {
+			l.log().WithError(err).Warn("error compacting objects")
+		}
+	}
+}
+
+// compact merges the logger's objects in the primary bucket that fall into
+// the same window and partition, wherever there are at least minObjects of
+// them, into objects whose parts add up to at most max-object-size as
+// stored, returning how many were merged and deleted. A merged object is
+// named after the first of its objects, which are only deleted once it has
+// been uploaded and verified; compaction interrupted in between leaves their
+// lines in both. Replicas aren't compacted, nor are parquet objects or those
+// of upload-mode=presigned.
+func (l *S3Logger) compact(ctx context.Context, window time.Duration, minObjects int) (int, error) {
+	if l.opts.Format == formatParquet || l.opts.UploadMode == uploadModePresigned {
+		return 0, nil
+	}
+	objects, err := l.listObjects(ctx, ReadConfig{})
+	if err != nil {
+		return 0, err
+	}
+
+	type group struct {
+		dir   string
+		start time.Time
+	}
+	var groups [][]logObject
+	var last group
+	for _, obj := range objects {
+		if isCompacted(obj.key) || obj.size >= int64(l.opts.MaxObjectSize) {
+			continue
+		}
+		g := group{dir: path.Dir(obj.key), start: obj.time.UTC().Truncate(window)}
+		if len(groups) == 0 || g != last {
+			groups = append(groups, nil)
+			last = g
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], obj)
+	}
+
+	merged := 0
+	for _, g := range groups {
+		if len(g) < minObjects {
+			continue
+		}
+		for len(g) > 0 {
+			var size int64
+			n := 0
+			for n < len(g) && (n == 0 || size+g[n].size <= int64(l.opts.MaxObjectSize)) {
+				size += g[n].size
+				n++
+			}
+			if n > 1 {
+				if err := l.merge(ctx, g[:n]); err != nil {
+					return merged, err
+				}
+				merged += n
+			}
+			g = g[n:]
+		}
+	}
+	return merged, nil
+}
+
+// merge replaces objects, which must be sorted oldest first, with a single
+// object holding their lines in order. The manifest, if the logger keeps
+// one, is updated before the objects are deleted.
+func (l *S3Logger) merge(ctx context.Context, objects []logObject) error {
+	var body bytes.Buffer
+	for _, obj := range objects {
+		r, err := l.openObject(ctx, obj)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(&body, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read object %q: %v", obj.key, err)
+		}
+		if n := body.Len(); n > 0 && body.Bytes()[n-1] != '\n' {
+			body.WriteByte('\n')
+		}
+	}
+
+	b, err := l.newBatch(withUniqueSuffix(trimCodecExt(objects[0].key), compactedSuffix), body.Bytes())
+	if err != nil {
+		return err
+	}
+	t := l.targets[0]
+	b.Bucket = t.bucket
+	b.Client = t.cfg
+	err = retry(ctx, l.opts.MaxRetries, l.opts.MaxRetryDelay, func() error {
+		return l.pool.upload(ctx, t.bucket, l.opts.S3RequestTimeout, func(ctx context.Context) error {
+			return uploadBatch(ctx, t.uploader, b)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err := l.verify(ctx, b); err != nil {
+		return err
+	}
+	if b.index != nil {
+		l.putIndex(ctx, b)
+	}
+	if key := l.manifestPath(); key != "" {
+		keys := make(map[string]bool, len(objects))
+		for _, obj := range objects {
+			keys[obj.key] = true
+		}
+		err := updateManifest(ctx, l.s3Client, l.bucket, key, l.opts.RequestPayer, l.retention, func(m *manifest) {
+			m.merge(keys, b.manifestObject(false))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < len(objects); i += maxDeleteObjects {
+		chunk := objects[i:min(i+maxDeleteObjects, len(objects))]
+		ids := make([]types.ObjectIdentifier, len(chunk))
+		for j, obj := range chunk {
+			ids[j] = types.ObjectIdentifier{Key: aws.String(obj.key)}
+		}
+		out, err := l.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket:       aws.String(l.bucket),
+			Delete:       &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+			RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects merged into %q: %v", b.Key, err)
+		}
+		compactedObjects.Add(float64(len(chunk) - len(out.Errors)))
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("failed to delete %d objects merged into %q, e.g. %q: %s", len(out.Errors), b.Key, aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+	}
+	if l.opts.Index {
+		l.deleteIndexes(ctx, objects)
+	}
+	l.log().WithField("key", b.Key).WithField("objects", len(objects)).Debug("merged objects")
+	return nil
+}
+
+// deleteIndexes deletes the indexes of objects, which have been merged. The
+// keys of objects uploaded without an index are named too, which S3 doesn't
+// mind. An index left behind is harmless: nothing reads it.
+func (l *S3Logger) deleteIndexes(ctx context.Context, objects []logObject) {
+	for i := 0; i < len(objects); i += maxDeleteObjects {
+		chunk := objects[i:min(i+maxDeleteObjects, len(objects))]
+		ids := make([]types.ObjectIdentifier, len(chunk))
+		for j, obj := range chunk {
+			ids[j] = types.ObjectIdentifier{Key: aws.String(obj.key + indexSuffix)}
+		}
+		out, err := l.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket:       aws.String(l.bucket),
+			Delete:       &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+			RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+		})
+		if err == nil && len(out.Errors) > 0 {
+			err = fmt.Errorf("%d not deleted, e.g. %q: %s", len(out.Errors), aws.ToString(out.Errors[0].Key), aws.ToString(out.Errors[0].Message))
+		}
+		if err != nil {
+			l.log().WithError(err).Warn("error deleting indexes of merged objects")
+		}
+	}
+}
+
+// trimCodecExt returns key without the extension added by compress.
+func trimCodecExt(key string) string {
+	for _, codec := range codecs {
+		if strings.HasSuffix(key, codec.ext) {
+			return strings.TrimSuffix(key, codec.ext)
+		}
+	}
+	return key
+}
+
+// isCompacted reports whether key names an object merged by compaction.
+func isCompacted(key string) bool {
+	key = trimCodecExt(key)
+	return strings.HasSuffix(strings.TrimSuffix(key, path.Ext(key)), "-"+compactedSuffix)
+}
+
+// verify checks that the object uploaded for b is stored with b's size, and
+// with its checksum if it has one.
+func (l *S3Logger) verify(ctx context.Context, b *batch) error {
+	input := &s3.HeadObjectInput{
+		Bucket:       aws.String(l.bucket),
+		Key:          aws.String(b.Key),
+		RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+	}
+	if b.versionID != "" {
+		input.VersionId = aws.String(b.versionID)
+	}
+	if b.ChecksumSHA256 != "" {
+		input.ChecksumMode = types.ChecksumModeEnabled
+	}
+	l.ssec.set(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	out, err := l.s3Client.HeadObject(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to verify merged object %q: %v", b.Key, err)
+	}
+	if size := aws.ToInt64(out.ContentLength); size != int64(len(b.body)) {
+		return fmt.Errorf("merged object %q is %d bytes, not %d", b.Key, size, len(b.body))
+	}
+	if b.ChecksumSHA256 != "" && aws.ToString(out.ChecksumSHA256) != b.ChecksumSHA256 {
+		return fmt.Errorf("merged object %q doesn't match its checksum", b.Key)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package s3log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressLevelKey = "compress-level"
+
+	compressNone = ""
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// codecs maps each compress value to the key suffix and Content-Encoding of
+// the objects it produces.
+var codecs = map[string]struct{ ext, encoding string }{
+	compressGzip: {".gz", "gzip"},
+	compressZstd: {".zst", "zstd"},
+}
+
+var (
+	// gzipWriters pools gzip writers by level, since allocating one costs
+	// more than compressing a small batch.
+	gzipWriters sync.Map // int -> *sync.Pool
+
+	// zstdEncoders holds an encoder per level. EncodeAll may be called
+	// concurrently, so a single encoder serves every logger.
+	zstdMu       sync.Mutex
+	zstdEncoders = make(map[int]*zstd.Encoder)
+)
+
+// validateCompressLevel checks that level is valid for codec. 0 picks the
+// codec's default.
+func validateCompressLevel(codec string, level int) error {
+	switch {
+	case level == 0:
+		return nil
+	case codec == compressGzip && (level < gzip.HuffmanOnly || level > gzip.BestCompression):
+		return fmt.Errorf("must be between %d and %d for %s", gzip.HuffmanOnly, gzip.BestCompression, codec)
+	case codec == compressZstd && (level < 1 || level > 22):
+		return fmt.Errorf("must be between 1 and 22 for %s", codec)
+	}
+	return nil
+}
+
+// compressBytes returns a copy of p compressed with codec at level.
+func compressBytes(codec string, level int, p []byte) ([]byte, error) {
+	if codec == compressZstd {
+		enc, err := zstdEncoder(level)
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(p, nil), nil
+	}
+	return compressGzipBytes(p, level)
+}
+
+// compressGzipBytes returns a gzip encoded copy of p. The writer is closed
+// before the result is returned so the gzip footer is always present.
+func compressGzipBytes(p []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	pool, _ := gzipWriters.LoadOrStore(level, &sync.Pool{New: func() any {
+		// The level has been validated.
+		zw, _ := gzip.NewWriterLevel(nil, level)
+		return zw
+	}})
+	zw := pool.(*sync.Pool).Get().(*gzip.Writer)
+	defer pool.(*sync.Pool).Put(zw)
+
+	var buf bytes.Buffer
+	zw.Reset(&buf)
+	if _, err := zw.Write(p); err != nil {
+		zw.Close()
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func zstdEncoder(level int) (*zstd.Encoder, error) {
+	zstdMu.Lock()
+	defer zstdMu.Unlock()
+	if enc, ok := zstdEncoders[level]; ok {
+		return enc, nil
+	}
+	opts := []zstd.EOption{}
+	if level != 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	zstdEncoders[level] = enc
+	return enc, nil
+}
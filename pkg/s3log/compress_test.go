@@ -0,0 +1,150 @@
+package s3log
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat(`{"log":"a line of the container's output\n","stream":"stdout"}`+"\n", 100))
+	tests := []struct {
+		codec string
+		level int
+	}{
+		{compressGzip, 0},
+		{compressGzip, 1},
+		{compressGzip, 9},
+		{compressZstd, 0},
+		{compressZstd, 3},
+		{compressZstd, 19},
+	}
+	for _, tt := range tests {
+		compressed, err := compressBytes(tt.codec, tt.level, data)
+		if err != nil {
+			t.Fatalf("%s level %d: %v", tt.codec, tt.level, err)
+		}
+		if len(compressed) >= len(data) {
+			t.Errorf("%s level %d: %d bytes compressed to %d", tt.codec, tt.level, len(data), len(compressed))
+		}
+		// The codec is found from the object's first bytes alone.
+		_, peek, err := peekObject(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		codec := objectCodec("key", "", peek)
+		if codec != tt.codec {
+			t.Errorf("%s level %d: sniffed as %q", tt.codec, tt.level, codec)
+		}
+		r, err := decompress(codec, io.NopCloser(bytes.NewReader(compressed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s level %d: round trip gave %d bytes, %v", tt.codec, tt.level, len(got), err)
+		}
+	}
+}
+
+// TestCompressPooledWriters checks that a gzip writer taken back from the
+// pool doesn't carry anything over from the batch before.
+func TestCompressPooledWriters(t *testing.T) {
+	for i := range 5 {
+		data := []byte(strings.Repeat(string(rune('a'+i)), 1000+i))
+		compressed, err := compressBytes(compressGzip, 0, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := decompress(compressGzip, io.NopCloser(bytes.NewReader(compressed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(r)
+		if !bytes.Equal(got, data) {
+			t.Fatalf("batch %d decompressed to %d bytes, want %d", i, len(got), len(data))
+		}
+	}
+}
+
+func TestObjectCodec(t *testing.T) {
+	gz, _ := compressBytes(compressGzip, 0, []byte("x"))
+	tests := []struct {
+		key, encoding string
+		peek          []byte
+		want          string
+	}{
+		{"a.log.gz", "", nil, compressGzip},
+		{"a.log.zst", "", nil, compressZstd},
+		{"a.log", "gzip", nil, compressGzip},
+		{"a.log", "zstd", nil, compressZstd},
+		{"a.log", "", gz, compressGzip},
+		{"a.log", "", []byte("plain text"), compressNone},
+		// The key's extension wins over the encoding.
+		{"a.log.zst", "gzip", nil, compressZstd},
+	}
+	for _, tt := range tests {
+		if got := objectCodec(tt.key, tt.encoding, tt.peek); got != tt.want {
+			t.Errorf("objectCodec(%q, %q) = %q, want %q", tt.key, tt.encoding, got, tt.want)
+		}
+	}
+}
+
+func TestIsText(t *testing.T) {
+	tests := []struct {
+		name string
+		p    []byte
+		want bool
+	}{
+		{"empty", nil, true},
+		{"ascii", []byte("plain text\n"), true},
+		{"record", []byte(`{"log":"x"}`), true},
+		{"multibyte", []byte("日本語"), true},
+		// The peek may end in the middle of a rune.
+		{"cut rune", []byte("日本語")[:7], true},
+		// Latin-1 is text to http.DetectContentType.
+		{"latin-1", []byte("caf\xe9"), true},
+		{"binary", []byte{0x00, 0x01, 0xfe, 0xff}, false},
+	}
+	for _, tt := range tests {
+		if got := isText(tt.p); got != tt.want {
+			t.Errorf("%s: isText(%q) = %v, want %v", tt.name, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestValidateCompressLevel(t *testing.T) {
+	tests := []struct {
+		codec string
+		level int
+		ok    bool
+	}{
+		{compressGzip, 0, true},
+		{compressGzip, 9, true},
+		{compressGzip, -2, true},
+		{compressGzip, 10, false},
+		{compressGzip, -3, false},
+		{compressZstd, 1, true},
+		{compressZstd, 22, true},
+		{compressZstd, 23, false},
+	}
+	for _, tt := range tests {
+		if err := validateCompressLevel(tt.codec, tt.level); (err == nil) != tt.ok {
+			t.Errorf("validateCompressLevel(%s, %d) = %v, want ok %v", tt.codec, tt.level, err, tt.ok)
+		}
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	_, err := decompress(compressGzip, io.NopCloser(strings.NewReader("not gzip at all")))
+	if err == nil {
+		t.Fatal("decompressed garbage")
+	}
+	var ferr *formatError
+	if !errors.As(err, &ferr) {
+		t.Errorf("error %v isn't a formatError", err)
+	}
+}
@@ -0,0 +1,325 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// configPath is the plugin API endpoint the config command asks for a
+// container's effective configuration. It is the plugin's own, not one the
+// daemon calls: the daemon has no way to ask a log driver for its
+// configuration.
+const configPath = "/S3LogDriver.Config"
+
+// maskedValue replaces secrets in a reported configuration.
+const maskedValue = "****"
+
+// secretLogOpts are the log-opts whose values are masked in a reported
+// configuration.
+var secretLogOpts = map[string]bool{
+	secretKeyKey:    true,
+	sessionTokenKey: true,
+	externalIDKey:   true,
+}
+
+type ConfigRequest struct {
+	ContainerID string
+}
+
+type ConfigResponse struct {
+	Err    string
+	Config *containerConfig `json:",omitempty"`
+}
+
+// containerConfig is the configuration a container's logger runs with, after
+// the plugin's flags, environment expansion and the container's log-opts,
+// with secrets masked. Nothing in it can be used to authenticate.
+type containerConfig struct {
+	ContainerID   string            `json:"container_id"`
+	ContainerName string            `json:"container_name"`
+	Bucket        string            `json:"bucket"`
+	Replicas      []string          `json:"replicas,omitempty"`
+	Region        string            `json:"region,omitempty"`
+	Endpoint      string            `json:"endpoint,omitempty"`
+	Prefix        string            `json:"prefix"`
+	KeyTemplate   string            `json:"key_template"`
+	Group         string            `json:"group,omitempty"`
+	SampleKeys    []string          `json:"sample_keys"`
+	Format        string            `json:"format"`
+	Compress      string            `json:"compress"`
+	Mode          string            `json:"mode"`
+	StdoutMode    string            `json:"stdout_mode"`
+	StderrMode    string            `json:"stderr_mode"`
+	FlushInterval string            `json:"flush_interval"`
+	FlushBytes    int               `json:"flush_bytes"`
+	AdaptiveFlush bool              `json:"adaptive_flush,omitempty"`
+	MaxBufferSize int               `json:"max_buffer_size"`
+	SplitStreams  bool              `json:"split_streams,omitempty"`
+	SpoolDir      string            `json:"spool_dir,omitempty"`
+	WAL           bool              `json:"wal,omitempty"`
+	SSE           string            `json:"sse,omitempty"`
+	SSEKMSKeyID   string            `json:"sse_kms_key_id,omitempty"`
+	SSECKeyFile   string            `json:"sse_c_key_file,omitempty"`
+	Credentials   string            `json:"credentials"`
+	AccessKeyID   string            `json:"access_key_id,omitempty"`
+	RoleARN       string            `json:"role_arn,omitempty"`
+	Profile       string            `json:"profile,omitempty"`
+	Proxy         string            `json:"proxy,omitempty"`
+	LogOpts       map[string]string `json:"log_opts"`
+}
+
+// maskAccessKeyID returns the last 4 characters of an access key ID, enough
+// to tell keys apart in IAM without giving the ID away.
+func maskAccessKeyID(id string) string {
+	if id == "" {
+		return ""
+	}
+	if len(id) <= 8 {
+		return maskedValue
+	}
+	return maskedValue + id[len(id)-4:]
+}
+
+// maskLogOpts returns a copy of cfg, a container's log-opts, with the
+// values of secrets masked.
+func maskLogOpts(cfg map[string]string) map[string]string {
+	masked := maps.Clone(cfg)
+	if masked == nil {
+		masked = map[string]string{}
+	}
+	for k, v := range masked {
+		switch {
+		case v == "":
+		case secretLogOpts[k]:
+			masked[k] = maskedValue
+		case k == accessKeyIDKey:
+			masked[k] = maskAccessKeyID(v)
+		case k == proxyURLKey:
+			masked[k] = redactURL(v)
+		}
+	}
+	return masked
+}
+
+// credentialsSource describes where a logger with opts gets its
+// credentials, without giving any of them away.
+func credentialsSource(opts LogOption) string {
+	var source string
+	switch {
+	case opts.AccessKeyID != "":
+		source = "static keys"
+	case opts.CredentialsFile != "":
+		source = fmt.Sprintf("credentials file %q", opts.CredentialsFile)
+	case opts.Profile != "":
+		source = fmt.Sprintf("shared config profile %q", opts.Profile)
+	case defaultCredentials != nil:
+		source = "default chain"
+		if won := defaultCredentials.source(); won != "" {
+			source += ", last using " + won
+		}
+	default:
+		source = "default chain"
+	}
+	if opts.AssumeRoleARN != "" {
+		source = fmt.Sprintf("role %q assumed with %s", opts.AssumeRoleARN, source)
+	}
+	return source
+}
+
+// lookup returns the logger of the container whose ID is, or starts with,
+// id.
+func (d *Driver) lookup(id string) (*logPair, error) {
+	if id == "" {
+		return nil, errors.New("must provide container id")
+	}
+	d.mu.Lock()
+	var matches []*logPair
+	for _, lf := range d.logs {
+		if strings.HasPrefix(lf.info.ContainerID, id) {
+			matches = append(matches, lf)
+		}
+	}
+	d.mu.Unlock()
+	switch {
+	case len(matches) == 0:
+		return nil, fmt.Errorf("no container %q is logging to the plugin", id)
+	case len(matches) > 1:
+		return nil, fmt.Errorf("container ID prefix %q is ambiguous: %d containers match", id, len(matches))
+	}
+	return matches[0], nil
+}
+
+// s3Loggers returns the S3 loggers l is, or is split into.
+func s3Loggers(l containerLogger) []*S3Logger {
+	switch l := l.(type) {
+	case *S3Logger:
+		return []*S3Logger{l}
+	case *splitLogger:
+		return l.loggers[:]
+	}
+	return nil
+}
+
+// config returns the configuration of the container whose ID is, or
+// starts with, id.
+func (d *Driver) config(id string) (*containerConfig, error) {
+	lf, err := d.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	l, _ := lf.logger()
+	loggers := s3Loggers(l)
+	if len(loggers) == 0 {
+		return nil, fmt.Errorf("container %q has no S3 logger", id)
+	}
+	// The update command may be changing some of them.
+	loggers[0].mu.Lock()
+	opts := loggers[0].opts
+	loggers[0].mu.Unlock()
+	return describeConfig(loggers, opts, lf.logOpts()), nil
+}
+
+// describeConfig returns the configuration of the container whose loggers,
+// with opts, were started with the log-opts cfg.
+func describeConfig(loggers []*S3Logger, opts LogOption, cfg map[string]string) *containerConfig {
+	info := loggers[0].info
+	prefix := opts.S3Prefix
+	if opts.stream != "" {
+		prefix = strings.TrimSuffix(prefix, opts.stream+"/")
+	}
+	c := &containerConfig{
+		ContainerID:   info.ContainerID,
+		ContainerName: info.Name(),
+		Bucket:        opts.S3Bucket,
+		Region:        opts.S3Region,
+		Endpoint:      opts.EndpointURL,
+		Prefix:        prefix,
+		KeyTemplate:   opts.KeyTemplate,
+		Group:         loggers[0].keyData.Group,
+		SampleKeys:    []string{},
+		Format:        opts.Format,
+		Compress:      opts.Compress,
+		Mode:          opts.Mode,
+		StdoutMode:    opts.StdoutMode,
+		StderrMode:    opts.StderrMode,
+		FlushInterval: opts.FlushInterval.String(),
+		FlushBytes:    opts.FlushBytes,
+		AdaptiveFlush: opts.AdaptiveFlush,
+		MaxBufferSize: opts.MaxBufferSize,
+		SplitStreams:  opts.SplitStreams,
+		SpoolDir:      opts.SpoolDir,
+		WAL:           opts.WAL,
+		SSE:           opts.SSE,
+		SSEKMSKeyID:   opts.SSEKMSKeyID,
+		SSECKeyFile:   opts.SSECKeyFile,
+		Credentials:   credentialsSource(opts),
+		AccessKeyID:   maskAccessKeyID(opts.AccessKeyID),
+		RoleARN:       opts.AssumeRoleARN,
+		Profile:       opts.Profile,
+		Proxy:         redactURL(opts.ProxyURL),
+		LogOpts:       maskLogOpts(cfg),
+	}
+	for _, r := range opts.Replicas {
+		c.Replicas = append(c.Replicas, r.Bucket)
+	}
+	now := time.Now()
+	for _, l := range loggers {
+		c.SampleKeys = append(c.SampleKeys, l.sampleKey(now))
+	}
+	return c
+}
+
+// sampleKey returns the key an object flushed at t would get, numbered as
+// the first object and line, and the first of its time slice.
+func (l *S3Logger) sampleKey(t time.Time) string {
+	data := l.keyData
+	data.Sequence = fmt.Sprintf(sequenceFormat, 1)
+	data.FirstSeq = fmt.Sprintf(lineSequenceFormat, 1)
+	data.TimeSlice, data.Index = l.timeSlice(t), "0"
+	key, _ := renderKey(l.keyTmpl, data, t)
+	key = l.opts.S3Prefix + l.partition(t) + withUniqueSuffix(key, l.uniqueSuffix(t))
+	if codec, ok := codecs[l.opts.Compress]; ok {
+		key += codec.ext
+	}
+	return key
+}
+
+// RunConfig runs the config command, which asks the running plugin for the
+// configuration a container's logger runs with and prints it as JSON. It
+// returns the exit status.
+func RunConfig(args []string) int {
+	fs := flag.NewFlagSet(driverName+" config", flag.ExitOnError)
+	containerID := fs.String("container-id", "", "ID, or unique ID prefix, of the container whose configuration is printed")
+	socketPath := fs.String(socketPathKey, defaultSocketPath, "path of the running plugin's unix socket")
+	timeout := fs.Duration("timeout", 10*time.Second, "time the request may take")
+	fs.Parse(args)
+
+	if *containerID == "" {
+		fmt.Fprintln(os.Stderr, "--container-id is required")
+		return 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	c, err := requestConfig(ctx, *socketPath, *containerID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s\n", data)
+	return 0
+}
+
+// requestConfig asks the plugin listening on socketPath for the
+// configuration of container id.
+func requestConfig(ctx context.Context, socketPath, id string) (*containerConfig, error) {
+	body, err := json.Marshal(ConfigRequest{ContainerID: id})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://plugin"+configPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := socketClient(socketPath).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach plugin on %s: %v", socketPath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("plugin on %s answered %s, is it a version with the config command?", socketPath, resp.Status)
+	}
+	var res ConfigResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("invalid response from plugin: %v", err)
+	}
+	if res.Err != "" {
+		return nil, errors.New(res.Err)
+	}
+	return res.Config, nil
+}
+
+// socketClient returns a client of the plugin API served on socketPath.
+func socketClient(socketPath string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}}
+}
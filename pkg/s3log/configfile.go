@@ -0,0 +1,343 @@
+package s3log
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	configFileKey = "config-file"
+
+	// configEnvPrefix starts the env var that overrides each of the plugin's
+	// flags, such as S3LOGDRIVER_FLUSH_INTERVAL for --flush-interval.
+	configEnvPrefix = "S3LOGDRIVER_"
+
+	logLevelKey = "log-level"
+)
+
+// mutablePluginFlags are the plugin's own flags a reload of the config file
+// applies, besides the container defaults of mutableLogOpts. Anything else
+// takes a restart of the plugin.
+var mutablePluginFlags = map[string]bool{
+	logLevelKey: true,
+	maxPutsKey:  true,
+}
+
+// flagConfig holds the value of each of the plugin's flags, by name, and
+// where it came from: its default, overridden by the config file, then by
+// the command line, then by its env var.
+type flagConfig struct {
+	path    string
+	values  map[string]string
+	sources map[string]string // "" for the default
+	args    []string
+	tenants map[string]map[string]string
+}
+
+// configEnv returns the env var overriding flag name.
+func configEnv(name string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadFlagConfig returns the values of fs's flags given args, the command
+// line fs was parsed from, with the config file the command line or its env
+// var names, and the env vars.
+func loadFlagConfig(fs *flag.FlagSet, args []string) (*flagConfig, error) {
+	cmdline, err := rawFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	c := &flagConfig{path: cmdline[configFileKey], values: map[string]string{}, sources: map[string]string{}, args: args}
+	if v, ok := os.LookupEnv(configEnv(configFileKey)); ok {
+		c.path = v
+	}
+	file := map[string]string{}
+	if c.path != "" {
+		if file, c.tenants, err = readConfigFile(c.path); err != nil {
+			return nil, err
+		}
+	}
+	for name := range file {
+		if fs.Lookup(name) == nil || name == configFileKey {
+			return nil, fmt.Errorf("invalid config file %s: unknown flag %q", c.path, name)
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		v, src := f.DefValue, ""
+		if fv, ok := file[f.Name]; ok {
+			v, src = fv, "config file "+c.path
+		}
+		if av, ok := cmdline[f.Name]; ok {
+			v, src = av, "--"+f.Name
+		}
+		if ev, ok := os.LookupEnv(configEnv(f.Name)); ok {
+			v, src = ev, "$"+configEnv(f.Name)
+		}
+		c.values[f.Name], c.sources[f.Name] = v, src
+	})
+	return c, nil
+}
+
+// rawFlag records the value a flag is given on the command line as it was
+// written.
+type rawFlag struct {
+	values  map[string]string
+	name    string
+	boolean bool
+}
+
+func (f *rawFlag) String() string     { return "" }
+func (f *rawFlag) IsBoolFlag() bool   { return f.boolean }
+func (f *rawFlag) Set(v string) error { f.values[f.name] = v; return nil }
+
+// rawFlags returns the values of fs's flags that args set, as written.
+func rawFlags(fs *flag.FlagSet, args []string) (map[string]string, error) {
+	values := map[string]string{}
+	raw := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	raw.SetOutput(io.Discard)
+	fs.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		raw.Var(&rawFlag{values: values, name: f.Name, boolean: ok && b.IsBoolFlag()}, f.Name, f.Usage)
+	})
+	if err := raw.Parse(args); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// readConfigFile returns the flags the YAML file at path sets, by name
+// without their dashes, and the settings of each tenant its tenants section
+// sets, by tenant. A list is joined with commas.
+func readConfigFile(path string) (map[string]string, map[string]map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading config file: %v", err)
+	}
+	var doc map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	values := make(map[string]string, len(doc))
+	var tenants map[string]map[string]string
+	for name, node := range doc {
+		if name == tenantsKey {
+			if tenants, err = configTenants(&node); err != nil {
+				return nil, nil, fmt.Errorf("invalid config file %s: %v", path, err)
+			}
+			continue
+		}
+		if values[name], err = configValue(name, &node); err != nil {
+			return nil, nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+	}
+	return values, tenants, nil
+}
+
+// configValue returns the value node sets name to, joining a list with
+// commas.
+func configValue(name string, node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Value, nil
+	case yaml.SequenceNode:
+		var items []string
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("%s must be a value or a list of values", name)
+			}
+			items = append(items, item.Value)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("%s must be a value or a list of values", name)
+	}
+}
+
+// configTenants returns the settings of each tenant of the tenants section
+// node, a mapping of tenants to mappings of settings.
+func configTenants(node *yaml.Node) (map[string]map[string]string, error) {
+	var sections map[string]map[string]yaml.Node
+	if err := node.Decode(&sections); err != nil {
+		return nil, fmt.Errorf("%s must map each tenant to its settings", tenantsKey)
+	}
+	tenants := make(map[string]map[string]string, len(sections))
+	for name, section := range sections {
+		tenants[name] = make(map[string]string, len(section))
+		for key, node := range section {
+			v, err := configValue(tenantsKey+"."+name+"."+key, &node)
+			if err != nil {
+				return nil, err
+			}
+			tenants[name][key] = v
+		}
+	}
+	return tenants, nil
+}
+
+// apply sets fs's flags that the config file or an env var set, as fs was
+// already parsed from the command line.
+func (c *flagConfig) apply(fs *flag.FlagSet) error {
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if src := c.sources[f.Name]; src == "" || src == "--"+f.Name {
+			return
+		}
+		if err := fs.Set(f.Name, c.values[f.Name]); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q%s: %v", f.Name, c.values[f.Name], c.origin(f.Name), err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// origin describes where flag name's value came from, and what overrides
+// it, for errors about the value.
+func (c *flagConfig) origin(name string) string {
+	switch src := c.sources[name]; {
+	case src == "":
+		return ""
+	case strings.HasPrefix(src, "$"):
+		return fmt.Sprintf(" (from %s, which overrides --%s and the config file)", src, name)
+	case strings.HasPrefix(src, "--"):
+		return fmt.Sprintf(" (from %s, which overrides the config file and is overridden by $%s)", src, configEnv(name))
+	default:
+		return fmt.Sprintf(" (from %s, which --%s and $%s override)", src, name, configEnv(name))
+	}
+}
+
+// changed returns the names of the flags whose values differ between c and
+// next, sorted.
+func (c *flagConfig) changed(next *flagConfig) []string {
+	var names []string
+	for name, v := range next.values {
+		if c.values[name] != v {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// logOptions returns the container defaults c's values set, as optionFlags
+// would parse them.
+func (c *flagConfig) logOptions() (LogOption, error) {
+	var opts LogOption
+	fs := flag.NewFlagSet(driverName, flag.ContinueOnError)
+	optionFlags(fs, &opts)
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if c.sources[f.Name] == "" {
+			return
+		}
+		if err := fs.Set(f.Name, c.values[f.Name]); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q%s: %v", f.Name, c.values[f.Name], c.origin(f.Name), err))
+		}
+	})
+	return opts, errors.Join(errs...)
+}
+
+// reload reads the config file again, returning the plugin's config as it
+// now is. Of the flags that changed, those of mutablePluginFlags and
+// mutableLogOpts are applied to the plugin and to the running containers
+// that don't set them themselves, and the rest are warned about, as they
+// take a restart. Nothing is applied if any value is invalid, for the plugin
+// or for one of its containers.
+func (d *Driver) reload(fs *flag.FlagSet, c *flagConfig) (*flagConfig, error) {
+	next, err := loadFlagConfig(fs, c.args)
+	if err != nil {
+		return c, err
+	}
+	changed := c.changed(next)
+	// The tenants are set up once, when the plugin starts.
+	if !maps.EqualFunc(c.tenants, next.tenants, maps.Equal) {
+		logrus.WithField("file", next.path).Warnf("config file changes its %s section, which only takes effect when the plugin restarts", tenantsKey)
+		next.tenants = c.tenants
+	}
+	if len(changed) == 0 {
+		logrus.WithField("file", next.path).Info("reloaded config file, nothing changed")
+		return next, nil
+	}
+	var applied, fixed []string
+	for _, name := range changed {
+		if mutablePluginFlags[name] || mutableLogOpts[name] {
+			applied = append(applied, name)
+		} else {
+			fixed = append(fixed, name)
+		}
+	}
+	// The flags that need a restart keep their running values until then.
+	for _, name := range fixed {
+		next.values[name], next.sources[name] = c.values[name], c.sources[name]
+	}
+
+	fresh, err := next.logOptions()
+	if err != nil {
+		return c, err
+	}
+	opts := d.defaults()
+	opts.setMutable(fresh)
+	level, err := parseLogLevel(next.values[logLevelKey])
+	if err != nil {
+		return c, fmt.Errorf("invalid %s %q%s: %v", logLevelKey, next.values[logLevelKey], next.origin(logLevelKey), err)
+	}
+	maxPuts, err := strconv.ParseFloat(next.values[maxPutsKey], 64)
+	if err != nil || maxPuts < 0 {
+		return c, fmt.Errorf("invalid --%s %s%s: must be a non-negative number", maxPutsKey, next.values[maxPutsKey], next.origin(maxPutsKey))
+	}
+	d.mu.Lock()
+	containers := make([]*logPair, 0, len(d.logs))
+	for _, lf := range d.logs {
+		containers = append(containers, lf)
+	}
+	d.mu.Unlock()
+	for _, lf := range containers {
+		if _, err := d.tenantOptions(opts, lf.info, lf.logOpts()); err != nil {
+			return c, fmt.Errorf("invalid config file %s for container %s: %v", next.path, lf.info.ContainerID, err)
+		}
+	}
+
+	d.optsMu.Lock()
+	d.opts = opts
+	d.optsMu.Unlock()
+	logrus.SetLevel(level)
+	if lim := d.pool.putLimiter(); lim != nil {
+		setPutLimit(lim, maxPuts)
+	}
+	for _, lf := range containers {
+		d.reloadContainer(lf, opts)
+	}
+	for _, name := range applied {
+		logrus.WithField("flag", name).WithField("old", c.values[name]).WithField("new", next.values[name]).Info("applied config file change")
+	}
+	if len(fixed) > 0 {
+		logrus.WithField("flags", strings.Join(fixed, ",")).Warn("config file changes flags that only take effect when the plugin restarts")
+	}
+	return next, nil
+}
+
+// reloadContainer has lf's loggers pick up the mutable options of the
+// plugin's new defaults, opts, that its log-opts don't set.
+func (d *Driver) reloadContainer(lf *logPair, opts LogOption) {
+	lf.updateMu.Lock()
+	defer lf.updateMu.Unlock()
+	copts, err := d.tenantOptions(opts, lf.info, lf.logOpts())
+	if err != nil {
+		logrus.WithField("id", lf.info.ContainerID).WithError(err).Error("error applying config file to container")
+		return
+	}
+	l, _ := lf.logger()
+	for _, l := range s3Loggers(l) {
+		if err := l.update(copts); err != nil {
+			l.log().WithError(err).Error("error applying config file to container")
+		}
+	}
+}
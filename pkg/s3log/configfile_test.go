@@ -0,0 +1,194 @@
+package s3log
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// testFlags returns the flags of the plugin a reload reads, as Serve
+// defines them.
+func testFlags() *flag.FlagSet {
+	var opts LogOption
+	fs := flag.NewFlagSet(driverName, flag.ContinueOnError)
+	fs.String(configFileKey, "", "")
+	fs.String(logLevelKey, "", "")
+	fs.Float64(maxPutsKey, 0, "")
+	fs.Int(uploadWorkersKey, defaultUploadWorkers, "")
+	optionFlags(fs, &opts)
+	return fs
+}
+
+// writeConfigFile writes a config file of content to the test's temp dir,
+// or over path if it is given.
+func writeConfigFile(t *testing.T, path, content string) string {
+	t.Helper()
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "config.yaml")
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFlagConfig(t *testing.T) {
+	// The config file overrides a flag's default, the command line the
+	// file, and its env var everything.
+	tests := []struct {
+		name       string
+		file       string
+		args       []string
+		env        string // of flush-interval
+		want       string
+		wantOrigin string
+		wantErr    string
+	}{
+		{name: "default", want: "5s"},
+		{name: "file", file: "flush-interval: 10s\n", want: "10s", wantOrigin: "(from config file "},
+		{name: "command line", file: "flush-interval: 10s\n", args: []string{"--" + flushIntervalKey, "20s"}, want: "20s", wantOrigin: "(from --" + flushIntervalKey + ", which overrides the config file"},
+		{name: "env", file: "flush-interval: 10s\n", args: []string{"--" + flushIntervalKey, "20s"}, env: "30s", want: "30s", wantOrigin: "(from $S3LOGDRIVER_FLUSH_INTERVAL, which overrides --" + flushIntervalKey},
+		{name: "unknown flag", file: "flush-intervl: 10s\n", wantErr: `unknown flag "flush-intervl"`},
+		{name: "not yaml", file: "flush-interval: [10s\n", wantErr: "invalid config file"},
+		{name: "nested value", file: "flush-interval:\n  a: b\n", wantErr: "must be a value or a list of values"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := testFlags()
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"--" + configFileKey, writeConfigFile(t, "", tt.file)}, args...)
+			}
+			if tt.env != "" {
+				t.Setenv(configEnv(flushIntervalKey), tt.env)
+			}
+			c, err := loadFlagConfig(fs, args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loaded config returned %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.values[flushIntervalKey]; got != tt.want {
+				t.Errorf("%s = %s, want %s", flushIntervalKey, got, tt.want)
+			}
+			if origin := c.origin(flushIntervalKey); !strings.Contains(origin, tt.wantOrigin) || (tt.wantOrigin == "") != (origin == "") {
+				t.Errorf("origin %q, want %q", origin, tt.wantOrigin)
+			}
+			if err := fs.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.apply(fs); err != nil {
+				t.Fatal(err)
+			}
+			if got := fs.Lookup(flushIntervalKey).Value.String(); got != tt.want {
+				t.Errorf("flag set to %s once applied, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadFlagConfigFile(t *testing.T) {
+	// The file is named by the command line or its env var, lists are
+	// joined with commas, and an invalid value names where it came from.
+	fs := testFlags()
+	path := writeConfigFile(t, "", "upload-workers: lots\nno-proxy: [a.internal, b.internal]\n")
+	t.Setenv(configEnv(configFileKey), path)
+	c, err := loadFlagConfig(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.path != path || c.values[noProxyKey] != "a.internal,b.internal" {
+		t.Errorf("loaded %s with no-proxy %q, want %s with the list joined", c.path, c.values[noProxyKey], path)
+	}
+	err = c.apply(fs)
+	if err == nil || !strings.Contains(err.Error(), `invalid upload-workers "lots" (from config file `+path+", which --upload-workers and $S3LOGDRIVER_UPLOAD_WORKERS override)") {
+		t.Errorf("applied the config with %v, want the invalid value and its origin", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	level := logrus.GetLevel()
+	t.Cleanup(func() { logrus.SetLevel(level) })
+
+	fake := newFakeS3()
+	d := newTestDriver(t, fake, nil)
+	fs := testFlags()
+	path := writeConfigFile(t, "", "flush-interval: 1h\nlog-level: info\n")
+	c, err := loadFlagConfig(fs, []string{"--" + configFileKey, path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	following := startContainer(t, d, nil)
+	defer following.stop(t, d)
+	own := startContainer(t, d, map[string]string{flushIntervalKey: "2h"})
+	defer own.stop(t, d)
+
+	// A bad value leaves everything as it was.
+	interval := following.l.flushInterval()
+	writeConfigFile(t, path, "flush-interval: soon\nlog-level: debug\n")
+	if next, err := d.reload(fs, c); err == nil || next != c {
+		t.Fatalf("reload of a bad value returned %v", err)
+	}
+	if logrus.GetLevel() == logrus.DebugLevel || following.l.flushInterval() != interval {
+		t.Fatal("reload of a bad value applied the rest")
+	}
+
+	writeConfigFile(t, path, "flush-interval: 50ms\nlog-level: debug\ns3-bucket: elsewhere\n")
+	hook.Reset()
+	c, err = d.reload(fs, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logrus.GetLevel() != logrus.DebugLevel {
+		t.Errorf("log level %s after reload, want debug", logrus.GetLevel())
+	}
+	if got := following.l.flushInterval(); got != 50*time.Millisecond {
+		t.Errorf("container following the defaults flushes every %s, want the reloaded 50ms", got)
+	}
+	if got := own.l.flushInterval(); got != 2*time.Hour {
+		t.Errorf("container setting its own flush-interval flushes every %s, want its 2h", got)
+	}
+	if got := d.defaults(); got.FlushInterval != 50*time.Millisecond || got.S3Bucket != testBucket {
+		t.Errorf("defaults after reload flush every %s to %s, want 50ms to the bucket as it was", got.FlushInterval, got.S3Bucket)
+	}
+	if c.values[s3BucketKey] == "elsewhere" {
+		t.Error("config kept the bucket change that takes a restart")
+	}
+	applied := map[string]bool{}
+	var restart string
+	for _, e := range hook.AllEntries() {
+		if e.Message == "applied config file change" {
+			applied[e.Data["flag"].(string)] = true
+		}
+		if e.Level == logrus.WarnLevel && strings.Contains(e.Message, "restart") {
+			restart, _ = e.Data["flags"].(string)
+		}
+	}
+	if !applied[flushIntervalKey] || !applied[logLevelKey] || len(applied) != 2 {
+		t.Errorf("logged changes applied to %v, want flush-interval and log-level", applied)
+	}
+	if restart != s3BucketKey {
+		t.Errorf("warned of %q taking a restart, want %s", restart, s3BucketKey)
+	}
+
+	// The running container picks up the new interval at once.
+	following.write(t, entry("stdout", "line", time.Now()))
+	waitFor(t, "the flush on the reloaded interval", func() bool { return len(containerRecords(t, fake, following.info.ContainerID)) == 1 })
+
+	// Reloading the same file changes nothing.
+	if next, err := d.reload(fs, c); err != nil || next.changed(c) != nil {
+		t.Errorf("reload of the same file changed %q: %v", next.changed(c), err)
+	}
+}
@@ -0,0 +1,277 @@
+package s3log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	dailyBytesBudgetKey  = "daily-bytes-budget"
+	dailyObjectBudgetKey = "daily-object-budget"
+	overBudgetPolicyKey  = "over-budget-policy"
+
+	overBudgetDrop     = "drop"
+	overBudgetSpool    = "spool"
+	overBudgetContinue = "continue-with-warning"
+
+	// costBudgetName is the file the day's usage is kept in, under the
+	// state-dir.
+	costBudgetName = "cost-budget.json"
+
+	costBudgetDayFormat = "2006-01-02"
+)
+
+// errOverBudget holds off draining the spool while a budget with the spool
+// policy is exceeded.
+var errOverBudget = errors.New("daily budget exceeded, not uploading")
+
+var (
+	costBudgetUsedBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: driverName,
+		Name:      "cost_budget_used_bytes",
+		Help:      "Bytes uploaded so far today (UTC), counted against daily-bytes-budget.",
+	})
+	costBudgetUsedObjects = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: driverName,
+		Name:      "cost_budget_used_objects",
+		Help:      "Objects uploaded so far today (UTC), counted against daily-object-budget.",
+	})
+	costBudgetExceeded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: driverName,
+		Name:      "cost_budget_exceeded",
+		Help:      "1 while a daily budget is exceeded and the over-budget-policy is in effect, 0 otherwise.",
+	}, []string{"policy"})
+	costBudgetDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "cost_budget_dropped_batches_total",
+		Help:      "Batches dropped, or spooled for want of a spool, by the drop over-budget-policy.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(costBudgetUsedBytes, costBudgetUsedObjects, costBudgetExceeded, costBudgetDropped)
+}
+
+// costUsage is what has been uploaded on a UTC day, as kept in the budget's
+// file.
+type costUsage struct {
+	Day     string `json:"day"`
+	Bytes   int64  `json:"bytes"`
+	Objects int64  `json:"objects"`
+}
+
+// costBudget caps the bytes and objects uploaded across every container on
+// the host each UTC day, which is what S3 charges for. Once either is used
+// up, uploads follow the policy until midnight: their batches are dropped,
+// spooled until the next day, or uploaded anyway with a warning. Usage is
+// kept in a file so that a restarted plugin carries on counting the same
+// day; without one it starts from nothing.
+//
+// A tenant's budget caps what its containers upload, within the host's.
+type costBudget struct {
+	maxBytes   int64
+	maxObjects int64
+	policy     string
+	path       string
+	tenant     string      // "" for the host's
+	host       *costBudget // the host's, counted against too, for a tenant's
+
+	mu     sync.Mutex
+	usage  costUsage
+	warned bool // whether the day's crossing has been logged
+}
+
+// newCostBudget returns the budget of tenant, or of the host if tenant is "",
+// or nil if neither maxBytes nor maxObjects is set. Usage is read from and
+// saved to path, if it is set.
+func newCostBudget(maxBytes, maxObjects int64, policy, path, tenant string) (*costBudget, error) {
+	if maxBytes < 0 || maxObjects < 0 {
+		return nil, fmt.Errorf("invalid %s or %s: must not be negative", dailyBytesBudgetKey, dailyObjectBudgetKey)
+	}
+	switch policy {
+	case overBudgetDrop, overBudgetSpool, overBudgetContinue:
+	default:
+		return nil, fmt.Errorf("invalid %s %q: must be %q, %q or %q", overBudgetPolicyKey, policy, overBudgetDrop, overBudgetSpool, overBudgetContinue)
+	}
+	if maxBytes == 0 && maxObjects == 0 {
+		return nil, nil
+	}
+	b := &costBudget{maxBytes: maxBytes, maxObjects: maxObjects, policy: policy, path: path, tenant: tenant}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &b.usage); err != nil {
+				return nil, fmt.Errorf("invalid budget file %q: %v", path, err)
+			}
+		}
+	}
+	b.mu.Lock()
+	b.roll(time.Now())
+	b.report()
+	b.mu.Unlock()
+	return b, nil
+}
+
+// roll starts a new day's count once now is past midnight UTC. A clock
+// stepped back over midnight doesn't go back to the day before, whose count
+// is gone. Callers must hold b.mu.
+func (b *costBudget) roll(now time.Time) {
+	day := now.UTC().Format(costBudgetDayFormat)
+	if day <= b.usage.Day {
+		return
+	}
+	b.usage = costUsage{Day: day}
+	b.warned = false
+}
+
+// exceeded reports whether either budget is used up. Callers must hold b.mu.
+func (b *costBudget) exceeded() bool {
+	return (b.maxBytes > 0 && b.usage.Bytes >= b.maxBytes) ||
+		(b.maxObjects > 0 && b.usage.Objects >= b.maxObjects)
+}
+
+// report sets the budget's metrics. Callers must hold b.mu.
+func (b *costBudget) report() {
+	exceeded := 0.0
+	if b.exceeded() {
+		exceeded = 1
+	}
+	if b.tenant != "" {
+		tenantBudgetUsedBytes.WithLabelValues(b.tenant).Set(float64(b.usage.Bytes))
+		tenantBudgetUsedObjects.WithLabelValues(b.tenant).Set(float64(b.usage.Objects))
+		tenantBudgetExceeded.WithLabelValues(b.tenant, b.policy).Set(exceeded)
+		return
+	}
+	costBudgetUsedBytes.Set(float64(b.usage.Bytes))
+	costBudgetUsedObjects.Set(float64(b.usage.Objects))
+	costBudgetExceeded.WithLabelValues(b.policy).Set(exceeded)
+}
+
+// check returns the policy uploads follow while the budget is used up, or ""
+// while it isn't or there is no budget. The first upload over budget each day
+// is logged. A tenant's budget that isn't used up returns the host's policy.
+func (b *costBudget) check() string {
+	if b == nil {
+		return ""
+	}
+	if policy := b.checkDay(); policy != "" {
+		return policy
+	}
+	return b.host.check()
+}
+
+// checkDay is check for this budget alone.
+func (b *costBudget) checkDay() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(time.Now())
+	b.report()
+	if !b.exceeded() {
+		return ""
+	}
+	if !b.warned {
+		b.warned = true
+		log := logrus.WithField("day", b.usage.Day)
+		if b.tenant != "" {
+			log = log.WithField("tenant", b.tenant)
+		}
+		log.WithField("bytes", b.usage.Bytes).WithField("objects", b.usage.Objects).
+			Warnf("daily upload budget exceeded, applying %s %q until midnight UTC", overBudgetPolicyKey, b.policy)
+	}
+	return b.policy
+}
+
+// charge counts an uploaded object of n bytes against the day's budget, and
+// the host's for a tenant's.
+func (b *costBudget) charge(n int) {
+	if b == nil {
+		return
+	}
+	defer b.host.charge(n)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(time.Now())
+	b.usage.Bytes += int64(n)
+	b.usage.Objects++
+	b.report()
+	if err := b.save(); err != nil {
+		logrus.WithField("file", b.path).WithError(err).Warn("error saving budget usage")
+	}
+}
+
+// save writes the day's usage to the budget's file, replacing it atomically.
+// Callers must hold b.mu.
+func (b *costBudget) save() error {
+	if b.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(b.usage)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path), 0700); err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// costBudgetStats is the budget as the SIGUSR1 dump reports it.
+type costBudgetStats struct {
+	Day          string `json:"day"`
+	BytesUsed    int64  `json:"bytes_used"`
+	ObjectsUsed  int64  `json:"objects_used"`
+	BytesBudget  int64  `json:"bytes_budget,omitempty"`
+	ObjectBudget int64  `json:"object_budget,omitempty"`
+	Policy       string `json:"policy"`
+	Exceeded     bool   `json:"exceeded"`
+}
+
+// stats returns the budget's state for the SIGUSR1 dump, or nil if there is
+// no budget.
+func (b *costBudget) stats() *costBudgetStats {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(time.Now())
+	b.report()
+	return &costBudgetStats{
+		Day:          b.usage.Day,
+		BytesUsed:    b.usage.Bytes,
+		ObjectsUsed:  b.usage.Objects,
+		BytesBudget:  b.maxBytes,
+		ObjectBudget: b.maxObjects,
+		Policy:       b.policy,
+		Exceeded:     b.exceeded(),
+	}
+}
+
+// costBudget returns the host's daily budget, or nil if there is none.
+func (p *uploadPool) costBudget() *costBudget {
+	if p == nil {
+		return nil
+	}
+	return p.cost
+}
@@ -0,0 +1,155 @@
+package s3log
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/sirupsen/logrus"
+)
+
+// credentialsTimeout bounds how long the plugin waits at startup for the
+// default chain to yield credentials.
+const credentialsTimeout = 30 * time.Second
+
+// ecsCredentialsHost serves the credentials of an ECS task's role at the path
+// in AWS_CONTAINER_CREDENTIALS_RELATIVE_URI.
+const ecsCredentialsHost = "http://169.254.170.2"
+
+// imdsHopLimitHint is added to the error when no provider yields credentials,
+// since an IMDSv2 token doesn't survive the extra hop into a container unless
+// the instance allows it.
+const imdsHopLimitHint = "on EC2, a plugin or container reaching the instance role through IMDSv2 needs a metadata hop limit of at least 2, " +
+	"e.g. aws ec2 modify-instance-metadata-options --instance-id <id> --http-put-response-hop-limit 2"
+
+// credentialSource is a provider in the plugin's default credential chain.
+type credentialSource struct {
+	name     string
+	provider aws.CredentialsProvider
+}
+
+// credentialChain is the plugin's default credential chain, used by
+// containers that don't configure credentials of their own. Rather than
+// leave it to the shared config, the providers for IRSA web identity tokens
+// and ECS task roles are built from their environment variables, so that
+// they are found inside the plugin's rootfs.
+type credentialChain struct {
+	sources []credentialSource
+
+	mu  sync.Mutex
+	won string // name of the source that last yielded credentials
+}
+
+// defaultCredentials is the plugin's default chain, once loadAWSConfig has
+// built it, so that the config command can say which source it uses.
+var defaultCredentials *credentialChain
+
+// source returns the name of the source that last yielded credentials, or
+// "" if none has.
+func (c *credentialChain) source() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.won
+}
+
+// newCredentialChain returns the default chain for the plugin's environment:
+// static keys from the environment, the shared config if there is any, a web
+// identity token, the ECS container credentials endpoint and finally the EC2
+// instance role through IMDSv2. cfg is the config loaded from the
+// environment, whose credentials are used for the shared config.
+func newCredentialChain(cfg aws.Config) *credentialChain {
+	var sources []credentialSource
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		sources = append(sources, credentialSource{"environment", credentials.NewStaticCredentialsProvider(id, secret, os.Getenv("AWS_SESSION_TOKEN"))})
+	}
+	if hasSharedConfig() && cfg.Credentials != nil {
+		sources = append(sources, credentialSource{"shared-config", cfg.Credentials})
+	}
+	if file, role := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN"); file != "" && role != "" {
+		client := sts.NewFromConfig(cfg, func(o *sts.Options) {
+			if o.Region == "" {
+				o.Region = "us-east-1"
+			}
+		})
+		sources = append(sources, credentialSource{"web-identity", stscreds.NewWebIdentityRoleProvider(client, role, stscreds.IdentityTokenFile(file), func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = os.Getenv("AWS_ROLE_SESSION_NAME")
+			if o.RoleSessionName == "" {
+				o.RoleSessionName = defaultRoleSessionName
+			}
+		})})
+	}
+	if endpoint := ecsCredentialsEndpoint(); endpoint != "" {
+		sources = append(sources, credentialSource{"ecs", endpointcreds.New(endpoint, func(o *endpointcreds.Options) {
+			if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+				o.AuthorizationTokenProvider = endpointcreds.TokenProviderFunc(func() (string, error) {
+					token, err := os.ReadFile(file)
+					return strings.TrimSpace(string(token)), err
+				})
+			} else {
+				o.AuthorizationToken = os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+			}
+		})})
+	}
+	sources = append(sources, credentialSource{"imds", ec2rolecreds.New()})
+	return &credentialChain{sources: sources}
+}
+
+// hasSharedConfig reports whether a profile is selected or a shared config or
+// credentials file exists.
+func hasSharedConfig() bool {
+	if os.Getenv("AWS_PROFILE") != "" {
+		return true
+	}
+	for _, path := range []string{
+		os.Getenv("AWS_SHARED_CREDENTIALS_FILE"), config.DefaultSharedCredentialsFilename(),
+		os.Getenv("AWS_CONFIG_FILE"), config.DefaultSharedConfigFilename(),
+	} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ecsCredentialsEndpoint returns the URL an ECS task's role credentials are
+// served at, or "" outside ECS.
+func ecsCredentialsEndpoint() string {
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return ecsCredentialsHost + uri
+	}
+	return os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+}
+
+// Retrieve returns the credentials of the first source that yields any,
+// logging which one it was whenever that changes.
+func (c *credentialChain) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	var errs []string
+	for _, s := range c.sources {
+		creds, err := s.provider.Retrieve(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", s.name, err))
+			continue
+		}
+		c.mu.Lock()
+		if c.won != s.name {
+			logrus.WithField("provider", s.name).Info("using AWS credentials")
+			c.won = s.name
+		}
+		c.mu.Unlock()
+		return creds, nil
+	}
+	return aws.Credentials{}, fmt.Errorf("no AWS credentials found (%s); %s", strings.Join(errs, "; "), imdsHopLimitHint)
+}
@@ -0,0 +1,180 @@
+package s3log
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/sirupsen/logrus"
+)
+
+const credentialsFileKey = "aws-credentials-file"
+
+// fileCredentials are the credentials in a file such as a Docker secret,
+// read again whenever the file changes so that rotating it takes effect on
+// the next request. The secrets are never logged or written to disk, and
+// errors never quote the file's contents.
+type fileCredentials struct {
+	path    string
+	profile string // section of an ini file, if not the default one
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	creds   aws.Credentials
+}
+
+func newFileCredentials(path, profile string) *fileCredentials {
+	return &fileCredentials{path: path, profile: profile}
+}
+
+// Retrieve returns the credentials in the file, reading it again if it has
+// changed since it was last read. A file that can no longer be read or
+// parsed keeps the credentials it last held, to ride out a rotation that
+// rewrites it in place, until it changes again.
+func (f *fileCredentials) Retrieve(context.Context) (aws.Credentials, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info, err := os.Stat(f.path)
+	if err == nil && f.creds.HasKeys() && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.creds, nil
+	}
+	var creds aws.Credentials
+	if err == nil {
+		creds, err = f.load()
+	} else {
+		err = fmt.Errorf("error reading %s: %v", credentialsFileKey, err)
+	}
+	if err != nil {
+		if !f.creds.HasKeys() {
+			return aws.Credentials{}, err
+		}
+		if info != nil {
+			f.modTime, f.size = info.ModTime(), info.Size()
+		}
+		logrus.WithField("file", f.path).WithError(err).Warn("error reloading AWS credentials, keeping the last ones")
+		return f.creds, nil
+	}
+	if f.creds.HasKeys() {
+		logrus.WithField("file", f.path).Info("reloaded AWS credentials")
+	}
+	f.creds, f.modTime, f.size = creds, info.ModTime(), info.Size()
+	return creds, nil
+}
+
+// load reads the credentials in the file: JSON as the AWS CLI prints them,
+// such as from sts assume-role or a credential_process, or else an ini file
+// in the format of the shared credentials file.
+func (f *fileCredentials) load() (aws.Credentials, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("error reading %s: %v", credentialsFileKey, err)
+	}
+	var creds aws.Credentials
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '{' {
+		creds, err = parseCredentialsJSON(data)
+	} else {
+		creds, err = parseCredentialsINI(data, f.profile)
+	}
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("invalid %s %q: %v", credentialsFileKey, f.path, err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return aws.Credentials{}, fmt.Errorf("invalid %s %q: must hold an access key ID and secret access key", credentialsFileKey, f.path)
+	}
+	creds.Source = credentialsFileKey
+	return creds, nil
+}
+
+// credentialsJSON is the shape of credentials printed by the AWS CLI, either
+// bare or under Credentials.
+type credentialsJSON struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+	Credentials     *credentialsJSON
+}
+
+func parseCredentialsJSON(data []byte) (aws.Credentials, error) {
+	var c credentialsJSON
+	if err := json.Unmarshal(data, &c); err != nil {
+		// json's own errors may quote a character of the secrets.
+		return aws.Credentials{}, errors.New("not valid JSON")
+	}
+	if c.Credentials != nil {
+		c = *c.Credentials
+	}
+	return aws.Credentials{
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.SessionToken,
+		CanExpire:       !c.Expiration.IsZero(),
+		Expires:         c.Expiration,
+	}, nil
+}
+
+// parseCredentialsINI returns the credentials in the section of data named
+// profile, or if it is empty the default section, the only one or the keys
+// outside any section. Sections may be named "profile <name>" as in the
+// shared config file.
+func parseCredentialsINI(data []byte, profile string) (aws.Credentials, error) {
+	sections := make(map[string]map[string]string)
+	var names []string
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+			continue
+		case line[0] == '[':
+			if !strings.HasSuffix(line, "]") {
+				return aws.Credentials{}, fmt.Errorf("line %d: unterminated section", n)
+			}
+			section = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line[1:len(line)-1]), "profile "))
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return aws.Credentials{}, fmt.Errorf("line %d: must be key = value", n)
+		}
+		if sections[section] == nil {
+			sections[section] = make(map[string]string)
+			names = append(names, section)
+		}
+		sections[section][strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+	}
+	if err := scanner.Err(); err != nil {
+		return aws.Credentials{}, err
+	}
+
+	var keys map[string]string
+	switch {
+	case profile != "":
+		if keys = sections[profile]; keys == nil {
+			return aws.Credentials{}, fmt.Errorf("no section for %s %q", profileKey, profile)
+		}
+	case sections["default"] != nil:
+		keys = sections["default"]
+	case len(names) == 1:
+		keys = sections[names[0]]
+	case len(names) == 0:
+		// No keys at all, which load reports.
+	default:
+		return aws.Credentials{}, fmt.Errorf("no default section, set %s to one of %s", profileKey, strings.Join(names, ", "))
+	}
+	return aws.Credentials{
+		AccessKeyID:     keys["aws_access_key_id"],
+		SecretAccessKey: keys["aws_secret_access_key"],
+		SessionToken:    keys["aws_session_token"],
+	}, nil
+}
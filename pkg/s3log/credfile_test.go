@@ -0,0 +1,253 @@
+package s3log
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// testSecret is the secret access key of the credentials files written by
+// the tests, which must never show up in an error or log.
+const testSecret = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+
+// writeCredentials writes data to the credentials file at path, stamped
+// with mtime so that a rewrite within the file system's resolution is seen
+// as a change.
+func writeCredentials(t *testing.T, path, data string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCredentialsFile(t *testing.T) {
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name    string
+		data    string
+		profile string
+		want    aws.Credentials
+		wantErr string
+	}{
+		{
+			name: "JSON",
+			data: `{"AccessKeyId": "AKID", "SecretAccessKey": "` + testSecret + `"}`,
+			want: aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: testSecret},
+		},
+		{
+			name: "assume-role JSON",
+			data: `{"Credentials": {"AccessKeyId": "ASIA", "SecretAccessKey": "` + testSecret + `", "SessionToken": "TOKEN", "Expiration": "2030-01-02T03:04:05Z"}}`,
+			want: aws.Credentials{AccessKeyID: "ASIA", SecretAccessKey: testSecret, SessionToken: "TOKEN", CanExpire: true, Expires: expires},
+		},
+		{
+			name: "ini default",
+			data: "# rotated nightly\n[other]\naws_access_key_id = OTHER\naws_secret_access_key = x\n\n[default]\naws_access_key_id = AKID\naws_secret_access_key = " + testSecret + "\naws_session_token = TOKEN\n",
+			want: aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: testSecret, SessionToken: "TOKEN"},
+		},
+		{
+			name: "ini single section",
+			data: "[logs]\nAWS_ACCESS_KEY_ID=AKID\naws_secret_access_key=" + testSecret + "\n",
+			want: aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: testSecret},
+		},
+		{
+			name: "ini without sections",
+			data: "aws_access_key_id=AKID\naws_secret_access_key=" + testSecret + "\n",
+			want: aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: testSecret},
+		},
+		{
+			name:    "ini profile",
+			data:    "[default]\naws_access_key_id=DEFAULT\naws_secret_access_key=x\n[profile logs]\naws_access_key_id=AKID\naws_secret_access_key=" + testSecret + "\n",
+			profile: "logs",
+			want:    aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: testSecret},
+		},
+		{name: "missing profile", data: "[default]\naws_access_key_id=AKID\naws_secret_access_key=" + testSecret + "\n", profile: "logs", wantErr: `no section for aws-profile "logs"`},
+		{name: "no default", data: "[a]\naws_access_key_id=A\naws_secret_access_key=x\n[b]\naws_access_key_id=B\naws_secret_access_key=y\n", wantErr: "set aws-profile to one of a, b"},
+		{name: "unterminated section", data: "[default\naws_access_key_id=AKID\n", wantErr: "line 1: unterminated section"},
+		{name: "not key = value", data: "[default]\n" + testSecret + "\n", wantErr: "line 2: must be key = value"},
+		{name: "no secret", data: "aws_access_key_id=AKID\n", wantErr: "must hold an access key ID and secret access key"},
+		{name: "invalid JSON", data: `{"AccessKeyId": "AKID", "SecretAccessKey": "` + testSecret, wantErr: "not valid JSON"},
+		{name: "empty", wantErr: "must hold an access key ID and secret access key"},
+		{name: "only comments", data: "# filled in at deploy time\n", wantErr: "must hold an access key ID and secret access key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "creds")
+			writeCredentials(t, path, tt.data, time.Now())
+			got, err := newFileCredentials(path, tt.profile).Retrieve(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Retrieve returned %v, want an error containing %q", err, tt.wantErr)
+				}
+				if strings.Contains(err.Error(), testSecret) || !strings.Contains(err.Error(), path) {
+					t.Errorf("error %q, want the path without the secret", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want.Source = credentialsFileKey
+			if got != tt.want {
+				t.Errorf("Retrieve = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCredentialsFileRotation(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	path := filepath.Join(t.TempDir(), "creds")
+	f := newFileCredentials(path, "")
+	if _, err := f.Retrieve(context.Background()); err == nil || !strings.Contains(err.Error(), path) {
+		t.Fatalf("Retrieve of a missing file returned %v, want an error naming it", err)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	steps := []struct {
+		name string
+		data string // written unless empty
+		want string // the access key ID retrieved
+	}{
+		{name: "first", data: "aws_access_key_id=ONE\naws_secret_access_key=" + testSecret, want: "ONE"},
+		{name: "unchanged", want: "ONE"},
+		{name: "rotated", data: "aws_access_key_id=TWO\naws_secret_access_key=" + testSecret, want: "TWO"},
+		// A rewrite caught halfway keeps the last credentials until the
+		// file changes again.
+		{name: "half written", data: "aws_access_key_id=THREE\n", want: "TWO"},
+		{name: "rotated again", data: "aws_access_key_id=THREE\naws_secret_access_key=" + testSecret, want: "THREE"},
+	}
+	for i, step := range steps {
+		if step.data != "" {
+			writeCredentials(t, path, step.data, start.Add(time.Duration(i)*time.Minute))
+		}
+		creds, err := f.Retrieve(context.Background())
+		if err != nil || creds.AccessKeyID != step.want {
+			t.Fatalf("%s: Retrieve = %q, %v, want %q", step.name, creds.AccessKeyID, err, step.want)
+		}
+	}
+	for _, e := range hook.AllEntries() {
+		if s, _ := e.String(); strings.Contains(s, testSecret) {
+			t.Errorf("logged the secret: %s", s)
+		}
+	}
+}
+
+// signedS3 is an S3 endpoint recording the access key ID each PUT was
+// signed with, and answering anything else with an empty 200.
+type signedS3 struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+var credentialScope = regexp.MustCompile(`Credential=([^/]+)/`)
+
+func (s *signedS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	if r.Method != http.MethodPut {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m := credentialScope.FindStringSubmatch(r.Header.Get("Authorization")); m != nil {
+		s.keys = append(s.keys, m[1])
+	}
+	w.Header().Set("ETag", `"etag"`)
+}
+
+func (s *signedS3) signers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.keys)
+}
+
+// credentialsFileInfo returns the Info of a container uploading to srv with
+// the credentials in path.
+func credentialsFileInfo(t *testing.T, srv *httptest.Server, path string) Info {
+	return Info{
+		Config: testLogOpts(t, map[string]string{
+			endpointURLKey:     srv.URL,
+			forcePathStyleKey:  "true",
+			credentialsFileKey: path,
+			flushIntervalKey:   "1h",
+		}),
+		ContainerID:   testContainerID(t),
+		ContainerName: "/test",
+	}
+}
+
+func TestCredentialsFileUploads(t *testing.T) {
+	// Rotating the file takes effect on the next upload.
+	s := &signedS3{}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "creds")
+	writeCredentials(t, path, "aws_access_key_id=ONE\naws_secret_access_key="+testSecret, time.Now().Add(-time.Hour))
+	clients := newTestClients(nil)
+	clients.newClient = newS3Client
+	info := credentialsFileInfo(t, srv, path)
+	cl, _ := newClientsLogger(t, clients, info)
+	l := s3Loggers(cl)[0]
+
+	logLines(t, l, time.Now(), "signed by one")
+	if err := l.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	writeCredentials(t, path, `{"AccessKeyId": "TWO", "SecretAccessKey": "`+testSecret+`"}`, time.Now())
+	logLines(t, l, time.Now(), "signed by two")
+	if err := l.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.signers(); len(got) != 2 || got[0] != "ONE" || got[1] != "TWO" {
+		t.Errorf("uploads signed by %q, want ONE then TWO", got)
+	}
+
+	// The container's config names the file, never what it holds.
+	if got := describeConfig(s3Loggers(cl), l.opts, info.Config); got.Credentials != `credentials file "`+path+`"` {
+		t.Errorf("config gives credentials %q, want the file", got.Credentials)
+	}
+}
+
+func TestCredentialsFileStart(t *testing.T) {
+	// A file that can't be read or holds no credentials fails the start,
+	// naming only the path.
+	s := &signedS3{}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid")
+	writeCredentials(t, invalid, "[default]\n"+testSecret+"\n", time.Now())
+	for _, path := range []string{filepath.Join(dir, "missing"), invalid} {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			info := credentialsFileInfo(t, srv, path)
+			opts, err := parseLogOpts(DefaultOptions(), info.Config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clients := newTestClients(nil)
+			clients.newClient = newS3Client
+			d := newDriver(clients, newUploadPool(1, defaultBreakerThreshold, defaultBreakerCooldown, 0), newMemoryBudget(defaultMaxTotalBuffer), opts)
+			t.Cleanup(d.cancel)
+			_, err = newLogger(d.clients, d.pool, d.budget, opts, info, nil, nil)
+			if err == nil || !strings.Contains(err.Error(), path) || strings.Contains(err.Error(), testSecret) {
+				t.Errorf("start failed with %v, want an error naming the path without the secret", err)
+			}
+		})
+	}
+}
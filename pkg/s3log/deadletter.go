@@ -0,0 +1,185 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	deadLetterKey              = "dead-letter"
+	deadLetterMaxBytesKey      = "dead-letter-max-bytes"
+	deadLetterFlushIntervalKey = "dead-letter-flush-interval"
+
+	defaultDeadLetterMaxBytes      = 1 << 20
+	defaultDeadLetterFlushInterval = time.Minute
+
+	// deadLetterDir holds a container's dead-letter objects, next to its
+	// manifest.
+	deadLetterDir = "_errors/"
+
+	reasonTruncated   = "line exceeded max-line-bytes and was truncated"
+	reasonPartial     = "partial line exceeded max-partial-bytes and was truncated"
+	reasonIncomplete  = "partial line was incomplete when the container stopped"
+	reasonInvalidUTF8 = "line is not valid UTF-8 and was stored with U+FFFD in its place"
+	reasonSuppressed  = "dead-letter-max-bytes reached, further records were only counted"
+
+	reasonPartialTimeout = "partial line was incomplete after max-partial-age and was truncated"
+	reasonPartialEvicted = "partial line was truncated to make room under max-partial-groups"
+)
+
+// deadRecord is a line of a dead-letter object: a line the logger couldn't
+// store as it was logged, and why. The line is left out of records for
+// partial lines, which can be a megabyte long, and is base64-encoded when it
+// isn't valid UTF-8. The last record of an object counts those suppressed
+// once the object reached dead-letter-max-bytes.
+type deadRecord struct {
+	Time          time.Time `json:"time"`
+	ContainerID   string    `json:"container_id"`
+	ContainerName string    `json:"container_name"`
+	Stream        string    `json:"stream,omitempty"`
+	Reason        string    `json:"reason"`
+	Bytes         int       `json:"bytes,omitempty"`
+	Line          string    `json:"line,omitempty"`
+	LineBase64    []byte    `json:"line_base64,omitempty"`
+	Suppressed    int64     `json:"suppressed,omitempty"`
+}
+
+// deadLetters accumulates a logger's dead-letter records until they are
+// uploaded every dead-letter-flush-interval, so that problem lines are kept
+// out of the data objects without being lost. It holds at most
+// dead-letter-max-bytes between uploads, past which records are only
+// counted, so that a container logging nothing but bad lines can't double
+// its footprint. It is guarded by the logger's mu.
+type deadLetters struct {
+	buf        []byte
+	records    int
+	suppressed int64
+	seq        int64 // of the last object uploaded
+}
+
+// deadLetter records msg, whose line is size bytes, for the dead-letter
+// objects with reason. msg's line is left out if nil, and redacted if
+// redact-patterns is set. Callers must hold l.mu.
+func (l *S3Logger) deadLetter(msg *Message, reason string, size int) {
+	d := l.dead
+	if d == nil {
+		return
+	}
+	r := deadRecord{
+		Time:          msg.Timestamp.UTC(),
+		ContainerID:   l.info.ContainerID,
+		ContainerName: l.info.Name(),
+		Stream:        msg.Source,
+		Reason:        reason,
+		Bytes:         size,
+	}
+	line := msg.Line
+	if line != nil && l.redactor != nil {
+		line, _ = l.redactor.redact(line)
+	}
+	if utf8.Valid(line) {
+		r.Line = string(line)
+	} else {
+		r.LineBase64 = line
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	if len(d.buf)+len(data)+1 > l.opts.DeadLetterMaxBytes {
+		d.suppressed++
+		l.metrics.deadSuppressed.Inc()
+		return
+	}
+	d.buf = append(append(d.buf, data...), '\n')
+	d.records++
+	l.metrics.deadLettered.Inc()
+}
+
+// deadLetterLoop uploads the dead-letter records every
+// dead-letter-flush-interval until the logger is closed.
+func (l *S3Logger) deadLetterLoop() {
+	defer l.wg.Done()
+	t := time.NewTicker(l.opts.DeadLetterFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-t.C:
+			l.flushDeadLetters(l.ctx)
+		}
+	}
+}
+
+// deadLetterPrefix returns the prefix of the container's dead-letter
+// objects, which listings of its logs skip.
+func (l *S3Logger) deadLetterPrefix() string {
+	prefix := l.containerKeyPrefix()
+	if prefix == "" {
+		prefix = l.info.ContainerID + "/"
+	}
+	return l.opts.S3Prefix + prefix + deadLetterDir
+}
+
+// deadLetterPath returns the key of the seq'th dead-letter object, uploaded
+// at t.
+func (l *S3Logger) deadLetterPath(t time.Time, seq int64) string {
+	return fmt.Sprintf("%s%s-%06d.jsonl", l.deadLetterPrefix(), t.UTC().Format("20060102T150405Z"), seq)
+}
+
+// flushDeadLetters uploads the records accumulated since the last call as one
+// object in the primary bucket, retrying once. Like the run summary it is
+// best effort: records that can't be uploaded are logged and given up on,
+// rather than spooled, so a failing bucket doesn't make them pile up.
+func (l *S3Logger) flushDeadLetters(ctx context.Context) {
+	l.mu.Lock()
+	d := l.dead
+	if d == nil || d.records == 0 && d.suppressed == 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	body := d.buf
+	records, suppressed := d.records, d.suppressed
+	if suppressed > 0 {
+		data, _ := json.Marshal(deadRecord{
+			Time:          now.UTC(),
+			ContainerID:   l.info.ContainerID,
+			ContainerName: l.info.Name(),
+			Reason:        reasonSuppressed,
+			Suppressed:    suppressed,
+		})
+		body = append(append(body, data...), '\n')
+	}
+	d.buf, d.records, d.suppressed = nil, 0, 0
+	d.seq++
+	key := l.deadLetterPath(now, d.seq)
+	l.mu.Unlock()
+
+	t := l.targets[0]
+	b := &batch{
+		Bucket:       t.bucket,
+		Key:          key,
+		ContentType:  contentType(formatJSONL),
+		ContainerID:  l.info.ContainerID,
+		SSE:          l.opts.SSE,
+		SSEKMSKeyID:  l.opts.SSEKMSKeyID,
+		RequestPayer: l.opts.RequestPayer,
+		Client:       t.cfg,
+		Tag:          l.keyData.Tag,
+		body:         body,
+	}
+	l.retain(b)
+	err := retry(ctx, 1, l.opts.MaxRetryDelay, func() error {
+		return uploadBatch(ctx, t.uploader, b)
+	})
+	if err != nil {
+		s3Failed(l.log().WithField("key", key).WithField("records", records), t.bucket, err).Warn("error writing dead-letter records")
+		return
+	}
+	l.log().WithField("key", key).WithField("records", records).WithField("suppressed", suppressed).Debug("wrote dead-letter records")
+}
@@ -0,0 +1,293 @@
+package s3log
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	dedupeWindowKey      = "dedupe-window"
+	dedupeGranularityKey = "dedupe-granularity"
+
+	dedupeBatch  = "batch"
+	dedupeRecord = "record"
+
+	eventDuplicate = "duplicate"
+
+	// dedupeMaxHashes bounds the hashes a group of loggers keeps from one
+	// flush to the next, the oldest of which are forgotten first. A flush
+	// of many distinct records may hold up to twice as many.
+	dedupeMaxHashes = 4096
+)
+
+var dedupeHashes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: driverName,
+	Name:      "dedupe_hashes",
+	Help:      "Hashes of recent batches or records held for dedupe-window.",
+})
+
+func init() {
+	metricsRegistry.MustRegister(dedupeHashes)
+}
+
+// dedupeEntry is the hash of a batch, or a record, uploaded within the
+// window: Seq is the sequence number of its first line, Seen when it was
+// uploaded and Count how often it has been repeated since.
+type dedupeEntry struct {
+	Hash  uint64    `json:"hash"`
+	Seq   int64     `json:"seq"`
+	Count int       `json:"count,omitempty"`
+	Seen  time.Time `json:"seen"`
+}
+
+// dedupeWindow holds the hashes uploaded within dedupe-window by the loggers
+// of a container and of the containers that replace it, sharing its stable
+// key or its ID across a restart, so that a crash-looping container's
+// repeated output is uploaded once.
+type dedupeWindow struct {
+	group  string
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[uint64]*dedupeEntry
+	order   []*dedupeEntry // oldest first
+	users   int
+}
+
+// dedupeWindows are the windows of every group with a logger or with hashes
+// still within their window, so that a restarted container picks up the
+// hashes of the last run.
+var dedupeWindows = struct {
+	sync.Mutex
+	all map[string]*dedupeWindow
+}{all: make(map[string]*dedupeWindow)}
+
+// dedupeGroup returns the key of the logger's window in dedupeWindows.
+func (l *S3Logger) dedupeGroup() string {
+	return l.bucket + "\x00" + l.identityPrefix() + "\x00" + l.opts.stream + "\x00" + l.opts.DedupeGranularity
+}
+
+// acquireDedupe returns the logger's window, or nil without dedupe-window.
+// A group that has none yet starts with the hashes saved in the logger's
+// state, those of its last run before the plugin restarted.
+func (l *S3Logger) acquireDedupe(saved []dedupeEntry) *dedupeWindow {
+	if l.opts.DedupeWindow == 0 {
+		return nil
+	}
+	group := l.dedupeGroup()
+	now := time.Now()
+	dedupeWindows.Lock()
+	defer dedupeWindows.Unlock()
+	for g, w := range dedupeWindows.all {
+		w.mu.Lock()
+		w.expire(now)
+		idle := w.users == 0 && len(w.order) == 0
+		w.mu.Unlock()
+		if idle {
+			delete(dedupeWindows.all, g)
+		}
+	}
+	w := dedupeWindows.all[group]
+	if w == nil {
+		w = &dedupeWindow{group: group, window: l.opts.DedupeWindow, entries: make(map[uint64]*dedupeEntry)}
+		for _, e := range saved {
+			w.add(e)
+		}
+		dedupeWindows.all[group] = w
+	}
+	w.mu.Lock()
+	w.users++
+	w.window = l.opts.DedupeWindow
+	w.expire(now)
+	w.mu.Unlock()
+	return w
+}
+
+// release lets w be forgotten once its hashes are out of the window.
+func (w *dedupeWindow) release() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.users--
+	w.mu.Unlock()
+}
+
+// add holds e. Callers must hold w.mu.
+func (w *dedupeWindow) add(e dedupeEntry) {
+	if _, ok := w.entries[e.Hash]; ok {
+		return
+	}
+	w.entries[e.Hash] = &e
+	w.order = append(w.order, &e)
+	dedupeHashes.Inc()
+	if len(w.order) >= 2*dedupeMaxHashes {
+		w.expire(e.Seen)
+	}
+}
+
+// expire forgets the hashes seen longer than the window ago, and the oldest
+// over dedupeMaxHashes. Callers must hold w.mu.
+func (w *dedupeWindow) expire(now time.Time) {
+	n := 0
+	for n < len(w.order) && (now.Sub(w.order[n].Seen) >= w.window || len(w.order)-n > dedupeMaxHashes) {
+		delete(w.entries, w.order[n].Hash)
+		n++
+	}
+	if n > 0 {
+		w.order = slices.Delete(w.order, 0, n)
+		dedupeHashes.Sub(float64(n))
+	}
+}
+
+// saved returns w's hashes, for the logger's state.
+func (w *dedupeWindow) saved() []dedupeEntry {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.expire(time.Now())
+	entries := make([]dedupeEntry, len(w.order))
+	for i, e := range w.order {
+		entries[i] = *e
+	}
+	return entries
+}
+
+// seen returns the entry of h within the window, counting the repeat, or
+// else holds h as first seen now with seq. Callers must hold w.mu.
+func (w *dedupeWindow) seen(h uint64, seq int64, now time.Time) (dedupeEntry, bool) {
+	if e, ok := w.entries[h]; ok {
+		e.Count++
+		return *e, true
+	}
+	w.add(dedupeEntry{Hash: h, Seq: seq, Seen: now})
+	return dedupeEntry{}, false
+}
+
+// duplicateEvent is the record that replaces lines repeating those numbered
+// from OfSeq, first uploaded at FirstSeen and repeated Count times since.
+type duplicateEvent struct {
+	Event     string    `json:"event"`
+	OfSeq     int64     `json:"of_seq"`
+	Lines     int       `json:"lines"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// dedupe returns body, the lines numbered from firstSeq, with those repeating
+// lines uploaded within dedupe-window replaced by a duplicate record: the
+// whole of it if it repeats an earlier batch, or with dedupe-granularity=record
+// each run of records repeating a run uploaded before. A duplicate record is
+// only written where it is shorter than the lines it replaces. Callers must
+// hold l.flushMu.
+func (l *S3Logger) dedupe(body []byte, firstSeq int64) []byte {
+	if l.hashes == nil {
+		return body
+	}
+	now := time.Now()
+	l.hashes.mu.Lock()
+	defer l.hashes.mu.Unlock()
+	l.hashes.expire(now)
+	var out []byte
+	if l.opts.DedupeGranularity == dedupeBatch {
+		out = l.dedupeObject(body, firstSeq, now)
+	} else {
+		out = l.dedupeRecords(body, firstSeq, now)
+	}
+	if len(out) < len(body) {
+		l.metrics.dedupedBytes.Add(float64(len(body) - len(out)))
+	}
+	return out
+}
+
+func (l *S3Logger) dedupeObject(body []byte, firstSeq int64, now time.Time) []byte {
+	d := xxhash.New()
+	lines := 0
+	var first time.Time
+	for rest := body; len(rest) > 0; lines++ {
+		var line []byte
+		line, rest, _ = bytes.Cut(rest, []byte{'\n'})
+		msg := l.format.decode(line, time.Time{})
+		if lines == 0 {
+			first = msg.Timestamp
+		}
+		d.WriteString(msg.Source)
+		d.Write([]byte{0})
+		d.Write(msg.Line)
+	}
+	e, ok := l.hashes.seen(d.Sum64(), firstSeq, now)
+	if !ok {
+		return body
+	}
+	ref := l.duplicateRecord(nil, e, lines, firstSeq, first, now)
+	if len(ref) >= len(body) {
+		return body
+	}
+	l.metrics.deduplicated.Add(float64(lines))
+	return ref
+}
+
+func (l *S3Logger) dedupeRecords(body []byte, firstSeq int64, now time.Time) []byte {
+	out := make([]byte, 0, len(body))
+	// run is the run of repeated lines being replaced, which start at
+	// runStart in body and repeat those from runOf.Seq.
+	var runOf dedupeEntry
+	var runStart, runLines int
+	var runSeq int64
+	var runTime time.Time
+	end := func(at int) {
+		if runLines == 0 {
+			return
+		}
+		replaced := body[runStart:at]
+		if ref := l.duplicateRecord(nil, runOf, runLines, runSeq, runTime, now); len(ref) < len(replaced) {
+			out = append(out, ref...)
+			l.metrics.deduplicated.Add(float64(runLines))
+		} else {
+			out = append(out, replaced...)
+		}
+		runLines = 0
+	}
+	seq := firstSeq
+	for at := 0; at < len(body); seq++ {
+		line, _, _ := bytes.Cut(body[at:], []byte{'\n'})
+		next := min(at+len(line)+1, len(body))
+		msg := l.format.decode(line, time.Time{})
+		d := xxhash.New()
+		d.WriteString(msg.Source)
+		d.Write([]byte{0})
+		d.Write(msg.Line)
+		e, ok := l.hashes.seen(d.Sum64(), seq, now)
+		switch {
+		case !ok:
+			end(at)
+			out = append(out, body[at:next]...)
+		case runLines > 0 && e.Seq == runOf.Seq+int64(runLines):
+			runLines++
+		default:
+			end(at)
+			runOf, runStart, runLines, runSeq, runTime = e, at, 1, seq, msg.Timestamp
+		}
+		at = next
+	}
+	end(len(body))
+	return out
+}
+
+// duplicateRecord appends the record replacing lines lines, the first of
+// them numbered seq and logged at t, that repeat those of e.
+func (l *S3Logger) duplicateRecord(dst []byte, e dedupeEntry, lines int, seq int64, t, now time.Time) []byte {
+	if t.IsZero() {
+		t = now
+	}
+	event, _ := json.Marshal(duplicateEvent{Event: eventDuplicate, OfSeq: e.Seq, Lines: lines, Count: e.Count, FirstSeen: e.Seen.UTC()})
+	return l.format.marker(dst, event, seq, t)
+}
@@ -0,0 +1,21 @@
+// Package s3log batches, partitions and uploads log lines to S3. It is the
+// whole of the Docker log driver plugin, which serves it to the daemon and
+// runs its commands, and can be embedded in other programs to upload the
+// lines of sources outside Docker the same way:
+//
+//	opts := s3log.DefaultOptions()
+//	opts.S3Bucket = "logs"
+//	opts.Compress = "zstd"
+//	l, err := s3log.New(opts, s3log.Info{ContainerID: "journald-web-01", ContainerName: "web"})
+//	if err != nil {
+//		return err
+//	}
+//	defer l.Close()
+//	return l.WriteMessage(s3log.Message{Line: line, Source: "stdout", Timestamp: ts})
+//
+// Every log-opt is a field of LogOption, documented in the README under the
+// log-opt's name; Info.Config takes log-opts by name as well, overriding the
+// fields. The package doesn't import the Docker daemon: Message, Info and
+// the other types it is driven with mirror the daemon's, and the plugin
+// converts between them.
+package s3log
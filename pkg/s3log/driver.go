@@ -0,0 +1,582 @@
+package s3log
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/containerd/fifo"
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	protoio "github.com/gogo/protobuf/io"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Driver is the plugin's side of the Docker log driver API: it logs each
+// container the daemon starts logging to a FIFO, and reads their logs back.
+type Driver struct {
+	mu      sync.Mutex
+	logs    map[string]*logPair
+	idx     map[string]*logPair
+	spools  map[string]*spool
+	logger  containerLogger
+	clients *clientFactory
+	pool    *uploadPool
+	budget  *memoryBudget
+	opts    LogOption // the containers' defaults, guarded by optsMu
+	optsMu  sync.Mutex
+	ready   *readiness
+
+	compactor *compactor
+	openCache OpenCacheStore
+
+	// allowedRetention is the retention-days containers may ask for, any
+	// of them if empty.
+	allowedRetention []int
+
+	// docker follows the daemon's events, with --docker-socket, and
+	// stopping tracks the run summaries waiting on them for an exit code.
+	docker   *dockerEvents
+	stopping sync.WaitGroup
+
+	// closing is set, under mu, once the plugin is shutting down, after
+	// which no container is started.
+	closing bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type logPair struct {
+	stream io.ReadCloser
+	info   Info
+	fifo   os.FileInfo   // of the FIFO when it was opened
+	done   chan struct{} // closed once consumeLog returns
+
+	// routines runs consumeLog, which stopping lf waits for along with the
+	// logger's own goroutines.
+	routines *routines
+
+	// logMu is held while a line is logged and across a handoff, so that
+	// every line goes to either the old logger or the new one.
+	logMu sync.Mutex
+
+	mu    sync.Mutex // guards l, cache and updated, which a handoff replaces
+	l     containerLogger
+	cache *logCache
+
+	// updated holds the log-opts changed by the update command since l was
+	// started, and updateMu serializes the changes.
+	updated  map[string]string
+	updateMu sync.Mutex
+}
+
+// logger returns the logger lf's lines currently go to, along with its
+// cache.
+func (lf *logPair) logger() (containerLogger, *logCache) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.l, lf.cache
+}
+
+// logOpts returns the log-opts lf's logger runs with: the container's,
+// with the changes of the update command.
+func (lf *logPair) logOpts() map[string]string {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	cfg := maps.Clone(lf.info.Config)
+	if cfg == nil {
+		cfg = map[string]string{}
+	}
+	maps.Copy(cfg, lf.updated)
+	return cfg
+}
+
+// stopDrainTimeout is how long StopLogging waits for the daemon to close its
+// end of the FIFO, so that every line it wrote is read, before closing the
+// FIFO itself.
+const stopDrainTimeout = 5 * time.Second
+
+// stop waits for the FIFO to be drained, or closes it after stopDrainTimeout,
+// and then closes the logger, flushing its buffer. A blocking logger whose
+// buffer is full may hold up the last line read from the FIFO until a flush
+// makes room; if none has within another stopDrainTimeout the logger is
+// abandoned. Before the logger is closed, drained is called with it if it
+// isn't nil.
+func (lf *logPair) stop(drained func(containerLogger)) error {
+	t := time.NewTimer(stopDrainTimeout)
+	defer t.Stop()
+	select {
+	case <-lf.done:
+	case <-t.C:
+		logrus.WithField("id", lf.info.ContainerID).Warn("timed out draining log fifo, closing it")
+		t.Reset(stopDrainTimeout)
+	}
+	lf.stream.Close()
+	select {
+	case <-lf.done:
+	case <-t.C:
+		logrus.WithField("id", lf.info.ContainerID).Warn("timed out waiting for buffer space, abandoning pending flushes")
+		l, _ := lf.logger()
+		if a, ok := l.(interface{ abandon() }); ok {
+			a.abandon()
+		}
+		<-lf.done
+	}
+	// A handoff still in progress has to finish before the logger it
+	// installs can be closed.
+	lf.logMu.Lock()
+	defer lf.logMu.Unlock()
+	l, _ := lf.logger()
+	if l == nil {
+		return nil
+	}
+	if drained != nil {
+		drained(l)
+	}
+	return l.Close()
+}
+
+func newDriver(clients *clientFactory, pool *uploadPool, budget *memoryBudget, opts LogOption) *Driver {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Driver{
+		logs:    make(map[string]*logPair),
+		idx:     make(map[string]*logPair),
+		spools:  make(map[string]*spool),
+		clients: clients,
+		pool:    pool,
+		budget:  budget,
+		opts:    opts,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// defaults returns the options containers start from before their log-opts.
+func (d *Driver) defaults() LogOption {
+	d.optsMu.Lock()
+	defer d.optsMu.Unlock()
+	return d.opts
+}
+
+// spoolFor returns the spool for dir, creating it and starting its drainer
+// the first time dir is seen. Batches left over from a previous run are
+// drained along with new ones.
+func (d *Driver) spoolFor(dir string, maxBytes int64) (*spool, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if sp, ok := d.spools[dir]; ok {
+		return sp, nil
+	}
+	sp, err := newSpool(dir, maxBytes, func(ctx context.Context, b *batch) error {
+		ctx = withTenant(ctx, b.Tenant)
+		cost := d.pool.tenantBudget(tenantOf(ctx))
+		if cost.check() == overBudgetSpool {
+			return errOverBudget
+		}
+		client, err := d.clients.client(b.Client)
+		if err != nil {
+			return err
+		}
+		uploader, err := d.clients.uploader(b.Client, client)
+		if err != nil {
+			return err
+		}
+		err = d.pool.upload(ctx, b.Bucket, d.defaults().S3RequestTimeout, func(ctx context.Context) error {
+			return uploadBatch(ctx, uploader, b)
+		})
+		if err == nil {
+			cost.charge(len(b.body))
+			d.clients.notifyUpload(ctx, b)
+			if b.Manifest != "" {
+				merr := updateManifest(ctx, client, b.Bucket, b.Manifest, b.RequestPayer, b.Retention, func(m *manifest) { m.add(b.manifestObject(false)) })
+				if merr != nil {
+					s3Failed(logrus.WithField("id", b.ContainerID).WithField("bucket", b.Bucket), b.Bucket, merr).Warn("error updating manifest")
+				}
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.spools[dir] = sp
+	sp.start(d.ctx)
+	return sp, nil
+}
+
+// StartLogging starts a logger reading the container's FIFO. A daemon that
+// restarts without stopping its containers starts logging again to a FIFO
+// that already has a logger; that one is stopped first, flushing what it
+// holds and keeping its state for the new one. Until the startup probe has
+// succeeded, containers are refused.
+func (d *Driver) StartLogging(file string, logCtx Info) error {
+	if err := d.ready.check(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	running, closing := d.logs[file], d.closing
+	d.mu.Unlock()
+	if closing {
+		return errShuttingDown
+	}
+	if running != nil && running.info.ContainerID == logCtx.ContainerID && running.samePipe(file) {
+		return d.handoff(running, file, logCtx)
+	}
+	if old := d.remove(file); old != nil {
+		logrus.WithField("id", old.info.ContainerID).WithField("file", file).Warn("logger for fifo already exists, replacing it")
+		if err := old.stop(nil); err != nil && !isUploadError(err) {
+			logrus.WithField("id", old.info.ContainerID).WithError(err).Warn("error closing replaced logger")
+		}
+		old.routines.wait(goroutineStopTimeout)
+		_, cache := old.logger()
+		cache.close()
+	}
+
+	l, cache, err := d.newContainerLogger(file, logCtx)
+	if err != nil {
+		return err
+	}
+	f, err := fifo.OpenFifo(context.Background(), file, syscall.O_RDONLY, 0700)
+	if err != nil {
+		l.Close()
+		cache.remove()
+		return errors.Wrapf(err, "error opening logger fifo: %q", file)
+	}
+	fi, _ := os.Stat(file)
+
+	d.mu.Lock()
+	if _, exists := d.logs[file]; exists || d.closing {
+		// Another StartLogging for the same FIFO won the race, or the
+		// plugin started shutting down.
+		d.mu.Unlock()
+		f.Close()
+		l.Close()
+		cache.close()
+		if !exists {
+			return errShuttingDown
+		}
+		return fmt.Errorf("logger for %q already exists", file)
+	}
+	lf := &logPair{l: l, stream: f, info: logCtx, fifo: fi, cache: cache, done: make(chan struct{}), routines: newRoutines(logCtx.ContainerID)}
+	d.logs[file] = lf
+	d.idx[logCtx.ContainerID] = lf
+	containersLogging.Set(float64(len(d.logs)))
+	d.mu.Unlock()
+
+	lf.routines.start("fifo", func() { consumeLog(lf) })
+	return nil
+}
+
+// containerOptions returns the options of a container logging with logCtx:
+// the plugin's, overridden by its tenant's and then by its own log-opts.
+func (d *Driver) containerOptions(logCtx Info) (LogOption, error) {
+	opts, err := d.tenantOptions(d.defaults(), logCtx, logCtx.Config)
+	if err != nil {
+		return opts, newOpError(opParseOptions, "", err)
+	}
+	if err := d.checkRetention(opts); err != nil {
+		return opts, newOpError(opParseOptions, "", err)
+	}
+	return opts, nil
+}
+
+// newContainerLogger returns the logger, and cache if any, of a container
+// starting to log to file with logCtx.
+func (d *Driver) newContainerLogger(file string, logCtx Info) (containerLogger, *logCache, error) {
+	opts, err := d.containerOptions(logCtx)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch types.StorageClass(opts.StorageClass) {
+	case types.StorageClassGlacier, types.StorageClassDeepArchive:
+		logrus.WithField("id", logCtx.ContainerID).Warnf("%s %s must be restored before docker logs can read it", storageClassKey, opts.StorageClass)
+	}
+
+	if opts.FIPS && opts.EndpointURL != "" {
+		logrus.WithField("id", logCtx.ContainerID).Warnf("%s is set, ignoring %s", endpointURLKey, fipsKey)
+	}
+
+	sp, err := d.spoolFor(opts.SpoolDir, opts.SpoolMaxBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cache *logCache
+	if !opts.CacheDisabled {
+		if cache, err = newLogCache(d.openCache, opts, logCtx); err != nil {
+			return nil, nil, err
+		}
+	}
+	l, err := newLogger(d.clients, d.pool, d.budget, opts, logCtx, sp, cache)
+	if err != nil {
+		cache.remove()
+		return nil, nil, err
+	}
+	logrus.WithField("id", logCtx.ContainerID).WithField("file", file).WithField("bucket", opts.S3Bucket).Debugf("Start logging")
+	return l, cache, nil
+}
+
+// StopLogging unregisters the container's logger, reads whatever is left in
+// its FIFO and flushes the logger. Uploads that fail in that last flush are
+// logged, not returned: the daemon can do nothing about them.
+func (d *Driver) StopLogging(file string) error {
+	logrus.WithField("file", file).Debugf("Stop logging")
+	lf := d.remove(file)
+	if lf == nil {
+		return nil
+	}
+	at := time.Now()
+	var exit *containerExit
+	err := lf.stop(func(l containerLogger) {
+		if r, ok := l.(interface {
+			recordExit(*dockerEvents, time.Time) *containerExit
+		}); ok {
+			exit = r.recordExit(d.docker, at)
+		}
+	})
+	lf.routines.wait(goroutineStopTimeout)
+	l, cache := lf.logger()
+	// The container is gone, so there is nothing left to resume.
+	if st, ok := l.(interface{ removeState() }); ok {
+		st.removeState()
+	}
+	cache.remove()
+	if m, ok := l.(interface{ closeManifest() }); ok {
+		m.closeManifest()
+	}
+	if s, ok := l.(interface{ writeSummary(*containerExit) }); ok {
+		if exit != nil && exit.ExitCode == nil && d.docker != nil {
+			// The daemon only reports the exit code once StopLogging
+			// has returned.
+			d.stopping.Add(1)
+			go func() {
+				defer d.stopping.Done()
+				d.docker.waitExitCode(d.ctx, exit)
+				s.writeSummary(exit)
+			}()
+		} else {
+			s.writeSummary(exit)
+		}
+	}
+	d.compactor.add(lf.info)
+	if isUploadError(err) {
+		// Already logged along with the batch it dropped.
+		logrus.WithField("id", lf.info.ContainerID).WithError(err).Debug("error flushing logs on stop")
+		return nil
+	}
+	return err
+}
+
+// remove unregisters the logger reading file, returning it, or nil if there
+// is none.
+func (d *Driver) remove(file string) *logPair {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lf, ok := d.logs[file]
+	if !ok {
+		return nil
+	}
+	delete(d.logs, file)
+	if d.idx[lf.info.ContainerID] == lf {
+		delete(d.idx, lf.info.ContainerID)
+	}
+	containersLogging.Set(float64(len(d.logs)))
+	return lf
+}
+
+// Close stops every active logger, flushing what they have buffered, and then
+// stops draining the spools, however long that takes.
+func (d *Driver) Close() {
+	_ = d.Shutdown(context.Background())
+}
+
+// consumeLog decodes the entries the daemon writes to the FIFO and hands them
+// to the logger until the FIFO is closed. A frame that can't be decoded leaves
+// the stream out of step, so it ends the stream as well.
+func consumeLog(lf *logPair) {
+	defer close(lf.done)
+	defer lf.stream.Close()
+	dec := newEntryReader(lf.stream)
+	// The entry, its line and the message are reused for every line, since
+	// the logger copies whatever it keeps of a message before Log returns.
+	var buf logdriver.LogEntry
+	var msg Message
+	var meta PartialLogMetaData
+	for {
+		if err := dec.read(&buf); err != nil {
+			if err == io.EOF || errors.Is(err, os.ErrClosed) || errors.Is(err, fifo.ErrReadClosed) {
+				logrus.WithField("id", lf.info.ContainerID).Debug("shutting down log logger")
+			} else if err == io.ErrUnexpectedEOF {
+				// The daemon's end went away in the middle of writing an
+				// entry, as it may when a container exits abruptly. The
+				// entries before it are whole, so it ends the stream like
+				// any other EOF.
+				logrus.WithField("id", lf.info.ContainerID).WithField("offset", dec.off).Warn("log fifo ended in the middle of an entry, dropping it")
+			} else {
+				logrus.WithField("id", lf.info.ContainerID).WithError(err).Error("error reading log fifo, shutting down log logger")
+			}
+			return
+		}
+		setMessage(&msg, &meta, &buf)
+		lf.logMu.Lock()
+		var err error
+		if l, _ := lf.logger(); l != nil {
+			err = l.Log(&msg)
+		}
+		lf.logMu.Unlock()
+		if err != nil {
+			logrus.WithField("id", lf.info.ContainerID).WithError(err).WithField("message", &msg).Error("error writing log message")
+		}
+	}
+}
+
+// maxEntrySize bounds the entries read from the FIFO.
+const maxEntrySize = 1e6
+
+// entryReader reads the length-prefixed entries the daemon writes to the
+// FIFO. Unlike protoio's reader it doesn't reset the entry before decoding
+// into it, so each line is decoded into the buffer of the one before.
+type entryReader struct {
+	r    *bufio.Reader
+	size [4]byte
+	buf  []byte
+	off  int64 // bytes of the stream read as whole entries
+}
+
+func newEntryReader(r io.Reader) *entryReader {
+	return &entryReader{r: bufio.NewReader(r)}
+}
+
+// read decodes the next entry into e, keeping the capacity of its line.
+func (r *entryReader) read(e *logdriver.LogEntry) error {
+	if _, err := io.ReadFull(r.r, r.size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(r.size[:])
+	if n > maxEntrySize {
+		return io.ErrShortBuffer
+	}
+	if int(n) > cap(r.buf) {
+		r.buf = make([]byte, n)
+	}
+	r.buf = r.buf[:n]
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	r.off += int64(len(r.size) + len(r.buf))
+	line := e.Line[:0]
+	e.Reset()
+	e.Line = line
+	return e.Unmarshal(r.buf)
+}
+
+// newMessage converts an entry read from a journal into a message.
+func newMessage(e *logdriver.LogEntry) *Message {
+	msg := new(Message)
+	setMessage(msg, new(PartialLogMetaData), e)
+	return msg
+}
+
+// setMessage overwrites msg with an entry read from the FIFO, pointing it at
+// meta if the entry is part of a partial line.
+func setMessage(msg *Message, meta *PartialLogMetaData, e *logdriver.LogEntry) {
+	*msg = Message{
+		Line:      e.Line,
+		Source:    e.Source,
+		Timestamp: time.Unix(0, e.TimeNano),
+	}
+	if e.PartialLogMetadata != nil {
+		*meta = PartialLogMetaData{
+			ID:      e.PartialLogMetadata.Id,
+			Last:    e.PartialLogMetadata.Last,
+			Ordinal: int(e.PartialLogMetadata.Ordinal),
+		}
+		msg.PLogMetaData = meta
+	}
+}
+
+func (d *Driver) ReadLogs(info Info, config ReadConfig) (io.ReadCloser, error) {
+	d.mu.Lock()
+	lf, exists := d.idx[info.ContainerID]
+	d.mu.Unlock()
+
+	var l containerLogger
+	var cache *logCache
+	if exists {
+		l, cache = lf.logger()
+	} else {
+		// The container is no longer running, but its logs are still in S3.
+		// There is nothing left to follow, nor to journal.
+		config.Follow = false
+		opts, err := d.tenantOptions(d.defaults(), info, info.Config)
+		if err != nil {
+			return nil, err
+		}
+		opts.WAL = false
+		if l, err = newLogger(d.clients, d.pool, nil, opts, info, nil, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	r, w := io.Pipe()
+	lr, ok := l.(logReader)
+	if cache != nil {
+		lr, ok = cache, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("logger does not support reading")
+	}
+
+	go func() {
+		if !exists {
+			defer l.Close()
+		}
+		watcher := lr.ReadLogs(config)
+
+		enc := protoio.NewUint32DelimitedWriter(w, binary.BigEndian)
+		defer enc.Close()
+		defer watcher.ConsumerGone()
+
+		var buf logdriver.LogEntry
+		for {
+			select {
+			case msg, ok := <-watcher.Msg:
+				if !ok {
+					w.Close()
+					return
+				}
+
+				buf.Line = msg.Line
+				buf.Partial = msg.PLogMetaData != nil
+				buf.TimeNano = msg.Timestamp.UnixNano()
+				buf.Source = msg.Source
+
+				if err := enc.WriteMsg(&buf); err != nil {
+					w.CloseWithError(err)
+					return
+				}
+			case err := <-watcher.Err:
+				w.CloseWithError(err)
+				return
+			}
+
+			buf.Reset()
+		}
+	}()
+
+	return r, nil
+}
@@ -0,0 +1,424 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/fifo"
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestDriverUploadsContainerLogs(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []string
+		lines   []string
+	}{
+		{name: "stdout", sources: []string{"stdout"}, lines: []string{"one", "two", "three"}},
+		{name: "stdout and stderr", sources: []string{"stdout", "stderr"}, lines: []string{"out", "err", "out again", "err again"}},
+		{name: "nothing logged", sources: []string{"stdout"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			d := newTestDriver(t, fake, nil)
+			c := startContainer(t, d, nil)
+			start := time.Now()
+			for i, line := range tt.lines {
+				c.write(t, entry(tt.sources[i%len(tt.sources)], line, start.Add(time.Duration(i))))
+			}
+			c.stop(t, d)
+
+			keys := fake.logKeys(testBucket)
+			if len(tt.lines) == 0 {
+				if len(keys) != 0 {
+					t.Fatalf("uploaded %q with nothing logged", keys)
+				}
+				return
+			}
+			// The lines are buffered into one object rather than a PUT each.
+			if len(keys) != 1 {
+				t.Fatalf("uploaded %q, want one object", keys)
+			}
+			if !strings.Contains(keys[0], c.info.ContainerID) {
+				t.Errorf("key %q doesn't name the container", keys[0])
+			}
+			msgs := objectMessages(t, c.l, keys[0])
+			var lines, sources []string
+			for _, m := range msgs {
+				lines = append(lines, strings.TrimSuffix(string(m.Line), "\n"))
+				sources = append(sources, m.Source)
+			}
+			if !slices.Equal(lines, tt.lines) {
+				t.Errorf("uploaded %q, want %q", lines, tt.lines)
+			}
+			for i, src := range sources {
+				if want := tt.sources[i%len(tt.sources)]; src != want {
+					t.Errorf("line %d from %q, want %q", i, src, want)
+				}
+			}
+		})
+	}
+}
+
+// encodeEntries returns entries as the daemon writes them to the FIFO.
+func encodeEntries(t testing.TB, entries ...*logdriver.LogEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := logdriver.NewLogEntryEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestEntryReader(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	partial := entry("stdout", "first half ", ts)
+	partial.Partial = true
+	partial.PartialLogMetadata = &logdriver.PartialLogEntryMetadata{Id: "p1", Ordinal: 1}
+	long := entry("stderr", strings.Repeat("x", 4096), ts)
+	data := encodeEntries(t, long, partial, entry("stdout", "short", ts))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []*logdriver.LogEntry
+		wantErr error
+	}{
+		{
+			// A shorter line after a longer one and a whole one after a
+			// partial are decoded without anything left of the one before.
+			name:    "reused",
+			data:    data,
+			want:    []*logdriver.LogEntry{long, partial, entry("stdout", "short", ts)},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "cut in the middle of an entry",
+			data:    data[:len(data)-3],
+			want:    []*logdriver.LogEntry{long, partial},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "entry over the limit",
+			data:    binary.BigEndian.AppendUint32(nil, maxEntrySize+1),
+			wantErr: io.ErrShortBuffer,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newEntryReader(bytes.NewReader(tt.data))
+			var e logdriver.LogEntry
+			var got []*logdriver.LogEntry
+			var err error
+			for {
+				if err = r.read(&e); err != nil {
+					break
+				}
+				c := e
+				c.Line = bytes.Clone(e.Line)
+				got = append(got, &c)
+			}
+			if err != tt.wantErr {
+				t.Errorf("read ended with %v, want %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("read %d entries, want %d", len(got), len(tt.want))
+			}
+			for i, w := range tt.want {
+				if !reflect.DeepEqual(got[i], w) {
+					t.Errorf("entry %d read as %v, want %v", i, got[i], w)
+				}
+			}
+		})
+	}
+}
+
+func TestEntryReaderAllocs(t *testing.T) {
+	e := entry("stdout", strings.Repeat("x", 1024), time.Now())
+	const n = 1000
+	r := newEntryReader(bytes.NewReader(bytes.Repeat(encodeEntries(t, e), n+1)))
+	var got logdriver.LogEntry
+	var msg Message
+	var meta PartialLogMetaData
+	allocs := testing.AllocsPerRun(n, func() {
+		if err := r.read(&got); err != nil {
+			t.Fatal(err)
+		}
+		setMessage(&msg, &meta, &got)
+	})
+	// The decoder allocates the stream name, but the line is decoded into
+	// the buffer of the one before.
+	if allocs > 1 {
+		t.Errorf("%v allocations per entry, want at most the stream name", allocs)
+	}
+}
+
+// reopen starts logging c again to a FIFO made anew at the same path, as a
+// daemon restarted without stopping its containers does. The old FIFO is
+// closed first, so its logger has read all of it.
+func (c *testContainer) reopen(t testing.TB, d *Driver) {
+	t.Helper()
+	c.w.Close()
+	d.mu.Lock()
+	old := d.logs[c.file]
+	d.mu.Unlock()
+	<-old.done
+	if err := os.Remove(c.file); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(c.file, 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, err := fifo.OpenFifo(context.Background(), c.file, syscall.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.w, c.enc = w, logdriver.NewLogEntryEncoder(w)
+	if err := d.StartLogging(c.file, c.info); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	l, _ := d.logs[c.file].logger()
+	d.mu.Unlock()
+	c.l = s3Loggers(l)[0]
+}
+
+// containerRecords returns the records uploaded for the container id, in
+// the order of their keys.
+func containerRecords(t testing.TB, fake *fakeS3, id string) []record {
+	t.Helper()
+	var recs []record
+	for _, key := range fake.logKeys(testBucket) {
+		if !strings.Contains(key, id) {
+			continue
+		}
+		o, _ := fake.object(testBucket, key)
+		for _, line := range strings.Split(strings.TrimSpace(string(o.data)), "\n") {
+			var rec record
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatal(err)
+			}
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+func TestStartLoggingAgain(t *testing.T) {
+	// Several containers log at once, each started again twice without a
+	// StopLogging. Under -race this checks their state isn't shared.
+	const containers, restarts, lines = 6, 2, 50
+	fake := newFakeS3()
+	d := newTestDriver(t, fake, nil)
+	var wg sync.WaitGroup
+	cs := make([]*testContainer, containers)
+	for i := range cs {
+		cs[i] = startContainer(t, d, nil)
+		cs[i].info.ContainerID = fmt.Sprintf("%064d", i)
+		cs[i].info.ContainerName = fmt.Sprintf("/test-%d", i)
+	}
+	// The containers were started under the test's ID; start them again
+	// under their own, as distinct containers.
+	for _, c := range cs {
+		c.reopen(t, d)
+	}
+	for _, c := range cs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range restarts + 1 {
+				if r > 0 {
+					c.reopen(t, d)
+				}
+				for i := range lines {
+					c.write(t, entry("stdout", fmt.Sprintf("%s run %d line %d", c.info.ContainerName, r, i), time.Now()))
+				}
+			}
+			c.stop(t, d)
+		}()
+	}
+	wg.Wait()
+
+	d.mu.Lock()
+	logs, idx := len(d.logs), len(d.idx)
+	d.mu.Unlock()
+	if logs != 0 || idx != 0 {
+		t.Errorf("%d loggers and %d containers still registered", logs, idx)
+	}
+	for _, c := range cs {
+		recs := containerRecords(t, fake, c.info.ContainerID)
+		if len(recs) != (restarts+1)*lines {
+			t.Errorf("%s uploaded %d lines, want %d", c.info.ContainerName, len(recs), (restarts+1)*lines)
+			continue
+		}
+		for i, rec := range recs {
+			want := fmt.Sprintf("%s run %d line %d", c.info.ContainerName, i/lines, i%lines)
+			// Each logger carries on the numbering of the one it replaced.
+			if rec.Log != want || rec.Seq != int64(i+1) {
+				t.Errorf("%s line %d is %q numbered %d, want %q numbered %d", c.info.ContainerName, i, rec.Log, rec.Seq, want, i+1)
+				break
+			}
+		}
+	}
+}
+
+func TestFIFOEndsMidEntry(t *testing.T) {
+	ts := time.Now()
+	part := entry("stdout", "part", ts)
+	part.Partial = true
+	part.PartialLogMetadata = &logdriver.PartialLogEntryMetadata{Id: "p1", Ordinal: 1}
+	whole := encodeEntries(t, entry("stdout", "one", ts), entry("stderr", "two", ts), part)
+	next := encodeEntries(t, entry("stdout", "never finished", ts))
+	tests := []struct {
+		name string
+		tail []byte // written after the whole entries
+		warn bool
+	}{
+		{name: "between entries"},
+		{name: "in the length", tail: next[:2], warn: true},
+		{name: "after the length", tail: next[:4], warn: true},
+		{name: "in the entry", tail: next[:7], warn: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewGlobal()
+			defer hook.Reset()
+			fake := newFakeS3()
+			d := newTestDriver(t, fake, nil)
+			c := startContainer(t, d, map[string]string{manifestKey: "true"})
+			if _, err := c.w.Write(append(slices.Clip(whole), tt.tail...)); err != nil {
+				t.Fatal(err)
+			}
+			// The daemon's end goes away; StopLogging returns no error.
+			c.stop(t, d)
+
+			if got, want := uploadedLines(t, fake, c.l), []string{"one", "two", "part" + partialTruncatedMarker}; !slices.Equal(got, want) {
+				t.Errorf("uploaded %q, want %q", got, want)
+			}
+			var m manifest
+			data, ok := fake.object(testBucket, c.l.manifestPath())
+			if !ok {
+				t.Fatal("no manifest uploaded")
+			}
+			if err := json.Unmarshal(data.data, &m); err != nil || !m.Closed {
+				t.Errorf("manifest %s isn't closed: %v", data.data, err)
+			}
+			var warned bool
+			for _, e := range hook.AllEntries() {
+				if strings.Contains(e.Message, "in the middle of an entry") {
+					warned = true
+					if off := e.Data["offset"]; off != int64(len(whole)) {
+						t.Errorf("warned of an entry cut at offset %v, want %d", off, len(whole))
+					}
+				}
+			}
+			if warned != tt.warn {
+				t.Errorf("warned of a cut entry: %v, want %v", warned, tt.warn)
+			}
+		})
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	// The daemon keeps writing to a FIFO while it asks for it to be logged
+	// again, as after a live-restore. Every line written before, during and
+	// after the handoffs is uploaded once, in order and numbered on.
+	const lines, handoffs = 3000, 3
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		// handoff is the log-opts of the second StartLogging, those of
+		// the first if nil.
+		handoff map[string]string
+		wantErr string
+	}{
+		{name: "with state-dir"},
+		{name: "without state-dir", cfg: map[string]string{stateDirKey: ""}},
+		{name: "small flushes", cfg: map[string]string{flushBytesKey: "4096"}},
+		{
+			// Bad log-opts are refused while the old logger keeps going.
+			name:    "bad log-opts",
+			handoff: map[string]string{formatKey: "xml"},
+			wantErr: "xml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			d := newTestDriver(t, fake, nil)
+			c := startContainer(t, d, tt.cfg)
+			d.mu.Lock()
+			lf := d.logs[c.file]
+			d.mu.Unlock()
+			info := c.info
+			if tt.handoff != nil {
+				info.Config = testLogOpts(t, tt.handoff)
+			}
+
+			written := make(chan int, lines)
+			go func() {
+				defer close(written)
+				for i := range lines {
+					if err := c.enc.Encode(entry("stdout", fmt.Sprintf("line %d", i), time.Now())); err != nil {
+						t.Error(err)
+						return
+					}
+					written <- i
+				}
+			}()
+			var n int
+			for i := range handoffs {
+				// Hand over once a share of the lines have been written.
+				for n < (i+1)*lines/(handoffs+1) {
+					n = <-written + 1
+				}
+				err := d.StartLogging(c.file, info)
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Errorf("handoff with bad log-opts returned %v", err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for range written {
+			}
+			d.mu.Lock()
+			same := d.logs[c.file] == lf
+			d.mu.Unlock()
+			if !same {
+				t.Error("the FIFO's reader was replaced rather than kept")
+			}
+			c.stop(t, d)
+
+			recs := containerRecords(t, fake, c.info.ContainerID)
+			if len(recs) != lines {
+				t.Fatalf("uploaded %d lines, want %d", len(recs), lines)
+			}
+			for i, rec := range recs {
+				if want := fmt.Sprintf("line %d", i); rec.Log != want || rec.Seq != int64(i+1) {
+					t.Fatalf("line %d is %q numbered %d, want %q numbered %d", i, rec.Log, rec.Seq, want, i+1)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// Logger uploads the lines of a source outside Docker, such as a journald
+// unit, through the same pipeline a container's go through in the plugin:
+// its buffer, flushes, keys and partitions, retries and spool. Each Logger
+// has its own upload pool and memory budget, sized as the plugin's defaults.
+type Logger struct {
+	l containerLogger
+	d *Driver
+}
+
+// DefaultOptions returns the options the plugin runs a container with when
+// neither its flags nor the container's log-opts set them.
+func DefaultOptions() LogOption {
+	var opts LogOption
+	optionFlags(flag.NewFlagSet(driverName, flag.ContinueOnError), &opts)
+	return opts
+}
+
+// New returns a logger uploading the lines of the source info describes,
+// with opts overridden by the log-opts in info.Config, as a container's are
+// set by the plugin's flags and its own log-opts. opts start from
+// DefaultOptions, and have an S3Bucket unless info.Config sets s3-bucket.
+// ContainerID identifies the source, and must be at least 12 characters long
+// as the tag and key templates may shorten it to that. Credentials are
+// looked up with the default AWS credential chain unless opts set their own.
+func New(opts LogOption, info Info) (*Logger, error) {
+	if len(info.ContainerID) < 12 {
+		return nil, fmt.Errorf("invalid container ID %q: must be at least 12 characters", info.ContainerID)
+	}
+	opts, err := parseLogOpts(opts, info.Config)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.CacheDisabled {
+		return nil, fmt.Errorf("%s=false needs the plugin's cache store", cacheDisabledKey)
+	}
+	awsCfg, err := newAWSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS config: %v", err)
+	}
+	pool := newUploadPool(defaultUploadWorkers, defaultBreakerThreshold, defaultBreakerCooldown, 0)
+	// The embedding program is the operator, so it may skip verifying
+	// certificates without a flag of its own.
+	d := newDriver(newClientFactory(awsCfg, defaultUploadWorkers*opts.Concurrency, true), pool, newMemoryBudget(defaultMaxTotalBuffer), opts)
+	sp, err := d.spoolFor(opts.SpoolDir, opts.SpoolMaxBytes)
+	if err != nil {
+		d.cancel()
+		return nil, err
+	}
+	l, err := newLogger(d.clients, d.pool, d.budget, opts, info, sp, nil)
+	if err != nil {
+		d.cancel()
+		return nil, err
+	}
+	return &Logger{l: l, d: d}, nil
+}
+
+// WriteMessage logs msg. Its Line may be reused once WriteMessage returns.
+// In blocking mode it waits for room in the buffer.
+func (l *Logger) WriteMessage(msg Message) error {
+	return l.l.Log(&msg)
+}
+
+// Flush uploads the lines buffered so far, without waiting for
+// flush-interval or flush-bytes. A partial line or multiline record still
+// waiting for the rest of it is left buffered.
+func (l *Logger) Flush(ctx context.Context) error {
+	var errs []error
+	for _, s := range s3Loggers(l.l) {
+		errs = append(errs, s.flush(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// Close flushes what is buffered and stops the logger, keeping its state in
+// state-dir for the next Logger of the same source, as the plugin does when
+// it exits. Batches left in the spool are uploaded by the next Logger with
+// the same spool-dir.
+func (l *Logger) Close() error {
+	defer l.d.cancel()
+	return l.l.Close()
+}
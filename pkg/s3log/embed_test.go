@@ -0,0 +1,176 @@
+package s3log_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"DockerS3LogDriver/pkg/s3log"
+)
+
+// stubS3 is an S3 endpoint keeping the objects PUT to it by path, and
+// answering anything else with an empty 200.
+type stubS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *stubS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if r.Method != http.MethodPut {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[r.URL.Path] = body
+	w.Header().Set("ETag", `"etag"`)
+}
+
+// lines returns the log field of each record uploaded under prefix, in key
+// order.
+func (s *stubS3) lines(t *testing.T, prefix string) []string {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) && strings.HasSuffix(k, ".log") {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	var lines []string
+	for _, k := range keys {
+		for _, rec := range strings.Split(strings.TrimSpace(string(s.objects[k])), "\n") {
+			var r struct{ Log string }
+			if err := json.Unmarshal([]byte(rec), &r); err != nil {
+				t.Fatalf("object %s holds %q: %v", k, rec, err)
+			}
+			lines = append(lines, r.Log)
+		}
+	}
+	return lines
+}
+
+// newEmbedded returns a Logger uploading to a stub endpoint as the logs
+// bucket, and the stub.
+func newEmbedded(t *testing.T, cfg map[string]string) (*s3log.Logger, *stubS3) {
+	t.Helper()
+	// The default credential chain is looked up once, from the environment
+	// rather than the instance metadata service.
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	stub := &stubS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+
+	opts := s3log.DefaultOptions()
+	opts.S3Bucket = "logs"
+	opts.Compress = ""
+	opts.FlushInterval = time.Hour
+	config := map[string]string{
+		"endpoint-url":     srv.URL,
+		"force-path-style": "true",
+		"state-dir":        t.TempDir(),
+	}
+	maps.Copy(config, cfg)
+	l, err := s3log.New(opts, s3log.Info{ContainerID: "journald-web-01", ContainerName: "web", Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, stub
+}
+
+func TestLogger(t *testing.T) {
+	l, stub := newEmbedded(t, nil)
+	line := []byte("first")
+	if err := l.WriteMessage(s3log.Message{Line: line, Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	// The line can be reused once written.
+	copy(line, "XXXXX")
+	if err := l.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := stub.lines(t, "/logs/web/journald-web-01/"); !slices.Equal(got, []string{"first"}) {
+		t.Fatalf("flushed %q, want [first]", got)
+	}
+
+	for _, line := range []string{"second", "third"} {
+		if err := l.WriteMessage(s3log.Message{Line: []byte(line), Source: "stderr", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stub.lines(t, "/logs/"), []string{"first", "second", "third"}; !slices.Equal(got, want) {
+		t.Errorf("uploaded %q, want %q", got, want)
+	}
+}
+
+func TestLoggerOptions(t *testing.T) {
+	// Log-opts in Info.Config override the options' fields.
+	l, stub := newEmbedded(t, map[string]string{"s3-prefix": "journald/", "filter-exclude": "healthz"})
+	for _, line := range []string{"GET /healthz", "GET /"} {
+		if err := l.WriteMessage(s3log.Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := stub.lines(t, "/logs/journald/"); !slices.Equal(got, []string{"GET /"}) {
+		t.Errorf("uploaded %q under the prefix, want [GET /]", got)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	opts := s3log.DefaultOptions()
+	opts.S3Bucket = "logs"
+	tests := []struct {
+		name    string
+		opts    s3log.LogOption
+		info    s3log.Info
+		wantErr string
+	}{
+		{name: "short ID", opts: opts, info: s3log.Info{ContainerID: "web"}, wantErr: "at least 12 characters"},
+		{name: "no bucket", opts: s3log.DefaultOptions(), info: s3log.Info{ContainerID: "journald-web-01"}, wantErr: "bucket"},
+		{name: "bad log-opt", opts: opts, info: s3log.Info{ContainerID: "journald-web-01", Config: map[string]string{"compress": "rar"}}, wantErr: "compress"},
+		{name: "cache", opts: opts, info: s3log.Info{ContainerID: "journald-web-01", Config: map[string]string{"cache-disabled": "false", "cache-dir": "/tmp"}}, wantErr: "cache store"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s3log.New(tt.opts, tt.info); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("New returned %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNoDaemonImports(t *testing.T) {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go toolchain to list the package's imports with")
+	}
+	out, err := exec.Command(gobin, "list", "-deps", ".").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range strings.Fields(string(out)) {
+		if strings.HasPrefix(pkg, "github.com/docker/docker/daemon") {
+			t.Errorf("package imports %s", pkg)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsretry "github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Operations named by an opError.
+const (
+	opParseOptions = "parse log-opts"
+	opLoadCreds    = "load credentials"
+	opAssumeRole   = "assume role"
+	opBucketRegion = "look up region of bucket"
+	opCheckBucket  = "check bucket"
+	opVerifyWrite  = "write probe object to bucket"
+	opReadProbe    = "read probe object from bucket"
+	opUpload       = "upload to bucket"
+)
+
+var s3Errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: driverName,
+	Name:      "s3_errors_total",
+	Help:      "S3 calls that failed, by the API operation and the AWS error code.",
+}, []string{"bucket", "operation", "code"})
+
+func init() {
+	metricsRegistry.MustRegister(s3Errors)
+}
+
+// maxErrorCodeSize bounds the error codes put in an opError.
+const maxErrorCodeSize = 64
+
+// headCodes maps the codes S3 gives the errors of HEAD requests, which have
+// no body to carry the real code and so are named after their status, to the
+// codes the same error has on other requests. The only HEAD requests whose
+// errors are reported are on buckets, so a missing one is always the bucket.
+var headCodes = map[string]string{
+	"Forbidden":        "AccessDenied",
+	"NotFound":         "NoSuchBucket",
+	"MovedPermanently": "PermanentRedirect",
+}
+
+// opError is an error that fails a container's start or stop, naming the
+// operation that failed, the bucket it was for and the AWS error code, if
+// any. The daemon shows the user nothing but its message, so that much is
+// enough to tell a missing IAM permission from a typo or a network problem
+// without reading the plugin's logs.
+type opError struct {
+	op     string
+	bucket string
+	code   string
+	err    error
+}
+
+// newOpError wraps err, from op on bucket, taking its AWS error code.
+func newOpError(op, bucket string, err error) error {
+	return &opError{op: op, bucket: bucket, code: errorCode(err), err: err}
+}
+
+func (e *opError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.op)
+	if e.bucket != "" {
+		fmt.Fprintf(&b, " %q", e.bucket)
+	}
+	if e.code != "" {
+		b.WriteString(": " + e.code)
+	}
+	b.WriteString(": " + e.err.Error())
+	return b.String()
+}
+
+func (e *opError) Unwrap() error { return e.err }
+
+// errorCode returns the AWS error code of err, such as AccessDenied,
+// NoSuchBucket or RequestTimeout, or "" if it has none. Codes are cut down to
+// letters and digits, since some S3-compatible stores return whatever they
+// like.
+func errorCode(err error) string {
+	var code string
+	var apiErr smithy.APIError
+	var notFound manager.BucketNotFound
+	switch {
+	case errors.As(err, &apiErr):
+		code = apiErr.ErrorCode()
+		if c, ok := headCodes[code]; ok {
+			code = c
+		}
+	case errors.As(err, &notFound):
+		code = "NoSuchBucket"
+	case errors.Is(err, context.DeadlineExceeded):
+		code = "RequestTimeout"
+	}
+	code = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, code)
+	if len(code) > maxErrorCodeSize {
+		code = code[:maxErrorCodeSize]
+	}
+	return code
+}
+
+// isRetryable reports whether err is one the SDK would retry, such as a
+// timeout, throttling or a 5xx, rather than one that will fail again until
+// the configuration or IAM policy changes.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	return awsretry.IsErrorRetryables(awsretry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// isUploadError reports whether err is from uploading a batch. Those are
+// logged, with the batch, where they happen, so they aren't reported to the
+// daemon again.
+func isUploadError(err error) bool {
+	var e *opError
+	return errors.As(err, &e) && e.op == opUpload
+}
+
+// awsError is what AWS said about a failed call: the operation, the error
+// code and message, and the request IDs AWS support asks for to trace it.
+// Fields are "" when err doesn't carry them, as when the call got no
+// response at all.
+type awsError struct {
+	operation string
+	code      string
+	message   string
+	requestID string
+	hostID    string // x-amz-id-2, the extended request ID
+}
+
+// describeAWSError returns what err, however wrapped by the uploader or by
+// retry, says about the call that failed.
+func describeAWSError(err error) awsError {
+	e := awsError{code: errorCode(err)}
+	var opErr *smithy.OperationError
+	if errors.As(err, &opErr) {
+		e.operation = opErr.OperationName
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		e.message = apiErr.ErrorMessage()
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		e.requestID = respErr.ServiceRequestID()
+	}
+	var hostErr interface{ ServiceHostID() string }
+	if errors.As(err, &hostErr) {
+		e.hostID = hostErr.ServiceHostID()
+	}
+	return e
+}
+
+// fields adds what e has to log.
+func (e awsError) fields(log *logrus.Entry) *logrus.Entry {
+	if e.code != "" {
+		log = log.WithField("error_code", e.code)
+	}
+	if e.message != "" {
+		log = log.WithField("error_message", e.message)
+	}
+	if e.requestID != "" {
+		log = log.WithField("request_id", e.requestID)
+	}
+	if e.hostID != "" {
+		log = log.WithField("extended_request_id", e.hostID)
+	}
+	return log
+}
+
+// countS3Error counts err, from a call on bucket, in s3Errors and returns
+// what it says about the call.
+func countS3Error(bucket string, err error) awsError {
+	e := describeAWSError(err)
+	s3Errors.WithLabelValues(bucket, e.operation, e.code).Inc()
+	return e
+}
+
+// s3Failed counts err, from a call on bucket, and returns log with what it
+// says about the call, for logging the failure.
+func s3Failed(log *logrus.Entry, bucket string, err error) *logrus.Entry {
+	return countS3Error(bucket, err).fields(log).WithError(err)
+}
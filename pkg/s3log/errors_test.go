@@ -0,0 +1,303 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	awsretry "github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "API error", err: fakeStatusError(http.StatusForbidden, "AccessDenied"), want: "AccessDenied"},
+		{name: "wrapped", err: fmt.Errorf("upload: %w", fakeStatusError(http.StatusNotFound, "NoSuchBucket")), want: "NoSuchBucket"},
+		{name: "HEAD forbidden", err: fakeStatusError(http.StatusForbidden, "Forbidden"), want: "AccessDenied"},
+		{name: "HEAD not found", err: fakeStatusError(http.StatusNotFound, "NotFound"), want: "NoSuchBucket"},
+		{name: "HEAD redirect", err: fakeStatusError(http.StatusMovedPermanently, "MovedPermanently"), want: "PermanentRedirect"},
+		{name: "deadline", err: fmt.Errorf("put: %w", context.DeadlineExceeded), want: "RequestTimeout"},
+		{name: "sanitized", err: &smithy.GenericAPIError{Code: "Bad Code<script>"}, want: "BadCodescript"},
+		{name: "capped", err: &smithy.GenericAPIError{Code: strings.Repeat("A", 100)}, want: strings.Repeat("A", maxErrorCodeSize)},
+		{name: "no code", err: errors.New("connection refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorCode(tt.err); got != tt.want {
+				t.Errorf("errorCode(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fakeStatusError(http.StatusServiceUnavailable, "ServiceUnavailable"), true},
+		{fakeStatusError(http.StatusServiceUnavailable, "SlowDown"), true},
+		{fmt.Errorf("put: %w", context.DeadlineExceeded), true},
+		{fakeStatusError(http.StatusForbidden, "AccessDenied"), false},
+		{fakeStatusError(http.StatusNotFound, "NoSuchBucket"), false},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestStartLoggingErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		op   string
+		err  error
+		want string
+	}{
+		{
+			name: "no ListBucket",
+			op:   "HeadBucket",
+			err:  fakeStatusError(http.StatusForbidden, "Forbidden"),
+			want: `check bucket "logs": AccessDenied: access denied, check the IAM policy of the plugin's credentials: https response error StatusCode: 403, RequestID: fake, api error Forbidden: Forbidden`,
+		},
+		{
+			name: "no such bucket",
+			op:   "HeadBucket",
+			err:  fakeStatusError(http.StatusNotFound, "NotFound"),
+			want: `check bucket "logs": NoSuchBucket: bucket does not exist: https response error StatusCode: 404, RequestID: fake, api error NotFound: Not Found`,
+		},
+		{
+			name: "bucket in another region",
+			op:   "HeadBucket",
+			err:  fakeStatusError(http.StatusMovedPermanently, "MovedPermanently"),
+			want: `check bucket "logs": PermanentRedirect: bucket is in another region than s3-region: https response error StatusCode: 301, RequestID: fake, api error MovedPermanently: Moved Permanently`,
+		},
+		{
+			name: "no PutObject",
+			cfg:  map[string]string{verifyWriteKey: "true"},
+			op:   "PutObject",
+			err:  fakeStatusError(http.StatusForbidden, "AccessDenied"),
+			want: `write probe object to bucket "logs": AccessDenied: access denied, check the IAM policy of the plugin's credentials: failed to upload object ".s3logdriver-probe" to S3: https response error StatusCode: 403, RequestID: fake, api error AccessDenied: Forbidden`,
+		},
+		{
+			name: "bad log-opt",
+			cfg:  map[string]string{modeKey: "async"},
+			want: `parse log-opts: invalid mode "async": must be "blocking" or "non-blocking"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			if tt.op != "" {
+				fake.fail(tt.op, 1, tt.err)
+			}
+			d := newTestDriver(t, fake, nil)
+			info := Info{Config: testLogOpts(t, tt.cfg), ContainerID: testContainerID(t), ContainerName: "/test"}
+			err := d.StartLogging(filepath.Join(t.TempDir(), "fifo"), info)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("StartLogging returned\n%v\nwant\n%s", err, tt.want)
+			}
+			var opErr *opError
+			if tt.err != nil && (!errors.As(err, &opErr) || !errors.Is(err, tt.err)) {
+				t.Errorf("%v doesn't wrap %v in an opError", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestStartLoggingRetryableCheck(t *testing.T) {
+	// A bucket check that may pass by itself is only logged.
+	fake := newFakeS3()
+	fake.fail("HeadBucket", 1, fakeStatusError(http.StatusServiceUnavailable, "ServiceUnavailable"))
+	d := newTestDriver(t, fake, nil)
+	c := startContainer(t, d, nil)
+	c.write(t, entry("stdout", "started anyway", time.Now()))
+	c.stop(t, d)
+	if got := uploadedLines(t, fake, c.l); len(got) != 1 {
+		t.Errorf("uploaded %q, want the line", got)
+	}
+}
+
+func TestStopLoggingUploadErrors(t *testing.T) {
+	// Upload errors are logged with the batch, not returned to the daemon.
+	fake := newFakeS3()
+	fake.fail("PutObject", 10, fakeStatusError(http.StatusForbidden, "AccessDenied"))
+	d := newTestDriver(t, fake, nil)
+	c := startContainer(t, d, map[string]string{maxRetriesKey: "0"})
+	c.write(t, entry("stdout", "never uploaded", time.Now()))
+	c.stop(t, d)
+	if keys := fake.logKeys(testBucket); len(keys) != 0 {
+		t.Errorf("uploaded %q", keys)
+	}
+}
+
+// hostIDError is an error carrying an extended request ID, as S3's response
+// errors do.
+type hostIDError struct {
+	error
+	hostID string
+}
+
+func (e *hostIDError) ServiceHostID() string { return e.hostID }
+
+func (e *hostIDError) Unwrap() error { return e.error }
+
+func TestDescribeAWSError(t *testing.T) {
+	denied := fakeStatusError(http.StatusForbidden, "AccessDenied")
+	tests := []struct {
+		name string
+		err  error
+		want awsError
+	}{
+		{name: "response", err: denied, want: awsError{code: "AccessDenied", message: "Forbidden", requestID: "fake"}},
+		{
+			// As the uploader and retry return it.
+			name: "wrapped",
+			err: newOpError(opUpload, testBucket, fmt.Errorf("upload: %w", &smithy.OperationError{
+				ServiceID:     "S3",
+				OperationName: "PutObject",
+				Err:           &awsretry.MaxAttemptsError{Attempt: 3, Err: &hostIDError{denied, "HOST"}},
+			})),
+			want: awsError{operation: "PutObject", code: "AccessDenied", message: "Forbidden", requestID: "fake", hostID: "HOST"},
+		},
+		{name: "no response", err: &smithy.OperationError{OperationName: "PutObject", Err: errors.New("connection refused")}, want: awsError{operation: "PutObject"}},
+		{name: "not AWS", err: errors.New("disk full")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describeAWSError(tt.err); got != tt.want {
+				t.Errorf("describeAWSError(%v) = %+v, want %+v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// idS3 is an S3 endpoint keeping the objects PUT to it by path, unless deny
+// is set, when it denies the PUT of log objects. Each response has a request
+// ID of its own, and an extended one.
+type idS3 struct {
+	deny bool
+
+	mu       sync.Mutex
+	requests int
+	objects  map[string][]byte
+	logPuts  []string // the request IDs of log objects' PUTs
+}
+
+func (s *idS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	id := fmt.Sprintf("REQ%d", s.requests)
+	w.Header().Set("X-Amz-Request-Id", id)
+	w.Header().Set("X-Amz-Id-2", "HOST"+id)
+	fail := func(status int, code, message string) {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message><RequestId>%s</RequestId><HostId>HOST%s</HostId></Error>`, code, message, id, id)
+	}
+	switch {
+	case r.Method == http.MethodPut && s.deny && strings.HasSuffix(r.URL.Path, ".log"):
+		fail(http.StatusForbidden, "AccessDenied", "Access Denied")
+	case r.Method == http.MethodPut:
+		s.objects[r.URL.Path] = body
+		if strings.HasSuffix(r.URL.Path, ".log") {
+			s.logPuts = append(s.logPuts, id)
+		}
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == http.MethodGet:
+		data, ok := s.objects[r.URL.Path]
+		if !ok {
+			fail(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Write(data)
+	}
+}
+
+// newIDLogger returns a logger uploading to s, with cfg.
+func newIDLogger(t *testing.T, s *idS3, cfg map[string]string) *S3Logger {
+	t.Helper()
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	clients := newTestClients(nil)
+	clients.newClient = newS3Client
+	opts := map[string]string{
+		endpointURLKey:    srv.URL,
+		forcePathStyleKey: "true",
+		maxRetriesKey:     "0",
+		flushIntervalKey:  "1h",
+	}
+	maps.Copy(opts, cfg)
+	info := Info{Config: testLogOpts(t, opts), ContainerID: testContainerID(t), ContainerName: "/test"}
+	cl, _ := newClientsLogger(t, clients, info)
+	return s3Loggers(cl)[0]
+}
+
+func TestS3ErrorDetails(t *testing.T) {
+	// A failed upload is logged and counted with what S3 said of it.
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	l := newIDLogger(t, &idS3{deny: true, objects: make(map[string][]byte)}, nil)
+	denied := s3Errors.WithLabelValues(testBucket, "PutObject", "AccessDenied")
+	before := metricValue(denied)
+	logLines(t, l, time.Now(), "denied")
+	if err := l.flush(context.Background()); err == nil {
+		t.Fatal("flush succeeded, want the upload denied")
+	}
+
+	if got := metricValue(denied) - before; got != 1 {
+		t.Errorf("counted %v denied uploads, want 1", got)
+	}
+	var logged bool
+	for _, e := range hook.AllEntries() {
+		if e.Message != "error uploading logs" {
+			continue
+		}
+		logged = true
+		id, _ := e.Data["request_id"].(string)
+		if e.Data["error_code"] != "AccessDenied" || e.Data["error_message"] != "Access Denied" || !strings.HasPrefix(id, "REQ") || e.Data["extended_request_id"] != "HOST"+id {
+			t.Errorf("upload error logged with %v, want the code, message and request IDs from S3", e.Data)
+		}
+	}
+	if !logged {
+		t.Error("upload error not logged")
+	}
+}
+
+func TestManifestRequestID(t *testing.T) {
+	s := &idS3{objects: make(map[string][]byte)}
+	l := newIDLogger(t, s, map[string]string{manifestKey: "true"})
+	logLines(t, l, time.Now(), "uploaded")
+	if err := l.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var m manifest
+	if err := json.Unmarshal(s.objects["/"+testBucket+"/"+l.manifestPath()], &m); err != nil {
+		t.Fatalf("manifest: %v", err)
+	}
+	if len(m.Objects) != 1 || len(s.logPuts) != 1 || m.Objects[0].RequestID != s.logPuts[0] {
+		t.Errorf("manifest lists %+v, want the object with the request ID of its PUT, %q", m.Objects, s.logPuts)
+	}
+}
@@ -0,0 +1,40 @@
+package s3log_test
+
+import (
+	"context"
+	"time"
+
+	"DockerS3LogDriver/pkg/s3log"
+)
+
+func ExampleNew() {
+	opts := s3log.DefaultOptions()
+	opts.S3Bucket = "logs"
+	opts.Compress = "zstd"
+	l, err := s3log.New(opts, s3log.Info{
+		ContainerID:   "journald-web-01",
+		ContainerName: "web",
+		// Log-opts by name, as a container's, override the fields.
+		Config: map[string]string{"s3-prefix": "journald/"},
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	l.WriteMessage(s3log.Message{Line: []byte("started"), Source: "stdout", Timestamp: time.Now()})
+}
+
+func ExampleLogger_Flush() {
+	opts := s3log.DefaultOptions()
+	opts.S3Bucket = "logs"
+	l, err := s3log.New(opts, s3log.Info{ContainerID: "journald-web-01"})
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	l.WriteMessage(s3log.Message{Line: []byte("checkpoint reached"), Source: "stdout", Timestamp: time.Now()})
+	// Upload what is buffered now rather than at the next flush-interval.
+	if err := l.Flush(context.Background()); err != nil {
+		panic(err)
+	}
+}
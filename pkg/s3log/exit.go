@@ -0,0 +1,299 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	exitEventKey    = "exit-event"
+	dockerSocketKey = "docker-socket"
+
+	eventStopped = "container_stopped"
+
+	// The reasons a container_stopped record gives for the container
+	// stopping.
+	exitOOMKilled = "oom_killed"
+	exitKilled    = "killed"
+	exitExited    = "exited"
+	exitUnknown   = "unknown"
+
+	// exitCodeTimeout bounds how long a stopped container's run summary
+	// waits for the daemon to report its exit code.
+	exitCodeTimeout = 10 * time.Second
+
+	// dockerEventsRetry is how long the events watcher waits before
+	// connecting to the daemon again.
+	dockerEventsRetry = 5 * time.Second
+
+	// dockerEventsKeep is how long the events of a container are kept for
+	// its logger to stop.
+	dockerEventsKeep = 10 * time.Minute
+)
+
+// containerExit is how a container stopped, as its container_stopped record
+// and run summary give it.
+type containerExit struct {
+	Reason   string    `json:"reason"`
+	Signal   int       `json:"signal,omitempty"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+	At       time.Time `json:"at"`
+
+	id    string
+	since time.Time // when the logger started, before which events are another run's
+}
+
+// dockerEvents follows the daemon's events over its API socket for the
+// containers that are killed, run out of memory or die. The daemon only
+// reports a container as stopped once its logger has stopped, holding the
+// container until then, so the events are the one way of telling at
+// StopLogging why it stopped, and the exit code comes after it.
+type dockerEvents struct {
+	client *http.Client
+
+	mu        sync.Mutex
+	changed   *sync.Cond // signalled whenever an event arrives
+	connected bool
+	seen      map[string]*containerEvents
+}
+
+// containerEvents are the latest events of a container.
+type containerEvents struct {
+	oom      time.Time
+	kill     time.Time
+	signal   int
+	die      time.Time
+	exitCode int
+}
+
+func newDockerEvents(socket string) *dockerEvents {
+	dial := &net.Dialer{Timeout: 5 * time.Second}
+	e := &dockerEvents{
+		client: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dial.DialContext(ctx, "unix", socket)
+			},
+		}},
+		seen: make(map[string]*containerEvents),
+	}
+	e.changed = sync.NewCond(&e.mu)
+	return e
+}
+
+// run follows the daemon's events until ctx is cancelled, connecting again
+// after dockerEventsRetry whenever the stream ends.
+func (e *dockerEvents) run(ctx context.Context) {
+	for {
+		err := e.follow(ctx)
+		e.mu.Lock()
+		wasConnected := e.connected
+		e.connected = false
+		e.mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		if wasConnected {
+			logrus.WithError(err).Warn("lost the docker events stream, reconnecting")
+		} else {
+			logrus.WithError(err).Debug("error following docker events")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dockerEventsRetry):
+		}
+	}
+}
+
+// dockerEvent is an event as the daemon's API streams it.
+type dockerEvent struct {
+	Action string
+	Actor  struct {
+		ID         string
+		Attributes map[string]string
+	}
+	TimeNano int64 `json:"timeNano"`
+}
+
+// follow reads the daemon's events until the stream ends.
+func (e *dockerEvents) follow(ctx context.Context) error {
+	filters, _ := json.Marshal(map[string][]string{"type": {"container"}, "event": {"oom", "kill", "die"}})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker/events?filters="+url.QueryEscape(string(filters)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker events: %s", resp.Status)
+	}
+	e.mu.Lock()
+	if !e.connected {
+		logrus.Debug("following docker events")
+	}
+	e.connected = true
+	e.mu.Unlock()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev dockerEvent
+		if err := dec.Decode(&ev); err != nil {
+			return err
+		}
+		e.record(ev)
+	}
+}
+
+// record notes ev for the container it is about, forgetting containers with
+// no events in dockerEventsKeep.
+func (e *dockerEvents) record(ev dockerEvent) {
+	at := time.Unix(0, ev.TimeNano)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	defer e.changed.Broadcast()
+	for id, c := range e.seen {
+		if time.Since(c.latest()) > dockerEventsKeep {
+			delete(e.seen, id)
+		}
+	}
+	c := e.seen[ev.Actor.ID]
+	if c == nil {
+		c = &containerEvents{}
+		e.seen[ev.Actor.ID] = c
+	}
+	switch ev.Action {
+	case "oom":
+		c.oom = at
+	case "kill":
+		c.kill = at
+		c.signal, _ = strconv.Atoi(ev.Actor.Attributes["signal"])
+	case "die":
+		c.die = at
+		c.exitCode, _ = strconv.Atoi(ev.Actor.Attributes["exitCode"])
+	}
+}
+
+// latest returns when the last of c's events arrived.
+func (c *containerEvents) latest() time.Time {
+	latest := c.oom
+	for _, t := range []time.Time{c.kill, c.die} {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// exit returns how the container id, whose logger started at since, has
+// stopped, going by the events seen since then: killed for running out of
+// memory or by a signal, or otherwise exited of its own accord. The reason
+// is unknown while the events can't be followed. e may be nil, for a plugin
+// without a docker socket.
+func (e *dockerEvents) exit(id string, since time.Time) *containerExit {
+	exit := &containerExit{Reason: exitUnknown, id: id, since: since}
+	if e == nil {
+		return exit
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.connected {
+		return exit
+	}
+	exit.Reason = exitExited
+	c := e.seen[id]
+	if c == nil {
+		return exit
+	}
+	switch {
+	case c.oom.After(since):
+		exit.Reason = exitOOMKilled
+	case c.kill.After(since):
+		exit.Reason, exit.Signal = exitKilled, c.signal
+	}
+	if c.die.After(since) {
+		code := c.exitCode
+		exit.ExitCode = &code
+	}
+	return exit
+}
+
+// waitExitCode sets the exit code of exit once the daemon reports the
+// container as dead, waiting at most exitCodeTimeout or until ctx is done.
+func (e *dockerEvents) waitExitCode(ctx context.Context, exit *containerExit) {
+	if e == nil || exit.ExitCode != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, exitCodeTimeout)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		e.mu.Lock()
+		e.changed.Broadcast()
+		e.mu.Unlock()
+	})
+	defer stop()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ctx.Err() == nil {
+		if c := e.seen[exit.id]; c != nil && c.die.After(exit.since) {
+			code := c.exitCode
+			exit.ExitCode = &code
+			return
+		}
+		e.changed.Wait()
+	}
+}
+
+// stoppedRecord is the container_stopped marker of a container's exit.
+type stoppedRecord struct {
+	Event string `json:"event"`
+	*containerExit
+}
+
+// stoppedEvent is the container_stopped record of exit.
+func stoppedEvent(exit *containerExit) []byte {
+	event, _ := json.Marshal(stoppedRecord{eventStopped, exit})
+	return event
+}
+
+// recordExit notes how the container stopped, going by events, for Close to
+// write as its last record once it has drained the logger, and returns it,
+// or nil without exit-event. at is when the daemon stopped the logger.
+func (l *S3Logger) recordExit(events *dockerEvents, at time.Time) *containerExit {
+	if !l.opts.ExitEvent {
+		return nil
+	}
+	exit := events.exit(l.info.ContainerID, l.started)
+	exit.At = at
+	l.mu.Lock()
+	l.exit = exit
+	l.mu.Unlock()
+	l.log().WithField("reason", exit.Reason).Debug("container stopped")
+	return exit
+}
+
+// markExit appends the container_stopped record noted by recordExit, if
+// any, to the buffer. Callers must hold l.mu.
+func (l *S3Logger) markExit() {
+	if l.exit == nil {
+		return
+	}
+	l.appendMarker(stoppedEvent(l.exit), l.exit.At)
+	l.exit = nil
+}
+
+// recordExit records how the container stopped in its stderr logger, where
+// the log_gap markers go as well.
+func (s *splitLogger) recordExit(events *dockerEvents, at time.Time) *containerExit {
+	return s.loggers[1].recordExit(events, at)
+}
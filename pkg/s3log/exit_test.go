@@ -0,0 +1,249 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dockerAPI is a daemon's API socket streaming the events sent to it.
+type dockerAPI struct {
+	events chan dockerEvent
+}
+
+// newDockerAPI serves a docker API socket and returns it along with a
+// dockerEvents following it until the end of the test.
+func newDockerAPI(t *testing.T) (*dockerAPI, *dockerEvents) {
+	t.Helper()
+	// Unix socket paths are short, too short for most test temp dirs.
+	dir, err := os.MkdirTemp("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &dockerAPI{events: make(chan dockerEvent)}
+	srv := httptest.NewUnstartedServer(api)
+	srv.Listener.Close()
+	srv.Listener = ln
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	e := newDockerEvents(socket)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go e.run(ctx)
+	waitFor(t, "the events stream", func() bool {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.connected
+	})
+	return api, e
+}
+
+func (a *dockerAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var filters map[string][]string
+	if r.URL.Path != "/events" || json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters) != nil || !strings.Contains(strings.Join(filters["event"], ","), "oom") {
+		http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+		return
+	}
+	w.(http.Flusher).Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-a.events:
+			enc.Encode(ev)
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// event returns the event of action on the container id, with attributes
+// as key-value pairs.
+func event(action, id string, attrs ...string) dockerEvent {
+	ev := dockerEvent{Action: action, TimeNano: time.Now().UnixNano()}
+	ev.Actor.ID = id
+	ev.Actor.Attributes = make(map[string]string)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		ev.Actor.Attributes[attrs[i]] = attrs[i+1]
+	}
+	return ev
+}
+
+// send streams ev and waits for it to be recorded.
+func (a *dockerAPI) send(t *testing.T, e *dockerEvents, ev dockerEvent) {
+	t.Helper()
+	a.events <- ev
+	waitFor(t, "the "+ev.Action+" event", func() bool {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		c := e.seen[ev.Actor.ID]
+		return c != nil && c.latest().UnixNano() == ev.TimeNano
+	})
+}
+
+// exitString describes exit for comparing one with another.
+func exitString(exit *containerExit) string {
+	code := "none"
+	if exit.ExitCode != nil {
+		code = strconv.Itoa(*exit.ExitCode)
+	}
+	return fmt.Sprintf("%s, signal %d, exit code %s", exit.Reason, exit.Signal, code)
+}
+
+func TestDockerEventsExit(t *testing.T) {
+	since := time.Now()
+	before := since.Add(-time.Minute).UnixNano()
+	stale := func(ev dockerEvent) dockerEvent { ev.TimeNano = before; return ev }
+	code := func(n int) *int { return &n }
+	tests := []struct {
+		name         string
+		disconnected bool
+		events       []dockerEvent
+		want         containerExit
+	}{
+		{name: "not following", disconnected: true, events: []dockerEvent{event("oom", "c")}, want: containerExit{Reason: exitUnknown}},
+		{name: "no events", want: containerExit{Reason: exitExited}},
+		{name: "exited", events: []dockerEvent{event("die", "c", "exitCode", "3")}, want: containerExit{Reason: exitExited, ExitCode: code(3)}},
+		{name: "oom", events: []dockerEvent{event("oom", "c"), event("kill", "c", "signal", "9"), event("die", "c", "exitCode", "137")}, want: containerExit{Reason: exitOOMKilled, ExitCode: code(137)}},
+		{name: "killed", events: []dockerEvent{event("kill", "c", "signal", "15")}, want: containerExit{Reason: exitKilled, Signal: 15}},
+		{name: "earlier run", events: []dockerEvent{stale(event("oom", "c")), stale(event("die", "c", "exitCode", "137"))}, want: containerExit{Reason: exitExited}},
+		{name: "another container", events: []dockerEvent{event("oom", "other")}, want: containerExit{Reason: exitExited}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newDockerEvents("/nonexistent")
+			e.connected = !tt.disconnected
+			for _, ev := range tt.events {
+				e.record(ev)
+			}
+			if got, want := exitString(e.exit("c", since)), exitString(&tt.want); got != want {
+				t.Errorf("exit = %s, want %s", got, want)
+			}
+		})
+	}
+	if got := (*dockerEvents)(nil).exit("c", since); got.Reason != exitUnknown {
+		t.Errorf("exit without a docker socket = %q, want %q", got.Reason, exitUnknown)
+	}
+}
+
+func TestDockerEventsFollow(t *testing.T) {
+	api, e := newDockerAPI(t)
+	since := time.Now()
+	api.send(t, e, event("kill", "c", "signal", "9"))
+	exit := e.exit("c", since)
+	if got, want := exitString(exit), "killed, signal 9, exit code none"; got != want {
+		t.Fatalf("exit = %s, want %s", got, want)
+	}
+
+	// The exit code comes once the daemon reports the container dead.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.waitExitCode(context.Background(), exit)
+	}()
+	api.send(t, e, event("die", "c", "exitCode", "137"))
+	<-done
+	if got, want := exitString(exit), "killed, signal 9, exit code 137"; got != want {
+		t.Errorf("exit = %s, want %s", got, want)
+	}
+
+	// A container that never dies is given up on with the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	never := e.exit("never", since)
+	e.waitExitCode(ctx, never)
+	if never.ExitCode != nil {
+		t.Errorf("exit code %d of a container still running", *never.ExitCode)
+	}
+}
+
+func TestExitEvent(t *testing.T) {
+	// The container_stopped record is the last of an OOM-killed container's,
+	// told from its lines by its stream or raw prefix, and the run summary
+	// gives the exit code the daemon reports after it.
+	for _, format := range []string{formatJSONL, formatRaw} {
+		t.Run(format, func(t *testing.T) {
+			api, events := newDockerAPI(t)
+			fake := newFakeS3()
+			d := newTestDriver(t, fake, nil)
+			d.docker = events
+			c := startContainer(t, d, map[string]string{exitEventKey: "true", summaryKey: "true", formatKey: format})
+			c.write(t, entry("stdout", "allocating", time.Now()))
+			api.send(t, events, event("oom", c.info.ContainerID))
+			c.stop(t, d)
+			api.send(t, events, event("die", c.info.ContainerID, "exitCode", "137"))
+
+			o, _ := fake.object(testBucket, fake.logKeys(testBucket)[0])
+			lines := strings.Split(strings.TrimSpace(string(o.data)), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("uploaded %q, want the line and the record", lines)
+			}
+			marker := lines[1]
+			if format == formatRaw {
+				var ok bool
+				if _, marker, ok = strings.Cut(marker, gapRawPrefix); !ok {
+					t.Fatalf("last line %q, want it marked %q", lines[1], gapRawPrefix)
+				}
+			}
+			var rec map[string]any
+			if err := json.Unmarshal([]byte(marker), &rec); err != nil {
+				t.Fatal(err)
+			}
+			if rec["event"] != eventStopped || rec["reason"] != exitOOMKilled || rec["at"] == nil {
+				t.Errorf("last record %v, want %s for %s", rec, eventStopped, exitOOMKilled)
+			}
+			if format == formatJSONL && rec["stream"] != gapStream {
+				t.Errorf("record on stream %v, want %s", rec["stream"], gapStream)
+			}
+
+			key := c.l.summaryPath()
+			waitFor(t, "the run summary", func() bool {
+				_, ok := fake.object(testBucket, key)
+				return ok
+			})
+			so, _ := fake.object(testBucket, key)
+			var s runSummary
+			if err := json.Unmarshal(so.data, &s); err != nil {
+				t.Fatal(err)
+			}
+			if s.Exit == nil {
+				t.Fatal("summary gives no exit")
+			}
+			if got, want := exitString(s.Exit), "oom_killed, signal 0, exit code 137"; got != want {
+				t.Errorf("summary exit %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestExitEventOff(t *testing.T) {
+	// Without exit-event nothing is added to the container's lines, however
+	// it stopped.
+	api, events := newDockerAPI(t)
+	fake := newFakeS3()
+	d := newTestDriver(t, fake, nil)
+	d.docker = events
+	c := startContainer(t, d, nil)
+	c.write(t, entry("stdout", "line", time.Now()))
+	api.send(t, events, event("oom", c.info.ContainerID))
+	c.stop(t, d)
+	if recs := containerRecords(t, fake, c.info.ContainerID); len(recs) != 1 || recs[0].Log != "line" {
+		t.Errorf("uploaded %+v, want the one line", recs)
+	}
+}
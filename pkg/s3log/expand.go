@@ -0,0 +1,82 @@
+package s3log
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// expandEnv replaces ${VAR} with the value of the plugin's environment
+// variable VAR, or with default for ${VAR:-default} when VAR is unset or
+// empty. Defaults may themselves hold references. $$ stands for a literal $,
+// and a $ not followed by { or $ is kept as it is so that template
+// variables survive. A variable that is unset and has no default is an error.
+func expandEnv(s string) (string, error) {
+	out, rest, err := expandUntil(s, false)
+	if err != nil {
+		return "", err
+	}
+	if rest != "" {
+		return "", fmt.Errorf("unexpected %q", rest)
+	}
+	return out, nil
+}
+
+// expandUntil expands s up to the end of the string or, inside a default,
+// the closing brace, returning the expansion and what follows it.
+func expandUntil(s string, inDefault bool) (string, string, error) {
+	var b strings.Builder
+	for len(s) > 0 {
+		switch {
+		case inDefault && s[0] == '}':
+			return b.String(), s, nil
+		case strings.HasPrefix(s, "$$"):
+			b.WriteByte('$')
+			s = s[2:]
+		case strings.HasPrefix(s, "${"):
+			v, rest, err := expandVar(s[2:])
+			if err != nil {
+				return "", "", err
+			}
+			b.WriteString(v)
+			s = rest
+		default:
+			b.WriteByte(s[0])
+			s = s[1:]
+		}
+	}
+	if inDefault {
+		return "", "", fmt.Errorf("missing }")
+	}
+	return b.String(), "", nil
+}
+
+// expandVar expands a reference whose ${ has been consumed.
+func expandVar(s string) (string, string, error) {
+	i := strings.IndexAny(s, ":}")
+	if i < 0 {
+		return "", "", fmt.Errorf("missing } in ${%s", s)
+	}
+	name := s[:i]
+	if name == "" {
+		return "", "", fmt.Errorf("empty variable name")
+	}
+	value, set := os.LookupEnv(name)
+	if s[i] == '}' {
+		if !set {
+			return "", "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, s[i+1:], nil
+	}
+	if !strings.HasPrefix(s[i:], ":-") {
+		return "", "", fmt.Errorf("invalid reference ${%s: only ${%s:-default} is supported", name, name)
+	}
+	def, rest, err := expandUntil(s[i+2:], true)
+	if err != nil {
+		return "", "", err
+	}
+	if value == "" {
+		value = def
+	}
+	return value, rest[1:], nil
+}
@@ -0,0 +1,74 @@
+package s3log
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("S3LOG_ENV", "prod")
+	t.Setenv("S3LOG_EMPTY", "")
+	t.Setenv("S3LOG_TEAM", "payments")
+	tests := []struct {
+		in, want string
+		err      string
+	}{
+		{in: "logs-${S3LOG_ENV}", want: "logs-prod"},
+		{in: "plain", want: "plain"},
+		{in: "${S3LOG_ENV}/${S3LOG_TEAM}/", want: "prod/payments/"},
+		{in: "${S3LOG_UNSET:-dev}", want: "dev"},
+		{in: "${S3LOG_EMPTY:-dev}", want: "dev"},
+		{in: "${S3LOG_ENV:-dev}", want: "prod"},
+		{in: "${S3LOG_UNSET:-}", want: ""},
+		{in: "${S3LOG_UNSET:-${S3LOG_TEAM}}", want: "payments"},
+		{in: "${S3LOG_UNSET:-${S3LOG_ALSO_UNSET:-fallback}}", want: "fallback"},
+		{in: "${S3LOG_UNSET:-a-${S3LOG_ENV}-b}", want: "a-prod-b"},
+		{in: "cost$$5", want: "cost$5"},
+		{in: "$${S3LOG_ENV}", want: "${S3LOG_ENV}"},
+		{in: "${S3LOG_UNSET:-$$}", want: "$"},
+		// Template variables are left for the key template.
+		{in: "{{.ContainerID}}/$x", want: "{{.ContainerID}}/$x"},
+		{in: "${S3LOG_UNSET}", err: "S3LOG_UNSET is not set"},
+		{in: "${S3LOG_UNSET:-${S3LOG_ALSO_UNSET}}", err: "S3LOG_ALSO_UNSET is not set"},
+		{in: "${S3LOG_ENV", err: "missing }"},
+		{in: "${S3LOG_UNSET:-dev", err: "missing }"},
+		{in: "${}", err: "empty variable name"},
+		{in: "${S3LOG_ENV:=dev}", err: "invalid reference"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := expandEnv(tt.in)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expandEnv(%q) = %q, %v, want an error containing %q", tt.in, got, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("expandEnv(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLogOptsExpandsEnv(t *testing.T) {
+	t.Setenv("S3LOG_ENV", "prod")
+	opts, err := parseLogOpts(DefaultOptions(), map[string]string{
+		s3BucketKey:    "logs-${S3LOG_ENV}",
+		s3PrefixKey:    "${S3LOG_UNSET:-dev}/",
+		keyTemplateKey: "${S3LOG_ENV}/{{.ContainerID}}/{{.Timestamp}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.S3Bucket != "logs-prod" || opts.S3Prefix != "dev/" || opts.KeyTemplate != "prod/{{.ContainerID}}/{{.Timestamp}}" {
+		t.Errorf("expanded to bucket %q, prefix %q and key-template %q", opts.S3Bucket, opts.S3Prefix, opts.KeyTemplate)
+	}
+
+	for _, key := range []string{s3BucketKey, s3PrefixKey, keyTemplateKey} {
+		cfg := map[string]string{s3BucketKey: testBucket, key: "${S3LOG_UNSET}"}
+		if _, err := parseLogOpts(DefaultOptions(), cfg); err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("%s with an unset variable: %v, want an error naming it", key, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	failoverBucketKey = "failover-bucket"
+	failoverAfterKey  = "failover-after"
+
+	defaultFailoverAfter = 2 * time.Minute
+
+	// failoverTag is added to the tags of an object written to the failover
+	// bucket, so a reconciliation job can find what to copy back.
+	failoverTag = "failover=true"
+)
+
+var (
+	failoverActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: driverName,
+		Name:      "failover_active",
+		Help:      "Whether objects due for the bucket are being written to its failover bucket: 1 if so, else 0.",
+	}, []string{"bucket"})
+	failoverObjects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "failover_objects_total",
+		Help:      "Objects due for the bucket written to its failover bucket instead.",
+	}, []string{"bucket", "failover_bucket"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(failoverActive, failoverObjects)
+}
+
+// failover is the bucket a logger writes the objects due for s3-bucket to
+// while the primary's circuit breaker has been open for after, so that a
+// sustained outage of the primary or its region doesn't leave every batch in
+// the spool.
+type failover struct {
+	target *target
+	after  time.Duration
+
+	// active is whether the last batch went to the failover bucket. Only
+	// flushes upload to the primary, so it's guarded by the logger's
+	// flushMu.
+	active bool
+}
+
+// parseFailoverBucket splits a failover-bucket, a bucket optionally followed
+// by @region.
+func parseFailoverBucket(v string) (string, string, error) {
+	bucket, region, _ := strings.Cut(strings.TrimSpace(v), "@")
+	switch {
+	case bucket == "":
+		return "", "", errors.New("empty bucket name")
+	case strings.Contains(v, ","):
+		return "", "", errors.New("must be a single bucket")
+	}
+	return bucket, region, nil
+}
+
+// openFor returns how long the breaker has held uploads to its bucket off,
+// from when it opened through any probes that failed since, or 0 if it is
+// closed. A nil breaker is never open.
+func (b *circuitBreaker) openFor() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerClosed {
+		return 0
+	}
+	return time.Since(b.opened)
+}
+
+// failOver uploads b, which failed to upload to t, to the failover bucket
+// instead, if t is the primary and its circuit breaker has been open for
+// failover-after, reporting whether it was uploaded. The object is tagged
+// failover=true and listed in the primary's manifest, which is written once
+// the primary is reachable again, with the bucket it was written to. Strict
+// loggers never fail over, since the primary would then miss objects ahead
+// of the ones uploaded to it once it recovers.
+func (l *S3Logger) failOver(ctx context.Context, t *target, b *batch, log *logrus.Entry) bool {
+	f := l.failover
+	if f == nil || t != l.targets[0] || l.strict() || l.pool.breaker(t.bucket).openFor() < f.after {
+		return false
+	}
+	ft := f.target
+	c := *b
+	fb := &c
+	fb.Bucket, fb.Client, fb.failover = ft.bucket, ft.cfg, true
+	if fb.Tagging != "" {
+		fb.Tagging += "&"
+	}
+	fb.Tagging += failoverTag
+	log = log.WithField("failover_bucket", ft.bucket)
+	if !f.active {
+		f.active = true
+		failoverActive.WithLabelValues(t.bucket).Set(1)
+		log.Warnf("circuit breaker open for longer than %s %s, writing objects to the failover bucket", failoverAfterKey, f.after)
+	}
+	err := retry(ctx, l.opts.MaxRetries, l.opts.MaxRetryDelay, func() error {
+		err := l.pool.upload(ctx, ft.bucket, l.opts.S3RequestTimeout, func(ctx context.Context) error {
+			return uploadBatch(ctx, ft.uploader, fb)
+		})
+		if err != nil && !errors.Is(err, errBreakerOpen) {
+			ft.metrics.errors.Inc()
+			s3Failed(log, ft.bucket, err).Warn("error uploading logs to the failover bucket")
+		}
+		return err
+	})
+	if err != nil {
+		describeAWSError(err).fields(log).WithError(err).Error("error uploading logs to the failover bucket")
+		return false
+	}
+	l.pool.tenantBudget(l.opts.Tenant).charge(len(fb.body))
+	ft.metrics.uploaded.Add(float64(len(fb.body)))
+	ft.metrics.lines.Add(float64(fb.Lines))
+	failoverObjects.WithLabelValues(t.bucket, ft.bucket).Inc()
+	log.WithField("bytes", len(fb.body)).Debug("uploaded logs to the failover bucket")
+	t.record(fb, false)
+	l.clients.notifyUpload(ctx, fb)
+	return true
+}
+
+// failedBack notes that a batch uploaded to t again, ending a failover of the
+// primary if there was one.
+func (l *S3Logger) failedBack(t *target, log *logrus.Entry) {
+	f := l.failover
+	if f == nil || !f.active || t != l.targets[0] {
+		return
+	}
+	f.active = false
+	failoverActive.WithLabelValues(t.bucket).Set(0)
+	log.WithField("failover_bucket", f.target.bucket).Info("bucket reachable again, no longer writing objects to the failover bucket")
+}
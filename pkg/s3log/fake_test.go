@@ -0,0 +1,794 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/containerd/fifo"
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeS3 is an in-memory s3API. Objects are kept per bucket, and every call
+// is counted by operation, with the range of every GetObject recorded. Errors queued with fail are returned by the next
+// calls of an operation, before it does anything; before, if set, is called
+// ahead of every operation and can block it or fail it too.
+type fakeS3 struct {
+	mu       sync.Mutex
+	buckets  map[string]map[string]*fakeObject
+	uploads  map[string]*fakeUpload
+	calls    map[string]int
+	ranges   []string // of each GetObject, "" for a whole object
+	failures map[string][]error
+	pageSize int
+	before   func(ctx context.Context, op, bucket, key string) error
+	nextID   int
+}
+
+type fakeObject struct {
+	data            []byte
+	modified        time.Time
+	contentType     string
+	contentEncoding string
+	metadata        map[string]string
+	tagging         string
+	storageClass    types.StorageClass
+}
+
+type fakeUpload struct {
+	bucket, key string
+	input       *s3.CreateMultipartUploadInput
+	parts       map[int32][]byte
+	initiated   time.Time
+}
+
+var _ s3API = (*fakeS3)(nil)
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		buckets:  make(map[string]map[string]*fakeObject),
+		uploads:  make(map[string]*fakeUpload),
+		calls:    make(map[string]int),
+		failures: make(map[string][]error),
+		pageSize: 1000,
+	}
+}
+
+// fakeStatusError returns an error shaped as the SDK's for a response with
+// status and the API error code.
+func fakeStatusError(status int, code string) error {
+	var api error = &smithy.GenericAPIError{Code: code, Message: http.StatusText(status)}
+	if code == "NoSuchKey" {
+		api = &types.NoSuchKey{Message: aws.String(http.StatusText(status))}
+	}
+	return &awshttp.ResponseError{
+		ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status, Header: http.Header{}}},
+			Err:      api,
+		},
+		RequestID: "fake",
+	}
+}
+
+// fail makes the next n calls of op return err.
+func (f *fakeS3) fail(op string, n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for range n {
+		f.failures[op] = append(f.failures[op], err)
+	}
+}
+
+// count returns how many times op has been called.
+func (f *fakeS3) count(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// getRanges returns the range of each GetObject so far, "" for a whole
+// object.
+func (f *fakeS3) getRanges() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.ranges)
+}
+
+// put stores an object as if it had been uploaded at modified.
+func (f *fakeS3) put(bucket, key string, data []byte, modified time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.store(bucket, key, &fakeObject{data: data, modified: modified})
+}
+
+// object returns the contents of an object, and whether it exists.
+func (f *fakeS3) object(bucket, key string) (*fakeObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.buckets[bucket][key]
+	return o, ok
+}
+
+// keys returns the keys of bucket in order.
+func (f *fakeS3) keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.buckets[bucket]))
+	for k := range f.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// logKeys returns the keys of bucket holding logs rather than sidecars.
+func (f *fakeS3) logKeys(bucket string) []string {
+	var keys []string
+	for _, k := range f.keys(bucket) {
+		if !isSidecar(k) && !strings.Contains(k, deadLetterDir) && !strings.HasPrefix(k, probeKey) && !strings.Contains(k, "/"+probeKey) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (f *fakeS3) store(bucket, key string, o *fakeObject) {
+	if f.buckets[bucket] == nil {
+		f.buckets[bucket] = make(map[string]*fakeObject)
+	}
+	f.buckets[bucket][key] = o
+}
+
+// call counts a call of op and returns the error it should fail with.
+func (f *fakeS3) call(ctx context.Context, op, bucket, key string) error {
+	f.mu.Lock()
+	f.calls[op]++
+	before := f.before
+	var err error
+	if q := f.failures[op]; len(q) > 0 {
+		err, f.failures[op] = q[0], q[1:]
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if before != nil {
+		if err := before(ctx, op, bucket, key); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if err := f.call(ctx, "PutObject", aws.ToString(in.Bucket), aws.ToString(in.Key)); err != nil {
+		return nil, err
+	}
+	var data []byte
+	if in.Body != nil {
+		var err error
+		if data, err = io.ReadAll(in.Body); err != nil {
+			return nil, err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.store(aws.ToString(in.Bucket), aws.ToString(in.Key), &fakeObject{
+		data:            data,
+		modified:        time.Now(),
+		contentType:     aws.ToString(in.ContentType),
+		contentEncoding: aws.ToString(in.ContentEncoding),
+		metadata:        maps.Clone(in.Metadata),
+		tagging:         aws.ToString(in.Tagging),
+		storageClass:    in.StorageClass,
+	})
+	return &s3.PutObjectOutput{ETag: aws.String(etag(data))}, nil
+}
+
+func etag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", sum[:16]))
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if err := f.call(ctx, "GetObject", aws.ToString(in.Bucket), aws.ToString(in.Key)); err != nil {
+		return nil, err
+	}
+	o, ok := f.object(aws.ToString(in.Bucket), aws.ToString(in.Key))
+	if !ok {
+		return nil, fakeStatusError(http.StatusNotFound, "NoSuchKey")
+	}
+	data := o.data
+	r := aws.ToString(in.Range)
+	f.mu.Lock()
+	f.ranges = append(f.ranges, r)
+	f.mu.Unlock()
+	if r != "" {
+		start, end, err := parseRange(r, int64(len(data)))
+		if err != nil {
+			return nil, fakeStatusError(http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+		}
+		data = data[start:end]
+	}
+	return &s3.GetObjectOutput{
+		Body:            io.NopCloser(bytes.NewReader(data)),
+		ContentLength:   aws.Int64(int64(len(data))),
+		ContentType:     aws.String(o.contentType),
+		ContentEncoding: aws.String(o.contentEncoding),
+		LastModified:    aws.Time(o.modified),
+		Metadata:        maps.Clone(o.metadata),
+		ETag:            aws.String(etag(o.data)),
+	}, nil
+}
+
+// parseRange returns the bounds of a "bytes=" range of an object of size
+// bytes, as written by the readers: first-last, first- or -suffix.
+func parseRange(r string, size int64) (int64, int64, error) {
+	first, last, ok := strings.Cut(strings.TrimPrefix(r, "bytes="), "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("bad range %q", r)
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		return max(size-n, 0), size, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, fmt.Errorf("bad range %q", r)
+	}
+	end := size
+	if last != "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		end = min(n+1, size)
+	}
+	return start, end, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if err := f.call(ctx, "HeadObject", aws.ToString(in.Bucket), aws.ToString(in.Key)); err != nil {
+		return nil, err
+	}
+	o, ok := f.object(aws.ToString(in.Bucket), aws.ToString(in.Key))
+	if !ok {
+		return nil, fakeStatusError(http.StatusNotFound, "NotFound")
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(o.data))),
+		ContentType:   aws.String(o.contentType),
+		LastModified:  aws.Time(o.modified),
+		Metadata:      maps.Clone(o.metadata),
+		ETag:          aws.String(etag(o.data)),
+	}, nil
+}
+
+func (f *fakeS3) HeadBucket(ctx context.Context, in *s3.HeadBucketInput, _ ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	if err := f.call(ctx, "HeadBucket", aws.ToString(in.Bucket), ""); err != nil {
+		return nil, err
+	}
+	return &s3.HeadBucketOutput{BucketRegion: aws.String("us-east-1")}, nil
+}
+
+// ListObjectsV2 lists keys in order, pageSize or MaxKeys at a time, rolling
+// keys up to the delimiter into common prefixes when one is given.
+func (f *fakeS3) ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	bucket, prefix := aws.ToString(in.Bucket), aws.ToString(in.Prefix)
+	if err := f.call(ctx, "ListObjectsV2", bucket, prefix); err != nil {
+		return nil, err
+	}
+	after := aws.ToString(in.StartAfter)
+	if t := aws.ToString(in.ContinuationToken); t > after {
+		after = t
+	}
+	limit := f.pageSize
+	if n := aws.ToInt32(in.MaxKeys); n > 0 && int(n) < limit {
+		limit = int(n)
+	}
+	delimiter := aws.ToString(in.Delimiter)
+
+	out := &s3.ListObjectsV2Output{Name: in.Bucket, Prefix: in.Prefix}
+	seen := make(map[string]bool)
+	n := 0
+	for _, k := range f.keys(bucket) {
+		if !strings.HasPrefix(k, prefix) || k <= after {
+			continue
+		}
+		entry := k
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				entry = k[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if seen[entry] || entry <= after {
+			continue
+		}
+		if n == limit {
+			out.IsTruncated = aws.Bool(true)
+			break
+		}
+		seen[entry] = true
+		n++
+		if entry != k {
+			out.CommonPrefixes = append(out.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(entry)})
+			// Resume past every key under the prefix.
+			out.NextContinuationToken = aws.String(entry + "\xff")
+			continue
+		}
+		o, _ := f.object(bucket, k)
+		out.Contents = append(out.Contents, types.Object{
+			Key:          aws.String(k),
+			Size:         aws.Int64(int64(len(o.data))),
+			LastModified: aws.Time(o.modified),
+			ETag:         aws.String(etag(o.data)),
+		})
+		out.NextContinuationToken = aws.String(k)
+	}
+	if !aws.ToBool(out.IsTruncated) {
+		out.NextContinuationToken = nil
+	}
+	out.KeyCount = aws.Int32(int32(n))
+	return out, nil
+}
+
+func (f *fakeS3) DeleteObjects(ctx context.Context, in *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	if err := f.call(ctx, "DeleteObjects", aws.ToString(in.Bucket), ""); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &s3.DeleteObjectsOutput{}
+	for _, o := range in.Delete.Objects {
+		delete(f.buckets[aws.ToString(in.Bucket)], aws.ToString(o.Key))
+		out.Deleted = append(out.Deleted, types.DeletedObject{Key: o.Key})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) SelectObjectContent(ctx context.Context, in *s3.SelectObjectContentInput, _ ...func(*s3.Options)) (*s3.SelectObjectContentOutput, error) {
+	if err := f.call(ctx, "SelectObjectContent", aws.ToString(in.Bucket), aws.ToString(in.Key)); err != nil {
+		return nil, err
+	}
+	return nil, fakeStatusError(http.StatusNotImplemented, "NotImplemented")
+}
+
+func (f *fakeS3) CreateMultipartUpload(ctx context.Context, in *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	if err := f.call(ctx, "CreateMultipartUpload", aws.ToString(in.Bucket), aws.ToString(in.Key)); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	id := strconv.Itoa(f.nextID)
+	f.uploads[id] = &fakeUpload{bucket: aws.ToString(in.Bucket), key: aws.ToString(in.Key), input: in, parts: make(map[int32][]byte), initiated: time.Now()}
+	return &s3.CreateMultipartUploadOutput{Bucket: in.Bucket, Key: in.Key, UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) UploadPart(ctx context.Context, in *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if err := f.call(ctx, "UploadPart", aws.ToString(in.Bucket), aws.ToString(in.Key)); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, ok := f.uploads[aws.ToString(in.UploadId)]
+	if !ok {
+		return nil, fakeStatusError(http.StatusNotFound, "NoSuchUpload")
+	}
+	u.parts[aws.ToInt32(in.PartNumber)] = data
+	return &s3.UploadPartOutput{ETag: aws.String(etag(data))}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(ctx context.Context, in *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	if err := f.call(ctx, "CompleteMultipartUpload", aws.ToString(in.Bucket), aws.ToString(in.Key)); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, ok := f.uploads[aws.ToString(in.UploadId)]
+	if !ok {
+		return nil, fakeStatusError(http.StatusNotFound, "NoSuchUpload")
+	}
+	var data []byte
+	for _, p := range in.MultipartUpload.Parts {
+		data = append(data, u.parts[aws.ToInt32(p.PartNumber)]...)
+	}
+	delete(f.uploads, aws.ToString(in.UploadId))
+	f.store(u.bucket, u.key, &fakeObject{
+		data:            data,
+		modified:        time.Now(),
+		contentType:     aws.ToString(u.input.ContentType),
+		contentEncoding: aws.ToString(u.input.ContentEncoding),
+		metadata:        maps.Clone(u.input.Metadata),
+		tagging:         aws.ToString(u.input.Tagging),
+		storageClass:    u.input.StorageClass,
+	})
+	return &s3.CompleteMultipartUploadOutput{Bucket: in.Bucket, Key: in.Key, ETag: aws.String(etag(data))}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	if err := f.call(ctx, "AbortMultipartUpload", aws.ToString(in.Bucket), aws.ToString(in.Key)); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.uploads, aws.ToString(in.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) ListParts(ctx context.Context, in *s3.ListPartsInput, _ ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	if err := f.call(ctx, "ListParts", aws.ToString(in.Bucket), aws.ToString(in.Key)); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, ok := f.uploads[aws.ToString(in.UploadId)]
+	if !ok {
+		return nil, fakeStatusError(http.StatusNotFound, "NoSuchUpload")
+	}
+	out := &s3.ListPartsOutput{Bucket: in.Bucket, Key: in.Key, UploadId: in.UploadId}
+	for n, data := range u.parts {
+		out.Parts = append(out.Parts, types.Part{PartNumber: aws.Int32(n), Size: aws.Int64(int64(len(data))), ETag: aws.String(etag(data))})
+	}
+	sort.Slice(out.Parts, func(i, j int) bool {
+		return aws.ToInt32(out.Parts[i].PartNumber) < aws.ToInt32(out.Parts[j].PartNumber)
+	})
+	return out, nil
+}
+
+func (f *fakeS3) ListMultipartUploads(ctx context.Context, in *s3.ListMultipartUploadsInput, _ ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	if err := f.call(ctx, "ListMultipartUploads", aws.ToString(in.Bucket), aws.ToString(in.Prefix)); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &s3.ListMultipartUploadsOutput{Bucket: in.Bucket}
+	for id, u := range f.uploads {
+		if u.bucket == aws.ToString(in.Bucket) && strings.HasPrefix(u.key, aws.ToString(in.Prefix)) {
+			out.Uploads = append(out.Uploads, types.MultipartUpload{Key: aws.String(u.key), UploadId: aws.String(id), Initiated: aws.Time(u.initiated)})
+		}
+	}
+	return out, nil
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// The loggers warn of every failure a test injects.
+	if !testing.Verbose() {
+		logrus.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// testBucket is the bucket the test loggers upload to.
+const testBucket = "logs"
+
+// newTestClients returns a client factory whose every S3 client is fake,
+// with static credentials standing in for the default chain.
+func newTestClients(fake *fakeS3) *clientFactory {
+	cfg := aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIDTEST", "secret", ""),
+	}
+	f := newClientFactory(cfg, 4, false)
+	f.newClient = func(aws.Config, ...func(*s3.Options)) s3API { return fake }
+	return f
+}
+
+// testContainerIDs are the IDs testContainerID gave each test, and how
+// many times each test's name has run.
+var testContainerIDs = struct {
+	sync.Mutex
+	ids  map[testing.TB]string
+	runs map[string]int
+}{ids: make(map[testing.TB]string), runs: make(map[string]int)}
+
+// testContainerID returns a container ID unique to the test, as the metrics
+// of a container are registered by its ID, and to its run under -count, as
+// the plugin carries some state over to a container that starts again.
+func testContainerID(t testing.TB) string {
+	testContainerIDs.Lock()
+	defer testContainerIDs.Unlock()
+	if id, ok := testContainerIDs.ids[t]; ok {
+		return id
+	}
+	testContainerIDs.runs[t.Name()]++
+	sum := sha256.Sum256([]byte(t.Name() + "\x00" + strconv.Itoa(testContainerIDs.runs[t.Name()])))
+	id := fmt.Sprintf("%x", sum)
+	testContainerIDs.ids[t] = id
+	return id
+}
+
+// testLogOpts returns the log-opts of a test container uploading to
+// testBucket through the fake, with cfg on top. Its state stays in a
+// temporary directory, and the endpoint is set so that the bucket's region
+// isn't looked up.
+func testLogOpts(t testing.TB, cfg map[string]string) map[string]string {
+	opts := map[string]string{
+		s3BucketKey:    testBucket,
+		endpointURLKey: "http://s3.test",
+		stateDirKey:    t.TempDir(),
+	}
+	maps.Copy(opts, cfg)
+	return opts
+}
+
+// newTestLogger starts a logger for a test container uploading to fake with
+// the log-opts cfg, and stops it at the end of the test.
+func newTestLogger(t testing.TB, fake *fakeS3, cfg map[string]string) *S3Logger {
+	t.Helper()
+	l, _ := newTestDriverLogger(t, fake, Info{Config: testLogOpts(t, cfg), ContainerID: testContainerID(t), ContainerName: "/test"})
+	s, ok := l.(*S3Logger)
+	if !ok {
+		t.Fatalf("logger is a %T, not an *S3Logger", l)
+	}
+	return s
+}
+
+// newTestDriverLogger starts the logger newLogger returns for info, with a
+// driver of its own for its spool, and closes it at the end of the test if
+// the test hasn't.
+func newTestDriverLogger(t testing.TB, fake *fakeS3, info Info) (containerLogger, *Driver) {
+	t.Helper()
+	return newClientsLogger(t, newTestClients(fake), info)
+}
+
+// newClientsLogger is newTestDriverLogger with the logger's clients built by
+// clients.
+func newClientsLogger(t testing.TB, clients *clientFactory, info Info) (containerLogger, *Driver) {
+	t.Helper()
+	opts, err := parseLogOpts(DefaultOptions(), info.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newUploadPool(4, defaultBreakerThreshold, defaultBreakerCooldown, 0)
+	d := newDriver(clients, pool, newMemoryBudget(defaultMaxTotalBuffer), opts)
+	t.Cleanup(d.cancel)
+	sp, err := d.spoolFor(opts.SpoolDir, opts.SpoolMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := newLogger(d.clients, d.pool, d.budget, opts, info, sp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, s := range s3Loggers(l) {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if !closed {
+				l.Close()
+				return
+			}
+		}
+	})
+	return l, d
+}
+
+// logLines logs each of lines to l as a line of stdout, a millisecond apart
+// from start.
+func logLines(t testing.TB, l containerLogger, start time.Time, lines ...string) {
+	t.Helper()
+	for i, line := range lines {
+		msg := &Message{Line: []byte(line), Source: "stdout", Timestamp: start.Add(time.Duration(i) * time.Millisecond)}
+		if err := l.Log(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// objectMessages returns the messages of the object at key in testBucket,
+// read back by l.
+func objectMessages(t testing.TB, l *S3Logger, key string) []*Message {
+	t.Helper()
+	var msgs []*Message
+	err := l.readObject(context.Background(), logObject{key: key}, func(msg *Message) bool {
+		c := *msg
+		c.Line = slices.Clone(msg.Line)
+		msgs = append(msgs, &c)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+// objectLines returns the lines of the object at key in testBucket, read
+// back by l and without their newlines.
+func objectLines(t testing.TB, l *S3Logger, key string) []string {
+	t.Helper()
+	var lines []string
+	for _, msg := range objectMessages(t, l, key) {
+		lines = append(lines, strings.TrimSuffix(string(msg.Line), "\n"))
+	}
+	return lines
+}
+
+// uploadedLines returns the lines of every log object in testBucket, in the
+// order of their keys.
+func uploadedLines(t testing.TB, fake *fakeS3, l *S3Logger) []string {
+	t.Helper()
+	var lines []string
+	for _, k := range fake.logKeys(testBucket) {
+		lines = append(lines, objectLines(t, l, k)...)
+	}
+	return lines
+}
+
+// newTestDriver returns a driver whose containers upload to fake, starting
+// from the test log-opts with cfg on top, and shuts it down at the end of the
+// test.
+func newTestDriver(t testing.TB, fake *fakeS3, cfg map[string]string) *Driver {
+	t.Helper()
+	opts, err := parseLogOpts(DefaultOptions(), testLogOpts(t, cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newUploadPool(4, defaultBreakerThreshold, defaultBreakerCooldown, 0)
+	d := newDriver(newTestClients(fake), pool, newMemoryBudget(defaultMaxTotalBuffer), opts)
+	t.Cleanup(d.Close)
+	return d
+}
+
+// testContainer is a container logging through a driver: the daemon's end
+// of its FIFO, what the driver was told of it and the logger it started,
+// which still reads the container's objects back once stopped.
+type testContainer struct {
+	file string
+	info Info
+	w    io.WriteCloser
+	enc  logdriver.LogEntryEncoder
+	l    *S3Logger
+}
+
+// startContainer starts logging a container with the log-opts cfg, as the
+// daemon does, and returns it ready for its lines to be written.
+func startContainer(t testing.TB, d *Driver, cfg map[string]string) *testContainer {
+	t.Helper()
+	return startContainerInfo(t, d, Info{Config: testLogOpts(t, cfg), ContainerID: testContainerID(t), ContainerName: "/test"})
+}
+
+// startContainerInfo is startContainer for the container info.
+func startContainerInfo(t testing.TB, d *Driver, info Info) *testContainer {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "fifo")
+	if err := syscall.Mkfifo(file, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The daemon opens its end first, without waiting for the plugin's.
+	w, err := fifo.OpenFifo(context.Background(), file, syscall.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testContainer{file: file, info: info}
+	c.w, c.enc = w, logdriver.NewLogEntryEncoder(w)
+	if err := d.StartLogging(file, c.info); err != nil {
+		w.Close()
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	l, _ := d.logs[file].logger()
+	d.mu.Unlock()
+	c.l = s3Loggers(l)[0]
+	return c
+}
+
+// write writes entries to the container's FIFO as the daemon would.
+func (c *testContainer) write(t testing.TB, entries ...*logdriver.LogEntry) {
+	t.Helper()
+	for _, e := range entries {
+		if err := c.enc.Encode(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// stop closes the daemon's end of the FIFO and stops logging the container.
+func (c *testContainer) stop(t testing.TB, d *Driver) {
+	t.Helper()
+	c.w.Close()
+	if err := d.StopLogging(c.file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// entry returns the FIFO entry of a line of source logged at t.
+func entry(source, line string, t time.Time) *logdriver.LogEntry {
+	return &logdriver.LogEntry{Source: source, TimeNano: t.UnixNano(), Line: []byte(line)}
+}
+
+// waitFor polls cond until it holds, failing the test if it doesn't within
+// a few seconds.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// readLogs reads the container's logs back through l as docker logs does,
+// returning each line without its newline.
+func readLogs(t testing.TB, l *S3Logger, config ReadConfig) []string {
+	t.Helper()
+	watcher := l.ReadLogs(config)
+	defer watcher.ConsumerGone()
+	var lines []string
+	for msg := range watcher.Msg {
+		lines = append(lines, strings.TrimSuffix(string(msg.Line), "\n"))
+	}
+	select {
+	case err := <-watcher.Err:
+		t.Fatal(err)
+	default:
+	}
+	return lines
+}
+
+// encodeObject returns the contents of an object holding lines, one a
+// second from start, as l would upload them, compressed with codec.
+func encodeObject(t testing.TB, l *S3Logger, codec string, start time.Time, lines ...string) []byte {
+	t.Helper()
+	var data []byte
+	for i, line := range lines {
+		msg := &Message{Line: []byte(line), Source: "stdout", Timestamp: start.Add(time.Duration(i) * time.Second)}
+		data, _ = l.encodeRecord(data, msg, int64(i+1))
+	}
+	if codec == compressNone {
+		return data
+	}
+	data, err := compressBytes(codec, 0, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// putObject stores an object of lines as l would upload it when flushing at
+// ts: the lines are a second apart, the last logged at ts, and the key is l's
+// key prefix followed by ts, or by name instead if it is set.
+func putObject(t testing.TB, fake *fakeS3, l *S3Logger, codec, name string, ts time.Time, lines ...string) string {
+	t.Helper()
+	key := l.keyPrefix() + name
+	if name == "" {
+		key = l.keyPrefix() + ts.UTC().Format(keyTimestampFormat) + ".log" + codecs[codec].ext
+	}
+	start := ts.Add(-time.Duration(len(lines)-1) * time.Second)
+	fake.put(testBucket, key, encodeObject(t, l, codec, start, lines...), ts)
+	return key
+}
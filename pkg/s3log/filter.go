@@ -0,0 +1,48 @@
+package s3log
+
+import (
+	"regexp"
+)
+
+const (
+	filterIncludeKey = "filter-include"
+	filterExcludeKey = "filter-exclude"
+)
+
+// lineFilter keeps the lines matching include, if set, unless they also match
+// exclude.
+type lineFilter struct {
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+// newLineFilter compiles the filter-include and filter-exclude patterns.
+// Either may be empty.
+func newLineFilter(include, exclude string) (lineFilter, error) {
+	var f lineFilter
+	var err error
+	if include != "" {
+		if f.include, err = regexp.Compile(include); err != nil {
+			return f, err
+		}
+	}
+	if exclude != "" {
+		if f.exclude, err = regexp.Compile(exclude); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// keep reports whether msg passes the container's filters, counting the
+// lines it drops. It sees complete lines, after partial lines have been
+// reassembled and before they are grouped into multiline records. Callers
+// must hold l.mu.
+func (l *S3Logger) keep(msg *Message) bool {
+	f := l.filter
+	if f.exclude != nil && f.exclude.Match(msg.Line) || f.include != nil && !f.include.Match(msg.Line) {
+		l.metrics.filtered.Inc()
+		return false
+	}
+	return true
+}
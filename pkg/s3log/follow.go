@@ -0,0 +1,129 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+)
+
+// followerBufferSize is how many lines a follower may fall behind the
+// container before it is disconnected.
+const followerBufferSize = 1024
+
+var errFollowerLagged = errors.New("log reader fell too far behind the container")
+
+// follower receives every line logged to an S3Logger after it subscribed.
+type follower struct {
+	ch     chan *Message
+	lagged bool
+}
+
+// subscribe registers a follower and returns it along with a copy of the
+// lines that are buffered, sealed or being uploaded, and the time before which every
+// other object was written. Objects newer than the cutoff hold lines the
+// follower already has, either in the snapshot or through its channel.
+func (l *S3Logger) subscribe() (*follower, []byte, time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f := &follower{ch: make(chan *Message, followerBufferSize)}
+	if l.followers == nil {
+		l.followers = make(map[*follower]struct{})
+	}
+	if l.closed {
+		close(f.ch)
+	} else {
+		l.followers[f] = struct{}{}
+	}
+	snapshot := bytes.Clone(l.inflight)
+	for _, b := range l.sealed {
+		snapshot = append(snapshot, b.data...)
+	}
+	snapshot = append(snapshot, l.buf.Bytes()...)
+	if l.inflight != nil {
+		return f, snapshot, l.inflightTime.Add(-time.Nanosecond)
+	}
+	return f, snapshot, time.Now()
+}
+
+func (l *S3Logger) unsubscribe(f *follower) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.followers[f]; ok {
+		delete(l.followers, f)
+		close(f.ch)
+	}
+}
+
+// publish hands a copy of msg to every follower. A follower whose buffer is
+// full is disconnected rather than stalling the container. Callers must hold
+// l.mu.
+func (l *S3Logger) publish(msg *Message) {
+	if len(l.followers) == 0 {
+		return
+	}
+	line := make([]byte, len(msg.Line), len(msg.Line)+1)
+	copy(line, msg.Line)
+	for f := range l.followers {
+		m := &Message{
+			Line:      append(line, '\n'),
+			Source:    msg.Source,
+			Timestamp: msg.Timestamp,
+		}
+		select {
+		case f.ch <- m:
+		default:
+			f.lagged = true
+			delete(l.followers, f)
+			close(f.ch)
+		}
+	}
+}
+
+// closeFollowers ends every follow stream. Callers must hold l.mu.
+func (l *S3Logger) closeFollowers() {
+	for f := range l.followers {
+		delete(l.followers, f)
+		close(f.ch)
+	}
+}
+
+// follow replays the objects uploaded before subscribing, then the buffered
+// lines, then streams new lines until the consumer goes away, the container
+// stops or a line past config.Until arrives.
+func (l *S3Logger) follow(ctx context.Context, watcher *LogWatcher, config ReadConfig, objects []logObject, snapshot []byte, f *follower, cutoff time.Time) error {
+	var history []logObject
+	for _, obj := range objects {
+		if obj.time.After(cutoff) {
+			break
+		}
+		history = append(history, obj)
+	}
+	history = append(history, logObject{time: cutoff, data: snapshot})
+
+	emit := watcherEmitter(watcher, config)
+	if err := l.replay(ctx, history, config, emit); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case msg, ok := <-f.ch:
+			if !ok {
+				l.mu.Lock()
+				lagged := f.lagged
+				l.mu.Unlock()
+				if lagged {
+					return errFollowerLagged
+				}
+				return nil
+			}
+			if !emit(msg) {
+				return nil
+			}
+		case <-watcher.WatchConsumerGone():
+			return nil
+		}
+	}
+}
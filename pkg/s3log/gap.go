@@ -0,0 +1,139 @@
+package s3log
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The reasons a log_gap marker gives for the lines missing before it.
+const (
+	gapBufferFull   = "buffer_full"
+	gapBudget       = "budget_exceeded"
+	gapSpoolEvicted = "spool_evicted"
+	gapUploadFailed = "upload_failed"
+
+	// gapStream is the stream of a marker's record, and gapRawPrefix starts
+	// a marker in the raw format, whose lines have none.
+	gapStream    = "stderr"
+	gapRawPrefix = "[s3logdriver] "
+
+	eventLogGap = "log_gap"
+)
+
+var logGaps = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: driverName,
+	Name:      "log_gaps_total",
+	Help:      "log_gap markers written into containers' logs, by the reason their lines were dropped.",
+}, []string{"reason"})
+
+func init() {
+	metricsRegistry.MustRegister(logGaps)
+}
+
+// logGap is a run of lines dropped for the same reason. from and to are the
+// sequence numbers of the lines kept either side of it, so the numbers in
+// between, if any, are those of the dropped lines; lines dropped from the
+// ring, before they were numbered, leave none.
+type logGap struct {
+	reason  string
+	dropped int64
+	from    int64
+	to      int64
+	closed  time.Time // when the last of its lines was dropped
+}
+
+// gapEvent is the log_gap marker of a gap.
+type gapEvent struct {
+	Event   string `json:"event"`
+	Dropped int64  `json:"dropped_lines"`
+	From    int64  `json:"from_seq"`
+	To      int64  `json:"to_seq"`
+	Reason  string `json:"reason"`
+}
+
+// noteGap records n lines dropped for reason between the lines numbered from
+// and to, for the next flush to mark. A gap that runs on from the last one
+// noted for the same reason extends it, so that it is marked once.
+func (l *S3Logger) noteGap(reason string, n, from, to int64) {
+	if n <= 0 {
+		return
+	}
+	l.gapMu.Lock()
+	defer l.gapMu.Unlock()
+	if k := len(l.gaps); k > 0 {
+		if g := &l.gaps[k-1]; g.reason == reason && g.from <= from && from < g.to {
+			g.dropped += n
+			g.to = max(g.to, to)
+			g.closed = time.Now()
+			return
+		}
+	}
+	l.gaps = append(l.gaps, logGap{reason: reason, dropped: n, from: from, to: to, closed: time.Now()})
+}
+
+// droppedBatch notes the lines of b as dropped from t for reason. Only the
+// primary bucket's are: a batch a replica lost is still in the primary.
+func (l *S3Logger) droppedBatch(t *target, b *batch, reason string) {
+	if t == l.targets[0] {
+		l.noteGap(reason, int64(b.Lines), b.FirstSeq-1, b.FirstSeq+int64(b.Lines))
+	}
+}
+
+// evicted notes the lines of b, evicted from the spool, as dropped if b is
+// one of the logger's batches for its primary bucket.
+func (l *S3Logger) evicted(b *batch) {
+	if b.Bucket == l.bucket && strings.HasPrefix(b.Key, l.opts.S3Prefix) {
+		l.noteGap(gapSpoolEvicted, int64(b.Lines), b.FirstSeq-1, b.FirstSeq+int64(b.Lines))
+	}
+}
+
+// markGaps appends a log_gap marker to the buffer for each gap noted since
+// the last flush, numbered as the next line and stamped with when the gap
+// closed. Callers must hold l.mu.
+func (l *S3Logger) markGaps() {
+	l.gapMu.Lock()
+	gaps := l.gaps
+	l.gaps = nil
+	l.gapMu.Unlock()
+	for _, g := range gaps {
+		event, _ := json.Marshal(gapEvent{eventLogGap, g.dropped, g.from, g.to, g.reason})
+		l.appendMarker(event, g.closed)
+		logGaps.WithLabelValues(g.reason).Inc()
+		l.log().WithField("reason", g.reason).WithField("from_seq", g.from).WithField("to_seq", g.to).Warnf("marked a gap of %d dropped lines", g.dropped)
+	}
+}
+
+// appendMarker appends event to the buffer as a record of its own, numbered
+// as the next line and stamped t. Callers must hold l.mu.
+func (l *S3Logger) appendMarker(event []byte, t time.Time) {
+	seq := l.lineSeq + 1
+	if l.buf.Len() == 0 {
+		l.bufSeq = seq
+		l.bufTime = t
+		l.bufPart = l.partition(l.partitionTime(t))
+		l.bufLast = t
+	} else if t.After(l.bufLast) {
+		l.bufLast = t
+	}
+	l.lineSeq = seq
+	l.scratch = l.format.marker(l.scratch[:0], event, seq, t)
+	l.buf.Write(l.scratch)
+}
+
+// marker appends event as a record of its own, with the fields of a line on
+// gapStream, as merge-json-log merges a line that is a JSON object.
+func (f jsonlFormat) marker(dst, event []byte, seq int64, t time.Time) []byte {
+	dst = append(dst, event[:len(event)-1]...)
+	dst = append(dst, `,"stream":`...)
+	dst = f.appendFields(dst, &Message{Source: gapStream, Timestamp: t}, seq)
+	return append(dst, f.suffix...)
+}
+
+// marker appends event after gapRawPrefix, as a raw line logged at t.
+func (f rawFormat) marker(dst, event []byte, _ int64, t time.Time) []byte {
+	line := append([]byte(gapRawPrefix), event...)
+	return f.encode(dst, &Message{Line: line, Timestamp: t}, 0)
+}
@@ -0,0 +1,241 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// uploadedRecords returns every record uploaded to fake, each as the fields
+// it holds, in key order.
+func uploadedRecords(t *testing.T, fake *fakeS3) []map[string]any {
+	t.Helper()
+	var recs []map[string]any
+	for _, key := range fake.logKeys(testBucket) {
+		o, _ := fake.object(testBucket, key)
+		for _, line := range strings.Split(strings.TrimSpace(string(o.data)), "\n") {
+			var rec map[string]any
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("record %q in %s: %v", line, key, err)
+			}
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+// checkGap checks that recs hold a single log_gap marker, for reason, and
+// that it accounts for the lines missing from recs: those numbered between
+// its from_seq and to_seq, if they were numbered at all. It returns the
+// marker.
+func checkGap(t *testing.T, recs []map[string]any, reason string) map[string]any {
+	t.Helper()
+	var marker map[string]any
+	seqs := make(map[int64]bool)
+	for _, rec := range recs {
+		seq := int64(rec["seq"].(float64))
+		if seqs[seq] {
+			t.Errorf("two records numbered %d", seq)
+		}
+		seqs[seq] = true
+		if rec["event"] != eventLogGap {
+			continue
+		}
+		if marker != nil {
+			t.Fatalf("markers %v and %v, want one", marker, rec)
+		}
+		marker = rec
+	}
+	if marker == nil {
+		t.Fatal("no log_gap marker")
+	}
+	if marker["reason"] != reason || marker["stream"] != gapStream || marker["time"] == nil {
+		t.Errorf("marker %v, want one for %s on %s with a time", marker, reason, gapStream)
+	}
+	from, to := int64(marker["from_seq"].(float64)), int64(marker["to_seq"].(float64))
+	dropped := int64(marker["dropped_lines"].(float64))
+	if dropped <= 0 || to <= from {
+		t.Fatalf("marker %v doesn't describe a gap", marker)
+	}
+	if from > 0 && !seqs[from] || !seqs[to] {
+		t.Errorf("marker %v isn't between two of the lines kept", marker)
+	}
+	var missing int64
+	for seq := from + 1; seq < to; seq++ {
+		if seqs[seq] {
+			t.Errorf("line %d, inside the gap, was uploaded", seq)
+		}
+		missing++
+	}
+	if missing != 0 && missing != dropped {
+		t.Errorf("marker counts %d dropped lines, but %d are missing", dropped, missing)
+	}
+	// The marker takes a number of its own, after the line closing the gap.
+	if seq := int64(marker["seq"].(float64)); seq <= to {
+		t.Errorf("marker numbered %d, before the line %d closing the gap", seq, to)
+	}
+	return marker
+}
+
+// fillBuffer logs n lines to l, far more than its buffer holds while its
+// uploads are stalled. Each is handed on from the ring before the next is
+// logged, so that the lines are all dropped from the buffer rather than some
+// from the ring.
+func fillBuffer(t *testing.T, l *S3Logger, n int) {
+	t.Helper()
+	line := strings.Repeat("x", 200)
+	for i := range n {
+		if err := l.Log(&Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the line to be buffered", func() bool { return lineSequence(l) > int64(i) })
+	}
+}
+
+func TestGapBufferFull(t *testing.T) {
+	fake := newFakeS3()
+	release := stallPuts(fake, "")
+	defer release()
+	l := newTestLogger(t, fake, map[string]string{
+		modeKey:          modeNonBlocking,
+		stderrModeKey:    modeNonBlocking,
+		maxBufferSizeKey: "2048",
+		flushBytesKey:    "1024",
+		flushIntervalKey: "1h",
+	})
+	fillBuffer(t, l, 50)
+	release()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	marker := checkGap(t, uploadedRecords(t, fake), gapBufferFull)
+	if dropped := int64(marker["dropped_lines"].(float64)); dropped != l.dropped.Load() {
+		t.Errorf("marker counts %d dropped lines, want %d", dropped, l.dropped.Load())
+	}
+}
+
+func TestGapBudget(t *testing.T) {
+	fake := newFakeS3()
+	opts, err := parseLogOpts(DefaultOptions(), testLogOpts(t, map[string]string{flushIntervalKey: "1h"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	budget := newMemoryBudget(4 << 10)
+	d := newDriver(newTestClients(fake), newUploadPool(4, defaultBreakerThreshold, defaultBreakerCooldown, 0), budget, opts)
+	t.Cleanup(d.cancel)
+	cl, err := newLogger(d.clients, d.pool, budget, opts, Info{ContainerID: testContainerID(t), ContainerName: "/test"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := s3Loggers(cl)[0]
+	line := strings.Repeat("x", 1024)
+	for range 10 {
+		if err := l.Log(&Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	marker := checkGap(t, uploadedRecords(t, fake), gapBudget)
+	if dropped := int64(marker["dropped_lines"].(float64)); dropped != l.dropped.Load() || dropped == 0 {
+		t.Errorf("marker counts %d dropped lines, want %d", dropped, l.dropped.Load())
+	}
+}
+
+func TestGapSpoolEvicted(t *testing.T) {
+	// S3 is down while three batches are spooled, and then one that only
+	// fits once all three are evicted.
+	const spoolMax = 16 << 10
+	fake := newFakeS3()
+	var down atomic.Bool
+	down.Store(true)
+	fake.before = func(_ context.Context, op, _, _ string) error {
+		if op == "PutObject" && down.Load() {
+			return fakeStatusError(http.StatusServiceUnavailable, "ServiceUnavailable")
+		}
+		return nil
+	}
+	l := newTestLogger(t, fake, map[string]string{
+		spoolDirKey:      t.TempDir(),
+		spoolMaxBytesKey: strconv.Itoa(spoolMax),
+		maxRetriesKey:    "0",
+		flushIntervalKey: "1h",
+	})
+	for _, line := range []string{"one", "two", "three"} {
+		logLines(t, l, time.Now(), line)
+		l.flush(context.Background())
+	}
+	l.spool.mu.Lock()
+	spooled := int(l.spool.size) / 3
+	l.spool.mu.Unlock()
+	// A spooled batch takes len(line)+overhead bytes, so this one takes
+	// half a small batch less than the whole spool.
+	overhead := spooled - len("three")
+	logLines(t, l, time.Now(), strings.Repeat("x", spoolMax-spooled/2-overhead))
+	l.flush(context.Background())
+	if n := l.spool.count(); n != 1 {
+		t.Fatalf("%d batches spooled, want the last alone", n)
+	}
+
+	down.Store(false)
+	logLines(t, l, time.Now(), "after")
+	if err := l.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	l.spool.drain(context.Background())
+	marker := checkGap(t, uploadedRecords(t, fake), gapSpoolEvicted)
+	if marker["from_seq"] != 0.0 || marker["to_seq"] != 4.0 || marker["dropped_lines"] != 3.0 {
+		t.Errorf("marker %v, want one for lines 1 to 3", marker)
+	}
+}
+
+func TestGapRaw(t *testing.T) {
+	// In the raw format, whose lines have no fields, the marker is a line
+	// of its own, prefixed to tell it from the container's.
+	fake := newFakeS3()
+	release := stallPuts(fake, "")
+	defer release()
+	l := newTestLogger(t, fake, map[string]string{
+		formatKey:        formatRaw,
+		modeKey:          modeNonBlocking,
+		stderrModeKey:    modeNonBlocking,
+		maxBufferSizeKey: "2048",
+		flushBytesKey:    "1024",
+		flushIntervalKey: "1h",
+	})
+	fillBuffer(t, l, 50)
+	release()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var markers []gapEvent
+	for _, key := range fake.logKeys(testBucket) {
+		o, _ := fake.object(testBucket, key)
+		for _, line := range strings.Split(strings.TrimSpace(string(o.data)), "\n") {
+			_, event, ok := strings.Cut(line, gapRawPrefix)
+			if !ok {
+				if strings.Trim(line, "x") != "" {
+					t.Errorf("unexpected line %q", line)
+				}
+				continue
+			}
+			var g gapEvent
+			if err := json.Unmarshal([]byte(event), &g); err != nil {
+				t.Fatalf("marker %q: %v", line, err)
+			}
+			markers = append(markers, g)
+		}
+	}
+	if len(markers) != 1 || markers[0].Event != eventLogGap || markers[0].Reason != gapBufferFull || markers[0].Dropped != l.dropped.Load() {
+		t.Errorf("markers %+v, want one for the %d lines dropped", markers, l.dropped.Load())
+	}
+}
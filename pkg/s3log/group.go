@@ -0,0 +1,63 @@
+package s3log
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	groupByLabelKey = "group-by-label"
+
+	// ungroupedName is the group of containers without any of the labels.
+	ungroupedName = "ungrouped"
+
+	// groupAttr is the record attribute holding a container's group.
+	groupAttr = "group"
+)
+
+// defaultGroupLabels are the labels group-by-label=true groups containers
+// by: their Compose project, else their Swarm service.
+var defaultGroupLabels = []string{"com.docker.compose.project", "com.docker.swarm.service.name"}
+
+// parseGroupLabels parses a group-by-label: true for the default labels,
+// false or nothing to turn grouping off, or a comma-separated list of labels
+// tried in order.
+func parseGroupLabels(v string) ([]string, error) {
+	switch v {
+	case "", "false":
+		return nil, nil
+	case "true":
+		return defaultGroupLabels, nil
+	}
+	var labels []string
+	for _, label := range strings.Split(v, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	if len(labels) == 0 {
+		return nil, errors.New("must be true, false or a comma-separated list of labels")
+	}
+	return labels, nil
+}
+
+// containerGroup returns the value of the first of labels the container has,
+// or ungrouped if it has none of them. Slashes are replaced so the group
+// stays a single path component.
+func containerGroup(labels []string, info Info) string {
+	for _, label := range labels {
+		if v := info.ContainerLabels[label]; v != "" {
+			return strings.ReplaceAll(v, "/", "_")
+		}
+	}
+	return ungroupedName
+}
+
+// groupKeyTemplate returns a key template putting the group ahead of the
+// keys text renders, unless text places .Group itself.
+func groupKeyTemplate(text string) string {
+	if strings.Contains(text, ".Group") {
+		return text
+	}
+	return "{{.Group}}/" + strings.TrimPrefix(text, "/")
+}
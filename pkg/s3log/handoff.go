@@ -0,0 +1,117 @@
+package s3log
+
+import (
+	"errors"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errLoggerGone is returned by a handoff to a FIFO whose logger a failed
+// handoff has already let go of.
+var errLoggerGone = errors.New("logger for fifo was stopped by a failed handoff")
+
+// samePipe reports whether file is still the FIFO lf reads, rather than one
+// created in its place. Once lf's reader has ended it reads nothing more, so
+// a FIFO made since, possibly with the inode of the one removed, isn't it.
+func (lf *logPair) samePipe(file string) bool {
+	select {
+	case <-lf.done:
+		return false
+	default:
+	}
+	fi, err := os.Stat(file)
+	return err == nil && lf.fifo != nil && os.SameFile(fi, lf.fifo)
+}
+
+// handoff starts a new logger for the FIFO that lf already reads, as the
+// daemon asks for after a live-restore. Reading the FIFO a second time would
+// split its lines between two readers, and closing lf's reader would lose
+// the lines it has read ahead, so lf's reader is kept and only its logger is
+// replaced. Lines are held back while the old logger is closed, flushing its
+// buffer and persisting its state, and the new one started, carrying on its
+// line and object numbering. Every line goes to exactly one of them.
+func (d *Driver) handoff(lf *logPair, file string, logCtx Info) error {
+	if _, err := d.tenantOptions(d.defaults(), logCtx, logCtx.Config); err != nil {
+		return newOpError(opParseOptions, "", err)
+	}
+	log := logrus.WithField("id", logCtx.ContainerID).WithField("file", file)
+	log.Info("logger for fifo already exists, handing it over to a new logger")
+
+	lf.logMu.Lock()
+	defer lf.logMu.Unlock()
+	old, oldCache := lf.logger()
+	if old == nil {
+		return errLoggerGone
+	}
+	if err := old.Close(); err != nil && !isUploadError(err) {
+		log.WithError(err).Warn("error closing replaced logger")
+	}
+	oldCache.close()
+
+	l, cache, err := d.newContainerLogger(file, logCtx)
+	if err != nil {
+		// With the old logger closed there is nothing to log the FIFO's
+		// lines to, so it is let go of.
+		lf.mu.Lock()
+		lf.l, lf.cache = nil, nil
+		lf.mu.Unlock()
+		d.remove(file)
+		lf.stream.Close()
+		// consumeLog is waiting on lf.logMu, held until this returns.
+		go lf.routines.wait(goroutineStopTimeout)
+		return err
+	}
+	if c, ok := l.(interface{ continueFrom(containerLogger) }); ok {
+		c.continueFrom(old)
+	}
+	// The new logger starts with the log-opts the daemon passed, so changes
+	// made with the update command are gone.
+	lf.mu.Lock()
+	lf.l, lf.cache, lf.updated = l, cache, nil
+	lf.mu.Unlock()
+	return nil
+}
+
+// continueFrom carries on the numbering of prev, the closed logger this one
+// replaces in a handoff, so that its objects and lines follow on without a
+// gap or a repeat whether or not state-dir persisted it.
+func (l *S3Logger) continueFrom(prev containerLogger) {
+	p, ok := prev.(*S3Logger)
+	if !ok {
+		return
+	}
+	p.flushMu.Lock()
+	state, stateRead, slice := p.state, p.stateRead, p.slice
+	p.flushMu.Unlock()
+	p.mu.Lock()
+	lineSeq := p.lineSeq
+	p.mu.Unlock()
+
+	l.flushMu.Lock()
+	if stateRead && state.Sequence >= l.state.Sequence {
+		l.state.Sequence, l.stateRead = state.Sequence, true
+	}
+	if state.LastFlush.After(l.state.LastFlush) {
+		l.state.LastFlush = state.LastFlush
+	}
+	if l.slice.name == "" {
+		l.slice = slice
+	}
+	l.flushMu.Unlock()
+	l.mu.Lock()
+	l.lineSeq = max(l.lineSeq, lineSeq)
+	l.mu.Unlock()
+}
+
+// continueFrom carries on the numbering of each stream of prev, if it was
+// split too.
+func (s *splitLogger) continueFrom(prev containerLogger) {
+	p, ok := prev.(*splitLogger)
+	if !ok {
+		return
+	}
+	for i, l := range s.loggers {
+		l.continueFrom(p.loggers[i])
+	}
+}
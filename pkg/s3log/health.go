@@ -0,0 +1,147 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	startupProbeTimeoutKey = "startup-probe-timeout"
+
+	defaultStartupProbeTimeout = 5 * time.Minute
+
+	// startupProbeInterval is how long the startup probe waits between
+	// attempts.
+	startupProbeInterval = 5 * time.Second
+)
+
+// errNotReady fails container starts while the plugin can't yet reach S3.
+// The daemon doesn't retry StartLogging, so the message says to.
+var errNotReady = errors.New("plugin is not ready to log to S3 yet, retry starting the container")
+
+// readiness is whether the plugin has shown it can log to S3: that the
+// default credentials resolve and, with an s3-bucket flag, that the bucket
+// answers HeadBucket. Until it has, containers are refused rather than
+// accepted with logs that would go nowhere.
+type readiness struct {
+	mu     sync.Mutex
+	ready  bool
+	reason string
+}
+
+func newReadiness() *readiness {
+	return &readiness{reason: "startup probe has not run yet"}
+}
+
+// set records the outcome of a probe: ready if err is nil, not ready with
+// err as the reason otherwise. Once ready, the plugin stays ready.
+func (r *readiness) set(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ready {
+		return
+	}
+	if err == nil {
+		r.ready, r.reason = true, ""
+		return
+	}
+	r.reason = err.Error()
+}
+
+// status returns whether the plugin is ready and, if not, why. A nil
+// readiness is always ready.
+func (r *readiness) status() (bool, string) {
+	if r == nil {
+		return true, ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ready, r.reason
+}
+
+// check returns nil once the plugin is ready, and an errNotReady naming the
+// reason until then.
+func (r *readiness) check() error {
+	if ready, reason := r.status(); !ready {
+		return fmt.Errorf("%w: %s", errNotReady, reason)
+	}
+	return nil
+}
+
+// ServeHTTP serves /healthz: 200 once the plugin is ready, 503 with the
+// reason until then.
+func (r *readiness) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if ready, reason := r.status(); !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not ready: %s\n", reason)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// probeStartup probes S3 every startupProbeInterval until a probe succeeds,
+// marking the plugin ready, or timeout passes, when it exits so that
+// whatever supervises the plugin notices.
+func (r *readiness) probeStartup(clients *clientFactory, opts LogOption, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), credentialsTimeout)
+		err := probeS3(ctx, clients, opts)
+		cancel()
+		r.set(err)
+		if err == nil {
+			logrus.Info("startup probe succeeded, accepting containers")
+			return
+		}
+		if !time.Now().Add(startupProbeInterval).Before(deadline) {
+			logrus.WithError(err).Fatalf("startup probe still failing after %s %s, exiting", startupProbeTimeoutKey, timeout)
+		}
+		logrus.WithError(err).Warn("startup probe failed, refusing containers until it succeeds")
+		time.Sleep(startupProbeInterval)
+	}
+}
+
+// probeS3 resolves the default credentials, along with the region of the
+// s3-bucket flag's bucket, and checks that bucket with HeadBucket, or with
+// upload-mode=presigned that the token file can be read. opts are the
+// plugin's flags.
+func probeS3(ctx context.Context, clients *clientFactory, opts LogOption) error {
+	if opts.UploadMode == uploadModePresigned {
+		_, err := readPresignToken(opts.PresignTokenFile)
+		return err
+	}
+	// Without the flag every container names its own bucket, which parsing
+	// the flags alone would refuse.
+	if opts.S3Bucket == "" {
+		if clients.cfg.Credentials == nil {
+			return newOpError(opLoadCreds, "", errors.New("no credentials configured"))
+		}
+		if _, err := clients.cfg.Credentials.Retrieve(ctx); err != nil {
+			return newOpError(opLoadCreds, "", err)
+		}
+		return nil
+	}
+	opts, err := parseLogOpts(opts, nil)
+	if err != nil {
+		return newOpError(opParseOptions, "", err)
+	}
+	cfg, err := clients.resolve(ctx, opts.S3Bucket, opts.clientConfig())
+	if err != nil {
+		return err
+	}
+	client, err := clients.client(cfg)
+	if err != nil {
+		return newOpError(opLoadCreds, opts.S3Bucket, err)
+	}
+	if err := headBucket(ctx, client, opts.S3Bucket, opts.RequestPayer); err != nil {
+		return newOpError(opCheckBucket, opts.S3Bucket, describeAccessError(err))
+	}
+	return nil
+}
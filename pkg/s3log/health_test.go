@@ -0,0 +1,141 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// healthz returns the status and body /healthz answers with.
+func healthz(r *readiness) (int, string) {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	return w.Code, w.Body.String()
+}
+
+func TestReadinessGatesStartLogging(t *testing.T) {
+	fake := newFakeS3()
+	d := newTestDriver(t, fake, nil)
+	d.ready = newReadiness()
+	flags := DefaultOptions()
+	flags.S3Bucket = testBucket
+	probe := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), credentialsTimeout)
+		defer cancel()
+		d.ready.set(probeS3(ctx, d.clients, flags))
+	}
+
+	// Before the first probe, and while probes are denied, containers are
+	// refused with the reason.
+	if code, body := healthz(d.ready); code != http.StatusServiceUnavailable || !strings.Contains(body, "has not run yet") {
+		t.Errorf("/healthz before probing answered %d %q", code, body)
+	}
+	fake.fail("HeadBucket", 1, fakeStatusError(http.StatusForbidden, "AccessDenied"))
+	probe()
+	code, body := healthz(d.ready)
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "AccessDenied") {
+		t.Errorf("/healthz after a denied probe answered %d %q", code, body)
+	}
+	file := filepath.Join(t.TempDir(), "fifo")
+	if err := syscall.Mkfifo(file, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := d.StartLogging(file, Info{Config: testLogOpts(t, nil), ContainerID: testContainerID(t)})
+	if !errors.Is(err, errNotReady) || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Fatalf("StartLogging while not ready returned %v, want errNotReady with the reason", err)
+	}
+	if len(d.logs) != 0 {
+		t.Errorf("refused container left %d loggers", len(d.logs))
+	}
+	os.Remove(file)
+
+	// Once a probe succeeds the plugin is ready, and stays so.
+	probe()
+	if code, body := healthz(d.ready); code != http.StatusOK || body != "ready\n" {
+		t.Errorf("/healthz once ready answered %d %q", code, body)
+	}
+	d.ready.set(errors.New("later failure"))
+	if ready, _ := d.ready.status(); !ready {
+		t.Error("a later failed probe made the plugin not ready again")
+	}
+	c := startContainer(t, d, nil)
+	c.stop(t, d)
+}
+
+func TestProbeS3(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("presign-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		modify  func(o *LogOption, clients *clientFactory)
+		fail    string // the fake's operation to fail
+		wantErr string
+	}{
+		{name: "credentials only", modify: func(*LogOption, *clientFactory) {}},
+		{
+			name:    "no credentials",
+			modify:  func(_ *LogOption, c *clientFactory) { c.cfg.Credentials = nil },
+			wantErr: "no credentials configured",
+		},
+		{
+			name: "credentials fail",
+			modify: func(_ *LogOption, c *clientFactory) {
+				c.cfg.Credentials = aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+					return aws.Credentials{}, errors.New("no IMDS")
+				})
+			},
+			wantErr: "no IMDS",
+		},
+		{name: "bucket", modify: func(o *LogOption, _ *clientFactory) { o.S3Bucket = testBucket }},
+		{
+			name:    "missing bucket",
+			modify:  func(o *LogOption, _ *clientFactory) { o.S3Bucket = testBucket },
+			fail:    "HeadBucket",
+			wantErr: "bucket not found",
+		},
+		{
+			name: "presigned",
+			modify: func(o *LogOption, _ *clientFactory) {
+				o.UploadMode, o.PresignTokenFile = uploadModePresigned, token
+			},
+		},
+		{
+			name: "presigned without a token",
+			modify: func(o *LogOption, _ *clientFactory) {
+				o.UploadMode, o.PresignTokenFile = uploadModePresigned, filepath.Join(t.TempDir(), "missing")
+			},
+			wantErr: "missing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			if tt.fail != "" {
+				fake.fail(tt.fail, 1, fakeStatusError(http.StatusNotFound, "NotFound"))
+			}
+			clients := newTestClients(fake)
+			flags := DefaultOptions()
+			tt.modify(&flags, clients)
+			err := probeS3(context.Background(), clients, flags)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("probe failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("probe returned %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const (
+	heartbeatIntervalKey = "heartbeat-interval"
+
+	heartbeatName = "_heartbeat.json"
+)
+
+// heartbeat is the object a logger writes when it has gone a
+// heartbeat-interval without uploading any lines, so that a container that
+// logs nothing can be told from one whose logs aren't getting through. It
+// carries the logger's counters, as in the stats dump.
+type heartbeat struct {
+	Time    time.Time `json:"time"`
+	Started time.Time `json:"started"`
+	Stream  string    `json:"stream,omitempty"`
+	containerStats
+}
+
+// heartbeatPath returns the key of the logger's heartbeat, next to its
+// manifest. With split-streams each stream has its own.
+func (l *S3Logger) heartbeatPath() string {
+	prefix := l.containerKeyPrefix()
+	if prefix == "" {
+		prefix = l.info.ContainerID + "/"
+	}
+	return l.opts.S3Prefix + prefix + heartbeatName
+}
+
+// heartbeatLoop writes a heartbeat whenever the logger has gone a
+// heartbeat-interval without a flush or a heartbeat, until it is closed.
+func (l *S3Logger) heartbeatLoop() {
+	defer l.wg.Done()
+	// A heartbeat being written when the logger is closed is given up on.
+	ctx, cancel := context.WithCancel(l.ctx)
+	defer cancel()
+	l.routines.start("heartbeat-stop", func() {
+		select {
+		case <-l.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	})
+
+	interval := l.opts.HeartbeatInterval
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	beat := l.started
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-t.C:
+		}
+		if wait := interval - min(l.sinceFlush(), time.Since(beat)); wait > 0 {
+			t.Reset(wait)
+			continue
+		}
+		l.putHeartbeat(ctx)
+		beat = time.Now()
+		t.Reset(interval)
+	}
+}
+
+// putHeartbeat uploads a heartbeat to the primary bucket, replacing the
+// last. It is written outside the upload pool, so it isn't counted against
+// a cost budget, and isn't retried: the next one is due soon enough.
+func (l *S3Logger) putHeartbeat(ctx context.Context) {
+	h := heartbeat{
+		Time:           time.Now().UTC(),
+		Started:        l.started.UTC(),
+		Stream:         l.opts.stream,
+		containerStats: containerStats{ID: l.info.ContainerID, Name: l.info.Name()},
+	}
+	l.addStats(&h.containerStats)
+	data, err := json.Marshal(h)
+	if err != nil {
+		return
+	}
+	t := l.targets[0]
+	b := &batch{
+		Bucket:       t.bucket,
+		Key:          l.heartbeatPath(),
+		ContentType:  "application/json",
+		ContainerID:  l.info.ContainerID,
+		SSE:          l.opts.SSE,
+		SSEKMSKeyID:  l.opts.SSEKMSKeyID,
+		RequestPayer: l.opts.RequestPayer,
+		Client:       t.cfg,
+		Tag:          l.keyData.Tag,
+		body:         data,
+	}
+	l.retain(b)
+	if err := uploadBatch(ctx, t.uploader, b); err != nil {
+		if ctx.Err() == nil {
+			s3Failed(l.log().WithField("key", b.Key), t.bucket, err).Warn("error writing heartbeat")
+		}
+		return
+	}
+	l.log().WithField("key", b.Key).Debug("wrote heartbeat")
+}
@@ -0,0 +1,50 @@
+package s3log
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Handle registers the plugin's own API endpoints, which the config and
+// update commands call, on mux, next to the log driver API.
+func (d *Driver) Handle(mux interface {
+	HandleFunc(string, func(http.ResponseWriter, *http.Request))
+}) {
+	mux.HandleFunc(configPath, func(w http.ResponseWriter, r *http.Request) {
+		var req ConfigRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c, err := d.config(req.ContainerID)
+		var res ConfigResponse
+		if err != nil {
+			res.Err = err.Error()
+		}
+		res.Config = c
+		json.NewEncoder(w).Encode(&res)
+	})
+
+	mux.HandleFunc(updateOptionsPath, func(w http.ResponseWriter, r *http.Request) {
+		var req UpdateOptionsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		Respond(d.updateOptions(req.ContainerID, req.Options), w)
+	})
+}
+
+type response struct {
+	Err string
+}
+
+// Respond writes the reply to a plugin API call that only reports whether
+// it failed: err's message as Err, or an empty Err if err is nil.
+func Respond(err error, w http.ResponseWriter) {
+	var res response
+	if err != nil {
+		res.Err = err.Error()
+	}
+	json.NewEncoder(w).Encode(&res)
+}
@@ -0,0 +1,29 @@
+package s3log
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRespond(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{errors.New("no such container"), "no such container"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		Respond(tt.err, w)
+		var res struct{ Err string }
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Err != tt.want {
+			t.Errorf("Respond(%v) replied Err %q, want %q", tt.err, res.Err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	indexKey         = "index"
+	indexIntervalKey = "index-interval"
+
+	defaultIndexInterval = 1000
+
+	// indexSuffix is appended to an object's key to name its index.
+	indexSuffix = ".idx"
+)
+
+// objectIndex is the sidecar of an object uploaded with index set. Every
+// interval records it notes where the next block of the object starts, so
+// that reading lines logged since a time starts near them rather than at the
+// object's first byte. A compressed object is compressed block by block, as
+// gzip members or zstd frames that decompress on their own, so that it can be
+// read from the start of any block. size is that of the object as stored,
+// which tells an index from the object it was written for apart from one
+// left behind by an object since replaced.
+type objectIndex struct {
+	Interval int          `json:"interval"`
+	Size     int64        `json:"size"`
+	Entries  []indexEntry `json:"entries"`
+}
+
+// indexEntry is a block of an object's records. Line counts the object's
+// lines before the block, Offset its bytes before the block once
+// decompressed and StoredOffset its bytes as stored. Time is when the
+// block's first record was logged and MaxTime when its latest was, which
+// lines logged on other streams can make a later one.
+type indexEntry struct {
+	Time         time.Time `json:"time"`
+	MaxTime      time.Time `json:"max_time"`
+	Line         int64     `json:"line"`
+	Offset       int64     `json:"offset"`
+	StoredOffset int64     `json:"stored_offset"`
+}
+
+// buildIndex returns an index of body, the records of an object, in blocks
+// of interval records, and the object as stored: body, or each block
+// compressed on its own with codec at level.
+func buildIndex(body []byte, interval int, codec string, level int) ([]byte, *objectIndex, error) {
+	idx := &objectIndex{Interval: interval}
+	stored := body
+	if codec != compressNone {
+		stored = nil
+	}
+	var line, offset int64
+	for len(body) > 0 {
+		// Find the end of the block and the times of its records.
+		e := indexEntry{Line: line, Offset: offset, StoredOffset: offset}
+		if codec != compressNone {
+			e.StoredOffset = int64(len(stored))
+		}
+		end := 0
+		for n := 0; n < interval && end < len(body); n++ {
+			next := len(body)
+			if i := bytes.IndexByte(body[end:], '\n'); i >= 0 {
+				next = end + i + 1
+			}
+			if t, ok := recordTime(body[end:next]); ok {
+				if e.Time.IsZero() {
+					e.Time = t
+				}
+				if t.After(e.MaxTime) {
+					e.MaxTime = t
+				}
+			}
+			end = next
+			line++
+		}
+		if codec != compressNone {
+			block, err := compressBytes(codec, level, body[:end])
+			if err != nil {
+				return nil, nil, err
+			}
+			stored = append(stored, block...)
+		}
+		idx.Entries = append(idx.Entries, e)
+		offset += int64(end)
+		body = body[end:]
+	}
+	idx.Size = int64(len(stored))
+	return stored, idx, nil
+}
+
+// recordTime returns when the record line was logged, reporting false if
+// line isn't a record or has no timestamp.
+func recordTime(line []byte) (time.Time, bool) {
+	msg, ok := decodeRecord(bytes.TrimSuffix(line, []byte{'\n'}), time.Time{})
+	if !ok || msg.Timestamp.IsZero() {
+		return time.Time{}, false
+	}
+	return msg.Timestamp, true
+}
+
+// start returns the stored offset of the first block that may hold records
+// logged since since, reporting false if none can.
+func (idx *objectIndex) start(since time.Time) (int64, bool) {
+	for _, e := range idx.Entries {
+		// A block without timestamps can't be ruled out.
+		if e.MaxTime.IsZero() || !e.MaxTime.Before(since) {
+			return e.StoredOffset, true
+		}
+	}
+	return 0, false
+}
+
+// putIndex uploads the index of b, an object just uploaded, to the primary
+// bucket, retrying once. Like the run summary it is best effort: an object
+// without an index is read from its start.
+func (l *S3Logger) putIndex(ctx context.Context, b *batch) {
+	data, err := json.Marshal(b.index)
+	if err != nil {
+		return
+	}
+	t := l.targets[0]
+	ib := &batch{
+		Bucket:       t.bucket,
+		Key:          b.Key + indexSuffix,
+		ContentType:  "application/json",
+		ContainerID:  l.info.ContainerID,
+		SSE:          l.opts.SSE,
+		SSEKMSKeyID:  l.opts.SSEKMSKeyID,
+		RequestPayer: l.opts.RequestPayer,
+		Client:       t.cfg,
+		Tag:          l.keyData.Tag,
+		body:         data,
+	}
+	l.retain(ib)
+	err = retry(ctx, 1, l.opts.MaxRetryDelay, func() error {
+		return uploadBatch(ctx, t.uploader, ib)
+	})
+	if err != nil {
+		s3Failed(l.log().WithField("key", ib.Key), t.bucket, err).Warn("error writing object index")
+	}
+}
+
+// seek returns obj set to be read from the first block its index says may
+// hold lines logged since since, reporting false if none can and obj needn't
+// be read at all. An object without an index, or whose index can't be read
+// or doesn't match it, is read from its start.
+func (l *S3Logger) seek(ctx context.Context, obj logObject, since time.Time) (logObject, bool) {
+	if !l.opts.Index || since.IsZero() || obj.key == "" {
+		return obj, true
+	}
+	idx, err := l.readIndex(ctx, obj.key)
+	if err != nil {
+		if !isDeleted(err) {
+			l.log().WithField("key", obj.key).WithError(err).Debug("error reading object index, reading the object from its start")
+		}
+		return obj, true
+	}
+	if obj.size > 0 && idx.Size != obj.size {
+		l.log().WithField("key", obj.key).Debug("object index is of another version of the object, reading it from its start")
+		return obj, true
+	}
+	off, ok := idx.start(since)
+	if !ok {
+		return obj, false
+	}
+	if off < 0 || off >= idx.Size {
+		return obj, true
+	}
+	obj.offset = off
+	return obj, true
+}
+
+// readIndex downloads the index of the object at key.
+func (l *S3Logger) readIndex(ctx context.Context, key string) (*objectIndex, error) {
+	// The index isn't encrypted with sse-c-key-file, like the manifest.
+	out, err := l.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:       aws.String(l.bucket),
+		Key:          aws.String(key + indexSuffix),
+		RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, err
+	}
+	var idx objectIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("invalid object index: %v", err)
+	}
+	return &idx, nil
+}
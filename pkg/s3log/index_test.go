@@ -0,0 +1,237 @@
+package s3log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// indexedRecords returns n records a second apart from start, with lines
+// of several sizes and multibyte text, without a newline after the last if
+// cut is set.
+func indexedRecords(t *testing.T, n int, start time.Time, cut bool) []byte {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.Format, opts.TimestampFormat = formatJSONL, timestampRFC3339Nano
+	f, err := newLineFormat(opts, "c1", "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body []byte
+	for i := range n {
+		msg := &Message{Line: []byte(fmt.Sprintf("line %d %s", i, strings.Repeat("é", i%7))), Source: "stdout", Timestamp: start.Add(time.Duration(i) * time.Second)}
+		body = f.encode(body, msg, int64(i+1))
+	}
+	if cut {
+		body = bytes.TrimSuffix(body, []byte{'\n'})
+	}
+	return body
+}
+
+func TestBuildIndex(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, codec := range []string{compressNone, compressGzip, compressZstd} {
+		for _, interval := range []int{1, 3, 10, 1000} {
+			for _, cut := range []bool{false, true} {
+				name := fmt.Sprintf("%s every %d", codec, interval)
+				if cut {
+					name += " without a last newline"
+				}
+				t.Run(name, func(t *testing.T) {
+					const n = 25
+					body := indexedRecords(t, n, start, cut)
+					stored, idx, err := buildIndex(body, interval, codec, 0)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if want := (n + interval - 1) / interval; len(idx.Entries) != want {
+						t.Fatalf("%d blocks, want %d", len(idx.Entries), want)
+					}
+					if idx.Size != int64(len(stored)) || idx.Interval != interval {
+						t.Errorf("index of %d bytes every %d, want %d every %d", idx.Size, idx.Interval, len(stored), interval)
+					}
+					lines := bytes.SplitAfter(body, []byte{'\n'})
+					for i, e := range idx.Entries {
+						first := i * interval
+						if e.Line != int64(first) || e.Offset != int64(len(bytes.Join(lines[:first], nil))) {
+							t.Errorf("block %d at line %d offset %d, want line %d", i, e.Line, e.Offset, first)
+						}
+						last := min(first+interval, n) - 1
+						if !e.Time.Equal(start.Add(time.Duration(first)*time.Second)) || !e.MaxTime.Equal(start.Add(time.Duration(last)*time.Second)) {
+							t.Errorf("block %d from %v to %v, want lines %d to %d", i, e.Time, e.MaxTime, first, last)
+						}
+						// Reading from the block's stored offset gets the
+						// rest of the object from the block on.
+						r, err := decompress(codec, io.NopCloser(bytes.NewReader(stored[e.StoredOffset:])))
+						if err != nil {
+							t.Fatal(err)
+						}
+						rest, err := io.ReadAll(r)
+						if err != nil {
+							t.Fatalf("block %d: %v", i, err)
+						}
+						if !bytes.Equal(rest, body[e.Offset:]) {
+							t.Errorf("block %d read %d bytes from its stored offset, want %d", i, len(rest), len(body)-int(e.Offset))
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestIndexStart(t *testing.T) {
+	at := func(s int) time.Time { return time.Date(2024, 5, 1, 12, 0, s, 0, time.UTC) }
+	idx := &objectIndex{Entries: []indexEntry{
+		{Time: at(0), MaxTime: at(9), StoredOffset: 0},
+		// A line from another stream may be later than the next block's.
+		{Time: at(10), MaxTime: at(25), StoredOffset: 100},
+		{Time: at(20), MaxTime: at(29), StoredOffset: 200},
+		{StoredOffset: 300},
+	}}
+	tests := []struct {
+		since time.Time
+		off   int64
+		ok    bool
+	}{
+		{at(0), 0, true},
+		{at(9), 0, true},
+		{at(10), 100, true},
+		{at(22), 100, true},
+		{at(26), 200, true},
+		// A block without timestamps can't be ruled out.
+		{at(59), 300, true},
+	}
+	for _, tt := range tests {
+		if off, ok := idx.start(tt.since); off != tt.off || ok != tt.ok {
+			t.Errorf("start(%v) = %d, %v, want %d, %v", tt.since, off, ok, tt.off, tt.ok)
+		}
+	}
+	idx.Entries = idx.Entries[:3]
+	if _, ok := idx.start(at(30)); ok {
+		t.Error("an object of lines before since is read")
+	}
+}
+
+func TestReadLogsIndex(t *testing.T) {
+	const lines = 100
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name   string
+		codec  string
+		since  int // seconds after start
+		modify func(t *testing.T, fake *fakeS3, key string)
+		ranged bool // whether the object is read with a range
+		read   bool // whether the object is read at all
+	}{
+		{name: "plain", codec: compressNone, since: 55, ranged: true, read: true},
+		{name: "gzip", codec: compressGzip, since: 55, ranged: true, read: true},
+		{name: "zstd", codec: compressZstd, since: 55, ranged: true, read: true},
+		{name: "since the first block", codec: compressGzip, since: 5, read: true},
+		{name: "since after everything", codec: compressGzip, since: lines + 10},
+		{
+			name:  "no index",
+			codec: compressGzip,
+			since: 55,
+			modify: func(t *testing.T, fake *fakeS3, key string) {
+				fake.mu.Lock()
+				delete(fake.buckets[testBucket], key+indexSuffix)
+				fake.mu.Unlock()
+			},
+			read: true,
+		},
+		{
+			name:  "unreadable index",
+			codec: compressGzip,
+			since: 55,
+			modify: func(t *testing.T, fake *fakeS3, key string) {
+				fake.put(testBucket, key+indexSuffix, []byte("not json"), time.Now())
+			},
+			read: true,
+		},
+		{
+			// An index left behind by an object since replaced.
+			name:  "stale index",
+			codec: compressGzip,
+			since: 55,
+			modify: func(t *testing.T, fake *fakeS3, key string) {
+				o, _ := fake.object(testBucket, key+indexSuffix)
+				var idx objectIndex
+				if err := json.Unmarshal(o.data, &idx); err != nil {
+					t.Fatal(err)
+				}
+				idx.Size++
+				data, _ := json.Marshal(idx)
+				fake.put(testBucket, key+indexSuffix, data, time.Now())
+			},
+			read: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			l := newTestLogger(t, fake, map[string]string{
+				indexKey:         "true",
+				indexIntervalKey: "10",
+				compressKey:      tt.codec,
+				flushIntervalKey: "1h",
+			})
+			var want []string
+			for i := range lines {
+				line := fmt.Sprintf("line %d", i)
+				if err := l.Log(&Message{Line: []byte(line), Source: "stdout", Timestamp: start.Add(time.Duration(i) * time.Second)}); err != nil {
+					t.Fatal(err)
+				}
+				if i >= tt.since {
+					want = append(want, line)
+				}
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			keys := fake.logKeys(testBucket)
+			if len(keys) != 1 {
+				t.Fatalf("uploaded %q, want one object", keys)
+			}
+			if _, ok := fake.object(testBucket, keys[0]+indexSuffix); !ok {
+				t.Fatal("no index uploaded")
+			}
+			if tt.modify != nil {
+				tt.modify(t, fake, keys[0])
+			}
+
+			before := len(fake.getRanges())
+			got := readLogs(t, l, ReadConfig{Since: start.Add(time.Duration(tt.since) * time.Second), Tail: -1})
+			if !slices.Equal(got, want) {
+				t.Errorf("read %d lines from %.10q, want %d from %.10q", len(got), got, len(want), want)
+			}
+			// The first GET is of the index, whole, if there is one.
+			ranges := fake.getRanges()[before:]
+			if _, ok := fake.object(testBucket, keys[0]+indexSuffix); ok {
+				if len(ranges) == 0 || ranges[0] != "" {
+					t.Fatalf("GETs %q, want the index's first", ranges)
+				}
+				ranges = ranges[1:]
+			}
+			switch {
+			case !tt.read:
+				if len(ranges) != 0 {
+					t.Errorf("object had GETs %q, want none", ranges)
+				}
+			case tt.ranged:
+				if len(ranges) != 1 || !strings.HasPrefix(ranges[0], "bytes=") || ranges[0] == "bytes=0-" {
+					t.Errorf("object read with %q, want a range from a later block", ranges)
+				}
+			default:
+				if len(ranges) != 1 || ranges[0] != "" {
+					t.Errorf("object read with %q, want in full", ranges)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,534 @@
+//go:build integration
+
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/containerd/fifo"
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/minio"
+)
+
+// The integration suite runs the whole pipeline against a real S3 API:
+//
+//	go test -tags integration ./pkg/s3log
+//
+// By default that is MinIO, started in Docker by testcontainers-go for the
+// run and removed once it ends. Setting S3LOGDRIVER_IT_ENDPOINT runs it
+// against an S3 API of your own instead, such as a MinIO or LocalStack that
+// CI already runs, with its credentials in S3LOGDRIVER_IT_ACCESS_KEY_ID and
+// S3LOGDRIVER_IT_SECRET_ACCESS_KEY:
+//
+//	S3LOGDRIVER_IT_ENDPOINT=http://localhost:4566 \
+//	S3LOGDRIVER_IT_ACCESS_KEY_ID=test \
+//	S3LOGDRIVER_IT_SECRET_ACCESS_KEY=test \
+//	go test -tags integration ./pkg/s3log
+//
+// S3LOGDRIVER_IT_REGION sets the region, us-east-1 by default, and
+// S3LOGDRIVER_IT_BUCKET a bucket to use rather than one made for each test.
+const integrationEnvPrefix = "S3LOGDRIVER_IT_"
+
+// integrationMinIOImage is the MinIO the suite starts without an endpoint
+// of its own.
+const integrationMinIOImage = "minio/minio:RELEASE.2024-01-16T16-07-38Z"
+
+// integrationMinIO is the MinIO container the tests share, started by the
+// first that needs it. testcontainers-go's reaper removes it once the test
+// binary exits.
+var integrationMinIO struct {
+	once                   sync.Once
+	endpoint, user, secret string
+	err                    error
+}
+
+// startMinIO returns the endpoint and credentials of the shared MinIO,
+// starting it the first time.
+func startMinIO(t *testing.T) (endpoint, user, secret string) {
+	t.Helper()
+	m := &integrationMinIO
+	m.once.Do(func() {
+		ctx := context.Background()
+		c, err := minio.RunContainer(ctx, testcontainers.WithImage(integrationMinIOImage))
+		if err != nil {
+			m.err = err
+			return
+		}
+		addr, err := c.ConnectionString(ctx)
+		if err != nil {
+			m.err = err
+			return
+		}
+		m.endpoint, m.user, m.secret = "http://"+addr, c.Username, c.Password
+	})
+	if m.err != nil {
+		t.Fatalf("error starting MinIO, set %sENDPOINT to use an S3 API of your own: %v", integrationEnvPrefix, m.err)
+	}
+	return m.endpoint, m.user, m.secret
+}
+
+// integrationS3 is the S3 API a test of the integration suite uploads to.
+type integrationS3 struct {
+	endpoint string
+	bucket   string
+	cfg      aws.Config
+	client   *s3.Client
+	// transport sees every request the plugin sends.
+	transport *integrationTransport
+}
+
+// newIntegrationS3 returns the endpoint the environment names, or the
+// shared MinIO, with a bucket of the test's own.
+func newIntegrationS3(t *testing.T) *integrationS3 {
+	t.Helper()
+	env := func(name string) string { return os.Getenv(integrationEnvPrefix + name) }
+	it := &integrationS3{endpoint: env("ENDPOINT")}
+	user, secret := env("ACCESS_KEY_ID"), env("SECRET_ACCESS_KEY")
+	if it.endpoint == "" {
+		it.endpoint, user, secret = startMinIO(t)
+	}
+	region := env("REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	it.transport = &integrationTransport{next: http.DefaultTransport}
+	it.cfg = aws.Config{
+		Region:      region,
+		Credentials: credentials.NewStaticCredentialsProvider(user, secret, ""),
+		HTTPClient:  &http.Client{Transport: it.transport},
+	}
+	it.client = s3.NewFromConfig(it.cfg, func(o *s3.Options) {
+		o.BaseEndpoint = aws.String(it.endpoint)
+		o.UsePathStyle = true
+	})
+	if it.bucket = env("BUCKET"); it.bucket != "" {
+		return it
+	}
+	it.bucket = fmt.Sprintf("s3logdriver-it-%d", time.Now().UnixNano())
+	ctx := context.Background()
+	if _, err := it.client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(it.bucket)}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pages := s3.NewListObjectsV2Paginator(it.client, &s3.ListObjectsV2Input{Bucket: aws.String(it.bucket)})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				t.Log(err)
+				return
+			}
+			for _, o := range page.Contents {
+				it.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(it.bucket), Key: o.Key})
+			}
+		}
+		it.client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: aws.String(it.bucket)})
+	})
+	return it
+}
+
+// logOpts returns the log-opts of a container uploading to the test's
+// bucket, with cfg on top.
+func (it *integrationS3) logOpts(t *testing.T, cfg map[string]string) map[string]string {
+	opts := map[string]string{
+		s3BucketKey:       it.bucket,
+		endpointURLKey:    it.endpoint,
+		forcePathStyleKey: "true",
+		stateDirKey:       t.TempDir(),
+		cacheDirKey:       t.TempDir(),
+	}
+	for k, v := range cfg {
+		opts[k] = v
+	}
+	return opts
+}
+
+// newDriver returns a driver uploading through it with the plugin's
+// default flags, closed at the end of the test.
+func (it *integrationS3) newDriver(t *testing.T) *Driver {
+	t.Helper()
+	var opts LogOption
+	fs := flag.NewFlagSet(driverName, flag.ContinueOnError)
+	optionFlags(fs, &opts)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	pool := newUploadPool(4, defaultBreakerThreshold, defaultBreakerCooldown, 0)
+	d := newDriver(newClientFactory(it.cfg, 4, false), pool, newMemoryBudget(defaultMaxTotalBuffer), opts)
+	t.Cleanup(d.Close)
+	return d
+}
+
+// object downloads the object at key.
+func (it *integrationS3) object(t *testing.T, key string) (*s3.GetObjectOutput, []byte) {
+	t.Helper()
+	out, err := it.client.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String(it.bucket), Key: aws.String(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out, data
+}
+
+// wantETag reports whether etag is what S3 gives an object of data
+// uploaded in parts of partSize, or in one if it is smaller.
+func wantETag(etag string, data []byte, partSize int64) bool {
+	if int64(len(data)) < partSize {
+		return etag == fmt.Sprintf(`"%x"`, md5.Sum(data))
+	}
+	var sums []byte
+	parts := 0
+	for p := data; len(p) > 0; parts++ {
+		n := min(int64(len(p)), partSize)
+		s := md5.Sum(p[:n])
+		sums = append(sums, s[:]...)
+		p = p[n:]
+	}
+	s := md5.Sum(sums)
+	return etag == fmt.Sprintf(`"%x-%d"`, s, parts)
+}
+
+// integrationContainer is a container logging through a FIFO, as the
+// daemon runs one.
+type integrationContainer struct {
+	file string
+	info Info
+	w    io.WriteCloser
+	enc  logdriver.LogEntryEncoder
+	l    *S3Logger
+}
+
+// startIntegrationContainer starts logging the container info to a FIFO of
+// its own, as the daemon does.
+func startIntegrationContainer(t *testing.T, d *Driver, info Info) *integrationContainer {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "fifo")
+	if err := syscall.Mkfifo(file, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The daemon opens its end first, without waiting for the plugin's.
+	w, err := fifo.OpenFifo(context.Background(), file, syscall.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &integrationContainer{file: file, info: info, w: w, enc: logdriver.NewLogEntryEncoder(w)}
+	if err := d.StartLogging(file, info); err != nil {
+		w.Close()
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	l, _ := d.logs[file].logger()
+	d.mu.Unlock()
+	c.l = l.(*S3Logger)
+	return c
+}
+
+// write writes line to the container's FIFO as the daemon would, as logged
+// to source at ts.
+func (c *integrationContainer) write(t *testing.T, source, line string, ts time.Time) {
+	t.Helper()
+	if err := c.enc.Encode(&logdriver.LogEntry{Source: source, TimeNano: ts.UnixNano(), Line: []byte(line)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stop closes the daemon's end of the FIFO and stops logging the container.
+func (c *integrationContainer) stop(t *testing.T, d *Driver) {
+	t.Helper()
+	c.w.Close()
+	if err := d.StopLogging(c.file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// manifest downloads the container's manifest.
+func (c *integrationContainer) manifest(t *testing.T, it *integrationS3) manifest {
+	t.Helper()
+	_, data := it.object(t, c.l.manifestPath())
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// records returns the records of body, an object compressed with codec.
+func records(t *testing.T, codec string, body []byte) []record {
+	t.Helper()
+	r, err := decompress(codec, io.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []record
+	for _, line := range bytes.Split(bytes.TrimSuffix(raw, []byte("\n")), []byte("\n")) {
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			t.Fatalf("%v: %s", err, line)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// integrationTransport counts the requests sent through it, and answers the
+// first slowDown PutObject requests with the 503 SlowDown S3 throttles
+// with.
+type integrationTransport struct {
+	next     http.RoundTripper
+	slowDown atomic.Int64
+	parts    atomic.Int64 // UploadPart requests
+	throttle atomic.Int64 // requests answered with SlowDown
+}
+
+func (tr *integrationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	q := req.URL.Query()
+	if req.Method == http.MethodPut && q.Has("partNumber") {
+		tr.parts.Add(1)
+	}
+	if req.Method == http.MethodPut && !q.Has("partNumber") && !strings.HasSuffix(req.URL.Path, manifestName) && tr.slowDown.Add(-1) >= 0 {
+		tr.throttle.Add(1)
+		if req.Body != nil {
+			io.Copy(io.Discard, req.Body)
+			req.Body.Close()
+		}
+		body := `<?xml version="1.0" encoding="UTF-8"?><Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Status:     "503 Slow Down",
+			Header:     http.Header{"Content-Type": {"application/xml"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	}
+	return tr.next.RoundTrip(req)
+}
+
+// integrationLines returns n lines, each of a random length of up to size
+// bytes and random enough that they compress like real logs rather than
+// down to nothing.
+func integrationLines(n, size int) []string {
+	r := rand.New(rand.NewSource(int64(n)))
+	words := []string{"GET", "POST", "/api/v1/orders", "/healthz", "200", "404", "500", "user=", "latency_ms=", "trace_id=", "error:", "timeout", "upstream"}
+	lines := make([]string, n)
+	for i := range lines {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%06d", i)
+		for want := 16 + r.Intn(size-16); b.Len() < want; {
+			b.WriteByte(' ')
+			if r.Intn(3) == 0 {
+				fmt.Fprintf(&b, "%x", r.Uint64())
+			} else {
+				b.WriteString(words[r.Intn(len(words))])
+			}
+		}
+		lines[i] = b.String()
+	}
+	return lines
+}
+
+func TestIntegrationPipeline(t *testing.T) {
+	// A container logs through a real FIFO and the driver uploads to a real
+	// S3 API, rotating its objects; once it stops every object is
+	// downloaded and checked against its manifest entry, and the lines
+	// read back, in order, are all those logged.
+	tests := []struct {
+		name     string
+		cfg      map[string]string
+		lines    int
+		size     int   // most bytes of a line
+		slowDown int64 // PutObject requests throttled
+		// parts is whether objects are sent in parts.
+		parts bool
+	}{
+		{
+			name:  "gzip",
+			cfg:   map[string]string{compressKey: compressGzip, maxObjectSizeKey: "64k", flushBytesKey: "256k"},
+			lines: 5000,
+			size:  400,
+		},
+		{
+			name:  "zstd",
+			cfg:   map[string]string{compressKey: compressZstd, maxObjectSizeKey: "64k", flushBytesKey: "256k"},
+			lines: 5000,
+			size:  400,
+		},
+		{
+			// Uploads retried by the plugin after S3 throttles them.
+			name:     "slow down",
+			cfg:      map[string]string{compressKey: compressGzip, maxObjectSizeKey: "64k", flushBytesKey: "256k", maxRetriesKey: "5"},
+			lines:    3000,
+			size:     400,
+			slowDown: 3,
+		},
+		{
+			name:  "multipart",
+			cfg:   map[string]string{flushBytesKey: "12m", maxObjectSizeKey: "12m", partSizeKey: "5m"},
+			lines: 30000,
+			size:  600,
+			parts: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			it := newIntegrationS3(t)
+			it.transport.slowDown.Store(tt.slowDown)
+			tt.cfg[manifestKey], tt.cfg[flushIntervalKey] = "true", "1h"
+			d := it.newDriver(t)
+			cfg := it.logOpts(t, tt.cfg)
+			opts, err := parseLogOpts(d.opts, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := startIntegrationContainer(t, d, Info{Config: cfg, ContainerID: fmt.Sprintf("%064d", time.Now().UnixNano()), ContainerName: "/it"})
+			lines := integrationLines(tt.lines, tt.size)
+			logged := time.Now().Add(-time.Minute)
+			for i, line := range lines {
+				c.write(t, "stdout", line, logged.Add(time.Duration(i)*time.Microsecond))
+			}
+			c.stop(t, d)
+
+			m := c.manifest(t, it)
+			if !m.Closed || m.ContainerID != c.info.ContainerID || len(m.Objects) < 2 {
+				t.Fatalf("manifest of %s closed %v with %d objects, want it closed with every object rotated", m.ContainerID, m.Closed, len(m.Objects))
+			}
+			var got []string
+			var seq int64
+			for _, mo := range m.Objects {
+				out, body := it.object(t, mo.Key)
+				if int64(len(body)) != mo.Size || aws.ToInt64(out.ContentLength) != mo.Size {
+					t.Errorf("%s of %d bytes, listed as %d", mo.Key, len(body), mo.Size)
+				}
+				if !wantETag(aws.ToString(out.ETag), body, opts.PartSize) {
+					t.Errorf("%s has ETag %s, not that of its %d bytes", mo.Key, aws.ToString(out.ETag), len(body))
+				}
+				if codec, ok := codecs[opts.Compress]; ok {
+					if !strings.HasSuffix(mo.Key, codec.ext) || aws.ToString(out.ContentEncoding) != codec.encoding {
+						t.Errorf("%s has Content-Encoding %q, want %q and a %s suffix", mo.Key, aws.ToString(out.ContentEncoding), codec.encoding, codec.ext)
+					}
+				}
+				if mo.Spooled {
+					t.Errorf("%s listed as spooled", mo.Key)
+				}
+				recs := records(t, opts.Compress, body)
+				if len(recs) != mo.Lines {
+					t.Errorf("%s holds %d lines, listed as %d", mo.Key, len(recs), mo.Lines)
+				}
+				for i, rec := range recs {
+					if rec.Seq != seq+1 || (i == 0 && rec.Seq != mo.FirstSequence) || (i == len(recs)-1 && rec.Seq != mo.LastSequence) {
+						t.Errorf("%s has line %d after %d, listed as %d-%d", mo.Key, rec.Seq, seq, mo.FirstSequence, mo.LastSequence)
+					}
+					seq = rec.Seq
+					got = append(got, rec.Log)
+				}
+			}
+			if len(got) != len(lines) {
+				t.Fatalf("read back %d lines, want %d", len(got), len(lines))
+			}
+			for i := range lines {
+				if got[i] != lines[i] {
+					t.Fatalf("line %d read back as %q, want %q", i+1, got[i], lines[i])
+				}
+			}
+
+			pages := s3.NewListObjectsV2Paginator(it.client, &s3.ListObjectsV2Input{Bucket: aws.String(it.bucket), Prefix: aws.String(c.l.keyPrefix())})
+			listed := 0
+			for pages.HasMorePages() {
+				page, err := pages.NextPage(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				listed += len(page.Contents)
+			}
+			if listed != len(m.Objects)+1 {
+				t.Errorf("bucket holds %d objects of the container, want the manifest's %d and the manifest", listed, len(m.Objects))
+			}
+			if n := it.transport.throttle.Load(); n != tt.slowDown {
+				t.Errorf("%d requests throttled, want %d", n, tt.slowDown)
+			}
+			if n := it.transport.parts.Load(); (n > 0) != tt.parts {
+				t.Errorf("%d parts uploaded, want objects sent in parts = %v", n, tt.parts)
+			}
+		})
+	}
+}
+
+func TestIntegrationConcurrentContainers(t *testing.T) {
+	// Containers logging at once through one driver each get every line,
+	// under prefixes of their own.
+	const containers, lines = 8, 2000
+	it := newIntegrationS3(t)
+	d := it.newDriver(t)
+	cfg := it.logOpts(t, map[string]string{compressKey: compressGzip, maxObjectSizeKey: "32k", flushIntervalKey: "1h", manifestKey: "true"})
+
+	var cs []*integrationContainer
+	for i := range containers {
+		cs = append(cs, startIntegrationContainer(t, d, Info{
+			Config:        cfg,
+			ContainerID:   fmt.Sprintf("%063d%d", time.Now().UnixNano(), i),
+			ContainerName: fmt.Sprintf("/it%d", i),
+		}))
+	}
+	var wg sync.WaitGroup
+	for i, c := range cs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range lines {
+				c.write(t, "stdout", fmt.Sprintf("container %d line %d", i, j), time.Now())
+			}
+		}()
+	}
+	wg.Wait()
+	for _, c := range cs {
+		c.stop(t, d)
+	}
+
+	for i, c := range cs {
+		m := c.manifest(t, it)
+		n := 0
+		for _, mo := range m.Objects {
+			if !strings.HasPrefix(mo.Key, c.l.keyPrefix()) {
+				t.Errorf("%s uploaded %s, outside its prefix %s", c.info.ContainerName, mo.Key, c.l.keyPrefix())
+			}
+			_, body := it.object(t, mo.Key)
+			for _, rec := range records(t, compressGzip, body) {
+				if want := fmt.Sprintf("container %d line %d", i, n); rec.Log != want {
+					t.Fatalf("%s read back %q, want %q", c.info.ContainerName, rec.Log, want)
+				}
+				n++
+			}
+		}
+		if n != lines {
+			t.Errorf("%s read back %d lines, want %d", c.info.ContainerName, n, lines)
+		}
+	}
+}
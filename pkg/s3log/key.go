@@ -0,0 +1,146 @@
+package s3log
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	keyUniqueSuffixKey = "key-unique-suffix"
+
+	uniqueSuffixULID          = "ulid"
+	uniqueSuffixTimestampNano = "timestamp-nano"
+	uniqueSuffixNone          = "none"
+
+	// keyUniqueSentinel stands in for the unique suffix when rendering the
+	// key template to find where it appears in a key.
+	keyUniqueSentinel = "\x02"
+
+	defaultKeyTemplate = "{{.ContainerName}}/{{.ContainerID}}/{{.Timestamp}}-{{.Sequence}}.log"
+
+	// keyTimestampFormat sorts lexically and is precise enough that two
+	// flushes from one container never render the same key.
+	keyTimestampFormat = "20060102T150405.000000000Z"
+)
+
+// keyData is the set of fields available to the key-template option.
+type keyData struct {
+	ContainerID   string
+	ContainerName string
+	ImageName     string
+	Timestamp     string
+	Hostname      string
+	Tag           string
+	Sequence      string
+	FirstSeq      string
+	Group         string
+	TimeSlice     string
+	Index         string
+}
+
+// parseKeyTemplate parses the key template and executes it once against
+// placeholder data so that references to unknown fields are caught when the
+// logger is created rather than on the first flush.
+func parseKeyTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("key").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", keyTemplateKey, text, err)
+	}
+	sample := keyData{"id", "name", "image", "timestamp", "host", "tag", "000001", "000000000001", "group", "2024010100", "0"}
+	if err := tmpl.Execute(new(bytes.Buffer), sample); err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", keyTemplateKey, text, err)
+	}
+	return tmpl, nil
+}
+
+func newKeyData(info Info, tag string) keyData {
+	hostname, _ := os.Hostname()
+	return keyData{
+		ContainerID:   info.ContainerID,
+		ContainerName: strings.TrimPrefix(info.ContainerName, "/"),
+		ImageName:     info.ContainerImageName,
+		Hostname:      hostname,
+		Tag:           tag,
+	}
+}
+
+// parseTag resolves the tag log-opt the same way docker's own drivers do,
+// defaulting to the short container ID.
+func parseTag(info Info) (string, error) {
+	tag, err := parseLogTag(info, defaultTagTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q: %v", tagKey, info.Config[tagKey], err)
+	}
+	return tag, nil
+}
+
+// renderKey renders the object key for a batch flushed at t. If the template
+// fails to render the container ID is used instead so the batch still lands
+// somewhere.
+func renderKey(tmpl *template.Template, data keyData, t time.Time) (string, error) {
+	data.Timestamp = t.UTC().Format(keyTimestampFormat)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil || buf.Len() == 0 {
+		if err == nil {
+			err = fmt.Errorf("template rendered an empty key")
+		}
+		return fmt.Sprintf("%s/%s-%s.log", data.ContainerID, data.Timestamp, data.Sequence), err
+	}
+	return strings.TrimPrefix(buf.String(), "/"), nil
+}
+
+// crockford is the base32 alphabet ULIDs are written in.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID for t: 48 bits of milliseconds followed by 80
+// random bits, as 26 characters that sort in time order.
+func newULID(t time.Time) string {
+	var id [16]byte
+	ms := uint64(t.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		id[i] = byte(ms)
+		ms >>= 8
+	}
+	rand.Read(id[6:])
+
+	// 128 bits in 26 characters of 5 bits, the first holding only 3.
+	var out [26]byte
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// uniqueSuffix returns the key-unique-suffix for an object uploaded at t, or
+// "" for none.
+func (l *S3Logger) uniqueSuffix(t time.Time) string {
+	switch l.opts.KeyUniqueSuffix {
+	case uniqueSuffixULID:
+		return newULID(t)
+	case uniqueSuffixTimestampNano:
+		return fmt.Sprintf("%019d", t.UnixNano())
+	}
+	return ""
+}
+
+// withUniqueSuffix inserts suffix into key before the extension of its last
+// segment, so that objects of different runs with the same rendered key
+// never overwrite each other.
+func withUniqueSuffix(key, suffix string) string {
+	if suffix == "" {
+		return key
+	}
+	ext := path.Ext(key)
+	return strings.TrimSuffix(key, ext) + "-" + suffix + ext
+}
@@ -0,0 +1,116 @@
+package s3log
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	slowFlushThresholdKey = "slow-flush-threshold"
+
+	defaultSlowFlushThreshold = 10 * time.Second
+)
+
+var flushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: driverName,
+	Name:      "flush_duration_seconds",
+	Help:      "Time an object took from its flush starting to compress it to its upload to the bucket finishing, retries included.",
+	Buckets:   prometheus.ExponentialBuckets(0.025, 2, 12),
+}, []string{"bucket"})
+
+func init() {
+	metricsRegistry.MustRegister(flushDuration)
+}
+
+// uploadTrace collects what the SDK saw while uploading an object, which the
+// uploader doesn't return: the API calls it made, the HTTP attempts they
+// took, counting the SDK's own retries, and the request ID of the last
+// response.
+type uploadTrace struct {
+	mu        sync.Mutex
+	calls     int
+	attempts  int
+	requestID string
+}
+
+// option returns an uploader option that has every call of an upload add to
+// tr.
+func (tr *uploadTrace) option() func(*manager.Uploader) {
+	return func(u *manager.Uploader) {
+		u.ClientOptions = append(slices.Clip(u.ClientOptions), func(o *s3.Options) {
+			o.APIOptions = append(o.APIOptions, tr.addMiddleware)
+		})
+	}
+}
+
+// addMiddleware counts a call in the initialize step, which runs once, and
+// an attempt in the deserialize step, which the retryer runs for each
+// attempt.
+func (tr *uploadTrace) addMiddleware(stack *middleware.Stack) error {
+	call := middleware.InitializeMiddlewareFunc("UploadTraceCall", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		tr.mu.Lock()
+		tr.calls++
+		tr.mu.Unlock()
+		return next.HandleInitialize(ctx, in)
+	})
+	attempt := middleware.DeserializeMiddlewareFunc("UploadTraceAttempt", func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+		out, md, err := next.HandleDeserialize(ctx, in)
+		tr.mu.Lock()
+		tr.attempts++
+		if resp, ok := out.RawResponse.(*smithyhttp.Response); ok {
+			if id := resp.Header.Get("X-Amz-Request-Id"); id != "" {
+				tr.requestID = id
+			}
+		}
+		tr.mu.Unlock()
+		return out, md, err
+	})
+	if err := stack.Initialize.Add(call, middleware.Before); err != nil {
+		return err
+	}
+	return stack.Deserialize.Add(attempt, middleware.After)
+}
+
+// record adds what tr saw to b, the batch it traced an upload of.
+func (tr *uploadTrace) record(b *batch) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	b.sdkRetries += tr.attempts - tr.calls
+	if tr.requestID != "" {
+		b.requestID = tr.requestID
+	}
+}
+
+// observeFlush records how long b took to reach t, from its flush starting
+// to compress it to the end of its last upload attempt, having been retried
+// retried times, and warns if that was over slow-flush-threshold.
+func (l *S3Logger) observeFlush(t *target, b *batch, retried int, err error) {
+	if b.flushed.IsZero() {
+		return
+	}
+	took := time.Since(b.flushed)
+	flushDuration.WithLabelValues(t.bucket).Observe(took.Seconds())
+	threshold := l.opts.SlowFlushThreshold
+	if threshold <= 0 || took < threshold {
+		return
+	}
+	log := l.log().WithField("bucket", t.bucket).WithField("key", b.Key).
+		WithField("duration", took.Round(time.Millisecond)).
+		WithField("bytes", len(b.body)).
+		WithField("retries", retried+b.sdkRetries)
+	if b.requestID != "" {
+		log = log.WithField("request_id", b.requestID)
+	}
+	if err != nil {
+		log = log.WithError(err)
+	}
+	log.Warnf("slow flush, took longer than %s %s", slowFlushThresholdKey, threshold)
+}
@@ -0,0 +1,186 @@
+package s3log
+
+import (
+	"context"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// flushesObserved returns how many flushes to bucket the latency histogram
+// has recorded.
+func flushesObserved(t *testing.T, bucket string) uint64 {
+	t.Helper()
+	var pb dto.Metric
+	if err := flushDuration.WithLabelValues(bucket).(prometheus.Metric).Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	return pb.GetHistogram().GetSampleCount()
+}
+
+// slowFlushes returns the slow-flush warnings hook has caught.
+func slowFlushes(hook *logtest.Hook) []*logrus.Entry {
+	var warnings []*logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if strings.HasPrefix(e.Message, "slow flush") {
+			warnings = append(warnings, e)
+		}
+	}
+	return warnings
+}
+
+func TestSlowFlushWarning(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     map[string]string
+		delay   time.Duration
+		fail    int
+		warn    bool
+		retries int
+	}{
+		{name: "fast", cfg: map[string]string{slowFlushThresholdKey: "10s"}},
+		{name: "slow", cfg: map[string]string{slowFlushThresholdKey: "20ms"}, delay: 50 * time.Millisecond, warn: true},
+		{
+			// The time taken is the object's, retries included, though no
+			// attempt is slow on its own.
+			name:    "slow after retries",
+			cfg:     map[string]string{slowFlushThresholdKey: "50ms", maxRetryDelayKey: "1ms"},
+			delay:   30 * time.Millisecond,
+			fail:    2,
+			warn:    true,
+			retries: 2,
+		},
+		{name: "disabled", cfg: map[string]string{slowFlushThresholdKey: "0"}, delay: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewGlobal()
+			defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+			fake := newFakeS3()
+			var puts int
+			fake.before = func(ctx context.Context, op, bucket, key string) error {
+				if op != "PutObject" {
+					return nil
+				}
+				time.Sleep(tt.delay)
+				if puts++; puts <= tt.fail {
+					return fakeStatusError(http.StatusServiceUnavailable, "SlowDown")
+				}
+				return nil
+			}
+			cfg := map[string]string{flushIntervalKey: "1h"}
+			maps.Copy(cfg, tt.cfg)
+			l := newTestLogger(t, fake, cfg)
+			observed := flushesObserved(t, testBucket)
+			logLines(t, l, time.Now(), "one", "two", "three")
+			if err := l.flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := flushesObserved(t, testBucket) - observed; got != 1 {
+				t.Errorf("histogram recorded %d flushes, want 1", got)
+			}
+			warnings := slowFlushes(hook)
+			if !tt.warn {
+				if len(warnings) != 0 {
+					t.Errorf("warned of a slow flush: %v", warnings[0].Data)
+				}
+				return
+			}
+			if len(warnings) != 1 {
+				t.Fatalf("%d slow-flush warnings, want 1", len(warnings))
+			}
+			keys := fake.logKeys(testBucket)
+			if len(keys) != 1 {
+				t.Fatalf("uploaded %q, want one object", keys)
+			}
+			o, _ := fake.object(testBucket, keys[0])
+			w := warnings[0]
+			if w.Level != logrus.WarnLevel || w.Data["bucket"] != testBucket || w.Data["key"] != keys[0] || w.Data["bytes"] != len(o.data) || w.Data["retries"] != tt.retries {
+				t.Errorf("warning %q with %v, want bucket, key, %d bytes and %d retries", w.Message, w.Data, len(o.data), tt.retries)
+			}
+			if d, _ := w.Data["duration"].(time.Duration); d < l.opts.SlowFlushThreshold {
+				t.Errorf("warning gives a duration of %v, under the threshold", w.Data["duration"])
+			}
+			if _, ok := w.Data["request_id"]; ok {
+				t.Errorf("warning has a request ID, %v, without an HTTP response", w.Data["request_id"])
+			}
+		})
+	}
+}
+
+// slowS3 is an S3 endpoint answering the first PUT with a 503 SlowDown and
+// the retry after delay, each with a request ID of its own. Anything else
+// it answers with an empty 200.
+type slowS3 struct {
+	delay time.Duration
+
+	mu   sync.Mutex
+	puts int
+}
+
+func (s *slowS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	if r.Method != http.MethodPut {
+		return
+	}
+	s.mu.Lock()
+	s.puts++
+	n := s.puts
+	s.mu.Unlock()
+	if n == 1 {
+		w.Header().Set("X-Amz-Request-Id", "REQ1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message><RequestId>REQ1</RequestId></Error>`)
+		return
+	}
+	time.Sleep(s.delay)
+	w.Header().Set("X-Amz-Request-Id", "REQ2")
+	w.Header().Set("ETag", `"etag"`)
+}
+
+func TestSlowFlushRequestID(t *testing.T) {
+	// The SDK retries the 503 itself, so it is only seen through the
+	// middleware the upload is traced with.
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	s := &slowS3{delay: 50 * time.Millisecond}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	clients := newTestClients(nil)
+	clients.newClient = newS3Client
+	info := Info{
+		Config: testLogOpts(t, map[string]string{
+			endpointURLKey:        srv.URL,
+			forcePathStyleKey:     "true",
+			slowFlushThresholdKey: "20ms",
+			flushIntervalKey:      "1h",
+		}),
+		ContainerID:   testContainerID(t),
+		ContainerName: "/test",
+	}
+	cl, _ := newClientsLogger(t, clients, info)
+	l := s3Loggers(cl)[0]
+	logLines(t, l, time.Now(), "one")
+	if err := l.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	warnings := slowFlushes(hook)
+	if len(warnings) != 1 {
+		t.Fatalf("%d slow-flush warnings, want 1", len(warnings))
+	}
+	if w := warnings[0]; w.Data["request_id"] != "REQ2" || w.Data["retries"] != 1 {
+		t.Errorf("warning with %v, want the request ID REQ2 of the retry and 1 retry", w.Data)
+	}
+}
@@ -0,0 +1,242 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	keyLayoutKey       = "key-layout"
+	timeSliceFormatKey = "time-slice-format"
+
+	keyLayoutDefault = "default"
+	keyLayoutFluentd = "fluentd"
+
+	defaultTimeSliceFormat = "%Y%m%d%H"
+
+	// keySliceSentinel stands in for the time slice when rendering the key
+	// template to find whether keys start with it.
+	keySliceSentinel = "\x03"
+)
+
+// keyLayouts are the key-layout presets other than the default, which names
+// objects with key-template. Each returns the key template it stands for,
+// which may depend on how objects are encoded. Templates render .TimeSlice
+// and .Index, which the logger keeps track of for any template.
+var keyLayouts = map[string]func(opts LogOption) string{
+	keyLayoutFluentd: fluentdKeyTemplate,
+}
+
+// fluentdKeyTemplate returns the template of the object keys fluentd's s3
+// output writes by default, {path}{time_slice}_{index}.{file_extension},
+// with the tag under s3-prefix as path. A compressed object gets its codec's
+// extension added as any other, .gz or .zst as with fluentd's store_as gzip
+// or zstd; an uncompressed one is .json or .txt, as with store_as json or
+// text. A parquet object gets .parquet, as with store_as parquet.
+func fluentdKeyTemplate(opts LogOption) string {
+	tmpl := "{{.Tag}}/{{.TimeSlice}}_{{.Index}}"
+	switch {
+	case opts.Compress != compressNone, opts.Format == formatParquet:
+		return tmpl
+	case opts.Format == formatRaw:
+		return tmpl + ".txt"
+	}
+	return tmpl + ".json"
+}
+
+// keySlice is the time slice of the last object a logger uploaded and its
+// index within it.
+type keySlice struct {
+	name  string
+	time  time.Time // latest time an object was sliced by
+	index int64
+}
+
+// strftimeVerbs maps the strftime verbs a time-slice-format may use to the
+// time layout they stand for.
+var strftimeVerbs = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'H': "15",
+	'M': "04",
+	'S': "05",
+}
+
+// sliceLayout returns the time layout of a strftime-style time-slice-format,
+// as fluentd's time_slice_format is written. Besides the verbs only
+// punctuation is allowed, which a layout keeps as it is.
+func sliceLayout(format string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		switch {
+		case c == '%' && i+1 < len(format):
+			i++
+			if format[i] == '%' {
+				b.WriteByte('%')
+				continue
+			}
+			verb, ok := strftimeVerbs[format[i]]
+			if !ok {
+				return "", fmt.Errorf("unsupported verb %%%c, must be one of %%Y, %%y, %%m, %%d, %%H, %%M and %%S", format[i])
+			}
+			b.WriteString(verb)
+		case c == '%':
+			return "", fmt.Errorf("trailing %%")
+		case c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80:
+			return "", fmt.Errorf("unsupported character %q, only punctuation may come between verbs", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if b.Len() == 0 {
+		return "", fmt.Errorf("must not be empty")
+	}
+	return b.String(), nil
+}
+
+// sliceSorts reports whether the time slices of a time-slice-format sort
+// in time order: whether it is the year and then each smaller unit down to
+// some unit in turn, like %Y%m%d%H.
+func sliceSorts(format string) bool {
+	const units = "YmdHMS"
+	next := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			continue
+		}
+		i++
+		unit := strings.IndexByte(units, format[i])
+		if format[i] == 'y' {
+			unit = 0
+		}
+		if unit < 0 {
+			continue
+		}
+		if unit != next {
+			return false
+		}
+		next++
+	}
+	return next > 0
+}
+
+// timeSlice returns the time slice that t falls in, in partition-timezone as
+// partitions are.
+func (l *S3Logger) timeSlice(t time.Time) string {
+	return t.In(l.partitionLoc).Format(l.sliceLayout)
+}
+
+// keysStartWithSlice reports whether the container's keys start with their
+// time slice, rather than their timestamp, after containerKeyPrefix, and the
+// slices sort in time order, so that listing is narrowed and ordered by it.
+func (l *S3Logger) keysStartWithSlice() bool {
+	if !sliceSorts(l.opts.TimeSliceFormat) {
+		return false
+	}
+	data := l.keyData
+	data.Timestamp = keyPrefixSentinel
+	data.Sequence = keyPrefixSentinel
+	data.FirstSeq = keyPrefixSentinel
+	data.Index = keyPrefixSentinel
+	data.TimeSlice = keySliceSentinel
+	var buf bytes.Buffer
+	if err := l.keyTmpl.Execute(&buf, data); err != nil {
+		return false
+	}
+	i := strings.IndexAny(buf.String(), keyPrefixSentinel+keySliceSentinel)
+	return i >= 0 && buf.String()[i:i+1] == keySliceSentinel
+}
+
+// nextIndex returns the time slice of an object in partition whose first
+// line was logged at t, and its index among the slice's objects, counting
+// from 0. Like partitions, slices only move forward: an object whose first
+// line was logged before that of the last goes in the last's slice. Moving
+// on to a later slice starts its count over, and the first slice of a logger
+// is listed for the highest index already taken, so that numbering carries
+// on from a previous run. Callers must hold l.flushMu.
+func (l *S3Logger) nextIndex(ctx context.Context, partition string, t time.Time) (string, string) {
+	if t = t.Round(0); t.Before(l.slice.time) {
+		t = l.slice.time
+	}
+	slice := l.timeSlice(t)
+	switch {
+	case slice == l.slice.name:
+		l.slice.index++
+	case l.slice.name != "":
+		l.slice.index = 0
+	default:
+		next, err := l.firstFreeIndex(ctx, partition, slice)
+		if err != nil {
+			l.log().WithField("slice", slice).WithError(err).Warn("error finding the last object index of the time slice, starting from 0")
+		}
+		l.slice.index = next
+	}
+	l.slice.name, l.slice.time = slice, t
+	return slice, strconv.FormatInt(l.slice.index, 10)
+}
+
+// firstFreeIndex returns the index following the highest taken by the
+// container's objects of slice in partition, or 0 if there are none, the
+// key template doesn't index them or they are replayed.
+func (l *S3Logger) firstFreeIndex(ctx context.Context, partition, slice string) (int64, error) {
+	// A replay numbers its objects afresh, to name them the same every time.
+	if l.opts.replay != nil {
+		return 0, nil
+	}
+	pattern := l.keyPattern(func(d *keyData) {
+		d.TimeSlice = slice
+		d.Index = keySequenceSentinel
+	})
+	if pattern == nil {
+		return 0, nil
+	}
+	// List only the slice: its keys share everything up to the index.
+	data := l.keyData
+	data.Timestamp = keyPrefixSentinel
+	data.Sequence = keyPrefixSentinel
+	data.FirstSeq = keyPrefixSentinel
+	data.Index = keyPrefixSentinel
+	data.TimeSlice = slice
+	var buf bytes.Buffer
+	if err := l.keyTmpl.Execute(&buf, data); err != nil {
+		return 0, err
+	}
+	rendered := strings.TrimPrefix(buf.String(), "/")
+	if i := strings.Index(rendered, keyPrefixSentinel); i >= 0 {
+		rendered = rendered[:i]
+	}
+	base := l.opts.S3Prefix + partition
+	next := int64(0)
+	pages := s3.NewListObjectsV2Paginator(l.s3Client, &s3.ListObjectsV2Input{
+		Bucket:       aws.String(l.bucket),
+		Prefix:       aws.String(base + rendered),
+		RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return next, err
+		}
+		for _, o := range page.Contents {
+			m := pattern.FindStringSubmatch(strings.TrimPrefix(aws.ToString(o.Key), base))
+			if m == nil {
+				continue
+			}
+			if index, err := strconv.ParseInt(m[1], 10, 64); err == nil && index >= next {
+				next = index + 1
+			}
+		}
+	}
+	return next, nil
+}
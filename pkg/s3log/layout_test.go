@@ -0,0 +1,173 @@
+package s3log
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSliceLayout(t *testing.T) {
+	tests := []struct {
+		format, want, wantErr string
+	}{
+		{format: "%Y%m%d%H", want: "2006010215"},
+		{format: "%Y%m%d", want: "20060102"},
+		{format: "%Y-%m-%d/%H", want: "2006-01-02/15"},
+		{format: "%y%m%d%H%M%S", want: "060102150405"},
+		{format: "%Y%%%m", want: "2006%01"},
+		{format: "", wantErr: "must not be empty"},
+		{format: "%Q", wantErr: "unsupported verb %Q"},
+		{format: "%Y%", wantErr: "trailing %"},
+		{format: "%Yx%m", wantErr: `unsupported character 'x'`},
+	}
+	for _, tt := range tests {
+		got, err := sliceLayout(tt.format)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("sliceLayout(%q) returned %q, %v, want an error containing %q", tt.format, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("sliceLayout(%q) = %q, %v, want %q", tt.format, got, err, tt.want)
+		}
+	}
+}
+
+func TestSliceSorts(t *testing.T) {
+	for format, want := range map[string]bool{
+		"%Y%m%d%H":     true,
+		"%Y%m%d":       true,
+		"%Y-%m-%d/%H":  true,
+		"%y%m%d":       true,
+		"%Y":           true,
+		"%d%m%Y":       false,
+		"%Y%d":         false,
+		"%H":           false,
+		"%Y%m%d%H%M%S": true,
+	} {
+		if got := sliceSorts(format); got != want {
+			t.Errorf("sliceSorts(%q) = %v, want %v", format, got, want)
+		}
+	}
+}
+
+// fluentdLogger returns a logger with the fluentd key layout, tagged web
+// under logs/, slicing in UTC, along with cfg.
+func fluentdLogger(t *testing.T, fake *fakeS3, cfg map[string]string) *S3Logger {
+	t.Helper()
+	opts := map[string]string{
+		keyLayoutKey:         keyLayoutFluentd,
+		s3PrefixKey:          "logs/",
+		tagKey:               "web",
+		partitionTimezoneKey: "UTC",
+		flushIntervalKey:     "1h",
+	}
+	maps.Copy(opts, cfg)
+	return newTestLogger(t, fake, opts)
+}
+
+// flushAt logs a line at each of times, flushing after each.
+func flushAt(t *testing.T, l *S3Logger, times ...time.Time) {
+	t.Helper()
+	for i, ts := range times {
+		if err := l.Log(&Message{Line: []byte(fmt.Sprintf("line %d", i)), Source: "stdout", Timestamp: ts}); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFluentdKeys(t *testing.T) {
+	// fluentd's own examples: time slices of 2013-01-11 10:xx.
+	at := func(h, m int) time.Time { return time.Date(2013, 1, 11, h, m, 0, 0, time.UTC) }
+	tests := []struct {
+		name  string
+		cfg   map[string]string
+		times []time.Time
+		want  []string
+	}{
+		{
+			name:  "hourly gzip",
+			cfg:   map[string]string{compressKey: compressGzip},
+			times: []time.Time{at(10, 0), at(10, 30), at(10, 59), at(11, 5)},
+			want:  []string{"logs/web/2013011110_0.gz", "logs/web/2013011110_1.gz", "logs/web/2013011110_2.gz", "logs/web/2013011111_0.gz"},
+		},
+		{
+			name:  "daily json",
+			cfg:   map[string]string{timeSliceFormatKey: "%Y%m%d", formatKey: formatJSONL},
+			times: []time.Time{at(0, 0), at(10, 0), at(23, 59)},
+			want:  []string{"logs/web/20130111_0.json", "logs/web/20130111_1.json", "logs/web/20130111_2.json"},
+		},
+		{
+			name:  "text",
+			cfg:   map[string]string{formatKey: formatRaw},
+			times: []time.Time{at(10, 0)},
+			want:  []string{"logs/web/2013011110_0.txt"},
+		},
+		{
+			name:  "zstd",
+			cfg:   map[string]string{compressKey: compressZstd},
+			times: []time.Time{at(10, 0)},
+			want:  []string{"logs/web/2013011110_0.zst"},
+		},
+		{
+			// A line from before the slice the logger moved on to goes in
+			// that slice.
+			name:  "late line",
+			cfg:   map[string]string{compressKey: compressGzip},
+			times: []time.Time{at(10, 59), at(11, 0), at(10, 58), at(11, 1)},
+			want:  []string{"logs/web/2013011110_0.gz", "logs/web/2013011111_0.gz", "logs/web/2013011111_1.gz", "logs/web/2013011111_2.gz"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			l := fluentdLogger(t, fake, tt.cfg)
+			flushAt(t, l, tt.times...)
+			want := slices.Clone(tt.want)
+			slices.Sort(want)
+			if got := fake.logKeys(testBucket); !slices.Equal(got, want) {
+				t.Errorf("keys %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFluentdIndexCarriesOn(t *testing.T) {
+	at := time.Date(2013, 1, 11, 10, 0, 0, 0, time.UTC)
+	fake := newFakeS3()
+	// A previous run, or fluentd, took indexes up to 11 of the slice.
+	for i := range 12 {
+		fake.put(testBucket, fmt.Sprintf("logs/web/2013011110_%d.gz", i), []byte("old\n"), at)
+	}
+	fake.put(testBucket, "logs/web/2013011109_40.gz", []byte("old\n"), at)
+	l := fluentdLogger(t, fake, map[string]string{compressKey: compressGzip})
+	flushAt(t, l, at.Add(time.Minute), at.Add(2*time.Minute))
+	for _, key := range []string{"logs/web/2013011110_12.gz", "logs/web/2013011110_13.gz"} {
+		if _, ok := fake.object(testBucket, key); !ok {
+			t.Errorf("no %s among %q", key, fake.logKeys(testBucket))
+		}
+	}
+
+	// Reads order a slice's objects by index, _10 after _9, even with the
+	// lines all logged at once.
+	fake = newFakeS3()
+	l = fluentdLogger(t, fake, map[string]string{compressKey: compressGzip})
+	var times []time.Time
+	var want []string
+	for i := range 12 {
+		times = append(times, at)
+		want = append(want, fmt.Sprintf("line %d", i))
+	}
+	flushAt(t, l, times...)
+	if got := readLogs(t, l, ReadConfig{Tail: -1}); !slices.Equal(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
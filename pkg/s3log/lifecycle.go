@@ -0,0 +1,202 @@
+package s3log
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// goroutineStopTimeout bounds how long a stopped container's goroutines are
+// waited for before those still running are counted as leaked.
+const goroutineStopTimeout = 5 * time.Second
+
+var (
+	containerGoroutines = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: driverName,
+		Name:      "container_goroutines",
+		Help:      "Goroutines run for containers, by state: running for a container that is logging, or leaked past its stop.",
+	}, []string{"state"})
+	containersLogging = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: driverName,
+		Name:      "containers",
+		Help:      "Containers the daemon has started logging that haven't stopped.",
+	})
+	goroutinesLeaked = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "goroutine_leaks_total",
+		Help:      "Goroutines still running once their container's stop had waited for them.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(containerGoroutines, containersLogging, goroutinesLeaked)
+}
+
+// routines are the goroutines that run for as long as a container's logger,
+// or the reader of its FIFO, by name. Stopping the container waits for them
+// to exit, and any still running after that have leaked.
+type routines struct {
+	id string
+
+	mu      sync.Mutex
+	running map[string]int
+	n       int
+	idle    chan struct{} // closed while none are running
+	stopped bool
+}
+
+// liveRoutines holds the routines of every container that hasn't stopped or
+// still has goroutines running.
+var liveRoutines = struct {
+	sync.Mutex
+	all map[*routines]struct{}
+}{all: make(map[*routines]struct{})}
+
+func newRoutines(id string) *routines {
+	r := &routines{id: id, running: make(map[string]int), idle: make(chan struct{})}
+	close(r.idle)
+	liveRoutines.Lock()
+	liveRoutines.all[r] = struct{}{}
+	liveRoutines.Unlock()
+	return r
+}
+
+// state is the containerGoroutines label of r's goroutines. Callers must
+// hold r.mu.
+func (r *routines) state() string {
+	if r.stopped {
+		return "leaked"
+	}
+	return "running"
+}
+
+// start runs fn in a goroutine counted under name until it returns.
+func (r *routines) start(name string, fn func()) {
+	r.mu.Lock()
+	if r.n == 0 {
+		r.idle = make(chan struct{})
+	}
+	r.n++
+	r.running[name]++
+	containerGoroutines.WithLabelValues(r.state()).Inc()
+	r.mu.Unlock()
+	go func() {
+		defer r.exit(name)
+		fn()
+	}()
+}
+
+func (r *routines) exit(name string) {
+	r.mu.Lock()
+	if r.running[name]--; r.running[name] == 0 {
+		delete(r.running, name)
+	}
+	r.n--
+	containerGoroutines.WithLabelValues(r.state()).Dec()
+	if r.n == 0 {
+		close(r.idle)
+		if r.stopped {
+			r.forget()
+		}
+	}
+	r.mu.Unlock()
+}
+
+// wait waits up to timeout for r's goroutines to exit, warning about those
+// that haven't, and marks the container stopped, so that any still running
+// from then on count as leaked.
+func (r *routines) wait(timeout time.Duration) {
+	r.mu.Lock()
+	idle := r.idle
+	r.mu.Unlock()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-idle:
+	case <-t.C:
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+	r.stopped = true
+	if r.n == 0 {
+		r.forget()
+		return
+	}
+	containerGoroutines.WithLabelValues("running").Sub(float64(r.n))
+	containerGoroutines.WithLabelValues("leaked").Add(float64(r.n))
+	goroutinesLeaked.Add(float64(r.n))
+	logrus.WithField("id", r.id).WithField("goroutines", r.names()).Warnf("goroutines still running %s after the container stopped", timeout)
+}
+
+// names returns the names of r's running goroutines, each as often as it
+// runs. Callers must hold r.mu.
+func (r *routines) names() []string {
+	var names []string
+	for name, n := range r.running {
+		for range n {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// forget drops r from liveRoutines. Callers must hold r.mu, which
+// countRoutines never holds while taking liveRoutines.
+func (r *routines) forget() {
+	liveRoutines.Lock()
+	delete(liveRoutines.all, r)
+	liveRoutines.Unlock()
+}
+
+// routineStats counts the goroutines run for containers against the
+// containers logging: those of a stopped container, which should all have
+// exited, are leaked.
+type routineStats struct {
+	Containers int            `json:"containers"`
+	Running    int            `json:"running"`
+	Leaked     int            `json:"leaked"`
+	LeakedBy   []leakedByStat `json:"leaked_by,omitempty"`
+}
+
+type leakedByStat struct {
+	ID         string   `json:"id"`
+	Goroutines []string `json:"goroutines"`
+}
+
+// countRoutines returns the routineStats of the containers logging, along
+// with how many goroutines run for each of them by ID.
+func countRoutines(containers int) (routineStats, map[string]int) {
+	liveRoutines.Lock()
+	all := make([]*routines, 0, len(liveRoutines.all))
+	for r := range liveRoutines.all {
+		all = append(all, r)
+	}
+	liveRoutines.Unlock()
+
+	stats := routineStats{Containers: containers}
+	byID := make(map[string]int)
+	for _, r := range all {
+		r.mu.Lock()
+		if r.stopped {
+			if r.n > 0 {
+				stats.Leaked += r.n
+				stats.LeakedBy = append(stats.LeakedBy, leakedByStat{ID: r.id, Goroutines: r.names()})
+			}
+		} else {
+			stats.Running += r.n
+			byID[r.id] += r.n
+		}
+		r.mu.Unlock()
+	}
+	slices.SortFunc(stats.LeakedBy, func(a, b leakedByStat) int { return strings.Compare(a.ID, b.ID) })
+	return stats, byID
+}
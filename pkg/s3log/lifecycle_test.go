@@ -0,0 +1,125 @@
+package s3log
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// isLive reports whether r is still in liveRoutines.
+func isLive(r *routines) bool {
+	liveRoutines.Lock()
+	defer liveRoutines.Unlock()
+	_, ok := liveRoutines.all[r]
+	return ok
+}
+
+func TestRoutinesLeaked(t *testing.T) {
+	// A goroutine still running once its container's stop has waited for it
+	// is reported, by name, until it exits.
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	leaked := metricValue(goroutinesLeaked)
+	id := testContainerID(t)
+	r := newRoutines(id)
+	release := make(chan struct{})
+	r.start("flush", func() {})
+	r.start("stuck", func() { <-release })
+	r.start("stuck", func() { <-release })
+	r.wait(20 * time.Millisecond)
+
+	if got := metricValue(goroutinesLeaked) - leaked; got != 2 {
+		t.Errorf("%v goroutines counted leaked, want 2", got)
+	}
+	stats, byID := countRoutines(0)
+	i := slices.IndexFunc(stats.LeakedBy, func(s leakedByStat) bool { return s.ID == id })
+	if i < 0 || !slices.Equal(stats.LeakedBy[i].Goroutines, []string{"stuck", "stuck"}) || byID[id] != 0 {
+		t.Errorf("stats %+v, want the two stuck goroutines leaked by the container", stats)
+	}
+	var warned bool
+	for _, e := range hook.AllEntries() {
+		warned = warned || e.Level == logrus.WarnLevel && e.Data["id"] == id
+	}
+	if !warned {
+		t.Error("no warning of the leaked goroutines")
+	}
+
+	close(release)
+	waitFor(t, "the stopped container's routines to be forgotten", func() bool { return !isLive(r) })
+}
+
+func TestRoutinesStopped(t *testing.T) {
+	// Goroutines that exit within the wait leave nothing behind.
+	leaked := metricValue(goroutinesLeaked)
+	r := newRoutines(testContainerID(t))
+	for range 3 {
+		r.start("loop", func() { time.Sleep(time.Millisecond) })
+	}
+	r.wait(5 * time.Second)
+	if isLive(r) || metricValue(goroutinesLeaked) != leaked {
+		t.Error("goroutines that exited counted as leaked")
+	}
+}
+
+func TestContainerChurn(t *testing.T) {
+	// Starting and stopping many containers leaves no goroutine of theirs
+	// behind.
+	n := 1000
+	if testing.Short() {
+		n = 100
+	}
+	fake := newFakeS3()
+	d := newTestDriver(t, fake, nil)
+	runtime.GC()
+	baseline := runtime.NumGoroutine()
+	var ids []string
+	for i := range n {
+		id := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprint(t.Name(), i))))
+		ids = append(ids, id)
+		c := startContainerInfo(t, d, Info{Config: testLogOpts(t, nil), ContainerID: id, ContainerName: fmt.Sprintf("/churn%d", i)})
+		c.write(t, entry("stdout", "line", time.Now()))
+		if i%100 == 0 {
+			// While logging, each container's goroutines are counted.
+			var buf bytes.Buffer
+			if err := d.dumpStats(&buf); err != nil {
+				t.Fatal(err)
+			}
+			var snap statsSnapshot
+			if err := json.Unmarshal(buf.Bytes(), &snap); err != nil {
+				t.Fatal(err)
+			}
+			if snap.Routines.Containers != 1 || len(snap.Containers) != 1 || snap.Containers[0].Goroutines == 0 {
+				t.Fatalf("stats %+v while one container logs, want its goroutines counted", snap.Routines)
+			}
+		}
+		c.stop(t, d)
+	}
+
+	waitFor(t, "the goroutines to return to baseline", func() bool { return runtime.NumGoroutine() <= baseline })
+	if got := metricValue(containersLogging); got != 0 {
+		t.Errorf("%v containers counted logging, want none", got)
+	}
+	stats, byID := countRoutines(0)
+	for _, l := range stats.LeakedBy {
+		if slices.Contains(ids, l.ID) {
+			t.Errorf("container %s leaked %q", l.ID, l.Goroutines)
+		}
+	}
+	for _, id := range ids {
+		if byID[id] != 0 {
+			t.Errorf("container %s stopped with %d goroutines registered", id, byID[id])
+		}
+	}
+	if keys := fake.logKeys(testBucket); len(keys) != n || !strings.Contains(keys[0], "churn") {
+		t.Errorf("uploaded %d objects, want one per container", len(keys))
+	}
+}
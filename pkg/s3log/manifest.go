@@ -0,0 +1,283 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	manifestKey = "manifest"
+
+	manifestName = "manifest.json"
+
+	// manifestAttempts bounds how many times a manifest update is retried
+	// after losing a race with another writer.
+	manifestAttempts = 5
+)
+
+func init() {
+	manifests := func(s permissionScope) bool { return s.opts.Manifest }
+	requirePermissions(
+		permission{"s3:GetObject", onObjects, manifestKey, manifests},
+		permission{"s3:PutObject", onObjects, manifestKey, manifests},
+		// Objects are read by the version the manifest lists.
+		permission{"s3:GetObjectVersion", onObjects, "docker logs with " + manifestKey, func(s permissionScope) bool { return s.read && s.opts.Manifest }},
+	)
+}
+
+// manifest lists every object uploaded for a container, so that consumers
+// know which objects belong to it without listing the bucket. It is kept
+// next to the container's objects and rewritten after every flush, with
+// closed set once the container has stopped.
+type manifest struct {
+	ContainerID   string           `json:"container_id"`
+	ContainerName string           `json:"container_name"`
+	Closed        bool             `json:"closed"`
+	Objects       []manifestObject `json:"objects"`
+}
+
+// manifestObject is an object listed in a manifest. A spooled object hasn't
+// been uploaded yet; the spool clears the flag once it has. In a versioned
+// bucket the version uploaded is recorded, and read back rather than the
+// latest. An object written to the failover bucket names it.
+type manifestObject struct {
+	Key            string    `json:"key"`
+	Size           int64     `json:"size"`
+	Lines          int       `json:"lines"`
+	FirstTimestamp time.Time `json:"first_timestamp"`
+	LastTimestamp  time.Time `json:"last_timestamp"`
+	FirstSequence  int64     `json:"first_sequence"`
+	LastSequence   int64     `json:"last_sequence"`
+	VersionID      string    `json:"version_id,omitempty"`
+	RequestID      string    `json:"request_id,omitempty"`
+	Spooled        bool      `json:"spooled,omitempty"`
+	FailoverBucket string    `json:"failover_bucket,omitempty"`
+}
+
+// manifestPath returns the key of the logger's manifest, or "" if it keeps
+// none.
+func (l *S3Logger) manifestPath() string {
+	if !l.opts.Manifest {
+		return ""
+	}
+	prefix := l.containerKeyPrefix()
+	if prefix == "" {
+		prefix = l.info.ContainerID + "/"
+	}
+	return l.opts.S3Prefix + prefix + manifestName
+}
+
+// manifestObject describes b, uploaded or spooled, for the manifest.
+func (b *batch) manifestObject(spooled bool) manifestObject {
+	o := manifestObject{
+		Key:            b.Key,
+		Size:           b.objectSize(),
+		Lines:          b.Lines,
+		FirstTimestamp: b.First,
+		LastTimestamp:  b.Last,
+		FirstSequence:  b.FirstSeq,
+		LastSequence:   b.FirstSeq + int64(b.Lines) - 1,
+		VersionID:      b.versionID,
+		RequestID:      b.requestID,
+		Spooled:        spooled,
+	}
+	if b.failover {
+		o.FailoverBucket = b.Bucket
+	}
+	return o
+}
+
+// add lists o in the manifest, replacing the entry for its key if there is
+// one.
+func (m *manifest) add(o manifestObject) {
+	for i := range m.Objects {
+		if m.Objects[i].Key == o.Key {
+			m.Objects[i] = o
+			return
+		}
+	}
+	m.Objects = append(m.Objects, o)
+}
+
+// merge replaces the entries of the objects named by keys with one for
+// merged, which takes the place of the first of them and spans their
+// timestamps and sequence numbers. Nothing changes if none are listed.
+func (m *manifest) merge(keys map[string]bool, merged manifestObject) {
+	objects := m.Objects[:0]
+	at := -1
+	for _, o := range m.Objects {
+		if !keys[o.Key] {
+			objects = append(objects, o)
+			continue
+		}
+		if at < 0 {
+			at = len(objects)
+			merged.FirstTimestamp, merged.LastTimestamp = o.FirstTimestamp, o.LastTimestamp
+			merged.FirstSequence, merged.LastSequence = o.FirstSequence, o.LastSequence
+			objects = append(objects, merged)
+		}
+		e := &objects[at]
+		if o.FirstTimestamp.Before(e.FirstTimestamp) {
+			e.FirstTimestamp = o.FirstTimestamp
+		}
+		if o.LastTimestamp.After(e.LastTimestamp) {
+			e.LastTimestamp = o.LastTimestamp
+		}
+		e.FirstSequence = min(e.FirstSequence, o.FirstSequence)
+		e.LastSequence = max(e.LastSequence, o.LastSequence)
+	}
+	m.Objects = objects
+}
+
+// writeManifests adds the objects each target has uploaded or spooled since
+// the last call to its manifest, marking it closed if closed is set. Callers
+// must hold l.flushMu.
+func (l *S3Logger) writeManifests(ctx context.Context, closed bool) error {
+	key := l.manifestPath()
+	if key == "" {
+		return nil
+	}
+	var errs []error
+	for _, t := range l.targets {
+		if len(t.manifest) == 0 && !closed {
+			continue
+		}
+		objects := t.manifest
+		err := updateManifest(ctx, t.client, t.bucket, key, l.opts.RequestPayer, l.retention, func(m *manifest) {
+			m.ContainerID = l.info.ContainerID
+			m.ContainerName = l.info.Name()
+			m.Closed = closed
+			for _, o := range objects {
+				m.add(o)
+			}
+		})
+		if err != nil {
+			countS3Error(t.bucket, err)
+			errs = append(errs, err)
+			continue
+		}
+		t.manifest = nil
+	}
+	return errors.Join(errs...)
+}
+
+// closeManifest marks the logger's manifests closed once its container has
+// stopped and the logger has been closed.
+func (l *S3Logger) closeManifest() {
+	if l.manifestPath() == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), l.opts.ShutdownFlushTimeout)
+	defer cancel()
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+	if err := l.writeManifests(ctx, true); err != nil {
+		describeAWSError(err).fields(l.log()).WithError(err).Warn("error closing manifest")
+	}
+}
+
+// updateManifest applies fn to the manifest at key and writes it back. The
+// write is conditional on the manifest not having changed since it was read,
+// and is retried on a fresh copy if it has. The manifest is tagged with r,
+// as the objects it lists are.
+func updateManifest(ctx context.Context, client s3API, bucket, key, requestPayer string, r *retention, fn func(*manifest)) error {
+	var err error
+	for range manifestAttempts {
+		m, etag, rerr := readManifest(ctx, client, bucket, key, requestPayer)
+		if rerr != nil {
+			return rerr
+		}
+		fn(&m)
+		data, merr := json.Marshal(m)
+		if merr != nil {
+			return merr
+		}
+		input := &s3.PutObjectInput{
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(key),
+			Body:         bytes.NewReader(data),
+			ContentType:  aws.String("application/json"),
+			RequestPayer: types.RequestPayer(requestPayer),
+		}
+		if tagging, metadata := r.apply("", nil, time.Now()); tagging != "" {
+			input.Tagging = aws.String(tagging)
+			input.Metadata = metadata
+		}
+		if etag != "" {
+			input.IfMatch = aws.String(etag)
+		} else {
+			input.IfNoneMatch = aws.String("*")
+		}
+		_, err = client.PutObject(ctx, input)
+		if err == nil {
+			return nil
+		}
+		var apiErr smithy.APIError
+		if !errors.As(err, &apiErr) || (apiErr.ErrorCode() != "PreconditionFailed" && apiErr.ErrorCode() != "ConditionalRequestConflict") {
+			return fmt.Errorf("failed to write manifest %q: %v", key, err)
+		}
+	}
+	return fmt.Errorf("failed to write manifest %q after %d attempts: %v", key, manifestAttempts, err)
+}
+
+// readManifest downloads the manifest at key along with its ETag. A missing
+// manifest is returned empty, with no ETag.
+func readManifest(ctx context.Context, client s3API, bucket, key, requestPayer string) (manifest, string, error) {
+	var m manifest
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		RequestPayer: types.RequestPayer(requestPayer),
+	})
+	var noKey *types.NoSuchKey
+	if errors.As(err, &noKey) {
+		return m, "", nil
+	}
+	if err != nil {
+		return m, "", fmt.Errorf("failed to get manifest %q: %v", key, err)
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return m, "", fmt.Errorf("failed to read manifest %q: %v", key, err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, "", fmt.Errorf("invalid manifest %q: %v", key, err)
+	}
+	return m, aws.ToString(out.ETag), nil
+}
+
+// manifestObjects returns the objects the logger's manifest lists as
+// uploaded whose lines may fall between since and until, oldest first, and
+// whether there is a manifest to list them from.
+func (l *S3Logger) manifestObjects(ctx context.Context, since, until time.Time) ([]logObject, bool, error) {
+	key := l.manifestPath()
+	if key == "" {
+		return nil, false, nil
+	}
+	m, etag, err := readManifest(ctx, l.s3Client, l.bucket, key, l.opts.RequestPayer)
+	if err != nil || etag == "" {
+		return nil, false, err
+	}
+	var objects []logObject
+	for _, o := range m.Objects {
+		if o.Spooled || (!since.IsZero() && o.LastTimestamp.Before(since)) {
+			continue
+		}
+		if !until.IsZero() && o.FirstTimestamp.After(until) {
+			continue
+		}
+		objects = append(objects, logObject{key: o.Key, version: o.VersionID, time: o.LastTimestamp, seq: o.FirstSequence, size: o.Size})
+	}
+	return objects, true, nil
+}
@@ -0,0 +1,146 @@
+package s3log
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	mergeJSONLogKey = "merge-json-log"
+
+	// mergedKeyPrefix is prepended to the keys of a merged line that clash
+	// with a field of the record.
+	mergedKeyPrefix = "log_"
+)
+
+// envelopeFields are the fields of a record, which the keys of a merged
+// line can't take. log is among them although a merged record has none, so
+// that a line's own log key is told apart from the record's when decoding.
+// So are the fields of lines split for max-record-bytes or cut short, which
+// decoding would otherwise take for the record's.
+var envelopeFields = map[string]bool{
+	"log":              true,
+	"stream":           true,
+	"seq":              true,
+	"time":             true,
+	originalTimeKey:    true,
+	"record_id":        true,
+	"part":             true,
+	"total":            true,
+	"truncated":        true,
+	partialTimeoutAttr: true,
+	"container_id":     true,
+	"tag":              true,
+	"attrs":            true,
+}
+
+// clashes reports whether key, a key of a merged line, is a field of the
+// record, or one with log_ prefixes, so that prefixing keys that clash
+// can't make them clash with another key of the line.
+func clashes(key string) bool {
+	for {
+		if envelopeFields[key] {
+			return true
+		}
+		var ok bool
+		if key, ok = strings.CutPrefix(key, mergedKeyPrefix); !ok {
+			return false
+		}
+	}
+}
+
+// mergedKey returns the field a key of a merged line is written as: the key
+// itself, or prefixed with log_ if it clashes with a field of the record or
+// an attribute of the line.
+func mergedKey(key string, attrs []LogAttr) string {
+	if clashes(key) || slices.ContainsFunc(attrs, func(a LogAttr) bool { return a.Key == key }) {
+		return mergedKeyPrefix + key
+	}
+	return key
+}
+
+// jsonObject returns line without its leading whitespace if it is a JSON
+// object, such as an application logging JSON writes, or nil. Lines that
+// don't start with a brace are turned down without being parsed, and lines
+// that aren't valid UTF-8 are left to the log field, which escapes them.
+func jsonObject(line []byte) []byte {
+	line = bytes.TrimLeft(line, " \t")
+	if len(line) == 0 || line[0] != '{' || !utf8.Valid(line) || !json.Valid(line) {
+		return nil
+	}
+	return line
+}
+
+// appendMerged appends the top-level keys of obj, a JSON object, to dst as
+// fields of a record, each preceded by a comma, reporting whether obj could
+// be read. Values are compacted but otherwise written as they are, so
+// nested objects and arrays are kept whole.
+func appendMerged(dst, obj []byte, attrs []LogAttr) ([]byte, bool) {
+	dec := json.NewDecoder(bytes.NewReader(obj))
+	if _, err := dec.Token(); err != nil {
+		return dst, false
+	}
+	out := dst
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return dst, false
+		}
+		key, _ := tok.(string)
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return dst, false
+		}
+		out = append(out, ',')
+		out = appendJSONString(out, mergedKey(key, attrs))
+		out = append(out, ':')
+		buf := bytes.NewBuffer(out)
+		if err := json.Compact(buf, v); err != nil {
+			return dst, false
+		}
+		out = buf.Bytes()
+	}
+	return out, true
+}
+
+// unmerge returns the line of rec, a merged record, as the JSON object it
+// was logged as: the fields that aren't the record's, with the log_ prefix
+// taken off those that clashed with them. It reports false if rec has a log
+// field, and so wasn't merged.
+func unmerge(rec []byte) ([]byte, bool) {
+	dec := json.NewDecoder(bytes.NewReader(rec))
+	if _, err := dec.Token(); err != nil {
+		return nil, false
+	}
+	line := []byte{'{'}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		key, _ := tok.(string)
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return nil, false
+		}
+		if key == "log" {
+			return nil, false
+		}
+		if envelopeFields[key] {
+			continue
+		}
+		if field, ok := strings.CutPrefix(key, mergedKeyPrefix); ok && clashes(field) {
+			key = field
+		}
+		if len(line) > 1 {
+			line = append(line, ',')
+		}
+		line = appendJSONString(line, key)
+		line = append(line, ':')
+		line = append(line, v...)
+	}
+	return append(line, '}'), true
+}
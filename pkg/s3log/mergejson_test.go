@@ -0,0 +1,124 @@
+package s3log
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeJSONLog(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 30, 45, 0, time.UTC)
+	tests := []struct {
+		name  string
+		line  string
+		attrs []LogAttr
+		jsonl string
+		// decoded is the line docker logs gets back, without its newline.
+		decoded string
+	}{
+		{
+			name:    "object",
+			line:    `{"level":"info","msg":"started","port":8080}`,
+			jsonl:   `{"stream":"stdout","seq":3,"level":"info","msg":"started","port":8080,"container_id":"c1","tag":"web"}`,
+			decoded: `{"level":"info","msg":"started","port":8080}`,
+		},
+		{
+			// Nested values are kept whole, compacted.
+			name:    "nested",
+			line:    `  {"req": {"method": "GET", "path": "/"}, "tags": ["a", "b"], "n": null}`,
+			jsonl:   `{"stream":"stdout","seq":3,"req":{"method":"GET","path":"/"},"tags":["a","b"],"n":null,"container_id":"c1","tag":"web"}`,
+			decoded: `{"req":{"method":"GET","path":"/"},"tags":["a","b"],"n":null}`,
+		},
+		{
+			name:    "conflicting keys",
+			line:    `{"time":"yesterday","log":"inner","stream":"app","log_time":"x","tag":"v1"}`,
+			jsonl:   `{"stream":"stdout","seq":3,"log_time":"yesterday","log_log":"inner","log_stream":"app","log_log_time":"x","log_tag":"v1","container_id":"c1","tag":"web"}`,
+			decoded: `{"time":"yesterday","log":"inner","stream":"app","log_time":"x","tag":"v1"}`,
+		},
+		{
+			// The fields of records split for max-record-bytes, and of
+			// partials cut short, are the record's too.
+			name:    "split record fields",
+			line:    `{"record_id":"r","part":2,"total":3,"truncated":"no","partial_timeout":true}`,
+			jsonl:   `{"stream":"stdout","seq":3,"log_record_id":"r","log_part":2,"log_total":3,"log_truncated":"no","log_partial_timeout":true,"container_id":"c1","tag":"web"}`,
+			decoded: `{"record_id":"r","part":2,"total":3,"truncated":"no","partial_timeout":true}`,
+		},
+		{
+			// A restamped line keeps its own original_time.
+			name:    "restamped",
+			line:    `{"original_time":"x","msg":"y"}`,
+			attrs:   []LogAttr{{Key: originalTimeKey, Value: "2024-05-01T12:00:00Z"}},
+			jsonl:   `{"stream":"stdout","seq":3,"original_time":"2024-05-01T12:00:00Z","log_original_time":"x","msg":"y","container_id":"c1","tag":"web"}`,
+			decoded: `{"original_time":"x","msg":"y"}`,
+		},
+		{
+			name:    "bare array",
+			line:    `["a","b"]`,
+			jsonl:   `{"log":"[\"a\",\"b\"]","stream":"stdout","seq":3,"container_id":"c1","tag":"web"}`,
+			decoded: `["a","b"]`,
+		},
+		{
+			name:    "malformed",
+			line:    `{"msg":"cut short`,
+			jsonl:   `{"log":"{\"msg\":\"cut short","stream":"stdout","seq":3,"container_id":"c1","tag":"web"}`,
+			decoded: `{"msg":"cut short`,
+		},
+		{
+			name:    "trailing text",
+			line:    `{"msg":"a"} and more`,
+			jsonl:   `{"log":"{\"msg\":\"a\"} and more","stream":"stdout","seq":3,"container_id":"c1","tag":"web"}`,
+			decoded: `{"msg":"a"} and more`,
+		},
+		{
+			// Invalid UTF-8 is left to the log field, which escapes it.
+			name:    "invalid UTF-8",
+			line:    "{\"msg\":\"\xff\"}",
+			jsonl:   `{"log":"{\"msg\":\"\ufffd\"}","stream":"stdout","seq":3,"container_id":"c1","tag":"web"}`,
+			decoded: `{"msg":"�"}`,
+		},
+		{
+			name:    "not JSON",
+			line:    "plain text",
+			jsonl:   `{"log":"plain text","stream":"stdout","seq":3,"container_id":"c1","tag":"web"}`,
+			decoded: "plain text",
+		},
+	}
+	opts := DefaultOptions()
+	opts.Format, opts.TimestampFormat, opts.MergeJSONLog = formatJSONL, timestampNone, true
+	f, err := newLineFormat(opts, "c1", "web", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &Message{Line: []byte(tt.line), Source: "stdout", Timestamp: ts, Attrs: tt.attrs}
+			got := f.encode(nil, msg, 3)
+			if string(got) != tt.jsonl+"\n" {
+				t.Errorf("encoded\n%s\nwant\n%s", got, tt.jsonl)
+			}
+			dec := f.decode(got[:len(got)-1], ts)
+			if string(dec.Line) != tt.decoded+"\n" || dec.Source != "stdout" || dec.PLogMetaData != nil {
+				t.Errorf("decoded %q from %s, partial %+v, want %q", dec.Line, dec.Source, dec.PLogMetaData, tt.decoded+"\n")
+			}
+		})
+	}
+}
+
+func TestJSONObject(t *testing.T) {
+	for line, want := range map[string]bool{
+		`{}`:               true,
+		` {"a":1}`:         true,
+		"\t{\"a\":1}":      true,
+		`{"a":1}   `:       true,
+		`[1]`:              false,
+		`"{}"`:             false,
+		`{"a":1`:           false,
+		`{"a":1}{}`:        false,
+		`x{"a":1}`:         false,
+		"{\"a\":\"\xff\"}": false,
+		``:                 false,
+	} {
+		if got := jsonObject([]byte(line)) != nil; got != want {
+			t.Errorf("jsonObject(%q) is an object: %v, want %v", line, got, want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package s3log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// The types a logger is driven with mirror those of the Docker daemon's
+// logger package, field for field, so that the plugin converts between them
+// without copying, while the package itself doesn't depend on the daemon.
+
+// Message is a line logged by a container. Line may be reused by the caller
+// once Log returns, so the logger copies whatever it keeps of it.
+type Message struct {
+	Line         []byte
+	Source       string
+	Timestamp    time.Time
+	Attrs        []LogAttr
+	PLogMetaData *PartialLogMetaData
+
+	// Err is an error reading the message back, which may leave the rest
+	// of it incomplete.
+	Err error
+}
+
+// LogAttr is an extra attribute of a message.
+type LogAttr struct {
+	Key   string
+	Value string
+}
+
+// PartialLogMetaData marks a message as one of the pieces of a line too long
+// to be logged at once: the Ordinal'th of the line ID, the Last of which
+// ends it.
+type PartialLogMetaData struct {
+	Last    bool
+	ID      string
+	Ordinal int
+}
+
+// Info describes the container a logger is for. Config holds its log-opts.
+type Info struct {
+	Config              map[string]string
+	ContainerID         string
+	ContainerName       string
+	ContainerEntrypoint string
+	ContainerArgs       []string
+	ContainerImageID    string
+	ContainerImageName  string
+	ContainerCreated    time.Time
+	ContainerEnv        []string
+	ContainerLabels     map[string]string
+	LogPath             string
+	DaemonName          string
+}
+
+// ExtraAttributes returns the labels and environment variables the labels,
+// labels-regex, env and env-regex log-opts pick, with their keys passed
+// through keyMod if it isn't nil.
+func (info *Info) ExtraAttributes(keyMod func(string) string) (map[string]string, error) {
+	extra := make(map[string]string)
+	add := func(k, v string) {
+		if keyMod != nil {
+			k = keyMod(k)
+		}
+		extra[k] = v
+	}
+	if labels := info.Config["labels"]; labels != "" {
+		for _, k := range strings.Split(labels, ",") {
+			if v, ok := info.ContainerLabels[k]; ok {
+				add(k, v)
+			}
+		}
+	}
+	if expr := info.Config["labels-regex"]; expr != "" {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range info.ContainerLabels {
+			if re.MatchString(k) {
+				add(k, v)
+			}
+		}
+	}
+	env := make(map[string]string)
+	for _, e := range info.ContainerEnv {
+		if k, v, ok := strings.Cut(e, "="); ok {
+			env[k] = v
+		}
+	}
+	if keys := info.Config["env"]; keys != "" {
+		for _, k := range strings.Split(keys, ",") {
+			if v, ok := env[k]; ok {
+				add(k, v)
+			}
+		}
+	}
+	if expr := info.Config["env-regex"]; expr != "" {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range env {
+			if re.MatchString(k) {
+				add(k, v)
+			}
+		}
+	}
+	return extra, nil
+}
+
+// Hostname returns the host's name.
+func (info *Info) Hostname() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("can not resolve hostname: %v", err)
+	}
+	return hostname, nil
+}
+
+// Command returns the container's entrypoint followed by its arguments.
+func (info *Info) Command() string {
+	return strings.Join(append([]string{info.ContainerEntrypoint}, info.ContainerArgs...), " ")
+}
+
+// ID returns the container ID shortened to 12 characters.
+func (info *Info) ID() string {
+	return info.ContainerID[:12]
+}
+
+// FullID returns the container ID.
+func (info *Info) FullID() string {
+	return info.ContainerID
+}
+
+// Name returns the container name without its leading slash.
+func (info *Info) Name() string {
+	return strings.TrimPrefix(info.ContainerName, "/")
+}
+
+// ImageID returns the image ID shortened to 12 characters.
+func (info *Info) ImageID() string {
+	return info.ContainerImageID[:12]
+}
+
+// ImageFullID returns the image ID.
+func (info *Info) ImageFullID() string {
+	return info.ContainerImageID
+}
+
+// ImageName returns the name of the container's image.
+func (info *Info) ImageName() string {
+	return info.ContainerImageName
+}
+
+// defaultTagTemplate is the tag of a container without a tag log-opt.
+const defaultTagTemplate = "{{.ID}}"
+
+// tagFuncs are the functions a tag template can call, as in Docker's.
+var tagFuncs = template.FuncMap{
+	"json": func(v any) string {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(v)
+		return strings.TrimSpace(buf.String())
+	},
+	"split": strings.Split,
+	"join":  strings.Join,
+	//nolint:staticcheck // as Docker's, for templates written for it
+	"title": strings.Title,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"pad": func(s string, prefix, suffix int) string {
+		if s == "" {
+			return s
+		}
+		return strings.Repeat(" ", prefix) + s + strings.Repeat(" ", suffix)
+	},
+	"truncate": func(s string, n int) string {
+		if len(s) < n {
+			return s
+		}
+		return s[:n]
+	},
+}
+
+// parseLogTag renders the container's tag log-opt, or defaultTemplate
+// without one, the way Docker's own drivers do.
+func parseLogTag(info Info, defaultTemplate string) (string, error) {
+	text := info.Config["tag"]
+	if text == "" {
+		text = defaultTemplate
+	}
+	tmpl, err := template.New("log-tag").Funcs(tagFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &info); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ReadConfig is what a read of a container's logs asks for.
+type ReadConfig struct {
+	Since  time.Time
+	Until  time.Time
+	Tail   int
+	Follow bool
+}
+
+// logWatcherBufferSize is how many messages a LogWatcher holds for its
+// consumer.
+const logWatcherBufferSize = 4096
+
+// LogWatcher carries the messages of a read to its consumer, which calls
+// ConsumerGone once it stops reading. The reader closes Msg once it has sent
+// every message, or sends an error to Err instead.
+type LogWatcher struct {
+	Msg chan *Message
+	Err chan error
+
+	consumerOnce sync.Once
+	consumerGone chan struct{}
+}
+
+func NewLogWatcher() *LogWatcher {
+	return &LogWatcher{
+		Msg:          make(chan *Message, logWatcherBufferSize),
+		Err:          make(chan error, 1),
+		consumerGone: make(chan struct{}),
+	}
+}
+
+// ConsumerGone tells the reader that the consumer has stopped reading.
+func (w *LogWatcher) ConsumerGone() {
+	w.consumerOnce.Do(func() { close(w.consumerGone) })
+}
+
+// WatchConsumerGone returns a channel closed once the consumer has stopped
+// reading.
+func (w *LogWatcher) WatchConsumerGone() <-chan struct{} {
+	return w.consumerGone
+}
+
+// containerLogger is a logger of a container's lines: an S3Logger, or a
+// splitLogger with one for each stream.
+type containerLogger interface {
+	Log(*Message) error
+	Name() string
+	Close() error
+}
+
+// logReader is a containerLogger, or a cache, that reads the container's
+// logs back.
+type logReader interface {
+	ReadLogs(ReadConfig) *LogWatcher
+}
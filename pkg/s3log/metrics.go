@@ -0,0 +1,233 @@
+package s3log
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const metricsAddrKey = "metrics-addr"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	linesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "lines_received_total",
+		Help:      "Lines logged by the container.",
+	}, []string{"container_id"})
+	linesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "lines_dropped_total",
+		Help:      "Lines dropped because the buffer was full in non-blocking mode.",
+	}, []string{"container_id"})
+	linesFiltered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "lines_filtered_total",
+		Help:      "Lines dropped by filter-include or filter-exclude.",
+	}, []string{"container_id"})
+	linesSampled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "lines_sampled_total",
+		Help:      "Lines dropped by sample-rate.",
+	}, []string{"container_id"})
+	linesSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "lines_skipped_total",
+		Help:      "Blank lines dropped by skip-empty.",
+	}, []string{"container_id"})
+	linesStripped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "lines_ansi_stripped_total",
+		Help:      "Lines whose ANSI escape sequences strip-ansi removed.",
+	}, []string{"container_id"})
+	deadLettered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "dead_letter_records_total",
+		Help:      "Lines written to the dead-letter objects.",
+	}, []string{"container_id"})
+	deadSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "dead_letter_suppressed_total",
+		Help:      "Dead-letter records only counted because dead-letter-max-bytes was reached.",
+	}, []string{"container_id"})
+	bufferedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: driverName,
+		Name:      "buffered_bytes",
+		Help:      "Bytes buffered and waiting to be uploaded.",
+	}, []string{"container_id"})
+	bytesUploaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "uploaded_bytes_total",
+		Help:      "Bytes uploaded to S3, after compression.",
+	}, []string{"container_id", "bucket"})
+	linesUploaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "uploaded_lines_total",
+		Help:      "Lines uploaded to S3, not counting those uploaded from the spool.",
+	}, []string{"container_id", "bucket"})
+	uploadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "upload_errors_total",
+		Help:      "Upload attempts that failed.",
+	}, []string{"container_id", "bucket"})
+	uploadRetryCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "upload_retries_total",
+		Help:      "Failed uploads that were retried.",
+	}, []string{"container_id", "bucket"})
+	batchesSpooled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "spooled_batches_total",
+		Help:      "Batches written to the spool after their upload failed.",
+	}, []string{"container_id", "bucket"})
+	batchesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "failed_batches_total",
+		Help:      "Batches dropped after their upload failed.",
+	}, []string{"container_id", "bucket"})
+	flushesThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "throttled_flushes_total",
+		Help:      "Flushes delayed by max-puts-per-second or max-puts-per-second-per-container.",
+	}, []string{"container_id"})
+	linesDeduplicated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "deduplicated_lines_total",
+		Help:      "Lines replaced by a duplicate record for repeating lines uploaded within dedupe-window.",
+	}, []string{"container_id"})
+	bytesDeduplicated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "deduplicated_bytes_total",
+		Help:      "Bytes of lines not uploaded for dedupe-window, less those of the duplicate records replacing them, before compression.",
+	}, []string{"container_id"})
+
+	spoolBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: driverName,
+		Name:      "spool_bytes",
+		Help:      "Bytes held in the spool directories.",
+	})
+	spoolUploaded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "spool_uploaded_bytes_total",
+		Help:      "Bytes uploaded from the spool.",
+	})
+	spoolEvicted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: driverName,
+		Name:      "spool_evicted_batches_total",
+		Help:      "Spooled batches evicted because the spool was full.",
+	})
+
+	containerVecs = []*prometheus.MetricVec{
+		linesReceived.MetricVec,
+		linesDropped.MetricVec,
+		linesFiltered.MetricVec,
+		linesSampled.MetricVec,
+		linesSkipped.MetricVec,
+		linesStripped.MetricVec,
+		deadLettered.MetricVec,
+		deadSuppressed.MetricVec,
+		bufferedBytes.MetricVec,
+		bytesUploaded.MetricVec,
+		linesUploaded.MetricVec,
+		uploadErrors.MetricVec,
+		uploadRetryCount.MetricVec,
+		batchesSpooled.MetricVec,
+		batchesFailed.MetricVec,
+		flushesThrottled.MetricVec,
+		linesDeduplicated.MetricVec,
+		bytesDeduplicated.MetricVec,
+	}
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		linesReceived, linesDropped, linesFiltered, linesSampled, linesSkipped, linesStripped, deadLettered, deadSuppressed, bufferedBytes, bytesUploaded, linesUploaded, uploadErrors,
+		uploadRetryCount, batchesSpooled, batchesFailed, flushesThrottled, linesDeduplicated, bytesDeduplicated,
+		spoolBytes, spoolUploaded, spoolEvicted,
+	)
+}
+
+// containerMetrics holds a container's series so that the hot path doesn't
+// look them up by label on every line.
+type containerMetrics struct {
+	id             string
+	received       prometheus.Counter
+	dropped        prometheus.Counter
+	filtered       prometheus.Counter
+	sampled        prometheus.Counter
+	skipped        prometheus.Counter
+	stripped       prometheus.Counter
+	deadLettered   prometheus.Counter
+	deadSuppressed prometheus.Counter
+	buffered       prometheus.Gauge
+	throttled      prometheus.Counter
+	deduplicated   prometheus.Counter
+	dedupedBytes   prometheus.Counter
+}
+
+// targetMetrics holds a container's series for one of its buckets.
+type targetMetrics struct {
+	uploaded prometheus.Counter
+	lines    prometheus.Counter
+	errors   prometheus.Counter
+	retries  prometheus.Counter
+	spooled  prometheus.Counter
+	failed   prometheus.Counter
+}
+
+func newContainerMetrics(id string) *containerMetrics {
+	return &containerMetrics{
+		id:             id,
+		received:       linesReceived.WithLabelValues(id),
+		dropped:        linesDropped.WithLabelValues(id),
+		filtered:       linesFiltered.WithLabelValues(id),
+		sampled:        linesSampled.WithLabelValues(id),
+		skipped:        linesSkipped.WithLabelValues(id),
+		stripped:       linesStripped.WithLabelValues(id),
+		deadLettered:   deadLettered.WithLabelValues(id),
+		deadSuppressed: deadSuppressed.WithLabelValues(id),
+		buffered:       bufferedBytes.WithLabelValues(id),
+		throttled:      flushesThrottled.WithLabelValues(id),
+		deduplicated:   linesDeduplicated.WithLabelValues(id),
+		dedupedBytes:   bytesDeduplicated.WithLabelValues(id),
+	}
+}
+
+func (m *containerMetrics) target(bucket string) *targetMetrics {
+	return &targetMetrics{
+		uploaded: bytesUploaded.WithLabelValues(m.id, bucket),
+		lines:    linesUploaded.WithLabelValues(m.id, bucket),
+		errors:   uploadErrors.WithLabelValues(m.id, bucket),
+		retries:  uploadRetryCount.WithLabelValues(m.id, bucket),
+		spooled:  batchesSpooled.WithLabelValues(m.id, bucket),
+		failed:   batchesFailed.WithLabelValues(m.id, bucket),
+	}
+}
+
+// unregister removes the container's series so that stopped containers don't
+// accumulate.
+func (m *containerMetrics) unregister() {
+	for _, vec := range containerVecs {
+		vec.DeletePartialMatch(prometheus.Labels{"container_id": m.id})
+	}
+}
+
+// serveMetrics serves the Prometheus metrics on addr until the server it
+// returns is shut down.
+func serveMetrics(addr string, ready *readiness) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.Handle("/healthz", ready)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	logrus.WithField("addr", addr).Info("serving metrics")
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithField("addr", addr).WithError(err).Error("error serving metrics")
+		}
+	}()
+	return srv
+}
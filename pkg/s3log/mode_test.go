@@ -0,0 +1,120 @@
+package s3log
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamModeOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        map[string]string
+		wantStdout string
+		wantStderr string
+	}{
+		{name: "defaults", wantStdout: modeBlocking, wantStderr: modeBlocking},
+		{name: "stdout follows mode", cfg: map[string]string{modeKey: modeNonBlocking}, wantStdout: modeNonBlocking, wantStderr: modeBlocking},
+		{name: "stderr too", cfg: map[string]string{modeKey: modeNonBlocking, stderrModeKey: modeNonBlocking}, wantStdout: modeNonBlocking, wantStderr: modeNonBlocking},
+		{name: "stdout overrides mode", cfg: map[string]string{modeKey: modeNonBlocking, stdoutModeKey: modeBlocking, stderrModeKey: modeNonBlocking}, wantStdout: modeBlocking, wantStderr: modeNonBlocking},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseLogOpts(DefaultOptions(), testLogOpts(t, tt.cfg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.StdoutMode != tt.wantStdout || opts.StderrMode != tt.wantStderr {
+				t.Errorf("stdout %s and stderr %s, want %s and %s", opts.StdoutMode, opts.StderrMode, tt.wantStdout, tt.wantStderr)
+			}
+			opts.SplitStreams = true
+			for i, so := range streamOptions(opts) {
+				want := []string{tt.wantStdout, tt.wantStderr}[i]
+				if so.Mode != want || so.StdoutMode != want || so.StderrMode != want {
+					t.Errorf("%s logger in mode %s (stdout %s, stderr %s), want %s", so.stream, so.Mode, so.StdoutMode, so.StderrMode, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamModeOneFull(t *testing.T) {
+	// While uploads hang the non-blocking stream keeps being accepted,
+	// dropping lines, and the blocking stream's lines logged among them are
+	// all kept.
+	const (
+		flowing = 200
+		kept    = 5
+	)
+	line := strings.Repeat("x", 100)
+	tests := []struct {
+		name     string
+		cfg      map[string]string
+		blocking string // the stream that is never dropped
+	}{
+		{name: "stderr blocking", cfg: map[string]string{stdoutModeKey: modeNonBlocking}, blocking: "stderr"},
+		{name: "stdout blocking", cfg: map[string]string{stderrModeKey: modeNonBlocking}, blocking: "stdout"},
+		{name: "split streams", cfg: map[string]string{stdoutModeKey: modeNonBlocking, splitStreamsKey: "true"}, blocking: "stderr"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := map[string]string{"stdout": "stderr", "stderr": "stdout"}[tt.blocking]
+			fake := newFakeS3()
+			release := stallPuts(fake, "")
+			defer release()
+			tt.cfg[maxBufferSizeKey], tt.cfg[flushBytesKey], tt.cfg[flushIntervalKey] = "4096", "2048", "1h"
+			d := newTestDriver(t, fake, nil)
+			c := startContainer(t, d, tt.cfg)
+			lf, err := d.lookup(c.info.ContainerID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, _ := lf.logger()
+
+			logged := make(chan struct{})
+			go func() {
+				defer close(logged)
+				log := func(stream string, i int) {
+					l.Log(&Message{Line: []byte(fmt.Sprintf("%s %03d %s", stream, i, line)), Source: stream, Timestamp: time.Now()})
+				}
+				for i := range flowing {
+					log(other, i)
+				}
+				for i := range kept {
+					log(tt.blocking, i)
+				}
+				for i := range flowing {
+					log(other, flowing+i)
+				}
+			}()
+			select {
+			case <-logged:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Log blocked with uploads hanging")
+			}
+			release()
+			c.stop(t, d)
+
+			got := map[string][]string{}
+			var gaps int
+			for _, rec := range containerRecords(t, fake, c.info.ContainerID) {
+				if rec.Log == "" {
+					gaps++
+					continue
+				}
+				got[rec.Stream] = append(got[rec.Stream], rec.Log[:len(tt.blocking)+4])
+			}
+			var want []string
+			for i := range kept {
+				want = append(want, fmt.Sprintf("%s %03d", tt.blocking, i))
+			}
+			if strings.Join(got[tt.blocking], ",") != strings.Join(want, ",") {
+				t.Errorf("uploaded %s lines %q, want all %d in order", tt.blocking, got[tt.blocking], kept)
+			}
+			if n := len(got[other]); n == 0 || n == 2*flowing || gaps == 0 {
+				t.Errorf("uploaded %d of %d %s lines with %d gaps, want some dropped and the gap marked", n, 2*flowing, other, gaps)
+			}
+		})
+	}
+}
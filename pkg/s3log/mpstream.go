@@ -0,0 +1,557 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	writeModeKey            = "write-mode"
+	multipartWindowKey      = "multipart-window"
+	abortIncompleteAfterKey = "abort-incomplete-after"
+
+	writeModeObject          = "object"
+	writeModeMultipartStream = "multipart-stream"
+
+	defaultMultipartWindow      = time.Hour
+	defaultAbortIncompleteAfter = 24 * time.Hour
+
+	// maxUploadParts is the most parts S3 takes in a multipart upload.
+	maxUploadParts = 10000
+)
+
+var multipartStreams = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: driverName,
+	Name:      "multipart_stream_uploads_total",
+	Help:      "Multipart uploads of write-mode=multipart-stream, by result: completed, recovered, aborted or failed.",
+}, []string{"result"})
+
+func init() {
+	metricsRegistry.MustRegister(multipartStreams)
+	streaming := func(s permissionScope) bool { return s.opts.WriteMode == writeModeMultipartStream }
+	feature := writeModeKey + "=" + writeModeMultipartStream
+	requirePermissions(
+		permission{"s3:AbortMultipartUpload", onObjects, feature, streaming},
+		permission{"s3:ListMultipartUploadParts", onObjects, feature, streaming},
+		permission{"s3:ListBucketMultipartUploads", onBucket, abortIncompleteAfterKey, func(s permissionScope) bool {
+			return streaming(s) && s.opts.AbortIncompleteAfter > 0
+		}},
+		permission{"kms:Decrypt", onKMSKey, feature, func(s permissionScope) bool { return streaming(s) && s.opts.SSEKMSKeyID != "" }},
+	)
+}
+
+// streamState is a multipart upload of write-mode=multipart-stream,
+// persisted with the logger's state so that a restarted plugin completes it.
+type streamState struct {
+	Bucket    string       `json:"bucket"`
+	Key       string       `json:"key"`
+	UploadID  string       `json:"upload_id"`
+	Window    time.Time    `json:"window"`
+	Partition string       `json:"partition,omitempty"`
+	Parts     []streamPart `json:"parts,omitempty"`
+	Size      int64        `json:"size"`
+	Lines     int          `json:"lines"`
+	FirstSeq  int64        `json:"first_seq"`
+	First     time.Time    `json:"first"`
+	Last      time.Time    `json:"last"`
+}
+
+type streamPart struct {
+	Number int32  `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// multipartStream is the object of the current window of a multipart-stream
+// logger, which each flush adds to. Flushes are coalesced, compressed one by
+// one as members of a gzip or frames of a zstd stream, until upload-part-size
+// of them is pending, as every part but the last must be at least 5MiB. The
+// object is completed when a flush starts the next window or partition, when
+// a window passes without one, and when the container stops. It is guarded
+// by the logger's flushMu.
+type multipartStream struct {
+	window    time.Time // start of the object's window, zero before its first line
+	partition string
+	touched   time.Time // when a flush last added to the object
+
+	pending  []byte // lines not yet uploaded in a part
+	raw      int    // bytes of pending before compression
+	lines    int
+	firstSeq int64
+	first    time.Time
+	last     time.Time
+}
+
+// streaming reports whether the logger writes an object per window in parts.
+func (l *S3Logger) streaming() bool {
+	return l.opts.WriteMode == writeModeMultipartStream
+}
+
+// streamBatch adds sb to the object of its window, completing the object of
+// the last window first if sb is past it, and uploads a part once enough is
+// pending. Callers must hold l.flushMu.
+func (l *S3Logger) streamBatch(ctx context.Context, sb sealedBatch) error {
+	if l.stream == nil {
+		l.stream = &multipartStream{}
+	}
+	s := l.stream
+	window := sb.time.Truncate(l.opts.MultipartWindow)
+	var err error
+	if !s.window.IsZero() && (!s.window.Equal(window) || s.partition != sb.partition) {
+		err = l.finishStream(ctx)
+	}
+	if s.window.IsZero() {
+		s.window, s.partition = window, sb.partition
+	}
+	body := sb.data
+	if codec := l.opts.Compress; codec != compressNone {
+		var cerr error
+		if body, cerr = compressBytes(codec, l.opts.CompressLevel, body); cerr != nil {
+			return fmt.Errorf("failed to compress logs: %v", cerr)
+		}
+	}
+	if s.lines == 0 {
+		s.firstSeq, s.first = sb.firstSeq, sb.time
+	}
+	s.pending = append(s.pending, body...)
+	s.raw += len(sb.data)
+	s.lines += bytes.Count(sb.data, []byte{'\n'})
+	s.last = sb.last
+	s.touched = time.Now()
+	if int64(len(s.pending)) >= l.opts.PartSize {
+		if perr := l.uploadPart(ctx); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// streamPending reports whether lines are waiting to be uploaded in a part,
+// and so mustn't be released from the journal. Callers must hold l.flushMu.
+func (l *S3Logger) streamPending() bool {
+	return l.stream != nil && l.stream.lines > 0
+}
+
+// idleStream completes the object of a window that has passed, by the
+// clock as well as by its lines, without a flush adding to it, so that lines
+// stamped behind the clock don't complete an object per flush. Callers must
+// hold l.flushMu.
+func (l *S3Logger) idleStream(ctx context.Context, now time.Time) error {
+	s := l.stream
+	if s == nil || s.window.IsZero() {
+		return nil
+	}
+	window := now.Truncate(l.opts.MultipartWindow)
+	if window.Equal(s.window) || window.Equal(s.touched.Truncate(l.opts.MultipartWindow)) {
+		return nil
+	}
+	err := l.finishStream(ctx)
+	if serr := l.saveState(); serr != nil {
+		l.log().WithError(serr).Warn("error saving logger state")
+	}
+	return err
+}
+
+// finishStream uploads what is pending as the last part of the object and
+// completes it. Lines whose part fails to upload are kept for the next
+// object. Callers must hold l.flushMu.
+func (l *S3Logger) finishStream(ctx context.Context) error {
+	var err error
+	if l.stream.lines > 0 {
+		err = l.uploadPart(ctx)
+	}
+	if st := l.state.Stream; st != nil {
+		l.state.Stream = nil
+		if cerr := l.completeUpload(ctx, st, nil); cerr != nil {
+			l.state.Unfinished = append(l.state.Unfinished, *st)
+			if err == nil {
+				err = cerr
+			}
+		}
+	}
+	l.stream.window = time.Time{}
+	return err
+}
+
+// closeStream completes the object of a stopping logger, dropping the lines
+// of a last part that fails to upload.
+func (l *S3Logger) closeStream(ctx context.Context) error {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+	if l.stream == nil {
+		return nil
+	}
+	err := l.finishStream(ctx)
+	if s := l.stream; s.lines > 0 {
+		l.metrics.dropped.Add(float64(s.lines))
+		l.log().WithField("lines", s.lines).Error("dropped the last lines of the multipart object, their part failed to upload")
+		*s = multipartStream{}
+	}
+	if serr := l.saveState(); serr != nil {
+		l.log().WithError(serr).Warn("error saving logger state")
+	}
+	return err
+}
+
+// uploadPart uploads the pending lines as the next part of the object,
+// starting its multipart upload if this is its first part. A part that fails
+// after its retries stays pending, to be uploaded with the next flush,
+// unless that would hold more than the logger may buffer, when its lines are
+// dropped. Callers must hold l.flushMu.
+func (l *S3Logger) uploadPart(ctx context.Context) error {
+	s := l.stream
+	st := l.state.Stream
+	var err error
+	if st == nil {
+		if st, err = l.createUpload(ctx); err != nil {
+			return l.partFailed(err)
+		}
+		l.state.Stream = st
+	}
+	number := int32(len(st.Parts) + 1)
+	body := s.pending
+	log := l.log().WithField("key", st.Key).WithField("part", number)
+	var out *s3.UploadPartOutput
+	err = retry(ctx, l.opts.MaxRetries, l.opts.MaxRetryDelay, func() error {
+		err := l.pool.upload(ctx, l.bucket, l.opts.S3RequestTimeout, func(ctx context.Context) error {
+			input := &s3.UploadPartInput{
+				Bucket:        aws.String(st.Bucket),
+				Key:           aws.String(st.Key),
+				UploadId:      aws.String(st.UploadID),
+				PartNumber:    aws.Int32(number),
+				Body:          bytes.NewReader(body),
+				ContentLength: aws.Int64(int64(len(body))),
+				RequestPayer:  types.RequestPayer(l.opts.RequestPayer),
+			}
+			l.ssec.set(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+			var err error
+			out, err = l.s3Client.UploadPart(ctx, input)
+			return err
+		})
+		if err != nil && !errors.Is(err, errBreakerOpen) {
+			l.targets[0].metrics.errors.Inc()
+			s3Failed(log, st.Bucket, err).Warn("error uploading part")
+		}
+		return err
+	})
+	if err != nil {
+		return l.partFailed(err)
+	}
+	st.Parts = append(st.Parts, streamPart{Number: number, ETag: aws.ToString(out.ETag)})
+	st.Size += int64(len(body))
+	if st.Lines == 0 {
+		st.FirstSeq, st.First = s.firstSeq, s.first
+	}
+	st.Lines += s.lines
+	st.Last = s.last
+	t := l.targets[0]
+	t.metrics.uploaded.Add(float64(len(body)))
+	t.metrics.lines.Add(float64(s.lines))
+	l.countObject(s.raw, len(body), s.partition)
+	log.WithField("bytes", len(body)).Debug("uploaded part")
+	// A failed attempt's request may still be reading the body, so it isn't
+	// reused.
+	s.pending, s.raw, s.lines = nil, 0, 0
+
+	if len(st.Parts) >= maxUploadParts {
+		l.state.Stream = nil
+		if err := l.completeUpload(ctx, st, nil); err != nil {
+			l.state.Unfinished = append(l.state.Unfinished, *st)
+			return err
+		}
+	}
+	return nil
+}
+
+// partFailed keeps the pending lines of a part that failed to upload for the
+// next, or drops them once they outgrow the logger's buffer, returning err.
+func (l *S3Logger) partFailed(err error) error {
+	s := l.stream
+	if len(s.pending) <= max(l.opts.MaxBufferSize, 2*int(l.opts.PartSize)) {
+		return err
+	}
+	l.metrics.dropped.Add(float64(s.lines))
+	l.noteGap(gapUploadFailed, int64(s.lines), s.firstSeq-1, s.firstSeq+int64(s.lines))
+	l.log().WithField("lines", s.lines).WithError(err).Error("dropped lines whose part failed to upload")
+	s.pending, s.raw, s.lines = nil, 0, 0
+	return err
+}
+
+// createUpload starts the multipart upload of the object of the current
+// window, named by the key template as a single object stamped with the
+// start of the window would be. Uploads left unfinished are completed first.
+func (l *S3Logger) createUpload(ctx context.Context) (*streamState, error) {
+	l.recoverUploads(ctx)
+	s := l.stream
+	data := l.keyData
+	data.Sequence = fmt.Sprintf(sequenceFormat, l.nextSequence(ctx))
+	data.FirstSeq = fmt.Sprintf(lineSequenceFormat, s.firstSeq)
+	data.TimeSlice, data.Index = l.nextIndex(ctx, s.partition, s.window)
+	key, err := renderKey(l.keyTmpl, data, s.window)
+	if err != nil {
+		l.log().WithError(err).Warnf("error rendering %s, falling back to %q", keyTemplateKey, key)
+	}
+	key = withUniqueSuffix(key, l.uniqueSuffix(time.Now()))
+	b, err := l.newBatch(l.opts.S3Prefix+s.partition+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(l.bucket),
+		Key:          aws.String(b.Key),
+		RequestPayer: types.RequestPayer(b.RequestPayer),
+	}
+	if b.ContentType != "" {
+		input.ContentType = aws.String(b.ContentType)
+	}
+	if b.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(b.ContentEncoding)
+	}
+	if b.Tagging != "" {
+		input.Tagging = aws.String(b.Tagging)
+	}
+	if len(b.Metadata) > 0 {
+		input.Metadata = b.Metadata
+	}
+	if b.SSE != "" {
+		input.ServerSideEncryption = types.ServerSideEncryption(b.SSE)
+	}
+	if b.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(b.SSEKMSKeyID)
+	}
+	l.ssec.set(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	if b.StorageClass != "" {
+		input.StorageClass = types.StorageClass(b.StorageClass)
+	}
+	if b.ACL != "" {
+		input.ACL = types.ObjectCannedACL(b.ACL)
+	}
+	var out *s3.CreateMultipartUploadOutput
+	err = retry(ctx, l.opts.MaxRetries, l.opts.MaxRetryDelay, func() error {
+		err := l.pool.upload(ctx, l.bucket, l.opts.S3RequestTimeout, func(ctx context.Context) error {
+			var err error
+			out, err = l.s3Client.CreateMultipartUpload(ctx, input)
+			return err
+		})
+		if err != nil && !errors.Is(err, errBreakerOpen) {
+			s3Failed(l.log().WithField("key", b.Key), l.bucket, err).Warn("error starting multipart upload")
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	l.log().WithField("key", b.Key).Debug("started multipart upload")
+	return &streamState{
+		Bucket:    l.bucket,
+		Key:       b.Key,
+		UploadID:  aws.ToString(out.UploadId),
+		Window:    s.window,
+		Partition: s.partition,
+	}, nil
+}
+
+// completeUpload completes st with parts, or the parts recorded in it if
+// nil. An upload without parts is aborted instead.
+func (l *S3Logger) completeUpload(ctx context.Context, st *streamState, parts []types.CompletedPart) error {
+	if parts == nil {
+		for _, p := range st.Parts {
+			parts = append(parts, types.CompletedPart{PartNumber: aws.Int32(p.Number), ETag: aws.String(p.ETag)})
+		}
+	}
+	log := l.log().WithField("key", st.Key)
+	if len(parts) == 0 {
+		return l.abortUpload(ctx, st.Bucket, st.Key, st.UploadID)
+	}
+	sort.Slice(parts, func(i, j int) bool { return aws.ToInt32(parts[i].PartNumber) < aws.ToInt32(parts[j].PartNumber) })
+	input := &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(st.Bucket),
+		Key:             aws.String(st.Key),
+		UploadId:        aws.String(st.UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		RequestPayer:    types.RequestPayer(l.opts.RequestPayer),
+	}
+	l.ssec.set(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	var out *s3.CompleteMultipartUploadOutput
+	err := retry(ctx, l.opts.MaxRetries, l.opts.MaxRetryDelay, func() error {
+		err := l.pool.upload(ctx, st.Bucket, l.opts.S3RequestTimeout, func(ctx context.Context) error {
+			var err error
+			out, err = l.s3Client.CompleteMultipartUpload(ctx, input)
+			return err
+		})
+		if err != nil && !errors.Is(err, errBreakerOpen) {
+			s3Failed(log, st.Bucket, err).Warn("error completing multipart upload")
+		}
+		return err
+	})
+	if err != nil {
+		multipartStreams.WithLabelValues("failed").Inc()
+		return err
+	}
+	multipartStreams.WithLabelValues("completed").Inc()
+	log.WithField("parts", len(parts)).WithField("bytes", st.Size).Debug("completed multipart upload")
+
+	b, berr := l.newBatch(st.Key, nil)
+	if berr != nil {
+		return nil
+	}
+	b.Key, b.Bucket, b.Client = st.Key, st.Bucket, l.targets[0].cfg
+	b.Manifest = l.manifestPath()
+	b.Lines, b.FirstSeq, b.First, b.Last = st.Lines, st.FirstSeq, st.First, st.Last
+	b.size = st.Size
+	b.versionID = aws.ToString(out.VersionId)
+	l.targets[0].record(b, false)
+	l.clients.notifyUpload(ctx, b)
+	return nil
+}
+
+// abortUpload aborts a multipart upload. One that is already gone isn't an
+// error.
+func (l *S3Logger) abortUpload(ctx context.Context, bucket, key, uploadID string) error {
+	_, err := l.s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		UploadId:     aws.String(uploadID),
+		RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+	})
+	if err != nil && !isNoSuchUpload(err) {
+		s3Failed(l.log().WithField("key", key), bucket, err).Warn("error aborting multipart upload")
+		return err
+	}
+	multipartStreams.WithLabelValues("aborted").Inc()
+	return nil
+}
+
+// startRecovery completes, in the background, the uploads a logger whose
+// state was loaded left unfinished, including the one it had open.
+func (l *S3Logger) startRecovery() {
+	if st := l.state.Stream; st != nil {
+		l.state.Unfinished = append(l.state.Unfinished, *st)
+		l.state.Stream = nil
+	}
+	if len(l.state.Unfinished) == 0 {
+		return
+	}
+	l.wg.Add(1)
+	l.routines.start("recover-uploads", func() {
+		defer l.wg.Done()
+		l.flushMu.Lock()
+		defer l.flushMu.Unlock()
+		l.recoverUploads(l.ctx)
+		if err := l.saveState(); err != nil {
+			l.log().WithError(err).Warn("error saving logger state")
+		}
+	})
+}
+
+// recoverUploads completes the uploads the logger left unfinished, whose
+// completion failed or which were still open when the plugin stopped, with
+// the parts S3 holds of them, and then aborts any multipart upload under
+// s3-prefix started more than abort-incomplete-after ago. Callers must hold
+// l.flushMu.
+func (l *S3Logger) recoverUploads(ctx context.Context) {
+	var unfinished []streamState
+	for _, st := range l.state.Unfinished {
+		log := l.log().WithField("key", st.Key)
+		if st.Bucket != l.bucket {
+			log.WithField("upload_bucket", st.Bucket).Warnf("leaving the unfinished multipart upload of another bucket to %s", abortIncompleteAfterKey)
+			continue
+		}
+		parts, err := l.listParts(ctx, st)
+		if isNoSuchUpload(err) {
+			continue
+		}
+		if err == nil {
+			err = l.completeUpload(ctx, &st, parts)
+		}
+		if err != nil {
+			s3Failed(log, st.Bucket, err).Warn("error completing unfinished multipart upload, retrying with the next object")
+			unfinished = append(unfinished, st)
+			continue
+		}
+		multipartStreams.WithLabelValues("recovered").Inc()
+		log.WithField("parts", len(parts)).Info("completed unfinished multipart upload")
+	}
+	l.state.Unfinished = unfinished
+	if l.streaming() && l.opts.AbortIncompleteAfter > 0 {
+		l.abortIncomplete(ctx, time.Now().Add(-l.opts.AbortIncompleteAfter))
+	}
+}
+
+// listParts returns the parts S3 holds of st, which may be more than the
+// state last saved recorded.
+func (l *S3Logger) listParts(ctx context.Context, st streamState) ([]types.CompletedPart, error) {
+	var parts []types.CompletedPart
+	input := &s3.ListPartsInput{
+		Bucket:       aws.String(st.Bucket),
+		Key:          aws.String(st.Key),
+		UploadId:     aws.String(st.UploadID),
+		RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+	}
+	l.ssec.set(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	for {
+		out, err := l.s3Client.ListParts(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range out.Parts {
+			parts = append(parts, types.CompletedPart{PartNumber: p.PartNumber, ETag: p.ETag})
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			return parts, nil
+		}
+		input.PartNumberMarker = out.NextPartNumberMarker
+	}
+}
+
+// abortIncomplete aborts the multipart uploads under s3-prefix started
+// before cutoff, other than the logger's own, such as those of a plugin that
+// stopped without saving its state or of containers that never started
+// again.
+func (l *S3Logger) abortIncomplete(ctx context.Context, cutoff time.Time) {
+	input := &s3.ListMultipartUploadsInput{
+		Bucket:       aws.String(l.bucket),
+		Prefix:       aws.String(l.opts.S3Prefix),
+		RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+	}
+	own := make(map[string]bool)
+	for _, st := range l.state.Unfinished {
+		own[st.UploadID] = true
+	}
+	for {
+		out, err := l.s3Client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			s3Failed(l.log(), l.bucket, err).Warn("error listing incomplete multipart uploads")
+			return
+		}
+		for _, u := range out.Uploads {
+			id := aws.ToString(u.UploadId)
+			if own[id] || u.Initiated == nil || !u.Initiated.Before(cutoff) {
+				continue
+			}
+			if l.abortUpload(ctx, l.bucket, aws.ToString(u.Key), id) == nil {
+				l.log().WithField("key", aws.ToString(u.Key)).WithField("initiated", *u.Initiated).Infof("aborted multipart upload incomplete after %s", l.opts.AbortIncompleteAfter)
+			}
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			return
+		}
+		input.KeyMarker, input.UploadIdMarker = out.NextKeyMarker, out.NextUploadIdMarker
+	}
+}
+
+// isNoSuchUpload reports whether err is S3 saying a multipart upload has
+// already been completed or aborted.
+func isNoSuchUpload(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchUpload"
+}
@@ -0,0 +1,290 @@
+package s3log
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// streamOpts returns the log-opts of a multipart-stream logger with cfg on
+// top, uploading parts of the smallest size S3 takes and flushing only when
+// the test does.
+func streamOpts(cfg map[string]string) map[string]string {
+	opts := map[string]string{
+		writeModeKey:     writeModeMultipartStream,
+		partSizeKey:      strconv.FormatInt(manager.MinUploadPartSize, 10),
+		flushIntervalKey: "1h",
+	}
+	maps.Copy(opts, cfg)
+	return opts
+}
+
+// partLines returns lines that take more than a part to upload
+// uncompressed.
+func partLines(prefix string) []string {
+	lines := make([]string, 6000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%s %04d %s", prefix, i, strings.Repeat("x", 1000))
+	}
+	return lines
+}
+
+// logFlush logs lines stamped from start and flushes l.
+func logFlush(t *testing.T, l *S3Logger, start time.Time, lines ...string) error {
+	t.Helper()
+	logLines(t, l, start, lines...)
+	return l.flush(context.Background())
+}
+
+func TestMultipartStream(t *testing.T) {
+	// Flushes are coalesced until a part's worth is pending, and the
+	// window's object is completed when the container stops.
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, streamOpts(map[string]string{compressKey: compressNone}))
+	start := time.Now().Truncate(time.Hour)
+	var want []string
+	for i := range 3 {
+		line := fmt.Sprintf("small %d", i)
+		if err := logFlush(t, l, start, line); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, line)
+	}
+	if n := fake.count("CreateMultipartUpload") + fake.count("UploadPart"); n != 0 {
+		t.Fatalf("%d multipart calls for less than a part, want none", n)
+	}
+
+	big := partLines("big")
+	if err := logFlush(t, l, start.Add(time.Second), big...); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, big...)
+	if n := fake.count("UploadPart"); n != 1 {
+		t.Fatalf("%d parts uploaded once more than a part was pending, want 1", n)
+	}
+	if err := logFlush(t, l, start.Add(time.Minute), "last"); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "last")
+	if keys := fake.logKeys(testBucket); len(keys) != 0 {
+		t.Fatalf("uploaded %q before the window's object was completed", keys)
+	}
+
+	completed := metricValue(multipartStreams.WithLabelValues("completed"))
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	keys := fake.logKeys(testBucket)
+	if len(keys) != 1 || fake.count("CreateMultipartUpload") != 1 || fake.count("UploadPart") != 2 {
+		t.Fatalf("uploaded %q in %d parts, want one object in 2", keys, fake.count("UploadPart"))
+	}
+	if got := objectLines(t, l, keys[0]); !slices.Equal(got, want) {
+		t.Errorf("object holds %d lines, want the %d logged in order", len(got), len(want))
+	}
+	if got := metricValue(multipartStreams.WithLabelValues("completed")) - completed; got != 1 {
+		t.Errorf("%v uploads counted completed, want 1", got)
+	}
+}
+
+func TestMultipartStreamWindows(t *testing.T) {
+	// A flush into the next window completes the object of the last, each
+	// window's members of a gzip stream reading back as one object.
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, streamOpts(nil))
+	start := time.Now().Truncate(time.Hour).Add(-3 * time.Hour)
+	for _, line := range []string{"a1", "a2"} {
+		if err := logFlush(t, l, start, line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := logFlush(t, l, start.Add(time.Hour), "b1"); err != nil {
+		t.Fatal(err)
+	}
+	first := fake.logKeys(testBucket)
+	if len(first) != 1 {
+		t.Fatalf("uploaded %q on starting the next window, want the last window's object", first)
+	}
+	if got := objectLines(t, l, first[0]); !slices.Equal(got, []string{"a1", "a2"}) {
+		t.Errorf("first window's object holds %q", got)
+	}
+
+	// A flush of lines stamped behind the clock leaves the object open, but
+	// a window passing without a flush completes it.
+	if err := logFlush(t, l, start.Add(time.Hour+time.Minute), "b2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if keys := fake.logKeys(testBucket); len(keys) != 1 {
+		t.Fatalf("uploaded %q while the window's object was in use, want it open", keys)
+	}
+	l.flushMu.Lock()
+	err := l.idleStream(context.Background(), time.Now().Add(2*l.opts.MultipartWindow))
+	l.flushMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := fake.logKeys(testBucket)
+	if len(keys) != 2 {
+		t.Fatalf("uploaded %q once the window passed, want 2 objects", keys)
+	}
+	if got := uploadedLines(t, fake, l); !slices.Equal(got, []string{"a1", "a2", "b1", "b2"}) {
+		t.Errorf("objects hold %q", got)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.count("CreateMultipartUpload"); n != 2 {
+		t.Errorf("%d multipart uploads, want one per window", n)
+	}
+}
+
+func TestMultipartStreamPartRetry(t *testing.T) {
+	// A part that fails to upload stays pending and goes up with the next
+	// flush.
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, streamOpts(map[string]string{compressKey: compressNone, maxRetriesKey: "0"}))
+	start := time.Now().Truncate(time.Hour)
+	fake.fail("UploadPart", 1, fakeStatusError(http.StatusServiceUnavailable, "SlowDown"))
+	big := partLines("big")
+	logFlush(t, l, start, big...)
+	if err := logFlush(t, l, start.Add(time.Minute), "after"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := append(big, "after")
+	if got := uploadedLines(t, fake, l); !slices.Equal(got, want) {
+		t.Errorf("uploaded %d lines, want the %d logged in order", len(got), len(want))
+	}
+	if got := metricValue(l.metrics.dropped); got != 0 {
+		t.Errorf("%v lines dropped, want none", got)
+	}
+}
+
+func TestMultipartStreamRecovery(t *testing.T) {
+	// The plugin dies with the window's object open, and the next start
+	// completes it with the parts S3 holds.
+	fake := newFakeS3()
+	cfg := streamOpts(map[string]string{compressKey: compressNone, stateDirKey: t.TempDir()})
+	before := newTestLogger(t, fake, cfg)
+	big := partLines("big")
+	if err := logFlush(t, before, time.Now().Truncate(time.Hour), big...); err != nil {
+		t.Fatal(err)
+	}
+	if fake.count("UploadPart") != 1 || len(fake.logKeys(testBucket)) != 0 {
+		t.Fatalf("%d parts uploaded, want 1 of an open object", fake.count("UploadPart"))
+	}
+	before.abandon()
+
+	recovered := metricValue(multipartStreams.WithLabelValues("recovered"))
+	after := newTestLogger(t, fake, cfg)
+	waitFor(t, "the unfinished upload to be completed", func() bool {
+		return len(fake.logKeys(testBucket)) == 1
+	})
+	got := objectLines(t, after, fake.logKeys(testBucket)[0])
+	if len(got) == 0 || !slices.Equal(got, big[:len(got)]) {
+		t.Errorf("completed object holds %d lines, want the first of those logged", len(got))
+	}
+	waitFor(t, "the upload to be counted recovered", func() bool {
+		return metricValue(multipartStreams.WithLabelValues("recovered"))-recovered == 1
+	})
+	if err := after.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.count("ListParts"); n != 1 {
+		t.Errorf("%d ListParts, want 1 for the unfinished upload", n)
+	}
+}
+
+// startUpload starts a multipart upload of key in testBucket, as if
+// initiated at initiated, and returns its ID.
+func startUpload(t *testing.T, fake *fakeS3, key string, initiated time.Time) string {
+	t.Helper()
+	out, err := fake.CreateMultipartUpload(context.Background(), &s3.CreateMultipartUploadInput{Bucket: aws.String(testBucket), Key: aws.String(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := aws.ToString(out.UploadId)
+	fake.mu.Lock()
+	fake.uploads[id].initiated = initiated
+	fake.mu.Unlock()
+	return id
+}
+
+func TestMultipartStreamAbortIncomplete(t *testing.T) {
+	// Starting an object aborts the uploads under s3-prefix left incomplete
+	// for longer than abort-incomplete-after, and only those.
+	fake := newFakeS3()
+	old := startUpload(t, fake, "mine/old.log", time.Now().Add(-48*time.Hour))
+	recent := startUpload(t, fake, "mine/recent.log", time.Now().Add(-time.Hour))
+	other := startUpload(t, fake, "other/old.log", time.Now().Add(-48*time.Hour))
+	aborted := metricValue(multipartStreams.WithLabelValues("aborted"))
+	l := newTestLogger(t, fake, streamOpts(map[string]string{s3PrefixKey: "mine/", abortIncompleteAfterKey: "24h"}))
+	if err := logFlush(t, l, time.Now(), "line"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if _, ok := fake.uploads[old]; ok {
+		t.Error("upload incomplete for 48h under s3-prefix not aborted")
+	}
+	if _, ok := fake.uploads[recent]; !ok {
+		t.Error("upload incomplete for 1h aborted")
+	}
+	if _, ok := fake.uploads[other]; !ok {
+		t.Error("upload outside s3-prefix aborted")
+	}
+	if got := metricValue(multipartStreams.WithLabelValues("aborted")) - aborted; got != 1 {
+		t.Errorf("%v uploads counted aborted, want 1", got)
+	}
+}
+
+func TestMultipartStreamOpts(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     map[string]string
+		wantErr string
+	}{
+		{name: "object", cfg: map[string]string{writeModeKey: writeModeObject, indexKey: "true"}},
+		{name: "stream", cfg: streamOpts(map[string]string{multipartWindowKey: "10m", abortIncompleteAfterKey: "0"})},
+		{name: "unknown mode", cfg: map[string]string{writeModeKey: "append"}, wantErr: "invalid write-mode"},
+		{name: "zero window", cfg: streamOpts(map[string]string{multipartWindowKey: "0s"}), wantErr: "invalid multipart-window"},
+		{name: "negative abort", cfg: streamOpts(map[string]string{abortIncompleteAfterKey: "-1h"}), wantErr: "invalid abort-incomplete-after"},
+		{name: "abort within window", cfg: streamOpts(map[string]string{multipartWindowKey: "2h", abortIncompleteAfterKey: "2h"}), wantErr: "must be longer than multipart-window"},
+		{name: "replicas", cfg: streamOpts(map[string]string{s3BucketKey: testBucket + ",copy"}), wantErr: "replica buckets"},
+		{name: "failover", cfg: streamOpts(map[string]string{failoverBucketKey: "fallback"}), wantErr: failoverBucketKey},
+		{name: "index", cfg: streamOpts(map[string]string{indexKey: "true"}), wantErr: indexKey},
+		{name: "strict ordering", cfg: streamOpts(map[string]string{orderingKey: orderingStrict}), wantErr: orderingKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseLogOpts(DefaultOptions(), testLogOpts(t, tt.cfg))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseLogOpts returned %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
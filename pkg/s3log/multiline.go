@@ -0,0 +1,83 @@
+package s3log
+
+import (
+	"bytes"
+	"time"
+)
+
+const (
+	multilinePatternKey = "multiline-pattern"
+	multilineTimeoutKey = "multiline-flush-timeout"
+
+	defaultMultilineTimeout = time.Second
+
+	// multilineMaxBytes caps a grouped record. A line that would make the
+	// group larger starts a new one instead.
+	multilineMaxBytes = 1 << 20
+)
+
+// lineGroup is a multiline record still waiting for more lines.
+type lineGroup struct {
+	msg   Message // header of the first line, without its line
+	line  []byte
+	timer *time.Timer
+	wal   int64 // journal index of the first line
+}
+
+// group appends msg to the stream's pending record unless it matches the
+// multiline-pattern, in which case the pending record is complete and msg
+// starts the next one. Records that see no new line for the
+// multiline-flush-timeout are written out as they are. Without a pattern
+// every line is its own record. wal is the journal index of msg. Callers must
+// hold l.mu.
+func (l *S3Logger) group(msg *Message, wal int64) {
+	if l.multiline == nil {
+		l.append(msg)
+		return
+	}
+
+	stream := msg.Source
+	g := l.groups[stream]
+	if g != nil && !l.multiline.Match(msg.Line) && len(g.line)+1+len(msg.Line) <= multilineMaxBytes {
+		g.line = append(g.line, '\n')
+		g.line = append(g.line, msg.Line...)
+		g.timer.Reset(l.opts.MultilineTimeout)
+		return
+	}
+	if g != nil {
+		l.emitGroup(stream)
+	}
+
+	g = &lineGroup{msg: header(msg), line: bytes.Clone(msg.Line), wal: wal}
+	g.timer = time.AfterFunc(l.opts.MultilineTimeout, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.groups[stream] == g {
+			l.emitGroup(stream)
+			l.charge()
+		}
+	})
+	l.groups[stream] = g
+}
+
+// emitGroup writes out the stream's pending record. Callers must hold l.mu.
+func (l *S3Logger) emitGroup(stream string) {
+	g := l.groups[stream]
+	delete(l.groups, stream)
+	g.timer.Stop()
+	l.append(&Message{
+		Line:      g.line,
+		Source:    g.msg.Source,
+		Timestamp: g.msg.Timestamp,
+		Attrs:     g.msg.Attrs,
+	})
+}
+
+// flushGroups writes out every pending record. It is called when the
+// container stops so that a trailing traceback isn't lost. Callers must hold
+// l.mu.
+func (l *S3Logger) flushGroups() {
+	for stream := range l.groups {
+		l.emitGroup(stream)
+	}
+}
@@ -0,0 +1,115 @@
+package s3log
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMultiline(t *testing.T) {
+	type logged struct{ source, line string }
+	big := strings.Repeat("x", multilineMaxBytes/2+1)
+	tests := []struct {
+		name  string
+		lines []logged
+		want  []string
+	}{
+		{
+			name: "trailing traceback at stop",
+			lines: []logged{
+				{"stdout", "2024-05-01 starting"},
+				{"stdout", "2024-05-01 error"},
+				{"stdout", "Traceback (most recent call last):"},
+				{"stdout", `  File "app.py", line 1`},
+				{"stdout", "ValueError: boom"},
+			},
+			want: []string{
+				"2024-05-01 starting",
+				"2024-05-01 error\nTraceback (most recent call last):\n  File \"app.py\", line 1\nValueError: boom",
+			},
+		},
+		{
+			name: "per stream",
+			lines: []logged{
+				{"stdout", "2024-05-01 out"},
+				{"stderr", "2024-05-01 err"},
+				{"stdout", "  out continued"},
+				{"stderr", "  err continued"},
+				{"stdout", "2024-05-01 next out"},
+			},
+			want: []string{
+				"2024-05-01 out\n  out continued",
+				"2024-05-01 err\n  err continued",
+				"2024-05-01 next out",
+			},
+		},
+		{
+			name: "leading lines without a start",
+			lines: []logged{
+				{"stdout", "  orphan"},
+				{"stdout", "  orphan continued"},
+				{"stdout", "2024-05-01 record"},
+			},
+			want: []string{"  orphan\n  orphan continued", "2024-05-01 record"},
+		},
+		{
+			name: "capped size",
+			lines: []logged{
+				{"stdout", "2024-05-01 " + big},
+				{"stdout", big},
+			},
+			want: []string{"2024-05-01 " + big, big},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			l := newTestLogger(t, fake, map[string]string{
+				multilinePatternKey: `^\d{4}-\d{2}-\d{2}`,
+				maxBufferSizeKey:    "4194304",
+				flushBytesKey:       "4194304",
+			})
+			for _, line := range tt.lines {
+				if err := l.Log(&Message{Line: []byte(line.line), Source: line.source, Timestamp: time.Now()}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// Records still pending at stop are written out in no
+			// particular order.
+			got := uploadedLines(t, fake, l)
+			slices.Sort(got)
+			want := slices.Clone(tt.want)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("uploaded %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestMultilineTimeout(t *testing.T) {
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, map[string]string{
+		multilinePatternKey: `^\S`,
+		multilineTimeoutKey: "20ms",
+		flushIntervalKey:    "1h",
+	})
+	logLines(t, l, time.Now(), "panic: boom", "\tgoroutine 1")
+	waitFor(t, "the pending record to be written out", func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.groups) == 0 && l.buf.Len() > 0
+	})
+	// A line after the timeout starts a record of its own even though it
+	// doesn't match.
+	logLines(t, l, time.Now(), "\tlate")
+	l.Close()
+	want := []string{"panic: boom\n\tgoroutine 1", "\tlate"}
+	if got := uploadedLines(t, fake, l); !slices.Equal(got, want) {
+		t.Errorf("uploaded %q, want %q", got, want)
+	}
+}
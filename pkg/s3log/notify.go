@@ -0,0 +1,201 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	notifySNSKey = "notify-sns-topic-arn"
+	notifySQSKey = "notify-sqs-queue-url"
+
+	notifyAttempts   = 3
+	notifyRetryDelay = time.Second
+)
+
+func init() {
+	requirePermissions(
+		permission{"sns:Publish", onTopic, notifySNSKey, func(s permissionScope) bool { return s.opts.NotifyTopic != "" }},
+		permission{"sqs:SendMessage", onQueue, notifySQSKey, func(s permissionScope) bool { return s.opts.NotifyQueue != "" }},
+	)
+}
+
+// uploadNotification is the message published after each object is
+// uploaded, carrying the container metadata that S3 event notifications
+// lack.
+type uploadNotification struct {
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	VersionID   string `json:"version_id,omitempty"`
+	Bytes       int    `json:"bytes"`
+	Lines       int    `json:"lines"`
+	ContainerID string `json:"container_id"`
+	Tag         string `json:"tag"`
+	Summary     string `json:"summary,omitempty"`
+}
+
+// parseTopicARN checks that v is an SNS topic ARN and returns its region.
+func parseTopicARN(v string) (string, error) {
+	a, err := arn.Parse(v)
+	if err != nil {
+		return "", err
+	}
+	if a.Service != "sns" {
+		return "", fmt.Errorf("not an SNS topic ARN")
+	}
+	return a.Region, nil
+}
+
+// parseQueueURL checks that v is an SQS queue URL and returns the region in
+// its host, if any.
+func parseQueueURL(v string) (string, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Path == "" {
+		return "", fmt.Errorf("not an SQS queue URL")
+	}
+	// sqs.<region>.amazonaws.com, or the legacy <region>.queue.amazonaws.com.
+	parts := strings.Split(u.Hostname(), ".")
+	switch {
+	case len(parts) >= 3 && parts[0] == "sqs":
+		return parts[1], nil
+	case len(parts) >= 3 && parts[1] == "queue":
+		return parts[0], nil
+	}
+	return "", nil
+}
+
+// notifyUpload publishes a notification for b, which has just been uploaded,
+// to its SNS topic and SQS queue. Publishing is retried a couple of times and
+// then given up on; the object is never uploaded again because of it.
+func (f *clientFactory) notifyUpload(ctx context.Context, b *batch) {
+	if b.NotifyTopic == "" && b.NotifyQueue == "" {
+		return
+	}
+	n := uploadNotification{
+		Bucket:      b.Bucket,
+		Key:         b.Key,
+		VersionID:   b.versionID,
+		Bytes:       int(b.objectSize()),
+		Lines:       b.Lines,
+		ContainerID: b.ContainerID,
+		Tag:         b.Tag,
+	}
+	if b.summary {
+		n.Summary = b.Key
+	}
+	data, err := json.Marshal(n)
+	if err != nil {
+		return
+	}
+	msg := aws.String(string(data))
+	log := logrus.WithField("id", b.ContainerID).WithField("bucket", b.Bucket).WithField("key", b.Key)
+
+	if b.NotifyTopic != "" {
+		err := notifyRetry(ctx, func() error {
+			client, err := f.snsClient(b.Client, b.NotifyTopic)
+			if err != nil {
+				return err
+			}
+			_, err = client.Publish(ctx, &sns.PublishInput{TopicArn: aws.String(b.NotifyTopic), Message: msg})
+			return err
+		})
+		if err != nil {
+			log.WithField("topic", b.NotifyTopic).WithError(err).Warn("error publishing upload notification")
+		}
+	}
+	if b.NotifyQueue != "" {
+		err := notifyRetry(ctx, func() error {
+			client, err := f.sqsClient(b.Client, b.NotifyQueue)
+			if err != nil {
+				return err
+			}
+			_, err = client.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: aws.String(b.NotifyQueue), MessageBody: msg})
+			return err
+		})
+		if err != nil {
+			log.WithField("queue", b.NotifyQueue).WithError(err).Warn("error sending upload notification")
+		}
+	}
+}
+
+func notifyRetry(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < notifyAttempts; attempt++ {
+		if err = fn(); err == nil || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff(attempt, notifyRetryDelay)):
+		}
+	}
+	return err
+}
+
+// snsClient returns a client for topic with the credentials of cfg, in the
+// topic's region.
+func (f *clientFactory) snsClient(cfg clientConfig, topic string) (*sns.Client, error) {
+	if region, _ := parseTopicARN(topic); region != "" {
+		cfg.Region = region
+	}
+	creds, err := f.credentials(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.snsClients[cfg]; ok {
+		return c, nil
+	}
+	c := sns.NewFromConfig(f.cfg, func(o *sns.Options) {
+		if creds != nil {
+			o.Credentials = creds
+		}
+		if cfg.Region != "" {
+			o.Region = cfg.Region
+		}
+	})
+	f.snsClients[cfg] = c
+	return c, nil
+}
+
+// sqsClient returns a client for queue with the credentials of cfg, in the
+// queue's region.
+func (f *clientFactory) sqsClient(cfg clientConfig, queue string) (*sqs.Client, error) {
+	if region, _ := parseQueueURL(queue); region != "" {
+		cfg.Region = region
+	}
+	creds, err := f.credentials(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.sqsClients[cfg]; ok {
+		return c, nil
+	}
+	c := sqs.NewFromConfig(f.cfg, func(o *sqs.Options) {
+		if creds != nil {
+			o.Credentials = creds
+		}
+		if cfg.Region != "" {
+			o.Region = cfg.Region
+		}
+	})
+	f.sqsClients[cfg] = c
+	return c, nil
+}
@@ -0,0 +1,1362 @@
+package s3log
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	units "github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	s3BucketKey      = "s3-bucket"
+	s3PrefixKey      = "s3-prefix"
+	flushIntervalKey = "flush-interval"
+	flushBytesKey    = "flush-bytes"
+	compressKey      = "compress"
+	keyTemplateKey   = "key-template"
+	partSizeKey      = "upload-part-size"
+	concurrencyKey   = "upload-concurrency"
+	shutdownFlushKey = "shutdown-flush-timeout"
+	modeKey          = "mode"
+	stdoutModeKey    = "stdout-mode"
+	stderrModeKey    = "stderr-mode"
+	maxBufferSizeKey = "max-buffer-size"
+	sseKey           = "sse"
+	sseKMSKeyIDKey   = "sse-kms-key-id"
+	tagKey           = "tag"
+	storageClassKey  = "storage-class"
+	aclKey           = "acl"
+	requestPayerKey  = "request-payer"
+
+	modeBlocking    = "blocking"
+	modeNonBlocking = "non-blocking"
+
+	defaultFlushInterval = 5 * time.Second
+	defaultFlushBytes    = 1 << 20
+	defaultShutdownFlush = 10 * time.Second
+	defaultMaxBufferSize = 16 << 20
+)
+
+// logOptKeys is the set of log-opts accepted by the driver.
+var logOptKeys = map[string]bool{
+	s3BucketKey:         true,
+	failoverBucketKey:   true,
+	failoverAfterKey:    true,
+	s3PrefixKey:         true,
+	flushIntervalKey:    true,
+	flushBytesKey:       true,
+	adaptiveFlushKey:    true,
+	adaptiveFlushMinKey: true,
+	adaptiveFlushMaxKey: true,
+	startupGraceKey:     true,
+	coalesceWindowKey:   true,
+	compressKey:         true,
+	compressLevelKey:    true,
+	strictOptsKey:       true,
+	keyTemplateKey:      true,
+	partSizeKey:         true,
+	concurrencyKey:      true,
+	shutdownFlushKey:    true,
+	maxRetriesKey:       true,
+	maxRetryDelayKey:    true,
+	spoolDirKey:         true,
+	spoolMaxBytesKey:    true,
+	stateDirKey:         true,
+	walKey:              true,
+	walDirKey:           true,
+	modeKey:             true,
+	stdoutModeKey:       true,
+	stderrModeKey:       true,
+	orderingKey:         true,
+	maxBufferSizeKey:    true,
+	sseKey:              true,
+	sseKMSKeyIDKey:      true,
+	sseCKeyFileKey:      true,
+	tagKey:              true,
+
+	s3RequestTimeoutKey:  true,
+	walSyncIntervalKey:   true,
+	walSegmentBytesKey:   true,
+	walRetentionKey:      true,
+	keyUniqueSuffixKey:   true,
+	keyLayoutKey:         true,
+	timeSliceFormatKey:   true,
+	maxLineBytesKey:      true,
+	maxPartialBytesKey:   true,
+	maxPartialAgeKey:     true,
+	maxPartialGroupsKey:  true,
+	maxRecordBytesKey:    true,
+	oversizePolicyKey:    true,
+	filterIncludeKey:     true,
+	stripANSIKey:         true,
+	skipEmptyKey:         true,
+	filterExcludeKey:     true,
+	sampleRateKey:        true,
+	samplePatternKey:     true,
+	redactPatternsKey:    true,
+	redactReplacementKey: true,
+	multilinePatternKey:  true,
+	multilineTimeoutKey:  true,
+
+	cloudWatchGroupKey:          true,
+	cloudWatchStreamTemplateKey: true,
+	cloudWatchFilterKey:         true,
+	notifySNSKey:                true,
+	notifySQSKey:                true,
+	storageClassKey:             true,
+	aclKey:                      true,
+	requestPayerKey:             true,
+	verifyWriteKey:              true,
+	disableChecksumsKey:         true,
+	manifestKey:                 true,
+	summaryKey:                  true,
+	exitEventKey:                true,
+	deadLetterKey:               true,
+	deadLetterMaxBytesKey:       true,
+	deadLetterFlushIntervalKey:  true,
+	indexKey:                    true,
+	heartbeatIntervalKey:        true,
+	slowFlushThresholdKey:       true,
+	indexIntervalKey:            true,
+	maxPutsPerContainerKey:      true,
+	cacheDisabledKey:            true,
+	cacheMaxSizeKey:             true,
+	cacheDirKey:                 true,
+	retentionDaysKey:            true,
+	retentionExpiresAtKey:       true,
+	writeModeKey:                true,
+	multipartWindowKey:          true,
+	abortIncompleteAfterKey:     true,
+	parquetCompressionKey:       true,
+	uploadModeKey:               true,
+	presignEndpointKey:          true,
+	presignTokenFileKey:         true,
+	dedupeWindowKey:             true,
+	dedupeGranularityKey:        true,
+	verifyAfterWriteKey:         true,
+	verifySampleRateKey:         true,
+
+	objectTagsKey:     true,
+	objectMetadataKey: true,
+	labelsKey:         true,
+	labelsRegexKey:    true,
+	envKey:            true,
+	envRegexKey:       true,
+	formatKey:         true,
+	timestampKey:      true,
+	mergeJSONLogKey:   true,
+	groupByLabelKey:   true,
+	splitStreamsKey:   true,
+	maxObjectSizeKey:  true,
+
+	partitionByKey:       true,
+	partitionTimezoneKey: true,
+	maxFutureSkewKey:     true,
+	stableKeySourceKey:   true,
+	readPriorRunsKey:     true,
+	readConcurrencyKey:   true,
+	readBufferBytesKey:   true,
+
+	tenantKey:      true,
+	tenantLabelKey: true,
+
+	s3RegionKey:           true,
+	endpointURLKey:        true,
+	forcePathStyleKey:     true,
+	disableSSLKey:         true,
+	accelerateKey:         true,
+	dualstackKey:          true,
+	fipsKey:               true,
+	caCertFileKey:         true,
+	insecureSkipVerifyKey: true,
+	proxyURLKey:           true,
+	noProxyKey:            true,
+	assumeRoleARNKey:      true,
+	externalIDKey:         true,
+	roleSessionKey:        true,
+	accessKeyIDKey:        true,
+	secretKeyKey:          true,
+	sessionTokenKey:       true,
+	profileKey:            true,
+	credentialsFileKey:    true,
+}
+
+// LogOption represents options for configuring the S3 logger. The plugin
+// flags provide the defaults, which per-container log-opts override.
+type LogOption struct {
+	S3Bucket         string
+	S3Prefix         string
+	Replicas         []replica
+	FailoverBucket   string
+	FailoverRegion   string
+	FailoverAfter    time.Duration
+	FlushInterval    time.Duration
+	FlushBytes       int
+	AdaptiveFlush    bool
+	AdaptiveFlushMin int
+	AdaptiveFlushMax int
+	StartupGrace     time.Duration
+	CoalesceWindow   time.Duration
+	Compress         string
+	CompressLevel    int
+	Format           string
+	KeyTemplate      string
+	PartSize         int64
+	Concurrency      int
+	StrictOpts       bool
+
+	ShutdownFlushTimeout time.Duration
+	MaxRetries           int
+	MaxRetryDelay        time.Duration
+	S3RequestTimeout     time.Duration
+	SpoolDir             string
+	SpoolMaxBytes        int64
+	StateDir             string
+	WAL                  bool
+	WALDir               string
+	WALSyncInterval      time.Duration
+	WALSegmentBytes      int64
+	Mode                 string
+	StdoutMode           string
+	StderrMode           string
+	Ordering             string
+	MaxBufferSize        int
+	SSE                  string
+	SSEKMSKeyID          string
+	SSECKeyFile          string
+	StorageClass         string
+	ACL                  string
+	RequestPayer         string
+	KeyUniqueSuffix      string
+	KeyLayout            string
+	TimeSliceFormat      string
+	MaxLineBytes         int
+	MaxPartialBytes      int
+	MaxPartialAge        time.Duration
+	MaxPartialGroups     int
+	MaxRecordBytes       int
+	OversizePolicy       string
+	FilterInclude        string
+	StripANSI            bool
+	SkipEmpty            bool
+	FilterExclude        string
+	MultilinePattern     string
+	SampleRate           float64
+	SamplePattern        string
+	RedactPatterns       []string
+	RedactReplacement    string
+	MultilineTimeout     time.Duration
+
+	CloudWatchGroup          string
+	CloudWatchStreamTemplate string
+	CloudWatchFilter         string
+	NotifyTopic              string
+	NotifyQueue              string
+	VerifyWrite              bool
+	DisableChecksums         bool
+	Manifest                 bool
+	Summary                  bool
+	ExitEvent                bool
+	DeadLetter               bool
+	DeadLetterMaxBytes       int
+	DeadLetterFlushInterval  time.Duration
+	HeartbeatInterval        time.Duration
+	SlowFlushThreshold       time.Duration
+	Index                    bool
+	IndexInterval            int
+	MaxPutsPerContainer      float64
+	CacheDisabled            bool
+	CacheMaxSize             int64
+	CacheDir                 string
+	ObjectTags               map[string]string
+	ObjectMetadata           map[string]string
+	RetentionDays            int
+	RetentionExpiresAt       bool
+	TimestampFormat          string
+	MergeJSONLog             bool
+	GroupByLabel             []string
+	SplitStreams             bool
+	StableKeySource          string
+	ReadPriorRuns            bool
+	ReadConcurrency          int
+	ReadBufferBytes          int64
+	MaxObjectSize            int
+	PartitionBy              string
+	PartitionTimezone        string
+	MaxFutureSkew            time.Duration
+	WriteMode                string
+	MultipartWindow          time.Duration
+	AbortIncompleteAfter     time.Duration
+	ParquetCompression       string
+	UploadMode               string
+	PresignEndpoint          string
+	PresignTokenFile         string
+	DedupeWindow             time.Duration
+	DedupeGranularity        string
+	VerifyAfterWrite         bool
+	VerifySampleRate         float64
+
+	WALRetention time.Duration
+
+	Tenant      string
+	TenantLabel string
+
+	S3Region       string
+	EndpointURL    string
+	ForcePathStyle bool
+	DisableSSL     bool
+	Accelerate     bool
+	Dualstack      bool
+	FIPS           bool
+
+	CACertFile         string
+	InsecureSkipVerify bool
+	ProxyURL           string
+	NoProxy            string
+
+	AssumeRoleARN   string
+	ExternalID      string
+	RoleSessionName string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Profile         string
+	CredentialsFile string
+
+	// stream is set on the options of each logger of a split container.
+	stream string
+	// stableKey is set by query to the stable key whose objects are read.
+	stableKey string
+
+	// backfill is set by the backfill command, whose objects are named for
+	// when their lines were logged rather than when they were uploaded.
+	backfill bool
+	// replay is set by the replay command, whose uploads it counts and
+	// skips if their keys are already taken.
+	replay *replayRun
+}
+
+// ValidateLogOpt checks that every log-opt passed for a container is one the
+// driver understands, suggesting the log-opts closest to any that aren't.
+func ValidateLogOpt(cfg map[string]string) error {
+	var unknown []string
+	for k := range cfg {
+		if !logOptKeys[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		return unknownOptsError(unknown)
+	}
+	return nil
+}
+
+// parseSize parses a positive size given in bytes or in human-readable form
+// such as 4m or 512k, the way the daemon parses its own max-buffer-size.
+func parseSize(key, v string) (int64, error) {
+	n, err := units.RAMInBytes(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive size such as 4m or 512k", key, v)
+	}
+	return n, nil
+}
+
+// parseLogOpts overrides the plugin-wide defaults with the log-opts docker
+// passed for a single container. Unknown log-opts fail it unless
+// strict-opts is false, when they are ignored with a warning.
+func parseLogOpts(defaults LogOption, cfg map[string]string) (LogOption, error) {
+	opts := defaults
+	if v, ok := cfg[strictOptsKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", strictOptsKey, v)
+		}
+		opts.StrictOpts = b
+	}
+	if err := ValidateLogOpt(cfg); err != nil {
+		if opts.StrictOpts {
+			return opts, err
+		}
+		logrus.Warnf("%v: ignoring them with %s=false, lines may go somewhere other than intended", err, strictOptsKey)
+	}
+	if v, ok := cfg[s3BucketKey]; ok {
+		opts.S3Bucket = v
+	}
+	if v, ok := cfg[s3PrefixKey]; ok {
+		opts.S3Prefix = v
+	}
+	for key, v := range map[string]*string{s3BucketKey: &opts.S3Bucket, s3PrefixKey: &opts.S3Prefix} {
+		expanded, err := expandEnv(*v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: %v", key, *v, err)
+		}
+		*v = expanded
+	}
+	var bucketRegion string
+	if opts.S3Bucket != "" {
+		bucket, region, replicas, err := parseBuckets(opts.S3Bucket)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: %v", s3BucketKey, opts.S3Bucket, err)
+		}
+		opts.S3Bucket, bucketRegion, opts.Replicas = bucket, region, replicas
+	}
+	if opts.S3Bucket == "" {
+		return opts, fmt.Errorf("no S3 bucket configured: set the %s log-opt or plugin flag", s3BucketKey)
+	}
+	if v, ok := cfg[failoverBucketKey]; ok {
+		opts.FailoverBucket, opts.FailoverRegion = v, ""
+	}
+	if opts.FailoverBucket != "" {
+		bucket, region, err := parseFailoverBucket(opts.FailoverBucket)
+		if err == nil && bucket == opts.S3Bucket {
+			err = fmt.Errorf("must differ from %s", s3BucketKey)
+		}
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: %v", failoverBucketKey, opts.FailoverBucket, err)
+		}
+		opts.FailoverBucket = bucket
+		if region != "" {
+			opts.FailoverRegion = region
+		}
+	}
+	if v, ok := cfg[failoverAfterKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a positive duration", failoverAfterKey, v)
+		}
+		opts.FailoverAfter = d
+	}
+	if v, ok := cfg[flushIntervalKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a positive duration", flushIntervalKey, v)
+		}
+		opts.FlushInterval = d
+	}
+	if v, ok := cfg[flushBytesKey]; ok {
+		n, err := parseSize(flushBytesKey, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.FlushBytes = int(n)
+	}
+	if v, ok := cfg[compressKey]; ok {
+		opts.Compress = v
+	}
+	if v, ok := cfg[formatKey]; ok {
+		opts.Format = v
+	}
+	if opts.Format != formatJSONL && opts.Format != formatRaw && opts.Format != formatParquet {
+		return opts, fmt.Errorf("invalid %s %q: must be %q, %q or %q", formatKey, opts.Format, formatJSONL, formatRaw, formatParquet)
+	}
+	if v, ok := cfg[timestampKey]; ok {
+		opts.TimestampFormat = v
+	}
+	switch opts.TimestampFormat {
+	case "":
+		opts.TimestampFormat = timestampRFC3339Nano
+		if opts.Format == formatRaw {
+			opts.TimestampFormat = timestampNone
+		}
+	case timestampRFC3339Nano, timestampUnixMs, timestampNone:
+	default:
+		return opts, fmt.Errorf("invalid %s %q: must be %q, %q or %q", timestampKey, opts.TimestampFormat, timestampRFC3339Nano, timestampUnixMs, timestampNone)
+	}
+	if v, ok := cfg[mergeJSONLogKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", mergeJSONLogKey, v)
+		}
+		opts.MergeJSONLog = b
+	}
+	if v, ok := cfg[groupByLabelKey]; ok {
+		labels, err := parseGroupLabels(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: %v", groupByLabelKey, v, err)
+		}
+		opts.GroupByLabel = labels
+	}
+	if v, ok := cfg[splitStreamsKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", splitStreamsKey, v)
+		}
+		opts.SplitStreams = b
+	}
+	if v, ok := cfg[stableKeySourceKey]; ok {
+		opts.StableKeySource = v
+	}
+	if err := parseStableKeySource(opts.StableKeySource); err != nil {
+		return opts, fmt.Errorf("invalid %s %q: %v", stableKeySourceKey, opts.StableKeySource, err)
+	}
+	if v, ok := cfg[readPriorRunsKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", readPriorRunsKey, v)
+		}
+		opts.ReadPriorRuns = b
+	}
+	if v, ok := cfg[readConcurrencyKey]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a positive integer", readConcurrencyKey, v)
+		}
+		opts.ReadConcurrency = n
+	}
+	if v, ok := cfg[readBufferBytesKey]; ok {
+		n, err := parseSize(readBufferBytesKey, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.ReadBufferBytes = n
+	}
+	if v, ok := cfg[keyTemplateKey]; ok {
+		opts.KeyTemplate = v
+	}
+	tmpl, err := expandEnv(opts.KeyTemplate)
+	if err != nil {
+		return opts, fmt.Errorf("invalid %s %q: %v", keyTemplateKey, opts.KeyTemplate, err)
+	}
+	opts.KeyTemplate = tmpl
+	if v, ok := cfg[keyUniqueSuffixKey]; ok {
+		opts.KeyUniqueSuffix = v
+	}
+	switch opts.KeyUniqueSuffix {
+	case uniqueSuffixULID, uniqueSuffixTimestampNano, uniqueSuffixNone:
+	default:
+		return opts, fmt.Errorf("invalid %s %q: must be %q, %q or %q", keyUniqueSuffixKey, opts.KeyUniqueSuffix, uniqueSuffixULID, uniqueSuffixTimestampNano, uniqueSuffixNone)
+	}
+	if v, ok := cfg[timeSliceFormatKey]; ok {
+		opts.TimeSliceFormat = v
+	}
+	if _, err := sliceLayout(opts.TimeSliceFormat); err != nil {
+		return opts, fmt.Errorf("invalid %s %q: %v", timeSliceFormatKey, opts.TimeSliceFormat, err)
+	}
+	if v, ok := cfg[keyLayoutKey]; ok {
+		opts.KeyLayout = v
+	} else if _, ok := cfg[keyTemplateKey]; ok {
+		// A container's own key-template wins over the plugin's key-layout.
+		opts.KeyLayout = keyLayoutDefault
+	}
+	if opts.KeyLayout != keyLayoutDefault {
+		layout, ok := keyLayouts[opts.KeyLayout]
+		if !ok {
+			return opts, fmt.Errorf("invalid %s %q: must be %q or %q", keyLayoutKey, opts.KeyLayout, keyLayoutDefault, keyLayoutFluentd)
+		}
+		if _, ok := cfg[keyTemplateKey]; ok {
+			return opts, fmt.Errorf("%s can't be set with %s=%s", keyTemplateKey, keyLayoutKey, opts.KeyLayout)
+		}
+		// The layout numbers keys itself, and a suffix would break it.
+		if _, ok := cfg[keyUniqueSuffixKey]; !ok {
+			opts.KeyUniqueSuffix = uniqueSuffixNone
+		}
+		opts.KeyTemplate = layout(opts)
+	}
+	if v, ok := cfg[partSizeKey]; ok {
+		n, err := parseSize(partSizeKey, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.PartSize = n
+	}
+	if opts.PartSize < manager.MinUploadPartSize {
+		return opts, fmt.Errorf("invalid %s %d: must be at least %d", partSizeKey, opts.PartSize, manager.MinUploadPartSize)
+	}
+	if v, ok := cfg[concurrencyKey]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a positive integer", concurrencyKey, v)
+		}
+		opts.Concurrency = n
+	}
+	if v, ok := cfg[shutdownFlushKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a positive duration", shutdownFlushKey, v)
+		}
+		opts.ShutdownFlushTimeout = d
+	}
+	if v, ok := cfg[maxRetriesKey]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a non-negative integer", maxRetriesKey, v)
+		}
+		opts.MaxRetries = n
+	}
+	if v, ok := cfg[maxRetryDelayKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a positive duration", maxRetryDelayKey, v)
+		}
+		opts.MaxRetryDelay = d
+	}
+	if v, ok := cfg[s3RequestTimeoutKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a non-negative duration", s3RequestTimeoutKey, v)
+		}
+		opts.S3RequestTimeout = d
+	}
+	if v, ok := cfg[spoolDirKey]; ok {
+		opts.SpoolDir = v
+	}
+	if v, ok := cfg[spoolMaxBytesKey]; ok {
+		n, err := parseSize(spoolMaxBytesKey, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.SpoolMaxBytes = n
+	}
+	if v, ok := cfg[stateDirKey]; ok {
+		opts.StateDir = v
+	}
+	if v, ok := cfg[walKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", walKey, v)
+		}
+		opts.WAL = b
+	}
+	if v, ok := cfg[walDirKey]; ok {
+		opts.WALDir = v
+	}
+	if opts.WAL && opts.WALDir == "" {
+		return opts, fmt.Errorf("%s requires %s", walKey, walDirKey)
+	}
+	if v, ok := cfg[walSyncIntervalKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a non-negative duration", walSyncIntervalKey, v)
+		}
+		opts.WALSyncInterval = d
+	}
+	if v, ok := cfg[walSegmentBytesKey]; ok {
+		n, err := parseSize(walSegmentBytesKey, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.WALSegmentBytes = n
+	}
+	if v, ok := cfg[walRetentionKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a non-negative duration", walRetentionKey, v)
+		}
+		opts.WALRetention = d
+	}
+	if v, ok := cfg[modeKey]; ok {
+		opts.Mode = v
+	}
+	if opts.Mode != modeBlocking && opts.Mode != modeNonBlocking {
+		return opts, fmt.Errorf("invalid %s %q: must be %q or %q", modeKey, opts.Mode, modeBlocking, modeNonBlocking)
+	}
+	if v, ok := cfg[stdoutModeKey]; ok {
+		opts.StdoutMode = v
+	}
+	if opts.StdoutMode == "" {
+		opts.StdoutMode = opts.Mode
+	}
+	if v, ok := cfg[stderrModeKey]; ok {
+		opts.StderrMode = v
+	}
+	if opts.StderrMode == "" {
+		opts.StderrMode = modeBlocking
+	}
+	for _, m := range []struct{ key, mode string }{{stdoutModeKey, opts.StdoutMode}, {stderrModeKey, opts.StderrMode}} {
+		if m.mode != modeBlocking && m.mode != modeNonBlocking {
+			return opts, fmt.Errorf("invalid %s %q: must be %q or %q", m.key, m.mode, modeBlocking, modeNonBlocking)
+		}
+	}
+	if v, ok := cfg[orderingKey]; ok {
+		opts.Ordering = v
+	}
+	if opts.Ordering != orderingRelaxed && opts.Ordering != orderingStrict {
+		return opts, fmt.Errorf("invalid %s %q: must be %q or %q", orderingKey, opts.Ordering, orderingRelaxed, orderingStrict)
+	}
+	if v, ok := cfg[maxBufferSizeKey]; ok {
+		n, err := parseSize(maxBufferSizeKey, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.MaxBufferSize = int(n)
+	}
+	if opts.MaxBufferSize < opts.FlushBytes {
+		return opts, fmt.Errorf("invalid %s %d: must be at least %s (%d)", maxBufferSizeKey, opts.MaxBufferSize, flushBytesKey, opts.FlushBytes)
+	}
+	if v, ok := cfg[adaptiveFlushKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", adaptiveFlushKey, v)
+		}
+		opts.AdaptiveFlush = b
+	}
+	if v, ok := cfg[adaptiveFlushMinKey]; ok {
+		n, err := parseSize(adaptiveFlushMinKey, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.AdaptiveFlushMin = int(n)
+	}
+	if v, ok := cfg[adaptiveFlushMaxKey]; ok {
+		n, err := parseSize(adaptiveFlushMaxKey, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.AdaptiveFlushMax = int(n)
+	}
+	if opts.AdaptiveFlush {
+		if opts.AdaptiveFlushMax < opts.AdaptiveFlushMin {
+			return opts, fmt.Errorf("invalid %s %d: must be at least %s (%d)", adaptiveFlushMaxKey, opts.AdaptiveFlushMax, adaptiveFlushMinKey, opts.AdaptiveFlushMin)
+		}
+		if opts.MaxBufferSize < opts.AdaptiveFlushMax {
+			return opts, fmt.Errorf("invalid %s %d: must be at least %s (%d)", maxBufferSizeKey, opts.MaxBufferSize, adaptiveFlushMaxKey, opts.AdaptiveFlushMax)
+		}
+	}
+	if v, ok := cfg[startupGraceKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a non-negative duration", startupGraceKey, v)
+		}
+		opts.StartupGrace = d
+	}
+	if v, ok := cfg[coalesceWindowKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a non-negative duration", coalesceWindowKey, v)
+		}
+		opts.CoalesceWindow = d
+	}
+	if v, ok := cfg[maxLineBytesKey]; ok {
+		n, err := units.RAMInBytes(v)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a size, or 0 for no limit", maxLineBytesKey, v)
+		}
+		opts.MaxLineBytes = int(n)
+	}
+	if v, ok := cfg[maxPartialBytesKey]; ok {
+		n, err := parseSize(maxPartialBytesKey, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.MaxPartialBytes = int(n)
+	}
+	if v, ok := cfg[maxPartialAgeKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a duration, or 0 for no limit", maxPartialAgeKey, v)
+		}
+		opts.MaxPartialAge = d
+	}
+	if v, ok := cfg[maxPartialGroupsKey]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a positive integer", maxPartialGroupsKey, v)
+		}
+		opts.MaxPartialGroups = n
+	}
+	if opts.MaxPartialBytes <= 0 {
+		opts.MaxPartialBytes = defaultMaxPartialBytes
+	}
+	if opts.MaxPartialGroups <= 0 {
+		opts.MaxPartialGroups = defaultMaxPartialGroups
+	}
+	if v, ok := cfg[maxRecordBytesKey]; ok {
+		n, err := units.RAMInBytes(v)
+		if err != nil || n < 0 || n > 0 && n < minRecordBytes {
+			return opts, fmt.Errorf("invalid %s %q: must be a size of at least %d, or 0 for no limit", maxRecordBytesKey, v, minRecordBytes)
+		}
+		opts.MaxRecordBytes = int(n)
+	}
+	if v, ok := cfg[oversizePolicyKey]; ok {
+		opts.OversizePolicy = v
+	}
+	if opts.OversizePolicy != oversizeSplit && opts.OversizePolicy != oversizeTruncate {
+		return opts, fmt.Errorf("invalid %s %q: must be %q or %q", oversizePolicyKey, opts.OversizePolicy, oversizeSplit, oversizeTruncate)
+	}
+	if v, ok := cfg[maxObjectSizeKey]; ok {
+		n, err := parseSize(maxObjectSizeKey, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.MaxObjectSize = int(n)
+	}
+	if v, ok := cfg[partitionByKey]; ok {
+		opts.PartitionBy = v
+	}
+	switch opts.PartitionBy {
+	case partitionNone, partitionDay, partitionHour:
+	default:
+		return opts, fmt.Errorf("invalid %s %q: must be %q, %q or %q", partitionByKey, opts.PartitionBy, partitionHour, partitionDay, partitionNone)
+	}
+	if v, ok := cfg[partitionTimezoneKey]; ok {
+		opts.PartitionTimezone = v
+	}
+	if _, err := time.LoadLocation(opts.PartitionTimezone); err != nil {
+		return opts, fmt.Errorf("invalid %s %q: %v", partitionTimezoneKey, opts.PartitionTimezone, err)
+	}
+	if v, ok := cfg[maxFutureSkewKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a non-negative duration", maxFutureSkewKey, v)
+		}
+		opts.MaxFutureSkew = d
+	}
+	if v, ok := cfg[sseKey]; ok {
+		opts.SSE = v
+	}
+	if v, ok := cfg[sseKMSKeyIDKey]; ok {
+		opts.SSEKMSKeyID = v
+	}
+	switch types.ServerSideEncryption(opts.SSE) {
+	case "", types.ServerSideEncryptionAes256, types.ServerSideEncryptionAwsKms:
+	default:
+		return opts, fmt.Errorf("invalid %s %q: must be %q or %q", sseKey, opts.SSE, types.ServerSideEncryptionAes256, types.ServerSideEncryptionAwsKms)
+	}
+	if opts.SSEKMSKeyID != "" && opts.SSE != string(types.ServerSideEncryptionAwsKms) {
+		return opts, fmt.Errorf("%s requires %s=%s", sseKMSKeyIDKey, sseKey, types.ServerSideEncryptionAwsKms)
+	}
+	if v, ok := cfg[sseCKeyFileKey]; ok {
+		opts.SSECKeyFile = v
+	}
+	if opts.SSECKeyFile != "" && opts.SSE != "" {
+		return opts, fmt.Errorf("%s can't be combined with %s", sseCKeyFileKey, sseKey)
+	}
+	if v, ok := cfg[storageClassKey]; ok {
+		opts.StorageClass = v
+	}
+	if opts.StorageClass != "" && !slices.Contains(types.StorageClass("").Values(), types.StorageClass(opts.StorageClass)) {
+		return opts, fmt.Errorf("invalid %s %q: must be one of %v", storageClassKey, opts.StorageClass, types.StorageClass("").Values())
+	}
+	if v, ok := cfg[aclKey]; ok {
+		opts.ACL = v
+	}
+	if opts.ACL != "" && !slices.Contains(types.ObjectCannedACL("").Values(), types.ObjectCannedACL(opts.ACL)) {
+		return opts, fmt.Errorf("invalid %s %q: must be one of %v, or unset for buckets with Object Ownership set to bucket owner enforced, which reject ACLs", aclKey, opts.ACL, types.ObjectCannedACL("").Values())
+	}
+	if v, ok := cfg[requestPayerKey]; ok {
+		opts.RequestPayer = v
+	}
+	if opts.RequestPayer != "" && opts.RequestPayer != string(types.RequestPayerRequester) {
+		return opts, fmt.Errorf("invalid %s %q: must be %q or empty", requestPayerKey, opts.RequestPayer, types.RequestPayerRequester)
+	}
+	if v, ok := cfg[objectTagsKey]; ok {
+		tags, err := parseObjectTags(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.ObjectTags = tags
+	}
+	if v, ok := cfg[objectMetadataKey]; ok {
+		metadata, err := parsePairs(objectMetadataKey, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.ObjectMetadata = metadata
+	}
+	if v, ok := cfg[retentionDaysKey]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a non-negative number of days", retentionDaysKey, v)
+		}
+		opts.RetentionDays = n
+	}
+	if v, ok := cfg[retentionExpiresAtKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", retentionExpiresAtKey, v)
+		}
+		opts.RetentionExpiresAt = b
+	}
+	if opts.RetentionDays > 0 {
+		if _, ok := opts.ObjectTags[retentionTag]; ok {
+			return opts, fmt.Errorf("invalid %s: %q is set by %s", objectTagsKey, retentionTag, retentionDaysKey)
+		}
+		if len(opts.ObjectTags) >= maxObjectTags {
+			return opts, fmt.Errorf("invalid %s: S3 allows at most %d tags, and %s adds one to its %d", objectTagsKey, maxObjectTags, retentionDaysKey, len(opts.ObjectTags))
+		}
+	}
+	if v, ok := cfg[verifyWriteKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", verifyWriteKey, v)
+		}
+		opts.VerifyWrite = b
+	}
+	if v, ok := cfg[disableChecksumsKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", disableChecksumsKey, v)
+		}
+		opts.DisableChecksums = b
+	}
+	if v, ok := cfg[manifestKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", manifestKey, v)
+		}
+		opts.Manifest = b
+	}
+	if v, ok := cfg[summaryKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", summaryKey, v)
+		}
+		opts.Summary = b
+	}
+	if v, ok := cfg[exitEventKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", exitEventKey, v)
+		}
+		opts.ExitEvent = b
+	}
+	if v, ok := cfg[deadLetterKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", deadLetterKey, v)
+		}
+		opts.DeadLetter = b
+	}
+	if v, ok := cfg[deadLetterMaxBytesKey]; ok {
+		n, err := units.RAMInBytes(v)
+		if err != nil || n <= 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a positive size", deadLetterMaxBytesKey, v)
+		}
+		opts.DeadLetterMaxBytes = int(n)
+	}
+	if v, ok := cfg[deadLetterFlushIntervalKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a positive duration", deadLetterFlushIntervalKey, v)
+		}
+		opts.DeadLetterFlushInterval = d
+	}
+	if v, ok := cfg[heartbeatIntervalKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a non-negative duration", heartbeatIntervalKey, v)
+		}
+		opts.HeartbeatInterval = d
+	}
+	if v, ok := cfg[slowFlushThresholdKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a non-negative duration", slowFlushThresholdKey, v)
+		}
+		opts.SlowFlushThreshold = d
+	}
+	if v, ok := cfg[indexKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", indexKey, v)
+		}
+		opts.Index = b
+	}
+	if v, ok := cfg[indexIntervalKey]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a positive integer", indexIntervalKey, v)
+		}
+		opts.IndexInterval = n
+	}
+	if opts.Index && (opts.Format != formatJSONL || opts.TimestampFormat == timestampNone) {
+		return opts, fmt.Errorf("%s requires %s=%s with timestamps", indexKey, formatKey, formatJSONL)
+	}
+	if v, ok := cfg[cacheDisabledKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", cacheDisabledKey, v)
+		}
+		opts.CacheDisabled = b
+	}
+	if v, ok := cfg[cacheMaxSizeKey]; ok {
+		n, err := parseSize(cacheMaxSizeKey, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.CacheMaxSize = n
+	}
+	if v, ok := cfg[maxPutsPerContainerKey]; ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || math.IsInf(f, 0) {
+			return opts, fmt.Errorf("invalid %s %q: must be a non-negative number", maxPutsPerContainerKey, v)
+		}
+		opts.MaxPutsPerContainer = f
+	}
+	if v, ok := cfg[cacheDirKey]; ok {
+		opts.CacheDir = v
+	}
+	if !opts.CacheDisabled && opts.CacheDir == "" {
+		return opts, fmt.Errorf("%s=false requires %s", cacheDisabledKey, cacheDirKey)
+	}
+	if v, ok := cfg[filterIncludeKey]; ok {
+		opts.FilterInclude = v
+	}
+	if v, ok := cfg[filterExcludeKey]; ok {
+		opts.FilterExclude = v
+	}
+	for key, pattern := range map[string]string{filterIncludeKey: opts.FilterInclude, filterExcludeKey: opts.FilterExclude} {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return opts, fmt.Errorf("invalid %s %q: %v", key, pattern, err)
+		}
+	}
+	if v, ok := cfg[stripANSIKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", stripANSIKey, v)
+		}
+		opts.StripANSI = b
+	}
+	if v, ok := cfg[skipEmptyKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", skipEmptyKey, v)
+		}
+		opts.SkipEmpty = b
+	}
+	// Lines are filtered, then sampled, then redacted, so sample-key-pattern
+	// sees the lines that filter-include kept and the text before
+	// redact-patterns replaced anything in it.
+	if v, ok := cfg[sampleRateKey]; ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			return opts, fmt.Errorf("invalid %s %q: must be between 0.0 and 1.0", sampleRateKey, v)
+		}
+		opts.SampleRate = f
+	}
+	if v, ok := cfg[samplePatternKey]; ok {
+		opts.SamplePattern = v
+	}
+	if _, err := regexp.Compile(opts.SamplePattern); err != nil {
+		return opts, fmt.Errorf("invalid %s %q: %v", samplePatternKey, opts.SamplePattern, err)
+	}
+	if v, ok := cfg[redactPatternsKey]; ok {
+		patterns, err := parseRedactPatterns(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: %v", redactPatternsKey, v, err)
+		}
+		opts.RedactPatterns = patterns
+	}
+	if v, ok := cfg[redactReplacementKey]; ok {
+		opts.RedactReplacement = v
+	}
+	if v, ok := cfg[multilinePatternKey]; ok {
+		opts.MultilinePattern = v
+	}
+	if _, err := regexp.Compile(opts.MultilinePattern); err != nil {
+		return opts, fmt.Errorf("invalid %s %q: %v", multilinePatternKey, opts.MultilinePattern, err)
+	}
+	if v, ok := cfg[multilineTimeoutKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a positive duration", multilineTimeoutKey, v)
+		}
+		opts.MultilineTimeout = d
+	}
+	if opts.MultilineTimeout <= 0 {
+		opts.MultilineTimeout = defaultMultilineTimeout
+	}
+	if v, ok := cfg[cloudWatchGroupKey]; ok {
+		opts.CloudWatchGroup = v
+	}
+	if v, ok := cfg[cloudWatchStreamTemplateKey]; ok {
+		opts.CloudWatchStreamTemplate = v
+	}
+	if v, ok := cfg[cloudWatchFilterKey]; ok {
+		opts.CloudWatchFilter = v
+	}
+	if opts.CloudWatchStreamTemplate == "" {
+		opts.CloudWatchStreamTemplate = defaultCloudWatchStreamTemplate
+	}
+	if opts.CloudWatchFilter == "" {
+		opts.CloudWatchFilter = defaultCloudWatchFilter
+	}
+	if _, err := regexp.Compile(opts.CloudWatchFilter); err != nil {
+		return opts, fmt.Errorf("invalid %s %q: %v", cloudWatchFilterKey, opts.CloudWatchFilter, err)
+	}
+	if v, ok := cfg[notifySNSKey]; ok {
+		opts.NotifyTopic = v
+	}
+	if opts.NotifyTopic != "" {
+		if _, err := parseTopicARN(opts.NotifyTopic); err != nil {
+			return opts, fmt.Errorf("invalid %s %q: %v", notifySNSKey, opts.NotifyTopic, err)
+		}
+	}
+	if v, ok := cfg[notifySQSKey]; ok {
+		opts.NotifyQueue = v
+	}
+	if opts.NotifyQueue != "" {
+		if _, err := parseQueueURL(opts.NotifyQueue); err != nil {
+			return opts, fmt.Errorf("invalid %s %q: %v", notifySQSKey, opts.NotifyQueue, err)
+		}
+	}
+	if v, ok := cfg[tenantKey]; ok {
+		opts.Tenant = v
+	}
+	if v, ok := cfg[tenantLabelKey]; ok {
+		opts.TenantLabel = v
+	}
+	if v, ok := cfg[s3RegionKey]; ok {
+		opts.S3Region = v
+	}
+	if bucketRegion != "" {
+		opts.S3Region = bucketRegion
+	}
+	if v, ok := cfg[endpointURLKey]; ok {
+		opts.EndpointURL = v
+	}
+	if v, ok := cfg[forcePathStyleKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", forcePathStyleKey, v)
+		}
+		opts.ForcePathStyle = b
+	}
+	if v, ok := cfg[disableSSLKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", disableSSLKey, v)
+		}
+		opts.DisableSSL = b
+	}
+	if opts.SSECKeyFile != "" && (opts.DisableSSL || strings.HasPrefix(opts.EndpointURL, "http://")) {
+		return opts, fmt.Errorf("%s requires HTTPS: S3 refuses customer-provided keys sent in the clear", sseCKeyFileKey)
+	}
+	if v, ok := cfg[accelerateKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", accelerateKey, v)
+		}
+		opts.Accelerate = b
+	}
+	if v, ok := cfg[dualstackKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", dualstackKey, v)
+		}
+		opts.Dualstack = b
+	}
+	if v, ok := cfg[fipsKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", fipsKey, v)
+		}
+		opts.FIPS = b
+	}
+	if v, ok := cfg[caCertFileKey]; ok {
+		opts.CACertFile = v
+	}
+	if v, ok := cfg[insecureSkipVerifyKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", insecureSkipVerifyKey, v)
+		}
+		opts.InsecureSkipVerify = b
+	}
+	if v, ok := cfg[proxyURLKey]; ok {
+		opts.ProxyURL = v
+	}
+	if opts.ProxyURL != "" {
+		if _, err := parseProxyURL(opts.ProxyURL); err != nil {
+			return opts, err
+		}
+	}
+	if v, ok := cfg[noProxyKey]; ok {
+		opts.NoProxy = v
+	}
+	if opts.Accelerate && opts.EndpointURL != "" {
+		return opts, fmt.Errorf("%s can't be combined with %s", accelerateKey, endpointURLKey)
+	}
+	if opts.Accelerate && opts.FIPS {
+		return opts, fmt.Errorf("%s can't be combined with %s, S3 has no FIPS acceleration endpoints", accelerateKey, fipsKey)
+	}
+	if v, ok := cfg[assumeRoleARNKey]; ok {
+		opts.AssumeRoleARN = v
+	}
+	if v, ok := cfg[externalIDKey]; ok {
+		opts.ExternalID = v
+	}
+	if v, ok := cfg[roleSessionKey]; ok {
+		opts.RoleSessionName = v
+	}
+	if v, ok := cfg[accessKeyIDKey]; ok {
+		opts.AccessKeyID = v
+	}
+	if v, ok := cfg[secretKeyKey]; ok {
+		opts.SecretAccessKey = v
+	}
+	if v, ok := cfg[sessionTokenKey]; ok {
+		opts.SessionToken = v
+	}
+	if v, ok := cfg[profileKey]; ok {
+		opts.Profile = v
+	}
+	if (opts.AccessKeyID == "") != (opts.SecretAccessKey == "") {
+		return opts, fmt.Errorf("%s and %s must be set together", accessKeyIDKey, secretKeyKey)
+	}
+	if v, ok := cfg[credentialsFileKey]; ok {
+		opts.CredentialsFile = v
+	}
+	if opts.CredentialsFile != "" {
+		if !filepath.IsAbs(opts.CredentialsFile) {
+			return opts, fmt.Errorf("invalid %s %q: must be an absolute path in the plugin's rootfs", credentialsFileKey, opts.CredentialsFile)
+		}
+		if opts.AccessKeyID != "" {
+			return opts, fmt.Errorf("%s can't be combined with %s", credentialsFileKey, accessKeyIDKey)
+		}
+	}
+	if opts.Compress != compressNone && opts.Compress != compressGzip && opts.Compress != compressZstd {
+		return opts, fmt.Errorf("invalid %s %q: must be %q, %q or empty", compressKey, opts.Compress, compressGzip, compressZstd)
+	}
+	if v, ok := cfg[compressLevelKey]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be an integer", compressLevelKey, v)
+		}
+		opts.CompressLevel = n
+	}
+	if err := validateCompressLevel(opts.Compress, opts.CompressLevel); err != nil {
+		return opts, fmt.Errorf("invalid %s %d: %v", compressLevelKey, opts.CompressLevel, err)
+	}
+	if v, ok := cfg[writeModeKey]; ok {
+		opts.WriteMode = v
+	}
+	if opts.WriteMode != writeModeObject && opts.WriteMode != writeModeMultipartStream {
+		return opts, fmt.Errorf("invalid %s %q: must be %q or %q", writeModeKey, opts.WriteMode, writeModeObject, writeModeMultipartStream)
+	}
+	if v, ok := cfg[multipartWindowKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a positive duration", multipartWindowKey, v)
+		}
+		opts.MultipartWindow = d
+	}
+	if v, ok := cfg[abortIncompleteAfterKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a non-negative duration", abortIncompleteAfterKey, v)
+		}
+		opts.AbortIncompleteAfter = d
+	}
+	if opts.WriteMode == writeModeMultipartStream {
+		if opts.AbortIncompleteAfter > 0 && opts.AbortIncompleteAfter <= opts.MultipartWindow {
+			return opts, fmt.Errorf("invalid %s %s: must be longer than %s %s", abortIncompleteAfterKey, opts.AbortIncompleteAfter, multipartWindowKey, opts.MultipartWindow)
+		}
+		switch {
+		case len(opts.Replicas) > 0:
+			return opts, fmt.Errorf("%s=%s can't be combined with replica buckets", writeModeKey, writeModeMultipartStream)
+		case opts.FailoverBucket != "":
+			return opts, fmt.Errorf("%s=%s can't be combined with %s", writeModeKey, writeModeMultipartStream, failoverBucketKey)
+		case opts.Index:
+			return opts, fmt.Errorf("%s=%s can't be combined with %s", writeModeKey, writeModeMultipartStream, indexKey)
+		case opts.Ordering == orderingStrict:
+			return opts, fmt.Errorf("%s=%s can't be combined with %s=%s", writeModeKey, writeModeMultipartStream, orderingKey, orderingStrict)
+		}
+	}
+	if v, ok := cfg[parquetCompressionKey]; ok {
+		opts.ParquetCompression = v
+	}
+	if _, ok := parquetCodecs[opts.ParquetCompression]; !ok {
+		return opts, fmt.Errorf("invalid %s %q: must be %q or %q", parquetCompressionKey, opts.ParquetCompression, parquetSnappy, parquetZstd)
+	}
+	if opts.Format == formatParquet {
+		switch {
+		case opts.Compress != compressNone:
+			return opts, fmt.Errorf("%s=%s can't be combined with %s, use %s", formatKey, formatParquet, compressKey, parquetCompressionKey)
+		case opts.WriteMode == writeModeMultipartStream:
+			return opts, fmt.Errorf("%s=%s can't be combined with %s=%s", formatKey, formatParquet, writeModeKey, writeModeMultipartStream)
+		case opts.MergeJSONLog:
+			return opts, fmt.Errorf("%s=%s can't be combined with %s", formatKey, formatParquet, mergeJSONLogKey)
+		case opts.TimestampFormat != timestampRFC3339Nano:
+			return opts, fmt.Errorf("%s=%s can't be combined with %s=%s, its time column is always a timestamp", formatKey, formatParquet, timestampKey, opts.TimestampFormat)
+		}
+	}
+	if v, ok := cfg[uploadModeKey]; ok {
+		opts.UploadMode = v
+	}
+	if v, ok := cfg[presignEndpointKey]; ok {
+		opts.PresignEndpoint = v
+	}
+	if v, ok := cfg[presignTokenFileKey]; ok {
+		opts.PresignTokenFile = v
+	}
+	switch opts.UploadMode {
+	case uploadModeS3:
+		if opts.PresignEndpoint != "" {
+			return opts, fmt.Errorf("%s requires %s=%s", presignEndpointKey, uploadModeKey, uploadModePresigned)
+		}
+	case uploadModePresigned:
+		if u, err := url.Parse(opts.PresignEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return opts, fmt.Errorf("invalid %s %q: must be an http or https URL", presignEndpointKey, opts.PresignEndpoint)
+		}
+		if !filepath.IsAbs(opts.PresignTokenFile) {
+			return opts, fmt.Errorf("invalid %s %q: must be an absolute path in the plugin's rootfs", presignTokenFileKey, opts.PresignTokenFile)
+		}
+		// These read from the bucket or call S3 APIs other than PUT, which
+		// a presigned URL doesn't allow.
+		switch {
+		case opts.WriteMode == writeModeMultipartStream:
+			return opts, fmt.Errorf("%s=%s can't be combined with %s=%s", uploadModeKey, uploadModePresigned, writeModeKey, writeModeMultipartStream)
+		case opts.Manifest:
+			return opts, fmt.Errorf("%s=%s can't be combined with %s", uploadModeKey, uploadModePresigned, manifestKey)
+		case opts.Index:
+			return opts, fmt.Errorf("%s=%s can't be combined with %s", uploadModeKey, uploadModePresigned, indexKey)
+		case opts.SSECKeyFile != "":
+			return opts, fmt.Errorf("%s=%s can't be combined with %s", uploadModeKey, uploadModePresigned, sseCKeyFileKey)
+		case opts.KeyLayout == keyLayoutFluentd:
+			return opts, fmt.Errorf("%s=%s can't be combined with %s=%s, which numbers objects by listing the bucket", uploadModeKey, uploadModePresigned, keyLayoutKey, keyLayoutFluentd)
+		}
+	default:
+		return opts, fmt.Errorf("invalid %s %q: must be %q or %q", uploadModeKey, opts.UploadMode, uploadModeS3, uploadModePresigned)
+	}
+	if v, ok := cfg[dedupeWindowKey]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid %s %q: must be a non-negative duration", dedupeWindowKey, v)
+		}
+		opts.DedupeWindow = d
+	}
+	if v, ok := cfg[dedupeGranularityKey]; ok {
+		opts.DedupeGranularity = v
+	}
+	if opts.DedupeGranularity != dedupeBatch && opts.DedupeGranularity != dedupeRecord {
+		return opts, fmt.Errorf("invalid %s %q: must be %q or %q", dedupeGranularityKey, opts.DedupeGranularity, dedupeBatch, dedupeRecord)
+	}
+	if opts.DedupeWindow > 0 && opts.WriteMode == writeModeMultipartStream {
+		return opts, fmt.Errorf("%s can't be combined with %s=%s", dedupeWindowKey, writeModeKey, writeModeMultipartStream)
+	}
+	if v, ok := cfg[verifyAfterWriteKey]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: must be a boolean", verifyAfterWriteKey, v)
+		}
+		opts.VerifyAfterWrite = b
+	}
+	if v, ok := cfg[verifySampleRateKey]; ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			return opts, fmt.Errorf("invalid %s %q: must be between 0.0 and 1.0", verifySampleRateKey, v)
+		}
+		opts.VerifySampleRate = f
+	}
+	if opts.VerifyAfterWrite {
+		switch {
+		case opts.UploadMode == uploadModePresigned:
+			return opts, fmt.Errorf("%s can't be combined with %s=%s, which has no credentials to look objects up with", verifyAfterWriteKey, uploadModeKey, uploadModePresigned)
+		case opts.WriteMode == writeModeMultipartStream:
+			return opts, fmt.Errorf("%s can't be combined with %s=%s", verifyAfterWriteKey, writeModeKey, writeModeMultipartStream)
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,273 @@
+package s3log
+
+import (
+	"encoding/base64"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// logOptTest holds, for a log-opt, a value StartLogging accepts and, if it
+// checks the opt, one it refuses. with holds the log-opts the values need
+// alongside them, and badWith, if set, those the bad value is refused with
+// instead.
+type logOptTest struct {
+	key           string
+	good, bad     string
+	with, badWith map[string]string
+}
+
+// logOptTests returns a test for every log-opt, writing the files the good
+// values point at.
+func logOptTests(t *testing.T) []logOptTest {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(make([]byte, sseCKeySize))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	https := map[string]string{endpointURLKey: "https://s3.test"}
+	return []logOptTest{
+		{key: s3BucketKey, good: "logs@eu-west-1,replica@us-east-1", bad: "logs,,replica"},
+		{key: failoverBucketKey, good: "standby", bad: testBucket},
+		{key: failoverAfterKey, good: "1m", bad: "-1m"},
+		{key: s3PrefixKey, good: "team/${S3LOG_TEST_UNSET:-web}", bad: "team/${S3LOG_TEST_UNSET}"},
+		{key: flushIntervalKey, good: "5s", bad: "0"},
+		{key: flushBytesKey, good: "512k", bad: "lots"},
+		{key: adaptiveFlushKey, good: "true", bad: "sometimes"},
+		{key: adaptiveFlushMinKey, good: "64k", bad: "-1"},
+		{key: adaptiveFlushMaxKey, good: "1m", bad: "1k", with: map[string]string{adaptiveFlushKey: "true", adaptiveFlushMinKey: "64k"}},
+		{key: startupGraceKey, good: "10s", bad: "-1s"},
+		{key: coalesceWindowKey, good: "100ms", bad: "soon"},
+		{key: compressKey, good: compressZstd, bad: "lz4"},
+		{key: compressLevelKey, good: "3", bad: "high", with: map[string]string{compressKey: compressGzip}},
+		{key: strictOptsKey, good: "false", bad: "maybe"},
+		{key: keyTemplateKey, good: "{{.ContainerName}}/{{.Timestamp}}.log", bad: "{{.Nope"},
+		{key: partSizeKey, good: "8m", bad: "1k"},
+		{key: concurrencyKey, good: "8", bad: "0"},
+		{key: shutdownFlushKey, good: "30s", bad: "0"},
+		{key: maxRetriesKey, good: "0", bad: "-1"},
+		{key: maxRetryDelayKey, good: "10s", bad: "0"},
+		{key: spoolDirKey, good: "/var/spool/s3"},
+		{key: spoolMaxBytesKey, good: "1g", bad: "0"},
+		{key: stateDirKey, good: "/var/lib/s3"},
+		{key: walKey, good: "true", bad: "yes please", with: map[string]string{walDirKey: "/var/lib/wal"}},
+		{key: walDirKey, good: "/var/lib/wal"},
+		{key: modeKey, good: modeNonBlocking, bad: "async"},
+		{key: stdoutModeKey, good: modeNonBlocking, bad: "async"},
+		{key: stderrModeKey, good: modeBlocking, bad: "async"},
+		{key: orderingKey, good: orderingStrict, bad: "loose"},
+		{key: maxBufferSizeKey, good: "4m", bad: "1k"},
+		{key: sseKey, good: "AES256", bad: "rot13"},
+		{key: sseKMSKeyIDKey, good: "alias/logs", bad: "alias/logs", with: map[string]string{sseKey: "aws:kms"}, badWith: map[string]string{sseKey: "AES256"}},
+		{key: sseCKeyFileKey, good: keyFile, bad: keyFile, with: https, badWith: map[string]string{disableSSLKey: "true"}},
+		{key: tagKey, good: "{{.Name}}", bad: "{{.Name"},
+
+		{key: s3RequestTimeoutKey, good: "30s", bad: "-1s"},
+		{key: walSyncIntervalKey, good: "1s", bad: "-1s"},
+		{key: walSegmentBytesKey, good: "64m", bad: "0"},
+		{key: walRetentionKey, good: "24h", bad: "-1h"},
+		{key: keyUniqueSuffixKey, good: uniqueSuffixTimestampNano, bad: "uuid"},
+		{key: keyLayoutKey, good: keyLayoutFluentd, bad: "flat"},
+		{key: timeSliceFormatKey, good: "%Y%m%d%H", bad: "%Q"},
+		{key: maxLineBytesKey, good: "16k", bad: "-1"},
+		{key: maxPartialBytesKey, good: "1m", bad: "-1"},
+		{key: maxPartialAgeKey, good: "1m", bad: "-1m"},
+		{key: maxPartialGroupsKey, good: "100", bad: "0"},
+		{key: maxRecordBytesKey, good: "256k", bad: "1"},
+		{key: oversizePolicyKey, good: oversizeTruncate, bad: "drop"},
+		{key: filterIncludeKey, good: "ERROR", bad: "("},
+		{key: stripANSIKey, good: "true", bad: "on"},
+		{key: skipEmptyKey, good: "true", bad: "on"},
+		{key: filterExcludeKey, good: "^DEBUG", bad: "["},
+		{key: sampleRateKey, good: "0.5", bad: "2"},
+		{key: samplePatternKey, good: "^INFO", bad: "("},
+		{key: redactPatternsKey, good: `password=\S+`, bad: "("},
+		{key: redactReplacementKey, good: "[redacted]"},
+		{key: multilinePatternKey, good: `^\d{4}-`, bad: "("},
+		{key: multilineTimeoutKey, good: "2s", bad: "0"},
+
+		{key: cloudWatchGroupKey, good: "/docker/logs"},
+		{key: cloudWatchStreamTemplateKey, good: "{{.ContainerName}}", with: map[string]string{cloudWatchGroupKey: "/docker/logs"}},
+		{key: cloudWatchFilterKey, good: "ERROR", bad: "("},
+		{key: notifySNSKey, good: "arn:aws:sns:us-east-1:123456789012:logs", bad: "logs"},
+		{key: notifySQSKey, good: "https://sqs.us-east-1.amazonaws.com/123456789012/logs", bad: "logs"},
+		{key: storageClassKey, good: "STANDARD_IA", bad: "CHEAP"},
+		{key: aclKey, good: "bucket-owner-full-control", bad: "everyone"},
+		{key: requestPayerKey, good: "requester", bad: "me"},
+		{key: verifyWriteKey, good: "true", bad: "on"},
+		{key: disableChecksumsKey, good: "true", bad: "on"},
+		{key: manifestKey, good: "true", bad: "on"},
+		{key: summaryKey, good: "true", bad: "on"},
+		{key: exitEventKey, good: "true", bad: "on"},
+		{key: deadLetterKey, good: "true", bad: "on"},
+		{key: deadLetterMaxBytesKey, good: "1m", bad: "0"},
+		{key: deadLetterFlushIntervalKey, good: "1m", bad: "0"},
+		{key: indexKey, good: "true", bad: "on"},
+		{key: heartbeatIntervalKey, good: "1m", bad: "-1m"},
+		{key: slowFlushThresholdKey, good: "10s", bad: "-1s"},
+		{key: indexIntervalKey, good: "100", bad: "0"},
+		{key: maxPutsPerContainerKey, good: "2.5", bad: "-1"},
+		{key: cacheDisabledKey, good: "true", bad: "on"},
+		{key: cacheMaxSizeKey, good: "100m", bad: "0"},
+		{key: cacheDirKey, good: "/var/cache/s3"},
+		{key: retentionDaysKey, good: "30", bad: "-1"},
+		{key: retentionExpiresAtKey, good: "true", bad: "on", with: map[string]string{retentionDaysKey: "30"}},
+		{key: writeModeKey, good: writeModeMultipartStream, bad: "append"},
+		{key: multipartWindowKey, good: "5m", bad: "0", with: map[string]string{writeModeKey: writeModeMultipartStream}},
+		{key: abortIncompleteAfterKey, good: "2h", bad: "1s", with: map[string]string{writeModeKey: writeModeMultipartStream}},
+		{key: parquetCompressionKey, good: parquetZstd, bad: "brotli", with: map[string]string{formatKey: formatParquet}},
+		{key: uploadModeKey, good: uploadModePresigned, bad: "ftp", with: map[string]string{presignEndpointKey: "https://presign.test", presignTokenFileKey: "/run/secrets/token"}},
+		{key: presignEndpointKey, good: "https://presign.test", bad: "presign.test", with: map[string]string{uploadModeKey: uploadModePresigned, presignTokenFileKey: "/run/secrets/token"}},
+		{key: presignTokenFileKey, good: "/run/secrets/token", bad: "token", with: map[string]string{uploadModeKey: uploadModePresigned, presignEndpointKey: "https://presign.test"}},
+		{key: dedupeWindowKey, good: "1m", bad: "-1m"},
+		{key: dedupeGranularityKey, good: dedupeRecord, bad: "line"},
+		{key: verifyAfterWriteKey, good: "true", bad: "on"},
+		{key: verifySampleRateKey, good: "0.1", bad: "-0.1"},
+
+		{key: objectTagsKey, good: "team=logs,env=prod", bad: "team"},
+		{key: objectMetadataKey, good: "team=logs", bad: "team"},
+		{key: labelsKey, good: "com.example.team"},
+		{key: labelsRegexKey, good: `^com\.example\.`, bad: "("},
+		{key: envKey, good: "APP_VERSION"},
+		{key: envRegexKey, good: "^APP_", bad: "("},
+		{key: formatKey, good: formatRaw, bad: "xml"},
+		{key: timestampKey, good: timestampUnixMs, bad: "iso"},
+		{key: mergeJSONLogKey, good: "true", bad: "on"},
+		{key: groupByLabelKey, good: "com.example.team", bad: ","},
+		{key: splitStreamsKey, good: "true", bad: "on"},
+		{key: maxObjectSizeKey, good: "64m", bad: "0"},
+
+		{key: partitionByKey, good: partitionDay, bad: "week"},
+		{key: partitionTimezoneKey, good: "Europe/Amsterdam", bad: "Mars/Olympus"},
+		{key: maxFutureSkewKey, good: "1m", bad: "-1m"},
+		{key: stableKeySourceKey, good: "label:com.example.service", bad: "hostname"},
+		{key: readPriorRunsKey, good: "true", bad: "on"},
+		{key: readConcurrencyKey, good: "4", bad: "0"},
+		{key: readBufferBytesKey, good: "1m", bad: "0"},
+
+		{key: tenantKey, good: "team-a"},
+		{key: tenantLabelKey, good: "com.example.tenant"},
+
+		{key: s3RegionKey, good: "eu-west-1"},
+		{key: endpointURLKey, good: "https://minio.test:9000"},
+		{key: forcePathStyleKey, good: "true", bad: "on"},
+		{key: disableSSLKey, good: "true", bad: "on"},
+		{key: accelerateKey, good: "true", bad: "on", with: map[string]string{endpointURLKey: ""}},
+		{key: dualstackKey, good: "true", bad: "on"},
+		{key: fipsKey, good: "true", bad: "on"},
+		{key: caCertFileKey, good: "/etc/ssl/ca.pem"},
+		{key: insecureSkipVerifyKey, good: "true", bad: "on"},
+		{key: proxyURLKey, good: "http://proxy.test:3128", bad: "ftp://proxy.test"},
+		{key: noProxyKey, good: "169.254.169.254"},
+		{key: assumeRoleARNKey, good: "arn:aws:iam::123456789012:role/logs"},
+		{key: externalIDKey, good: "logs"},
+		{key: roleSessionKey, good: "logs"},
+		{key: accessKeyIDKey, good: "AKIDEXAMPLE", bad: "AKIDEXAMPLE", with: map[string]string{secretKeyKey: "secret"}, badWith: map[string]string{}},
+		{key: secretKeyKey, good: "secret", bad: "secret", with: map[string]string{accessKeyIDKey: "AKIDEXAMPLE"}, badWith: map[string]string{}},
+		{key: sessionTokenKey, good: "token"},
+		{key: profileKey, good: "logs"},
+		{key: credentialsFileKey, good: "/run/secrets/aws", bad: "aws"},
+	}
+}
+
+func TestLogOpts(t *testing.T) {
+	fake := newFakeS3()
+	d := newTestDriver(t, fake, nil)
+	validate := func(t *testing.T, cfg map[string]string) error {
+		info := Info{Config: testLogOpts(t, cfg), ContainerID: testContainerID(t), ContainerName: "/test"}
+		_, err := validateContainer(d, info, false, false, 0)
+		return err
+	}
+	for _, tt := range logOptTests(t) {
+		t.Run(tt.key, func(t *testing.T) {
+			cfg := map[string]string{tt.key: tt.good}
+			maps.Copy(cfg, tt.with)
+			if err := validate(t, cfg); err != nil {
+				t.Errorf("%s=%s refused: %v", tt.key, tt.good, err)
+			}
+			if tt.bad == "" {
+				return
+			}
+			cfg = map[string]string{tt.key: tt.bad}
+			if tt.badWith != nil {
+				maps.Copy(cfg, tt.badWith)
+			} else {
+				maps.Copy(cfg, tt.with)
+			}
+			err := validate(t, cfg)
+			if err == nil {
+				t.Fatalf("%s=%s accepted", tt.key, tt.bad)
+			}
+			if !strings.Contains(err.Error(), tt.key) {
+				t.Errorf("%s=%s refused with %q, which doesn't name it", tt.key, tt.bad, err)
+			}
+		})
+	}
+}
+
+func TestLogOptsCovered(t *testing.T) {
+	tested := make(map[string]bool)
+	for _, tt := range logOptTests(t) {
+		tested[tt.key] = true
+	}
+	for k := range logOptKeys {
+		if !tested[k] {
+			t.Errorf("log-opt %s has no test in logOptTests", k)
+		}
+	}
+}
+
+func TestValidateLogOpt(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		want string
+	}{
+		{name: "known", cfg: map[string]string{s3BucketKey: "logs", modeKey: modeNonBlocking, maxBufferSizeKey: "4m"}},
+		{name: "typo", cfg: map[string]string{"s3_bucket": "logs"}, want: "s3_bucket (did you mean s3-bucket?)"},
+		{name: "no suggestion", cfg: map[string]string{"colour": "red"}, want: "log driver: colour"},
+		{name: "listed in order", cfg: map[string]string{"zzz": "", "aaa": ""}, want: "aaa, zzz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateLogOpt(tt.cfg)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("refused: %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStrictOpts(t *testing.T) {
+	cfg := testLogOpts(t, map[string]string{"s3_bucket": "elsewhere"})
+	if _, err := parseLogOpts(DefaultOptions(), cfg); err == nil {
+		t.Error("unknown log-opt accepted")
+	}
+	cfg[strictOptsKey] = "false"
+	opts, err := parseLogOpts(DefaultOptions(), cfg)
+	if err != nil {
+		t.Fatalf("unknown log-opt refused with %s=false: %v", strictOptsKey, err)
+	}
+	if opts.S3Bucket != testBucket {
+		t.Errorf("logging to %q, want %q", opts.S3Bucket, testBucket)
+	}
+}
+
+func TestStartLoggingRefusesBadOpts(t *testing.T) {
+	fake := newFakeS3()
+	d := newTestDriver(t, fake, nil)
+	info := Info{
+		Config:        testLogOpts(t, map[string]string{modeKey: "async"}),
+		ContainerID:   testContainerID(t),
+		ContainerName: "/test",
+	}
+	// The FIFO doesn't exist: the opts must be refused before it is opened.
+	err := d.StartLogging(filepath.Join(t.TempDir(), "fifo"), info)
+	if err == nil || !strings.Contains(err.Error(), modeKey) {
+		t.Errorf("StartLogging returned %v, want %s refused", err, modeKey)
+	}
+}
@@ -0,0 +1,89 @@
+package s3log
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	orderingKey = "ordering"
+
+	orderingRelaxed = "relaxed"
+	orderingStrict  = "strict"
+)
+
+// With ordering=strict a container's objects reach each bucket in the order
+// they were flushed, so that if one exists every object before it does: a
+// batch is never dropped or skipped past. Flushes already upload one batch at
+// a time, each waiting for the last, so what strict changes is what happens
+// once a batch has exhausted its retries, and to batches flushed while an
+// earlier one is spooled.
+
+// strict reports whether the logger keeps its objects in strict order.
+func (l *S3Logger) strict() bool {
+	return l.opts.Ordering == orderingStrict
+}
+
+// holdFailed keeps b, which failed to upload to t with err once its retries
+// were exhausted, from being skipped past. In non-blocking mode, of either
+// stream, with a spool it is spooled, and the spool uploads it ahead of the
+// batches spooled after it; otherwise send, which retries the upload, is
+// called again every max-retry-delay, holding up the flushes behind it,
+// until it succeeds or ctx is done. It reports whether b was spooled, and returns the error of
+// the last upload attempt, which is nil once one succeeds.
+func (l *S3Logger) holdFailed(ctx context.Context, t *target, b *batch, log *logrus.Entry, err error, send func() error) (bool, error) {
+	for err != nil && ctx.Err() == nil {
+		if l.nonBlocking() && l.spool != nil {
+			serr := l.spoolBatch(ctx, b)
+			if serr == nil {
+				t.metrics.spooled.Inc()
+				t.record(b, true)
+				log.WithError(err).Warn("spooled batch to disk after failing to upload it")
+				return true, err
+			}
+			log.WithError(serr).Error("error spooling batch")
+		}
+		log.WithError(err).Warnf("error uploading logs, holding later objects back until it succeeds, %s=%s", orderingKey, orderingStrict)
+		if !sleepContext(ctx, max(l.opts.MaxRetryDelay, retryBaseDelay)) {
+			break
+		}
+		err = send()
+	}
+	return false, err
+}
+
+// queueBehindSpool spools b, due for t, if the container has batches spooled
+// already, so that it is uploaded after them rather than ahead of them. A
+// batch that can't be spooled waits for the spool to drain instead. It
+// reports whether b was spooled, or is to be dropped with the returned error
+// because ctx was done first.
+func (l *S3Logger) queueBehindSpool(ctx context.Context, t *target, b *batch, log *logrus.Entry) (bool, error) {
+	for l.spool.holds(b.ContainerID) {
+		err := l.spoolBatch(ctx, b)
+		if err == nil {
+			t.metrics.spooled.Inc()
+			t.record(b, true)
+			log.Debug("spooled batch to disk behind the container's spooled batches")
+			return true, nil
+		}
+		log.WithError(err).Error("error spooling batch, waiting for the container's spooled batches to drain")
+		if !sleepContext(ctx, spoolDrainInterval) {
+			return true, ctx.Err()
+		}
+	}
+	return false, nil
+}
+
+// sleepContext waits for d, reporting false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,151 @@
+package s3log
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// orderedPuts fails every PutObject to fake until healed, recording the key
+// of each attempt and, once healed, of each upload.
+type orderedPuts struct {
+	mu       sync.Mutex
+	healed   bool
+	attempts []string
+	uploads  []string
+}
+
+func newOrderedPuts(fake *fakeS3) *orderedPuts {
+	p := &orderedPuts{}
+	fake.before = func(_ context.Context, op, _, key string) error {
+		if op != "PutObject" {
+			return nil
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.attempts = append(p.attempts, key)
+		if !p.healed {
+			return fakeStatusError(http.StatusServiceUnavailable, "ServiceUnavailable")
+		}
+		p.uploads = append(p.uploads, key)
+		return nil
+	}
+	return p
+}
+
+func (p *orderedPuts) heal() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.healed = true
+}
+
+// tried returns the keys attempted so far.
+func (p *orderedPuts) tried() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.attempts)
+}
+
+func (p *orderedPuts) uploaded() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.uploads)
+}
+
+// lineSequence returns the number of the last line l buffered.
+func lineSequence(l *S3Logger) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lineSeq
+}
+
+func TestStrictOrdering(t *testing.T) {
+	// Object 1 fails until S3 heals. Nothing after it is attempted before
+	// it is uploaded, and once healed all three are uploaded in order.
+	tests := []struct {
+		name    string
+		cfg     map[string]string
+		spooled bool // whether failed batches go to the spool
+	}{
+		{name: "blocking", cfg: map[string]string{modeKey: modeBlocking}},
+		{name: "blocking with a spool", cfg: map[string]string{modeKey: modeBlocking, spoolDirKey: "spool"}},
+		{name: "non-blocking without a spool", cfg: map[string]string{modeKey: modeNonBlocking}},
+		{name: "non-blocking with a spool", cfg: map[string]string{modeKey: modeNonBlocking, spoolDirKey: "spool"}, spooled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			puts := newOrderedPuts(fake)
+			cfg := map[string]string{
+				orderingKey:      orderingStrict,
+				maxRetriesKey:    "0",
+				maxRetryDelayKey: "1ms",
+				flushIntervalKey: "1h",
+			}
+			maps.Copy(cfg, tt.cfg)
+			if cfg[spoolDirKey] != "" {
+				cfg[spoolDirKey] = t.TempDir()
+			}
+			l := newTestLogger(t, fake, cfg)
+
+			const objects = 3
+			flushed := make(chan struct{})
+			go func() {
+				defer close(flushed)
+				for i := range objects {
+					if err := l.Log(&Message{Line: []byte(fmt.Sprintf("object %d", i+1)), Source: "stdout", Timestamp: time.Now()}); err != nil {
+						t.Error(err)
+						return
+					}
+					// In non-blocking mode the line is only buffered
+					// once the ring hands it on.
+					for lineSequence(l) <= int64(i) {
+						time.Sleep(time.Millisecond)
+					}
+					if err := l.flush(context.Background()); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+			if tt.spooled {
+				// The flushes go on, spooling each batch behind the
+				// first, and draining the spool stops at it.
+				<-flushed
+				if n := l.spool.count(); n != objects {
+					t.Fatalf("%d batches spooled, want %d", n, objects)
+				}
+				for range 3 {
+					l.spool.drain(context.Background())
+				}
+			} else {
+				waitFor(t, "retries of object 1", func() bool { return len(puts.tried()) >= 3 })
+			}
+			tried := puts.tried()
+			for _, key := range tried {
+				if key != tried[0] {
+					t.Fatalf("attempted %q before the first object was uploaded", tried)
+				}
+			}
+
+			puts.heal()
+			if tt.spooled {
+				l.spool.drain(context.Background())
+			}
+			<-flushed
+			got := puts.uploaded()
+			if len(got) != objects || got[0] != tried[0] || !slices.IsSorted(got) {
+				t.Errorf("uploaded %q, want %d objects from %s in order", got, objects, tried[0])
+			}
+			want := []string{"object 1", "object 2", "object 3"}
+			if lines := uploadedLines(t, fake, l); !slices.Equal(lines, want) {
+				t.Errorf("uploaded %q, want %q", lines, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package s3log
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+const (
+	maxRecordBytesKey = "max-record-bytes"
+	oversizePolicyKey = "oversize-policy"
+
+	oversizeSplit    = "split"
+	oversizeTruncate = "truncate"
+
+	// minRecordBytes is the smallest max-record-bytes, which leaves room
+	// for the fields of a record besides some of its line.
+	minRecordBytes = 1024
+)
+
+// encodeRecord appends msg, the seq'th line the container logged, to dst as
+// encode does, unless it is a jsonl record over max-record-bytes. Such a
+// record is cut after redaction, so that the limit is checked against what
+// is stored, and has its line either split across records numbered from seq
+// on, sharing a record_id and numbered by part out of total, or truncated
+// and marked truncated, as oversize-policy says. A part is written as a log
+// field even with merge-json-log, since a piece of an object isn't one. It
+// returns the number of records appended.
+func (l *S3Logger) encodeRecord(dst []byte, msg *Message, seq int64) ([]byte, int64) {
+	start := len(dst)
+	dst = l.encode(dst, msg, seq)
+	limit := l.opts.MaxRecordBytes
+	f, ok := l.format.(jsonlFormat)
+	if limit <= 0 || !ok || len(dst)-start <= limit {
+		return dst, 1
+	}
+	dst = dst[:start]
+	// Numbers are reserved at the most digits a part could need.
+	widest := strconv.Itoa(len(msg.Line))
+	if l.opts.OversizePolicy == oversizeTruncate {
+		extra := []byte(`,"truncated":true`)
+		fit := limit - f.fragmentSize(msg, seq, extra)
+		part := *msg
+		part.Line = splitLine(msg.Line, fit)[0]
+		return f.encodeFragment(dst, &part, seq, extra), 1
+	}
+	id := newULID(msg.Timestamp)
+	reserved := []byte(`,"record_id":"` + id + `","part":` + widest + `,"total":` + widest)
+	parts := splitLine(msg.Line, limit-f.fragmentSize(msg, seq+int64(len(msg.Line)), reserved))
+	total := strconv.Itoa(len(parts))
+	for i, line := range parts {
+		part := *msg
+		part.Line = line
+		extra := []byte(`,"record_id":"` + id + `","part":` + strconv.Itoa(i+1) + `,"total":` + total)
+		dst = f.encodeFragment(dst, &part, seq+int64(i), extra)
+	}
+	return dst, int64(len(parts))
+}
+
+// encodeFragment appends a record of msg, whose line is a piece of the
+// seq'th line, with extra, the fields saying which, after its other fields.
+func (f jsonlFormat) encodeFragment(dst []byte, msg *Message, seq int64, extra []byte) []byte {
+	dst = append(dst, `{"log":`...)
+	dst = appendJSONString(dst, msg.Line)
+	dst = append(dst, `,"stream":`...)
+	dst = f.appendFields(dst, msg, seq)
+	dst = append(dst, extra...)
+	return append(dst, f.suffix...)
+}
+
+// fragmentSize returns the size of a fragment of msg with extra, less its
+// line.
+func (f jsonlFormat) fragmentSize(msg *Message, seq int64, extra []byte) int {
+	empty := *msg
+	empty.Line = nil
+	return len(f.encodeFragment(nil, &empty, seq, extra))
+}
+
+// splitLine cuts line into pieces that take at most n bytes each once
+// escaped as a JSON string, without cutting a UTF-8 sequence. Each piece
+// holds at least one character, however small n is.
+func splitLine(line []byte, n int) [][]byte {
+	var pieces [][]byte
+	start, size := 0, 0
+	for i := 0; i < len(line); {
+		width, length := escapedWidth(line[i:])
+		if size+width > n && i > start {
+			pieces = append(pieces, line[start:i])
+			start, size = i, 0
+		}
+		size += width
+		i += length
+	}
+	return append(pieces, line[start:])
+}
+
+// escapedWidth returns how many bytes the character that s starts with
+// takes escaped by appendJSONString, and how many it takes in s.
+func escapedWidth(s []byte) (int, int) {
+	if b := s[0]; b < utf8.RuneSelf {
+		switch {
+		case b == '"', b == '\\', b == '\n', b == '\r', b == '\t':
+			return 2, 1
+		case b < 0x20:
+			return 6, 1
+		}
+		return 1, 1
+	}
+	r, size := utf8.DecodeRune(s)
+	if r == utf8.RuneError && size == 1 {
+		return len(`\ufffd`), 1
+	}
+	return size, size
+}
+
+// joinParts returns an emitFunc passing messages on to emit, with the parts
+// of a line split for max-record-bytes joined back into it. A part whose
+// line is incomplete, as the first of a tail or seek may be, is passed on
+// as it is when the next message arrives.
+func joinParts(emit emitFunc) emitFunc {
+	var pending *Message
+	var id string
+	var next int
+	return func(msg *Message) bool {
+		p := msg.PLogMetaData
+		msg.PLogMetaData = nil
+		if pending != nil && (p == nil || p.ID != id || p.Ordinal != next) {
+			pending.Line = append(pending.Line, '\n')
+			if !emit(pending) {
+				return false
+			}
+			pending = nil
+		}
+		if p == nil {
+			return emit(msg)
+		}
+		if pending == nil {
+			pending, id = msg, p.ID
+		} else {
+			pending.Line = append(pending.Line, msg.Line...)
+		}
+		next = p.Ordinal + 1
+		if !p.Last {
+			return true
+		}
+		joined := pending
+		pending = nil
+		return emit(joined)
+	}
+}
+
+// partMetaData returns what joinParts needs to know of rec, a part of a split
+// line, or nil if it isn't one.
+func partMetaData(rec record) *PartialLogMetaData {
+	if rec.RecordID == "" || rec.Part <= 0 {
+		return nil
+	}
+	return &PartialLogMetaData{ID: rec.RecordID, Ordinal: rec.Part, Last: rec.Part >= rec.Total}
+}
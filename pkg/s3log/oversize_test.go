@@ -0,0 +1,131 @@
+package s3log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		n    int
+		want []string
+	}{
+		{name: "fits", line: "abc", n: 3, want: []string{"abc"}},
+		{name: "ascii", line: "abcdefg", n: 3, want: []string{"abc", "def", "g"}},
+		// An escape counts as the two bytes it takes.
+		{name: "escapes", line: `a"b\c`, n: 3, want: []string{`a"`, `b\`, "c"}},
+		{name: "control", line: "a\x01b", n: 6, want: []string{"a", "\x01", "b"}},
+		{name: "multibyte", line: "aééé", n: 4, want: []string{"aé", "éé"}},
+		// Invalid UTF-8 takes the six bytes of the � it is escaped to.
+		{name: "invalid UTF-8", line: "ab\xffc", n: 6, want: []string{"ab", "\xff", "c"}},
+		// However small n is, a piece holds a whole character.
+		{name: "under a character", line: "éx", n: 1, want: []string{"é", "x"}},
+		{name: "empty", line: "", n: 3, want: []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, p := range splitLine([]byte(tt.line), tt.n) {
+				got = append(got, string(p))
+			}
+			if strings.Join(got, "\x00") != strings.Join(tt.want, "\x00") {
+				t.Errorf("splitLine(%q, %d) = %q, want %q", tt.line, tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+// oversizePayload returns a single-line JSON object of about size bytes,
+// with secret in the middle of it and multibyte and escaped text all
+// through it.
+func oversizePayload(size int, secret string) string {
+	var b strings.Builder
+	b.WriteString(`{"msg":"big","items":[`)
+	for i := 0; b.Len() < size/2; i++ {
+		fmt.Fprintf(&b, `"item %d: héllo \"wörld\"",`, i)
+	}
+	fmt.Fprintf(&b, `"token=%s",`, secret)
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, `"item %d: ☃\t",`, i)
+	}
+	b.WriteString(`"end"]}`)
+	return b.String()
+}
+
+func TestOversizeRecords(t *testing.T) {
+	const (
+		limit  = 1 << 20
+		secret = "s3cr3t-value-0123456789"
+	)
+	payload := oversizePayload(5<<20, secret)
+	redacted := strings.Replace(payload, secret, defaultRedactReplacement, 1)
+	for _, policy := range []string{oversizeSplit, oversizeTruncate} {
+		t.Run(policy, func(t *testing.T) {
+			fake := newFakeS3()
+			l := newTestLogger(t, fake, map[string]string{
+				maxRecordBytesKey: "1MiB",
+				oversizePolicyKey: policy,
+				mergeJSONLogKey:   "true",
+				redactPatternsKey: `s3cr3t-value-\d+`,
+				maxObjectSizeKey:  "2MiB",
+				flushIntervalKey:  "1h",
+			})
+			logLines(t, l, time.Now(), "before", payload, "after")
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var parts int
+			for _, key := range fake.logKeys(testBucket) {
+				o, _ := fake.object(testBucket, key)
+				for _, line := range bytes.SplitAfter(o.data, []byte{'\n'}) {
+					if len(line) == 0 {
+						continue
+					}
+					if len(line) > limit {
+						t.Errorf("record of %d bytes in %s, over max-record-bytes", len(line), key)
+					}
+					var rec record
+					if err := json.Unmarshal(line, &rec); err != nil {
+						t.Fatalf("invalid record in %s: %v", key, err)
+					}
+					if bytes.Contains(line, []byte(secret)) {
+						t.Errorf("record in %s holds the secret", key)
+					}
+					if rec.RecordID != "" {
+						parts++
+					}
+				}
+			}
+
+			got := readLogs(t, l, ReadConfig{Tail: -1})
+			if len(got) != 3 || got[0] != "before" || got[2] != "after" {
+				t.Fatalf("read %d lines, want the payload between before and after", len(got))
+			}
+			switch policy {
+			case oversizeSplit:
+				if parts < 5 {
+					t.Errorf("payload split into %d parts, want at least 5", parts)
+				}
+				if got[1] != redacted {
+					t.Errorf("read back %d bytes, want the %d of the redacted payload", len(got[1]), len(redacted))
+				}
+			case oversizeTruncate:
+				if parts != 0 {
+					t.Errorf("%d parts written, want none", parts)
+				}
+				line, ok := strings.CutSuffix(got[1], lineTruncatedMarker)
+				if !ok || !strings.HasPrefix(redacted, line) || len(line) > limit || !utf8.ValidString(line) {
+					t.Errorf("read back %.40q... of %d bytes, want a prefix of the payload ending in %q", got[1], len(got[1]), lineTruncatedMarker)
+				}
+			}
+		})
+	}
+}
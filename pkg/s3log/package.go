@@ -0,0 +1,327 @@
+package s3log
+
+import (
+	"debug/elf"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// pluginEntrypoint is where the binary is staged in the rootfs.
+	pluginEntrypoint = "/usr/bin/docker-log-driver"
+
+	// pluginInterface is the plugin type the daemon hands containers' logs
+	// to.
+	pluginInterface = "docker.logdriver/1.0"
+
+	// pluginAWSDir and pluginCACert are where --aws-dir and --ca-cert are
+	// mounted in the plugin. The plugin runs as root, so the SDK finds the
+	// shared config and credentials files in pluginAWSDir.
+	pluginAWSDir = "/root/.aws"
+	pluginCACert = "/etc/" + driverName + "/ca.pem"
+
+	// pluginRootsPath is where the rootfs holds the system roots, which a
+	// static binary has no other way of finding.
+	pluginRootsPath = "/etc/ssl/certs/ca-certificates.crt"
+)
+
+// systemRoots are the usual locations of the host's CA bundle, copied into
+// the rootfs when --system-roots isn't given.
+var systemRoots = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// pluginEnv lists the environment passed through to the plugin, each
+// settable with docker plugin set.
+var pluginEnv = []pluginEnvVar{
+	{Name: "LOG_LEVEL", Description: "Level of the plugin's own logs: debug, info, warn or error", Value: "info"},
+	{Name: "DEBUG", Description: "Set to 1 to force debug logs"},
+	{Name: "S3LOGDRIVER_CONFIG_FILE", Description: "Path of the plugin's config file inside the plugin, re-read on SIGHUP"},
+	{Name: "AWS_REGION", Description: "Region of the default S3 client"},
+	{Name: "AWS_ACCESS_KEY_ID", Description: "Access key of the default credentials"},
+	{Name: "AWS_SECRET_ACCESS_KEY", Description: "Secret key of the default credentials"},
+	{Name: "AWS_SESSION_TOKEN", Description: "Session token of the default credentials"},
+	{Name: "AWS_PROFILE", Description: "Profile of the shared config and credentials files"},
+	{Name: "AWS_CONFIG_FILE", Description: "Path of the shared config file inside the plugin"},
+	{Name: "AWS_SHARED_CREDENTIALS_FILE", Description: "Path of the shared credentials file inside the plugin"},
+	{Name: "AWS_ROLE_ARN", Description: "Role assumed with the web identity token"},
+	{Name: "AWS_WEB_IDENTITY_TOKEN_FILE", Description: "Path of the web identity token inside the plugin"},
+	{Name: "AWS_ROLE_SESSION_NAME", Description: "Session name used with the web identity token"},
+}
+
+// pluginConfig is the part of a managed plugin's config.json the plugin
+// relies on.
+type pluginConfig struct {
+	Description   string           `json:"description"`
+	Documentation string           `json:"documentation"`
+	Entrypoint    []string         `json:"entrypoint"`
+	Interface     pluginInterfaces `json:"interface"`
+	Network       pluginNetwork    `json:"network"`
+	Env           []pluginEnvVar   `json:"env"`
+	Mounts        []pluginMount    `json:"mounts"`
+	Linux         pluginLinux      `json:"linux"`
+}
+
+type pluginInterfaces struct {
+	Types  []string `json:"types"`
+	Socket string   `json:"socket"`
+}
+
+type pluginNetwork struct {
+	Type string `json:"type"`
+}
+
+type pluginEnvVar struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Settable    []string `json:"settable"`
+	Value       string   `json:"value"`
+}
+
+type pluginMount struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options"`
+	Settable    []string `json:"settable"`
+}
+
+type pluginLinux struct {
+	Capabilities []string `json:"capabilities"`
+}
+
+// RunPackage runs the package command, which stages the binary as a managed
+// plugin in a directory ready for docker plugin create: a config.json and a
+// rootfs holding the binary and the system roots. It returns the exit
+// status.
+func RunPackage(args []string) int {
+	fs := flag.NewFlagSet(driverName+" package", flag.ExitOnError)
+	out := fs.String("out", "plugin", "directory the config.json and rootfs are written to")
+	binary := fs.String("binary", "", "statically linked binary staged as the plugin, defaulting to this one")
+	description := fs.String("description", "Docker log driver that publishes container logs to S3", "description of the plugin")
+	documentation := fs.String("documentation", "https://github.com/sroomberg/DockerS3LogDriver", "URL of the plugin's documentation")
+	roots := fs.String("system-roots", "", "CA bundle staged as the plugin's system roots, defaulting to the host's")
+	awsDir := fs.String("aws-dir", "", "host directory of shared AWS config and credentials files mounted at "+pluginAWSDir)
+	caCert := fs.String("ca-cert", "", "host CA certificate file mounted at "+pluginCACert+", for "+caCertFileKey)
+	var mounts []pluginMount
+	fs.Func("mount", "extra bind mount as source:destination, such as a spool-dir; repeatable", func(v string) error {
+		src, dst, ok := strings.Cut(v, ":")
+		if !ok || src == "" || dst == "" {
+			return fmt.Errorf("must be source:destination")
+		}
+		mounts = append(mounts, bindMount(fmt.Sprintf("mount%d", len(mounts)+1), "Extra bind mount", src, dst, false))
+		return nil
+	})
+	var caps []string
+	fs.Func("capability", "Linux capability granted to the plugin on top of the defaults, such as CAP_SYS_ADMIN; repeatable", func(v string) error {
+		caps = append(caps, v)
+		return nil
+	})
+	fs.Parse(args)
+
+	if *binary == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error finding the binary: %v\n", err)
+			return 1
+		}
+		*binary = exe
+	}
+	if *roots == "" {
+		for _, p := range systemRoots {
+			if _, err := os.Stat(p); err == nil {
+				*roots = p
+				break
+			}
+		}
+		if *roots == "" {
+			fmt.Fprintln(os.Stderr, "no CA bundle found on the host, set --system-roots")
+			return 2
+		}
+	}
+	if *caCert != "" {
+		mounts = append([]pluginMount{bindMount("ca-cert", "CA certificate trusted for the endpoint, set "+caCertFileKey+"="+pluginCACert, *caCert, pluginCACert, true)}, mounts...)
+	}
+	if *awsDir != "" {
+		mounts = append([]pluginMount{bindMount("aws", "Shared AWS config and credentials files", *awsDir, pluginAWSDir, true)}, mounts...)
+	}
+
+	cfg := newPluginConfig(*description, *documentation, mounts, caps)
+	rootfs := filepath.Join(*out, "rootfs")
+	if err := stageRootfs(rootfs, *binary, *roots); err != nil {
+		fmt.Fprintf(os.Stderr, "error staging rootfs: %v\n", err)
+		return 1
+	}
+	if err := checkPluginConfig(cfg, rootfs); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config.json: %v\n", err)
+		return 1
+	}
+	data, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := os.WriteFile(filepath.Join(*out, "config.json"), append(data, '\n'), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing config.json: %v\n", err)
+		return 1
+	}
+	fmt.Printf("staged plugin in %s, install it with:\n\tdocker plugin create %s %s\n", *out, driverName, *out)
+	return 0
+}
+
+// newPluginConfig returns the config of the plugin with mounts and caps.
+func newPluginConfig(description, documentation string, mounts []pluginMount, caps []string) pluginConfig {
+	env := make([]pluginEnvVar, len(pluginEnv))
+	for i, e := range pluginEnv {
+		e.Settable = []string{"value"}
+		env[i] = e
+	}
+	if mounts == nil {
+		mounts = []pluginMount{}
+	}
+	if caps == nil {
+		caps = []string{}
+	}
+	return pluginConfig{
+		Description:   description,
+		Documentation: documentation,
+		Entrypoint:    []string{pluginEntrypoint},
+		Interface:     pluginInterfaces{Types: []string{pluginInterface}, Socket: path.Base(defaultSocketPath)},
+		// The plugin reaches S3, STS and the instance metadata service
+		// through the host's network.
+		Network: pluginNetwork{Type: "host"},
+		Env:     env,
+		Mounts:  mounts,
+		Linux:   pluginLinux{Capabilities: caps},
+	}
+}
+
+// bindMount returns a bind mount of src at dst whose source can be changed
+// with docker plugin set.
+func bindMount(name, description, src, dst string, readOnly bool) pluginMount {
+	options := []string{"rbind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	return pluginMount{
+		Name:        name,
+		Description: description,
+		Source:      src,
+		Destination: dst,
+		Type:        "bind",
+		Options:     options,
+		Settable:    []string{"source"},
+	}
+}
+
+// stageRootfs fills rootfs with the binary, which must be statically linked
+// since the rootfs has no libc, and the system roots.
+func stageRootfs(rootfs, binary, roots string) error {
+	f, err := elf.Open(binary)
+	if err != nil {
+		return fmt.Errorf("%s isn't a Linux binary: %v", binary, err)
+	}
+	dynamic := slices.ContainsFunc(f.Progs, func(p *elf.Prog) bool { return p.Type == elf.PT_INTERP })
+	f.Close()
+	if dynamic {
+		return fmt.Errorf("%s is dynamically linked, build it with CGO_ENABLED=0", binary)
+	}
+	if err := os.MkdirAll(filepath.Join(rootfs, "tmp"), 0755); err != nil {
+		return err
+	}
+	if err := os.Chmod(filepath.Join(rootfs, "tmp"), 0777|os.ModeSticky); err != nil {
+		return err
+	}
+	if err := copyFile(binary, filepath.Join(rootfs, pluginEntrypoint), 0755); err != nil {
+		return err
+	}
+	return copyFile(roots, filepath.Join(rootfs, pluginRootsPath), 0644)
+}
+
+// copyFile copies src to dst with mode perm, creating dst's directory.
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// checkPluginConfig checks the fields of cfg the daemon and the plugin rely
+// on: the interface and socket the daemon connects to, an entrypoint that
+// exists in rootfs, settable env and mounts that can be bound.
+func checkPluginConfig(cfg pluginConfig, rootfs string) error {
+	var errs []error
+	if !slices.Equal(cfg.Interface.Types, []string{pluginInterface}) {
+		errs = append(errs, fmt.Errorf("interface.types must be [%q]", pluginInterface))
+	}
+	if cfg.Interface.Socket != driverName+".sock" {
+		errs = append(errs, fmt.Errorf("interface.socket must be %q, the socket the plugin listens on", driverName+".sock"))
+	}
+	if len(cfg.Entrypoint) == 0 || !path.IsAbs(cfg.Entrypoint[0]) {
+		errs = append(errs, errors.New("entrypoint must start with an absolute path"))
+	} else if fi, err := os.Stat(filepath.Join(rootfs, cfg.Entrypoint[0])); err != nil || fi.Mode()&0111 == 0 {
+		errs = append(errs, fmt.Errorf("entrypoint %q isn't an executable in the rootfs", cfg.Entrypoint[0]))
+	}
+	switch cfg.Network.Type {
+	case "host", "bridge", "none":
+	default:
+		errs = append(errs, fmt.Errorf("network.type %q must be host, bridge or none", cfg.Network.Type))
+	}
+	names := map[string]bool{}
+	for _, e := range cfg.Env {
+		if e.Name == "" || names[e.Name] {
+			errs = append(errs, fmt.Errorf("env %q is empty or repeated", e.Name))
+		}
+		names[e.Name] = true
+		if !slices.Equal(e.Settable, []string{"value"}) {
+			errs = append(errs, fmt.Errorf("env %q must be settable by value", e.Name))
+		}
+	}
+	names = map[string]bool{}
+	dests := map[string]bool{}
+	for _, m := range cfg.Mounts {
+		if m.Name == "" || names[m.Name] {
+			errs = append(errs, fmt.Errorf("mount %q is unnamed or its name is repeated", m.Name))
+		}
+		names[m.Name] = true
+		if !path.IsAbs(m.Destination) || dests[m.Destination] {
+			errs = append(errs, fmt.Errorf("mount %q: destination %q must be an absolute path mounted once", m.Name, m.Destination))
+		}
+		dests[m.Destination] = true
+		if m.Type != "bind" || !slices.Contains(m.Options, "rbind") || !filepath.IsAbs(m.Source) {
+			errs = append(errs, fmt.Errorf("mount %q must bind an absolute host path", m.Name))
+		}
+	}
+	for _, c := range cfg.Linux.Capabilities {
+		if !strings.HasPrefix(c, "CAP_") || strings.ToUpper(c) != c {
+			errs = append(errs, fmt.Errorf("capability %q must be named like CAP_SYS_ADMIN", c))
+		}
+	}
+	return errors.Join(errs...)
+}
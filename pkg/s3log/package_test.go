@@ -0,0 +1,199 @@
+package s3log
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+// staticBinary builds a statically linked binary to stage as the plugin.
+func staticBinary(t *testing.T) string {
+	t.Helper()
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go toolchain to build a static binary with")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "plugin")
+	cmd := exec.Command(gobin, "build", "-o", bin, "main.go")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS=linux", "GO111MODULE=off")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building a static binary: %v\n%s", err, out)
+	}
+	return bin
+}
+
+func TestRunPackage(t *testing.T) {
+	bin := staticBinary(t)
+	roots := filepath.Join(t.TempDir(), "ca-certificates.crt")
+	if err := os.WriteFile(roots, []byte("roots"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	status := RunPackage([]string{
+		"--out", out,
+		"--binary", bin,
+		"--system-roots", roots,
+		"--aws-dir", "/home/app/.aws",
+		"--ca-cert", "/etc/ssl/private-ca.pem",
+		"--mount", "/var/spool/s3:/spool",
+		"--capability", "CAP_SYS_ADMIN",
+		"--description", "S3 logs",
+	})
+	if status != 0 {
+		t.Fatalf("package exited %d", status)
+	}
+
+	// The config must decode as the daemon's plugin config, without fields
+	// it doesn't know.
+	data, err := os.ReadFile(filepath.Join(out, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var cfg types.PluginConfig
+	if err := dec.Decode(&cfg); err != nil {
+		t.Fatalf("config.json isn't a plugin config: %v", err)
+	}
+	if len(cfg.Interface.Types) != 1 || cfg.Interface.Types[0].String() != pluginInterface {
+		t.Errorf("interface types %v, want %s", cfg.Interface.Types, pluginInterface)
+	}
+	if cfg.Interface.Socket != driverName+".sock" {
+		t.Errorf("socket %q, want %q", cfg.Interface.Socket, driverName+".sock")
+	}
+	if cfg.Network.Type != "host" || cfg.Description != "S3 logs" {
+		t.Errorf("network %q and description %q", cfg.Network.Type, cfg.Description)
+	}
+	if !slices.Equal(cfg.Entrypoint, []string{pluginEntrypoint}) {
+		t.Errorf("entrypoint %q, want %q", cfg.Entrypoint, pluginEntrypoint)
+	}
+	var env []string
+	for _, e := range cfg.Env {
+		env = append(env, e.Name)
+		if !slices.Equal(e.Settable, []string{"value"}) {
+			t.Errorf("env %s isn't settable", e.Name)
+		}
+	}
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_REGION", "LOG_LEVEL"} {
+		if !slices.Contains(env, name) {
+			t.Errorf("env %q doesn't pass %s through", env, name)
+		}
+	}
+	mounts := make(map[string]types.PluginMount)
+	for _, m := range cfg.Mounts {
+		mounts[*m.Source] = m
+	}
+	for src, dst := range map[string]string{"/home/app/.aws": pluginAWSDir, "/etc/ssl/private-ca.pem": pluginCACert, "/var/spool/s3": "/spool"} {
+		m, ok := mounts[src]
+		if !ok || m.Destination != dst || m.Type != "bind" || !slices.Equal(m.Settable, []string{"source"}) {
+			t.Errorf("mount of %s is %+v, want a settable bind at %s", src, m, dst)
+		}
+	}
+	if !slices.Contains(mounts["/home/app/.aws"].Options, "ro") || slices.Contains(mounts["/var/spool/s3"].Options, "ro") {
+		t.Error("the AWS files must be mounted read-only and extra mounts writable")
+	}
+	if !slices.Equal(cfg.Linux.Capabilities, []string{"CAP_SYS_ADMIN"}) {
+		t.Errorf("capabilities %q", cfg.Linux.Capabilities)
+	}
+
+	for path, perm := range map[string]os.FileMode{pluginEntrypoint: 0755, pluginRootsPath: 0644} {
+		fi, err := os.Stat(filepath.Join(out, "rootfs", path))
+		if err != nil || fi.Mode().Perm() != perm {
+			t.Errorf("rootfs %s: %v, %v", path, fi, err)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(out, "rootfs", "tmp")); err != nil || fi.Mode()&os.ModeSticky == 0 {
+		t.Errorf("rootfs has no sticky /tmp: %v", err)
+	}
+}
+
+func TestCheckedInPluginConfig(t *testing.T) {
+	// The repo's config.json is what package writes with no flags.
+	want, err := os.ReadFile(filepath.Join("..", "..", "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newPluginConfig("Docker log driver that publishes container logs to S3", "https://github.com/sroomberg/DockerS3LogDriver", nil, nil)
+	got, err := json.MarshalIndent(d, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(append(got, '\n')) != string(want) {
+		t.Errorf("config.json differs from what package writes:\n%s", got)
+	}
+}
+
+func TestStageRootfsRefusesDynamic(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	if err := stageRootfs(t.TempDir(), "/bin/sh", "/dev/null"); err == nil || !strings.Contains(err.Error(), "dynamically linked") {
+		t.Errorf("staging /bin/sh: %v, want it refused as dynamically linked", err)
+	}
+	if err := stageRootfs(t.TempDir(), "/dev/null", "/dev/null"); err == nil || !strings.Contains(err.Error(), "isn't a Linux binary") {
+		t.Errorf("staging a file that isn't a binary: %v", err)
+	}
+}
+
+func TestCheckPluginConfig(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, filepath.Dir(pluginEntrypoint)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, pluginEntrypoint), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	valid := func() pluginConfig {
+		return newPluginConfig("d", "u", []pluginMount{bindMount("spool", "", "/var/spool", "/spool", false)}, []string{"CAP_SYS_ADMIN"})
+	}
+	tests := []struct {
+		name   string
+		modify func(c *pluginConfig)
+		want   string
+	}{
+		{name: "valid", modify: func(*pluginConfig) {}},
+		{name: "interface", modify: func(c *pluginConfig) { c.Interface.Types = []string{"docker.volumedriver/1.0"} }, want: "interface.types"},
+		{name: "socket", modify: func(c *pluginConfig) { c.Interface.Socket = "plugin.sock" }, want: "interface.socket"},
+		{name: "relative entrypoint", modify: func(c *pluginConfig) { c.Entrypoint = []string{"plugin"} }, want: "absolute path"},
+		{name: "missing entrypoint", modify: func(c *pluginConfig) { c.Entrypoint = []string{"/bin/plugin"} }, want: "isn't an executable"},
+		{name: "network", modify: func(c *pluginConfig) { c.Network.Type = "overlay" }, want: "network.type"},
+		{name: "repeated env", modify: func(c *pluginConfig) { c.Env = append(c.Env, c.Env[0]) }, want: "repeated"},
+		{name: "env not settable", modify: func(c *pluginConfig) { c.Env[0].Settable = nil }, want: "settable by value"},
+		{name: "relative mount", modify: func(c *pluginConfig) { c.Mounts[0].Destination = "spool" }, want: "destination"},
+		{name: "mounted twice", modify: func(c *pluginConfig) {
+			m := c.Mounts[0]
+			m.Name = "again"
+			c.Mounts = append(c.Mounts, m)
+		}, want: "mounted once"},
+		{name: "relative source", modify: func(c *pluginConfig) { c.Mounts[0].Source = "spool" }, want: "absolute host path"},
+		{name: "capability", modify: func(c *pluginConfig) { c.Linux.Capabilities = []string{"sys_admin"} }, want: "CAP_SYS_ADMIN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(&c)
+			err := checkPluginConfig(c, rootfs)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("valid config refused: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("checkPluginConfig returned %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
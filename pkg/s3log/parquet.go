@@ -0,0 +1,150 @@
+package s3log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+)
+
+const (
+	parquetCompressionKey = "parquet-compression"
+
+	formatParquet = "parquet"
+
+	parquetSnappy = "snappy"
+	parquetZstd   = "zstd"
+
+	// parquetExt is added to the key of every parquet object.
+	parquetExt = ".parquet"
+
+	contentTypeParquet = "application/vnd.apache.parquet"
+
+	// parquetBatchRows is how many rows are handed to the writer at a time.
+	parquetBatchRows = 1024
+)
+
+// parquetMagic starts and ends every parquet file.
+var parquetMagic = []byte("PAR1")
+
+// errParquetUnreadable is returned when reading back the objects of a
+// container logging parquet, which docker logs can only show from its cache.
+var errParquetUnreadable = errors.New("parquet objects can't be read back with docker logs, query them with Athena or Spark instead")
+
+// parquetCodecs maps each parquet-compression value to its codec.
+var parquetCodecs = map[string]compress.Codec{
+	parquetSnappy: &parquet.Snappy,
+	parquetZstd:   &parquet.Zstd,
+}
+
+// parquetRow is a row of a parquet object. Attrs holds the container's
+// labels and env along with the fields a record of the line has besides the
+// columns, such as original_time, the record_id and part of a split line,
+// or the fields of a log_gap marker.
+type parquetRow struct {
+	Time        time.Time         `parquet:"time,timestamp(microsecond)"`
+	Seq         int64             `parquet:"seq"`
+	Stream      string            `parquet:"stream,dict"`
+	ContainerID string            `parquet:"container_id,dict"`
+	Tag         string            `parquet:"tag,dict"`
+	Log         string            `parquet:"log"`
+	Attrs       map[string]string `parquet:"attrs"`
+}
+
+// encodeParquet returns the records of body, as jsonl encodes them, as a
+// parquet file compressed with codec, starting a new row group after every
+// rowGroupBytes of records.
+func encodeParquet(body []byte, rowGroupBytes int, codec string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := parquet.NewGenericWriter[parquetRow](&buf,
+		parquet.Compression(parquetCodecs[codec]),
+		parquet.CreatedBy(driverName, version, ""))
+	rows := make([]parquetRow, 0, parquetBatchRows)
+	write := func() error {
+		_, err := w.Write(rows)
+		rows = rows[:0]
+		return err
+	}
+	size := 0
+	for len(body) > 0 {
+		line, rest, _ := bytes.Cut(body, []byte{'\n'})
+		body = rest
+		row, err := parquetRowOf(line)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+		size += len(line) + 1
+		if len(rows) == cap(rows) || size >= rowGroupBytes {
+			if err := write(); err != nil {
+				return nil, err
+			}
+		}
+		if size >= rowGroupBytes {
+			if err := w.Flush(); err != nil {
+				return nil, err
+			}
+			size = 0
+		}
+	}
+	if err := write(); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parquetRowOf returns the row of a jsonl record.
+func parquetRowOf(line []byte) (parquetRow, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return parquetRow{}, fmt.Errorf("invalid record: %v", err)
+	}
+	var row parquetRow
+	var ts string
+	for _, f := range []struct {
+		key string
+		dst any
+	}{
+		{"log", &row.Log},
+		{"stream", &row.Stream},
+		{"seq", &row.Seq},
+		{"time", &ts},
+		{"container_id", &row.ContainerID},
+		{"tag", &row.Tag},
+		{"attrs", &row.Attrs},
+	} {
+		v, ok := fields[f.key]
+		if !ok {
+			continue
+		}
+		delete(fields, f.key)
+		if err := json.Unmarshal(v, f.dst); err != nil {
+			return parquetRow{}, fmt.Errorf("invalid record field %q: %v", f.key, err)
+		}
+	}
+	if ts != "" {
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return parquetRow{}, fmt.Errorf("invalid record field %q: %v", "time", err)
+		}
+		row.Time = t
+	}
+	if len(fields) > 0 && row.Attrs == nil {
+		row.Attrs = make(map[string]string, len(fields))
+	}
+	for k, v := range fields {
+		var s string
+		if json.Unmarshal(v, &s) != nil {
+			s = string(v)
+		}
+		row.Attrs[k] = s
+	}
+	return row, nil
+}
@@ -0,0 +1,242 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// readParquet returns the rows of a parquet object, failing the test if it
+// isn't one.
+func readParquet(t testing.TB, data []byte) []parquetRow {
+	t.Helper()
+	if !bytes.HasPrefix(data, parquetMagic) || !bytes.HasSuffix(data, parquetMagic) {
+		t.Fatalf("object %.8q...%q isn't framed by %q", data, data[max(len(data)-4, 0):], parquetMagic)
+	}
+	rows, err := parquet.Read[parquetRow](bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestParquet(t *testing.T) {
+	// Every line a container logs is a row of its parquet objects, read back
+	// with the library that wrote them, whichever the codec.
+	const n = 5000
+	for _, codec := range []string{parquetSnappy, parquetZstd} {
+		t.Run(codec, func(t *testing.T) {
+			fake := newFakeS3()
+			info := Info{
+				Config: testLogOpts(t, map[string]string{
+					formatKey:             formatParquet,
+					parquetCompressionKey: codec,
+					flushBytesKey:         "64kb",
+					flushIntervalKey:      "1h",
+					labelsKey:             "team",
+				}),
+				ContainerID:     testContainerID(t),
+				ContainerName:   "/test",
+				ContainerLabels: map[string]string{"team": "payments"},
+			}
+			l, _ := newTestDriverLogger(t, fake, info)
+			start := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+			lines := make([]string, n)
+			for i := range lines {
+				lines[i] = fmt.Sprintf("line %d: héllo \"quoted\" %s", i, strings.Repeat("x", i%50))
+			}
+			logLines(t, l, start, lines...)
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var rows []parquetRow
+			groups := 0
+			keys := fake.logKeys(testBucket)
+			for _, key := range keys {
+				if !strings.HasSuffix(key, parquetExt) {
+					t.Errorf("uploaded %s, want it ending in %s", key, parquetExt)
+				}
+				o, _ := fake.object(testBucket, key)
+				if o.contentType != contentTypeParquet {
+					t.Errorf("uploaded %s as %q, want %q", key, o.contentType, contentTypeParquet)
+				}
+				rows = append(rows, readParquet(t, o.data)...)
+				f, err := parquet.OpenFile(bytes.NewReader(o.data), int64(len(o.data)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				groups += len(f.RowGroups())
+			}
+			if groups < 2 {
+				t.Errorf("%d row groups in %d objects, want the lines split by flush-bytes", groups, len(keys))
+			}
+			if len(rows) != n {
+				t.Fatalf("read back %d rows, want %d", len(rows), n)
+			}
+			want := map[string]string{"team": "payments"}
+			for i, row := range rows {
+				ts := start.Add(time.Duration(i) * time.Millisecond).Truncate(time.Microsecond)
+				if row.Log != lines[i] || row.Seq != int64(i+1) || row.Stream != "stdout" || !row.Time.Equal(ts) {
+					t.Fatalf("row %d is %+v, want line %q, seq %d at %s", i, row, lines[i], i+1, ts)
+				}
+				if row.ContainerID != info.ContainerID || row.Tag == "" || !maps.Equal(row.Attrs, want) {
+					t.Fatalf("row %d has container %q, tag %q and attrs %v, want the container's", i, row.ContainerID, row.Tag, row.Attrs)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeParquetRowGroups(t *testing.T) {
+	// A new row group is started after every rowGroupBytes of records.
+	var body bytes.Buffer
+	const n = 3000
+	for i := range n {
+		fmt.Fprintf(&body, `{"log":"line %d","stream":"stderr","seq":%d,"time":"2024-05-01T12:00:00Z","container_id":"c","tag":"t"}`+"\n", i, i)
+	}
+	tests := []struct {
+		rowGroupBytes int
+		wantGroups    int
+	}{
+		{rowGroupBytes: body.Len() * 2, wantGroups: 1},
+		{rowGroupBytes: body.Len()/4 + 1, wantGroups: 4},
+		{rowGroupBytes: body.Len() / 10, wantGroups: 10},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.wantGroups), func(t *testing.T) {
+			data, err := encodeParquet(body.Bytes(), tt.rowGroupBytes, parquetZstd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(f.RowGroups()); got != tt.wantGroups {
+				t.Errorf("%d row groups, want %d", got, tt.wantGroups)
+			}
+			rows := readParquet(t, data)
+			if len(rows) != n || rows[n-1].Log != fmt.Sprintf("line %d", n-1) {
+				t.Errorf("read back %d rows, want %d", len(rows), n)
+			}
+		})
+	}
+}
+
+func TestParquetRowOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    parquetRow
+		wantErr string
+	}{
+		{
+			name: "line",
+			line: `{"log":"hi","stream":"stdout","seq":7,"time":"2024-05-01T12:00:00.5Z","container_id":"c","tag":"t","attrs":{"team":"payments"}}`,
+			want: parquetRow{Time: time.Date(2024, 5, 1, 12, 0, 0, 5e8, time.UTC), Seq: 7, Stream: "stdout", ContainerID: "c", Tag: "t", Log: "hi", Attrs: map[string]string{"team": "payments"}},
+		},
+		{
+			name: "split line",
+			line: `{"log":"part","stream":"stdout","seq":8,"time":"2024-05-01T12:00:00Z","record_id":"r1","part":2,"total":3,"truncated":true,"attrs":{"team":"payments"}}`,
+			want: parquetRow{Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Seq: 8, Stream: "stdout", Log: "part", Attrs: map[string]string{"team": "payments", "record_id": "r1", "part": "2", "total": "3", "truncated": "true"}},
+		},
+		{
+			name: "gap marker",
+			line: `{"event":"log_gap","stream":"stderr","dropped":12,"reason":"buffer_full","container_id":"c"}`,
+			want: parquetRow{Stream: gapStream, ContainerID: "c", Attrs: map[string]string{"event": "log_gap", "dropped": "12", "reason": "buffer_full"}},
+		},
+		{name: "not json", line: `hello`, wantErr: "invalid record"},
+		{name: "bad seq", line: `{"seq":"one"}`, wantErr: `invalid record field "seq"`},
+		{name: "bad time", line: `{"time":"yesterday"}`, wantErr: `invalid record field "time"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parquetRowOf([]byte(tt.line))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parquetRowOf returned %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Time.Equal(tt.want.Time) || got.Seq != tt.want.Seq || got.Stream != tt.want.Stream || got.ContainerID != tt.want.ContainerID ||
+				got.Tag != tt.want.Tag || got.Log != tt.want.Log || !maps.Equal(got.Attrs, tt.want.Attrs) {
+				t.Errorf("row %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParquetOpts(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     map[string]string
+		wantErr string
+	}{
+		{name: "snappy by default", cfg: map[string]string{formatKey: formatParquet}},
+		{name: "zstd", cfg: map[string]string{formatKey: formatParquet, parquetCompressionKey: parquetZstd}},
+		{name: "bad codec", cfg: map[string]string{formatKey: formatParquet, parquetCompressionKey: "gzip"}, wantErr: parquetCompressionKey},
+		{name: "compress", cfg: map[string]string{formatKey: formatParquet, compressKey: compressZstd}, wantErr: "use " + parquetCompressionKey},
+		{name: "multipart stream", cfg: map[string]string{formatKey: formatParquet, writeModeKey: writeModeMultipartStream}, wantErr: writeModeKey},
+		{name: "merge json", cfg: map[string]string{formatKey: formatParquet, mergeJSONLogKey: "true"}, wantErr: mergeJSONLogKey},
+		{name: "timestamp format", cfg: map[string]string{formatKey: formatParquet, timestampKey: timestampUnixMs}, wantErr: timestampKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseLogOpts(DefaultOptions(), testLogOpts(t, tt.cfg))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseLogOpts returned %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.cfg[parquetCompressionKey]; want != "" && opts.ParquetCompression != want || want == "" && opts.ParquetCompression != parquetSnappy {
+				t.Errorf("parquet compression %q", opts.ParquetCompression)
+			}
+		})
+	}
+}
+
+func TestParquetUnreadable(t *testing.T) {
+	// docker logs of a container logging parquet is refused rather than
+	// showing the objects' bytes.
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, map[string]string{formatKey: formatParquet})
+	logLines(t, l, time.Now(), "one")
+	if err := l.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.read(context.Background(), NewLogWatcher(), ReadConfig{}); err != errParquetUnreadable {
+		t.Errorf("read returned %v, want %v", err, errParquetUnreadable)
+	}
+}
+
+func BenchmarkEncodeParquet(b *testing.B) {
+	var body bytes.Buffer
+	for i := range 10000 {
+		fmt.Fprintf(&body, `{"log":"%s","stream":"stdout","seq":%d,"time":"2024-05-01T12:00:00.123456789Z","container_id":"c","tag":"t","attrs":{"team":"payments"}}`+"\n", strings.Repeat("x", 200), i)
+	}
+	for _, codec := range []string{parquetSnappy, parquetZstd} {
+		b.Run(codec, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(body.Len()))
+			for range b.N {
+				if _, err := encodeParquet(body.Bytes(), defaultFlushBytes, codec); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package s3log
+
+import (
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	maxPartialBytesKey  = "max-partial-bytes"
+	maxPartialAgeKey    = "max-partial-age"
+	maxPartialGroupsKey = "max-partial-groups"
+
+	defaultMaxPartialBytes  = 1 << 20
+	defaultMaxPartialAge    = time.Minute
+	defaultMaxPartialGroups = 16
+
+	// partialTruncatedMarker ends a partial line that was written out before
+	// its last part arrived.
+	partialTruncatedMarker = " [truncated]"
+
+	// partialTimeoutAttr is set on a partial line written out because its
+	// last part hadn't arrived within max-partial-age.
+	partialTimeoutAttr = "partial_timeout"
+
+	maxLineBytesKey = "max-line-bytes"
+
+	// lineTruncatedMarker ends a line cut short at max-line-bytes.
+	lineTruncatedMarker = "...[truncated]"
+)
+
+var partialsLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: driverName,
+	Name:      "partial_lines_limited_total",
+	Help:      "Partial lines written out before their last part arrived, by the limit that cut them off.",
+}, []string{"limit"})
+
+func init() {
+	metricsRegistry.MustRegister(partialsLimited)
+}
+
+// partialLine is a line that the daemon split into several messages because
+// it was longer than its buffer.
+type partialLine struct {
+	msg     Message // header of the first part, without its line
+	line    []byte
+	wal     int64     // journal index of the first part
+	started time.Time // when the first part arrived
+	timer   *time.Timer
+}
+
+// assemble collects the parts of a partial line and returns the complete line
+// once its last part arrives, or nil while parts are still outstanding. Whole
+// lines are returned as they are. The journal index of msg is wal, and that
+// of the line's first part is returned with it. A container can't make the
+// logger hold more than max-partial-groups lines of up to max-partial-bytes
+// each, for longer than max-partial-age: lines past those are written out
+// as they are. Callers must hold l.mu.
+func (l *S3Logger) assemble(msg *Message, wal int64) (*Message, int64) {
+	meta := msg.PLogMetaData
+	if meta == nil {
+		return msg, wal
+	}
+
+	p, ok := l.partials[meta.ID]
+	if !ok {
+		if len(l.partials) >= l.opts.MaxPartialGroups {
+			l.evictPartial()
+		}
+		p = l.stagePartial(meta.ID, msg, wal)
+	}
+	p.line = append(p.line, msg.Line...)
+
+	switch {
+	case meta.Last:
+	case len(p.line) >= l.opts.MaxPartialBytes:
+		partialsLimited.WithLabelValues("bytes").Inc()
+		l.log().WithField("partial", meta.ID).Warnf("partial line exceeded %s %d, writing it out truncated", maxPartialBytesKey, l.opts.MaxPartialBytes)
+		l.deadLetter(&p.msg, reasonPartial, len(p.line))
+		p.line = append(p.line, partialTruncatedMarker...)
+	default:
+		return nil, 0
+	}
+	l.unstagePartial(meta.ID)
+	return p.complete(), p.wal
+}
+
+// stagePartial starts holding the line id, whose first part is msg, and
+// writes it out if its last part hasn't arrived by max-partial-age. The
+// timer only takes the logger's own lock, so a stuck container holds up no
+// other. Callers must hold l.mu.
+func (l *S3Logger) stagePartial(id string, msg *Message, wal int64) *partialLine {
+	p := &partialLine{msg: header(msg), wal: wal, started: time.Now()}
+	if age := l.opts.MaxPartialAge; age > 0 {
+		p.timer = time.AfterFunc(age, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.partials[id] != p {
+				return
+			}
+			partialsLimited.WithLabelValues("age").Inc()
+			l.log().WithField("partial", id).Warnf("partial line incomplete after %s %s, writing it out truncated", maxPartialAgeKey, age)
+			l.deadLetter(&p.msg, reasonPartialTimeout, len(p.line))
+			p.msg.Attrs = append(slices.Clip(p.msg.Attrs), LogAttr{Key: partialTimeoutAttr, Value: "true"})
+			l.writePartial(id, p)
+			l.charge()
+		})
+	}
+	l.partials[id] = p
+	return p
+}
+
+// evictPartial writes out the partial line held the longest, to make room
+// for another under max-partial-groups. Callers must hold l.mu.
+func (l *S3Logger) evictPartial() {
+	var oldest string
+	var p *partialLine
+	for id, q := range l.partials {
+		if p == nil || q.started.Before(p.started) {
+			oldest, p = id, q
+		}
+	}
+	partialsLimited.WithLabelValues("groups").Inc()
+	l.log().WithField("partial", oldest).Debugf("more than %s %d partial lines in flight, writing out the oldest truncated", maxPartialGroupsKey, l.opts.MaxPartialGroups)
+	l.deadLetter(&p.msg, reasonPartialEvicted, len(p.line))
+	l.writePartial(oldest, p)
+}
+
+// writePartial stops holding the line id, p, and writes it out marked as
+// truncated. Callers must hold l.mu.
+func (l *S3Logger) writePartial(id string, p *partialLine) {
+	l.unstagePartial(id)
+	p.line = append(p.line, partialTruncatedMarker...)
+	l.handle(p.complete(), p.wal)
+}
+
+// unstagePartial stops holding the line id. Callers must hold l.mu.
+func (l *S3Logger) unstagePartial(id string) {
+	if p := l.partials[id]; p != nil && p.timer != nil {
+		p.timer.Stop()
+	}
+	delete(l.partials, id)
+}
+
+// complete returns the line assembled so far as a single message, stamped with
+// the time and stream of its first part.
+func (p *partialLine) complete() *Message {
+	return &Message{
+		Line:      p.line,
+		Source:    p.msg.Source,
+		Timestamp: p.msg.Timestamp,
+		Attrs:     p.msg.Attrs,
+	}
+}
+
+// header returns a copy of msg without its line, to stamp a line assembled
+// from it. msg itself is reused once Log returns.
+func header(msg *Message) Message {
+	return Message{Source: msg.Source, Timestamp: msg.Timestamp, Attrs: msg.Attrs}
+}
+
+// flushPartials writes out every partial line still waiting for its last part,
+// marked as truncated. It is called when the container stops so that their
+// parts aren't lost. Callers must hold l.mu.
+func (l *S3Logger) flushPartials() {
+	for id, p := range l.partials {
+		l.deadLetter(&p.msg, reasonIncomplete, len(p.line))
+		l.writePartial(id, p)
+	}
+}
@@ -0,0 +1,256 @@
+package s3log
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// part returns a message holding part ordinal of the line id, the last part
+// if last is set.
+func part(id string, ordinal int, last bool, source, line string) *Message {
+	return &Message{
+		Line:         []byte(line),
+		Source:       source,
+		Timestamp:    time.Now(),
+		PLogMetaData: &PartialLogMetaData{ID: id, Ordinal: ordinal, Last: last},
+	}
+}
+
+func TestPartials(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		msgs []*Message
+		want []string
+	}{
+		{
+			name: "whole lines",
+			msgs: []*Message{{Line: []byte("one"), Source: "stdout"}, {Line: []byte("two"), Source: "stdout"}},
+			want: []string{"one", "two"},
+		},
+		{
+			name: "one line in three parts",
+			msgs: []*Message{
+				part("a", 1, false, "stdout", `{"msg":`),
+				part("a", 2, false, "stdout", `"long`),
+				part("a", 3, true, "stdout", ` line"}`),
+			},
+			want: []string{`{"msg":"long line"}`},
+		},
+		{
+			name: "interleaved streams",
+			msgs: []*Message{
+				part("out", 1, false, "stdout", "stdout "),
+				part("err", 1, false, "stderr", "stderr "),
+				part("out", 2, false, "stdout", "first "),
+				part("err", 2, true, "stderr", "done"),
+				{Line: []byte("whole"), Source: "stdout"},
+				part("out", 3, true, "stdout", "done"),
+			},
+			want: []string{"stderr done", "whole", "stdout first done"},
+		},
+		{
+			name: "interrupted by stop",
+			msgs: []*Message{
+				part("a", 1, false, "stdout", "never "),
+				part("a", 2, false, "stdout", "finished"),
+			},
+			want: []string{"never finished" + partialTruncatedMarker},
+		},
+		{
+			name: "over max-partial-bytes",
+			cfg:  map[string]string{maxPartialBytesKey: "8"},
+			msgs: []*Message{
+				part("a", 1, false, "stdout", "12345"),
+				part("a", 2, false, "stdout", "67890"),
+				part("a", 3, true, "stdout", "rest"),
+			},
+			want: []string{"1234567890" + partialTruncatedMarker, "rest"},
+		},
+		{
+			name: "over max-partial-groups",
+			cfg:  map[string]string{maxPartialGroupsKey: "2"},
+			msgs: []*Message{
+				part("a", 1, false, "stdout", "a"),
+				part("b", 1, false, "stdout", "b"),
+				part("c", 1, false, "stdout", "c"),
+				part("b", 2, true, "stdout", "b"),
+				part("c", 2, true, "stdout", "c"),
+			},
+			want: []string{"a" + partialTruncatedMarker, "bb", "cc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			l := newTestLogger(t, fake, tt.cfg)
+			for _, msg := range tt.msgs {
+				if msg.Timestamp.IsZero() {
+					msg.Timestamp = time.Now()
+				}
+				if err := l.Log(msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := uploadedLines(t, fake, l); !slices.Equal(got, tt.want) {
+				t.Errorf("uploaded %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartialSources(t *testing.T) {
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, nil)
+	for _, msg := range []*Message{
+		part("out", 1, false, "stdout", "out "),
+		part("err", 1, false, "stderr", "err "),
+		part("out", 2, true, "stdout", "line"),
+		part("err", 2, true, "stderr", "line"),
+	} {
+		l.Log(msg)
+	}
+	l.Close()
+	keys := fake.logKeys(testBucket)
+	if len(keys) != 1 {
+		t.Fatalf("uploaded %q, want one object", keys)
+	}
+	var got []string
+	for _, msg := range objectMessages(t, l, keys[0]) {
+		got = append(got, msg.Source+": "+strings.TrimSuffix(string(msg.Line), "\n"))
+	}
+	want := []string{"stdout: out line", "stderr: err line"}
+	if !slices.Equal(got, want) {
+		t.Errorf("uploaded %q, want %q", got, want)
+	}
+}
+
+func TestPartialTimeout(t *testing.T) {
+	// A line whose last part never arrives is written out once it is
+	// max-partial-age old, marked as timed out, without waiting for the
+	// container to stop.
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, map[string]string{maxPartialAgeKey: "20ms", flushIntervalKey: "1h"})
+	timedOut := metricValue(partialsLimited.WithLabelValues("age"))
+	for _, msg := range []*Message{
+		part("a", 1, false, "stdout", "never "),
+		part("a", 2, false, "stdout", "finished"),
+		part("b", 1, false, "stdout", "done "),
+		part("b", 2, true, "stdout", "in time"),
+	} {
+		if err := l.Log(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the partial line to time out", func() bool { return lineSequence(l) == 2 })
+	if err := l.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	recs := uploadedRecords(t, fake)
+	if len(recs) != 2 || recs[0]["log"] != "done in time" || recs[0][partialTimeoutAttr] != nil {
+		t.Fatalf("uploaded %v, want the complete line first", recs)
+	}
+	if recs[1]["log"] != "never finished"+partialTruncatedMarker || recs[1][partialTimeoutAttr] != "true" {
+		t.Errorf("uploaded %v, want the incomplete line truncated with %s", recs[1], partialTimeoutAttr)
+	}
+	if got := metricValue(partialsLimited.WithLabelValues("age")) - timedOut; got != 1 {
+		t.Errorf("counted %v lines timed out, want 1", got)
+	}
+}
+
+func TestPartialsBounded(t *testing.T) {
+	// A container interleaving parts of thousands of lines that never end
+	// has the logger hold no more than max-partial-groups lines of up to
+	// max-partial-bytes each, and holds up no other container meanwhile.
+	const (
+		groups   = 16
+		maxBytes = 1 << 10
+	)
+	fake := newFakeS3()
+	flooded := newTestLogger(t, fake, map[string]string{
+		maxPartialGroupsKey: fmt.Sprint(groups),
+		maxPartialBytesKey:  fmt.Sprint(maxBytes),
+		maxPartialAgeKey:    "5ms",
+		deadLetterKey:       "false",
+	})
+	otherFake := newFakeS3()
+	other := newTestLogger(t, otherFake, nil)
+	evicted := metricValue(partialsLimited.WithLabelValues("groups"))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 200 {
+			if err := other.Log(&Message{Line: []byte(fmt.Sprintf("line %d", i)), Source: "stdout", Timestamp: time.Now()}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	rnd := rand.New(rand.NewSource(1))
+	for i := range 20000 {
+		id := fmt.Sprint(rnd.Intn(5000))
+		if err := flooded.Log(part(id, i, false, "stdout", strings.Repeat("x", rnd.Intn(64)))); err != nil {
+			t.Fatal(err)
+		}
+		flooded.mu.Lock()
+		held := 0
+		for _, p := range flooded.partials {
+			held += len(p.line)
+		}
+		n := len(flooded.partials)
+		flooded.mu.Unlock()
+		if n > groups || held > groups*maxBytes {
+			t.Fatalf("holding %d partial lines of %d bytes, want up to %d of %d bytes each", n, held, groups, maxBytes)
+		}
+	}
+	wg.Wait()
+	if got := metricValue(partialsLimited.WithLabelValues("groups")) - evicted; got == 0 {
+		t.Error("no partial lines counted as evicted")
+	}
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := uploadedLines(t, otherFake, other); len(got) != 200 {
+		t.Errorf("uploaded %d lines of the other container, want 200", len(got))
+	}
+}
+
+func TestMaxLineBytes(t *testing.T) {
+	long := strings.Repeat("z", 1<<20)
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		want string
+	}{
+		{name: "no cap", cfg: map[string]string{}, want: long},
+		{name: "capped", cfg: map[string]string{maxLineBytesKey: "1024"}, want: long[:1024] + lineTruncatedMarker},
+		{name: "under the cap", cfg: map[string]string{maxLineBytesKey: "2097152"}, want: long},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			tt.cfg[maxBufferSizeKey], tt.cfg[flushBytesKey] = "4194304", "4194304"
+			l := newTestLogger(t, fake, tt.cfg)
+			logLines(t, l, time.Now(), long)
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			got := uploadedLines(t, fake, l)
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("uploaded %d lines, want one of %d bytes", len(got), len(tt.want))
+			}
+		})
+	}
+}
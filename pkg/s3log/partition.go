@@ -0,0 +1,138 @@
+package s3log
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	partitionByKey       = "partition-by"
+	partitionTimezoneKey = "partition-timezone"
+	maxFutureSkewKey     = "max-future-skew"
+
+	defaultMaxFutureSkew = 10 * time.Minute
+
+	// originalTimeKey is the record field holding the timestamp of a line
+	// restamped for being too far in the future.
+	originalTimeKey = "original_time"
+
+	partitionNone = "none"
+	partitionDay  = "day"
+	partitionHour = "hour"
+
+	partitionDayFormat  = "2006-01-02"
+	partitionHourFormat = "15"
+)
+
+// partition returns the Hive-style key prefix of the partition t falls in,
+// such as "dt=2024-05-01/hour=13/", or "" if objects aren't partitioned.
+func (l *S3Logger) partition(t time.Time) string {
+	t = t.In(l.partitionLoc)
+	switch l.opts.PartitionBy {
+	case partitionDay:
+		return "dt=" + t.Format(partitionDayFormat) + "/"
+	case partitionHour:
+		return "dt=" + t.Format(partitionDayFormat) + "/hour=" + t.Format(partitionHourFormat) + "/"
+	}
+	return ""
+}
+
+// restamp returns msg stamped with the current time if its timestamp is more
+// than max-future-skew ahead of it, as a container with a skewed clock may
+// log, so that it doesn't land in a partition hours ahead. The original
+// timestamp is kept in an attribute for the record. Callers must hold l.mu.
+func (l *S3Logger) restamp(msg *Message) *Message {
+	skew := l.opts.MaxFutureSkew
+	now := time.Now()
+	if skew <= 0 || !msg.Timestamp.After(now.Add(skew)) {
+		return msg
+	}
+	if !l.skewed {
+		l.skewed = true
+		l.log().WithField("timestamp", msg.Timestamp).Warnf("line timestamped more than %s %s ahead, restamping it with the current time", maxFutureSkewKey, skew)
+	}
+	restamped := *msg
+	restamped.Timestamp = now
+	restamped.Attrs = append(slices.Clip(msg.Attrs), LogAttr{Key: originalTimeKey, Value: msg.Timestamp.UTC().Format(time.RFC3339Nano)})
+	return &restamped
+}
+
+// listPrefixes returns the prefixes to list the container's objects under,
+// oldest first. Without partitioning that is just the key prefix; otherwise
+// it is the key prefix inside every partition that overlaps the window
+// between since and until, either of which may be zero.
+func (l *S3Logger) listPrefixes(ctx context.Context, since, until time.Time) ([]string, error) {
+	if l.opts.PartitionBy == partitionNone {
+		return []string{l.keyPrefix()}, nil
+	}
+
+	days, err := l.listPartitions(ctx, l.opts.S3Prefix, "dt=")
+	if err != nil {
+		return nil, err
+	}
+	var partitions []string
+	for _, day := range days {
+		start, err := time.ParseInLocation(partitionDayFormat, strings.TrimSuffix(strings.TrimPrefix(day, l.opts.S3Prefix+"dt="), "/"), l.partitionLoc)
+		if err != nil || !overlaps(start, start.AddDate(0, 0, 1), since, until) {
+			continue
+		}
+		if l.opts.PartitionBy == partitionDay {
+			partitions = append(partitions, day)
+			continue
+		}
+		hours, err := l.listPartitions(ctx, day, "hour=")
+		if err != nil {
+			return nil, err
+		}
+		for _, hour := range hours {
+			h, err := time.Parse(partitionHourFormat, strings.TrimSuffix(strings.TrimPrefix(hour, day+"hour="), "/"))
+			if err != nil {
+				continue
+			}
+			hourStart := start.Add(time.Duration(h.Hour()) * time.Hour)
+			if overlaps(hourStart, hourStart.Add(time.Hour), since, until) {
+				partitions = append(partitions, hour)
+			}
+		}
+	}
+
+	prefix := l.containerKeyPrefix()
+	for i := range partitions {
+		partitions[i] += prefix
+	}
+	return partitions, nil
+}
+
+// listPartitions lists the partition directories named key=... directly
+// under parent, in lexical and therefore chronological order.
+func (l *S3Logger) listPartitions(ctx context.Context, parent, key string) ([]string, error) {
+	var partitions []string
+	pages := s3.NewListObjectsV2Paginator(l.s3Client, &s3.ListObjectsV2Input{
+		Bucket:       aws.String(l.bucket),
+		Prefix:       aws.String(parent + key),
+		Delimiter:    aws.String("/"),
+		RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page.CommonPrefixes {
+			partitions = append(partitions, aws.ToString(p.Prefix))
+		}
+	}
+	return partitions, nil
+}
+
+// overlaps reports whether [start, end) overlaps the window between since and
+// until, either of which may be zero.
+func overlaps(start, end, since, until time.Time) bool {
+	return (since.IsZero() || end.After(since)) && (until.IsZero() || !start.After(until))
+}
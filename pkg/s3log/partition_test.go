@@ -0,0 +1,278 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPartitionAcrossMidnight(t *testing.T) {
+	// The partitions are in a zone where it is just past midnight, so that
+	// the burst straddles it with the restamped line stamped now.
+	now := time.Now()
+	midnight := now.Add(-30 * time.Second)
+	sinceMidnight := midnight.Sub(midnight.UTC().Truncate(24 * time.Hour))
+	loc := time.FixedZone("test", -int(sinceMidnight/time.Second))
+	yesterday := "dt=" + midnight.Add(-time.Hour).In(loc).Format(partitionDayFormat) + "/"
+	today := "dt=" + midnight.In(loc).Format(partitionDayFormat) + "/"
+	tomorrow := "dt=" + midnight.Add(25*time.Hour).In(loc).Format(partitionDayFormat) + "/"
+
+	burst := []struct {
+		line string
+		t    time.Time
+	}{
+		{"before 1", midnight.Add(-2 * time.Second)},
+		{"before 2", midnight.Add(-time.Second)},
+		{"after 1", midnight.Add(time.Second)},
+		{"skewed", midnight.Add(30 * time.Hour)},
+		// Late, from before midnight, after lines from past it.
+		{"late", midnight.Add(-500 * time.Millisecond)},
+		{"after 2", midnight.Add(2 * time.Second)},
+	}
+	logged := make(map[string]time.Time)
+	for _, b := range burst {
+		logged[b.line] = b.t
+	}
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		want map[string][]string // lines by partition
+	}{
+		{
+			name: "restamped",
+			want: map[string][]string{
+				yesterday: {"before 1", "before 2"},
+				today:     {"after 1", "skewed", "late", "after 2"},
+			},
+		},
+		{
+			// Without max-future-skew the skewed line moves the logger on
+			// to its partition, where the rest follow it.
+			name: "max-future-skew 0",
+			cfg:  map[string]string{maxFutureSkewKey: "0"},
+			want: map[string][]string{
+				yesterday: {"before 1", "before 2"},
+				today:     {"after 1"},
+				tomorrow:  {"skewed", "late", "after 2"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			cfg := map[string]string{partitionByKey: partitionDay, flushIntervalKey: "1h"}
+			maps.Copy(cfg, tt.cfg)
+			l := newTestLogger(t, fake, cfg)
+			l.partitionLoc = loc
+			for _, b := range burst {
+				if err := l.Log(&Message{Line: []byte(b.line), Source: "stdout", Timestamp: b.t}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string][]string)
+			for _, key := range fake.logKeys(testBucket) {
+				i := strings.Index(key, "dt=")
+				if i < 0 {
+					t.Fatalf("key %q isn't partitioned", key)
+				}
+				part := key[i : i+len("dt=2006-01-02/")]
+				if _, ok := got[part]; ok {
+					t.Errorf("partition %s reopened by %q", part, key)
+				}
+				o, _ := fake.object(testBucket, key)
+				for _, line := range strings.Split(strings.TrimSpace(string(o.data)), "\n") {
+					var rec record
+					if err := json.Unmarshal([]byte(line), &rec); err != nil {
+						t.Fatal(err)
+					}
+					got[part] = append(got[part], rec.Log)
+					checkStamp(t, rec, logged[rec.Log], tt.cfg[maxFutureSkewKey] != "0")
+				}
+			}
+			if !maps.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("partitioned lines as %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// checkStamp checks that rec, logged at t, keeps its timestamp, or, if it
+// was restamped for skew, records it as its original_time.
+func checkStamp(t *testing.T, rec record, logged time.Time, restamp bool) {
+	t.Helper()
+	var stamp time.Time
+	if err := json.Unmarshal(rec.Time, &stamp); err != nil {
+		t.Fatal(err)
+	}
+	if !restamp || rec.Log != "skewed" {
+		if !stamp.Equal(logged) || rec.OriginalTime != "" {
+			t.Errorf("%q stamped %v with original_time %q, want its own time %v", rec.Log, stamp, rec.OriginalTime, logged)
+		}
+		return
+	}
+	if want := logged.UTC().Format(time.RFC3339Nano); rec.OriginalTime != want {
+		t.Errorf("restamped line has original_time %q, want %q", rec.OriginalTime, want)
+	}
+	if d := time.Since(stamp); d < 0 || d > time.Minute {
+		t.Errorf("restamped line stamped %v, want about now", stamp)
+	}
+}
+
+func TestPartitionKeys(t *testing.T) {
+	// Lines cross an hour and a UTC midnight; each object holds the lines of
+	// one partition, in the zone of partition-timezone.
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	lines := []struct {
+		line string
+		t    time.Time
+	}{
+		{"a", at("2024-05-01T22:59:59Z")},
+		{"b", at("2024-05-01T23:00:01Z")},
+		{"c", at("2024-05-01T23:30:00Z")},
+		{"d", at("2024-05-02T00:00:01Z")},
+	}
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		want map[string][]string // lines by partition, "" for none
+	}{
+		{
+			name: "none",
+			cfg:  map[string]string{partitionByKey: partitionNone},
+			want: map[string][]string{"": {"a", "b", "c", "d"}},
+		},
+		{
+			name: "day",
+			cfg:  map[string]string{partitionByKey: partitionDay},
+			want: map[string][]string{
+				"dt=2024-05-01/": {"a", "b", "c"},
+				"dt=2024-05-02/": {"d"},
+			},
+		},
+		{
+			name: "hour",
+			cfg:  map[string]string{partitionByKey: partitionHour},
+			want: map[string][]string{
+				"dt=2024-05-01/hour=22/": {"a"},
+				"dt=2024-05-01/hour=23/": {"b", "c"},
+				"dt=2024-05-02/hour=00/": {"d"},
+			},
+		},
+		{
+			// Still the evening of May 1st.
+			name: "day behind UTC",
+			cfg:  map[string]string{partitionByKey: partitionDay, partitionTimezoneKey: "America/New_York"},
+			want: map[string][]string{"dt=2024-05-01/": {"a", "b", "c", "d"}},
+		},
+		{
+			// Half an hour off UTC, so the hours break elsewhere.
+			name: "hour of a half-hour zone",
+			cfg:  map[string]string{partitionByKey: partitionHour, partitionTimezoneKey: "Asia/Kolkata"},
+			want: map[string][]string{
+				"dt=2024-05-02/hour=04/": {"a", "b"},
+				"dt=2024-05-02/hour=05/": {"c", "d"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			tt.cfg[flushIntervalKey] = "1h"
+			l := newTestLogger(t, fake, tt.cfg)
+			for _, line := range lines {
+				logLines(t, l, line.t, line.line)
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string][]string)
+			for _, key := range fake.logKeys(testBucket) {
+				part, _, _ := strings.Cut(key, l.containerKeyPrefix())
+				if _, ok := got[part]; ok {
+					t.Errorf("partition %q split across objects, last %q", part, key)
+				}
+				o, _ := fake.object(testBucket, key)
+				for _, line := range strings.Split(strings.TrimSpace(string(o.data)), "\n") {
+					var rec record
+					if err := json.Unmarshal([]byte(line), &rec); err != nil {
+						t.Fatal(err)
+					}
+					got[part] = append(got[part], rec.Log)
+				}
+			}
+			if !maps.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("partitioned lines as %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListPrefixes(t *testing.T) {
+	// Reads list only the partitions overlapping their window, oldest
+	// first, under each the container's own key prefix.
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		partitionBy  string
+		since, until time.Duration // after day, 0 for none
+		want         []string
+	}{
+		{name: "none", partitionBy: partitionNone, want: []string{""}},
+		{name: "days", partitionBy: partitionDay, want: []string{"dt=2024-05-01/", "dt=2024-05-02/", "dt=2024-05-04/"}},
+		{name: "days since", partitionBy: partitionDay, since: 30 * time.Hour, want: []string{"dt=2024-05-02/", "dt=2024-05-04/"}},
+		{name: "days until", partitionBy: partitionDay, until: 24 * time.Hour, want: []string{"dt=2024-05-01/", "dt=2024-05-02/"}},
+		{name: "days between", partitionBy: partitionDay, since: 49 * time.Hour, until: 70 * time.Hour},
+		{name: "hours", partitionBy: partitionHour, want: []string{"dt=2024-05-01/hour=10/", "dt=2024-05-01/hour=23/", "dt=2024-05-02/hour=00/", "dt=2024-05-04/hour=05/"}},
+		{name: "hours window", partitionBy: partitionHour, since: 23*time.Hour + 30*time.Minute, until: 24*time.Hour + 30*time.Minute, want: []string{"dt=2024-05-01/hour=23/", "dt=2024-05-02/hour=00/"}},
+	}
+	logged := []time.Duration{10 * time.Hour, 23 * time.Hour, 24 * time.Hour, 77 * time.Hour}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			cfg := map[string]string{partitionByKey: tt.partitionBy, flushIntervalKey: "1h", s3PrefixKey: "logs/"}
+			l := newTestLogger(t, fake, cfg)
+			for _, d := range logged {
+				logLines(t, l, day.Add(d), "line")
+				if err := l.flush(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var since, until time.Time
+			if tt.since > 0 {
+				since = day.Add(tt.since)
+			}
+			if tt.until > 0 {
+				until = day.Add(tt.until)
+			}
+			got, err := l.listPrefixes(context.Background(), since, until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, p := range tt.want {
+				if tt.partitionBy == partitionNone {
+					want = append(want, l.keyPrefix())
+					continue
+				}
+				want = append(want, "logs/"+p+l.containerKeyPrefix())
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("listed %q, want %q", got, want)
+			}
+		})
+	}
+}
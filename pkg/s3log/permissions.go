@@ -0,0 +1,596 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	permissionsCheckKey = "permissions-check"
+
+	iamPolicyVersion = "2012-10-17"
+)
+
+// resourceKind is what an IAM action is granted on.
+type resourceKind int
+
+const (
+	onBucket   resourceKind = iota // each bucket
+	onObjects                      // the objects under s3-prefix in each bucket
+	onKMSKey                       // sse-kms-key-id
+	onLogGroup                     // cloudwatch-group
+	onTopic                        // notify-sns-topic-arn
+	onQueue                        // notify-sqs-queue-url
+)
+
+// statementIDs name the policy's statement for each kind of resource.
+var statementIDs = map[resourceKind]string{
+	onBucket:   "Bucket",
+	onObjects:  "Objects",
+	onKMSKey:   "KMSKey",
+	onLogGroup: "CloudWatchLogs",
+	onTopic:    "SNSTopic",
+	onQueue:    "SQSQueue",
+}
+
+// permissionScope is what the plugin does for a container: log with opts,
+// read its logs back for docker logs if read is set, and compact its
+// objects once it stops if compact is.
+type permissionScope struct {
+	opts    LogOption
+	read    bool
+	compact bool
+}
+
+// permission is an IAM action a feature of the plugin calls, when needed
+// says the feature is in use.
+type permission struct {
+	action  string
+	on      resourceKind
+	feature string
+	needed  func(permissionScope) bool
+}
+
+// permissions is every action the plugin may call. Each feature adds those
+// it calls with requirePermissions from an init func, so that the policy
+// command and --permissions-check keep up with the features.
+var permissions []permission
+
+func requirePermissions(p ...permission) {
+	permissions = append(permissions, p...)
+}
+
+func always(permissionScope) bool { return true }
+
+// grant is an action a scope needs, and the features needing it.
+type grant struct {
+	action   string
+	on       resourceKind
+	features []string
+}
+
+// requiredPermissions returns the actions s needs, by kind of resource and
+// then action.
+func requiredPermissions(s permissionScope) []grant {
+	var grants []grant
+	for _, p := range permissions {
+		if !p.needed(s) {
+			continue
+		}
+		i := slices.IndexFunc(grants, func(g grant) bool { return g.action == p.action && g.on == p.on })
+		if i < 0 {
+			grants = append(grants, grant{action: p.action, on: p.on})
+			i = len(grants) - 1
+		}
+		if !slices.Contains(grants[i].features, p.feature) {
+			grants[i].features = append(grants[i].features, p.feature)
+		}
+	}
+	slices.SortFunc(grants, func(a, b grant) int {
+		if a.on != b.on {
+			return int(a.on) - int(b.on)
+		}
+		return strings.Compare(a.action, b.action)
+	})
+	return grants
+}
+
+// buckets returns the buckets s writes to, with their regions: s3-bucket,
+// the replicas and the failover bucket.
+func (s permissionScope) buckets() []replica {
+	buckets := append([]replica{{Bucket: s.opts.S3Bucket, Region: s.opts.S3Region}}, s.opts.Replicas...)
+	if s.opts.FailoverBucket != "" {
+		buckets = append(buckets, replica{Bucket: s.opts.FailoverBucket, Region: s.opts.FailoverRegion})
+	}
+	return buckets
+}
+
+// arnPartition returns the partition of ARNs in region.
+func arnPartition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	}
+	return "aws"
+}
+
+func bucketARN(r replica) string {
+	return "arn:" + arnPartition(r.Region) + ":s3:::" + r.Bucket
+}
+
+func objectsARN(r replica, prefix string) string {
+	return bucketARN(r) + "/" + prefix + "*"
+}
+
+// kmsAlias returns the alias sse-kms-key-id names, if it names one rather
+// than a key.
+func kmsAlias(id string) (string, bool) {
+	if i := strings.Index(id, ":alias/"); strings.HasPrefix(id, "arn:") && i >= 0 {
+		return id[i+1:], true
+	}
+	return id, strings.HasPrefix(id, "alias/")
+}
+
+// resources returns the ARNs actions on kind are granted on for s. A key
+// named by its alias is granted as any key, under the condition that it has
+// that alias, as IAM authorizes the key an alias points to rather than the
+// alias.
+func (s permissionScope) resources(on resourceKind) ([]string, map[string]map[string]string) {
+	region := s.opts.S3Region
+	if region == "" {
+		region = "*"
+	}
+	var arns []string
+	switch on {
+	case onBucket:
+		for _, r := range s.buckets() {
+			arns = append(arns, bucketARN(r))
+		}
+	case onObjects:
+		for _, r := range s.buckets() {
+			arns = append(arns, objectsARN(r, s.opts.S3Prefix))
+		}
+	case onKMSKey:
+		id := s.opts.SSEKMSKeyID
+		if alias, ok := kmsAlias(id); ok {
+			return []string{"arn:" + arnPartition(region) + ":kms:" + region + ":*:key/*"},
+				map[string]map[string]string{"ForAnyValue:StringEquals": {"kms:ResourceAliases": alias}}
+		}
+		if !strings.HasPrefix(id, "arn:") {
+			id = "arn:" + arnPartition(region) + ":kms:" + region + ":*:key/" + id
+		}
+		arns = append(arns, id)
+	case onLogGroup:
+		arns = append(arns, "arn:"+arnPartition(region)+":logs:"+region+":*:log-group:"+s.opts.CloudWatchGroup+":*")
+	case onTopic:
+		arns = append(arns, s.opts.NotifyTopic)
+	case onQueue:
+		arns = append(arns, queueARN(s.opts.NotifyQueue, region))
+	}
+	return arns, nil
+}
+
+// queueARN returns the ARN of the SQS queue at queueURL, such as
+// https://sqs.eu-west-1.amazonaws.com/123456789012/logs, in region if its
+// host doesn't name one.
+func queueARN(queueURL, region string) string {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return "*"
+	}
+	account, name, ok := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if !ok {
+		return "*"
+	}
+	if parts := strings.Split(u.Hostname(), "."); len(parts) > 2 && parts[0] == "sqs" {
+		region = parts[1]
+	}
+	return "arn:" + arnPartition(region) + ":sqs:" + region + ":" + account + ":" + name
+}
+
+// iamPolicy is an IAM policy document.
+type iamPolicy struct {
+	Version   string         `json:"Version"`
+	Statement []iamStatement `json:"Statement"`
+}
+
+type iamStatement struct {
+	Sid       string                       `json:"Sid"`
+	Effect    string                       `json:"Effect"`
+	Action    []string                     `json:"Action"`
+	Resource  []string                     `json:"Resource"`
+	Condition map[string]map[string]string `json:"Condition,omitempty"`
+}
+
+// policy returns the least-privilege policy for s, with a statement for
+// each kind of resource.
+func (s permissionScope) policy() iamPolicy {
+	p := iamPolicy{Version: iamPolicyVersion}
+	for _, g := range requiredPermissions(s) {
+		if n := len(p.Statement); n > 0 && p.Statement[n-1].Sid == statementIDs[g.on] {
+			p.Statement[n-1].Action = append(p.Statement[n-1].Action, g.action)
+			continue
+		}
+		arns, cond := s.resources(g.on)
+		p.Statement = append(p.Statement, iamStatement{
+			Sid:       statementIDs[g.on],
+			Effect:    "Allow",
+			Action:    []string{g.action},
+			Resource:  arns,
+			Condition: cond,
+		})
+	}
+	return p
+}
+
+// permissionCheck holds what the probes of a bucket share: the probe
+// object, its version in a versioned bucket, and the multipart upload
+// started on it.
+type permissionCheck struct {
+	scope    permissionScope
+	bucket   string
+	client   s3API
+	uploader objectUploader
+	ssec     *sseCKey
+	key      string
+	version  string
+	uploadID string
+}
+
+type permissionProbe struct {
+	action string
+	probe  func(context.Context, *permissionCheck) error
+}
+
+// errNotProbed is returned by a probe that can't check its action.
+var errNotProbed = errors.New("not checked")
+
+// permissionProbes exercise each action the plugin calls on S3 and KMS, in
+// the order they are run, with requests that only touch the probe object
+// under s3-prefix. The actions of the other services have none, as the only
+// way to check them is to publish or log something.
+var permissionProbes = []permissionProbe{
+	{"s3:ListBucket", func(ctx context.Context, c *permissionCheck) error {
+		_, err := c.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:       aws.String(c.bucket),
+			Prefix:       aws.String(c.scope.opts.S3Prefix),
+			MaxKeys:      aws.Int32(1),
+			RequestPayer: types.RequestPayer(c.scope.opts.RequestPayer),
+		})
+		return err
+	}},
+	{"s3:PutObject", func(ctx context.Context, c *permissionCheck) error {
+		return c.put(ctx, func(*batch) {})
+	}},
+	{"s3:GetObject", func(ctx context.Context, c *permissionCheck) error {
+		return c.get(ctx, "")
+	}},
+	{"s3:GetObjectVersion", func(ctx context.Context, c *permissionCheck) error {
+		if c.version == "" {
+			return fmt.Errorf("%w: the bucket isn't versioned", errNotProbed)
+		}
+		return c.get(ctx, c.version)
+	}},
+	{"s3:PutObjectTagging", func(ctx context.Context, c *permissionCheck) error {
+		return c.put(ctx, func(b *batch) { b.Tagging = driverName + "-probe=true" })
+	}},
+	{"s3:PutObjectAcl", func(ctx context.Context, c *permissionCheck) error {
+		return c.put(ctx, func(b *batch) { b.ACL = c.scope.opts.ACL })
+	}},
+	{"kms:GenerateDataKey", func(ctx context.Context, c *permissionCheck) error {
+		return c.put(ctx, func(b *batch) { b.SSEKMSKeyID = c.scope.opts.SSEKMSKeyID })
+	}},
+	{"kms:Decrypt", func(ctx context.Context, c *permissionCheck) error {
+		if err := c.put(ctx, func(b *batch) { b.SSEKMSKeyID = c.scope.opts.SSEKMSKeyID }); err != nil {
+			return fmt.Errorf("%w: the probe object can't be written with %s: %v", errNotProbed, sseKMSKeyIDKey, err)
+		}
+		return c.get(ctx, "")
+	}},
+	{"s3:ListMultipartUploadParts", func(ctx context.Context, c *permissionCheck) error {
+		if err := c.startUpload(ctx); err != nil {
+			return err
+		}
+		input := &s3.ListPartsInput{
+			Bucket:       aws.String(c.bucket),
+			Key:          aws.String(c.key),
+			UploadId:     aws.String(c.uploadID),
+			RequestPayer: types.RequestPayer(c.scope.opts.RequestPayer),
+		}
+		c.ssec.set(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+		_, err := c.client.ListParts(ctx, input)
+		return err
+	}},
+	{"s3:ListBucketMultipartUploads", func(ctx context.Context, c *permissionCheck) error {
+		_, err := c.client.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{
+			Bucket:       aws.String(c.bucket),
+			Prefix:       aws.String(c.key),
+			MaxUploads:   aws.Int32(1),
+			RequestPayer: types.RequestPayer(c.scope.opts.RequestPayer),
+		})
+		return err
+	}},
+	{"s3:AbortMultipartUpload", func(ctx context.Context, c *permissionCheck) error {
+		if err := c.startUpload(ctx); err != nil {
+			return err
+		}
+		_, err := c.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:       aws.String(c.bucket),
+			Key:          aws.String(c.key),
+			UploadId:     aws.String(c.uploadID),
+			RequestPayer: types.RequestPayer(c.scope.opts.RequestPayer),
+		})
+		if err == nil {
+			c.uploadID = ""
+		}
+		return err
+	}},
+	{"s3:DeleteObject", func(ctx context.Context, c *permissionCheck) error {
+		out, err := c.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket:       aws.String(c.bucket),
+			Delete:       &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String(c.key)}}, Quiet: aws.Bool(true)},
+			RequestPayer: types.RequestPayer(c.scope.opts.RequestPayer),
+		})
+		if err == nil && len(out.Errors) > 0 {
+			e := out.Errors[0]
+			err = fmt.Errorf("%s: %s", aws.ToString(e.Code), aws.ToString(e.Message))
+			if aws.ToString(e.Code) == "AccessDenied" {
+				err = &s3AccessDenied{err}
+			}
+		}
+		return err
+	}},
+}
+
+// s3AccessDenied is the AccessDenied of a key DeleteObjects failed on, which
+// the request itself doesn't fail with.
+type s3AccessDenied struct{ error }
+
+// put writes the probe object as the container's objects are written, with
+// its storage class and its encryption other than by sse-kms-key-id, and
+// with what set adds to it.
+func (c *permissionCheck) put(ctx context.Context, set func(*batch)) error {
+	b := probeBatch(c.scope.opts, c.bucket, []byte(driverName+" permissions check\n"))
+	b.SSEKMSKeyID, b.ACL, b.ssec = "", "", c.ssec
+	set(b)
+	if err := uploadBatch(ctx, c.uploader, b); err != nil {
+		return err
+	}
+	c.version = b.versionID
+	return nil
+}
+
+// get reads the probe object back, or the given version of it.
+func (c *permissionCheck) get(ctx context.Context, version string) error {
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(c.bucket),
+		Key:          aws.String(c.key),
+		RequestPayer: types.RequestPayer(c.scope.opts.RequestPayer),
+	}
+	if version != "" {
+		input.VersionId = aws.String(version)
+	}
+	c.ssec.set(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	out, err := c.client.GetObject(ctx, input)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, out.Body)
+	out.Body.Close()
+	return err
+}
+
+// startUpload starts the multipart upload of the probe object the multipart
+// probes share, unless it is already started.
+func (c *permissionCheck) startUpload(ctx context.Context) error {
+	if c.uploadID != "" {
+		return nil
+	}
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(c.bucket),
+		Key:          aws.String(c.key),
+		RequestPayer: types.RequestPayer(c.scope.opts.RequestPayer),
+	}
+	c.ssec.set(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	out, err := c.client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return fmt.Errorf("%w: a multipart upload can't be started: %v", errNotProbed, err)
+	}
+	c.uploadID = aws.ToString(out.UploadId)
+	return nil
+}
+
+// permissionResult is the outcome of checking an action on a resource.
+type permissionResult struct {
+	action   string
+	resource string
+	features []string
+	err      error
+}
+
+// missing reports whether the action was checked and denied.
+func (r permissionResult) missing() bool {
+	return r.err != nil && !errors.Is(r.err, errNotProbed) && (httpStatus(r.err) == http.StatusForbidden || errors.As(r.err, new(*s3AccessDenied)))
+}
+
+func (r permissionResult) String() string {
+	switch {
+	case r.action == "":
+		return fmt.Sprintf("FAIL %v", r.err)
+	case r.err == nil:
+		return fmt.Sprintf("ok   %s on %s", r.action, r.resource)
+	case errors.Is(r.err, errNotProbed):
+		return fmt.Sprintf("skip %s on %s: %v", r.action, r.resource, r.err)
+	case r.missing():
+		return fmt.Sprintf("FAIL missing %s on %s, needed for %s: %v", r.action, r.resource, strings.Join(r.features, ", "), r.err)
+	}
+	return fmt.Sprintf("FAIL error checking %s on %s: %v", r.action, r.resource, r.err)
+}
+
+// checkPermissions exercises each action s needs on each of its buckets
+// with the default credentials, or the credentials s sets, returning the
+// outcome of each. The actions there is no probe for are skipped.
+func checkPermissions(ctx context.Context, clients *clientFactory, s permissionScope) ([]permissionResult, error) {
+	grants := requiredPermissions(s)
+	var results []permissionResult
+	ssec, err := loadSSECKey(s.opts.SSECKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range s.buckets() {
+		cfg := s.opts.clientConfig()
+		if r.Region != "" {
+			cfg.Region = r.Region
+		}
+		c := &permissionCheck{scope: s, bucket: r.Bucket, ssec: ssec, key: s.opts.S3Prefix + probeKey}
+		cfg, err := clients.resolve(ctx, r.Bucket, cfg)
+		if err == nil {
+			var client s3API
+			if client, err = clients.client(cfg); err == nil {
+				c.client = client
+				c.uploader, err = clients.uploader(cfg, client)
+			}
+		}
+		if err != nil {
+			results = append(results, permissionResult{err: newOpError(opLoadCreds, r.Bucket, err)})
+			continue
+		}
+		r.Region = cfg.Region
+		bucketScope := s
+		bucketScope.opts.S3Bucket, bucketScope.opts.S3Region = r.Bucket, r.Region
+		bucketScope.opts.Replicas, bucketScope.opts.FailoverBucket = nil, ""
+		for _, p := range permissionProbes {
+			i := slices.IndexFunc(grants, func(g grant) bool { return g.action == p.action })
+			if i < 0 {
+				continue
+			}
+			arns, _ := bucketScope.resources(grants[i].on)
+			results = append(results, permissionResult{
+				action:   p.action,
+				resource: arns[0],
+				features: grants[i].features,
+				err:      p.probe(ctx, c),
+			})
+		}
+		if c.uploadID != "" {
+			logrus.WithField("bucket", r.Bucket).WithField("key", c.key).Warnf("multipart upload %s of the probe object left incomplete", c.uploadID)
+		}
+	}
+	for _, g := range grants {
+		if slices.ContainsFunc(permissionProbes, func(p permissionProbe) bool { return p.action == g.action }) {
+			continue
+		}
+		arns, _ := s.resources(g.on)
+		results = append(results, permissionResult{
+			action:   g.action,
+			resource: strings.Join(arns, ", "),
+			features: g.features,
+			err:      fmt.Errorf("%w: it can't be without publishing or logging something", errNotProbed),
+		})
+	}
+	return results, nil
+}
+
+// RunPolicy runs the policy command, which prints the least-privilege IAM
+// policy for the plugin logging a container with the given flags and
+// log-opts, or with --explain the features each action is needed for. It
+// returns the exit status.
+func RunPolicy(args []string) int {
+	var opts LogOption
+	fs := flag.NewFlagSet(driverName+" policy", flag.ExitOnError)
+	logOpts := logOptFlag{}
+	fs.Var(logOpts, "log-opt", "log-opt of the container, as key=value; may be repeated")
+	read := fs.Bool("read", true, "include the actions docker logs, query and tail read objects back with")
+	compactInterval := fs.Duration(compactIntervalKey, 0, "the plugin's --"+compactIntervalKey+", whose compaction's actions are included unless it is 0")
+	explain := fs.Bool("explain", false, "list each action with its resources and the features needing it instead of the policy")
+	optionFlags(fs, &opts)
+	fs.Parse(args)
+
+	opts, err := parseLogOpts(opts, logOpts)
+	if err == nil && opts.S3Bucket == "" {
+		err = fmt.Errorf("%s is required", s3BucketKey)
+	}
+	if err == nil && opts.UploadMode == uploadModePresigned {
+		err = fmt.Errorf("upload-mode=%s signs no requests of its own: the credentials of %s need s3:PutObject instead", uploadModePresigned, presignEndpointKey)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	s := permissionScope{opts: opts, read: *read, compact: *compactInterval > 0}
+	if *explain {
+		for _, g := range requiredPermissions(s) {
+			arns, cond := s.resources(g.on)
+			on := strings.Join(arns, ", ")
+			for _, c := range cond {
+				for k, v := range c {
+					on += fmt.Sprintf(" where %s is %s", k, v)
+				}
+			}
+			fmt.Printf("%s on %s: %s\n", g.action, on, strings.Join(g.features, ", "))
+		}
+		return 0
+	}
+	data, err := json.MarshalIndent(s.policy(), "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s\n", data)
+	return 0
+}
+
+// checkPluginPermissions runs the probes of --permissions-check for the
+// plugin's defaults, reading logs back and compacting objects if compact,
+// logging each missing permission and exiting if any is.
+func checkPluginPermissions(clients *clientFactory, opts LogOption, compact bool, timeout time.Duration) {
+	opts, err := parseLogOpts(opts, nil)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if opts.S3Bucket == "" {
+		logrus.Fatalf("--%s needs --%s to check", permissionsCheckKey, s3BucketKey)
+	}
+	if opts.UploadMode == uploadModePresigned {
+		logrus.Fatalf("--%s can't check upload-mode=%s, which signs no requests of its own", permissionsCheckKey, uploadModePresigned)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	results, err := checkPermissions(ctx, clients, permissionScope{opts: opts, read: true, compact: compact})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	var failed int
+	for _, r := range results {
+		log := logrus.WithField("action", r.action).WithField("resource", r.resource)
+		switch {
+		case r.err == nil:
+			log.Debug("permission checked")
+		case errors.Is(r.err, errNotProbed):
+			log.Info(r.String())
+		default:
+			failed++
+			log.Error(r.String())
+		}
+	}
+	if failed > 0 {
+		logrus.Fatalf("%s found %d permissions missing or failing, see `%s policy` for the policy the plugin needs", permissionsCheckKey, failed, driverName)
+	}
+	logrus.Info("permissions check passed")
+}
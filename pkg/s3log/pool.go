@@ -0,0 +1,274 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	uploadWorkersKey    = "upload-workers"
+	s3RequestTimeoutKey = "s3-request-timeout"
+
+	defaultUploadWorkers    = 4
+	defaultS3RequestTimeout = 5 * time.Minute
+
+	// lowPriorityWait is how long a low-priority job yields to the others
+	// before it waits for a worker like any other, so that it is never
+	// starved.
+	lowPriorityWait = 10 * time.Second
+)
+
+var uploadQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: driverName,
+	Name:      "upload_queue_depth",
+	Help:      "Uploads waiting for a free worker.",
+})
+
+func init() {
+	metricsRegistry.MustRegister(uploadQueueDepth)
+}
+
+// errPoolClosed fails the uploads queued once the plugin has shut down.
+var errPoolClosed = errors.New("upload pool is closed, the plugin is shutting down")
+
+// uploadPool bounds how many uploads run at once across every container on
+// the host. Each logger flushes one batch at a time and waits for it, so a
+// container never has more than one job queued and its batches complete in
+// order. Each bucket has a circuit breaker shared by every container
+// uploading to it, and flushes share the host's max-puts-per-second and
+// daily cost budget.
+//
+// Jobs queue by tenant, and a free worker takes the next job of the tenant
+// that has had the least of the workers for its weight, so that a tenant
+// with many containers, or slow uploads, takes no more than its share while
+// others are waiting and all of the workers while they aren't. Workers take
+// the jobs of low-priority contexts only while no other job is waiting.
+type uploadPool struct {
+	puts *rate.Limiter
+	cost *costBudget
+
+	mu      sync.Mutex
+	ready   *sync.Cond // signalled as jobs are queued
+	tenants map[string]*tenant
+	vtime   float64 // virtual start of the job last taken
+	closed  bool
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	breakersMu       sync.Mutex
+	breakers         map[string]*circuitBreaker
+}
+
+// poolJob is an upload waiting in its tenant's queue for a worker.
+type poolJob struct {
+	ctx    context.Context
+	fn     func(context.Context) error
+	done   chan error
+	tenant *tenant
+	low    bool
+	queued time.Time
+}
+
+func newUploadPool(workers, breakerThreshold int, breakerCooldown time.Duration, maxPuts float64) *uploadPool {
+	p := &uploadPool{
+		puts:             newPutLimiter(maxPuts),
+		tenants:          make(map[string]*tenant),
+		breakerThreshold: breakerThreshold,
+		breakerCooldown:  breakerCooldown,
+		breakers:         make(map[string]*circuitBreaker),
+	}
+	p.ready = sync.NewCond(&p.mu)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *uploadPool) work() {
+	for {
+		j := p.next()
+		if j == nil {
+			return
+		}
+		j.done <- j.fn(j.ctx)
+		p.mu.Lock()
+		j.tenant.running--
+		tenantWorkersBusy.WithLabelValues(j.tenant.name).Dec()
+		p.mu.Unlock()
+	}
+}
+
+// next waits for a job a worker may take and takes it, or returns nil once
+// the pool is closed.
+func (p *uploadPool) next() *poolJob {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.closed {
+		if j := p.take(time.Now()); j != nil {
+			return j
+		}
+		p.ready.Wait()
+	}
+	return nil
+}
+
+// take dequeues the job the next free worker runs, or returns nil if no
+// tenant with jobs queued is under its upload-workers. Of the tenants whose
+// first job isn't low priority, or all of them if none is, it is the first
+// job of the one with the earliest virtual time, which each job taken
+// advances by the inverse of its tenant's weight. Callers must hold p.mu.
+func (p *uploadPool) take(now time.Time) *poolJob {
+	var next *tenant
+	var nextLow bool
+	for _, t := range p.tenants {
+		if len(t.queue) == 0 || (t.workers > 0 && t.running >= t.workers) {
+			continue
+		}
+		low := t.queue[0].yields(now)
+		switch {
+		case next == nil, nextLow && !low:
+		case low != nextLow, t.vtime > next.vtime, t.vtime == next.vtime && t.name > next.name:
+			continue
+		}
+		next, nextLow = t, low
+	}
+	if next == nil {
+		return nil
+	}
+	j := next.queue[0]
+	next.queue = slices.Delete(next.queue, 0, 1)
+	p.vtime = next.vtime
+	next.vtime += 1 / next.weight
+	next.running++
+	uploadQueueDepth.Dec()
+	tenantQueueDepth.WithLabelValues(next.name).Dec()
+	tenantWorkersBusy.WithLabelValues(next.name).Inc()
+	tenantUploadWait.WithLabelValues(next.name).Observe(now.Sub(j.queued).Seconds())
+	return j
+}
+
+// yields reports whether j still lets other jobs go first, as a
+// low-priority job does for up to lowPriorityWait.
+func (j *poolJob) yields(now time.Time) bool {
+	return j.low && now.Sub(j.queued) < lowPriorityWait
+}
+
+// enqueue queues j behind the other jobs of its tenant, returning false if
+// the pool is closed. A tenant that had nothing queued or running starts
+// from the pool's virtual time, rather than from where it left off, so that
+// it gets its share from now on instead of making up for the time it was
+// idle.
+func (p *uploadPool) enqueue(j *poolJob) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	t := j.tenant
+	if len(t.queue) == 0 && t.running == 0 {
+		t.vtime = max(t.vtime, p.vtime)
+	}
+	// Low-priority jobs yield to the tenant's others too.
+	i := len(t.queue)
+	if !j.low {
+		for i > 0 && t.queue[i-1].yields(j.queued) {
+			i--
+		}
+	}
+	t.queue = slices.Insert(t.queue, i, j)
+	uploadQueueDepth.Inc()
+	tenantQueueDepth.WithLabelValues(t.name).Inc()
+	p.ready.Signal()
+	return true
+}
+
+// dequeue removes j from its tenant's queue, returning false if a worker
+// took it first.
+func (p *uploadPool) dequeue(j *poolJob) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := j.tenant
+	i := slices.Index(t.queue, j)
+	if i < 0 {
+		return false
+	}
+	t.queue = slices.Delete(t.queue, i, i+1)
+	uploadQueueDepth.Dec()
+	tenantQueueDepth.WithLabelValues(t.name).Dec()
+	return true
+}
+
+// close stops the workers once they have finished the jobs they are running.
+// Jobs still queued, and those queued after it, fail with errPoolClosed.
+func (p *uploadPool) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, t := range p.tenants {
+		for _, j := range t.queue {
+			j.done <- errPoolClosed
+			uploadQueueDepth.Dec()
+			tenantQueueDepth.WithLabelValues(t.name).Dec()
+		}
+		t.queue = nil
+	}
+	p.ready.Broadcast()
+}
+
+// do runs fn on a worker and returns its error, or ctx's if ctx is done
+// before a worker is free. Its job is queued for the tenant of ctx. A nil
+// pool runs fn directly.
+func (p *uploadPool) do(ctx context.Context, fn func(context.Context) error) error {
+	if p == nil {
+		return fn(ctx)
+	}
+	j := &poolJob{ctx: ctx, fn: fn, done: make(chan error, 1), tenant: p.tenant(tenantOf(ctx)), low: isLowPriority(ctx), queued: time.Now()}
+	if !p.enqueue(j) {
+		return errPoolClosed
+	}
+	select {
+	case err := <-j.done:
+		return err
+	case <-ctx.Done():
+		if p.dequeue(j) {
+			return ctx.Err()
+		}
+		return <-j.done
+	}
+}
+
+// upload makes a single attempt at an upload to bucket on a worker, bounded
+// by timeout. While the bucket's circuit breaker is open it fails with
+// errBreakerOpen without calling fn.
+func (p *uploadPool) upload(ctx context.Context, bucket string, timeout time.Duration, fn func(context.Context) error) error {
+	br := p.breaker(bucket)
+	return p.do(ctx, func(ctx context.Context) error {
+		if err := br.allow(); err != nil {
+			return err
+		}
+		ctx, cancel := requestContext(ctx, timeout)
+		defer cancel()
+		err := fn(ctx)
+		br.record(err)
+		return err
+	})
+}
+
+// requestContext bounds a single S3 request by timeout, so that a request
+// that hangs fails and is retried instead of holding up its logger's flushes
+// for good. A timeout of zero leaves the request unbounded.
+func requestContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,215 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	fake := newFakeS3()
+	var slept atomic.Int32
+	fake.before = func(ctx context.Context, op, _, _ string) error {
+		if op != "PutObject" {
+			return nil
+		}
+		// Sleep well past the deadline unless the request is abandoned.
+		slept.Add(1)
+		select {
+		case <-time.After(10 * time.Second):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	l := newTestLogger(t, fake, map[string]string{
+		s3RequestTimeoutKey: "50ms",
+		maxRetriesKey:       "2",
+		maxRetryDelayKey:    "10ms",
+	})
+	logLines(t, l, time.Now(), "hung")
+
+	start := time.Now()
+	l.flush(context.Background())
+	// Three attempts of 50ms each, and two short backoffs.
+	if took := time.Since(start); took > 3*50*time.Millisecond+500*time.Millisecond {
+		t.Errorf("flush took %v with a 50ms s3-request-timeout", took)
+	}
+	if n := slept.Load(); n != 3 {
+		t.Errorf("made %d attempts, want a timed-out upload retried twice", n)
+	}
+}
+
+func TestUploadPoolBound(t *testing.T) {
+	const workers = 3
+	p := newUploadPool(workers, defaultBreakerThreshold, defaultBreakerCooldown, 0)
+	defer p.close()
+	var running, most atomic.Int32
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.do(context.Background(), func(context.Context) error {
+				n := running.Add(1)
+				for {
+					m := most.Load()
+					if n <= m || most.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				running.Add(-1)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	if m := most.Load(); m != workers {
+		t.Errorf("%d uploads ran at once, want %d", m, workers)
+	}
+}
+
+func TestUploadPoolCanceledWhileQueued(t *testing.T) {
+	p := newUploadPool(1, defaultBreakerThreshold, defaultBreakerCooldown, 0)
+	defer p.close()
+	release := make(chan struct{})
+	go p.do(context.Background(), func(context.Context) error {
+		<-release
+		return nil
+	})
+	defer close(release)
+	waitFor(t, "the worker to be busy", func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, t := range p.tenants {
+			if t.running > 0 {
+				return true
+			}
+		}
+		return false
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	ran := false
+	err := p.do(ctx, func(context.Context) error {
+		ran = true
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || ran {
+		t.Errorf("queued upload past its deadline: %v, ran %v", err, ran)
+	}
+}
+
+func TestUploadPoolClosed(t *testing.T) {
+	p := newUploadPool(1, defaultBreakerThreshold, defaultBreakerCooldown, 0)
+	p.close()
+	if err := p.do(context.Background(), func(context.Context) error { return nil }); !errors.Is(err, errPoolClosed) {
+		t.Errorf("upload to a closed pool: %v, want errPoolClosed", err)
+	}
+}
+
+// queued returns how many jobs wait in p's queues.
+func queued(p *uploadPool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, t := range p.tenants {
+		n += len(t.queue)
+	}
+	return n
+}
+
+// occupy holds the pool's only worker until the returned func is called.
+func occupy(t *testing.T, p *uploadPool) func() {
+	t.Helper()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go p.do(context.Background(), func(context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	var once sync.Once
+	return func() { once.Do(func() { close(release) }) }
+}
+
+func TestUploadPoolLowPriority(t *testing.T) {
+	// Low-priority jobs wait until no other job is, of their own tenant or
+	// another.
+	tests := []struct {
+		name   string
+		tenant string // of the normal job, the low-priority ones having none
+	}{
+		{name: "same tenant"},
+		{name: "other tenant", tenant: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newUploadPool(1, defaultBreakerThreshold, defaultBreakerCooldown, 0)
+			defer p.close()
+			release := occupy(t, p)
+			defer release()
+
+			var mu sync.Mutex
+			var order []string
+			run := func(ctx context.Context, name string, wg *sync.WaitGroup) {
+				defer wg.Done()
+				p.do(ctx, func(context.Context) error {
+					mu.Lock()
+					order = append(order, name)
+					mu.Unlock()
+					return nil
+				})
+			}
+			var wg sync.WaitGroup
+			for i := range 5 {
+				wg.Add(1)
+				go run(withLowPriority(context.Background()), fmt.Sprintf("low %d", i), &wg)
+				waitFor(t, "the job to queue", func() bool { return queued(p) == i+1 })
+			}
+			wg.Add(1)
+			go run(withTenant(context.Background(), tt.tenant), "normal", &wg)
+			waitFor(t, "the job to queue", func() bool { return queued(p) == 6 })
+			release()
+			wg.Wait()
+			want := []string{"normal", "low 0", "low 1", "low 2", "low 3", "low 4"}
+			if !slices.Equal(order, want) {
+				t.Errorf("ran %q, want %q", order, want)
+			}
+		})
+	}
+}
+
+func TestUploadPoolLowPriorityNotStarved(t *testing.T) {
+	// A low-priority job that has waited lowPriorityWait stops yielding,
+	// and competes with the other tenant's job like any other, winning here
+	// on its tenant's name.
+	for _, waited := range []time.Duration{0, lowPriorityWait - time.Second, lowPriorityWait + time.Second} {
+		t.Run(waited.String(), func(t *testing.T) {
+			p := newUploadPool(0, defaultBreakerThreshold, defaultBreakerCooldown, 0)
+			defer p.close()
+			now := time.Now()
+			low := &poolJob{ctx: context.Background(), done: make(chan error, 1), tenant: p.tenant("a"), low: true, queued: now.Add(-waited)}
+			normal := &poolJob{ctx: context.Background(), done: make(chan error, 1), tenant: p.tenant("b"), queued: now}
+			p.enqueue(low)
+			p.enqueue(normal)
+			want := normal
+			if waited >= lowPriorityWait {
+				want = low
+			}
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if got := p.take(now); got != want {
+				t.Errorf("took the low-priority job %v, want %v", got == low, want == low)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	uploadModeKey       = "upload-mode"
+	presignEndpointKey  = "presign-endpoint"
+	presignTokenFileKey = "presign-token-file"
+
+	uploadModeS3        = "s3"
+	uploadModePresigned = "presigned"
+
+	// presignRefreshes is how many times an upload presigns its key again
+	// when the URL it got is refused as expired, before failing the attempt.
+	presignRefreshes = 2
+
+	// maxPresignResponseSize bounds how much is read of a response from the
+	// presign endpoint, or of a failed PUT.
+	maxPresignResponseSize = 4 << 10
+)
+
+var presignRefreshed = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: driverName,
+	Name:      "presign_refreshes_total",
+	Help:      "Presigned URLs requested again after the upload to the last one was refused with 403.",
+})
+
+func init() {
+	metricsRegistry.MustRegister(presignRefreshed)
+}
+
+// errPresignedUnreadable is returned when reading back the objects of a
+// container uploading with presigned URLs, which has no credentials to read
+// them with.
+var errPresignedUnreadable = errors.New("upload-mode=presigned has no credentials to read objects back from S3, docker logs can only show them from its cache")
+
+// presignConfig names the service that presigns the PUT of each object, for
+// containers that upload without S3 credentials of their own. Only the path
+// of the token file is kept, so spooled batches read it again when they are
+// drained.
+type presignConfig struct {
+	Endpoint  string `json:"endpoint,omitempty"`
+	TokenFile string `json:"token_file,omitempty"`
+}
+
+// presignRequest is what the presign endpoint is asked to sign: the key of
+// an object, its size and type, and the headers its PUT will be sent with,
+// which a signature has to cover.
+type presignRequest struct {
+	Bucket      string            `json:"bucket"`
+	Key         string            `json:"key"`
+	Size        int               `json:"size"`
+	ContentType string            `json:"content_type,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+// presignResponse is the presigned URL to PUT the object to, and any headers
+// the endpoint requires the PUT to send besides those it was asked for.
+type presignResponse struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// presignUploader uploads each object with a single plain HTTP PUT to a URL
+// the presign endpoint signs for it. It satisfies objectUploader, so uploads
+// are retried and spooled like any other; the uploader options, which only
+// apply to the SDK's uploader, are ignored.
+type presignUploader struct {
+	cfg    presignConfig
+	client aws.HTTPClient
+}
+
+// uploader returns the uploader for cfg: client's, or for upload-mode=presigned
+// one that PUTs to presigned URLs instead.
+func (f *clientFactory) uploader(cfg clientConfig, client s3API, optFns ...func(*manager.Uploader)) (objectUploader, error) {
+	if cfg.Presign.Endpoint == "" {
+		return manager.NewUploader(client, optFns...), nil
+	}
+	httpClient, err := f.httpClient(cfg.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &presignUploader{cfg: cfg.Presign, client: httpClient}, nil
+}
+
+func (u *presignUploader) Upload(ctx context.Context, input *s3.PutObjectInput, _ ...func(*manager.Uploader)) (*manager.UploadOutput, error) {
+	body, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	header := putHeader(input, body)
+	req := presignRequest{
+		Bucket:      aws.ToString(input.Bucket),
+		Key:         aws.ToString(input.Key),
+		Size:        len(body),
+		ContentType: aws.ToString(input.ContentType),
+		Headers:     make(map[string]string, len(header)),
+	}
+	for k := range header {
+		req.Headers[strings.ToLower(k)] = header.Get(k)
+	}
+	for refresh := 0; ; refresh++ {
+		signed, err := u.presign(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := u.put(ctx, signed, header, body)
+		if err == nil {
+			out := &manager.UploadOutput{Location: unsignedURL(signed.URL), Key: input.Key}
+			if v := resp.Header.Get("x-amz-version-id"); v != "" {
+				out.VersionID = aws.String(v)
+			}
+			if v := resp.Header.Get("ETag"); v != "" {
+				out.ETag = aws.String(v)
+			}
+			return out, nil
+		}
+		var pe *presignError
+		if !errors.As(err, &pe) || !pe.put || pe.status != http.StatusForbidden || refresh == presignRefreshes {
+			return nil, err
+		}
+		// The URL may have expired while the batch waited to be uploaded,
+		// which isn't a failure of the upload itself.
+		presignRefreshed.Inc()
+	}
+}
+
+// presign asks the presign endpoint for the URL to PUT req's object to.
+func (u *presignUploader) presign(ctx context.Context, req presignRequest) (presignResponse, error) {
+	token, err := readPresignToken(u.cfg.TokenFile)
+	if err != nil {
+		return presignResponse{}, err
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return presignResponse{}, err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, u.cfg.Endpoint, bytes.NewReader(data))
+	if err != nil {
+		return presignResponse{}, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+token)
+	resp, err := u.client.Do(r)
+	if err != nil {
+		return presignResponse{}, fmt.Errorf("failed to presign object %q: %w", req.Key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return presignResponse{}, newPresignError(false, resp)
+	}
+	var signed presignResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxPresignResponseSize)).Decode(&signed); err != nil {
+		return presignResponse{}, fmt.Errorf("invalid response from %s: %v", presignEndpointKey, err)
+	}
+	if pu, err := url.Parse(signed.URL); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+		return presignResponse{}, fmt.Errorf("invalid response from %s: url must be an http or https URL", presignEndpointKey)
+	}
+	return signed, nil
+}
+
+// put sends body to signed's URL with header and the headers signed asks
+// for.
+func (u *presignUploader) put(ctx context.Context, signed presignResponse, header http.Header, body []byte) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPut, signed.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header = header.Clone()
+	for k, v := range signed.Headers {
+		r.Header.Set(k, v)
+	}
+	resp, err := u.client.Do(r)
+	if err != nil {
+		// The URL's query is its signature.
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			ue.URL = unsignedURL(ue.URL)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, newPresignError(true, resp)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp, nil
+}
+
+// putHeader returns the headers of the PUT of input's object, along with the
+// SHA-256 checksum of body: S3 verifies a single PUT against it, and unlike
+// the SDK a plain PUT has nothing to compute it as the body is sent.
+func putHeader(input *s3.PutObjectInput, body []byte) http.Header {
+	h := make(http.Header)
+	set := func(k, v string) {
+		if v != "" {
+			h.Set(k, v)
+		}
+	}
+	set("Content-Type", aws.ToString(input.ContentType))
+	set("Content-Encoding", aws.ToString(input.ContentEncoding))
+	set("x-amz-tagging", aws.ToString(input.Tagging))
+	for k, v := range input.Metadata {
+		set("x-amz-meta-"+k, v)
+	}
+	set("x-amz-server-side-encryption", string(input.ServerSideEncryption))
+	set("x-amz-server-side-encryption-aws-kms-key-id", aws.ToString(input.SSEKMSKeyId))
+	set("x-amz-storage-class", string(input.StorageClass))
+	set("x-amz-acl", string(input.ACL))
+	set("x-amz-request-payer", string(input.RequestPayer))
+	if input.ChecksumAlgorithm != "" {
+		sum := aws.ToString(input.ChecksumSHA256)
+		if sum == "" {
+			s := sha256.Sum256(body)
+			sum = base64.StdEncoding.EncodeToString(s[:])
+		}
+		set("x-amz-checksum-sha256", sum)
+	}
+	return h
+}
+
+// unsignedURL returns v without its query, which holds a presigned URL's
+// signature, for logs and errors.
+func unsignedURL(v string) string {
+	u, err := url.Parse(v)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery = ""
+	return u.Redacted()
+}
+
+// readPresignToken returns the bearer token in path, read every time it is
+// used so that rotating the file takes effect on the next upload. Errors
+// never quote the file's contents.
+func readPresignToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %v", presignTokenFileKey, err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" || strings.ContainsAny(token, "\r\n") {
+		return "", fmt.Errorf("invalid %s %q: must hold a single bearer token", presignTokenFileKey, path)
+	}
+	return token, nil
+}
+
+// presignError is a failed response from the presign endpoint or to a PUT.
+// It carries the status and, from S3's XML error, the code, which is how
+// isRetryable and the error metrics classify it as they would an SDK error.
+type presignError struct {
+	put     bool // of the PUT rather than from the presign endpoint
+	status  int
+	code    string
+	message string
+}
+
+var _ smithy.APIError = (*presignError)(nil)
+
+func newPresignError(put bool, resp *http.Response) *presignError {
+	e := &presignError{put: put, status: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxPresignResponseSize))
+	var s3Err struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(data, &s3Err) == nil {
+		e.code, e.message = s3Err.Code, s3Err.Message
+	} else {
+		e.message = strings.TrimSpace(string(data))
+	}
+	return e
+}
+
+func (e *presignError) Error() string {
+	op := presignEndpointKey
+	if e.put {
+		op = "presigned PUT"
+	}
+	msg := fmt.Sprintf("%s: %d %s", op, e.status, http.StatusText(e.status))
+	if e.code != "" {
+		msg += ": " + e.code
+	}
+	if e.message != "" {
+		msg += ": " + e.message
+	}
+	return msg
+}
+
+func (e *presignError) HTTPStatusCode() int { return e.status }
+
+func (e *presignError) ErrorCode() string { return e.code }
+
+func (e *presignError) ErrorMessage() string { return e.message }
+
+func (e *presignError) ErrorFault() smithy.ErrorFault {
+	if e.status >= 500 {
+		return smithy.FaultServer
+	}
+	return smithy.FaultClient
+}
@@ -0,0 +1,297 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakePresigner is a presign endpoint along with the bucket its URLs PUT
+// to, in one server.
+type fakePresigner struct {
+	srv   *httptest.Server
+	token string // the bearer token presign requests must carry
+
+	mu       sync.Mutex
+	presigns []presignRequest
+	puts     []presignedPut
+	// putStatus is the status of each PUT in turn, until they run out and
+	// PUTs succeed.
+	putStatus []int
+}
+
+// presignedPut is a PUT to a presigned URL.
+type presignedPut struct {
+	path      string
+	signature string
+	header    http.Header
+	body      []byte
+	stored    bool // rather than refused
+}
+
+// newFakePresigner serves a presign endpoint until the end of the test,
+// with its token written to a file the returned log-opts point at.
+func newFakePresigner(t *testing.T) (*fakePresigner, map[string]string) {
+	t.Helper()
+	p := &fakePresigner{token: "bearer-s3cr3t"}
+	p.srv = httptest.NewServer(p)
+	t.Cleanup(p.srv.Close)
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte(p.token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p, map[string]string{
+		uploadModeKey:       uploadModePresigned,
+		presignEndpointKey:  p.srv.URL + "/presign",
+		presignTokenFileKey: token,
+	}
+}
+
+func (p *fakePresigner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/presign":
+		if r.Header.Get("Authorization") != "Bearer "+p.token {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		var req presignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.presigns = append(p.presigns, req)
+		json.NewEncoder(w).Encode(presignResponse{
+			URL:     fmt.Sprintf("%s/%s/%s?X-Amz-Signature=sig%d", p.srv.URL, req.Bucket, req.Key, len(p.presigns)),
+			Headers: map[string]string{"x-amz-meta-signed-by": "fake"},
+		})
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		p.puts = append(p.puts, presignedPut{path: r.URL.Path, signature: r.URL.Query().Get("X-Amz-Signature"), header: r.Header.Clone(), body: body})
+		if len(p.putStatus) > 0 {
+			status := p.putStatus[0]
+			p.putStatus = p.putStatus[1:]
+			w.WriteHeader(status)
+			if status == http.StatusForbidden {
+				io.WriteString(w, "<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>")
+			}
+			return
+		}
+		p.puts[len(p.puts)-1].stored = true
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("x-amz-version-id", "v1")
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// counts returns how many URLs were presigned and PUT to.
+func (p *fakePresigner) counts() (presigns, puts int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.presigns), len(p.puts)
+}
+
+func TestPresignedUpload(t *testing.T) {
+	// Each object is presigned for its key, size and type, then PUT to the
+	// URL with the headers signed for. S3 itself is never called.
+	fake := newFakeS3()
+	p, cfg := newFakePresigner(t)
+	l := newTestLogger(t, fake, cfg)
+	logLines(t, l, time.Now(), "one", "two")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.count("PutObject"); n != 0 {
+		t.Errorf("%d PutObject calls to S3, want none", n)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.presigns) != 1 || len(p.puts) != 1 {
+		t.Fatalf("%d presigns and %d PUTs, want one of each", len(p.presigns), len(p.puts))
+	}
+	req, put := p.presigns[0], p.puts[0]
+	if req.Bucket != testBucket || !strings.HasPrefix(req.Key, l.keyPrefix()) || req.Size != len(put.body) || req.ContentType == "" {
+		t.Errorf("presigned %+v for a %d byte PUT", req, len(put.body))
+	}
+	if want := "/" + testBucket + "/" + req.Key; put.path != want || put.signature != "sig1" {
+		t.Errorf("PUT to %s signed %q, want %s signed by the presign", put.path, put.signature, want)
+	}
+	for k, v := range req.Headers {
+		if put.header.Get(k) != v {
+			t.Errorf("PUT with %s %q, want the %q it was signed with", k, put.header.Get(k), v)
+		}
+	}
+	if put.header.Get("x-amz-meta-signed-by") != "fake" || put.header.Get("Content-Type") != req.ContentType {
+		t.Errorf("PUT with headers %v, want those the presign response asked for", put.header)
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(string(put.body)), "\n") {
+		var r record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, r.Log)
+	}
+	if strings.Join(lines, ",") != "one,two" {
+		t.Errorf("PUT lines %q, want one and two", lines)
+	}
+}
+
+func TestPresignedRetry(t *testing.T) {
+	// A PUT refused with 403 is presigned again without using up a retry,
+	// while other failures are retried like S3's.
+	tests := []struct {
+		name      string
+		status    []int
+		retries   string
+		presigns  int
+		puts      int
+		refreshed float64
+		uploaded  bool
+	}{
+		{name: "first try", retries: "0", presigns: 1, puts: 1, uploaded: true},
+		{name: "expired", status: []int{http.StatusForbidden}, retries: "0", presigns: 2, puts: 2, refreshed: 1, uploaded: true},
+		{name: "expired again", status: []int{http.StatusForbidden, http.StatusForbidden}, retries: "0", presigns: 3, puts: 3, refreshed: 2, uploaded: true},
+		{name: "always refused", status: []int{http.StatusForbidden, http.StatusForbidden, http.StatusForbidden}, retries: "0", presigns: 3, puts: 3, refreshed: 2},
+		{name: "unavailable", status: []int{http.StatusServiceUnavailable}, retries: "1", presigns: 2, puts: 2, uploaded: true},
+		{name: "out of retries", status: []int{http.StatusServiceUnavailable}, retries: "0", presigns: 1, puts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			p, cfg := newFakePresigner(t)
+			p.putStatus = tt.status
+			cfg[maxRetriesKey], cfg[maxRetryDelayKey] = tt.retries, "1ms"
+			l := newTestLogger(t, fake, cfg)
+			refreshed := metricValue(presignRefreshed)
+			logLines(t, l, time.Now(), "line")
+			l.Close()
+			if presigns, puts := p.counts(); presigns != tt.presigns || puts != tt.puts {
+				t.Errorf("%d presigns and %d PUTs, want %d and %d", presigns, puts, tt.presigns, tt.puts)
+			}
+			if got := metricValue(presignRefreshed) - refreshed; got != tt.refreshed {
+				t.Errorf("%v presigns counted refreshed, want %v", got, tt.refreshed)
+			}
+			p.mu.Lock()
+			last := p.puts[len(p.puts)-1]
+			p.mu.Unlock()
+			if uploaded := last.stored && strings.Contains(string(last.body), `"line"`); uploaded != tt.uploaded {
+				t.Errorf("uploaded = %v, want %v", uploaded, tt.uploaded)
+			}
+		})
+	}
+}
+
+func TestPresignUploaderErrors(t *testing.T) {
+	// Failures of the presign endpoint are reported as its own, without
+	// the token or a URL's signature.
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		token   string
+		wantErr string
+	}{
+		{
+			name:    "unauthorized",
+			handler: func(w http.ResponseWriter, _ *http.Request) { http.Error(w, "bad token", http.StatusUnauthorized) },
+			token:   "bearer-s3cr3t",
+			wantErr: presignEndpointKey + ": 401 Unauthorized: bad token",
+		},
+		{
+			name:    "not json",
+			handler: func(w http.ResponseWriter, _ *http.Request) { io.WriteString(w, "<html>") },
+			token:   "bearer-s3cr3t",
+			wantErr: "invalid response from " + presignEndpointKey,
+		},
+		{
+			name:    "not a URL",
+			handler: func(w http.ResponseWriter, _ *http.Request) { io.WriteString(w, `{"url":"ftp://bucket/key"}`) },
+			token:   "bearer-s3cr3t",
+			wantErr: "url must be an http or https URL",
+		},
+		{
+			name:    "empty token",
+			handler: func(http.ResponseWriter, *http.Request) { t.Error("presign requested without a token") },
+			token:   "\n",
+			wantErr: "must hold a single bearer token",
+		},
+		{
+			name: "PUT unreachable",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				io.WriteString(w, `{"url":"http://127.0.0.1:1/bucket/key?X-Amz-Signature=secret-signature"}`)
+			},
+			token:   "bearer-s3cr3t",
+			wantErr: "http://127.0.0.1:1/bucket/key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+			token := filepath.Join(t.TempDir(), "token")
+			if err := os.WriteFile(token, []byte(tt.token), 0600); err != nil {
+				t.Fatal(err)
+			}
+			u := &presignUploader{cfg: presignConfig{Endpoint: srv.URL, TokenFile: token}, client: srv.Client()}
+			_, err := u.Upload(context.Background(), &s3.PutObjectInput{
+				Bucket: aws.String(testBucket),
+				Key:    aws.String("key"),
+				Body:   strings.NewReader("line\n"),
+			})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("upload returned %v, want an error containing %q", err, tt.wantErr)
+			}
+			if msg := err.Error(); strings.Contains(msg, "bearer-s3cr3t") || strings.Contains(msg, "secret-signature") {
+				t.Errorf("error %q gives away a secret", msg)
+			}
+		})
+	}
+}
+
+func TestPresignTokenRotated(t *testing.T) {
+	// The token file is read for every presign, so a rotated token is used
+	// from the next upload on.
+	fake := newFakeS3()
+	p, cfg := newFakePresigner(t)
+	l := newTestLogger(t, fake, cfg)
+	logLines(t, l, time.Now(), "one")
+	if err := l.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.token = "rotated"
+	p.mu.Unlock()
+	if err := os.WriteFile(cfg[presignTokenFileKey], []byte("rotated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	logLines(t, l, time.Now(), "two")
+	if err := l.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if presigns, puts := p.counts(); presigns != 2 || puts != 2 {
+		t.Errorf("%d presigns and %d PUTs, want both flushes uploaded", presigns, puts)
+	}
+}
+
+func TestPresignedUnreadable(t *testing.T) {
+	_, cfg := newFakePresigner(t)
+	l := newTestLogger(t, newFakeS3(), cfg)
+	if err := l.read(context.Background(), NewLogWatcher(), ReadConfig{}); err != errPresignedUnreadable {
+		t.Errorf("read returned %v, want %v", err, errPresignedUnreadable)
+	}
+}
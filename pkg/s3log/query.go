@@ -0,0 +1,264 @@
+package s3log
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// RunQuery runs the query command, which prints the stored lines of a
+// container that contain a string, as they are stored. It takes the same
+// log-opt flags as the plugin, so that it finds the container's objects
+// where the plugin put them, and returns the exit status.
+func RunQuery(args []string) int {
+	var opts LogOption
+	fs := flag.NewFlagSet(driverName+" query", flag.ExitOnError)
+	containerID := fs.String("container-id", "", "full ID of the container whose lines are queried")
+	containerName := fs.String("container-name", "", "name of the container, if the key template uses it")
+	group := fs.String("group", "", "group of the container, if "+groupByLabelKey+" is set and it has one")
+	stable := fs.String("stable-key", "", "stable key whose runs are queried, if "+stableKeySourceKey+" is set, instead of the container's")
+	since := fs.String("since", "", "only lines logged since this RFC 3339 time, or this long ago, e.g. 2h")
+	until := fs.String("until", "", "only lines logged until this RFC 3339 time, or this long ago")
+	match := fs.String("match", "", "only lines containing this string")
+	allowInsecure := fs.Bool(allowInsecureKey, false, "allow "+insecureSkipVerifyKey)
+	levelVal := fs.String("log-level", "warn", "level of the plugin's own logs while querying")
+	optionFlags(fs, &opts)
+	fs.Parse(args)
+
+	setLogLevel(*levelVal)
+	if *containerID == "" {
+		fmt.Fprintln(os.Stderr, "--container-id is required")
+		return 2
+	}
+	now := time.Now()
+	var config ReadConfig
+	var err error
+	if config.Since, err = parseQueryTime(*since, now); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --since: %v\n", err)
+		return 2
+	}
+	if config.Until, err = parseQueryTime(*until, now); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --until: %v\n", err)
+		return 2
+	}
+	opts, err = parseLogOpts(opts, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, newOpError(opParseOptions, "", err))
+		return 1
+	}
+	// Querying reads what was uploaded; it journals nothing and writes no
+	// probe.
+	opts.WAL = false
+	opts.VerifyWrite = false
+	// A stable key is queried across all its runs.
+	opts.stableKey = *stable
+	opts.ReadPriorRuns = true
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	clients := newClientFactory(loadAWSConfig(), opts.Concurrency, *allowInsecure)
+	info := Info{ContainerID: *containerID, ContainerName: *containerName, Config: map[string]string{}}
+	if *group != "" && len(opts.GroupByLabel) > 0 {
+		info.ContainerLabels = map[string]string{opts.GroupByLabel[0]: *group}
+	}
+	l, err := newLogger(clients, nil, nil, opts, info, nil, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer l.Close()
+
+	loggers := s3Loggers(l)
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for _, l := range loggers {
+		if err := l.query(ctx, w, config, *match); err != nil {
+			w.Flush()
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// parseQueryTime parses v as an RFC 3339 time or as a duration before now.
+// An empty v is the zero time.
+func parseQueryTime(v string, now time.Time) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+// query writes the lines of the logger's objects that fall inside config's
+// window and contain match to w, oldest object first. jsonl objects that
+// aren't compressed, or are gzipped, are filtered by S3 Select so that only
+// matching records are downloaded, and are written as S3 Select serializes
+// them. Everything else is downloaded and filtered here, and written as it
+// is stored. Once S3 Select fails, as it does on stores and accounts that
+// don't offer it, the remaining objects are downloaded too.
+func (l *S3Logger) query(ctx context.Context, w io.Writer, config ReadConfig, match string) error {
+	objects, err := l.listObjects(ctx, config)
+	if err != nil {
+		return err
+	}
+	// Merged records have no log field for S3 Select to match.
+	useSelect := l.opts.Format == formatJSONL && (match == "" || !l.opts.MergeJSONLog)
+	for _, obj := range objects {
+		obj, ok := l.seek(ctx, obj, config.Since)
+		if !ok {
+			continue
+		}
+		if useSelect {
+			if compression, ok := selectCompression(obj); ok {
+				data, err := l.selectObject(ctx, obj, compression, match)
+				if isDeleted(err) {
+					continue
+				}
+				if err == nil {
+					if err := l.grep(w, bytes.NewReader(data), obj, config, match); err != nil {
+						return err
+					}
+					continue
+				}
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				l.log().WithField("key", obj.key).WithError(err).Warn("error querying object with S3 Select, downloading objects instead")
+				useSelect = false
+			}
+		}
+		r, err := l.openObject(ctx, obj)
+		if isDeleted(err) {
+			continue
+		}
+		if err == nil {
+			err = l.grep(w, r, obj, config, match)
+			r.Close()
+		}
+		var ferr *formatError
+		if errors.As(err, &ferr) {
+			l.log().WithField("key", obj.key).WithError(err).Warn("skipping unreadable object")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read object %q: %v", obj.key, err)
+		}
+	}
+	return nil
+}
+
+// grep writes the lines read from r, of obj, that fall inside config's
+// window and contain match to w.
+func (l *S3Logger) grep(w io.Writer, r io.Reader, obj logObject, config ReadConfig, match string) error {
+	br, peek, err := peekObject(r)
+	if err != nil {
+		return err
+	}
+	format, err := l.objectFormat(obj.key, peek)
+	if err != nil {
+		return err
+	}
+	var line []byte
+	for {
+		var err error
+		line, err = readLine(br, line[:0])
+		if len(line) > 0 {
+			msg := format.decode(line, obj.time)
+			inWindow := (config.Since.IsZero() || !msg.Timestamp.Before(config.Since)) && (config.Until.IsZero() || !msg.Timestamp.After(config.Until))
+			if inWindow && bytes.Contains(msg.Line, []byte(match)) {
+				if _, werr := w.Write(append(line, '\n')); werr != nil {
+					return werr
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// selectCompression returns the S3 Select compression type of obj, and
+// whether S3 Select can read it at all. Versions other than the latest
+// can't be selected from.
+func selectCompression(obj logObject) (types.CompressionType, bool) {
+	switch {
+	case obj.key == "" || obj.version != "":
+		return "", false
+	case strings.HasSuffix(obj.key, codecs[compressGzip].ext):
+		return types.CompressionTypeGzip, true
+	case strings.HasSuffix(obj.key, codecs[compressZstd].ext):
+		return "", false
+	}
+	return types.CompressionTypeNone, true
+}
+
+// selectObject returns the records of obj whose log contains match, one per
+// line, as selected by S3 Select.
+func (l *S3Logger) selectObject(ctx context.Context, obj logObject, compression types.CompressionType, match string) ([]byte, error) {
+	expr := "SELECT * FROM S3Object s"
+	if match != "" {
+		expr += " WHERE s.log LIKE '%" + likePattern(match) + "%' ESCAPE '\\'"
+	}
+	input := &s3.SelectObjectContentInput{
+		Bucket:         aws.String(l.bucket),
+		Key:            aws.String(obj.key),
+		Expression:     aws.String(expr),
+		ExpressionType: types.ExpressionTypeSql,
+		InputSerialization: &types.InputSerialization{
+			JSON:            &types.JSONInput{Type: types.JSONTypeLines},
+			CompressionType: compression,
+		},
+		OutputSerialization: &types.OutputSerialization{
+			JSON: &types.JSONOutput{RecordDelimiter: aws.String("\n")},
+		},
+	}
+	l.ssec.set(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	out, err := l.s3Client.SelectObjectContent(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select from object %q: %w", obj.key, err)
+	}
+	stream := out.GetStream()
+	defer stream.Close()
+	var data []byte
+	ended := false
+	for event := range stream.Events() {
+		switch e := event.(type) {
+		case *types.SelectObjectContentEventStreamMemberRecords:
+			data = append(data, e.Value.Payload...)
+		case *types.SelectObjectContentEventStreamMemberEnd:
+			ended = true
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, fmt.Errorf("failed to select from object %q: %w", obj.key, err)
+	}
+	if !ended {
+		return nil, fmt.Errorf("S3 Select ended before sending every record of object %q", obj.key)
+	}
+	return data, nil
+}
+
+// likePattern escapes s for use in a LIKE pattern quoted with single quotes
+// and escaped with a backslash.
+func likePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `'`, `''`).Replace(s)
+}
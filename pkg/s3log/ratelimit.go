@@ -0,0 +1,78 @@
+package s3log
+
+import (
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	maxPutsKey             = "max-puts-per-second"
+	maxPutsPerContainerKey = "max-puts-per-second-per-container"
+)
+
+// newPutLimiter returns a token bucket allowing perSecond PUTs a second in
+// bursts of up to a second's worth, or any number of them if perSecond is 0.
+func newPutLimiter(perSecond float64) *rate.Limiter {
+	lim := rate.NewLimiter(rate.Inf, 1)
+	setPutLimit(lim, perSecond)
+	return lim
+}
+
+// setPutLimit has lim allow perSecond PUTs a second from now on, as
+// newPutLimiter would.
+func setPutLimit(lim *rate.Limiter, perSecond float64) {
+	if perSecond <= 0 {
+		lim.SetLimit(rate.Inf)
+		return
+	}
+	lim.SetLimit(rate.Limit(perSecond))
+	lim.SetBurst(max(int(math.Ceil(perSecond)), 1))
+}
+
+// putLimiter returns the limiter shared by every container on the host, or
+// nil if there is no pool.
+func (p *uploadPool) putLimiter() *rate.Limiter {
+	if p == nil {
+		return nil
+	}
+	return p.puts
+}
+
+// throttle waits until the logger may make the PUTs of another flush, one to
+// each of its buckets, under max-puts-per-second-per-container, its tenant's
+// max-puts-per-second and the plugin's. Lines keep being buffered in the
+// meantime, so a throttled container uploads fewer, larger objects. It
+// returns false if the logger is closed while waiting; Close's own flush
+// isn't throttled.
+func (l *S3Logger) throttle() bool {
+	now := time.Now()
+	var reservations []*rate.Reservation
+	var delay time.Duration
+	for _, lim := range []*rate.Limiter{l.puts, l.pool.tenantPuts(l.opts.Tenant), l.pool.putLimiter()} {
+		if lim == nil {
+			continue
+		}
+		for range l.targets {
+			r := lim.ReserveN(now, 1)
+			reservations = append(reservations, r)
+			delay = max(delay, r.DelayFrom(now))
+		}
+	}
+	if delay <= 0 {
+		return true
+	}
+	l.metrics.throttled.Inc()
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-l.done:
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+		return false
+	}
+}
@@ -0,0 +1,455 @@
+package s3log
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+func init() {
+	reading := func(s permissionScope) bool { return s.read }
+	requirePermissions(
+		permission{"s3:ListBucket", onBucket, "docker logs", reading},
+		permission{"s3:GetObject", onObjects, "docker logs", reading},
+		permission{"kms:Decrypt", onKMSKey, "docker logs", func(s permissionScope) bool { return s.read && s.opts.SSEKMSKeyID != "" }},
+	)
+}
+
+// keyPrefixSentinel stands in for the timestamp when rendering the key
+// template to find the prefix shared by all of a container's objects.
+const keyPrefixSentinel = "\x00"
+
+// logObject is a batch of a container's logs. data holds the contents of
+// batches that haven't been uploaded yet; everything else is read from key.
+// seq is the sequence number of its first line, if the key template
+// includes it.
+type logObject struct {
+	key     string
+	version string // read instead of the latest, if set
+	time    time.Time
+	seq     int64
+	size    int64
+	offset  int64 // bytes of it skipped when reading, from its index
+	data    []byte
+}
+
+// emitFunc receives decoded messages and reports whether reading should
+// continue.
+type emitFunc func(*Message) bool
+
+// ReadLogs streams back the container's logs from S3, oldest object first.
+func (l *S3Logger) ReadLogs(config ReadConfig) *LogWatcher {
+	watcher := NewLogWatcher()
+	go l.readLogs(watcher, config)
+	return watcher
+}
+
+func (l *S3Logger) readLogs(watcher *LogWatcher, config ReadConfig) {
+	defer close(watcher.Msg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-watcher.WatchConsumerGone():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := l.read(ctx, watcher, config); err != nil && ctx.Err() == nil {
+		watcher.Err <- err
+	}
+}
+
+func (l *S3Logger) read(ctx context.Context, watcher *LogWatcher, config ReadConfig) error {
+	if l.opts.Format == formatParquet {
+		return errParquetUnreadable
+	}
+	if l.opts.UploadMode == uploadModePresigned {
+		return errPresignedUnreadable
+	}
+	if config.Follow {
+		// Subscribe before listing so that nothing uploaded in between is
+		// missed.
+		f, snapshot, cutoff := l.subscribe()
+		defer l.unsubscribe(f)
+		objects, err := l.listObjects(ctx, config)
+		if err != nil {
+			return err
+		}
+		return l.follow(ctx, watcher, config, objects, snapshot, f, cutoff)
+	}
+
+	objects, err := l.listObjects(ctx, config)
+	if err != nil {
+		return err
+	}
+	return l.replay(ctx, objects, config, watcherEmitter(watcher, config))
+}
+
+// watcherEmitter returns an emitFunc that sends messages inside the
+// since/until window to the watcher, stopping at the first message past
+// until or when the consumer goes away. Split lines are joined first.
+func watcherEmitter(watcher *LogWatcher, config ReadConfig) emitFunc {
+	return joinParts(func(msg *Message) bool {
+		if !config.Since.IsZero() && msg.Timestamp.Before(config.Since) {
+			return true
+		}
+		if !config.Until.IsZero() && msg.Timestamp.After(config.Until) {
+			return false
+		}
+		select {
+		case watcher.Msg <- msg:
+			return true
+		case <-watcher.WatchConsumerGone():
+			return false
+		}
+	})
+}
+
+// replay emits the messages held in objects, which must be sorted oldest
+// first. With a non-negative tail only the last config.Tail messages are
+// emitted, and objects are read newest first so that older history is never
+// downloaded once enough lines have been collected; of the oldest object
+// needed, only as much as holds the remaining lines is downloaded.
+func (l *S3Logger) replay(ctx context.Context, objects []logObject, config ReadConfig, emit emitFunc) error {
+	if config.Tail < 0 {
+		return l.readAll(ctx, objects, config.Since, emit)
+	}
+
+	var tail []*Message
+	for i := len(objects) - 1; i >= 0 && len(tail) < config.Tail; i-- {
+		msgs, err := l.readTail(ctx, objects[i], config.Tail-len(tail), func(read func(emitFunc) error) ([]*Message, error) {
+			var msgs []*Message
+			err := read(func(msg *Message) bool {
+				if !config.Since.IsZero() && msg.Timestamp.Before(config.Since) {
+					return true
+				}
+				if !config.Until.IsZero() && msg.Timestamp.After(config.Until) {
+					return false
+				}
+				msgs = append(msgs, msg)
+				return true
+			})
+			return msgs, err
+		})
+		if err != nil {
+			return err
+		}
+		tail = append(msgs, tail...)
+	}
+	if len(tail) > config.Tail {
+		tail = tail[len(tail)-config.Tail:]
+	}
+	for _, msg := range tail {
+		if !emit(msg) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// keyPrefix returns the part of the object key that is shared by every
+// batch this container uploads when objects aren't partitioned.
+func (l *S3Logger) keyPrefix() string {
+	return l.opts.S3Prefix + l.containerKeyPrefix()
+}
+
+// containerKeyPrefix returns the part of the rendered key template that is
+// shared by every batch this container uploads.
+func (l *S3Logger) containerKeyPrefix() string {
+	data := l.keyData
+	data.Timestamp = keyPrefixSentinel
+	data.Sequence = keyPrefixSentinel
+	data.FirstSeq = keyPrefixSentinel
+	data.TimeSlice = keyPrefixSentinel
+	data.Index = keyPrefixSentinel
+	var buf bytes.Buffer
+	if err := l.keyTmpl.Execute(&buf, data); err != nil {
+		return l.info.ContainerID + "/"
+	}
+	rendered := strings.TrimPrefix(buf.String(), "/")
+	if i := strings.Index(rendered, keyPrefixSentinel); i >= 0 {
+		rendered = rendered[:i]
+	}
+	return rendered
+}
+
+// listObjects lists the container's objects sorted by the batch timestamp
+// encoded in their key, falling back to the object's modification time for
+// keys the timestamp can't be parsed from. Objects with the same timestamp
+// are ordered by the sequence number of their first line when the key
+// template includes .FirstSeq, or by their index when it includes .Index.
+//
+// Batch timestamps sort lexically, as do the time slices of keys that start
+// with one rather than a timestamp, so the window in config is used to narrow
+// the LIST: listing starts at since. An object holds lines logged up to a
+// flush interval before its timestamp, so listing stops after the first
+// object past until rather than at it, and the prefix isn't narrowed to what
+// the since and until timestamps have in common, which would leave that
+// object out. Partitions outside the window aren't listed at all.
+//
+// With read-prior-runs the objects of every earlier run of the container's
+// stable key come first. Otherwise, unless following, the objects are taken
+// from the container's manifest instead when it keeps one.
+func (l *S3Logger) listObjects(ctx context.Context, config ReadConfig) ([]logObject, error) {
+	priorRuns := l.opts.ReadPriorRuns && l.run != ""
+	if !config.Follow && !priorRuns {
+		objects, ok, err := l.manifestObjects(ctx, config.Since, config.Until)
+		if err != nil {
+			l.log().WithError(err).Warn("error reading manifest, listing objects instead")
+		}
+		if ok {
+			return objects, nil
+		}
+	}
+	prefixes, err := l.listPrefixes(ctx, config.Since, config.Until)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions under %q: %v", l.opts.S3Prefix, err)
+	}
+	if priorRuns {
+		if prefixes, err = l.runPrefixes(ctx, prefixes); err != nil {
+			return nil, fmt.Errorf("failed to list runs of %q: %v", l.stableID, err)
+		}
+	}
+	seqPattern := l.keyPattern(func(d *keyData) { d.FirstSeq = keySequenceSentinel })
+	if seqPattern == nil {
+		// Objects of a time slice are in the order of their index.
+		seqPattern = l.keyPattern(func(d *keyData) { d.Index = keySequenceSentinel })
+	}
+	var objects []logObject
+	for _, prefix := range prefixes {
+		done, err := l.listPrefix(ctx, prefix, config, seqPattern, &objects)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		if !objects[i].time.Equal(objects[j].time) {
+			return objects[i].time.Before(objects[j].time)
+		}
+		return objects[i].seq < objects[j].seq
+	})
+	return objects, nil
+}
+
+// listPrefix appends the objects under prefix to objects, reporting whether
+// an object past config.Until was reached. seqPattern, if not nil, captures
+// the sequence number of an object's first line from its key.
+func (l *S3Logger) listPrefix(ctx context.Context, prefix string, config ReadConfig, seqPattern *regexp.Regexp, objects *[]logObject) (bool, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:       aws.String(l.bucket),
+		Prefix:       aws.String(prefix),
+		RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+	}
+	// Keys that start with their time slice are listed by it instead, which
+	// orders them as well.
+	format, loc := keyTimestampFormat, time.UTC
+	if l.sliceKeys {
+		format, loc = l.sliceLayout, l.partitionLoc
+	}
+	var since, until string
+	if !config.Since.IsZero() {
+		since = config.Since.In(loc).Format(format)
+		input.StartAfter = aws.String(prefix + since)
+	}
+	if !config.Until.IsZero() {
+		until = config.Until.In(loc).Format(format)
+	}
+
+	base, deadLetters := l.prefixBase(prefix), l.deadLetterPrefix()
+	pages := s3.NewListObjectsV2Paginator(l.s3Client, input)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return false, fmt.Errorf("failed to list objects under %q: %v", prefix, err)
+		}
+		for _, o := range page.Contents {
+			key := aws.ToString(o.Key)
+			if isSidecar(key) || strings.HasPrefix(key, deadLetters) {
+				continue
+			}
+			t := aws.ToTime(o.LastModified)
+			rest := strings.TrimPrefix(key, prefix)
+			if len(rest) >= len(format) {
+				if parsed, err := time.ParseInLocation(format, rest[:len(format)], loc); err == nil {
+					t = parsed
+				}
+			}
+			obj := logObject{key: key, time: t, size: aws.ToInt64(o.Size)}
+			if seqPattern != nil {
+				if m := seqPattern.FindStringSubmatch(strings.TrimPrefix(key, base)); m != nil {
+					obj.seq, _ = strconv.ParseInt(m[1], 10, 64)
+				}
+			}
+			*objects = append(*objects, obj)
+			if until != "" && t.After(config.Until) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// isSidecar reports whether key names one of the objects kept next to a
+// container's logs rather than logs: its manifest, run summary, heartbeat
+// or the index of an object. Its dead-letter objects are told apart by
+// their prefix.
+func isSidecar(key string) bool {
+	switch path.Base(key) {
+	case manifestName, summaryName, heartbeatName:
+		return true
+	}
+	return strings.HasSuffix(key, indexSuffix)
+}
+
+// readObject downloads a single object, or uses its in-memory data, and
+// emits every line in it. An object deleted since it was listed is skipped,
+// and one that can't be read as logs is replaced by a line saying so.
+func (l *S3Logger) readObject(ctx context.Context, obj logObject, emit emitFunc) error {
+	if obj.key == "" {
+		return l.decode(bytes.NewReader(obj.data), "", obj.time, emit)
+	}
+
+	r, err := l.openObject(ctx, obj)
+	if isDeleted(err) {
+		l.log().WithField("key", obj.key).Debug("object was deleted, skipping it")
+		return nil
+	}
+	if err == nil {
+		err = l.decode(r, obj.key, obj.time, emit)
+		r.Close()
+	}
+	var ferr *formatError
+	if errors.As(err, &ferr) {
+		l.log().WithField("key", obj.key).WithError(err).Warn("skipping unreadable object")
+		emit(unreadableMessage(obj, ferr))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read object %q: %v", obj.key, err)
+	}
+	return nil
+}
+
+// openObject downloads obj from the primary bucket, decompressing it if it
+// was compressed on upload. The codec is taken from the key's extension,
+// the Content-Encoding or, failing both, the object's first bytes, so that
+// objects uploaded by other tools are read as well.
+func (l *S3Logger) openObject(ctx context.Context, obj logObject) (io.ReadCloser, error) {
+	key := obj.key
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(l.bucket),
+		Key:          aws.String(key),
+		RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+	}
+	if obj.version != "" {
+		input.VersionId = aws.String(obj.version)
+	}
+	if obj.offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", obj.offset))
+	}
+	out, err := l.getObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object %q from S3: %w", key, err)
+	}
+
+	br, peek, err := peekObject(out.Body)
+	if err != nil {
+		out.Body.Close()
+		return nil, fmt.Errorf("failed to read object %q: %v", key, err)
+	}
+	body := objectReader{br, func() { out.Body.Close() }}
+	r, err := decompress(objectCodec(key, aws.ToString(out.ContentEncoding), peek), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress object %q: %w", key, err)
+	}
+	return r, nil
+}
+
+// isDeleted reports whether err is from getting an object that has been
+// deleted: one whose latest version is a delete marker, or a version that no
+// longer exists.
+func isDeleted(err error) bool {
+	var noKey *types.NoSuchKey
+	if errors.As(err, &noKey) {
+		return true
+	}
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NoSuchVersion" || apiErr.ErrorCode() == "MethodNotAllowed")
+}
+
+// objectReader reads a decompressed object, closing the decompressor and the
+// body along with it.
+type objectReader struct {
+	io.Reader
+	close func()
+}
+
+func (r objectReader) Close() error {
+	r.close()
+	return nil
+}
+
+// decode emits every line read from r, of the object at key, however long,
+// in the format the object turns out to be in. A last line without a
+// trailing newline is emitted too.
+func (l *S3Logger) decode(r io.Reader, key string, t time.Time, emit emitFunc) error {
+	br, peek, err := peekObject(r)
+	if err != nil {
+		return err
+	}
+	format, err := l.objectFormat(key, peek)
+	if err != nil {
+		return err
+	}
+	var line []byte
+	for {
+		var err error
+		line, err = readLine(br, line[:0])
+		if len(line) > 0 || err == nil {
+			if !emit(format.decode(line, t)) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readLine appends the next line read from r to dst, without its newline.
+func readLine(r *bufio.Reader, dst []byte) ([]byte, error) {
+	for {
+		chunk, err := r.ReadSlice('\n')
+		dst = append(dst, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if n := len(dst); n > 0 && dst[n-1] == '\n' {
+			dst = dst[:n-1]
+		}
+		return dst, err
+	}
+}
@@ -0,0 +1,383 @@
+package s3log
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsSidecar(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"c/20240101T000000.000000000Z-000001.log", false},
+		{"c/20240101T000000.000000000Z-000001.log.gz", false},
+		{"c/" + manifestName, true},
+		{"c/" + summaryName, true},
+		{"c/" + heartbeatName, true},
+		{"c/20240101T000000.000000000Z-000001.log" + indexSuffix, true},
+	}
+	for _, tt := range tests {
+		if got := isSidecar(tt.key); got != tt.want {
+			t.Errorf("isSidecar(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(i int) time.Time { return base.Add(time.Duration(i) * time.Minute) }
+	tests := []struct {
+		name   string
+		config ReadConfig
+		want   []int
+	}{
+		{name: "all", want: []int{0, 1, 2, 3, 4}},
+		{name: "since", config: ReadConfig{Since: at(2)}, want: []int{2, 3, 4}},
+		// An object holds lines logged before its timestamp, so the first
+		// one past until is listed too.
+		{name: "until", config: ReadConfig{Until: at(1).Add(time.Second)}, want: []int{0, 1, 2}},
+		{name: "window", config: ReadConfig{Since: at(1), Until: at(2).Add(time.Second)}, want: []int{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			// Small pages make the listing take several.
+			fake.pageSize = 2
+			l := newTestLogger(t, fake, nil)
+			prefix := l.keyPrefix()
+			var keys []string
+			// Uploaded out of order, to be sorted by their timestamps.
+			for _, i := range []int{3, 0, 4, 1, 2} {
+				key := fmt.Sprintf("%s%s-%06d.log", prefix, at(i).Format(keyTimestampFormat), i+1)
+				fake.put(testBucket, key, []byte("line\n"), time.Now())
+				fake.put(testBucket, key+indexSuffix, []byte("{}"), time.Now())
+				keys = append(keys, key)
+			}
+			for _, name := range []string{summaryName, heartbeatName, deadLetterDir + "x.jsonl"} {
+				fake.put(testBucket, prefix+name, []byte("{}"), time.Now())
+			}
+			fake.put(testBucket, "other/"+at(0).Format(keyTimestampFormat)+".log", []byte("line\n"), time.Now())
+
+			objects, err := l.listObjects(context.Background(), tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, o := range objects {
+				got = append(got, o.key)
+			}
+			var want []string
+			for _, i := range tt.want {
+				want = append(want, fmt.Sprintf("%s%s-%06d.log", prefix, at(i).Format(keyTimestampFormat), i+1))
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("listed %q, want %q", got, want)
+			}
+			if fake.count("ListObjectsV2") < 2 {
+				t.Errorf("listed in %d pages, want several", fake.count("ListObjectsV2"))
+			}
+		})
+	}
+}
+
+func TestListSkipsDeadLetters(t *testing.T) {
+	// Only the container's own dead-letter objects are skipped, not logs
+	// whose keys hold the directory's name elsewhere.
+	for _, prefix := range []string{"", "logs/", deadLetterDir, "logs/" + deadLetterDir} {
+		t.Run(prefix, func(t *testing.T) {
+			fake := newFakeS3()
+			l := newTestLogger(t, fake, map[string]string{s3PrefixKey: prefix})
+			now := time.Now().UTC()
+			key := fmt.Sprintf("%s%s-%06d.log", l.keyPrefix(), now.Format(keyTimestampFormat), 1)
+			fake.put(testBucket, key, []byte("line\n"), now)
+			fake.put(testBucket, l.deadLetterPath(now, 1), []byte("{}"), now)
+
+			objects, err := l.listObjects(context.Background(), ReadConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(objects) != 1 || objects[0].key != key {
+				t.Errorf("listed %v, want only %s", objects, key)
+			}
+		})
+	}
+}
+
+func TestReadLogsMerge(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	type object struct {
+		codec, name string
+		at          time.Time
+		lines       []string
+	}
+	tests := []struct {
+		name    string
+		objects []object
+		want    []string
+	}{
+		{
+			name: "listed out of order",
+			objects: []object{
+				{at: base.Add(2 * time.Minute), lines: []string{"5", "6"}},
+				{at: base, lines: []string{"1", "2"}},
+				{at: base.Add(time.Minute), lines: []string{"3", "4"}},
+			},
+			want: []string{"1", "2", "3", "4", "5", "6"},
+		},
+		{
+			name: "gzip and plain",
+			objects: []object{
+				{codec: compressGzip, at: base, lines: []string{"1"}},
+				{at: base.Add(time.Minute), lines: []string{"2"}},
+				{codec: compressZstd, at: base.Add(2 * time.Minute), lines: []string{"3"}},
+			},
+			want: []string{"1", "2", "3"},
+		},
+		{
+			// Objects whose keys have no timestamp are ordered by when
+			// they were written.
+			name: "keys without timestamps",
+			objects: []object{
+				{name: "c.log", at: base, lines: []string{"1"}},
+				{name: "a.log", at: base.Add(2 * time.Minute), lines: []string{"3"}},
+				{name: "b.log", at: base.Add(time.Minute), lines: []string{"2"}},
+			},
+			want: []string{"1", "2", "3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			l := newTestLogger(t, fake, nil)
+			for _, o := range tt.objects {
+				putObject(t, fake, l, o.codec, o.name, o.at, o.lines...)
+			}
+			if got := readLogs(t, l, ReadConfig{Tail: -1}); !slices.Equal(got, tt.want) {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadLogsWindow(t *testing.T) {
+	// Three objects flushed a minute apart, of three lines a second apart:
+	// 1-3 until base, 4-6 until base+1m and 7-9 until base+2m.
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		config     ReadConfig
+		want       []string
+		downloaded int
+	}{
+		{
+			name:       "everything",
+			config:     ReadConfig{Tail: -1},
+			want:       []string{"1", "2", "3", "4", "5", "6", "7", "8", "9"},
+			downloaded: 3,
+		},
+		{
+			name:       "tail larger than total",
+			config:     ReadConfig{Tail: 100},
+			want:       []string{"1", "2", "3", "4", "5", "6", "7", "8", "9"},
+			downloaded: 3,
+		},
+		{
+			name:       "tail inside newest object",
+			config:     ReadConfig{Tail: 2},
+			want:       []string{"8", "9"},
+			downloaded: 1,
+		},
+		{
+			name:       "tail across objects",
+			config:     ReadConfig{Tail: 4},
+			want:       []string{"6", "7", "8", "9"},
+			downloaded: 2,
+		},
+		{
+			name:       "since and until inside one object",
+			config:     ReadConfig{Tail: -1, Since: base.Add(59 * time.Second), Until: base.Add(59 * time.Second)},
+			want:       []string{"5"},
+			downloaded: 1,
+		},
+		{
+			name:       "tail of a window",
+			config:     ReadConfig{Tail: 1, Since: base.Add(58 * time.Second), Until: base.Add(59 * time.Second)},
+			want:       []string{"5"},
+			downloaded: 1,
+		},
+		{
+			name:       "since",
+			config:     ReadConfig{Tail: -1, Since: base.Add(90 * time.Second)},
+			want:       []string{"7", "8", "9"},
+			downloaded: 1,
+		},
+		{
+			name:       "until",
+			config:     ReadConfig{Tail: -1, Until: base.Add(-time.Second)},
+			want:       []string{"1", "2"},
+			downloaded: 1,
+		},
+		{
+			name:   "window before everything",
+			config: ReadConfig{Tail: -1, Since: base.Add(-time.Hour), Until: base.Add(-30 * time.Minute)},
+			want:   nil,
+			// The first object past until is listed, and may hold lines
+			// logged before it.
+			downloaded: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			l := newTestLogger(t, fake, nil)
+			putObject(t, fake, l, "", "", base, "1", "2", "3")
+			putObject(t, fake, l, "", "", base.Add(time.Minute), "4", "5", "6")
+			putObject(t, fake, l, "", "", base.Add(2*time.Minute), "7", "8", "9")
+			var mu sync.Mutex
+			var got []string
+			fake.before = func(_ context.Context, op, _, key string) error {
+				if op == "GetObject" {
+					mu.Lock()
+					defer mu.Unlock()
+					got = append(got, key)
+				}
+				return nil
+			}
+
+			if lines := readLogs(t, l, tt.config); !slices.Equal(lines, tt.want) {
+				t.Errorf("read %q, want %q", lines, tt.want)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(got) != tt.downloaded {
+				t.Errorf("downloaded %q, want %d objects", got, tt.downloaded)
+			}
+		})
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", 1<<20)
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"lines", "one\ntwo\n", []string{"one", "two"}},
+		{"1MB line", long + "\nnext\n", []string{long, "next"}},
+		{"no newline at EOF", "one\nlast", []string{"one", "last"}},
+		{"1MB line without a newline", long, []string{long}},
+		{"empty lines", "\n\none\n", []string{"", "", "one"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			var got []string
+			for {
+				line, err := readLine(r, nil)
+				if len(line) > 0 || err == nil {
+					got = append(got, string(line))
+				}
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("read %d lines, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestReadLogsLongLine(t *testing.T) {
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, map[string]string{maxBufferSizeKey: "4194304", flushBytesKey: "4194304"})
+	long := strings.Repeat("y", 1<<20)
+	logLines(t, l, time.Now(), "short", long, "after")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := readLogs(t, l, ReadConfig{Tail: -1})
+	if !slices.Equal(got, []string{"short", long, "after"}) {
+		t.Errorf("read back %d lines, want the 1MB line between two others", len(got))
+	}
+}
+
+func TestReadMixedHistory(t *testing.T) {
+	// One container's history, a minute an object, written in every format
+	// it has been logged in and by other tools.
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, map[string]string{compressKey: compressGzip})
+	var minutes int
+	put := func(ext string, data []byte) string {
+		at := base.Add(time.Duration(minutes) * time.Minute)
+		minutes++
+		key := l.keyPrefix() + at.Format(keyTimestampFormat) + ext
+		fake.put(testBucket, key, data, at)
+		return key
+	}
+	compress := func(codec string, data []byte) []byte {
+		data, err := compressBytes(codec, 0, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	stamped := fmt.Sprintf("%s raw 1\n%s raw 2\n", base.Format(time.RFC3339Nano), base.Add(time.Second).Format(time.RFC3339Nano))
+
+	put(".log", []byte(stamped))
+	put(".log.gz", encodeObject(t, l, compressGzip, base.Add(time.Minute), "jsonl gz"))
+	put(".jsonl", encodeObject(t, l, compressNone, base.Add(2*time.Minute), "jsonl plain"))
+	put(".log", compress(compressZstd, []byte("zstd raw\n")))
+	binary := put(".log", []byte{0x00, 0x01, 0xfe, 0xff, 0x00, 0x02})
+	corrupt := put(".log.gz", []byte("gzip that isn't"))
+	parquet := put(parquetExt, append(append([]byte(nil), parquetMagic...), 0, 0, 0, 0))
+	put(".txt", []byte("text 1\ntext 2\n"))
+
+	watcher := l.ReadLogs(ReadConfig{Tail: -1})
+	defer watcher.ConsumerGone()
+	var got []string
+	var stderr []string
+	for msg := range watcher.Msg {
+		line := strings.TrimSuffix(string(msg.Line), "\n")
+		if msg.Source == "stderr" {
+			stderr = append(stderr, line)
+			continue
+		}
+		// Raw lines have their leading timestamp taken off.
+		if line == "raw 2" && !msg.Timestamp.Equal(base.Add(time.Second)) {
+			t.Errorf("raw line stamped %v, want %v", msg.Timestamp, base.Add(time.Second))
+		}
+		got = append(got, line)
+	}
+	select {
+	case err := <-watcher.Err:
+		t.Fatalf("an unreadable object aborted the read: %v", err)
+	default:
+	}
+	want := []string{"raw 1", "raw 2", "jsonl gz", "jsonl plain", "zstd raw", "text 1", "text 2"}
+	if !slices.Equal(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+	skipped := []string{binary, corrupt, parquet}
+	if len(stderr) != len(skipped) {
+		t.Fatalf("stderr %q, want a line for each of %q", stderr, skipped)
+	}
+	for i, key := range skipped {
+		if prefix := "[" + driverName + ": skipped unreadable object " + key + ": "; !strings.HasPrefix(stderr[i], prefix) {
+			t.Errorf("stderr line %q, want one starting %q", stderr[i], prefix)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package s3log
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	readConcurrencyKey = "read-concurrency"
+	readBufferBytesKey = "read-buffer-bytes"
+
+	defaultReadConcurrency = 4
+	defaultReadBufferBytes = 16 << 20
+)
+
+// readAhead downloads the objects a read needs, read-concurrency at once,
+// while their messages are emitted strictly in order. Objects past the one
+// being emitted are decoded ahead of it until read-buffer-bytes of their
+// lines are held, so that memory stays bounded however far ahead the
+// downloads get, and are cancelled once the read stops.
+type readAhead struct {
+	mu      sync.Mutex
+	ready   *sync.Cond // signalled whenever a fetch or the cursor moves
+	fetches []prefetch
+	cursor  int   // index of the object being emitted
+	held    int64 // bytes of lines buffered across fetches
+	limit   int64
+	ctx     context.Context
+}
+
+// prefetch is the decoded messages of one object, waiting to be emitted.
+type prefetch struct {
+	msgs []*Message
+	done bool
+	err  error
+}
+
+// readAll emits the messages of objects, which must be sorted oldest first,
+// in order, from since on. It returns once emit returns false, an object
+// can't be read, or every object has been emitted.
+func (l *S3Logger) readAll(ctx context.Context, objects []logObject, since time.Time, emit emitFunc) error {
+	// Workers are waited for once cancelled, which wakes those waiting for
+	// room in the buffer.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ra := &readAhead{fetches: make([]prefetch, len(objects)), limit: int64(l.opts.ReadBufferBytes), ctx: ctx}
+	ra.ready = sync.NewCond(&ra.mu)
+	context.AfterFunc(ctx, func() {
+		ra.mu.Lock()
+		ra.ready.Broadcast()
+		ra.mu.Unlock()
+	})
+
+	next := make(chan int, len(objects))
+	for i := range objects {
+		next <- i
+	}
+	close(next)
+	for range min(l.opts.ReadConcurrency, len(objects)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if ctx.Err() != nil {
+					return
+				}
+				obj, ok := l.seek(ctx, objects[i], since)
+				var err error
+				if ok {
+					err = l.readObject(ctx, obj, func(msg *Message) bool { return ra.push(i, msg) })
+				}
+				ra.finish(i, err)
+			}
+		}()
+	}
+
+	for i := range objects {
+		for {
+			msgs, done, err := ra.take(i)
+			if ctx.Err() != nil {
+				return nil
+			}
+			for _, msg := range msgs {
+				if !emit(msg) {
+					return nil
+				}
+			}
+			ra.release(msgs)
+			if err != nil {
+				return err
+			}
+			if done {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// push buffers msg as the next message of the i'th object, waiting while
+// the buffer is full. The object being emitted may always have one message
+// waiting, so that it goes on however far ahead the others have filled
+// the buffer. It reports whether the read goes on.
+func (ra *readAhead) push(i int, msg *Message) bool {
+	n := int64(len(msg.Line))
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	for ra.ctx.Err() == nil && ra.held > 0 && ra.held+n > ra.limit && (i != ra.cursor || len(ra.fetches[i].msgs) > 0) {
+		ra.ready.Wait()
+	}
+	if ra.ctx.Err() != nil {
+		return false
+	}
+	ra.fetches[i].msgs = append(ra.fetches[i].msgs, msg)
+	ra.held += n
+	ra.ready.Broadcast()
+	return true
+}
+
+// finish marks the i'th object as read, with the error reading it if any.
+func (ra *readAhead) finish(i int, err error) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.fetches[i].done, ra.fetches[i].err = true, err
+	ra.ready.Broadcast()
+}
+
+// take waits for messages of the i'th object, moving the cursor to it, and
+// returns those buffered so far, which keep their room in the buffer until
+// released. Once the object has been read it reports so, with the error
+// reading it if any.
+func (ra *readAhead) take(i int) ([]*Message, bool, error) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.cursor != i {
+		ra.cursor = i
+		ra.ready.Broadcast()
+	}
+	f := &ra.fetches[i]
+	for ra.ctx.Err() == nil && len(f.msgs) == 0 && !f.done {
+		ra.ready.Wait()
+	}
+	msgs := f.msgs
+	f.msgs = nil
+	return msgs, f.done, f.err
+}
+
+// release frees the room in the buffer of msgs, which have been emitted.
+func (ra *readAhead) release(msgs []*Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	for _, msg := range msgs {
+		ra.held -= int64(len(msg.Line))
+	}
+	ra.ready.Broadcast()
+}
@@ -0,0 +1,212 @@
+package s3log
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// putObjects stores n objects of lines lines each for l, a minute apart, and
+// returns every line in the order they were logged.
+func putObjects(t *testing.T, fake *fakeS3, l *S3Logger, n, lines int) []string {
+	t.Helper()
+	start := time.Now().Add(-time.Duration(n) * time.Minute).Truncate(time.Second)
+	var all []string
+	for i := range n {
+		var obj []string
+		for j := range lines {
+			obj = append(obj, fmt.Sprintf("object %d line %d", i, j))
+		}
+		putObject(t, fake, l, compressGzip, "", start.Add(time.Duration(i)*time.Minute), obj...)
+		all = append(all, obj...)
+	}
+	return all
+}
+
+func TestReadAheadOrder(t *testing.T) {
+	// Downloads finish out of order, each delayed by its key, yet the lines
+	// are read in order, downloading read-concurrency objects at once.
+	for _, concurrency := range []int{1, 4, 16} {
+		t.Run(strconv.Itoa(concurrency), func(t *testing.T) {
+			fake := newFakeS3()
+			var mu sync.Mutex
+			var inflight, peak int
+			fake.before = func(_ context.Context, op, _, key string) error {
+				if op != "GetObject" {
+					return nil
+				}
+				mu.Lock()
+				inflight++
+				peak = max(peak, inflight)
+				mu.Unlock()
+				h := fnv.New32()
+				h.Write([]byte(key))
+				time.Sleep(time.Duration(h.Sum32()%10) * time.Millisecond)
+				mu.Lock()
+				inflight--
+				mu.Unlock()
+				return nil
+			}
+			l := newTestLogger(t, fake, map[string]string{readConcurrencyKey: strconv.Itoa(concurrency)})
+			want := putObjects(t, fake, l, 24, 10)
+			if got := readLogs(t, l, ReadConfig{Tail: -1}); !slices.Equal(got, want) {
+				t.Errorf("read %d lines out of order, want %d in order", len(got), len(want))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if peak > concurrency || concurrency > 1 && peak < 2 {
+				t.Errorf("up to %d downloads at once, want up to %d", peak, concurrency)
+			}
+		})
+	}
+}
+
+// testReadAhead returns a readAhead of n objects holding up to limit bytes,
+// woken as readAll wakes it once ctx is done.
+func testReadAhead(ctx context.Context, n int, limit int64) *readAhead {
+	ra := &readAhead{fetches: make([]prefetch, n), limit: limit, ctx: ctx}
+	ra.ready = sync.NewCond(&ra.mu)
+	context.AfterFunc(ctx, func() {
+		ra.mu.Lock()
+		ra.ready.Broadcast()
+		ra.mu.Unlock()
+	})
+	return ra
+}
+
+// pushAsync pushes msg for the i'th object from a goroutine, returning a
+// channel that gets whether the read goes on once the push returns.
+func pushAsync(ra *readAhead, i int, msg *Message) <-chan bool {
+	pushed := make(chan bool, 1)
+	go func() { pushed <- ra.push(i, msg) }()
+	return pushed
+}
+
+// blocked reports whether nothing has come of pushed for a while.
+func blocked(pushed <-chan bool) bool {
+	select {
+	case <-pushed:
+		return false
+	case <-time.After(20 * time.Millisecond):
+		return true
+	}
+}
+
+func TestReadAheadBuffer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ra := testReadAhead(ctx, 3, 100)
+	msg := func() *Message { return &Message{Line: make([]byte, 40)} }
+
+	// Object 1 is ahead of the cursor, and fills the buffer.
+	for range 2 {
+		if !ra.push(1, msg()) {
+			t.Fatal("push under the limit refused")
+		}
+	}
+	third := pushAsync(ra, 1, msg())
+	if !blocked(third) {
+		t.Fatal("push over read-buffer-bytes didn't wait")
+	}
+	// The object being emitted always gets one message in, so the read
+	// goes on.
+	if !ra.push(0, msg()) {
+		t.Fatal("push of the object being emitted refused")
+	}
+	if pushed := pushAsync(ra, 0, msg()); !blocked(pushed) {
+		t.Fatal("second push of the object being emitted didn't wait")
+	} else {
+		msgs, _, _ := ra.take(0)
+		ra.release(msgs)
+		if !<-pushed {
+			t.Fatal("push refused once there was room")
+		}
+	}
+	msgs, _, _ := ra.take(0)
+	ra.release(msgs)
+	ra.finish(0, nil)
+	if !blocked(third) {
+		t.Fatal("push went ahead while the buffer was still full")
+	}
+
+	// Emitting object 1 makes room for the rest of it.
+	msgs, done, _ := ra.take(1)
+	if len(msgs) != 2 || done {
+		t.Fatalf("took %d messages of object 1, done %v, want the 2 buffered", len(msgs), done)
+	}
+	ra.release(msgs)
+	if !<-third {
+		t.Fatal("push refused once there was room")
+	}
+
+	// A push waiting for room gives up once the read is cancelled.
+	if !ra.push(2, msg()) {
+		t.Fatal("push under the limit refused")
+	}
+	waiting := pushAsync(ra, 2, msg())
+	if !blocked(waiting) {
+		t.Fatal("push over read-buffer-bytes didn't wait")
+	}
+	cancel()
+	if <-waiting {
+		t.Error("push went on after the read was cancelled")
+	}
+}
+
+func TestReadAheadCancel(t *testing.T) {
+	// Every download after the first stalls until it is cancelled, which
+	// it must be once the reader goes away. The worker done with the first
+	// goes on to the next object, so every worker ends up stalled.
+	const concurrency = 4
+	fake := newFakeS3()
+	var mu sync.Mutex
+	var gets, cancelled int
+	fake.before = func(ctx context.Context, op, _, _ string) error {
+		if op != "GetObject" {
+			return nil
+		}
+		mu.Lock()
+		gets++
+		first := gets == 1
+		mu.Unlock()
+		if first {
+			return nil
+		}
+		<-ctx.Done()
+		mu.Lock()
+		cancelled++
+		mu.Unlock()
+		return ctx.Err()
+	}
+	l := newTestLogger(t, fake, map[string]string{readConcurrencyKey: strconv.Itoa(concurrency)})
+	putObjects(t, fake, l, 20, 10)
+
+	watcher := l.ReadLogs(ReadConfig{Tail: -1})
+	select {
+	case <-watcher.Msg:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message read")
+	}
+	waitFor(t, "every worker to start a download", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return gets == concurrency+1
+	})
+	watcher.ConsumerGone()
+	waitFor(t, "the stalled downloads to be cancelled", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return cancelled == concurrency
+	})
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if gets != concurrency+1 {
+		t.Errorf("%d downloads started, want none after the reader went away", gets)
+	}
+}
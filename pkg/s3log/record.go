@@ -0,0 +1,315 @@
+package s3log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	labelsKey      = "labels"
+	labelsRegexKey = "labels-regex"
+	envKey         = "env"
+	envRegexKey    = "env-regex"
+	formatKey      = "format"
+	timestampKey   = "timestamp-format"
+
+	formatJSONL = "jsonl"
+	formatRaw   = "raw"
+
+	timestampRFC3339Nano = "rfc3339nano"
+	timestampUnixMs      = "unix-ms"
+	timestampNone        = "none"
+)
+
+// record is a line in the jsonl format. Time is either an RFC 3339 string or
+// milliseconds since the epoch, depending on the timestamp-format.
+// OriginalTime is set on lines restamped for max-future-skew. RecordID, Part
+// and Total are set on the parts of a line split for max-record-bytes, and
+// Truncated on one truncated for it. Timeout is set on a partial line
+// written out at max-partial-age. The fields without omitempty are on every
+// record, as the schema command describes them.
+type record struct {
+	Log          string            `json:"log"`
+	Stream       string            `json:"stream"`
+	Seq          int64             `json:"seq"`
+	Time         json.RawMessage   `json:"time"`
+	OriginalTime string            `json:"original_time,omitempty"`
+	RecordID     string            `json:"record_id,omitempty"`
+	Part         int               `json:"part,omitempty"`
+	Total        int               `json:"total,omitempty"`
+	Truncated    bool              `json:"truncated,omitempty"`
+	Timeout      string            `json:"partial_timeout,omitempty"`
+	ContainerID  string            `json:"container_id"`
+	Tag          string            `json:"tag"`
+	Attrs        map[string]string `json:"attrs,omitempty"`
+}
+
+// parseAttrs extracts the container labels and environment variables selected
+// by the labels, labels-regex, env and env-regex log-opts, with the same
+// semantics as docker's json-file driver. It runs once per container so the
+// regexes are compiled, and rejected if invalid, before any line is logged.
+func parseAttrs(info Info) (map[string]string, error) {
+	attrs, err := info.ExtraAttributes(nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s or %s: %v", labelsRegexKey, envRegexKey, err)
+	}
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+	return attrs, nil
+}
+
+// recordSuffix encodes the fields that are the same for every record a
+// container logs, closing the record. It is computed once so that encoding a
+// line only has to escape the line itself.
+func recordSuffix(containerID, tag string, attrs map[string]string) ([]byte, error) {
+	suffix := []byte(`,"container_id":`)
+	suffix = appendJSONString(suffix, containerID)
+	suffix = append(suffix, `,"tag":`...)
+	suffix = appendJSONString(suffix, tag)
+	if len(attrs) > 0 {
+		b, err := json.Marshal(attrs)
+		if err != nil {
+			return nil, err
+		}
+		suffix = append(suffix, `,"attrs":`...)
+		suffix = append(suffix, b...)
+	}
+	return append(suffix, "}\n"...), nil
+}
+
+// lineFormat encodes lines for upload in one of the formats the format
+// log-opt selects, and decodes them again for docker logs. Encoding appends
+// to a buffer rather than writing to one, so that a line is encoded without
+// allocating, and can't fail: invalid UTF-8 is escaped rather than rejected.
+type lineFormat interface {
+	// encode appends msg, the seq'th line the container logged, to dst as
+	// a single line ending in a newline.
+	encode(dst []byte, msg *Message, seq int64) []byte
+	// decode parses a line, without its newline, back into a message.
+	// Lines that carry no timestamp of their own are stamped with t.
+	decode(line []byte, t time.Time) *Message
+	// marker appends event, a JSON object the logger inserts among the
+	// lines as the seq'th, stamped with t.
+	marker(dst, event []byte, seq int64, t time.Time) []byte
+}
+
+// newLineFormat returns the format opts select for a container logging
+// with tag and attrs.
+func newLineFormat(opts LogOption, containerID, tag string, attrs map[string]string) (lineFormat, error) {
+	if opts.Format == formatRaw {
+		return rawFormat{timestamp: opts.TimestampFormat}, nil
+	}
+	suffix, err := recordSuffix(containerID, tag, attrs)
+	if err != nil {
+		return nil, err
+	}
+	return jsonlFormat{timestamp: opts.TimestampFormat, suffix: suffix, merge: opts.MergeJSONLog}, nil
+}
+
+// jsonlFormat encodes each line as a record, along with the attributes the
+// logger gave it, such as original_time. With merge-json-log a line that is
+// a JSON object has its keys merged into the record in place of the log
+// field.
+type jsonlFormat struct {
+	timestamp string
+	suffix    []byte // from recordSuffix
+	merge     bool
+}
+
+func (f jsonlFormat) encode(dst []byte, msg *Message, seq int64) []byte {
+	if f.merge {
+		if obj := jsonObject(msg.Line); obj != nil {
+			start := len(dst)
+			dst = append(dst, `{"stream":`...)
+			dst = f.appendFields(dst, msg, seq)
+			if merged, ok := appendMerged(dst, obj, msg.Attrs); ok {
+				return append(merged, f.suffix...)
+			}
+			dst = dst[:start]
+		}
+	}
+	dst = append(dst, `{"log":`...)
+	dst = appendJSONString(dst, msg.Line)
+	dst = append(dst, `,"stream":`...)
+	return append(f.appendFields(dst, msg, seq), f.suffix...)
+}
+
+// appendFields appends the fields of msg's record from its stream's value
+// to its attributes.
+func (f jsonlFormat) appendFields(dst []byte, msg *Message, seq int64) []byte {
+	dst = appendJSONString(dst, msg.Source)
+	dst = append(dst, `,"seq":`...)
+	dst = strconv.AppendInt(dst, seq, 10)
+	switch f.timestamp {
+	case timestampRFC3339Nano:
+		dst = append(dst, `,"time":"`...)
+		dst = appendTimestamp(dst, msg.Timestamp, timestampRFC3339Nano)
+		dst = append(dst, '"')
+	case timestampUnixMs:
+		dst = append(dst, `,"time":`...)
+		dst = appendTimestamp(dst, msg.Timestamp, timestampUnixMs)
+	}
+	for _, a := range msg.Attrs {
+		dst = append(dst, ',')
+		dst = appendJSONString(dst, a.Key)
+		dst = append(dst, ':')
+		dst = appendJSONString(dst, a.Value)
+	}
+	return dst
+}
+
+// decode parses a record. Lines that aren't records, such as those uploaded
+// while the container was logging raw, are reported as stdout.
+func (f jsonlFormat) decode(line []byte, t time.Time) *Message {
+	if msg, ok := decodeRecord(line, t); ok {
+		return msg
+	}
+	return plainMessage(line, t)
+}
+
+// rawFormat encodes each line as it was logged, after the timestamp unless
+// that is none.
+type rawFormat struct {
+	timestamp string
+}
+
+func (f rawFormat) encode(dst []byte, msg *Message, _ int64) []byte {
+	if f.timestamp != timestampNone {
+		dst = appendTimestamp(dst, msg.Timestamp, f.timestamp)
+		dst = append(dst, ' ')
+	}
+	dst = append(dst, msg.Line...)
+	return append(dst, '\n')
+}
+
+// decode parses a raw line, taking the timestamp off the front if there is
+// one. Records, uploaded while the container was logging jsonl, are still
+// decoded as such. Every raw line is reported as stdout.
+func (f rawFormat) decode(line []byte, t time.Time) *Message {
+	if msg, ok := decodeRecord(line, t); ok {
+		return msg
+	}
+	if f.timestamp != timestampNone {
+		if prefix, rest, ok := bytes.Cut(line, []byte{' '}); ok {
+			if ts, ok := parseTimestamp(string(prefix)); ok {
+				t, line = ts, rest
+			}
+		}
+	}
+	return plainMessage(line, t)
+}
+
+// encode appends msg, the seq'th line the container logged, to dst in the
+// configured format. The timestamp is the one the daemon read the line at,
+// so time spent in the buffer doesn't skew it.
+func (l *S3Logger) encode(dst []byte, msg *Message, seq int64) []byte {
+	return l.format.encode(dst, msg, seq)
+}
+
+func appendTimestamp(dst []byte, t time.Time, format string) []byte {
+	if format == timestampUnixMs {
+		return strconv.AppendInt(dst, t.UnixMilli(), 10)
+	}
+	return t.UTC().AppendFormat(dst, time.RFC3339Nano)
+}
+
+// parseTimestamp parses a timestamp written by appendTimestamp in either
+// format.
+func parseTimestamp(s string) (time.Time, bool) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms), true
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t, err == nil
+}
+
+const hex = "0123456789abcdef"
+
+// appendJSONString appends s to dst as a quoted JSON string. Invalid UTF-8 is
+// escaped as U+FFFD, as encoding/json does, so that any line can be encoded.
+func appendJSONString[T string | []byte](dst []byte, s T) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				dst = append(dst, '\\', b)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hex[b>>4], hex[b&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(string(s[i:min(i+utf8.UTFMax, len(s))]))
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, `\ufffd`...)
+			i++
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
+
+// decodeRecord parses line as a record, reporting whether it is one.
+func decodeRecord(line []byte, t time.Time) (*Message, bool) {
+	var rec record
+	if len(line) == 0 || line[0] != '{' || json.Unmarshal(line, &rec) != nil || rec.Stream == "" {
+		return nil, false
+	}
+	if ts, ok := parseTimestamp(strings.Trim(string(rec.Time), `"`)); ok {
+		t = ts
+	}
+	text := []byte(rec.Log)
+	if rec.Log == "" {
+		// A line merged by merge-json-log has no log field.
+		if obj, ok := unmerge(line); ok {
+			text = obj
+		}
+	}
+	if rec.Truncated {
+		text = append(text, lineTruncatedMarker...)
+	}
+	msg := &Message{
+		Line:         text,
+		Source:       rec.Stream,
+		Timestamp:    t,
+		PLogMetaData: partMetaData(rec),
+	}
+	// The parts of a split line are joined by joinParts.
+	if msg.PLogMetaData == nil || msg.PLogMetaData.Last {
+		msg.Line = append(msg.Line, '\n')
+	}
+	return msg, true
+}
+
+// plainMessage returns line as a message on stdout stamped with t.
+func plainMessage(line []byte, t time.Time) *Message {
+	return &Message{
+		Line:      append(append([]byte(nil), line...), '\n'),
+		Source:    "stdout",
+		Timestamp: t,
+	}
+}
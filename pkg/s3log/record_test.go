@@ -0,0 +1,297 @@
+package s3log
+
+import (
+	"encoding/json"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAttrs(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    Info
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "nothing selected",
+			info: Info{ContainerLabels: map[string]string{"team": "a"}, ContainerEnv: []string{"TEAM=b"}},
+		},
+		{
+			name: "labels and env",
+			info: Info{
+				Config:          map[string]string{labelsKey: "team,missing", envKey: "DEPLOY"},
+				ContainerLabels: map[string]string{"team": "payments", "other": "x"},
+				ContainerEnv:    []string{"DEPLOY=blue", "HOME=/root"},
+			},
+			want: map[string]string{"team": "payments", "DEPLOY": "blue"},
+		},
+		{
+			name: "regexes",
+			info: Info{
+				Config:          map[string]string{labelsRegexKey: "^com\\.example\\.", envRegexKey: "^APP_"},
+				ContainerLabels: map[string]string{"com.example.team": "payments", "org.other": "x"},
+				ContainerEnv:    []string{"APP_NAME=api", "APP_ENV=prod", "PATH=/bin"},
+			},
+			want: map[string]string{"com.example.team": "payments", "APP_NAME": "api", "APP_ENV": "prod"},
+		},
+		{
+			// As with json-file, an env var wins over a label of the
+			// same name.
+			name: "label and env of the same name",
+			info: Info{
+				Config:          map[string]string{labelsKey: "team", envKey: "team"},
+				ContainerLabels: map[string]string{"team": "label"},
+				ContainerEnv:    []string{"team=env"},
+			},
+			want: map[string]string{"team": "env"},
+		},
+		{
+			name: "env value holding =",
+			info: Info{
+				Config:       map[string]string{envKey: "OPTS"},
+				ContainerEnv: []string{"OPTS=-Dkey=value -Dother=x"},
+			},
+			want: map[string]string{"OPTS": "-Dkey=value -Dother=x"},
+		},
+		{
+			name:    "invalid regex",
+			info:    Info{Config: map[string]string{envRegexKey: "("}, ContainerEnv: []string{"A=b"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAttrs(tt.info)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAttrs: %v, want error %v", err, tt.wantErr)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("attrs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordAttrs(t *testing.T) {
+	fake := newFakeS3()
+	info := Info{
+		Config:          testLogOpts(t, map[string]string{labelsKey: "team", envKey: "OPTS"}),
+		ContainerID:     testContainerID(t),
+		ContainerName:   "/test",
+		ContainerLabels: map[string]string{"team": "payments"},
+		ContainerEnv:    []string{"OPTS=a=b"},
+	}
+	l, _ := newTestDriverLogger(t, fake, info)
+	logLines(t, l, time.Now(), "one", "two")
+	l.Close()
+	keys := fake.logKeys(testBucket)
+	if len(keys) != 1 {
+		t.Fatalf("uploaded %q, want one object", keys)
+	}
+	o, _ := fake.object(testBucket, keys[0])
+	want := map[string]string{"team": "payments", "OPTS": "a=b"}
+	for _, line := range strings.Split(strings.TrimSpace(string(o.data)), "\n") {
+		var r record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		if !maps.Equal(r.Attrs, want) {
+			t.Errorf("record %s has attrs %v, want %v", line, r.Attrs, want)
+		}
+	}
+}
+
+func TestTimestampFormat(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 12, 30, 45, 123456789, time.FixedZone("CEST", 2*60*60))
+	tests := []struct {
+		format, timestamp string
+		want              string
+	}{
+		{formatJSONL, timestampRFC3339Nano, `{"log":"hello","stream":"stdout","seq":7,"time":"2024-05-01T10:30:45.123456789Z","container_id":"c1","tag":"web"}` + "\n"},
+		{formatJSONL, timestampUnixMs, `{"log":"hello","stream":"stdout","seq":7,"time":1714559445123,"container_id":"c1","tag":"web"}` + "\n"},
+		{formatJSONL, timestampNone, `{"log":"hello","stream":"stdout","seq":7,"container_id":"c1","tag":"web"}` + "\n"},
+		{formatRaw, timestampRFC3339Nano, "2024-05-01T10:30:45.123456789Z hello\n"},
+		{formatRaw, timestampUnixMs, "1714559445123 hello\n"},
+		{formatRaw, timestampNone, "hello\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+"/"+tt.timestamp, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Format, opts.TimestampFormat = tt.format, tt.timestamp
+			f, err := newLineFormat(opts, "c1", "web", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := string(f.encode(nil, &Message{Line: []byte("hello"), Source: "stdout", Timestamp: ts}, 7))
+			if got != tt.want {
+				t.Errorf("encoded\n%s\nwant\n%s", got, tt.want)
+			}
+			if tt.timestamp == timestampNone {
+				return
+			}
+			msg := f.decode([]byte(strings.TrimSuffix(got, "\n")), time.Time{})
+			want := ts
+			if tt.timestamp == timestampUnixMs {
+				want = ts.Truncate(time.Millisecond)
+			}
+			if !msg.Timestamp.Equal(want) || string(msg.Line) != "hello\n" {
+				t.Errorf("decoded %q at %v, want hello at %v", msg.Line, msg.Timestamp, want)
+			}
+		})
+	}
+}
+
+func TestTimestampFromDaemon(t *testing.T) {
+	// Lines keep the time the daemon read them at, however long they sat
+	// in the buffer.
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, map[string]string{formatKey: formatRaw, timestampKey: timestampRFC3339Nano})
+	logged := time.Now().Add(-time.Hour).UTC()
+	logLines(t, l, logged, "old")
+	l.Close()
+	keys := fake.logKeys(testBucket)
+	if len(keys) != 1 {
+		t.Fatalf("uploaded %q, want one object", keys)
+	}
+	o, _ := fake.object(testBucket, keys[0])
+	if want := logged.Format(time.RFC3339Nano) + " old\n"; string(o.data) != want {
+		t.Errorf("uploaded %q, want %q", o.data, want)
+	}
+}
+
+func TestLineFormat(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 30, 45, 0, time.UTC)
+	tests := []struct {
+		name  string
+		msg   *Message
+		jsonl string
+		raw   string
+		// decoded is the line docker logs gets back from jsonl, with its
+		// newline. A raw line comes back as it was.
+		decoded string
+	}{
+		{
+			name:    "plain",
+			msg:     &Message{Line: []byte("hello"), Source: "stdout"},
+			jsonl:   `{"log":"hello","stream":"stdout","seq":3,"container_id":"c1","tag":"web"}`,
+			raw:     "hello",
+			decoded: "hello\n",
+		},
+		{
+			name:    "quotes and backslashes",
+			msg:     &Message{Line: []byte(`say "hi" \ bye`), Source: "stderr"},
+			jsonl:   `{"log":"say \"hi\" \\ bye","stream":"stderr","seq":3,"container_id":"c1","tag":"web"}`,
+			raw:     `say "hi" \ bye`,
+			decoded: `say "hi" \ bye` + "\n",
+		},
+		{
+			name:    "control bytes",
+			msg:     &Message{Line: []byte("a\tb\x01\x1fc\r"), Source: "stdout"},
+			jsonl:   `{"log":"a\tb\u0001\u001fc\r","stream":"stdout","seq":3,"container_id":"c1","tag":"web"}`,
+			raw:     "a\tb\x01\x1fc\r",
+			decoded: "a\tb\x01\x1fc\r\n",
+		},
+		{
+			// Invalid UTF-8 is replaced rather than the line skipped.
+			name:    "invalid UTF-8",
+			msg:     &Message{Line: []byte("bad \xff\xfe end"), Source: "stdout"},
+			jsonl:   `{"log":"bad \ufffd\ufffd end","stream":"stdout","seq":3,"container_id":"c1","tag":"web"}`,
+			raw:     "bad \xff\xfe end",
+			decoded: "bad �� end\n",
+		},
+		{
+			name:    "multibyte",
+			msg:     &Message{Line: []byte("héllo 世界  "), Source: "stdout"},
+			jsonl:   `{"log":"héllo 世界 ` + " " + `","stream":"stdout","seq":3,"container_id":"c1","tag":"web"}`,
+			raw:     "héllo 世界  ",
+			decoded: "héllo 世界  \n",
+		},
+		{
+			name:    "empty",
+			msg:     &Message{Line: []byte{}, Source: "stdout"},
+			jsonl:   `{"log":"","stream":"stdout","seq":3,"container_id":"c1","tag":"web"}`,
+			raw:     "",
+			decoded: "\n",
+		},
+		{
+			// A line that is itself a record stays one line of jsonl.
+			name:    "embedded record",
+			msg:     &Message{Line: []byte(`{"log":"inner","stream":"stderr"}`), Source: "stdout"},
+			jsonl:   `{"log":"{\"log\":\"inner\",\"stream\":\"stderr\"}","stream":"stdout","seq":3,"container_id":"c1","tag":"web"}`,
+			raw:     `{"log":"inner","stream":"stderr"}`,
+			decoded: `{"log":"inner","stream":"stderr"}` + "\n",
+		},
+		{
+			name:    "attrs",
+			msg:     &Message{Line: []byte("late"), Source: "stdout", Attrs: []LogAttr{{Key: "original_time", Value: "2024-05-01T12:00:00Z"}}},
+			jsonl:   `{"log":"late","stream":"stdout","seq":3,"original_time":"2024-05-01T12:00:00Z","container_id":"c1","tag":"web"}`,
+			raw:     "late",
+			decoded: "late\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.msg.Timestamp = ts
+			for _, format := range []string{formatJSONL, formatRaw} {
+				opts := DefaultOptions()
+				opts.Format, opts.TimestampFormat = format, timestampNone
+				f, err := newLineFormat(opts, "c1", "web", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := tt.jsonl
+				if format == formatRaw {
+					want = tt.raw
+				}
+				// Lines are appended to what the buffer already holds.
+				got := f.encode([]byte("before\n"), tt.msg, 3)
+				if string(got) != "before\n"+want+"\n" {
+					t.Errorf("%s encoded\n%q\nwant\n%q", format, got, "before\n"+want+"\n")
+				}
+				if format == formatRaw && strings.HasPrefix(tt.raw, "{") {
+					// A raw line that is a record is read back as the
+					// record it looks like.
+					continue
+				}
+				msg := f.decode([]byte(want), ts)
+				decoded, source := tt.decoded, tt.msg.Source
+				if format == formatRaw {
+					decoded, source = tt.raw+"\n", "stdout"
+				}
+				if string(msg.Line) != decoded || msg.Source != source {
+					t.Errorf("%s decoded %q from %s, want %q from %s", format, msg.Line, msg.Source, decoded, source)
+				}
+			}
+		})
+	}
+}
+
+func TestAppendJSONString(t *testing.T) {
+	// Whatever the bytes, the string decodes as encoding/json would have
+	// encoded it.
+	inputs := []string{"", "plain", "\"\\/", "\x00\x7f", "bad \xff", "\xe4\xb8", "世\xe7界", strings.Repeat("\xc3", 3)}
+	var all []byte
+	for b := range 256 {
+		all = append(all, byte(b))
+		inputs = append(inputs, string([]byte{byte(b)}), "x"+string([]byte{byte(b)})+"世")
+	}
+	inputs = append(inputs, string(all))
+	for _, s := range inputs {
+		var got, want string
+		if err := json.Unmarshal(appendJSONString(nil, s), &got); err != nil {
+			t.Errorf("appendJSONString(%q) isn't a JSON string: %v", s, err)
+			continue
+		}
+		data, _ := json.Marshal(s)
+		json.Unmarshal(data, &want)
+		if got != want {
+			t.Errorf("appendJSONString(%q) decodes to %q, want %q", s, got, want)
+		}
+		if b := appendJSONString(nil, []byte(s)); string(b) != string(appendJSONString(nil, s)) {
+			t.Errorf("appendJSONString of %q as bytes gives %s, as a string %s", s, b, appendJSONString(nil, s))
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package s3log
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	redactPatternsKey    = "redact-patterns"
+	redactReplacementKey = "redact-replacement"
+
+	defaultRedactReplacement = "[REDACTED]"
+)
+
+// redactor replaces whatever its patterns match in a line. Lines without a
+// match are returned as they are, without allocating.
+type redactor struct {
+	patterns    []*regexp.Regexp
+	replacement []byte
+}
+
+// parseRedactPatterns splits a semicolon-separated list of regular
+// expressions. Empty patterns are skipped.
+func parseRedactPatterns(v string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(v, ";") {
+		if p == "" {
+			continue
+		}
+		if _, err := regexp.Compile(p); err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// newRedactor compiles patterns, which have been validated by
+// parseRedactPatterns. It returns nil when there is nothing to redact.
+func newRedactor(patterns []string, replacement string) *redactor {
+	if len(patterns) == 0 {
+		return nil
+	}
+	r := &redactor{replacement: []byte(replacement)}
+	for _, p := range patterns {
+		r.patterns = append(r.patterns, regexp.MustCompile(p))
+	}
+	return r
+}
+
+// redact returns line with every match replaced, reporting whether anything
+// was.
+func (r *redactor) redact(line []byte) ([]byte, bool) {
+	redacted := false
+	for _, re := range r.patterns {
+		if re.Match(line) {
+			line = re.ReplaceAllLiteral(line, r.replacement)
+			redacted = true
+		}
+	}
+	return line, redacted
+}
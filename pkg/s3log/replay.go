@@ -0,0 +1,502 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/sirupsen/logrus"
+)
+
+// replayedTag is the object tag the replay command adds to what it uploads.
+const replayedTag = "replayed"
+
+// replayRun counts the objects of a replay.
+type replayRun struct {
+	force bool
+
+	sent    atomic.Int64 // handed to S3
+	skipped atomic.Int64 // already there
+	failed  atomic.Int64 // not looked up, and so not sent
+}
+
+// taken reports whether b's key is already taken in its bucket, which
+// client reaches, counting b as skipped if so. A forced run takes no key to
+// be taken. An object encrypted with a customer-provided key is there even
+// if it is refused for lacking the key.
+func (r *replayRun) taken(ctx context.Context, client s3API, b *batch) (bool, error) {
+	if r.force {
+		r.sent.Add(1)
+		return false, nil
+	}
+	input := &s3.HeadObjectInput{
+		Bucket:       aws.String(b.Bucket),
+		Key:          aws.String(b.Key),
+		RequestPayer: types.RequestPayer(b.RequestPayer),
+	}
+	ssec, err := b.customerKey()
+	if err != nil {
+		r.failed.Add(1)
+		return false, err
+	}
+	ssec.set(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	_, err = client.HeadObject(ctx, input)
+	switch status := httpStatus(err); {
+	case err == nil || status == http.StatusBadRequest:
+		r.skipped.Add(1)
+		return true, nil
+	case status == http.StatusNotFound:
+		r.sent.Add(1)
+		return false, nil
+	}
+	r.failed.Add(1)
+	return false, fmt.Errorf("failed to look up object %q: %w", b.Key, err)
+}
+
+// journalInfo returns what the logger's journal records of the container
+// with info: its log-opts, under those of its tenant's section of the config
+// file, without credentials, and of its environment only the variables env
+// and env-regex pick.
+func (l *S3Logger) journalInfo(info Info) journalInfo {
+	cfg := map[string]string{}
+	if t := l.pool.tenant(l.opts.Tenant); t != nil {
+		maps.Copy(cfg, t.logOpts)
+	}
+	maps.Copy(cfg, info.Config)
+	for _, k := range []string{accessKeyIDKey, secretKeyKey, sessionTokenKey} {
+		delete(cfg, k)
+	}
+	info.Config = cfg
+	info.ContainerEnv = pickedEnv(info)
+	return journalInfo{Info: info, Stream: l.opts.stream}
+}
+
+// pickedEnv returns the variables of info's environment that its env and
+// env-regex log-opts pick.
+func pickedEnv(info Info) []string {
+	if info.Config[envKey] == "" && info.Config[envRegexKey] == "" {
+		return nil
+	}
+	info.ContainerLabels = nil
+	picked, err := info.ExtraAttributes(nil)
+	if err != nil {
+		return nil
+	}
+	var env []string
+	for _, e := range info.ContainerEnv {
+		if k, _, ok := strings.Cut(e, "="); ok {
+			if _, ok := picked[k]; ok {
+				env = append(env, e)
+			}
+		}
+	}
+	return env
+}
+
+// RunReplay runs the replay command, which uploads again the lines logged
+// in a span of time that the journals under --wal-dir kept with
+// wal-retention, and the batches spooled under --spool-dir, as after objects
+// were lost from the bucket. Each line is uploaded under the container's own
+// key template, numbered afresh so that a second replay of the span names
+// its objects the same, and tagged replayed=true; an object whose key is
+// taken is skipped unless --force is set. It takes the same log-opt flags as
+// the plugin, and returns the exit status.
+func RunReplay(args []string) int {
+	var defaults LogOption
+	fs := flag.NewFlagSet(driverName+" replay", flag.ExitOnError)
+	fromVal := fs.String("from", "", "RFC 3339 time of the first lines replayed")
+	toVal := fs.String("to", "", "RFC 3339 time the lines replayed were logged before, now if unset")
+	containerID := fs.String("container-id", "", "ID, or ID prefix, of the containers replayed, all of them if unset")
+	force := fs.Bool("force", false, "upload objects whose keys are taken, overwriting them")
+	allowInsecure := fs.Bool(allowInsecureKey, false, "allow "+insecureSkipVerifyKey)
+	levelVal := fs.String("log-level", "warn", "level of the plugin's own logs while replaying")
+	optionFlags(fs, &defaults)
+	fs.Parse(args)
+
+	setLogLevel(*levelVal)
+	if *fromVal == "" {
+		fmt.Fprintln(os.Stderr, "--from is required")
+		return 2
+	}
+	from, err := time.Parse(time.RFC3339Nano, *fromVal)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --from %q: must be an RFC 3339 time\n", *fromVal)
+		return 2
+	}
+	to := time.Now()
+	if *toVal != "" {
+		if to, err = time.Parse(time.RFC3339Nano, *toVal); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --to %q: must be an RFC 3339 time\n", *toVal)
+			return 2
+		}
+	}
+	if !to.After(from) {
+		fmt.Fprintln(os.Stderr, "--to must be after --from")
+		return 2
+	}
+	if defaults.WALDir == "" && defaults.SpoolDir == "" {
+		fmt.Fprintf(os.Stderr, "--%s or --%s is required\n", walDirKey, spoolDirKey)
+		return 2
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	clients := newClientFactory(loadAWSConfig(), defaults.Concurrency, *allowInsecure)
+	run := &replayRun{force: *force}
+	// failed counts what failed along the way, of which uploadFailed is
+	// objects sent that weren't uploaded.
+	var lines, containers, failed, uploadFailed int
+	// Containers replayed from their journals, whose spooled batches hold
+	// lines already replayed.
+	journaled := map[string]bool{}
+	if defaults.WALDir != "" {
+		// The plugin deletes no retained segment while the lock is held.
+		lock, err := os.OpenFile(filepath.Join(defaults.WALDir, replayLockName), os.O_RDWR|os.O_CREATE, 0600)
+		if err == nil {
+			defer lock.Close()
+			err = syscall.Flock(int(lock.Fd()), syscall.LOCK_SH)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error locking %s %q: %v\n", walDirKey, defaults.WALDir, err)
+			return 1
+		}
+		entries, err := os.ReadDir(defaults.WALDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, e := range entries {
+			if !e.IsDir() || ctx.Err() != nil {
+				continue
+			}
+			dir := filepath.Join(defaults.WALDir, e.Name())
+			ji, err := readJournalInfo(dir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "skipping %s: %v\n", dir, err)
+				failed++
+				continue
+			}
+			if !strings.HasPrefix(ji.Info.ContainerID, *containerID) {
+				continue
+			}
+			n, nfailed, err := replayRetained(ctx, clients, defaults, run, dir, ji, from, to)
+			lines += n
+			uploadFailed += nfailed
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error replaying %s: %v\n", dir, err)
+				failed++
+			}
+			if n > 0 {
+				journaled[ji.Info.ContainerID] = true
+			}
+		}
+	}
+	if defaults.SpoolDir != "" && ctx.Err() == nil {
+		n, nlines, nfailed, err := replaySpooled(ctx, clients, defaults, run, *containerID, journaled, from, to)
+		containers = n
+		lines += nlines
+		uploadFailed += nfailed
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error replaying %s %q: %v\n", spoolDirKey, defaults.SpoolDir, err)
+			failed++
+		}
+	}
+	containers += len(journaled)
+	failed += uploadFailed + int(run.failed.Load())
+	if ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, "replay interrupted")
+		failed++
+	}
+	fmt.Fprintf(os.Stderr, "replayed %d lines of %d containers: %d objects uploaded, %d already there\n",
+		lines, containers, run.sent.Load()-int64(uploadFailed), run.skipped.Load())
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d failed\n", failed)
+		return 1
+	}
+	return 0
+}
+
+// readJournalInfo returns what the journal in dir records of its container,
+// or, if it recorded nothing, the container ID and stream its name gives.
+func readJournalInfo(dir string) (journalInfo, error) {
+	var ji journalInfo
+	data, err := os.ReadFile(filepath.Join(dir, releasedDirName, journalInfoName))
+	if err == nil {
+		err = json.Unmarshal(data, &ji)
+		return ji, err
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return ji, err
+	}
+	ji.Info.ContainerID = filepath.Base(dir)
+	for _, stream := range splitStreams {
+		if id, ok := strings.CutSuffix(ji.Info.ContainerID, "-"+stream); ok {
+			ji.Info.ContainerID, ji.Stream = id, stream
+		}
+	}
+	return ji, nil
+}
+
+// replayRetained uploads again the lines in the journal in dir, of the
+// container ji describes, that were logged in [from, to) and have been
+// uploaded: those of its released segments, and those of the rest up to its
+// checkpoint. It returns how many lines it replayed and how many batches
+// failed to upload.
+func replayRetained(ctx context.Context, clients *clientFactory, defaults LogOption, run *replayRun, dir string, ji journalInfo, from, to time.Time) (int, int, error) {
+	var l *S3Logger
+	lines := 0
+	err := readRetained(dir, func(e *logdriver.LogEntry) error {
+		if t := time.Unix(0, e.TimeNano); t.Before(from) || !t.Before(to) {
+			return nil
+		}
+		if l == nil {
+			var err error
+			if l, err = newReplayLogger(clients, defaults, run, ji); err != nil {
+				return err
+			}
+		}
+		l.mu.Lock()
+		l.process(newMessage(e), 0)
+		full := l.bufferedLen() >= l.flushBytes()
+		l.mu.Unlock()
+		lines++
+		if full {
+			if err := l.flush(ctx); err != nil {
+				l.log().WithError(err).Error("error flushing replayed logs")
+			}
+		}
+		return ctx.Err()
+	})
+	if l == nil {
+		return lines, 0, err
+	}
+	cerr := l.Close()
+	failed := failedBatches([]*S3Logger{l})
+	if err == nil && failed == 0 {
+		err = cerr
+	}
+	return lines, failed, err
+}
+
+// newReplayLogger returns a logger uploading the lines of the container ji
+// describes, under defaults, for run. Its objects are named for when their
+// lines were logged and numbered from 1, and nothing but the lines handed to
+// it decides where a batch ends, so that they are named the same by every
+// replay of the same lines.
+func newReplayLogger(clients *clientFactory, defaults LogOption, run *replayRun, ji journalInfo) (*S3Logger, error) {
+	opts, err := parseLogOpts(defaults, ji.Info.Config)
+	if err != nil {
+		return nil, newOpError(opParseOptions, "", err)
+	}
+	streams := streamOptions(opts)
+	opts = streams[0]
+	for _, s := range streams {
+		if s.stream == ji.Stream {
+			opts = s
+		}
+	}
+	if len(opts.ObjectTags) >= maxObjectTags {
+		return nil, fmt.Errorf("invalid %s: S3 allows at most %d tags, and replay adds %s to its %d", objectTagsKey, maxObjectTags, replayedTag, len(opts.ObjectTags))
+	}
+	opts.ObjectTags = maps.Clone(opts.ObjectTags)
+	if opts.ObjectTags == nil {
+		opts.ObjectTags = map[string]string{}
+	}
+	opts.ObjectTags[replayedTag] = "true"
+	// Nothing is journaled, spooled or kept, nothing but lines is uploaded,
+	// and every line is, as it is handed over.
+	opts.WAL, opts.SpoolDir, opts.StateDir = false, "", ""
+	opts.Manifest, opts.Summary, opts.Index, opts.DeadLetter, opts.ExitEvent = false, false, false, false, false
+	opts.HeartbeatInterval, opts.CloudWatchGroup = 0, ""
+	opts.Mode, opts.StdoutMode, opts.StderrMode = modeBlocking, modeBlocking, modeBlocking
+	opts.SampleRate = 1
+	opts.WriteMode = writeModeObject
+	opts.FlushInterval = 24 * time.Hour
+	opts.AdaptiveFlush, opts.CoalesceWindow, opts.StartupGrace, opts.MaxPutsPerContainer = false, 0, 0, 0
+	opts.KeyUniqueSuffix = uniqueSuffixNone
+	opts.backfill = true
+	opts.replay = run
+
+	l, err := newS3Logger(clients, nil, nil, opts, ji.Info, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	l.flushMu.Lock()
+	l.stateRead = true
+	l.flushMu.Unlock()
+	return l, nil
+}
+
+// readRetained hands fn the records of the journal in dir whose lines have
+// been uploaded, oldest first: those of its released segments, then those
+// of the rest up to its checkpoint. A segment released while it is read is
+// read from the released directory. A torn or corrupt record ends its
+// segment, as the journal's own replay would, but is left as it is. fn's
+// error stops reading.
+func readRetained(dir string, fn func(*logdriver.LogEntry) error) error {
+	cp, _, err := loadCheckpoint(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replaying only the released segments of %s: %v\n", dir, err)
+	}
+	live, err := filepath.Glob(filepath.Join(dir, "*"+walSegmentSuffix))
+	if err != nil {
+		return err
+	}
+	sort.Strings(live)
+	read := map[string]bool{}
+	readReleased := func() error {
+		paths, err := filepath.Glob(filepath.Join(dir, releasedDirName, "*"+walSegmentSuffix))
+		if err != nil {
+			return err
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			if read[path] {
+				continue
+			}
+			read[path] = true
+			if err := readSegment(path, math.MaxInt64, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := readReleased(); err != nil {
+		return err
+	}
+	for _, path := range live {
+		n, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), walSegmentSuffix), 10, 64)
+		if err != nil || n > cp.Segment {
+			continue
+		}
+		records := int64(math.MaxInt64)
+		if n == cp.Segment {
+			records = cp.Records
+		}
+		err = readSegment(path, records, fn)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = readReleased()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegment hands fn each of the first records of the journal segment at
+// path.
+func readSegment(path string, records int64, fn func(*logdriver.LogEntry) error) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for off, i := 0, int64(0); off < len(data) && i < records; i++ {
+		e, n, ok := decodeJournalRecord(data[off:])
+		if !ok {
+			fmt.Fprintf(os.Stderr, "skipping the last %d bytes of %s, a torn record\n", len(data)-off, path)
+			return nil
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+// replaySpooled uploads again the batches spooled under defaults' spool-dir
+// by the containers whose ID starts with prefix, other than those in
+// journaled, holding lines logged in [from, to), under their own keys and
+// tagged replayed=true. The spooled files are left for the plugin to upload
+// and delete. It returns how many containers it replayed batches of, how
+// many lines they held and how many batches failed to upload.
+func replaySpooled(ctx context.Context, clients *clientFactory, defaults LogOption, run *replayRun, prefix string, journaled map[string]bool, from, to time.Time) (int, int, int, error) {
+	files, err := (&spool{dir: defaults.SpoolDir}).files()
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	containers := map[string]bool{}
+	lines, failed := 0, 0
+	for _, f := range files {
+		if ctx.Err() != nil {
+			return len(containers), lines, failed, ctx.Err()
+		}
+		id := f.container()
+		if journaled[id] || !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		if h, err := readSpoolHeader(f.path); err != nil || !h.First.Before(to) || h.Last.Before(from) {
+			continue
+		}
+		b, err := readSpoolFile(f.path)
+		if err != nil {
+			// Uploaded and deleted by the plugin since it was listed.
+			continue
+		}
+		containers[id] = true
+		lines += b.Lines
+		if err := replayBatch(ctx, clients, defaults, run, b); err != nil {
+			s3Failed(logrus.WithField("id", id).WithField("key", b.Key), b.Bucket, err).Error("error replaying spooled batch")
+			failed++
+		}
+	}
+	return len(containers), lines, failed, nil
+}
+
+// replayBatch uploads b, read from the spool, for run, unless its key is
+// taken, retrying as defaults do.
+func replayBatch(ctx context.Context, clients *clientFactory, defaults LogOption, run *replayRun, b *batch) error {
+	tags, err := url.ParseQuery(b.Tagging)
+	if err != nil {
+		return err
+	}
+	tags.Set(replayedTag, "true")
+	if len(tags) > maxObjectTags {
+		return fmt.Errorf("invalid %s: S3 allows at most %d tags, and replay adds %s to its %d", objectTagsKey, maxObjectTags, replayedTag, len(tags)-1)
+	}
+	b.Tagging = tags.Encode()
+	client, err := clients.client(b.Client)
+	if err != nil {
+		return err
+	}
+	uploader, err := clients.uploader(b.Client, client)
+	if err != nil {
+		return err
+	}
+	taken, err := run.taken(ctx, client, b)
+	if err != nil {
+		s3Failed(logrus.WithField("id", b.ContainerID).WithField("key", b.Key), b.Bucket, err).Error("error looking up spooled batch's object")
+	}
+	if taken || err != nil {
+		return nil
+	}
+	return retry(ctx, defaults.MaxRetries, defaults.MaxRetryDelay, func() error {
+		ctx, cancel := requestContext(ctx, defaults.S3RequestTimeout)
+		defer cancel()
+		return uploadBatch(ctx, uploader, b)
+	})
+}
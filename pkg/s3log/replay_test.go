@@ -0,0 +1,380 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestJournalInfo(t *testing.T) {
+	env := []string{"APP=web", "APP_VERSION=1.2", "DB_PASSWORD=hunter2", "EMPTY=", "NOVALUE"}
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		want []string
+	}{
+		{name: "no env log-opts", cfg: map[string]string{}},
+		{name: "env", cfg: map[string]string{envKey: "APP,MISSING"}, want: []string{"APP=web"}},
+		{name: "env-regex", cfg: map[string]string{envRegexKey: "^APP"}, want: []string{"APP=web", "APP_VERSION=1.2"}},
+		{name: "both", cfg: map[string]string{envKey: "EMPTY", envRegexKey: "VERSION$"}, want: []string{"APP_VERSION=1.2", "EMPTY="}},
+		{name: "labels only", cfg: map[string]string{"labels": "app"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := map[string]string{accessKeyIDKey: "AKID", secretKeyKey: "secret", sessionTokenKey: "token"}
+			for k, v := range tt.cfg {
+				cfg[k] = v
+			}
+			info := Info{Config: cfg, ContainerEnv: env, ContainerLabels: map[string]string{"app": "web"}}
+			ji := (&S3Logger{}).journalInfo(info)
+			if !slices.Equal(ji.Info.ContainerEnv, tt.want) {
+				t.Errorf("env = %q, want %q", ji.Info.ContainerEnv, tt.want)
+			}
+			for _, k := range []string{accessKeyIDKey, secretKeyKey, sessionTokenKey} {
+				if _, ok := ji.Info.Config[k]; ok {
+					t.Errorf("%s recorded", k)
+				}
+			}
+			if !slices.Equal(info.ContainerEnv, env) || info.Config[secretKeyKey] == "" {
+				t.Error("the container's own info was changed")
+			}
+		})
+	}
+}
+
+func TestJournalInfoReleased(t *testing.T) {
+	fake := newFakeS3()
+	dir := t.TempDir()
+	info := Info{
+		Config: testLogOpts(t, map[string]string{
+			walKey:          "true",
+			walDirKey:       dir,
+			walRetentionKey: "1h",
+			envKey:          "APP",
+			secretKeyKey:    "secret",
+			accessKeyIDKey:  "AKIDTEST",
+		}),
+		ContainerID:   testContainerID(t),
+		ContainerName: "/test",
+		ContainerEnv:  []string{"APP=web", "DB_PASSWORD=hunter2"},
+	}
+	l, _ := newTestDriverLogger(t, fake, info)
+	logLines(t, l, time.Now(), "line")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ji, err := readJournalInfo(s3Loggers(l)[0].walDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ji.Info.ContainerID != info.ContainerID {
+		t.Fatalf("recorded container %q, want %q", ji.Info.ContainerID, info.ContainerID)
+	}
+	if want := []string{"APP=web"}; !slices.Equal(ji.Info.ContainerEnv, want) {
+		t.Errorf("recorded env %q, want %q", ji.Info.ContainerEnv, want)
+	}
+	if _, ok := ji.Info.Config[secretKeyKey]; ok {
+		t.Errorf("recorded %s", secretKeyKey)
+	}
+}
+
+// replayDefaults returns the plugin's defaults as the replay command's flags
+// give them, with opts on top.
+func replayDefaults(t *testing.T, opts map[string]string) LogOption {
+	t.Helper()
+	var defaults LogOption
+	fs := flag.NewFlagSet(driverName+" replay", flag.ContinueOnError)
+	optionFlags(fs, &defaults)
+	for k, v := range opts {
+		if err := fs.Set(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return defaults
+}
+
+// replayedObjects returns the lines of each object in fake's testBucket, by
+// key, failing the test if one isn't tagged as replayed.
+func replayedObjects(t *testing.T, fake *fakeS3) map[string][]string {
+	t.Helper()
+	objects := map[string][]string{}
+	for _, key := range fake.logKeys(testBucket) {
+		o, _ := fake.object(testBucket, key)
+		if tags, err := url.ParseQuery(o.tagging); err != nil || tags.Get(replayedTag) != "true" {
+			t.Errorf("replayed %s tagged %q, want %s=true", key, o.tagging, replayedTag)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(o.data)), "\n") {
+			var rec record
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatal(err)
+			}
+			objects[key] = append(objects[key], rec.Log)
+		}
+	}
+	return objects
+}
+
+func TestReplayRetained(t *testing.T) {
+	// The lines a container's journal kept are uploaded again to a bucket
+	// that lost them: those of [from, to) that were uploaded, past a
+	// released segment that is gone and a torn record. A second replay
+	// finds every key taken and uploads nothing, and a forced one uploads
+	// the same objects again.
+	fake := newFakeS3()
+	walDir := t.TempDir()
+	l := newTestLogger(t, fake, map[string]string{
+		walKey:             "true",
+		walDirKey:          walDir,
+		walSyncIntervalKey: "0",
+		walSegmentBytesKey: "1", // a segment per line
+		walRetentionKey:    "1h",
+		flushIntervalKey:   "1h",
+	})
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 10 {
+		logLines(t, l, base.Add(time.Duration(i)*time.Minute), fmt.Sprintf("line %d", i))
+		if i%2 == 1 {
+			if err := l.flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Never uploaded, so left to the plugin's own replay of the journal.
+	logLines(t, l, base.Add(7*time.Minute), "pending")
+	released, _ := filepath.Glob(filepath.Join(l.walDir(), releasedDirName, "*"+walSegmentSuffix))
+	if len(released) != 10 {
+		t.Fatalf("released %d segments, want one for each uploaded line", len(released))
+	}
+	sort.Strings(released)
+	if err := os.Remove(released[4]); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(released[7], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 9, 1, 2})
+	f.Close()
+
+	ji, err := readJournalInfo(l.walDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost := newFakeS3()
+	clients := newTestClients(lost)
+	defaults := replayDefaults(t, nil)
+	from, to := base.Add(2*time.Minute), base.Add(8*time.Minute)
+	run := &replayRun{}
+	lines, failed, err := replayRetained(context.Background(), clients, defaults, run, l.walDir(), ji, from, to)
+	if err != nil || failed != 0 {
+		t.Fatalf("replay failed %d batches: %v", failed, err)
+	}
+	want := []string{"line 2", "line 3", "line 5", "line 6", "line 7"}
+	objects := replayedObjects(t, lost)
+	var got []string
+	keys := make([]string, 0, len(objects))
+	for k := range objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !strings.Contains(key, ji.Info.ContainerID) {
+			t.Errorf("replayed %s, want it under the container's key template", key)
+		}
+		got = append(got, objects[key]...)
+	}
+	if lines != len(want) || !slices.Equal(got, want) {
+		t.Fatalf("replayed %d lines %q, want %q", lines, got, want)
+	}
+	if run.sent.Load() != int64(len(objects)) || run.skipped.Load() != 0 {
+		t.Errorf("counted %d sent and %d skipped, want the %d objects sent", run.sent.Load(), run.skipped.Load(), len(objects))
+	}
+
+	puts := lost.count("PutObject")
+	again := &replayRun{}
+	if _, failed, err := replayRetained(context.Background(), clients, defaults, again, l.walDir(), ji, from, to); err != nil || failed != 0 {
+		t.Fatalf("second replay failed %d batches: %v", failed, err)
+	}
+	if n := lost.count("PutObject") - puts; n != 0 || again.skipped.Load() != int64(len(objects)) || again.sent.Load() != 0 {
+		t.Errorf("second replay uploaded %d objects and skipped %d, want all %d skipped", n, again.skipped.Load(), len(objects))
+	}
+
+	forced := &replayRun{force: true}
+	if _, failed, err := replayRetained(context.Background(), clients, defaults, forced, l.walDir(), ji, from, to); err != nil || failed != 0 {
+		t.Fatalf("forced replay failed %d batches: %v", failed, err)
+	}
+	if n := lost.count("PutObject") - puts; n != len(objects) || !maps.EqualFunc(replayedObjects(t, lost), objects, slices.Equal) {
+		t.Errorf("forced replay uploaded %d objects, want the same %d again", n, len(objects))
+	}
+}
+
+func TestReplaySpooled(t *testing.T) {
+	// Spooled batches are uploaded again under their own keys, left in the
+	// spool for the plugin, unless their container was replayed from its
+	// journal or their lines are outside the span.
+	fake := newFakeS3()
+	fake.fail("PutObject", 1, fakeStatusError(http.StatusServiceUnavailable, "ServiceUnavailable"))
+	spoolDir := t.TempDir()
+	l := newTestLogger(t, fake, map[string]string{spoolDirKey: spoolDir, maxRetriesKey: "0"})
+	// The spool's drainer would upload the batch and remove it once S3 is
+	// back, before the replay reads it.
+	l.spool.stop()
+	<-l.spool.stopped
+	logged := time.Now().Add(-time.Minute)
+	logLines(t, l, logged, "one", "two")
+	l.Close()
+	files, _ := filepath.Glob(filepath.Join(spoolDir, l.info.ContainerID, "*"+spoolFileSuffix))
+	if len(files) != 1 {
+		t.Fatalf("spooled %q, want one batch", files)
+	}
+	spooled, err := readSpoolFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		journaled map[string]bool
+		from, to  time.Time
+		want      int // objects replayed
+	}{
+		{name: "replayed", from: logged.Add(-time.Hour), to: time.Now(), want: 1},
+		{name: "journaled", journaled: map[string]bool{l.info.ContainerID: true}, from: logged.Add(-time.Hour), to: time.Now()},
+		{name: "before the span", from: logged.Add(time.Second), to: time.Now()},
+		{name: "after the span", from: logged.Add(-time.Hour), to: logged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lost := newFakeS3()
+			clients := newTestClients(lost)
+			run := &replayRun{}
+			defaults := replayDefaults(t, map[string]string{spoolDirKey: spoolDir})
+			containers, lines, failed, err := replaySpooled(context.Background(), clients, defaults, run, "", tt.journaled, tt.from, tt.to)
+			if err != nil || failed != 0 {
+				t.Fatalf("replay failed %d batches: %v", failed, err)
+			}
+			objects := replayedObjects(t, lost)
+			if len(objects) != tt.want || containers != tt.want || lines != 2*tt.want {
+				t.Fatalf("replayed %d objects of %d containers holding %d lines, want %d", len(objects), containers, lines, tt.want)
+			}
+			if tt.want > 0 && !slices.Equal(objects[spooled.Key], []string{"one", "two"}) {
+				t.Errorf("replayed %v, want the spooled lines under %s", objects, spooled.Key)
+			}
+			if _, err := os.Stat(files[0]); err != nil {
+				t.Errorf("spooled batch gone after the replay: %v", err)
+			}
+			puts := lost.count("PutObject")
+			again := &replayRun{}
+			replaySpooled(context.Background(), clients, defaults, again, "", tt.journaled, tt.from, tt.to)
+			if n := lost.count("PutObject") - puts; n != 0 || again.sent.Load() != 0 || again.skipped.Load() != int64(tt.want) {
+				t.Errorf("second replay uploaded %d objects and skipped %d, want none uploaded", n, again.skipped.Load())
+			}
+		})
+	}
+}
+
+// flock takes the lock how on path, creating it, until the end of the test.
+func flock(t *testing.T, path string, how int) *os.File {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestReplayLock(t *testing.T) {
+	// No expired segment is deleted while the replay command reads the
+	// journals, and the replay waits out a sweep under way.
+	root := t.TempDir()
+	released := filepath.Join(root, testContainerID(t), releasedDirName)
+	if err := os.MkdirAll(released, 0700); err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-time.Hour).UnixNano()
+	segment := filepath.Join(released, fmt.Sprintf("%020d-%020d%s", expired, expired, walSegmentSuffix))
+	if err := os.WriteFile(segment, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	lockPath := filepath.Join(root, replayLockName)
+
+	replaying := flock(t, lockPath, syscall.LOCK_SH)
+	sweepReleased(root, true)
+	if _, err := os.Stat(segment); err != nil {
+		t.Fatalf("expired segment deleted while the journals were replayed: %v", err)
+	}
+	syscall.Flock(int(replaying.Fd()), syscall.LOCK_UN)
+	sweepReleased(root, true)
+	if _, err := os.Stat(segment); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expired segment kept once the replay finished: %v", err)
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	level := logrus.GetLevel()
+	t.Cleanup(func() { logrus.SetLevel(level) })
+	sweeping := flock(t, lockPath, syscall.LOCK_EX)
+	done := make(chan int, 1)
+	go func() { done <- RunReplay([]string{"--from", "2024-05-01T00:00:00Z", "--" + walDirKey, root}) }()
+	select {
+	case code := <-done:
+		t.Fatalf("replay exited %d during a sweep", code)
+	case <-time.After(100 * time.Millisecond):
+	}
+	syscall.Flock(int(sweeping.Fd()), syscall.LOCK_UN)
+	select {
+	case code := <-done:
+		if code != 0 {
+			t.Errorf("replay exited %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replay still waiting once the sweep finished")
+	}
+}
+
+func TestRunReplayArgs(t *testing.T) {
+	dir := "--" + walDirKey + "=" + t.TempDir()
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "no from", args: []string{dir}, wantErr: "--from is required"},
+		{name: "bad from", args: []string{dir, "--from", "yesterday"}, wantErr: `invalid --from "yesterday"`},
+		{name: "bad to", args: []string{dir, "--from", "2024-05-01T00:00:00Z", "--to", "soon"}, wantErr: `invalid --to "soon"`},
+		{name: "to before from", args: []string{dir, "--from", "2024-05-01T00:00:00Z", "--to", "2024-04-30T00:00:00Z"}, wantErr: "--to must be after --from"},
+		{name: "no dirs", args: []string{"--from", "2024-05-01T00:00:00Z"}, wantErr: "--" + walDirKey + " or --" + spoolDirKey + " is required"},
+	}
+	level := logrus.GetLevel()
+	t.Cleanup(func() { logrus.SetLevel(level) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, stderr := runCommand(t, RunReplay, tt.args...)
+			if code != 2 || !strings.Contains(stderr, tt.wantErr) {
+				t.Errorf("exit status %d with %q, want 2 with %q", code, stderr, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func init() {
+	requirePermissions(permission{"s3:ListBucket", onBucket, "resuming object numbering", always})
+}
+
+// keyTimestampSentinel stands in for the timestamp when rendering the key
+// template to find where it appears in a key.
+const keyTimestampSentinel = "\x04"
+
+// resumedSequences holds the last sequence number the process gave each
+// container's objects, keyed by bucket and key pattern, so that a container
+// started again carries on from it without listing the bucket: the bucket
+// is listed at most once per container per process.
+var resumedSequences = struct {
+	sync.Mutex
+	last map[string]int64
+}{last: make(map[string]int64)}
+
+// sequenceKey returns the key of the container's objects in
+// resumedSequences, or "" if the key template doesn't number them.
+func (l *S3Logger) sequenceKey() string {
+	pattern := l.keyPattern(func(d *keyData) { d.Sequence = keySequenceSentinel })
+	if pattern == nil {
+		return ""
+	}
+	return l.bucket + "\x00" + pattern.String()
+}
+
+// resumeSequence sets the sequence number the container's objects carry on
+// from, before the first of them is numbered: the last one the process
+// gave them, or failing that the highest among those already in the bucket.
+// If the bucket can't be listed, keys that have no unique suffix get a ULID
+// from then on, so that the objects of an earlier run aren't overwritten, as
+// they do straight away with upload-mode=presigned, which can't list it.
+// Callers must hold l.flushMu.
+func (l *S3Logger) resumeSequence(ctx context.Context) {
+	l.seqKey = l.sequenceKey()
+	if l.seqKey == "" {
+		return
+	}
+	resumedSequences.Lock()
+	last, ok := resumedSequences.last[l.seqKey]
+	resumedSequences.Unlock()
+	if ok {
+		l.state.Sequence = max(l.state.Sequence, last)
+		return
+	}
+	if l.opts.UploadMode == uploadModePresigned {
+		if l.opts.KeyUniqueSuffix == uniqueSuffixNone {
+			l.opts.KeyUniqueSuffix = uniqueSuffixULID
+		}
+		return
+	}
+	seq, err := l.lastSequence(ctx)
+	if err != nil {
+		if l.opts.KeyUniqueSuffix == uniqueSuffixNone {
+			l.opts.KeyUniqueSuffix = uniqueSuffixULID
+			s3Failed(l.log(), l.bucket, err).Warnf("error finding the last object sequence number, starting from 0 with %s=%s so as not to overwrite existing objects", keyUniqueSuffixKey, uniqueSuffixULID)
+			return
+		}
+		s3Failed(l.log(), l.bucket, err).Warn("error finding the last object sequence number, starting from 0")
+		return
+	}
+	l.state.Sequence = max(l.state.Sequence, seq)
+}
+
+// rememberSequence records the sequence number last given to the
+// container's objects in resumedSequences. Callers must hold l.flushMu.
+func (l *S3Logger) rememberSequence() {
+	if l.seqKey == "" {
+		return
+	}
+	resumedSequences.Lock()
+	defer resumedSequences.Unlock()
+	resumedSequences.last[l.seqKey] = max(resumedSequences.last[l.seqKey], l.state.Sequence)
+}
+
+// sequenceProbe finds the highest sequence number under a prefix without
+// listing all of it, for key templates whose keys, past a part shared by
+// all of them, start with the timestamp or the sequence number, and so sort
+// oldest first. point returns the key that keys at position n or later of
+// that order sort after.
+type sequenceProbe struct {
+	prefix     string // the part of the keys shared by all of them
+	delimiter  string
+	base       string
+	pattern    *regexp.Regexp
+	point      func(n int64) string
+	bySequence bool // rather than by timestamp
+}
+
+// newSequenceProbe returns the probe for the container's objects under
+// base, or nil if the key template doesn't sort them oldest first.
+func (l *S3Logger) newSequenceProbe(base string, pattern *regexp.Regexp) *sequenceProbe {
+	if l.run != "" || l.opts.backfill {
+		return nil
+	}
+	data := l.keyData
+	data.Timestamp = keyTimestampSentinel
+	data.Sequence = keySequenceSentinel
+	data.FirstSeq = keyPrefixSentinel
+	data.TimeSlice = keyPrefixSentinel
+	data.Index = keyPrefixSentinel
+	var buf bytes.Buffer
+	if err := l.keyTmpl.Execute(&buf, data); err != nil {
+		return nil
+	}
+	rendered := strings.TrimPrefix(buf.String(), "/")
+	i := strings.IndexAny(rendered, keyPrefixSentinel+keySequenceSentinel+keyTimestampSentinel)
+	if i < 0 {
+		return nil
+	}
+	p := &sequenceProbe{prefix: base + rendered[:i], base: base, pattern: pattern}
+	if !strings.Contains(rendered[i+1:], "/") {
+		// Leave out the keys of anything kept in folders next to the objects.
+		p.delimiter = "/"
+	}
+	switch rendered[i : i+1] {
+	case keySequenceSentinel:
+		p.bySequence = true
+		p.point = func(n int64) string { return p.prefix + fmt.Sprintf(sequenceFormat, n) }
+	case keyTimestampSentinel:
+		p.point = func(n int64) string { return p.prefix + time.Unix(n*60, 0).UTC().Format(keyTimestampFormat) }
+	default:
+		return nil
+	}
+	return p
+}
+
+// last returns the highest sequence number under the probe's prefix. Keys
+// that fit in a page take one request. Past that it gallops from the end
+// where the newest keys sort, doubling its steps until it finds a key, then
+// narrows down by halves to the last page of keys, which it returns the
+// highest of, so that a container with millions of objects costs a few
+// dozen requests.
+func (p *sequenceProbe) last(ctx context.Context, l *S3Logger) (int64, error) {
+	if last, _, more, err := p.page(ctx, l, ""); err != nil || !more {
+		return last, err
+	}
+	var lo, hi int64
+	if p.bySequence {
+		// Numbers past sequenceFormat's digits don't sort by value.
+		const limit = 999999
+		lo, hi = 0, 1
+		for {
+			_, found, _, err := p.page(ctx, l, p.point(hi))
+			if err != nil {
+				return 0, err
+			}
+			if !found {
+				break
+			}
+			if hi >= limit {
+				return 0, errUnsorted
+			}
+			lo, hi = hi, min(2*hi, limit)
+		}
+	} else {
+		// Allow for keys stamped by a clock running a day ahead.
+		hi = time.Now().Add(24*time.Hour).Unix() / 60
+		if _, found, _, err := p.page(ctx, l, p.point(hi)); err != nil || found {
+			if err == nil {
+				err = errUnsorted
+			}
+			return 0, err
+		}
+		for step := int64(1); ; step *= 2 {
+			lo = max(hi-step, 0)
+			if lo == 0 {
+				break
+			}
+			_, found, _, err := p.page(ctx, l, p.point(lo))
+			if err != nil {
+				return 0, err
+			}
+			if found {
+				break
+			}
+			hi = lo
+		}
+	}
+
+	for {
+		last, _, more, err := p.page(ctx, l, p.point(lo))
+		if err != nil || !more {
+			return last, err
+		}
+		if hi-lo <= 1 {
+			return 0, errUnsorted
+		}
+		mid := lo + (hi-lo)/2
+		_, found, _, err := p.page(ctx, l, p.point(mid))
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+}
+
+// errUnsorted is returned by a probe that found more keys than its order
+// allows for, which are listed instead.
+var errUnsorted = errors.New("keys don't sort oldest first")
+
+// page lists a single page of the keys under the probe's prefix after
+// startAfter, returning the highest sequence number among them. A page
+// counts as found if it has a numbered key or there are more after it.
+func (p *sequenceProbe) page(ctx context.Context, l *S3Logger, startAfter string) (last int64, found, more bool, err error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:       aws.String(l.bucket),
+		Prefix:       aws.String(p.prefix),
+		RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+	}
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+	if p.delimiter != "" {
+		input.Delimiter = aws.String(p.delimiter)
+	}
+	out, err := l.s3Client.ListObjectsV2(ctx, input)
+	if err != nil {
+		return 0, false, false, err
+	}
+	for _, o := range out.Contents {
+		m := p.pattern.FindStringSubmatch(strings.TrimPrefix(aws.ToString(o.Key), p.base))
+		if m == nil {
+			continue
+		}
+		found = true
+		if seq, err := strconv.ParseInt(m[1], 10, 64); err == nil && seq > last {
+			last = seq
+		}
+	}
+	more = aws.ToBool(out.IsTruncated)
+	return last, found || more, more, nil
+}
@@ -0,0 +1,158 @@
+package s3log
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// forgetSequences empties resumedSequences, as a restart of the plugin does,
+// now and at the end of the test.
+func forgetSequences(t *testing.T) {
+	forget := func() {
+		resumedSequences.Lock()
+		defer resumedSequences.Unlock()
+		clear(resumedSequences.last)
+	}
+	forget()
+	t.Cleanup(forget)
+}
+
+// putNumbered stores n objects as l names them, numbered 1 to n and stamped
+// a minute apart up to now, as an earlier run of the container left them.
+func putNumbered(t *testing.T, fake *fakeS3, l *S3Logger, n int) {
+	t.Helper()
+	start := time.Now().Add(-time.Duration(n) * time.Minute)
+	for i := range n {
+		data := l.keyData
+		data.Sequence = fmt.Sprintf(sequenceFormat, i+1)
+		ts := start.Add(time.Duration(i) * time.Minute)
+		key, err := renderKey(l.keyTmpl, data, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake.put(testBucket, key, []byte("{}\n"), ts)
+	}
+}
+
+// newKey returns the key of the object l uploads next, and how many LISTs
+// naming it took.
+func newKey(t *testing.T, fake *fakeS3, l *S3Logger) (string, int) {
+	t.Helper()
+	old := make(map[string]bool)
+	for _, k := range fake.logKeys(testBucket) {
+		old[k] = true
+	}
+	lists := fake.count("ListObjectsV2")
+	logLines(t, l, time.Now(), "after the restart")
+	if err := l.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range fake.logKeys(testBucket) {
+		if !old[k] {
+			return k, fake.count("ListObjectsV2") - lists
+		}
+	}
+	t.Fatal("nothing uploaded")
+	return "", 0
+}
+
+func TestResumeSequence(t *testing.T) {
+	// The state dir is wiped, so numbering carries on from the objects in
+	// the bucket, listing only the newest of them where the keys sort
+	// oldest first.
+	tests := []struct {
+		name     string
+		cfg      map[string]string
+		objects  int
+		pageSize int
+		maxLists int
+	}{
+		{name: "none", objects: 0, maxLists: 1},
+		{name: "one page", objects: 7, maxLists: 1},
+		{name: "timestamp first", objects: 1000, pageSize: 10, maxLists: 40},
+		{
+			name:     "sequence first",
+			cfg:      map[string]string{keyTemplateKey: "{{.ContainerName}}/{{.ContainerID}}/{{.Sequence}}-{{.Timestamp}}.log"},
+			objects:  1000,
+			pageSize: 10,
+			maxLists: 40,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forgetSequences(t)
+			fake := newFakeS3()
+			if tt.pageSize > 0 {
+				fake.pageSize = tt.pageSize
+			}
+			cfg := map[string]string{keyUniqueSuffixKey: uniqueSuffixNone, flushIntervalKey: "1h"}
+			maps.Copy(cfg, tt.cfg)
+			l := newTestLogger(t, fake, cfg)
+			putNumbered(t, fake, l, tt.objects)
+
+			key, lists := newKey(t, fake, l)
+			if want := fmt.Sprintf(sequenceFormat, tt.objects+1); !strings.Contains(key, want) {
+				t.Errorf("uploaded %s, want it numbered %s", key, want)
+			}
+			if lists > tt.maxLists {
+				t.Errorf("%d LISTs to number the object, want up to %d", lists, tt.maxLists)
+			}
+		})
+	}
+}
+
+func TestResumeSequenceRemembered(t *testing.T) {
+	// A container started again by the same plugin carries on from the
+	// number the plugin last gave it, without listing the bucket.
+	forgetSequences(t)
+	fake := newFakeS3()
+	cfg := map[string]string{keyUniqueSuffixKey: uniqueSuffixNone, flushIntervalKey: "1h"}
+	before := newTestLogger(t, fake, cfg)
+	putNumbered(t, fake, before, 3)
+	if key, _ := newKey(t, fake, before); !strings.Contains(key, fmt.Sprintf(sequenceFormat, 4)) {
+		t.Fatalf("uploaded %s, want it numbered 4", key)
+	}
+	if err := before.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	after := newTestLogger(t, fake, cfg)
+	key, lists := newKey(t, fake, after)
+	if !strings.Contains(key, fmt.Sprintf(sequenceFormat, 5)) || lists != 0 {
+		t.Errorf("uploaded %s after %d LISTs, want it numbered 5 without any", key, lists)
+	}
+}
+
+func TestResumeSequenceListDenied(t *testing.T) {
+	// Without s3:ListBucket numbering starts over, and keys that would have
+	// no unique suffix get a ULID so as not to overwrite those of the
+	// earlier run.
+	ulid := regexp.MustCompile(`-` + fmt.Sprintf(sequenceFormat, 1) + `-[0-9A-Z]{26}\.log$`)
+	for _, suffix := range []string{uniqueSuffixNone, uniqueSuffixTimestampNano} {
+		t.Run(suffix, func(t *testing.T) {
+			forgetSequences(t)
+			fake := newFakeS3()
+			l := newTestLogger(t, fake, map[string]string{keyUniqueSuffixKey: suffix, flushIntervalKey: "1h"})
+			putNumbered(t, fake, l, 3)
+			fake.fail("ListObjectsV2", 10, fakeStatusError(http.StatusForbidden, "AccessDenied"))
+
+			key, _ := newKey(t, fake, l)
+			switch suffix {
+			case uniqueSuffixNone:
+				if !ulid.MatchString(key) {
+					t.Errorf("uploaded %s, want it numbered 1 with a ULID", key)
+				}
+			default:
+				if ulid.MatchString(key) || !regexp.MustCompile(`-000001-\d{19}\.log$`).MatchString(key) {
+					t.Errorf("uploaded %s, want it numbered 1 with its own suffix", key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package s3log
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	retentionDaysKey      = "retention-days"
+	retentionExpiresAtKey = "retention-expires-at"
+
+	// allowedRetentionDaysKey is the plugin flag restricting the
+	// retention-days containers may ask for.
+	allowedRetentionDaysKey = "allowed-retention-days"
+
+	// retentionTag is the tag lifecycle rules filter a container's objects
+	// on, and expiresAtKey the metadata of when they are due to expire.
+	retentionTag = "retention"
+	expiresAtKey = "expires-at"
+)
+
+func init() {
+	requirePermissions(permission{"s3:PutObjectTagging", onObjects, retentionDaysKey, func(s permissionScope) bool { return s.opts.RetentionDays > 0 }})
+}
+
+// retention is how long a container's objects are kept, from retention-days.
+// Spooled batches carry it so that their manifest entries are written with
+// it too.
+type retention struct {
+	Days      int  `json:"days"`
+	ExpiresAt bool `json:"expires_at,omitempty"`
+}
+
+// newRetention returns the retention of opts, or nil without retention-days.
+func newRetention(opts LogOption) *retention {
+	if opts.RetentionDays == 0 {
+		return nil
+	}
+	return &retention{Days: opts.RetentionDays, ExpiresAt: opts.RetentionExpiresAt}
+}
+
+// apply returns tagging with the retention tag added, and metadata with
+// expires-at if r asks for it, counting from now. metadata itself is shared
+// and left alone. A nil r returns both as they are.
+func (r *retention) apply(tagging string, metadata map[string]string, now time.Time) (string, map[string]string) {
+	if r == nil {
+		return tagging, metadata
+	}
+	if tagging != "" {
+		tagging += "&"
+	}
+	tagging += retentionTag + "=" + strconv.Itoa(r.Days)
+	if r.ExpiresAt {
+		m := make(map[string]string, len(metadata)+1)
+		maps.Copy(m, metadata)
+		m[expiresAtKey] = now.Add(time.Duration(r.Days) * 24 * time.Hour).UTC().Format(time.RFC3339)
+		metadata = m
+	}
+	return tagging, metadata
+}
+
+// retain tags b, and sets its expiry, with the logger's retention.
+func (l *S3Logger) retain(b *batch) {
+	b.Retention = l.retention
+	b.Tagging, b.Metadata = l.retention.apply(b.Tagging, b.Metadata, time.Now())
+}
+
+// parseAllowedRetention parses the comma-separated day counts of
+// --allowed-retention-days.
+func parseAllowedRetention(v string) ([]int, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var days []int
+	for _, s := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid --%s %q: must be comma-separated positive day counts", allowedRetentionDaysKey, v)
+		}
+		days = append(days, n)
+	}
+	slices.Sort(days)
+	return slices.Compact(days), nil
+}
+
+// checkRetention returns an error if opts ask for a retention-days the
+// plugin doesn't allow.
+func (d *Driver) checkRetention(opts LogOption) error {
+	if len(d.allowedRetention) == 0 || opts.RetentionDays == 0 {
+		return nil
+	}
+	if !slices.Contains(d.allowedRetention, opts.RetentionDays) {
+		return fmt.Errorf("invalid %s %d: must be one of %v", retentionDaysKey, opts.RetentionDays, d.allowedRetention)
+	}
+	return nil
+}
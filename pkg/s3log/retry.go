@@ -0,0 +1,59 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxRetriesKey    = "max-retries"
+	maxRetryDelayKey = "max-retry-delay"
+
+	defaultMaxRetries    = 5
+	defaultMaxRetryDelay = 30 * time.Second
+
+	retryBaseDelay = 100 * time.Millisecond
+)
+
+var (
+	// uploadRetries counts upload attempts that failed and were retried.
+	uploadRetries atomic.Int64
+	// uploadFailures counts batches dropped after exhausting their retries.
+	uploadFailures atomic.Int64
+)
+
+// retry calls fn until it succeeds, ctx is done, maxRetries retries have
+// failed or a circuit breaker is open. Retries are spaced with exponential
+// backoff and full jitter, capped at maxDelay.
+func retry(ctx context.Context, maxRetries int, maxDelay time.Duration, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = fn(); err == nil || attempt >= maxRetries || ctx.Err() != nil || errors.Is(err, errBreakerOpen) {
+			return err
+		}
+		uploadRetries.Add(1)
+
+		t := time.NewTimer(backoff(attempt, maxDelay))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// backoff returns a random delay between zero and the exponential backoff
+// ceiling for the given attempt.
+func backoff(attempt int, maxDelay time.Duration) time.Duration {
+	ceiling := maxDelay
+	if attempt < 32 {
+		if d := retryBaseDelay << attempt; d > 0 && d < maxDelay {
+			ceiling = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
@@ -0,0 +1,100 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	errFail := errors.New("fail")
+	tests := []struct {
+		name       string
+		failures   int
+		maxRetries int
+		err        error
+		calls      int
+		wantErr    error
+	}{
+		{name: "first try", maxRetries: 3, calls: 1},
+		{name: "after failures", failures: 2, maxRetries: 3, err: errFail, calls: 3},
+		{name: "out of retries", failures: 5, maxRetries: 3, err: errFail, calls: 4, wantErr: errFail},
+		{name: "no retries", failures: 1, maxRetries: 0, err: errFail, calls: 1, wantErr: errFail},
+		{name: "breaker open", failures: 5, maxRetries: 3, err: errBreakerOpen, calls: 1, wantErr: errBreakerOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retry(context.Background(), tt.maxRetries, time.Millisecond, func() error {
+				calls++
+				if calls <= tt.failures {
+					return tt.err
+				}
+				return nil
+			})
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Errorf("retry = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.calls {
+				t.Errorf("called %d times, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := retry(ctx, 10, time.Hour, func() error {
+		calls++
+		cancel()
+		return errors.New("fail")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("retry = %v after %d calls, want the error of the only call", err, calls)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := range 40 {
+		ceiling := min(retryBaseDelay<<min(attempt, 31), time.Second)
+		for range 20 {
+			if d := backoff(attempt, time.Second); d < 0 || d > ceiling {
+				t.Fatalf("backoff(%d) = %v, want between 0 and %v", attempt, d, ceiling)
+			}
+		}
+	}
+}
+
+func TestUploadRetried(t *testing.T) {
+	slowDown := fakeStatusError(http.StatusServiceUnavailable, "SlowDown")
+	tests := []struct {
+		name     string
+		failures int
+		retries  string
+		puts     int
+		uploaded bool
+	}{
+		{name: "no failures", retries: "3", puts: 1, uploaded: true},
+		{name: "retried", failures: 2, retries: "3", puts: 3, uploaded: true},
+		{name: "dropped", failures: 10, retries: "2", puts: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			l := newTestLogger(t, fake, map[string]string{maxRetriesKey: tt.retries, maxRetryDelayKey: "1ms"})
+			fake.fail("PutObject", tt.failures, slowDown)
+			logLines(t, l, time.Now(), "line")
+			l.Close()
+			if got := fake.count("PutObject"); got != tt.puts {
+				t.Errorf("%d PUTs, want %d", got, tt.puts)
+			}
+			if got := uploadedLines(t, fake, l); slices.Equal(got, []string{"line"}) != tt.uploaded {
+				t.Errorf("uploaded %q, uploaded = %v", got, tt.uploaded)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package s3log
+
+import (
+	"sync"
+)
+
+// ringBuffer holds messages of a non-blocking logger between Log and the
+// goroutine that appends them to the batch buffer, so that Log never waits
+// on the logger's lock while a flush is taking the buffer. It holds at most
+// maxBytes of lines; when full the oldest messages are dropped to make room.
+// Messages of a blocking stream, when only the other stream is non-blocking,
+// are never dropped: pushing one waits for room instead.
+type ringBuffer struct {
+	mu       sync.Mutex
+	ready    *sync.Cond // signalled when a message is pushed or the ring closes
+	room     *sync.Cond // signalled when a message is shifted or the ring closes
+	msgs     []ringEntry
+	head     int // index of the oldest message
+	n        int // number of messages held
+	size     int // bytes of lines held
+	maxBytes int
+	closed   bool
+	dropped  int // messages dropped since the last shift
+}
+
+// ringEntry is a message held in the ring along with its journal index, and
+// whether it is of a blocking stream.
+type ringEntry struct {
+	msg   Message
+	wal   int64
+	block bool
+}
+
+func newRingBuffer(maxBytes int) *ringBuffer {
+	r := &ringBuffer{msgs: make([]ringEntry, 64), maxBytes: maxBytes}
+	r.ready = sync.NewCond(&r.mu)
+	r.room = sync.NewCond(&r.mu)
+	return r
+}
+
+// push copies msg, numbered wal in the journal, into the ring, returning how
+// many messages were dropped to make room for it. Only the oldest messages
+// are dropped, and only while they aren't of a blocking stream: then a
+// message of a blocking stream, block, waits for room, and any other is
+// dropped itself. The daemon reuses msg once Log returns, so the line and
+// partial line metadata are copied.
+func (r *ringBuffer) push(msg *Message, wal int64, block bool) int {
+	line := make([]byte, len(msg.Line))
+	copy(line, msg.Line)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dropped := 0
+	for !r.closed && r.n > 0 && r.size+len(line) > r.maxBytes {
+		switch {
+		case !r.msgs[r.head].block:
+			r.pop()
+			dropped++
+		case block:
+			r.room.Wait()
+		default:
+			r.dropped += dropped + 1
+			return dropped + 1
+		}
+	}
+	r.dropped += dropped
+	if r.closed {
+		return dropped
+	}
+	if r.n == len(r.msgs) {
+		r.grow()
+	}
+	e := &r.msgs[(r.head+r.n)%len(r.msgs)]
+	e.msg, e.wal, e.block = *msg, wal, block
+	e.msg.Line = line
+	if meta := msg.PLogMetaData; meta != nil {
+		m := *meta
+		e.msg.PLogMetaData = &m
+	}
+	r.n++
+	r.size += len(line)
+	r.ready.Signal()
+	return dropped
+}
+
+// shift waits for the oldest message and removes it from the ring,
+// returning its journal index and how many messages were dropped from the
+// ring just before it. It returns false once the ring is closed and empty.
+func (r *ringBuffer) shift(dst *Message) (int64, int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.n == 0 && !r.closed {
+		r.ready.Wait()
+	}
+	if r.n == 0 {
+		return 0, 0, false
+	}
+	e := r.pop()
+	r.room.Broadcast()
+	*dst = e.msg
+	dropped := r.dropped
+	r.dropped = 0
+	return e.wal, dropped, true
+}
+
+// pop removes the oldest message. Callers must hold r.mu.
+func (r *ringBuffer) pop() ringEntry {
+	e := r.msgs[r.head]
+	r.msgs[r.head] = ringEntry{}
+	r.head = (r.head + 1) % len(r.msgs)
+	r.n--
+	r.size -= len(e.msg.Line)
+	return e
+}
+
+// grow doubles the ring's slots. Callers must hold r.mu.
+func (r *ringBuffer) grow() {
+	msgs := make([]ringEntry, 2*len(r.msgs))
+	for i := 0; i < r.n; i++ {
+		msgs[i] = r.msgs[(r.head+i)%len(r.msgs)]
+	}
+	r.msgs, r.head = msgs, 0
+}
+
+// close stops the ring accepting messages. Those already held are still
+// returned by shift.
+func (r *ringBuffer) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.ready.Broadcast()
+	r.room.Broadcast()
+}
+
+// drainRing hands the ring's messages to the logger until the ring is
+// closed and empty.
+func (l *S3Logger) drainRing() {
+	defer close(l.ringDone)
+	var msg Message
+	for {
+		wal, dropped, ok := l.ring.shift(&msg)
+		if !ok {
+			return
+		}
+		l.mu.Lock()
+		l.noteGap(gapBufferFull, int64(dropped), l.lineSeq, l.lineSeq+1)
+		l.process(&msg, wal)
+		l.mu.Unlock()
+		l.budget.enforce()
+	}
+}
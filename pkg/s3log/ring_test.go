@@ -0,0 +1,171 @@
+package s3log
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestRingBuffer(t *testing.T) {
+	type push struct {
+		line  string
+		block bool
+	}
+	tests := []struct {
+		name    string
+		max     int
+		pushes  []push
+		dropped []int
+		want    []string
+	}{
+		{
+			name:    "room for all",
+			max:     100,
+			pushes:  []push{{line: "a"}, {line: "b"}, {line: "c"}},
+			dropped: []int{0, 0, 0},
+			want:    []string{"a", "b", "c"},
+		},
+		{
+			name:    "oldest dropped",
+			max:     8,
+			pushes:  []push{{line: "1111"}, {line: "2222"}, {line: "3333"}, {line: "4444"}},
+			dropped: []int{0, 0, 1, 1},
+			want:    []string{"3333", "4444"},
+		},
+		{
+			name:    "many dropped for a long line",
+			max:     8,
+			pushes:  []push{{line: "11"}, {line: "22"}, {line: "33"}, {line: "4444444"}},
+			dropped: []int{0, 0, 0, 3},
+			want:    []string{"4444444"},
+		},
+		{
+			// The oldest is of a blocking stream, so the new line of the
+			// other is dropped itself.
+			name:    "blocking oldest",
+			max:     8,
+			pushes:  []push{{line: "1111", block: true}, {line: "2222"}, {line: "3333"}},
+			dropped: []int{0, 0, 1},
+			want:    []string{"1111", "2222"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRingBuffer(tt.max)
+			for i, p := range tt.pushes {
+				if n := r.push(&Message{Line: []byte(p.line)}, int64(i+1), p.block); n != tt.dropped[i] {
+					t.Errorf("push of %q dropped %d, want %d", p.line, n, tt.dropped[i])
+				}
+			}
+			r.close()
+			var got []string
+			var msg Message
+			for {
+				_, _, ok := r.shift(&msg)
+				if !ok {
+					break
+				}
+				got = append(got, string(msg.Line))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("shifted %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRingBufferBlockingWaits(t *testing.T) {
+	r := newRingBuffer(8)
+	r.push(&Message{Line: []byte("1111")}, 1, true)
+	r.push(&Message{Line: []byte("2222")}, 2, true)
+	pushed := make(chan int)
+	go func() { pushed <- r.push(&Message{Line: []byte("3333")}, 3, true) }()
+	select {
+	case <-pushed:
+		t.Fatal("line of a blocking stream pushed into a full ring")
+	case <-time.After(50 * time.Millisecond):
+	}
+	var msg Message
+	r.shift(&msg)
+	if n := <-pushed; n != 0 {
+		t.Errorf("blocking push dropped %d lines", n)
+	}
+}
+
+func TestRingBufferCopies(t *testing.T) {
+	// The daemon reuses a message once Log returns.
+	r := newRingBuffer(100)
+	msg := &Message{Line: []byte("first"), PLogMetaData: &PartialLogMetaData{ID: "a"}}
+	r.push(msg, 1, false)
+	copy(msg.Line, "XXXXX")
+	msg.PLogMetaData.ID = "b"
+	var got Message
+	r.shift(&got)
+	if string(got.Line) != "first" || got.PLogMetaData.ID != "a" {
+		t.Errorf("shifted %q of %q, want the line as pushed", got.Line, got.PLogMetaData.ID)
+	}
+}
+
+func TestRingBufferAllocs(t *testing.T) {
+	r := newRingBuffer(1 << 30)
+	msg := &Message{Line: make([]byte, 1024), Source: "stdout"}
+	// Grow the ring first.
+	for i := range 200 {
+		r.push(msg, int64(i), false)
+	}
+	var dst Message
+	allocs := testing.AllocsPerRun(1000, func() {
+		r.push(msg, 0, false)
+		r.shift(&dst)
+	})
+	if allocs > 1 {
+		t.Errorf("%v allocations per message, want only the line copy", allocs)
+	}
+}
+
+func TestDroppedReported(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	fake := newFakeS3()
+	release := stallPuts(fake, "")
+	defer release()
+	l := newTestLogger(t, fake, map[string]string{
+		modeKey:          modeNonBlocking,
+		stderrModeKey:    modeNonBlocking,
+		maxBufferSizeKey: "1024",
+		flushBytesKey:    "512",
+		flushIntervalKey: "1h",
+	})
+	line := strings.Repeat("x", 200)
+	for range 50 {
+		l.Log(&Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()})
+	}
+	release()
+	l.Close()
+
+	var reported bool
+	for _, e := range hook.AllEntries() {
+		if d, ok := e.Data["dropped"]; ok && e.Level == logrus.WarnLevel {
+			reported = d.(int64) == l.dropped.Load()
+		}
+	}
+	if l.dropped.Load() == 0 || !reported {
+		t.Errorf("dropped %d lines, reported: %v", l.dropped.Load(), reported)
+	}
+}
+
+func BenchmarkLogNonBlocking(b *testing.B) {
+	fake := newFakeS3()
+	l := newTestLogger(b, fake, map[string]string{modeKey: modeNonBlocking, stderrModeKey: modeNonBlocking})
+	msg := &Message{Line: []byte(strings.Repeat("x", 1024)), Source: "stdout", Timestamp: time.Now()}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg.Line)))
+	b.ResetTimer()
+	for range b.N {
+		l.Log(msg)
+	}
+}
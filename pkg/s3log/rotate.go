@@ -0,0 +1,156 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	maxObjectSizeKey = "max-object-size"
+
+	defaultMaxObjectSize = 64 << 20
+
+	sequenceFormat     = "%06d"
+	lineSequenceFormat = "%012d"
+
+	// keySequenceSentinel stands in for the sequence number when rendering
+	// the key template to find where it appears in a key.
+	keySequenceSentinel = "\x01"
+)
+
+// splitObjects splits data into objects of at most size bytes, breaking only
+// between lines. A single line longer than size gets an object of its own.
+func splitObjects(data []byte, size int) [][]byte {
+	var objects [][]byte
+	for len(data) > size {
+		i := bytes.LastIndexByte(data[:size], '\n')
+		if i < 0 {
+			if i = bytes.IndexByte(data[size:], '\n'); i < 0 {
+				break
+			}
+			i += size
+		}
+		objects = append(objects, data[:i+1])
+		data = data[i+1:]
+	}
+	if len(data) > 0 {
+		objects = append(objects, data)
+	}
+	return objects
+}
+
+// nextSequence returns the sequence number of the next object. Without
+// persisted state the first call resumes numbering from where a previous
+// run of the container or the plugin left off. Callers must hold l.flushMu.
+func (l *S3Logger) nextSequence(ctx context.Context) int64 {
+	if !l.stateRead {
+		l.stateRead = true
+		l.resumeSequence(ctx)
+	}
+	l.state.Sequence++
+	l.rememberSequence()
+	return l.state.Sequence
+}
+
+// lastSequence returns the highest sequence number among the container's
+// objects, or those of any run of its stable key, or 0 if there are none or
+// the key template doesn't number them. Partitions and runs are searched
+// newest first, stopping at the first that holds a numbered object. Where
+// the key template sorts a partition's keys oldest first, only its newest
+// keys are listed.
+func (l *S3Logger) lastSequence(ctx context.Context) (int64, error) {
+	pattern := l.keyPattern(func(d *keyData) { d.Sequence = keySequenceSentinel })
+	if pattern == nil {
+		return 0, nil
+	}
+	prefixes, err := l.listPrefixes(ctx, time.Time{}, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	// Numbering carries on from the earlier runs of a stable key.
+	if prefixes, err = l.runPrefixes(ctx, prefixes); err != nil {
+		return 0, err
+	}
+	for i := len(prefixes) - 1; i >= 0; i-- {
+		base := l.prefixBase(prefixes[i])
+		if p := l.newSequenceProbe(base, pattern); p != nil && strings.HasPrefix(p.prefix, prefixes[i]) {
+			last, err := p.last(ctx, l)
+			if err == nil && last > 0 {
+				return last, nil
+			}
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, errUnsorted) {
+				return 0, err
+			}
+		}
+		var last int64
+		pages := s3.NewListObjectsV2Paginator(l.s3Client, &s3.ListObjectsV2Input{
+			Bucket:       aws.String(l.bucket),
+			Prefix:       aws.String(prefixes[i]),
+			RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+		})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return last, err
+			}
+			for _, o := range page.Contents {
+				m := pattern.FindStringSubmatch(strings.TrimPrefix(aws.ToString(o.Key), base))
+				if m == nil {
+					continue
+				}
+				if seq, err := strconv.ParseInt(m[1], 10, 64); err == nil && seq > last {
+					last = seq
+				}
+			}
+		}
+		if last > 0 {
+			return last, nil
+		}
+	}
+	return 0, nil
+}
+
+// keyPattern returns a pattern matching the rendered key template of the
+// container's objects, capturing the number that capture puts the
+// keySequenceSentinel in place of, or nil if the template doesn't include it.
+func (l *S3Logger) keyPattern(capture func(*keyData)) *regexp.Regexp {
+	data := l.keyData
+	data.Timestamp = keyPrefixSentinel
+	data.Sequence = keyPrefixSentinel
+	data.FirstSeq = keyPrefixSentinel
+	data.TimeSlice = keyPrefixSentinel
+	data.Index = keyPrefixSentinel
+	if l.run != "" {
+		// Match the objects of every run.
+		data.ContainerID = l.stableID + "/" + runPrefix + keyPrefixSentinel
+	}
+	capture(&data)
+	var buf bytes.Buffer
+	if err := l.keyTmpl.Execute(&buf, data); err != nil {
+		return nil
+	}
+	rendered := strings.TrimPrefix(buf.String(), "/")
+	if strings.Count(rendered, keySequenceSentinel) != 1 {
+		return nil
+	}
+	// Match keys with and without a unique suffix, whatever the current
+	// key-unique-suffix, so that numbering survives changing it.
+	rendered = withUniqueSuffix(rendered, keyUniqueSentinel)
+	expr := regexp.QuoteMeta(rendered)
+	expr = strings.ReplaceAll(expr, keyPrefixSentinel, ".+?")
+	expr = strings.Replace(expr, keySequenceSentinel, `(\d+)`, 1)
+	expr = strings.Replace(expr, "-"+keyUniqueSentinel, `(?:-[0-9A-Z]+)?`, 1)
+	return regexp.MustCompile("^" + expr)
+}
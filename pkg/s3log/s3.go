@@ -0,0 +1,1241 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+const (
+	driverName = "s3logdriver"
+)
+
+func init() {
+	requirePermissions(
+		permission{"s3:PutObject", onObjects, "uploads", always},
+		permission{"s3:AbortMultipartUpload", onObjects, "uploads over " + partSizeKey, func(s permissionScope) bool { return s.opts.uploadsParts() }},
+		permission{"s3:PutObjectAcl", onObjects, aclKey, func(s permissionScope) bool { return s.opts.ACL != "" }},
+		permission{"kms:GenerateDataKey", onKMSKey, sseKMSKeyIDKey, func(s permissionScope) bool { return s.opts.SSEKMSKeyID != "" }},
+		permission{"kms:Decrypt", onKMSKey, "uploads over " + partSizeKey + " with " + sseKMSKeyIDKey, func(s permissionScope) bool {
+			return s.opts.SSEKMSKeyID != "" && s.opts.uploadsParts()
+		}},
+	)
+}
+
+// S3Logger is the logger struct that implements the Docker logger interface.
+//
+// Log appends lines to an in-memory buffer which a background goroutine
+// uploads as one object whenever flush-bytes, or the size adaptive-flush
+// picks, have accumulated or every flush-interval. While a batch is being uploaded Log keeps buffering up to
+// max-buffer-size, at which point it either blocks or drops the oldest lines
+// depending on the mode.
+type S3Logger struct {
+	s3Client s3API
+	clients  *clientFactory
+	targets  []*target // s3-bucket followed by its replicas
+	failover *failover // nil without failover-bucket
+	pool     *uploadPool
+	budget   *memoryBudget
+	bucket   string
+	info     Info
+	opts     LogOption
+	keyTmpl  *template.Template
+	keyData  keyData
+	format   lineFormat
+	spool    *spool
+	cache    *logCache // recent lines docker logs is read from, if any
+	tagging  string
+	metadata map[string]string
+	metrics  *containerMetrics
+	ssec     *sseCKey // from sse-c-key-file, if set
+
+	partitionLoc *time.Location
+	sliceLayout  string // of time-slice-format
+	sliceKeys    bool   // whether keys start with their time slice
+	stableID     string // of stable-key-source, if set
+	run          string // key component of the container's run of stableID
+	multiline    *regexp.Regexp
+	filter       lineFilter
+	redactor     *redactor
+	sampler      *sampler
+	cloudwatch   *cloudWatchMirror
+	dead         *deadLetters // with dead-letter, guarded by mu
+	retention    *retention   // of retention-days, if set
+	tracer       *containerTracer
+
+	mu        sync.Mutex
+	space     *sync.Cond // signalled when the flusher empties buf
+	buf       bytes.Buffer
+	bufPart   string        // partition of the lines in buf
+	bufTime   time.Time     // when the first line in buf was logged
+	bufLast   time.Time     // when the last line in buf was logged
+	bufSeq    int64         // sequence number of the first line in buf
+	partMark  time.Time     // latest time a partition was picked by
+	lineSeq   int64         // sequence number of the last line logged
+	sealed    []sealedBatch // full partitions waiting for the flusher
+	scratch   []byte        // reused to encode each line
+	followers map[*follower]struct{}
+	partials  map[string]*partialLine
+	groups    map[string]*lineGroup
+	closed    bool
+	skewed    bool // whether a line has been restamped, which is logged once
+	dropped   atomic.Int64
+	charged   int64 // bytes charged to budget
+
+	// exit is how the container stopped, with exit-event, which Close
+	// writes as its last record.
+	exit *containerExit
+
+	// gaps are the runs of dropped lines noted since the last flush, which
+	// drops outside l.mu note as well.
+	gapMu sync.Mutex
+	gaps  []logGap
+
+	// sizer picks the flush size of an adaptive-flush logger, and
+	// flushTarget is its latest pick, or flush-bytes, for the stats dump.
+	sizer       *flushSizer
+	flushTarget atomic.Int64
+
+	// wal journals each message as it arrives; walSeen is the journal index
+	// of the last message processed.
+	wal     *journal
+	walSeen int64
+
+	// ring takes the messages of a non-blocking logger, which ringDone
+	// drains into the buffer.
+	ring     *ringBuffer
+	ringDone chan struct{}
+
+	// inflight is the batch currently being uploaded, taken out of buf at
+	// inflightTime. It is kept so follow mode can replay it.
+	inflight     []byte
+	inflightTime time.Time
+
+	// flushMu serializes flushes so batches are uploaded in order and
+	// numbered without gaps or repeats.
+	flushMu   sync.Mutex
+	state     loggerState
+	stateRead bool
+	stream    *multipartStream
+	seqKey    string   // of the container's objects in resumedSequences
+	slice     keySlice // of the last object uploaded
+	kick      chan struct{}
+	retime    chan struct{} // the flush interval was changed
+	puts      *rate.Limiter // max-puts-per-second-per-container
+
+	// attemptFailed is set by a failed upload attempt during a flush. The
+	// HTTP client may still be reading a body it has given up on, so the
+	// flush's buffers aren't reused.
+	attemptFailed atomic.Bool
+
+	// lastFlush and lastError are kept for the stats dump, which mustn't wait
+	// on flushMu.
+	lastFlush atomic.Int64 // unix nanoseconds
+	lastError atomic.Pointer[string]
+
+	// flushedAt is when the logger last flushed, as the time since it
+	// started on the monotonic clock, which the flush timers go by. Until
+	// the first flush it is the negated flushJitter.
+	flushedAt atomic.Int64
+
+	// started, and the totals counted by flushes under flushMu, are kept
+	// for the run summary.
+	started     time.Time
+	rawBytes    int64
+	storedBytes int64
+	partitions  map[string]bool
+
+	// ctx is cancelled once Close gives up on flushing, aborting any upload
+	// still in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	// routines are the logger's goroutines, which Close waits for.
+	routines *routines
+
+	// hashes are those of the batches or records uploaded within
+	// dedupe-window, shared with the other loggers of its group.
+	hashes *dedupeWindow
+}
+
+// resolveLogger returns the logger of a container with opts and info as
+// far as the log-opts decide it, checking them as the container's start
+// does: its key template, tag, format, tags and metadata rendered, filters
+// compiled and SSE-C key read. It has no clients or goroutines yet, and
+// nothing is sent to AWS.
+func resolveLogger(opts LogOption, info Info) (*S3Logger, error) {
+	keyTemplate := opts.KeyTemplate
+	var group string
+	if len(opts.GroupByLabel) > 0 {
+		group = containerGroup(opts.GroupByLabel, info)
+		keyTemplate = groupKeyTemplate(keyTemplate)
+	}
+	tmpl, err := parseKeyTemplate(keyTemplate)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := parseTag(info)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := parseAttrs(info)
+	if err != nil {
+		return nil, err
+	}
+	if group != "" {
+		if attrs == nil {
+			attrs = map[string]string{}
+		}
+		attrs[groupAttr] = group
+	}
+	format, err := newLineFormat(opts, info.ContainerID, tag, attrs)
+	if err != nil {
+		return nil, err
+	}
+	kd := newKeyData(info, tag)
+	kd.Group = group
+	// Keys name a stable key's run in place of the container ID, which
+	// records, tags and metadata keep.
+	keyData := kd
+	var stable, run string
+	if opts.StableKeySource != "" {
+		var ok bool
+		if stable, ok = stableKey(opts.StableKeySource, info); opts.stableKey != "" {
+			stable, ok = opts.stableKey, true
+		}
+		if !ok {
+			logrus.WithField("id", info.ContainerID).Warnf("container has no %s %s, keying its objects by its name", stableKeySourceKey, opts.StableKeySource)
+		}
+		run = runName(info.ContainerCreated)
+		keyData.ContainerID = stable + "/" + run
+	}
+	tags, err := renderPairs(objectTagsKey, opts.ObjectTags, kd)
+	if err != nil {
+		return nil, err
+	}
+	tagging, err := encodeTagging(tags)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := renderPairs(objectMetadataKey, opts.ObjectMetadata, kd)
+	if err != nil {
+		return nil, err
+	}
+	// The key is read once; a new one takes effect when the logger is
+	// started again.
+	ssec, err := loadSSECKey(opts.SSECKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(opts.PartitionTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", partitionTimezoneKey, opts.PartitionTimezone, err)
+	}
+	// Validated by parseLogOpts.
+	sliceFormat, _ := sliceLayout(opts.TimeSliceFormat)
+	var multiline *regexp.Regexp
+	if opts.MultilinePattern != "" {
+		// Validated by parseLogOpts.
+		multiline = regexp.MustCompile(opts.MultilinePattern)
+	}
+	filter, err := newLineFilter(opts.FilterInclude, opts.FilterExclude)
+	if err != nil {
+		return nil, fmt.Errorf("invalid line filter: %v", err)
+	}
+	l := &S3Logger{
+		bucket:   opts.S3Bucket,
+		info:     info,
+		opts:     opts,
+		keyTmpl:  tmpl,
+		keyData:  keyData,
+		stableID: stable,
+		run:      run,
+		format:   format,
+		tagging:  tagging,
+		metadata: metadata,
+		ssec:     ssec,
+
+		partitionLoc: loc,
+		sliceLayout:  sliceFormat,
+		multiline:    multiline,
+		filter:       filter,
+		redactor:     newRedactor(opts.RedactPatterns, opts.RedactReplacement),
+		sampler:      newSampler(opts.SampleRate, opts.SamplePattern),
+		retention:    newRetention(opts),
+	}
+	l.sliceKeys = l.keysStartWithSlice()
+	return l, nil
+}
+
+func newS3Logger(clients *clientFactory, pool *uploadPool, budget *memoryBudget, opts LogOption, info Info, sp *spool, cache *logCache) (*S3Logger, error) {
+	l, err := resolveLogger(opts, info)
+	if err != nil {
+		return nil, err
+	}
+	metrics := newContainerMetrics(info.ContainerID)
+	primary, err := newTarget(clients, opts, opts.S3Bucket, opts.S3Region, metrics)
+	if err != nil {
+		metrics.unregister()
+		return nil, err
+	}
+	opts.S3Region = primary.cfg.Region
+	targets := []*target{primary}
+	for _, r := range opts.Replicas {
+		t, err := newTarget(clients, opts, r.Bucket, r.Region, metrics)
+		if err != nil {
+			metrics.unregister()
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	var fo *failover
+	if opts.FailoverBucket != "" {
+		t, err := newTarget(clients, opts, opts.FailoverBucket, opts.FailoverRegion, metrics)
+		if err != nil {
+			metrics.unregister()
+			return nil, err
+		}
+		fo = &failover{target: t, after: opts.FailoverAfter}
+	}
+	ctx, cancel := context.WithCancel(withTenant(context.Background(), opts.Tenant))
+	l.opts = opts
+	l.s3Client = primary.client
+	l.clients = clients
+	l.targets = targets
+	l.failover = fo
+	l.pool = pool
+	l.budget = budget
+	l.spool = sp
+	l.metrics = metrics
+	l.tracer = newTracer(&info)
+	l.partials = make(map[string]*partialLine)
+	l.groups = make(map[string]*lineGroup)
+	l.kick = make(chan struct{}, 1)
+	l.retime = make(chan struct{}, 1)
+	l.puts = newPutLimiter(opts.MaxPutsPerContainer)
+	l.ctx, l.cancel = ctx, cancel
+	l.done = make(chan struct{})
+	l.started = time.Now()
+	if opts.AdaptiveFlush {
+		l.sizer = newFlushSizer(opts.AdaptiveFlushMin, opts.AdaptiveFlushMax, opts.FlushInterval)
+	}
+	l.flushTarget.Store(int64(l.flushBytes()))
+	validated := targets
+	if fo != nil {
+		validated = append(slices.Clip(targets), fo.target)
+	}
+	for _, t := range validated {
+		if err := l.validate(ctx, clients, t); err != nil {
+			cancel()
+			l.metrics.unregister()
+			return nil, err
+		}
+	}
+	l.routines = newRoutines(info.ContainerID)
+	st, ok, err := l.loadState()
+	if err != nil {
+		l.log().WithError(err).Warn("error loading logger state")
+	}
+	if ok {
+		l.state, l.stateRead = st, true
+		l.lineSeq = st.LineSequence
+		l.startRecovery()
+	}
+	// CloudWatch names the container, not a stable key's run.
+	kd := l.keyData
+	kd.ContainerID = info.ContainerID
+	if l.cloudwatch, err = newCloudWatchMirrorFor(clients, opts, primary.cfg, kd, l.routines, l.log()); err != nil {
+		cancel()
+		l.routines.wait(goroutineStopTimeout)
+		l.metrics.unregister()
+		return nil, err
+	}
+	l.space = sync.NewCond(&l.mu)
+	// A Log waiting for space gives up once the logger is abandoned.
+	context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		l.space.Broadcast()
+		l.mu.Unlock()
+	})
+	budget.register(l)
+	if opts.WAL {
+		if l.wal, err = openJournal(l.walDir(), opts.WALSyncInterval, opts.WALSegmentBytes, l.routines, l.log()); err != nil {
+			budget.unregister(l)
+			cancel()
+			l.routines.wait(goroutineStopTimeout)
+			l.metrics.unregister()
+			return nil, err
+		}
+		if opts.WALRetention > 0 {
+			l.wal.retain(opts.WALRetention, l.journalInfo(info))
+		}
+	}
+	l.hashes = l.acquireDedupe(st.Dedupe)
+	l.spool.register(l)
+	if l.nonBlocking() {
+		l.ring = newRingBuffer(opts.MaxBufferSize)
+		l.ringDone = make(chan struct{})
+		l.routines.start("ring", l.drainRing)
+	}
+	l.wg.Add(1)
+	l.routines.start("flush", l.flushLoop)
+	if opts.DeadLetter {
+		l.dead = &deadLetters{}
+		l.wg.Add(1)
+		l.routines.start("dead-letter", l.deadLetterLoop)
+	}
+	if opts.HeartbeatInterval > 0 {
+		l.wg.Add(1)
+		l.routines.start("heartbeat", l.heartbeatLoop)
+	}
+	if l.wal != nil {
+		if err := l.replayJournal(); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	// Lines replayed from the journal were cached before the plugin stopped.
+	l.mu.Lock()
+	l.cache = cache
+	l.mu.Unlock()
+	return l, nil
+}
+
+// Log appends the message to the in-memory buffer and wakes the flusher once
+// the buffer grows past the flush size. In non-blocking mode the
+// message is only copied into the ring, from which a goroutine appends it,
+// so that Log returns at once whatever the flusher is doing. When only one
+// stream is non-blocking, the other's messages go through the ring too, to
+// stay in order, but wait for room in it.
+func (l *S3Logger) Log(msg *Message) error {
+	var wal int64
+	if l.wal != nil {
+		wal = l.wal.append(msg)
+	}
+	if l.ring != nil {
+		if n := l.ring.push(msg, wal, l.blocks(msg.Source)); n > 0 {
+			l.dropped.Add(int64(n))
+			l.metrics.dropped.Add(float64(n))
+		}
+		return nil
+	}
+	l.mu.Lock()
+	l.process(msg, wal)
+	l.mu.Unlock()
+	l.budget.enforce()
+	return nil
+}
+
+// process appends a message, numbered wal in the journal, to the buffer.
+// Parts of a partial line are held back until the whole line has arrived,
+// lines that don't pass the filters are dropped, and lines of a multiline
+// record are held back until the record is complete. Callers must hold l.mu.
+func (l *S3Logger) process(msg *Message, wal int64) {
+	if msg, first := l.assemble(msg, wal); msg != nil {
+		l.handle(msg, first)
+	}
+	l.walSeen = wal
+	l.charge()
+}
+
+// handle truncates, filters and groups a complete line on its way to the
+// buffer. wal is the journal index of the line's first message. Callers must
+// hold l.mu.
+func (l *S3Logger) handle(msg *Message, wal int64) {
+	msg = l.restamp(msg)
+	msg, ok := l.clean(msg)
+	if !ok {
+		return
+	}
+	original := msg
+	if n := l.opts.MaxLineBytes; n > 0 && len(msg.Line) > n {
+		truncated := *msg
+		truncated.Line = append(msg.Line[:n:n], lineTruncatedMarker...)
+		msg = &truncated
+	}
+	if l.keep(msg) {
+		if msg != original {
+			l.deadLetter(original, reasonTruncated, len(original.Line))
+		}
+		l.group(msg, wal)
+	}
+}
+
+// append adds a complete line to the buffer, unless it is sampled away, and
+// redacted if redact-patterns is set. Callers must hold l.mu.
+func (l *S3Logger) append(msg *Message) {
+	if !l.sample(msg) {
+		return
+	}
+	if l.opts.Format == formatJSONL && !utf8.Valid(msg.Line) {
+		l.deadLetter(msg, reasonInvalidUTF8, len(msg.Line))
+	}
+	if l.redactor != nil {
+		if line, ok := l.redactor.redact(msg.Line); ok {
+			redacted := *msg
+			redacted.Line = line
+			msg = &redacted
+		}
+	}
+	if l.cloudwatch != nil && !l.closed {
+		l.cloudwatch.send(msg)
+	}
+	seq := l.lineSeq + 1
+	var records int64
+	l.scratch, records = l.encodeRecord(l.scratch[:0], msg, seq)
+	n := len(l.scratch)
+	if !l.blocks(msg.Source) {
+		full := l.buf.Len() > 0 && l.buf.Len()+n > l.opts.MaxBufferSize
+		if full && l.opts.StdoutMode != l.opts.StderrMode {
+			// The oldest lines may be of the blocking stream, so the
+			// line itself is dropped instead.
+			l.noteGap(gapBufferFull, 1, l.lineSeq, l.lineSeq+1)
+			l.dropped.Add(1)
+			l.metrics.dropped.Inc()
+			l.wake()
+			return
+		}
+		for l.buf.Len() > 0 && l.buf.Len()+n > l.opts.MaxBufferSize {
+			l.dropOldest()
+		}
+	} else {
+		for l.buf.Len() > 0 && l.buf.Len()+n > l.opts.MaxBufferSize && !l.closed && l.ctx.Err() == nil {
+			l.wake()
+			l.space.Wait()
+		}
+		// Another line may have been encoded while waiting.
+		seq = l.lineSeq + 1
+		l.scratch, records = l.encodeRecord(l.scratch[:0], msg, seq)
+	}
+
+	// Batches never straddle a partition, so a line in a new one seals the
+	// buffer for the flusher and starts another.
+	part := l.partition(l.partitionTime(msg.Timestamp))
+	if l.buf.Len() > 0 && part != l.bufPart {
+		l.sealed = append(l.sealed, sealedBatch{data: sealBuffer(l.buf.Bytes()), partition: l.bufPart, firstSeq: l.bufSeq, time: l.bufTime, last: l.bufLast})
+		l.buf.Reset()
+		l.wake()
+	}
+	if l.buf.Len() == 0 {
+		l.bufSeq = seq
+		l.bufTime = msg.Timestamp
+	}
+	l.bufLast = msg.Timestamp
+	l.lineSeq = seq + records - 1
+	l.bufPart = part
+	l.buf.Write(l.scratch)
+	l.metrics.received.Inc()
+	l.metrics.buffered.Set(float64(l.bufferedLen()))
+	l.publish(msg)
+	l.cache.log(msg)
+	if l.sizer != nil {
+		l.sizer.add(n, time.Now())
+		l.flushTarget.Store(int64(l.sizer.target()))
+	}
+	if l.buf.Len() >= l.flushBytes() {
+		l.wake()
+	}
+}
+
+// blocks reports whether lines of source wait for space in a full buffer
+// rather than being dropped: stderr's with stderr-mode, any other's with
+// stdout-mode.
+func (l *S3Logger) blocks(source string) bool {
+	if source == "stderr" {
+		return l.opts.StderrMode == modeBlocking
+	}
+	return l.opts.StdoutMode == modeBlocking
+}
+
+// nonBlocking reports whether either stream drops lines when the buffer is
+// full.
+func (l *S3Logger) nonBlocking() bool {
+	return !l.blocks("stdout") || !l.blocks("stderr")
+}
+
+// dropOldest discards the oldest buffered line. Callers must hold l.mu.
+func (l *S3Logger) dropOldest() {
+	i := bytes.IndexByte(l.buf.Bytes(), '\n')
+	if i < 0 {
+		l.buf.Reset()
+	} else {
+		l.buf.Next(i + 1)
+	}
+	l.noteGap(gapBufferFull, 1, l.bufSeq-1, l.bufSeq+1)
+	l.bufSeq++
+	l.dropped.Add(1)
+	l.metrics.dropped.Inc()
+}
+
+// bufferedLen returns how many bytes are waiting for the flusher. Callers
+// must hold l.mu.
+func (l *S3Logger) bufferedLen() int {
+	n := l.buf.Len()
+	for _, b := range l.sealed {
+		n += len(b.data)
+	}
+	return n
+}
+
+// wake asks the flusher to upload the buffer without waiting for the next
+// flush-interval.
+func (l *S3Logger) wake() {
+	select {
+	case l.kick <- struct{}{}:
+	default:
+	}
+}
+
+// flushLoop uploads whatever has been buffered when woken by Log, and once
+// the logger has gone flush-interval without a flush, so that a quiet
+// container's lines don't sit in memory until the byte threshold is reached.
+// The idle timer starts again after every flush, whatever triggered it, so a
+// busy container isn't flushed on the interval as well as by size. The
+// first idle flush comes at a random point of the interval instead, and a
+// flush triggered right after another is coalesced with what follows it.
+// Once startup-grace is over, a buffer over the normal threshold is flushed
+// at once.
+func (l *S3Logger) flushLoop() {
+	defer l.wg.Done()
+	jitter := flushJitter(l.flushInterval())
+	l.flushedAt.CompareAndSwap(0, -int64(jitter))
+	t := time.NewTimer(l.flushInterval() - jitter)
+	defer t.Stop()
+	var graceEnd <-chan time.Time
+	if l.inStartupGrace() {
+		g := time.NewTimer(time.Until(l.started.Add(l.opts.StartupGrace)))
+		defer g.Stop()
+		graceEnd = g.C
+	}
+	var reported int64
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-l.kick:
+			if !t.Stop() {
+				<-t.C
+			}
+		case <-graceEnd:
+			graceEnd = nil
+			if !l.overFlushBytes() {
+				continue
+			}
+			if !t.Stop() {
+				<-t.C
+			}
+		case <-l.retime:
+			if !t.Stop() {
+				<-t.C
+			}
+			t.Reset(max(l.flushInterval()-l.sinceFlush(), 0))
+			continue
+		case <-t.C:
+			// Close, or the replay of the journal, may have flushed since
+			// the timer was set.
+			if idle := l.sinceFlush(); idle < l.flushInterval() {
+				t.Reset(l.flushInterval() - idle)
+				continue
+			}
+		}
+		if !l.coalesce() || !l.throttle() {
+			return
+		}
+		ctx := l.ctx
+		if l.inStartupGrace() {
+			ctx = withLowPriority(ctx)
+		}
+		if err := l.flush(ctx); err != nil {
+			l.log().WithError(err).Error("error flushing logs")
+		}
+		t.Reset(l.flushInterval())
+		if dropped := l.dropped.Load(); dropped > reported {
+			l.log().WithField("dropped", dropped).Warnf("buffer full, dropped %d lines", dropped-reported)
+			reported = dropped
+		}
+	}
+}
+
+// log returns a log entry carrying the container and bucket as fields.
+func (l *S3Logger) log() *logrus.Entry {
+	return logrus.WithField("id", l.info.ContainerID).WithField("bucket", l.bucket)
+}
+
+// Name returns the name of the logger.
+func (l *S3Logger) Name() string {
+	return driverName
+}
+
+// abandon gives up on the flush in progress and any still to come, and wakes
+// a Log waiting for space, so that a logger whose buckets can't be reached is
+// stopped without waiting out its retries. Batches are spooled or dropped as
+// when the retries are exhausted.
+func (l *S3Logger) abandon() {
+	l.cancel()
+}
+
+// Close stops the periodic flush, ends any follow streams and uploads
+// whatever is left in the buffer. If S3 can't be reached within the
+// shutdown-flush-timeout the buffered lines are dropped.
+func (l *S3Logger) Close() error {
+	defer l.cancel()
+	ctx, cancel := context.WithTimeout(l.ctx, l.opts.ShutdownFlushTimeout)
+	defer cancel()
+	// Make sure a flush that is stuck on S3 can't hold up Close past the
+	// deadline.
+	stop := context.AfterFunc(ctx, l.cancel)
+	defer stop()
+
+	if l.ring != nil {
+		l.ring.close()
+		<-l.ringDone
+	}
+	l.mu.Lock()
+	l.flushPartials()
+	l.flushGroups()
+	l.markExit()
+	l.closed = true
+	l.closeFollowers()
+	l.space.Broadcast()
+	l.mu.Unlock()
+
+	close(l.done)
+	l.wg.Wait()
+
+	err := l.flush(ctx)
+	if serr := l.closeStream(ctx); serr != nil && err == nil {
+		err = serr
+	}
+	l.flushDeadLetters(ctx)
+	if l.wal != nil {
+		l.wal.close()
+	}
+	l.budget.unregister(l)
+	l.spool.unregister(l)
+	l.mu.Lock()
+	l.budget.add(-l.charged)
+	l.charged = 0
+	l.mu.Unlock()
+	if l.cloudwatch != nil {
+		l.cloudwatch.close()
+	}
+	if dropped := l.dropped.Load(); dropped > 0 {
+		l.log().WithField("dropped", dropped).Warn("lines were dropped because the buffer was full")
+	}
+	l.metrics.unregister()
+	l.hashes.release()
+	l.tracer.shutdown()
+	l.routines.wait(goroutineStopTimeout)
+	return err
+}
+
+// flush takes the buffer and uploads it as new objects named by the key
+// template, each at most max-object-size, retrying failed uploads. Once the
+// retries are exhausted a batch is handed to the spool, or dropped if there is
+// none. Journal segments whose lines were all taken are deleted once every
+// batch has been uploaded or spooled.
+func (l *S3Logger) flush(ctx context.Context) error {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+
+	l.mu.Lock()
+	l.markGaps()
+	batches := l.sealed
+	if l.buf.Len() > 0 {
+		batches = append(batches, sealedBatch{data: sealBuffer(l.buf.Bytes()), partition: l.bufPart, firstSeq: l.bufSeq, time: l.bufTime, last: l.bufLast})
+	}
+	// Over the host's budget, batches go straight to the spool so that the
+	// memory is freed without waiting on S3.
+	divert := l.spool != nil && l.budget.over()
+	var journaled int64
+	if l.wal != nil {
+		journaled = l.journaled()
+		l.wal.rotate()
+	}
+	lineSeq := l.lineSeq
+	if len(batches) == 0 {
+		l.mu.Unlock()
+		if l.streaming() {
+			if err := l.idleStream(ctx, time.Now()); err != nil {
+				return err
+			}
+		}
+		if l.wal != nil && !l.streamPending() {
+			l.wal.release(journaled, lineSeq)
+		}
+		return nil
+	}
+	now := time.Now()
+	l.sealed = nil
+	l.buf.Reset()
+	l.metrics.buffered.Set(0)
+	l.charge()
+	// A single batch, as most flushes are, is replayed from its own buffer
+	// rather than copied.
+	l.inflight, l.inflightTime = batches[0].data, now
+	if len(batches) > 1 {
+		l.inflight = nil
+		for _, b := range batches {
+			l.inflight = append(l.inflight, b.data...)
+		}
+	}
+	l.space.Broadcast()
+	l.mu.Unlock()
+
+	l.attemptFailed.Store(false)
+	defer func() {
+		l.mu.Lock()
+		l.inflight = nil
+		l.mu.Unlock()
+		if !l.attemptFailed.Load() {
+			releaseBatches(batches)
+		}
+	}()
+
+	ctx, span := l.tracer.Start(ctx, "flush")
+	var err error
+	var flushed int
+	var lines int64
+	i := 0
+	for _, b := range batches {
+		if l.streaming() {
+			if serr := l.streamBatch(ctx, b); serr != nil && err == nil {
+				err = serr
+			}
+			l.state.BytesWritten += int64(len(b.data))
+			flushed += len(b.data)
+			lines += int64(bytes.Count(b.data, []byte{'\n'}))
+			continue
+		}
+		seq := b.firstSeq
+		for _, body := range splitObjects(b.data, l.opts.MaxObjectSize) {
+			// Offset the timestamps so the objects of one flush never share
+			// a key, even with a template that leaves out the sequence
+			// number.
+			var stamp time.Time
+			if l.opts.backfill {
+				stamp = b.last.Add(time.Duration(i))
+			} else {
+				stamp = l.keyStamp(now.Add(time.Duration(i)))
+			}
+			if uerr := l.upload(ctx, body, b, seq, stamp, divert); uerr != nil && err == nil {
+				err = uerr
+			}
+			l.state.BytesWritten += int64(len(body))
+			seq += int64(bytes.Count(body, []byte{'\n'}))
+			flushed += len(body)
+			i++
+		}
+		lines += seq - b.firstSeq
+	}
+	if span.IsRecording() {
+		span.SetAttributes(
+			attribute.Int("s3logdriver.bytes", flushed),
+			attribute.Int64("s3logdriver.lines", lines),
+			attribute.Int("s3logdriver.objects", i))
+	}
+	if merr := l.writeManifests(ctx, false); merr != nil {
+		describeAWSError(merr).fields(l.log()).WithError(merr).Warn("error updating manifest")
+	}
+	l.state.LineSequence = lineSeq
+	if serr := l.saveState(); serr != nil {
+		l.log().WithError(serr).Warn("error saving logger state")
+	}
+	if err == nil && l.wal != nil && !l.streamPending() {
+		l.wal.release(journaled, lineSeq)
+	}
+	l.lastFlush.Store(now.UnixNano())
+	l.markFlushed(now)
+	if err != nil {
+		msg := err.Error()
+		l.lastError.Store(&msg)
+	}
+	endSpan(span, err)
+	return err
+}
+
+// batchBuffers holds the buffers that batches are sealed into, so that a
+// flush reuses the memory of the last one instead of allocating its own.
+var batchBuffers sync.Pool
+
+// sealBuffer returns a copy of data, the lines of a batch being sealed, in a
+// buffer from batchBuffers.
+func sealBuffer(data []byte) []byte {
+	if p, ok := batchBuffers.Get().(*[]byte); ok {
+		return append((*p)[:0], data...)
+	}
+	return bytes.Clone(data)
+}
+
+// releaseBatches returns the buffers of batches to batchBuffers once nothing
+// refers to them.
+func releaseBatches(batches []sealedBatch) {
+	for _, b := range batches {
+		data := b.data[:0]
+		batchBuffers.Put(&data)
+	}
+}
+
+// sealedBatch is a run of buffered lines from a single partition.
+type sealedBatch struct {
+	data      []byte
+	partition string
+	firstSeq  int64
+	time      time.Time // when its first line was logged
+	last      time.Time // when its last line was logged
+}
+
+// upload uploads body, part of sb whose first line is numbered firstSeq, as
+// a single object stamped with t in sb's partition, to s3-bucket and each of
+// its replicas at once. Each bucket is retried and spooled on its own, so
+// one that can't be reached doesn't fail the others. With divert set the
+// object is spooled without trying S3.
+func (l *S3Logger) upload(ctx context.Context, body []byte, sb sealedBatch, firstSeq int64, t time.Time, divert bool) error {
+	data := l.keyData
+	data.Sequence = fmt.Sprintf(sequenceFormat, l.nextSequence(ctx))
+	data.FirstSeq = fmt.Sprintf(lineSequenceFormat, firstSeq)
+	sliced := sb.time
+	if sliced.IsZero() {
+		sliced = t
+	}
+	data.TimeSlice, data.Index = l.nextIndex(ctx, sb.partition, sliced)
+	key, err := renderKey(l.keyTmpl, data, t)
+	if err != nil {
+		l.log().WithError(err).Warnf("error rendering %s, falling back to %q", keyTemplateKey, key)
+	}
+	key = withUniqueSuffix(key, l.uniqueSuffix(time.Now()))
+	started := time.Now()
+	lines := bytes.Count(body, []byte{'\n'})
+	b, err := l.newBatch(l.opts.S3Prefix+sb.partition+key, l.dedupe(body, firstSeq))
+	if err != nil {
+		return err
+	}
+	// A duplicate record stands for the lines it replaced.
+	b.Lines = lines
+	b.flushed = started
+	l.countObject(len(body), len(b.body), sb.partition)
+	countPut(started)
+	b.Manifest = l.manifestPath()
+	b.FirstSeq, b.First, b.Last = firstSeq, sb.time, sb.last
+	b.Metadata = withDedupeHint(b.Metadata, firstSeq, firstSeq+int64(b.Lines)-1)
+
+	errs := make([]error, len(l.targets))
+	if len(l.targets) == 1 {
+		errs[0] = l.uploadTo(ctx, l.targets[0], b, divert)
+	} else {
+		var wg sync.WaitGroup
+		for i, t := range l.targets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = l.uploadTo(ctx, t, b, divert)
+			}()
+		}
+		wg.Wait()
+	}
+	if b.index != nil && errs[0] == nil && !divert {
+		l.putIndex(ctx, b)
+	}
+	return errors.Join(errs...)
+}
+
+// newBatch returns a batch uploading body as key with the logger's object
+// settings, compressing it and adding the codec's extension to the key as
+// configured.
+func (l *S3Logger) newBatch(key string, body []byte) (*batch, error) {
+	b := &batch{
+		Key:          key,
+		ContentType:  contentType(l.opts.Format),
+		ContainerID:  l.info.ContainerID,
+		SSE:          l.opts.SSE,
+		SSEKMSKeyID:  l.opts.SSEKMSKeyID,
+		SSECKeyFile:  l.opts.SSECKeyFile,
+		StorageClass: l.opts.StorageClass,
+		ACL:          l.opts.ACL,
+		RequestPayer: l.opts.RequestPayer,
+		Tagging:      l.tagging,
+		Metadata:     l.metadata,
+		Tag:          l.keyData.Tag,
+		Lines:        bytes.Count(body, []byte{'\n'}),
+		NotifyTopic:  l.opts.NotifyTopic,
+		NotifyQueue:  l.opts.NotifyQueue,
+		body:         body,
+		ssec:         l.ssec,
+		strict:       l.strict(),
+	}
+	l.retain(b)
+	if l.opts.Format == formatParquet {
+		var err error
+		if b.body, err = encodeParquet(b.body, l.flushBytes(), l.opts.ParquetCompression); err != nil {
+			return nil, fmt.Errorf("failed to encode logs as parquet: %v", err)
+		}
+		b.Key += parquetExt
+	}
+	codec, compressed := codecs[l.opts.Compress]
+	switch {
+	case l.opts.Index:
+		var err error
+		if b.body, b.index, err = buildIndex(b.body, l.opts.IndexInterval, l.opts.Compress, l.opts.CompressLevel); err != nil {
+			return nil, fmt.Errorf("failed to compress logs: %v", err)
+		}
+	case compressed:
+		var err error
+		if b.body, err = compressBytes(l.opts.Compress, l.opts.CompressLevel, b.body); err != nil {
+			return nil, fmt.Errorf("failed to compress logs: %v", err)
+		}
+	}
+	if compressed {
+		b.Key += codec.ext
+		b.ContentEncoding = codec.encoding
+	}
+	if !l.opts.DisableChecksums {
+		setChecksum(b, l.opts.PartSize)
+	}
+	return b, nil
+}
+
+// uploadTo uploads a copy of b to t, retrying failed uploads. Once the
+// retries are exhausted, or at once while the bucket's circuit breaker is
+// open, the copy is handed to the spool, or dropped if there is none. A
+// diverted copy is spooled without trying S3. With ordering=strict a copy is
+// never dropped while ctx lasts, and follows any the container has spooled.
+func (l *S3Logger) uploadTo(ctx context.Context, t *target, b *batch, divert bool) (err error) {
+	c := *b
+	b = &c
+	b.Bucket = t.bucket
+	b.Client = t.cfg
+	log := l.log().WithField("bucket", t.bucket).WithField("key", b.Key)
+	if l.opts.replay != nil {
+		if taken, err := l.opts.replay.taken(ctx, t.client, b); taken || err != nil {
+			return err
+		}
+	}
+	ctx, span := l.tracer.Start(ctx, "upload")
+	defer func() {
+		if span.IsRecording() {
+			span.SetAttributes(semconv.AWSS3Bucket(t.bucket), semconv.AWSS3Key(b.Key), attribute.Int("s3logdriver.bytes", len(b.body)))
+			if b.requestID != "" {
+				span.SetAttributes(semconv.AWSRequestID(b.requestID))
+			}
+		}
+		endSpan(span, err)
+	}()
+
+	if l.strict() {
+		if queued, err := l.queueBehindSpool(ctx, t, b, log); queued {
+			if err != nil {
+				return l.dropFailed(t, b, log, err)
+			}
+			return nil
+		}
+	}
+	if divert {
+		err := l.spoolBatch(ctx, b)
+		if err == nil {
+			t.metrics.spooled.Inc()
+			t.record(b, true)
+			log.Warnf("spooled batch to disk without uploading it, %s exceeded", maxTotalBufferKey)
+			return nil
+		}
+		log.WithError(err).Error("error spooling batch, uploading it instead")
+	}
+
+	cost := l.pool.tenantBudget(l.opts.Tenant)
+	switch cost.check() {
+	case overBudgetSpool:
+		if l.spool != nil {
+			err := l.spoolBatch(ctx, b)
+			if err == nil {
+				t.metrics.spooled.Inc()
+				t.record(b, true)
+				log.Debug("spooled batch to disk without uploading it, daily budget exceeded")
+				return nil
+			}
+			log.WithError(err).Error("error spooling batch over budget, dropping it")
+		}
+		fallthrough
+	case overBudgetDrop:
+		if l.strict() {
+			// Dropping the batch would leave a gap before the next.
+			if l.spool != nil && l.spoolBatch(ctx, b) == nil {
+				t.metrics.spooled.Inc()
+				t.record(b, true)
+				log.Debug("spooled batch to disk without uploading it, daily budget exceeded")
+				return nil
+			}
+			log.Warnf("uploading batch over the daily budget anyway, %s=%s", orderingKey, orderingStrict)
+			break
+		}
+		costBudgetDropped.Inc()
+		l.metrics.dropped.Add(float64(b.Lines))
+		l.droppedBatch(t, b, gapBudget)
+		log.Debugf("dropped %d bytes of logs, daily budget exceeded", len(b.body))
+		return nil
+	}
+
+	attempts := 0
+	send := func() error {
+		return retry(ctx, l.opts.MaxRetries, l.opts.MaxRetryDelay, func() error {
+			if attempts > 0 {
+				t.metrics.retries.Inc()
+				if span.IsRecording() {
+					span.AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempts)))
+				}
+			}
+			attempts++
+			err := l.pool.upload(ctx, t.bucket, l.opts.S3RequestTimeout, func(ctx context.Context) error {
+				return uploadBatch(ctx, t.uploader, b)
+			})
+			if errors.Is(err, errBreakerOpen) {
+				return err
+			}
+			if err != nil {
+				l.attemptFailed.Store(true)
+				t.metrics.errors.Inc()
+				span.RecordError(err)
+				s3Failed(log, t.bucket, err).Warn("error uploading logs")
+			}
+			return err
+		})
+	}
+	err = send()
+	if err == nil {
+		err = l.verifyWrite(ctx, t, b, log, send)
+	}
+	var held bool
+	if err != nil && l.strict() {
+		held, err = l.holdFailed(ctx, t, b, log, err, send)
+	}
+	l.observeFlush(t, b, attempts-1, err)
+	if held {
+		return nil
+	}
+	if err == nil {
+		cost.charge(len(b.body))
+		t.metrics.uploaded.Add(float64(len(b.body)))
+		t.metrics.lines.Add(float64(b.Lines))
+		log.WithField("bytes", len(b.body)).Debug("uploaded logs")
+		t.record(b, false)
+		l.clients.notifyUpload(ctx, b)
+		l.failedBack(t, log)
+		return nil
+	}
+	if l.failOver(ctx, t, b, log) {
+		return nil
+	}
+
+	if l.spool != nil {
+		serr := l.spoolBatch(ctx, b)
+		if serr == nil {
+			t.metrics.spooled.Inc()
+			t.record(b, true)
+			log.WithError(err).Warn("spooled batch to disk after failing to upload it")
+			return nil
+		}
+		log.WithError(serr).Error("error spooling batch")
+	}
+	return l.dropFailed(t, b, log, err)
+}
+
+// spoolBatch writes b to the spool, traced under ctx's span.
+func (l *S3Logger) spoolBatch(ctx context.Context, b *batch) error {
+	_, span := l.tracer.Start(ctx, "spool write")
+	b.Tenant = l.opts.Tenant
+	err := l.spool.write(b)
+	endSpan(span, err)
+	return err
+}
+
+// dropFailed counts and logs b as dropped from t after failing with err, and
+// returns the error.
+func (l *S3Logger) dropFailed(t *target, b *batch, log *logrus.Entry, err error) error {
+	uploadFailures.Add(1)
+	t.metrics.failed.Inc()
+	l.droppedBatch(t, b, gapUploadFailed)
+	log = describeAWSError(err).fields(log).WithError(err)
+	log.WithField("retried", uploadRetries.Load()).WithField("failed", uploadFailures.Load()).Errorf("dropped %d bytes of logs", len(b.body))
+	return newOpError(opUpload, t.bucket, err)
+}
+
+// uploadsParts reports whether an object opts upload may be large enough
+// for the uploader to send it in parts: a flush is at most the buffer, or a
+// line, and an object at most max-object-size.
+func (opts LogOption) uploadsParts() bool {
+	return int64(min(opts.MaxObjectSize, max(opts.MaxBufferSize, opts.MaxLineBytes))) >= opts.PartSize
+}
+
+// uploadBatch uploads b as a single object. A bytes.Reader lets the uploader
+// slice parts straight out of the body instead of copying each part. Parts of
+// a failed multipart upload are aborted by the uploader.
+func uploadBatch(ctx context.Context, uploader objectUploader, b *batch) error {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(b.Key),
+		Body:   bytes.NewReader(b.body),
+	}
+	if b.ContentType != "" {
+		input.ContentType = aws.String(b.ContentType)
+	}
+	if b.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(b.ContentEncoding)
+	}
+	if b.Tagging != "" {
+		input.Tagging = aws.String(b.Tagging)
+	}
+	if len(b.Metadata) > 0 {
+		input.Metadata = b.Metadata
+	}
+	if b.SSE != "" {
+		input.ServerSideEncryption = types.ServerSideEncryption(b.SSE)
+	}
+	if b.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(b.SSEKMSKeyID)
+	}
+	ssec, err := b.customerKey()
+	if err != nil {
+		return err
+	}
+	ssec.set(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	if b.StorageClass != "" {
+		input.StorageClass = types.StorageClass(b.StorageClass)
+	}
+	if b.ACL != "" {
+		input.ACL = types.ObjectCannedACL(b.ACL)
+	}
+	// The uploader passes RequestPayer on to every part of a multipart
+	// upload.
+	input.RequestPayer = types.RequestPayer(b.RequestPayer)
+	if b.ChecksumAlgorithm != "" {
+		input.ChecksumAlgorithm = types.ChecksumAlgorithm(b.ChecksumAlgorithm)
+	}
+	if b.ChecksumSHA256 != "" {
+		input.ChecksumSHA256 = aws.String(b.ChecksumSHA256)
+	}
+	var trace uploadTrace
+	out, err := uploader.Upload(ctx, input, trace.option())
+	trace.record(b)
+	if err != nil {
+		return fmt.Errorf("failed to upload object %q to S3: %w", b.Key, err)
+	}
+	b.versionID = aws.ToString(out.VersionID)
+	return nil
+}
@@ -0,0 +1,737 @@
+package s3log
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/docker/docker/api/types/plugins/logdriver"
+)
+
+func TestUpload(t *testing.T) {
+	lines := []string{"first", "second", "third"}
+	tests := []struct {
+		name  string
+		cfg   map[string]string
+		check func(t *testing.T, key string, o *fakeObject)
+	}{
+		{name: "defaults"},
+		{
+			name: "gzip",
+			cfg:  map[string]string{compressKey: "gzip"},
+			check: func(t *testing.T, key string, o *fakeObject) {
+				if !strings.HasSuffix(key, ".gz") {
+					t.Errorf("key %q, want a .gz object", key)
+				}
+			},
+		},
+		{
+			name: "zstd",
+			cfg:  map[string]string{compressKey: "zstd"},
+			check: func(t *testing.T, key string, o *fakeObject) {
+				if !strings.HasSuffix(key, ".zst") {
+					t.Errorf("key %q, want a .zst object", key)
+				}
+			},
+		},
+		{
+			name: "jsonl",
+			cfg:  map[string]string{formatKey: formatJSONL},
+			check: func(t *testing.T, key string, o *fakeObject) {
+				if o.contentType != contentType(formatJSONL) {
+					t.Errorf("content type = %q, want %q", o.contentType, contentType(formatJSONL))
+				}
+			},
+		},
+		{
+			name: "prefix",
+			cfg:  map[string]string{s3PrefixKey: "team/"},
+			check: func(t *testing.T, key string, o *fakeObject) {
+				if !strings.HasPrefix(key, "team/") {
+					t.Errorf("key %q isn't under the prefix", key)
+				}
+			},
+		},
+		{
+			name: "storage class",
+			cfg:  map[string]string{storageClassKey: "STANDARD_IA"},
+			check: func(t *testing.T, key string, o *fakeObject) {
+				if o.storageClass != "STANDARD_IA" {
+					t.Errorf("storage class = %q, want STANDARD_IA", o.storageClass)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			l := newTestLogger(t, fake, tt.cfg)
+			logLines(t, l, time.Now(), lines...)
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			keys := fake.logKeys(testBucket)
+			if len(keys) != 1 {
+				t.Fatalf("uploaded %q, want one object", keys)
+			}
+			if got := objectLines(t, l, keys[0]); !slices.Equal(got, lines) {
+				t.Errorf("uploaded lines %q, want %q", got, lines)
+			}
+			if tt.check != nil {
+				o, _ := fake.object(testBucket, keys[0])
+				tt.check(t, keys[0], o)
+			}
+		})
+	}
+}
+
+func TestUploadMultipart(t *testing.T) {
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, map[string]string{
+		partSizeKey:      "5242880",
+		maxBufferSizeKey: "16777216",
+		flushBytesKey:    "16777216",
+		flushIntervalKey: "1h",
+	})
+	line := strings.Repeat("x", 1023)
+	lines := make([]string, 6<<10)
+	for i := range lines {
+		lines[i] = line
+	}
+	logLines(t, l, time.Now(), lines...)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.count("CreateMultipartUpload") != 1 || fake.count("UploadPart") != 2 || fake.count("CompleteMultipartUpload") != 1 {
+		t.Errorf("%d multipart uploads of %d parts, want one of two", fake.count("CreateMultipartUpload"), fake.count("UploadPart"))
+	}
+	if got := uploadedLines(t, fake, l); !slices.Equal(got, lines) {
+		t.Errorf("uploaded %d lines, want %d", len(got), len(lines))
+	}
+}
+
+func TestUploadWhileRunning(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]string
+	}{
+		{name: "flush interval", cfg: map[string]string{flushIntervalKey: "20ms"}},
+		{name: "flush bytes", cfg: map[string]string{flushBytesKey: "64"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			l := newTestLogger(t, fake, tt.cfg)
+			lines := []string{strings.Repeat("a", 40), strings.Repeat("b", 40)}
+			logLines(t, l, time.Now(), lines...)
+			waitFor(t, "the lines to be uploaded", func() bool {
+				return len(uploadedLines(t, fake, l)) == len(lines)
+			})
+			if got := uploadedLines(t, fake, l); !slices.Equal(got, lines) {
+				t.Errorf("uploaded %q, want %q", got, lines)
+			}
+		})
+	}
+}
+
+func TestIdleFlush(t *testing.T) {
+	const interval = 200 * time.Millisecond
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		// log logs to l, returning the lines logged.
+		log func(t *testing.T, l *S3Logger) []string
+		// objects is how many are uploaded, gap how long apart at least.
+		objects int
+		gap     time.Duration
+	}{
+		{
+			// A few lines at startup and then nothing are still uploaded.
+			name: "quiet container",
+			log: func(t *testing.T, l *S3Logger) []string {
+				lines := []string{"starting", "listening on :8080", "ready"}
+				logLines(t, l, time.Now(), lines...)
+				return lines
+			},
+			objects: 1,
+		},
+		{
+			// A flush by size starts the interval again, so the line logged
+			// right after it waits out the whole of it.
+			name: "reset by a size flush",
+			cfg:  map[string]string{flushBytesKey: "256"},
+			log: func(t *testing.T, l *S3Logger) []string {
+				lines := []string{strings.Repeat("x", 300), "small"}
+				logLines(t, l, time.Now(), lines[0])
+				waitFor(t, "the size flush", func() bool { return l.flushedAt.Load() > 0 })
+				logLines(t, l, time.Now(), lines[1])
+				return lines
+			},
+			objects: 2,
+			gap:     interval,
+		},
+		{
+			// Idle flushes racing the flushes by size upload every line
+			// once, in order.
+			name: "racing size flushes",
+			cfg:  map[string]string{flushBytesKey: "512", flushIntervalKey: "1ms"},
+			log: func(t *testing.T, l *S3Logger) []string {
+				lines := fixedLines(0, 2000, 50)
+				for i := range 20 {
+					logLines(t, l, time.Now(), lines[i*100:(i+1)*100]...)
+					time.Sleep(time.Millisecond)
+				}
+				return lines
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			var mu sync.Mutex
+			var puts []time.Time
+			fake.before = func(_ context.Context, op, _, _ string) error {
+				if op == "PutObject" {
+					mu.Lock()
+					puts = append(puts, time.Now())
+					mu.Unlock()
+				}
+				return nil
+			}
+			cfg := map[string]string{flushIntervalKey: interval.String(), maxBufferSizeKey: "1048576"}
+			maps.Copy(cfg, tt.cfg)
+			l := newTestLogger(t, fake, cfg)
+			lines := tt.log(t, l)
+			waitFor(t, "the lines to be uploaded", func() bool {
+				return len(uploadedLines(t, fake, l)) >= len(lines)
+			})
+			if tt.objects > 0 {
+				// Nothing more is uploaded once the buffer is empty.
+				time.Sleep(2 * l.flushInterval())
+			}
+			if got := uploadedLines(t, fake, l); !slices.Equal(got, lines) {
+				t.Errorf("uploaded %d lines, want %d in order", len(got), len(lines))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.objects > 0 && len(puts) != tt.objects {
+				t.Errorf("%d objects uploaded, want %d", len(puts), tt.objects)
+			}
+			for i := 1; i < len(puts) && tt.gap > 0; i++ {
+				if gap := puts[i].Sub(puts[i-1]); gap < tt.gap*9/10 {
+					t.Errorf("object %d uploaded %v after the last, want at least %v", i, gap, tt.gap)
+				}
+			}
+		})
+	}
+}
+
+func TestIdleFlushStopsOnClose(t *testing.T) {
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, map[string]string{flushIntervalKey: "10ms"})
+	logLines(t, l, time.Now(), "last words")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	puts := fake.count("PutObject")
+	time.Sleep(50 * time.Millisecond)
+	if got := fake.count("PutObject"); got != puts {
+		t.Errorf("%d uploads after Close", got-puts)
+	}
+	if got := uploadedLines(t, fake, l); !slices.Equal(got, []string{"last words"}) {
+		t.Errorf("uploaded %q", got)
+	}
+}
+
+func TestClose(t *testing.T) {
+	lines := []string{"pending", "lines"}
+	tests := []struct {
+		name     string
+		setup    func(fake *fakeS3)
+		uploaded []string
+	}{
+		{name: "pending data", uploaded: lines},
+		{
+			name: "S3 errors",
+			setup: func(fake *fakeS3) {
+				fake.fail("PutObject", 1000, fakeStatusError(http.StatusInternalServerError, "InternalError"))
+			},
+		},
+		{
+			name: "S3 hangs",
+			setup: func(fake *fakeS3) {
+				fake.before = func(ctx context.Context, op, _, _ string) error {
+					if op != "PutObject" {
+						return nil
+					}
+					<-ctx.Done()
+					return ctx.Err()
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			l := newTestLogger(t, fake, map[string]string{
+				shutdownFlushKey: "200ms",
+				maxRetriesKey:    "100",
+				maxRetryDelayKey: "50ms",
+				flushIntervalKey: "1h",
+			})
+			logLines(t, l, time.Now(), lines...)
+			if tt.setup != nil {
+				tt.setup(fake)
+			}
+			start := time.Now()
+			l.Close()
+			if took := time.Since(start); took > 2*time.Second {
+				t.Errorf("Close took %v with a 200ms shutdown-flush-timeout", took)
+			}
+			if got := uploadedLines(t, fake, l); !slices.Equal(got, tt.uploaded) {
+				t.Errorf("uploaded %q, want %q", got, tt.uploaded)
+			}
+		})
+	}
+}
+
+// stallPuts makes fake's PutObject calls for keys containing match wait
+// until the returned func is called.
+func stallPuts(fake *fakeS3, match string) (release func()) {
+	stalled := make(chan struct{})
+	fake.before = func(ctx context.Context, op, _, key string) error {
+		if op != "PutObject" || !strings.Contains(key, match) {
+			return nil
+		}
+		select {
+		case <-stalled:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var once sync.Once
+	return func() { once.Do(func() { close(stalled) }) }
+}
+
+// logUntilBlocked logs n copies of line to l from a goroutine and returns
+// once Log has blocked, failing the test if all n were logged. finish waits
+// for the rest to be logged.
+func logUntilBlocked(t *testing.T, l containerLogger, line string, n int) (finish func()) {
+	t.Helper()
+	logged := make(chan struct{})
+	go func() {
+		defer close(logged)
+		for range n {
+			l.Log(&Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()})
+			logged <- struct{}{}
+		}
+	}()
+	for {
+		select {
+		case _, ok := <-logged:
+			if !ok {
+				t.Fatalf("logged all %d lines without blocking", n)
+			}
+			continue
+		case <-time.After(200 * time.Millisecond):
+		}
+		return func() {
+			for range logged {
+			}
+		}
+	}
+}
+
+func TestBufferFull(t *testing.T) {
+	line := strings.Repeat("x", 100)
+	cfg := map[string]string{maxBufferSizeKey: "512", flushBytesKey: "256", flushIntervalKey: "1h", maxRetriesKey: "0"}
+
+	t.Run("blocking", func(t *testing.T) {
+		fake := newFakeS3()
+		release := stallPuts(fake, "")
+		defer release()
+		l := newTestLogger(t, fake, cfg)
+
+		finish := logUntilBlocked(t, l, line, 20)
+		release()
+		finish()
+		l.Close()
+		if got := len(uploadedLines(t, fake, l)); got != 20 {
+			t.Errorf("uploaded %d lines, want all 20", got)
+		}
+		if d := l.dropped.Load(); d != 0 {
+			t.Errorf("dropped %d lines in blocking mode", d)
+		}
+	})
+
+	t.Run("non-blocking", func(t *testing.T) {
+		fake := newFakeS3()
+		release := stallPuts(fake, "")
+		defer release()
+		nonBlocking := maps.Clone(cfg)
+		// stderr blocks unless told otherwise, and a non-blocking stream
+		// then drops its newest line rather than the blocking stream's.
+		nonBlocking[modeKey] = modeNonBlocking
+		nonBlocking[stderrModeKey] = modeNonBlocking
+		l := newTestLogger(t, fake, nonBlocking)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := range 100 {
+				l.Log(&Message{Line: []byte(fmt.Sprintf("%03d %s", i, line)), Source: "stdout", Timestamp: time.Now()})
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Log blocked in non-blocking mode")
+		}
+		release()
+		l.Close()
+		var got []string
+		for _, line := range uploadedLines(t, fake, l) {
+			// Skip the markers of the gaps.
+			if !strings.HasPrefix(line, "{") {
+				got = append(got, line)
+			}
+		}
+		dropped := l.dropped.Load()
+		if dropped == 0 {
+			t.Error("dropped no lines with the buffer full")
+		}
+		if len(got)+int(dropped) != 100 {
+			t.Errorf("uploaded %d and dropped %d lines, want 100 in all", len(got), dropped)
+		}
+		if len(got) == 0 || !strings.HasPrefix(got[len(got)-1], "099 ") {
+			t.Errorf("kept %q, not the newest line", got)
+		}
+	})
+
+	t.Run("per container", func(t *testing.T) {
+		fake := newFakeS3()
+		stuck := testContainerID(t)
+		release := stallPuts(fake, stuck)
+		defer release()
+		info := Info{Config: testLogOpts(t, cfg), ContainerID: stuck, ContainerName: "/stuck"}
+		blocked, d := newTestDriverLogger(t, fake, info)
+		info.ContainerID, info.ContainerName = fmt.Sprintf("%x", sha256.Sum256([]byte(stuck))), "/other"
+		opts, err := parseLogOpts(DefaultOptions(), info.Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := newLogger(d.clients, d.pool, d.budget, opts, info, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+
+		finish := logUntilBlocked(t, blocked, line, 20)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			logLines(t, other, time.Now(), line, line, line, line, line, line, line, line)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("another container's Log blocked on the stuck container's buffer")
+		}
+		release()
+		finish()
+	})
+}
+
+func TestBlockedLogReturns(t *testing.T) {
+	// A blocking Log waits for a flush that never comes, as when the bucket
+	// can't be reached, until the logger gives up.
+	tests := []struct {
+		name string
+		stop func(t *testing.T, l *S3Logger)
+	}{
+		{name: "abandoned", stop: func(_ *testing.T, l *S3Logger) { l.abandon() }},
+		{name: "closed", stop: func(t *testing.T, l *S3Logger) {
+			closed := make(chan struct{})
+			go func() {
+				l.Close()
+				close(closed)
+			}()
+			t.Cleanup(func() { <-closed })
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			// The PUTs don't answer even once cancelled, so the flush never
+			// makes room.
+			stalled := make(chan struct{})
+			defer close(stalled)
+			fake.before = func(_ context.Context, op, _, _ string) error {
+				if op == "PutObject" {
+					<-stalled
+				}
+				return nil
+			}
+			l := newTestLogger(t, fake, map[string]string{
+				maxBufferSizeKey: "512",
+				flushBytesKey:    "256",
+				flushIntervalKey: "1h",
+				shutdownFlushKey: "100ms",
+			})
+			finish := logUntilBlocked(t, l, strings.Repeat("x", 100), 20)
+			start := time.Now()
+			tt.stop(t, l)
+			done := make(chan struct{})
+			go func() {
+				finish()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Log still blocked")
+			}
+			if took := time.Since(start); took > time.Second {
+				t.Errorf("Log returned %v after the logger stopped", took)
+			}
+		})
+	}
+}
+
+// payerS3 is a fakeS3 that records the RequestPayer of the calls that carry
+// one.
+type payerS3 struct {
+	*fakeS3
+	mu     sync.Mutex
+	payers map[string][]types.RequestPayer
+}
+
+func (p *payerS3) note(op string, payer types.RequestPayer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.payers[op] = append(p.payers[op], payer)
+}
+
+func (p *payerS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	p.note("PutObject", params.RequestPayer)
+	return p.fakeS3.PutObject(ctx, params, optFns...)
+}
+
+func (p *payerS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	p.note("GetObject", params.RequestPayer)
+	return p.fakeS3.GetObject(ctx, params, optFns...)
+}
+
+func (p *payerS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	p.note("ListObjectsV2", params.RequestPayer)
+	return p.fakeS3.ListObjectsV2(ctx, params, optFns...)
+}
+
+func (p *payerS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	p.note("CreateMultipartUpload", params.RequestPayer)
+	return p.fakeS3.CreateMultipartUpload(ctx, params, optFns...)
+}
+
+func (p *payerS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	p.note("UploadPart", params.RequestPayer)
+	return p.fakeS3.UploadPart(ctx, params, optFns...)
+}
+
+func (p *payerS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	p.note("CompleteMultipartUpload", params.RequestPayer)
+	return p.fakeS3.CompleteMultipartUpload(ctx, params, optFns...)
+}
+
+func TestRequestPayer(t *testing.T) {
+	line := strings.Repeat("x", 1023)
+	tests := []struct {
+		name  string
+		lines int
+		ops   []string
+	}{
+		{name: "simple upload", lines: 10, ops: []string{"PutObject", "ListObjectsV2", "GetObject"}},
+		{name: "multipart upload", lines: 6 << 10, ops: []string{"CreateMultipartUpload", "UploadPart", "CompleteMultipartUpload", "ListObjectsV2", "GetObject"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &payerS3{fakeS3: newFakeS3(), payers: make(map[string][]types.RequestPayer)}
+			opts, err := parseLogOpts(DefaultOptions(), testLogOpts(t, map[string]string{
+				requestPayerKey:  "requester",
+				partSizeKey:      "5242880",
+				maxBufferSizeKey: "16777216",
+				flushBytesKey:    "16777216",
+				flushIntervalKey: "1h",
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			clients := newTestClients(p.fakeS3)
+			clients.newClient = func(aws.Config, ...func(*s3.Options)) s3API { return p }
+			pool := newUploadPool(4, defaultBreakerThreshold, defaultBreakerCooldown, 0)
+			t.Cleanup(pool.close)
+			l, err := newS3Logger(clients, pool, nil, opts, Info{ContainerID: testContainerID(t), ContainerName: "/test"}, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := make([]string, tt.lines)
+			for i := range lines {
+				lines[i] = line
+			}
+			logLines(t, l, time.Now(), lines...)
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := readLogs(t, l, ReadConfig{Tail: -1}); len(got) != len(lines) {
+				t.Errorf("read back %d lines, want %d", len(got), len(lines))
+			}
+
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			for _, op := range tt.ops {
+				if len(p.payers[op]) == 0 {
+					t.Errorf("no %s calls", op)
+				}
+			}
+			for op, payers := range p.payers {
+				for _, payer := range payers {
+					if payer != types.RequestPayerRequester {
+						t.Errorf("%s with RequestPayer %q, want %q", op, payer, types.RequestPayerRequester)
+					}
+				}
+			}
+		})
+	}
+
+	t.Run("head bucket", func(t *testing.T) {
+		var header string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header = r.Header.Get("x-amz-request-payer")
+		}))
+		defer srv.Close()
+		client := s3.New(s3.Options{
+			Region:       "us-east-1",
+			Credentials:  credentials.NewStaticCredentialsProvider("AKIDTEST", "secret", ""),
+			BaseEndpoint: aws.String(srv.URL),
+			UsePathStyle: true,
+		})
+		if err := headBucket(context.Background(), client, testBucket, "requester"); err != nil {
+			t.Fatal(err)
+		}
+		if header != "requester" {
+			t.Errorf("HeadBucket sent x-amz-request-payer %q, want requester", header)
+		}
+	})
+}
+
+func TestSealBuffer(t *testing.T) {
+	// A buffer back from the pool holds another batch's lines past the
+	// length of this one.
+	old := sealBuffer([]byte(strings.Repeat("stale line\n", 100)))
+	releaseBatches([]sealedBatch{{data: old}})
+	data := []byte("new line\n")
+	sealed := sealBuffer(data)
+	copy(data, "XXX")
+	if string(sealed) != "new line\n" {
+		t.Errorf("sealed %q, want the line as logged", sealed)
+	}
+}
+
+func TestReusedBuffers(t *testing.T) {
+	// Lines go through reused entries, messages and batch buffers. Under
+	// -race this catches a buffer reused while still being read.
+	tests := []struct {
+		name string
+		mode string
+		fail int // PutObject attempts failed, whose buffers aren't reused
+	}{
+		{name: "blocking", mode: modeBlocking},
+		{name: "non-blocking", mode: modeNonBlocking},
+		{name: "failed attempts", mode: modeBlocking, fail: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			fake.fail("PutObject", tt.fail, fakeStatusError(http.StatusInternalServerError, "InternalError"))
+			d := newTestDriver(t, fake, nil)
+			c := startContainer(t, d, map[string]string{
+				modeKey:          tt.mode,
+				stderrModeKey:    tt.mode,
+				flushBytesKey:    "4096",
+				maxBufferSizeKey: "4194304",
+				maxRetryDelayKey: "1ms",
+			})
+			var want []string
+			ts := time.Now()
+			for i := range 5000 {
+				line := fmt.Sprintf("%d %s", i, strings.Repeat("x", i%300))
+				ts = ts.Add(time.Microsecond)
+				if i%7 != 0 {
+					c.write(t, entry("stdout", line, ts))
+					want = append(want, line)
+					continue
+				}
+				// Every seventh line comes in two parts.
+				for ord, half := range []string{line[:len(line)/2], line[len(line)/2:]} {
+					e := entry("stdout", half, ts)
+					e.Partial = true
+					e.PartialLogMetadata = &logdriver.PartialLogEntryMetadata{Id: fmt.Sprint(i), Ordinal: int32(ord + 1), Last: ord == 1}
+					c.write(t, e)
+				}
+				want = append(want, line)
+			}
+			c.stop(t, d)
+			got := uploadedLines(t, fake, c.l)
+			if len(got) != len(want) {
+				t.Fatalf("uploaded %d lines, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("line %d uploaded as %.40q, want %.40q", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLogLine(b *testing.B) {
+	fake := newFakeS3()
+	l := newTestLogger(b, fake, map[string]string{flushIntervalKey: "1h"})
+	msg := &Message{Line: []byte(strings.Repeat("x", 200)), Source: "stdout", Timestamp: time.Now()}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg.Line)))
+	b.ResetTimer()
+	for range b.N {
+		l.Log(msg)
+	}
+}
+
+func BenchmarkFlush(b *testing.B) {
+	fake := newFakeS3()
+	l := newTestLogger(b, fake, map[string]string{flushIntervalKey: "1h", maxBufferSizeKey: "16777216", flushBytesKey: "16777216"})
+	msg := &Message{Line: []byte(strings.Repeat("x", 200)), Source: "stdout", Timestamp: time.Now()}
+	const lines = 1000
+	b.ReportAllocs()
+	b.SetBytes(lines * int64(len(msg.Line)))
+	b.ResetTimer()
+	for range b.N {
+		for range lines {
+			l.Log(msg)
+		}
+		if err := l.flush(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
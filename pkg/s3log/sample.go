@@ -0,0 +1,46 @@
+package s3log
+
+import (
+	"math/rand/v2"
+	"regexp"
+)
+
+const (
+	sampleRateKey     = "sample-rate"
+	samplePatternKey  = "sample-key-pattern"
+	defaultSampleRate = 1.0
+)
+
+// sampler keeps each record with probability rate. Only records matching
+// pattern are sampled when it is set; the rest are always kept. Each logger
+// has its own source so that sampling doesn't contend on the global one.
+type sampler struct {
+	rate    float64
+	pattern *regexp.Regexp
+	rand    *rand.Rand
+}
+
+// newSampler returns nil when every record is kept. pattern has been
+// validated by parseLogOpts.
+func newSampler(rate float64, pattern string) *sampler {
+	if rate >= 1 {
+		return nil
+	}
+	s := &sampler{rate: rate, rand: rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))}
+	if pattern != "" {
+		s.pattern = regexp.MustCompile(pattern)
+	}
+	return s
+}
+
+// sample reports whether msg is kept, counting the records it drops. It sees
+// records that passed the filters, before they are redacted and buffered.
+// Callers must hold l.mu.
+func (l *S3Logger) sample(msg *Message) bool {
+	s := l.sampler
+	if s == nil || s.pattern != nil && !s.pattern.Match(msg.Line) || s.rand.Float64() < s.rate {
+		return true
+	}
+	l.metrics.sampled.Inc()
+	return false
+}
@@ -0,0 +1,569 @@
+package s3log
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	schemaFormatJSON = "json-schema"
+	schemaFormatGlue = "glue"
+
+	jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+	// maxGlueComment is the longest comment Glue takes on a column.
+	maxGlueComment = 255
+)
+
+// schemaField is a field of a record, read off the struct the record is
+// encoded or decoded with, so that the schema command describes the records
+// as they are written.
+type schemaField struct {
+	name     string
+	typ      reflect.Type
+	required bool
+}
+
+// structFields returns the fields t, a struct, is encoded with under tag,
+// json or parquet, in order and with those of embedded structs in place. A
+// json field is required unless it is omitempty; every parquet column is.
+func structFields(t reflect.Type, tag string) []schemaField {
+	var fields []schemaField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			fields = append(fields, structFields(ft, tag)...)
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get(tag), ",")
+		if !f.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		required := tag != "json" || !slices.Contains(strings.Split(opts, ","), "omitempty")
+		fields = append(fields, schemaField{name: name, typ: f.Type, required: required})
+	}
+	return fields
+}
+
+// markerRecords are the markers a logger writes among a container's lines,
+// by event, along with the struct each is marshaled from and whether opts
+// have them written.
+var markerRecords = []struct {
+	event string
+	typ   reflect.Type
+	on    func(LogOption) bool
+}{
+	{eventLogGap, reflect.TypeFor[gapEvent](), nil},
+	{eventDuplicate, reflect.TypeFor[duplicateEvent](), func(opts LogOption) bool { return opts.DedupeWindow > 0 }},
+	{eventStopped, reflect.TypeFor[stoppedRecord](), func(opts LogOption) bool { return opts.ExitEvent }},
+}
+
+// lineOnlyFields are the fields of record that only the records of lines
+// have, and markers don't.
+var lineOnlyFields = map[string]bool{
+	"log":              true,
+	originalTimeKey:    true,
+	"record_id":        true,
+	"part":             true,
+	"total":            true,
+	"truncated":        true,
+	partialTimeoutAttr: true,
+}
+
+// fieldDocs describe the fields of records by name, or for the fields of a
+// marker besides those of every record by its event and name.
+var fieldDocs = map[string]string{
+	"log":              "The line as the container logged it, without its newline.",
+	"stream":           "The stream the line was logged on. Markers are on stderr.",
+	"seq":              "The number of the record among the container's lines and markers, counting up by one.",
+	"time":             "When the daemon read the line, or for a marker when what it records happened.",
+	originalTimeKey:    "The line's own timestamp, RFC 3339 in UTC, on a line restamped for being over max-future-skew ahead.",
+	"record_id":        "The ID of the line the parts of a line split for max-record-bytes share.",
+	"part":             "Which of the parts of its line the record is, from 1.",
+	"total":            "How many parts the line was split into.",
+	"truncated":        "Set on a line truncated for max-record-bytes.",
+	partialTimeoutAttr: `"true" on a partial line written out because its last part hadn't arrived within max-partial-age.`,
+	"container_id":     "The ID of the container.",
+	"tag":              "The container's tag, as the tag log-opt renders it.",
+	"attrs":            "The container's labels and env picked by the labels, labels-regex, env and env-regex log-opts, and its group-by-label group.",
+	"event":            "What the marker records.",
+
+	eventLogGap + ".dropped_lines": "How many lines were dropped.",
+	eventLogGap + ".from_seq":      "The seq of the line kept before the gap.",
+	eventLogGap + ".to_seq":        "The seq of the line kept after the gap.",
+	eventLogGap + ".reason":        "Why the lines were dropped.",
+
+	eventDuplicate + ".of_seq":     "The seq of the first of the lines these repeat, uploaded within dedupe-window.",
+	eventDuplicate + ".lines":      "How many lines the marker replaces.",
+	eventDuplicate + ".count":      "How often the lines have been repeated since they were first uploaded.",
+	eventDuplicate + ".first_seen": "When the lines were first uploaded.",
+
+	eventStopped + ".reason":    "How the container stopped.",
+	eventStopped + ".signal":    "The signal the container was killed with.",
+	eventStopped + ".exit_code": "The container's exit code.",
+	eventStopped + ".at":        "When the daemon stopped the container's logger.",
+}
+
+// fieldEnums are the values the fields named as in fieldDocs take.
+var fieldEnums = map[string][]string{
+	"stream":                 {"stdout", "stderr"},
+	eventLogGap + ".reason":  {gapBufferFull, gapBudget, gapSpoolEvicted, gapUploadFailed},
+	eventStopped + ".reason": {exitOOMKilled, exitKilled, exitExited, exitUnknown},
+}
+
+// fieldDoc returns the description of field name of records of event, ""
+// for a line.
+func fieldDoc(event, name string) string {
+	if doc, ok := fieldDocs[event+"."+name]; ok {
+		return doc
+	}
+	return fieldDocs[name]
+}
+
+// markerFieldDoc returns the description of field name of records of event,
+// saying which event it is if the field is the event's own.
+func markerFieldDoc(event, name string) string {
+	if doc, ok := fieldDocs[event+"."+name]; ok {
+		return event + ": " + doc
+	}
+	return fieldDocs[name]
+}
+
+// recordKind is the fields of the records of a line, for an event of "", or
+// of a marker.
+type recordKind struct {
+	event  string
+	fields []schemaField
+}
+
+// recordKinds returns the kinds of records a container logging jsonl with
+// opts and attrs writes: its lines' and its markers'.
+func recordKinds(opts LogOption, attrs attrSchema) []recordKind {
+	var line, envelope []schemaField
+	for _, f := range structFields(reflect.TypeFor[record](), "json") {
+		if !recordHas(opts, attrs, f.name) {
+			continue
+		}
+		switch f.name {
+		case "log":
+			f.required = !opts.MergeJSONLog
+		case "attrs":
+			f.required = len(attrs.required) > 0
+		}
+		line = append(line, f)
+		if !lineOnlyFields[f.name] {
+			envelope = append(envelope, f)
+		}
+	}
+	kinds := []recordKind{{fields: line}}
+	for _, m := range markerRecords {
+		if m.on == nil || m.on(opts) {
+			kinds = append(kinds, recordKind{event: m.event, fields: append(structFields(m.typ, "json"), envelope...)})
+		}
+	}
+	return kinds
+}
+
+// recordHas reports whether records written with opts and attrs may have
+// field name of record.
+func recordHas(opts LogOption, attrs attrSchema, name string) bool {
+	switch name {
+	case "time":
+		return opts.TimestampFormat != timestampNone
+	case originalTimeKey:
+		return opts.MaxFutureSkew > 0
+	case "record_id", "part", "total":
+		return opts.MaxRecordBytes > 0 && opts.OversizePolicy == oversizeSplit
+	case "truncated":
+		return opts.MaxRecordBytes > 0 && opts.OversizePolicy == oversizeTruncate
+	case "attrs":
+		return !attrs.empty()
+	}
+	return true
+}
+
+// attrSchema is the attributes a container's records may have, as its
+// log-opts pick them: by name, or by the keys labels-regex and env-regex
+// match, which may be any.
+type attrSchema struct {
+	names    map[string]string // to their description
+	required []string
+	patterns []string
+}
+
+// attrsOf returns the attributes the log-opts cfg, parsed into opts, give
+// records.
+func attrsOf(opts LogOption, cfg map[string]string) attrSchema {
+	a := attrSchema{names: make(map[string]string)}
+	for key, what := range map[string]string{labelsKey: "label", envKey: "environment variable"} {
+		if cfg[key] == "" {
+			continue
+		}
+		for _, k := range strings.Split(cfg[key], ",") {
+			a.names[k] = fmt.Sprintf("The container's %s %s, if it has it.", what, k)
+		}
+	}
+	if len(opts.GroupByLabel) > 0 {
+		a.names[groupAttr] = fmt.Sprintf("The container's group, the value of the first of its %s labels it has, or %s.", groupByLabelKey, ungroupedName)
+		a.required = append(a.required, groupAttr)
+	}
+	for _, key := range []string{labelsRegexKey, envRegexKey} {
+		if cfg[key] != "" {
+			a.patterns = append(a.patterns, cfg[key])
+		}
+	}
+	return a
+}
+
+func (a attrSchema) empty() bool {
+	return len(a.names) == 0 && len(a.patterns) == 0
+}
+
+// jsonSchema returns the JSON Schema of the records a container logging with
+// opts writes, which attrs describes the attributes of.
+func jsonSchema(opts LogOption, attrs attrSchema) map[string]any {
+	if opts.Format == formatParquet {
+		return map[string]any{
+			"$schema":     jsonSchemaDialect,
+			"title":       driverName + " parquet row",
+			"description": "A row of an object logged with format=parquet, as a parquet reader gives it. Markers are rows with an empty log, whose fields are in attrs.",
+			"type":        "object",
+			"properties":  parquetProperties(opts, attrs),
+			"required":    fieldNames(structFields(reflect.TypeFor[parquetRow](), "parquet")),
+
+			"additionalProperties": false,
+		}
+	}
+	var kinds []any
+	for _, k := range recordKinds(opts, attrs) {
+		props := make(map[string]any, len(k.fields))
+		var required []string
+		for _, f := range k.fields {
+			props[f.name] = fieldSchema(opts, attrs, k.event, f)
+			if f.required {
+				required = append(required, f.name)
+			}
+		}
+		s := map[string]any{
+			"type":       "object",
+			"properties": props,
+			"required":   required,
+		}
+		if k.event == "" {
+			s["title"] = "line"
+			// A line merged by merge-json-log brings its own keys.
+			s["additionalProperties"] = opts.MergeJSONLog
+		} else {
+			s["title"] = k.event
+			s["additionalProperties"] = false
+			props["event"] = map[string]any{"const": k.event, "description": fieldDoc(k.event, "event")}
+		}
+		kinds = append(kinds, s)
+	}
+	return map[string]any{
+		"$schema":     jsonSchemaDialect,
+		"title":       driverName + " " + opts.Format + " record",
+		"description": "A line of an object logged with format=" + opts.Format + ": the record of a line the container logged, or a marker the logger wrote among them.",
+		"anyOf":       kinds,
+	}
+}
+
+// fieldSchema returns the JSON Schema of field f of the records of event.
+func fieldSchema(opts LogOption, attrs attrSchema, event string, f schemaField) map[string]any {
+	switch {
+	case f.typ == reflect.TypeFor[json.RawMessage]():
+		if opts.TimestampFormat == timestampUnixMs {
+			return map[string]any{"type": "integer", "description": fieldDoc(event, f.name) + " In milliseconds since the epoch."}
+		}
+		return map[string]any{"type": "string", "format": "date-time", "description": fieldDoc(event, f.name) + " RFC 3339, in UTC."}
+	case f.name == "attrs":
+		return attrs.jsonSchema(fieldDoc(event, f.name))
+	}
+	s := map[string]any{"type": jsonType(f.typ)}
+	if f.typ == reflect.TypeFor[time.Time]() {
+		s["format"] = "date-time"
+	}
+	if doc := fieldDoc(event, f.name); doc != "" {
+		s["description"] = doc
+	}
+	if enum, ok := fieldEnums[event+"."+f.name]; ok {
+		s["enum"] = enum
+	} else if enum, ok := fieldEnums[f.name]; ok {
+		s["enum"] = enum
+	}
+	return s
+}
+
+// jsonSchema returns the JSON Schema of attrs.
+func (a attrSchema) jsonSchema(doc string) map[string]any {
+	props := make(map[string]any, len(a.names))
+	for k, d := range a.names {
+		props[k] = map[string]any{"type": "string", "description": d}
+	}
+	s := map[string]any{
+		"type":        "object",
+		"description": doc,
+		"properties":  props,
+	}
+	if len(a.required) > 0 {
+		s["required"] = a.required
+	}
+	if len(a.patterns) > 0 {
+		patterns := make(map[string]any, len(a.patterns))
+		for _, p := range a.patterns {
+			patterns[p] = map[string]any{"type": "string"}
+		}
+		s["patternProperties"] = patterns
+	}
+	s["additionalProperties"] = false
+	return s
+}
+
+// parquetProperties returns the JSON Schema of the columns of a parquet row.
+// Its attrs hold, along with the container's attributes, the fields of the
+// jsonl records of opts besides the columns, as strings.
+func parquetProperties(opts LogOption, attrs attrSchema) map[string]any {
+	columns := structFields(reflect.TypeFor[parquetRow](), "parquet")
+	rowAttrs := attrSchema{names: make(map[string]string, len(attrs.names)), required: attrs.required, patterns: attrs.patterns}
+	for k, d := range attrs.names {
+		rowAttrs.names[k] = d
+	}
+	jsonlOpts := opts
+	jsonlOpts.Format = formatJSONL
+	for _, k := range recordKinds(jsonlOpts, attrs) {
+		for _, f := range k.fields {
+			if slices.ContainsFunc(columns, func(c schemaField) bool { return c.name == f.name }) {
+				continue
+			}
+			doc := markerFieldDoc(k.event, f.name)
+			if prev, ok := rowAttrs.names[f.name]; ok && prev != doc {
+				doc = prev + " " + doc
+			}
+			rowAttrs.names[f.name] = doc
+		}
+	}
+	props := make(map[string]any, len(columns))
+	for _, c := range columns {
+		switch {
+		case c.name == "attrs":
+			props[c.name] = rowAttrs.jsonSchema(fieldDocs["attrs"] + " Also the fields of the record besides the columns, such as a marker's, as strings.")
+		case c.typ == reflect.TypeFor[time.Time]():
+			props[c.name] = map[string]any{"type": "string", "format": "date-time", "description": fieldDocs[c.name] + " To the microsecond, in UTC."}
+		default:
+			s := map[string]any{"type": jsonType(c.typ), "description": fieldDocs[c.name]}
+			if enum, ok := fieldEnums[c.name]; ok {
+				s["enum"] = enum
+			}
+			props[c.name] = s
+		}
+	}
+	return props
+}
+
+// jsonType returns the JSON Schema type of values of t.
+func jsonType(t reflect.Type) string {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Map, reflect.Struct:
+		if t == reflect.TypeFor[time.Time]() {
+			return "string"
+		}
+		return "object"
+	case reflect.Slice:
+		return "array"
+	}
+	return "string"
+}
+
+func fieldNames(fields []schemaField) []string {
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.name
+	}
+	return names
+}
+
+// glueTable is the definition of a Glue table, as aws glue create-table
+// takes it with --table-input.
+type glueTable struct {
+	Name              string            `json:"Name"`
+	Description       string            `json:"Description,omitempty"`
+	TableType         string            `json:"TableType"`
+	Parameters        map[string]string `json:"Parameters"`
+	PartitionKeys     []glueColumn      `json:"PartitionKeys,omitempty"`
+	StorageDescriptor glueStorage       `json:"StorageDescriptor"`
+}
+
+type glueColumn struct {
+	Name    string `json:"Name"`
+	Type    string `json:"Type"`
+	Comment string `json:"Comment,omitempty"`
+}
+
+type glueStorage struct {
+	Columns      []glueColumn `json:"Columns"`
+	Location     string       `json:"Location"`
+	InputFormat  string       `json:"InputFormat"`
+	OutputFormat string       `json:"OutputFormat"`
+	SerdeInfo    glueSerde    `json:"SerdeInfo"`
+}
+
+type glueSerde struct {
+	SerializationLibrary string `json:"SerializationLibrary"`
+}
+
+// glueSchema returns the Glue table named name over the objects of a
+// container logging with opts, partitioned as partition-by partitions them.
+// A jsonl table has a column for each field of any of its kinds of records.
+func glueSchema(opts LogOption, attrs attrSchema, name string) (glueTable, error) {
+	if opts.SplitStreams && opts.PartitionBy != partitionNone {
+		return glueTable{}, fmt.Errorf("--format=%s can't describe %s with %s, whose partitions are under each stream's prefix", schemaFormatGlue, splitStreamsKey, partitionByKey)
+	}
+	t := glueTable{
+		Name:        name,
+		Description: "Logs " + driverName + " uploads to s3://" + opts.S3Bucket + "/" + opts.S3Prefix,
+		TableType:   "EXTERNAL_TABLE",
+		Parameters:  map[string]string{"EXTERNAL": "TRUE"},
+		StorageDescriptor: glueStorage{
+			Location: "s3://" + opts.S3Bucket + "/" + opts.S3Prefix,
+		},
+	}
+	switch opts.PartitionBy {
+	case partitionHour:
+		t.PartitionKeys = []glueColumn{{Name: "dt", Type: "string"}, {Name: "hour", Type: "string"}}
+	case partitionDay:
+		t.PartitionKeys = []glueColumn{{Name: "dt", Type: "string"}}
+	}
+	sd := &t.StorageDescriptor
+	if opts.Format == formatParquet {
+		t.Parameters["classification"] = "parquet"
+		sd.InputFormat = "org.apache.hadoop.hive.ql.io.parquet.MapredParquetInputFormat"
+		sd.OutputFormat = "org.apache.hadoop.hive.ql.io.parquet.MapredParquetOutputFormat"
+		sd.SerdeInfo.SerializationLibrary = "org.apache.hadoop.hive.ql.io.parquet.serde.ParquetHiveSerDe"
+		for _, c := range structFields(reflect.TypeFor[parquetRow](), "parquet") {
+			sd.Columns = append(sd.Columns, glueColumn{Name: c.name, Type: glueType(opts, c), Comment: glueComment(fieldDocs[c.name])})
+		}
+		return t, nil
+	}
+	t.Parameters["classification"] = "json"
+	sd.InputFormat = "org.apache.hadoop.mapred.TextInputFormat"
+	sd.OutputFormat = "org.apache.hadoop.hive.ql.io.HiveIgnoreKeyTextOutputFormat"
+	sd.SerdeInfo.SerializationLibrary = "org.openx.data.jsonserde.JsonSerDe"
+	for _, k := range recordKinds(opts, attrs) {
+		for _, f := range k.fields {
+			doc := markerFieldDoc(k.event, f.name)
+			// A field two markers have is a column of both.
+			if i := slices.IndexFunc(sd.Columns, func(c glueColumn) bool { return c.Name == f.name }); i >= 0 {
+				if !strings.Contains(sd.Columns[i].Comment, doc) {
+					sd.Columns[i].Comment = glueComment(sd.Columns[i].Comment + " " + doc)
+				}
+				continue
+			}
+			sd.Columns = append(sd.Columns, glueColumn{Name: f.name, Type: glueType(opts, f), Comment: glueComment(doc)})
+		}
+	}
+	return t, nil
+}
+
+// glueType returns the Glue type of field f of a record written with opts.
+func glueType(opts LogOption, f schemaField) string {
+	t := f.typ
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == reflect.TypeFor[json.RawMessage]():
+		if opts.TimestampFormat == timestampUnixMs {
+			return "bigint"
+		}
+		return "string"
+	case t == reflect.TypeFor[time.Time]():
+		// The JSON SerDe can't read RFC 3339 timestamps as timestamps.
+		if opts.Format == formatParquet {
+			return "timestamp"
+		}
+		return "string"
+	}
+	switch jsonType(t) {
+	case "boolean":
+		return "boolean"
+	case "integer":
+		return "bigint"
+	case "number":
+		return "double"
+	case "object":
+		return "map<string,string>"
+	}
+	return "string"
+}
+
+func glueComment(doc string) string {
+	if len(doc) > maxGlueComment {
+		doc = strings.TrimSpace(doc[:maxGlueComment-3]) + "..."
+	}
+	return doc
+}
+
+// RunSchema runs the schema command, which prints the schema of the records
+// a container logging with the given log-opts writes: a JSON Schema, or with
+// --format=glue the definition of a Glue table over its objects. It returns
+// the exit status.
+func RunSchema(args []string) int {
+	fs := flag.NewFlagSet(driverName+" schema", flag.ExitOnError)
+	logOpts := logOptFlag{}
+	fs.Var(logOpts, "log-opt", "log-opt of the container, as key=value; may be repeated")
+	format := fs.String("format", schemaFormatJSON, "schema to print: "+schemaFormatJSON+", or "+schemaFormatGlue+" for a Glue table definition")
+	table := fs.String("table", driverName, "name of the Glue table")
+	fs.Parse(args)
+
+	if *format != schemaFormatJSON && *format != schemaFormatGlue {
+		fmt.Fprintf(os.Stderr, "invalid --format %q: must be %q or %q\n", *format, schemaFormatJSON, schemaFormatGlue)
+		return 2
+	}
+	var defaults LogOption
+	optionFlags(flag.NewFlagSet(driverName, flag.ContinueOnError), &defaults)
+	opts, err := parseLogOpts(defaults, logOpts)
+	if err == nil && opts.Format == formatRaw {
+		err = errors.New("format=raw writes lines as they were logged, which have no schema")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	attrs := attrsOf(opts, logOpts)
+	var schema any
+	if *format == schemaFormatGlue {
+		if schema, err = glueSchema(opts, attrs, *table); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	} else {
+		schema = jsonSchema(opts, attrs)
+	}
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s\n", data)
+	return 0
+}
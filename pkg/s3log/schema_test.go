@@ -0,0 +1,300 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// compileSchema compiles the JSON Schema the schema command printed.
+func compileSchema(t *testing.T, data string) *jsonschema.Schema {
+	t.Helper()
+	doc, err := jsonschema.UnmarshalJSON(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("schema %s: %v", data, err)
+	}
+	c := jsonschema.NewCompiler()
+	c.AssertFormat()
+	if err := c.AddResource("schema.json", doc); err != nil {
+		t.Fatal(err)
+	}
+	sch, err := c.Compile("schema.json")
+	if err != nil {
+		t.Fatalf("compiling schema %s: %v", data, err)
+	}
+	return sch
+}
+
+// validateRecord reports whether the record data is valid under sch.
+func validateRecord(sch *jsonschema.Schema, data []byte) error {
+	inst, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return sch.Validate(inst)
+}
+
+// schemaArgs returns the arguments of the schema command for a container
+// with the log-opts cfg.
+func schemaArgs(cfg map[string]string, args ...string) []string {
+	for k, v := range cfg {
+		args = append(args, "--log-opt", k+"="+v)
+	}
+	return append(args, "--log-opt", s3BucketKey+"="+testBucket)
+}
+
+// logSampleRecords has a container logging with cfg write a sample of each
+// kind of record it has: lines, among them a JSON one, a long one and one
+// stamped in the future, the same lines again after a flush, and a gap
+// before it stops.
+func logSampleRecords(t *testing.T, fake *fakeS3, cfg map[string]string) string {
+	t.Helper()
+	d := newTestDriver(t, fake, nil)
+	info := Info{
+		Config:          testLogOpts(t, cfg),
+		ContainerID:     testContainerID(t),
+		ContainerName:   "/web",
+		ContainerLabels: map[string]string{"team": "payments", "com.example.tier": "web"},
+		ContainerEnv:    []string{"DEPLOY=blue"},
+	}
+	c := startContainerInfo(t, d, info)
+	lf, err := d.lookup(info.ContainerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _ := lf.logger()
+	now := time.Now()
+	lines := []*Message{
+		{Line: []byte("plain line"), Source: "stdout", Timestamp: now},
+		{Line: []byte(`{"level":"error","msg":"failed"}`), Source: "stderr", Timestamp: now},
+		{Line: []byte(strings.Repeat("long ", 400)), Source: "stdout", Timestamp: now},
+		{Line: []byte("from the future"), Source: "stdout", Timestamp: now.Add(time.Hour)},
+	}
+	for round := range 2 {
+		for _, msg := range lines {
+			if err := l.Log(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, sl := range s3Loggers(l) {
+			if round == 1 {
+				sl.noteGap(gapBufferFull, 2, 3, 6)
+			}
+			if err := sl.flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	c.stop(t, d)
+	return info.ContainerID
+}
+
+func TestSchemaValidatesRecords(t *testing.T) {
+	// Every record a container writes is valid under the schema the schema
+	// command prints for its log-opts, and is described by a column of the
+	// Glue table.
+	tests := []struct {
+		name       string
+		cfg        map[string]string
+		wantEvents []string // besides log_gap
+	}{
+		{name: "defaults"},
+		{name: "attrs", cfg: map[string]string{labelsKey: "team,missing", envKey: "DEPLOY", labelsRegexKey: `^com\.example\.`, groupByLabelKey: "team"}},
+		{name: "markers", cfg: map[string]string{dedupeWindowKey: "1m", dedupeGranularityKey: dedupeRecord, exitEventKey: "true"}, wantEvents: []string{eventDuplicate, eventStopped}},
+		{name: "unix-ms", cfg: map[string]string{timestampKey: timestampUnixMs}},
+		{name: "no timestamp", cfg: map[string]string{timestampKey: timestampNone}},
+		{name: "split", cfg: map[string]string{maxRecordBytesKey: "1024", oversizePolicyKey: oversizeSplit}},
+		{name: "truncate", cfg: map[string]string{maxRecordBytesKey: "1024", oversizePolicyKey: oversizeTruncate}},
+		{name: "merge json", cfg: map[string]string{mergeJSONLogKey: "true"}},
+		{name: "future skew", cfg: map[string]string{maxFutureSkewKey: "1m"}},
+		{name: "split streams", cfg: map[string]string{splitStreamsKey: "true", exitEventKey: "true"}, wantEvents: []string{eventStopped}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, schema, stderr := runCommand(t, RunSchema, schemaArgs(tt.cfg)...)
+			if code != 0 {
+				t.Fatalf("schema exited %d: %s", code, stderr)
+			}
+			sch := compileSchema(t, schema)
+			code, table, stderr := runCommand(t, RunSchema, schemaArgs(tt.cfg, "--format", schemaFormatGlue)...)
+			if code != 0 {
+				t.Fatalf("schema --format glue exited %d: %s", code, stderr)
+			}
+			var glue glueTable
+			if err := json.Unmarshal([]byte(table), &glue); err != nil {
+				t.Fatal(err)
+			}
+			columns := map[string]string{}
+			for _, c := range glue.StorageDescriptor.Columns {
+				columns[c.Name] = c.Type
+			}
+
+			fake := newFakeS3()
+			id := logSampleRecords(t, fake, tt.cfg)
+			events := map[string]bool{}
+			var records int
+			for _, key := range fake.logKeys(testBucket) {
+				if !strings.Contains(key, id) {
+					continue
+				}
+				o, _ := fake.object(testBucket, key)
+				for _, line := range bytes.Split(bytes.TrimSpace(o.data), []byte("\n")) {
+					records++
+					if err := validateRecord(sch, line); err != nil {
+						t.Errorf("record %s isn't valid under the schema: %v", line, err)
+					}
+					var rec map[string]any
+					if err := json.Unmarshal(line, &rec); err != nil {
+						t.Fatal(err)
+					}
+					if e, ok := rec["event"].(string); ok {
+						events[e] = true
+					}
+					if tt.cfg[mergeJSONLogKey] != "" {
+						continue
+					}
+					for k, v := range rec {
+						if want := map[bool]string{true: "map<string,string>"}[k == "attrs"]; columns[k] == "" || want != "" && columns[k] != want {
+							t.Errorf("field %s = %v of record %s is column %q of the table", k, v, line, columns[k])
+						}
+					}
+				}
+			}
+			if records < 6 {
+				t.Fatalf("uploaded %d records, want the sample's", records)
+			}
+			for _, e := range append([]string{eventLogGap}, tt.wantEvents...) {
+				if !events[e] {
+					t.Errorf("no %s record among the sample's, which has %v", e, events)
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaRejects(t *testing.T) {
+	// The schema isn't so loose that anything passes.
+	code, schema, stderr := runCommand(t, RunSchema, schemaArgs(map[string]string{labelsKey: "team"})...)
+	if code != 0 {
+		t.Fatalf("schema exited %d: %s", code, stderr)
+	}
+	sch := compileSchema(t, schema)
+	valid := `{"log":"line","stream":"stdout","seq":1,"time":"2024-05-01T12:00:00Z","container_id":"c","tag":"t","attrs":{"team":"payments"}}`
+	if err := validateRecord(sch, []byte(valid)); err != nil {
+		t.Fatalf("record %s isn't valid: %v", valid, err)
+	}
+	for _, invalid := range []string{
+		`{"log":"line","stream":"stdout","seq":1,"time":"2024-05-01T12:00:00Z","container_id":"c","tag":"t","extra":true}`,
+		`{"log":"line","stream":"stdin","seq":1,"time":"2024-05-01T12:00:00Z","container_id":"c","tag":"t"}`,
+		`{"log":"line","stream":"stdout","seq":"1","time":"2024-05-01T12:00:00Z","container_id":"c","tag":"t"}`,
+		`{"log":"line","stream":"stdout","seq":1,"time":"yesterday","container_id":"c","tag":"t"}`,
+		`{"log":"line","stream":"stdout","seq":1,"time":"2024-05-01T12:00:00Z","container_id":"c","tag":"t","attrs":{"other":"x"}}`,
+		`{"stream":"stdout","seq":1,"time":"2024-05-01T12:00:00Z","container_id":"c","tag":"t"}`,
+		`{"event":"log_gap","stream":"stderr","seq":1,"time":"2024-05-01T12:00:00Z","container_id":"c","tag":"t","dropped_lines":1,"from_seq":0,"to_seq":2,"reason":"bored"}`,
+	} {
+		if validateRecord(sch, []byte(invalid)) == nil {
+			t.Errorf("record %s is valid under the schema", invalid)
+		}
+	}
+}
+
+func TestSchemaParquet(t *testing.T) {
+	// The rows of parquet objects, as a reader gives them, are valid under
+	// the schema of the parquet row.
+	cfg := map[string]string{formatKey: formatParquet, labelsKey: "team"}
+	code, schema, stderr := runCommand(t, RunSchema, schemaArgs(cfg)...)
+	if code != 0 {
+		t.Fatalf("schema exited %d: %s", code, stderr)
+	}
+	sch := compileSchema(t, schema)
+	fake := newFakeS3()
+	logSampleRecords(t, fake, cfg)
+	var rows int
+	for _, key := range fake.logKeys(testBucket) {
+		o, _ := fake.object(testBucket, key)
+		for _, row := range readParquet(t, o.data) {
+			rows++
+			data, err := json.Marshal(map[string]any{
+				"time":         row.Time.UTC().Format(time.RFC3339Nano),
+				"seq":          row.Seq,
+				"stream":       row.Stream,
+				"container_id": row.ContainerID,
+				"tag":          row.Tag,
+				"log":          row.Log,
+				"attrs":        row.Attrs,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := validateRecord(sch, data); err != nil {
+				t.Errorf("row %s isn't valid under the schema: %v", data, err)
+			}
+		}
+	}
+	if rows < 9 {
+		t.Errorf("uploaded %d rows, want the sample's", rows)
+	}
+}
+
+func TestRunSchema(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+		wantStderr string
+	}{
+		{name: "json schema", args: schemaArgs(nil), wantStdout: `"$schema": "` + jsonSchemaDialect + `"`},
+		{name: "glue", args: schemaArgs(map[string]string{partitionByKey: partitionDay}, "--format", schemaFormatGlue, "--table", "web_logs"), wantStdout: `"Name": "web_logs"`},
+		{name: "glue partitions", args: schemaArgs(map[string]string{partitionByKey: partitionHour}, "--format", schemaFormatGlue), wantStdout: `"Name": "hour"`},
+		{name: "raw", args: schemaArgs(map[string]string{formatKey: formatRaw}), wantCode: 1, wantStderr: "have no schema"},
+		{name: "bad format", args: schemaArgs(nil, "--format", "avro"), wantCode: 2, wantStderr: `invalid --format "avro"`},
+		{name: "bad log-opt", args: schemaArgs(map[string]string{compressKey: "lz4"}), wantCode: 1, wantStderr: `invalid compress "lz4"`},
+		{name: "split partitions", args: schemaArgs(map[string]string{splitStreamsKey: "true", partitionByKey: partitionDay}, "--format", schemaFormatGlue), wantCode: 1, wantStderr: splitStreamsKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, stdout, stderr := runCommand(t, RunSchema, tt.args...)
+			if code != tt.wantCode {
+				t.Fatalf("exit status %d, want %d; stderr %s", code, tt.wantCode, stderr)
+			}
+			if !strings.Contains(stdout, tt.wantStdout) || !strings.Contains(stderr, tt.wantStderr) {
+				t.Errorf("printed %q and %q, want %q and %q", stdout, stderr, tt.wantStdout, tt.wantStderr)
+			}
+		})
+	}
+}
+
+func TestSchemaFieldsDocumented(t *testing.T) {
+	// Every field of every kind of record has a description, so that a new
+	// field can't be added without one.
+	opts, err := parseLogOpts(DefaultOptions(), map[string]string{
+		s3BucketKey:          testBucket,
+		dedupeWindowKey:      "1m",
+		exitEventKey:         "true",
+		maxRecordBytesKey:    "1024",
+		maxFutureSkewKey:     "1m",
+		dedupeGranularityKey: dedupeRecord,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range recordKinds(opts, attrSchema{names: map[string]string{"team": "x"}}) {
+		for _, f := range k.fields {
+			if fieldDoc(k.event, f.name) == "" {
+				t.Errorf("field %s of %q records has no description", f.name, k.event)
+			}
+		}
+	}
+	for _, f := range structFields(reflect.TypeFor[parquetRow](), "parquet") {
+		if fieldDocs[f.name] == "" {
+			t.Errorf("parquet column %s has no description", f.name)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const defaultSelftestTimeout = time.Minute
+
+// RunSelftest runs the selftest command, which checks from the host that the
+// plugin can write to the buckets its flags name before any container is
+// pointed at them. It takes the same log-opt flags as the plugin and returns
+// the exit status: 0 if every check passed.
+func RunSelftest(args []string) int {
+	var opts LogOption
+	fs := flag.NewFlagSet(driverName+" selftest", flag.ExitOnError)
+	allowInsecure := fs.Bool(allowInsecureKey, false, "allow "+insecureSkipVerifyKey)
+	timeout := fs.Duration("timeout", defaultSelftestTimeout, "time the whole test may take")
+	levelVal := fs.String("log-level", "warn", "level of the plugin's own logs while testing")
+	optionFlags(fs, &opts)
+	fs.Parse(args)
+
+	setLogLevel(*levelVal)
+	opts, err := parseLogOpts(opts, nil)
+	if !report(os.Stdout, opParseOptions, "", err) {
+		return 1
+	}
+	ssec, err := loadSSECKey(opts.SSECKeyFile)
+	if !report(os.Stdout, opParseOptions, "", err) {
+		return 1
+	}
+	clients := newClientFactory(loadAWSConfig(), opts.Concurrency, *allowInsecure)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	passed := true
+	for _, r := range append([]replica{{Bucket: opts.S3Bucket, Region: opts.S3Region}}, opts.Replicas...) {
+		if !selftest(ctx, os.Stdout, clients, opts, ssec, r) {
+			passed = false
+		}
+	}
+	if !passed {
+		fmt.Println("FAIL")
+		return 1
+	}
+	fmt.Println("PASS")
+	return 0
+}
+
+// selftest resolves the credentials and region of a bucket, checks it with
+// HeadBucket, writes the probe object and reads it back, with ssec if it is
+// set, reporting each step to w and stopping at the first that fails. With
+// upload-mode=presigned it only writes the probe, having no credentials for
+// the rest.
+func selftest(ctx context.Context, w io.Writer, clients *clientFactory, opts LogOption, ssec *sseCKey, r replica) bool {
+	cfg := opts.clientConfig()
+	if r.Region != "" {
+		cfg.Region = r.Region
+	}
+	cfg, err := clients.resolve(ctx, r.Bucket, cfg)
+	if !report(w, opLoadCreds+" and region of bucket", r.Bucket, err) {
+		return false
+	}
+	client, err := clients.client(cfg)
+	if err != nil {
+		return report(w, opLoadCreds, r.Bucket, err)
+	}
+
+	uploader, err := clients.uploader(cfg, client)
+	if err != nil {
+		return report(w, opLoadCreds, r.Bucket, err)
+	}
+	presigned := cfg.Presign.Endpoint != ""
+
+	if !presigned {
+		err = headBucket(ctx, client, r.Bucket, opts.RequestPayer)
+		if !report(w, opCheckBucket, r.Bucket, describeAccessError(err)) {
+			return false
+		}
+	}
+
+	body := []byte(fmt.Sprintf("%s %s selftest at %s\n", driverName, version, time.Now().UTC().Format(time.RFC3339Nano)))
+	b := probeBatch(opts, r.Bucket, body)
+	b.ssec = ssec
+	err = uploadBatch(ctx, uploader, b)
+	if !report(w, opVerifyWrite, r.Bucket, describeAccessError(err)) {
+		return false
+	}
+	if presigned {
+		return true
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(r.Bucket),
+		Key:          aws.String(b.Key),
+		RequestPayer: types.RequestPayer(opts.RequestPayer),
+	}
+	if b.versionID != "" {
+		input.VersionId = aws.String(b.versionID)
+	}
+	ssec.set(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	out, err := client.GetObject(ctx, input)
+	if err == nil {
+		var data []byte
+		data, err = io.ReadAll(out.Body)
+		out.Body.Close()
+		if err == nil && !bytes.Equal(data, body) {
+			err = fmt.Errorf("probe object %q doesn't hold what was written to it", b.Key)
+		}
+	}
+	return report(w, opReadProbe, r.Bucket, describeAccessError(err))
+}
+
+// report writes the outcome of op on bucket to w and returns whether it
+// succeeded.
+func report(w io.Writer, op, bucket string, err error) bool {
+	if err != nil {
+		var e *opError
+		if !errors.As(err, &e) {
+			err = newOpError(op, bucket, err)
+		}
+		fmt.Fprintf(w, "FAIL %v\n", err)
+		return false
+	}
+	if bucket != "" {
+		op += fmt.Sprintf(" %q", bucket)
+	}
+	fmt.Fprintf(w, "ok   %s\n", op)
+	return true
+}
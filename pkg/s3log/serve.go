@@ -0,0 +1,280 @@
+package s3log
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/sirupsen/logrus"
+)
+
+var logLevels = map[string]logrus.Level{
+	"debug": logrus.DebugLevel,
+	"info":  logrus.InfoLevel,
+	"warn":  logrus.WarnLevel,
+	"error": logrus.ErrorLevel,
+}
+
+// Serve runs the plugin with args as its flags, handing serve the driver and
+// its socket to serve the log driver API on until it is told to exit. The
+// plugin's caches are opened with openCache.
+func Serve(args []string, openCache OpenCacheStore, serve func(*Driver, net.Listener) error) {
+	var opts LogOption
+	fs := flag.NewFlagSet(driverName, flag.ExitOnError)
+	metricsAddr := fs.String(metricsAddrKey, "", "address to serve Prometheus metrics on, e.g. :9090; disabled when empty")
+	uploadWorkers := fs.Int(uploadWorkersKey, defaultUploadWorkers, "number of uploads run at once across all containers")
+	maxIdleConns := fs.Int(maxIdleConnsKey, 0, "idle connections kept per S3 host, 0 for the upload workers times the upload concurrency")
+	breakerThreshold := fs.Int(breakerThresholdKey, defaultBreakerThreshold, "consecutive failed uploads to a bucket that open its circuit breaker, 0 to disable it")
+	maxTotalBuffer := fs.Int64(maxTotalBufferKey, defaultMaxTotalBuffer, "bytes buffered across all containers before batches are spooled or dropped")
+	breakerCooldown := fs.Duration(breakerCooldownKey, defaultBreakerCooldown, "how long an open circuit breaker holds off uploads before probing the bucket")
+	maxPuts := fs.Float64(maxPutsKey, 0, "flushes' PUT requests a second across all containers, 0 for no limit")
+	dailyBytes := fs.Int64(dailyBytesBudgetKey, 0, "bytes uploaded across all containers each UTC day before the over-budget policy applies, 0 for no limit")
+	dailyObjects := fs.Int64(dailyObjectBudgetKey, 0, "objects uploaded across all containers each UTC day before the over-budget policy applies, 0 for no limit")
+	overBudget := fs.String(overBudgetPolicyKey, overBudgetContinue, "what uploads over a daily budget do: drop, spool or continue-with-warning")
+	allowInsecure := fs.Bool(allowInsecureKey, false, "let containers set "+insecureSkipVerifyKey)
+	allowedRetention := fs.String(allowedRetentionDaysKey, "", "comma-separated retention-days containers may ask for, e.g. 7,30,90,365; any when empty")
+	compactInterval := fs.Duration(compactIntervalKey, 0, "how often the objects of stopped containers are merged into larger ones, 0 to disable compaction")
+	compactWindow := fs.Duration(compactWindowKey, defaultCompactWindow, "span of time whose objects compaction merges together")
+	compactMinObjects := fs.Int(compactMinObjectsKey, defaultCompactMinObjects, "objects a window must hold for compaction to merge them")
+	permissionsCheck := fs.Bool(permissionsCheckKey, false, "check at startup, with harmless requests, every permission the defaults need, exiting with those missing")
+	startupProbeTimeout := fs.Duration(startupProbeTimeoutKey, defaultStartupProbeTimeout, "how long containers are refused while S3 can't be reached at startup before the plugin exits, 0 to accept them at once")
+	dockerSocket := fs.String(dockerSocketKey, "", "Docker API socket the daemon's events are followed on, for exit-event, e.g. /run/docker.sock; disabled when empty")
+	otelEndpoint := fs.String(otelEndpointKey, "", "OTLP/HTTP URL upload spans are exported to, e.g. http://collector:4318; $OTEL_EXPORTER_OTLP_ENDPOINT when empty, disabled without either")
+	socketPath := fs.String(socketPathKey, defaultSocketPath, "path of the unix socket the daemon talks to the plugin on")
+	socketGID := fs.String(socketGIDKey, "0", "group, by gid or name, given access to the socket")
+	shutdownTimeout := fs.Duration(shutdownTimeoutKey, defaultShutdownTimeout, "how long the plugin may take on SIGTERM or SIGINT to drain and flush every logger and the spools before it exits anyway")
+	fs.String(configFileKey, "", "YAML file of flags, by name without their dashes, overridden by the command line and by $"+configEnvPrefix+"<FLAG> env vars; re-read on SIGHUP")
+	levelVal := fs.String(logLevelKey, os.Getenv("LOG_LEVEL"), "level of the plugin's own logs (debug, info, warn or error), defaulting to $LOG_LEVEL or info; DEBUG=1 forces debug")
+	showVersion := fs.Bool("version", false, "print the plugin's version and exit")
+	buildInfo := fs.Bool(buildInfoKey, false, "print the plugin's version and the modules it was built from and exit")
+	optionFlags(fs, &opts)
+	fs.Parse(args)
+	cfg, err := loadFlagConfig(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := cfg.apply(fs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *showVersion || *buildInfo {
+		writeVersion(os.Stdout, *buildInfo)
+		return
+	}
+	setLogLevel(*levelVal)
+	logrus.WithField("version", version).WithField("commit", orUnknown(commit)).WithField("built", orUnknown(buildDate)).Info("starting plugin")
+	awsCfg := loadAWSConfig()
+
+	var ready *readiness
+	if *startupProbeTimeout > 0 {
+		ready = newReadiness()
+	}
+	var metrics *http.Server
+	if *metricsAddr != "" {
+		metrics = serveMetrics(*metricsAddr, ready)
+	}
+
+	if *uploadWorkers <= 0 {
+		logrus.Fatalf("invalid --%s %d%s: must be positive", uploadWorkersKey, *uploadWorkers, cfg.origin(uploadWorkersKey))
+	}
+	if *maxIdleConns < 0 {
+		logrus.Fatalf("invalid --%s %d%s: must not be negative", maxIdleConnsKey, *maxIdleConns, cfg.origin(maxIdleConnsKey))
+	}
+	idleConns := *uploadWorkers * opts.Concurrency
+	if *maxIdleConns > 0 {
+		idleConns = *maxIdleConns
+	}
+	if *breakerCooldown <= 0 {
+		logrus.Fatalf("invalid --%s %s%s: must be positive", breakerCooldownKey, *breakerCooldown, cfg.origin(breakerCooldownKey))
+	}
+	if *shutdownTimeout <= 0 {
+		logrus.Fatalf("invalid --%s %s%s: must be positive", shutdownTimeoutKey, *shutdownTimeout, cfg.origin(shutdownTimeoutKey))
+	}
+	if *maxTotalBuffer <= 0 {
+		logrus.Fatalf("invalid --%s %d%s: must be positive", maxTotalBufferKey, *maxTotalBuffer, cfg.origin(maxTotalBufferKey))
+	}
+	gid, err := lookupGID(*socketGID)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if *maxPuts < 0 {
+		logrus.Fatalf("invalid --%s %g%s: must not be negative", maxPutsKey, *maxPuts, cfg.origin(maxPutsKey))
+	}
+	if err := setupTracing(*otelEndpoint); err != nil {
+		logrus.Fatal(err)
+	}
+	pool := newUploadPool(*uploadWorkers, *breakerThreshold, *breakerCooldown, *maxPuts)
+	var costPath string
+	if opts.StateDir != "" {
+		costPath = filepath.Join(opts.StateDir, costBudgetName)
+	}
+	if pool.cost, err = newCostBudget(*dailyBytes, *dailyObjects, *overBudget, costPath, ""); err != nil {
+		logrus.Fatal(err)
+	}
+	if pool.cost != nil && costPath == "" {
+		logrus.Warnf("no --%s, daily budget usage starts from nothing each time the plugin starts", stateDirKey)
+	}
+	if err := pool.addTenants(cfg.tenants, opts, *overBudget, opts.StateDir); err != nil {
+		logrus.Fatalf("invalid config file %s: %v", cfg.path, err)
+	}
+	d := newDriver(newClientFactory(awsCfg, idleConns, *allowInsecure), pool, newMemoryBudget(*maxTotalBuffer), opts)
+	d.openCache = openCache
+	if d.allowedRetention, err = parseAllowedRetention(*allowedRetention); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := d.checkRetention(opts); err != nil {
+		logrus.Fatal(err)
+	}
+	if *permissionsCheck {
+		checkPluginPermissions(d.clients, opts, *compactInterval > 0, defaultSelftestTimeout)
+	}
+	if *dockerSocket != "" {
+		d.docker = newDockerEvents(*dockerSocket)
+		go d.docker.run(d.ctx)
+	}
+	if ready != nil {
+		d.ready = ready
+		go ready.probeStartup(d.clients, opts, *startupProbeTimeout)
+	}
+	if *compactInterval > 0 {
+		if *compactWindow <= 0 {
+			logrus.Fatalf("invalid --%s %s%s: must be positive", compactWindowKey, *compactWindow, cfg.origin(compactWindowKey))
+		}
+		if *compactMinObjects < 2 {
+			logrus.Fatalf("invalid --%s %d%s: must be at least 2", compactMinObjectsKey, *compactMinObjects, cfg.origin(compactMinObjectsKey))
+		}
+		d.startCompactor(*compactInterval, *compactWindow, *compactMinObjects)
+	}
+	if _, err := d.spoolFor(opts.SpoolDir, opts.SpoolMaxBytes); err != nil {
+		logrus.WithField("dir", opts.SpoolDir).WithError(err).Fatal("error opening spool")
+	}
+
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGUSR1)
+	go func() {
+		for range dump {
+			if err := d.dumpStats(os.Stderr); err != nil {
+				logrus.WithError(err).Error("error writing stats")
+			}
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if cfg.path == "" {
+				logrus.Warnf("no --%s to reload", configFileKey)
+				continue
+			}
+			next, err := d.reload(fs, cfg)
+			if err != nil {
+				logrus.WithError(err).Error("error reloading config file, keeping the running config")
+			}
+			cfg = next
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		logrus.WithField("signal", sig).Info("flushing loggers before exit")
+		os.Exit(shutdown(d, metrics, *shutdownTimeout))
+	}()
+
+	l, err := listenUnix(*socketPath, gid)
+	if err != nil {
+		logrus.WithField("socket", *socketPath).WithError(err).Fatal("error creating socket")
+	}
+	logrus.WithField("socket", *socketPath).WithField("bucket", opts.S3Bucket).Info("serving log driver")
+	if err := serve(d, l); err != nil {
+		logrus.WithError(err).Fatal("error serving log driver")
+	}
+}
+
+// shutdown shuts d down within timeout, then the metrics and health
+// endpoints, which are the last to go so the shutdown can be watched to the
+// end. It returns the plugin's exit status: 1 if the shutdown ran out of
+// time.
+func shutdown(d *Driver, metrics *http.Server, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := d.Shutdown(ctx)
+	if metrics != nil {
+		metrics.Shutdown(ctx)
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// setLogLevel sets the level of the plugin's own logs, exiting if it isn't
+// one of logLevels.
+func setLogLevel(levelVal string) {
+	level, err := parseLogLevel(levelVal)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid log level: ", levelVal)
+		os.Exit(1)
+	}
+	logrus.SetLevel(level)
+	logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+
+}
+
+// parseLogLevel returns the level of logLevels named levelVal, info if it
+// is empty, or debug whatever it is with DEBUG=1.
+func parseLogLevel(levelVal string) (logrus.Level, error) {
+	if levelVal == "" {
+		levelVal = "info"
+	}
+	if debug, _ := strconv.ParseBool(os.Getenv("DEBUG")); debug {
+		levelVal = "debug"
+	}
+	level, exists := logLevels[levelVal]
+	if !exists {
+		return 0, fmt.Errorf("must be debug, info, warn or error")
+	}
+	return level, nil
+}
+
+// loadAWSConfig loads the plugin's default AWS configuration, with its
+// credential chain.
+func loadAWSConfig() aws.Config {
+	awsCfg, err := newAWSConfig()
+	if err != nil {
+		logrus.WithError(err).Fatal("error loading AWS config")
+	}
+	return awsCfg
+}
+
+// newAWSConfig loads the default AWS configuration and sets up the default
+// credential chain with it.
+func newAWSConfig() (aws.Config, error) {
+	awsCfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return aws.Config{}, err
+	}
+	defaultCredentials = newCredentialChain(awsCfg)
+	awsCfg.Credentials = aws.NewCredentialsCache(defaultCredentials)
+	credsCtx, cancel := context.WithTimeout(context.Background(), credentialsTimeout)
+	if _, err := awsCfg.Credentials.Retrieve(credsCtx); err != nil {
+		logrus.WithError(err).Warn("no default AWS credentials, containers must configure their own")
+	}
+	cancel()
+
+	return awsCfg, nil
+}
@@ -0,0 +1,121 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	shutdownTimeoutKey = "shutdown-timeout"
+
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+// errShuttingDown refuses the containers started once the plugin is
+// shutting down.
+var errShuttingDown = errors.New("plugin is shutting down, retry starting the container once it is back")
+
+// Shutdown stops the plugin in order: it refuses new containers and stops
+// the compactor, then has every logger drain its FIFO and upload what it
+// holds through the upload pool, gives the spools a last drain, waits for
+// the loggers' last spans to be exported and stops the pool's workers. Whatever is still under way once ctx is done is abandoned,
+// and an error returned once what was lost is logged: the buffers of the
+// loggers still closing, which are cancelled, and the batches left spooled.
+// Only the first call does anything.
+func (d *Driver) Shutdown(ctx context.Context) error {
+	defer d.cancel()
+	start := time.Now()
+
+	d.mu.Lock()
+	if d.closing {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closing = true
+	pairs := make([]*logPair, 0, len(d.logs))
+	for file, lf := range d.logs {
+		pairs = append(pairs, lf)
+		delete(d.logs, file)
+		delete(d.idx, lf.info.ContainerID)
+	}
+	containersLogging.Set(0)
+	spools := make([]*spool, 0, len(d.spools))
+	for _, sp := range d.spools {
+		spools = append(spools, sp)
+	}
+	d.mu.Unlock()
+	uncompacted := d.compactor.close(ctx)
+	logrus.WithField("containers", len(pairs)).Info("shutting down, refusing new containers")
+
+	closed := make(chan *logPair, len(pairs))
+	for _, lf := range pairs {
+		go func(lf *logPair) {
+			if err := lf.stop(nil); err != nil {
+				logrus.WithField("id", lf.info.ContainerID).WithError(err).Error("error closing logger")
+			}
+			lf.routines.wait(goroutineStopTimeout)
+			_, cache := lf.logger()
+			cache.close()
+			closed <- lf
+		}(lf)
+	}
+	closing := make(map[*logPair]bool, len(pairs))
+	for _, lf := range pairs {
+		closing[lf] = true
+	}
+	for len(closing) > 0 && ctx.Err() == nil {
+		select {
+		case lf := <-closed:
+			delete(closing, lf)
+		case <-ctx.Done():
+		}
+	}
+	if len(closing) == 0 {
+		waitContext(ctx, &d.stopping)
+	}
+
+	spooled := 0
+	for _, sp := range spools {
+		spooled += sp.close(ctx)
+	}
+	waitTracing(ctx)
+	if ctx.Err() == nil {
+		d.pool.close()
+		logrus.WithField("spooled_batches", spooled).WithField("uncompacted_containers", uncompacted).WithField("took", time.Since(start).Round(time.Millisecond)).Info("shut down")
+		return nil
+	}
+
+	var buffered int64
+	for lf := range closing {
+		l, _ := lf.logger()
+		var bytes int64
+		for _, l := range s3Loggers(l) {
+			var cs containerStats
+			l.addStats(&cs)
+			bytes += cs.BufferedBytes
+			l.abandon()
+		}
+		buffered += bytes
+		logrus.WithField("id", lf.info.ContainerID).WithField("buffered_bytes", bytes).Warn("abandoned logger still closing at shutdown")
+	}
+	logrus.WithField("abandoned_containers", len(closing)).WithField("buffered_bytes", buffered).WithField("spooled_batches", spooled).WithField("uncompacted_containers", uncompacted).Errorf("shutdown ran out of time after %s, abandoning what was left", time.Since(start).Round(time.Millisecond))
+	return fmt.Errorf("shutdown ran out of time with %d loggers still closing and %d batches spooled", len(closing), spooled)
+}
+
+// waitContext waits for wg until ctx is done.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,191 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// shutdownTrace records what the plugin does as it shuts down, in order.
+type shutdownTrace struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (tr *shutdownTrace) add(format string, args ...any) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.events = append(tr.events, fmt.Sprintf(format, args...))
+}
+
+func (tr *shutdownTrace) list() []string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return append([]string(nil), tr.events...)
+}
+
+// serveHealth serves a stand-in for the metrics and health endpoints until
+// the end of the test, returning the server and its URL.
+func serveHealth(t *testing.T) (*http.Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return srv, "http://" + ln.Addr().String() + "/healthz"
+}
+
+// upClient doesn't keep connections, which a server shutting down would
+// wait on.
+var upClient = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+// up reports whether the endpoint at url answers.
+func up(url string) bool {
+	resp, err := upClient.Get(url)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+func TestShutdownOrder(t *testing.T) {
+	// Once shut down the plugin refuses new containers and stops the
+	// compactor, then every logger drains its FIFO and uploads it through
+	// the pool, then the spool is drained one last time and only then do the
+	// health endpoints go.
+	const containers, lines = 3, 50
+	fake := newFakeS3()
+	dir := t.TempDir()
+	d := newTestDriver(t, fake, nil)
+	d.startCompactor(time.Hour, time.Minute, 2)
+	metrics, health := serveHealth(t)
+
+	var cs []*testContainer
+	for i := range containers {
+		cs = append(cs, startContainerInfo(t, d, Info{
+			Config:        testLogOpts(t, map[string]string{spoolDirKey: dir, maxRetriesKey: "0", flushIntervalKey: "1h"}),
+			ContainerID:   fmt.Sprintf("%s%d", testContainerID(t)[:63], i),
+			ContainerName: fmt.Sprintf("/c%d", i),
+		}))
+	}
+
+	var tr shutdownTrace
+	var failed atomic.Bool
+	var refused sync.Once
+	fake.before = func(_ context.Context, op, _, key string) error {
+		if op != "PutObject" {
+			return nil
+		}
+		refused.Do(func() {
+			c := cs[0].info
+			c.ContainerID = strings.Repeat("f", 64)
+			if err := d.StartLogging(t.TempDir()+"/fifo", c); errors.Is(err, errShuttingDown) {
+				tr.add("refused")
+			}
+			select {
+			case <-d.compactor.stopped:
+				tr.add("compactor stopped")
+			default:
+			}
+		})
+		if !up(health) {
+			tr.add("health down")
+		}
+		// The first upload fails, so its batch is left to the spool.
+		if failed.CompareAndSwap(false, true) {
+			tr.add("spooled %s", key)
+			return fakeStatusError(http.StatusServiceUnavailable, "ServiceUnavailable")
+		}
+		tr.add("put %s", key)
+		return nil
+	}
+
+	for _, c := range cs {
+		for j := range lines {
+			c.write(t, entry("stdout", fmt.Sprintf("line %d", j), time.Now()))
+		}
+		// As the daemon does once the container stops, or else the drain
+		// waits out goroutineStopTimeout for more.
+		c.w.Close()
+	}
+	if code := shutdown(d, metrics, 10*time.Second); code != 0 {
+		t.Fatalf("exit status %d, want 0", code)
+	}
+	if up(health) {
+		t.Error("health endpoint still up after shutdown")
+	}
+
+	events := tr.list()
+	if len(events) != containers+3 || events[0] != "refused" || events[1] != "compactor stopped" {
+		t.Fatalf("shut down with %q, want new containers refused and the compactor stopped before a logger uploaded", events)
+	}
+	spooled, _ := strings.CutPrefix(events[2], "spooled ")
+	if last := events[len(events)-1]; last != "put "+spooled {
+		t.Errorf("last upload %q, want the spooled %s drained after every logger has uploaded: %q", last, spooled, events)
+	}
+	for _, c := range cs {
+		if n := len(containerRecords(t, fake, c.info.ContainerID)); n != lines {
+			t.Errorf("uploaded %d lines of %s, want all %d drained from its FIFO", n, c.info.ContainerName, lines)
+		}
+	}
+	if err := d.pool.upload(context.Background(), testBucket, time.Second, func(context.Context) error { return nil }); !errors.Is(err, errPoolClosed) {
+		t.Errorf("upload after shutdown returned %v, want %v", err, errPoolClosed)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	// With S3 hanging the plugin still exits once the timeout is up, with
+	// what it abandons logged.
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	fake := newFakeS3()
+	release := stallPuts(fake, "")
+	defer release()
+	d := newTestDriver(t, fake, nil)
+	metrics, health := serveHealth(t)
+	c := startContainer(t, d, map[string]string{flushIntervalKey: "1h"})
+	c.write(t, entry("stdout", "lost", time.Now()))
+	waitFor(t, "the line to be buffered", func() bool {
+		var cs containerStats
+		c.l.addStats(&cs)
+		return cs.BufferedBytes > 0
+	})
+
+	const timeout = 200 * time.Millisecond
+	start := time.Now()
+	if code := shutdown(d, metrics, timeout); code != 1 {
+		t.Errorf("exit status %d, want 1", code)
+	}
+	if took := time.Since(start); took > timeout+time.Second {
+		t.Errorf("shutdown took %s with a %s timeout", took, timeout)
+	}
+	if up(health) {
+		t.Error("health endpoint still up after shutdown")
+	}
+	var abandoned, summary bool
+	for _, e := range hook.AllEntries() {
+		switch {
+		case e.Message == "abandoned logger still closing at shutdown":
+			abandoned = e.Data["id"] == c.info.ContainerID && e.Data["buffered_bytes"].(int64) > 0
+		case strings.HasPrefix(e.Message, "shutdown ran out of time"):
+			summary = e.Level == logrus.ErrorLevel && e.Data["abandoned_containers"] == 1
+		}
+	}
+	if !abandoned || !summary {
+		t.Errorf("logged the container abandoned %v with a summary %v, want both", abandoned, summary)
+	}
+}
@@ -0,0 +1,191 @@
+package s3log
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// sniffSize is how much of an object is looked at to tell its compression
+// and format, as much as http.DetectContentType considers.
+const sniffSize = 512
+
+// codecMagic maps each codec to the bytes its streams start with, for
+// objects uploaded without the codec's extension or Content-Encoding, such
+// as those written by other tools.
+var codecMagic = map[string][]byte{
+	compressGzip: {0x1f, 0x8b},
+	compressZstd: {0x28, 0xb5, 0x2f, 0xfd},
+}
+
+// formatError is an object that can't be read as logs: compressed with a
+// codec the plugin doesn't know, corrupt, or not text at all. Reading skips
+// it, leaving a line in its place, rather than failing.
+type formatError struct {
+	err error
+}
+
+func (e *formatError) Error() string { return e.err.Error() }
+
+func (e *formatError) Unwrap() error { return e.err }
+
+// objectCodec returns the codec obj was compressed with, "" if none: the one
+// its key's extension names, else the one its Content-Encoding names, else
+// the one its first bytes, in peek, are the magic of.
+func objectCodec(key, encoding string, peek []byte) string {
+	for name, codec := range codecs {
+		if strings.HasSuffix(key, codec.ext) {
+			return name
+		}
+	}
+	for name, codec := range codecs {
+		if encoding == codec.encoding {
+			return name
+		}
+	}
+	for name, magic := range codecMagic {
+		if bytes.HasPrefix(peek, magic) {
+			return name
+		}
+	}
+	return compressNone
+}
+
+// decompress returns a reader of body's contents decompressed with codec.
+// Errors of the decompressor, as opposed to body's, are formatErrors.
+func decompress(codec string, body io.ReadCloser) (io.ReadCloser, error) {
+	br := &bodyReader{r: body}
+	var zr io.Reader
+	var close func()
+	switch codec {
+	case compressGzip:
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			body.Close()
+			return nil, br.wrap(err)
+		}
+		zr, close = gr, func() { gr.Close() }
+	case compressZstd:
+		dec, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			body.Close()
+			return nil, br.wrap(err)
+		}
+		zr, close = dec, dec.Close
+	default:
+		return body, nil
+	}
+	return objectReader{decompressReader{zr, br}, func() { close(); body.Close() }}, nil
+}
+
+// bodyReader keeps the last error reading an object's body, so that a
+// decompressor's own errors can be told from the body's.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.err = err
+	return n, err
+}
+
+// wrap returns err, from reading the decompressed body, as a formatError
+// unless it is the body's.
+func (r *bodyReader) wrap(err error) error {
+	if err == nil || err == io.EOF || err == r.err {
+		return err
+	}
+	if r.err != nil && r.err != io.EOF && errors.Is(err, r.err) {
+		return err
+	}
+	return &formatError{fmt.Errorf("corrupt compressed object: %v", err)}
+}
+
+type decompressReader struct {
+	zr   io.Reader
+	body *bodyReader
+}
+
+func (r decompressReader) Read(p []byte) (int, error) {
+	n, err := r.zr.Read(p)
+	return n, r.body.wrap(err)
+}
+
+// objectFormat returns the line format to decode an object with: the one its
+// key's extension names, else jsonl if its first line, in peek, is a record
+// and raw otherwise. Objects in the configured format are decoded as the
+// logger decodes its own. Anything that isn't text is a formatError.
+func (l *S3Logger) objectFormat(key string, peek []byte) (lineFormat, error) {
+	if strings.HasSuffix(key, parquetExt) || bytes.HasPrefix(peek, parquetMagic) {
+		return nil, &formatError{errParquetUnreadable}
+	}
+	if !isText(peek) {
+		return nil, &formatError{errors.New("object is neither text nor compressed with gzip or zstd")}
+	}
+	var format string
+	switch {
+	case strings.HasSuffix(key, ".jsonl") || strings.HasSuffix(key, ".ndjson"):
+		format = formatJSONL
+	case strings.HasSuffix(key, ".txt"):
+		format = formatRaw
+	case bytes.HasPrefix(bytes.TrimLeft(peek, " \t\r\n"), []byte{'{'}):
+		format = formatJSONL
+	default:
+		format = formatRaw
+	}
+	switch {
+	case format == l.opts.Format:
+		return l.format, nil
+	case format == formatJSONL:
+		return jsonlFormat{}, nil
+	}
+	return rawFormat{timestamp: timestampRFC3339Nano}, nil
+}
+
+// isText reports whether p, the start of an object, is text: what
+// http.DetectContentType takes for text, or valid UTF-8 up to a rune that p
+// cuts short.
+func isText(p []byte) bool {
+	if strings.HasPrefix(http.DetectContentType(p), "text/") {
+		return true
+	}
+	for len(p) > 0 {
+		r, size := utf8.DecodeRune(p)
+		if r == utf8.RuneError && size == 1 {
+			return len(p) < utf8.UTFMax && !utf8.FullRune(p)
+		}
+		p = p[size:]
+	}
+	return true
+}
+
+// peekObject returns a reader of r along with its first sniffSize bytes, or
+// all of them if it is shorter.
+func peekObject(r io.Reader) (*bufio.Reader, []byte, error) {
+	br := bufio.NewReaderSize(r, max(sniffSize, 4096))
+	peek, err := br.Peek(sniffSize)
+	if err == io.EOF || err == bufio.ErrBufferFull {
+		err = nil
+	}
+	return br, peek, err
+}
+
+// unreadableMessage is the line emitted in place of an object that err,
+// a formatError, kept from being read.
+func unreadableMessage(obj logObject, err error) *Message {
+	return &Message{
+		Line:      fmt.Appendf(nil, "[%s: skipped unreadable object %s: %v]\n", driverName, obj.key, err),
+		Source:    "stderr",
+		Timestamp: obj.time,
+	}
+}
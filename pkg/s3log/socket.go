@@ -0,0 +1,85 @@
+package s3log
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/docker/go-connections/sockets"
+)
+
+const (
+	socketPathKey = "socket-path"
+	socketGIDKey  = "socket-gid"
+
+	// defaultSocketDir is where the daemon looks for the sockets of plugins
+	// that it doesn't manage itself.
+	defaultSocketDir = "/run/docker/plugins"
+
+	// staleSocketTimeout bounds how long an existing socket is probed for a
+	// listener before it is taken as left over from a crash.
+	staleSocketTimeout = time.Second
+)
+
+// defaultSocketPath is the socket named in config.json, which is where a
+// managed plugin must listen.
+var defaultSocketPath = filepath.Join(defaultSocketDir, driverName+".sock")
+
+// lookupGID returns the gid named by v, either a number or the name of a
+// group.
+func lookupGID(v string) (int, error) {
+	if gid, err := strconv.Atoi(v); err == nil {
+		if gid < 0 {
+			return 0, fmt.Errorf("invalid --%s %d: must not be negative", socketGIDKey, gid)
+		}
+		return gid, nil
+	}
+	g, err := user.LookupGroup(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid --%s %q: %v", socketGIDKey, v, err)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// listenUnix creates the plugin's socket at path, readable and writable by
+// its owner and by gid only. A socket left behind by a plugin that crashed is
+// replaced, but one another process is still listening on is an error, as is
+// any other file in its place.
+func listenUnix(path string, gid int) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	return sockets.NewUnixSocketWithOpts(path, sockets.WithChown(os.Getuid(), gid), sockets.WithChmod(0660))
+}
+
+// removeStaleSocket removes the socket at path if nothing is listening on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%q exists and isn't a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, staleSocketTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("another process is listening on %q", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error removing stale socket %q: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package s3log
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestLookupGID(t *testing.T) {
+	g, err := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+	if err != nil {
+		t.Skipf("no name for gid %d: %v", os.Getgid(), err)
+	}
+	tests := []struct {
+		v       string
+		want    int
+		wantErr string
+	}{
+		{v: "0", want: 0},
+		{v: "999", want: 999},
+		{v: g.Name, want: os.Getgid()},
+		{v: "-1", wantErr: "must not be negative"},
+		{v: "no-such-group", wantErr: `invalid --socket-gid "no-such-group"`},
+	}
+	for _, tt := range tests {
+		got, err := lookupGID(tt.v)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("lookupGID(%q) returned %v, want an error containing %q", tt.v, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("lookupGID(%q) = %d, %v, want %d", tt.v, got, err, tt.want)
+		}
+	}
+}
+
+// leaveSocket leaves a socket at path with nothing listening on it, as a
+// plugin that crashed would.
+func leaveSocket(t *testing.T, path string) {
+	t.Helper()
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.SetUnlinkOnClose(false)
+	ln.Close()
+}
+
+func TestListenUnix(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, path string)
+		wantErr string
+	}{
+		{name: "new directory"},
+		{name: "stale socket", setup: leaveSocket},
+		{
+			name: "socket in use",
+			setup: func(t *testing.T, path string) {
+				ln, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { ln.Close() })
+			},
+			wantErr: "another process is listening",
+		},
+		{
+			name: "not a socket",
+			setup: func(t *testing.T, path string) {
+				if err := os.WriteFile(path, []byte("config"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "exists and isn't a socket",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "plugins", "s3.sock")
+			if tt.setup != nil {
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				tt.setup(t, path)
+			}
+			ln, err := listenUnix(path, os.Getgid())
+			if tt.wantErr != "" {
+				if err == nil {
+					ln.Close()
+				}
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("listenUnix returned %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := fi.Mode().Perm(); perm != 0660 {
+				t.Errorf("socket mode %v, want 0660", perm)
+			}
+			if gid := fi.Sys().(*syscall.Stat_t).Gid; int(gid) != os.Getgid() {
+				t.Errorf("socket group %d, want %d", gid, os.Getgid())
+			}
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		})
+	}
+}
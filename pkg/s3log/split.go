@@ -0,0 +1,229 @@
+package s3log
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+const (
+	splitStreamsKey = "split-streams"
+
+	// splitMergeDelay is how long a followed line from one stream is held
+	// back waiting for an older line from the other stream.
+	splitMergeDelay = 250 * time.Millisecond
+)
+
+// newLogger returns the logger for a container: a single S3Logger, or one per
+// stream when split-streams is set.
+func newLogger(clients *clientFactory, pool *uploadPool, budget *memoryBudget, opts LogOption, info Info, sp *spool, cache *logCache) (containerLogger, error) {
+	if !opts.SplitStreams {
+		return newS3Logger(clients, pool, budget, opts, info, sp, cache)
+	}
+	s := &splitLogger{}
+	for i, streamOpts := range streamOptions(opts) {
+		l, err := newS3Logger(clients, pool, budget, streamOpts, info, sp, cache)
+		if err != nil {
+			for _, l := range s.loggers[:i] {
+				l.Close()
+			}
+			return nil, err
+		}
+		s.loggers[i] = l
+	}
+	return s, nil
+}
+
+var splitStreams = [2]string{"stdout", "stderr"}
+
+// streamOptions returns the options of each of a container's S3Loggers:
+// opts itself, or with split-streams those of each stream, in the mode
+// given for it.
+func streamOptions(opts LogOption) []LogOption {
+	if !opts.SplitStreams {
+		return []LogOption{opts}
+	}
+	var streams []LogOption
+	for _, stream := range splitStreams {
+		streamOpts := opts
+		streamOpts.S3Prefix += stream + "/"
+		streamOpts.stream = stream
+		mode := opts.StdoutMode
+		if stream == "stderr" {
+			mode = opts.StderrMode
+		}
+		streamOpts.Mode, streamOpts.StdoutMode, streamOpts.StderrMode = mode, mode, mode
+		streams = append(streams, streamOpts)
+	}
+	return streams
+}
+
+// splitLogger sends stdout and stderr to separate S3Loggers, each with its
+// own buffer and flush thresholds, whose objects are stored under a stream
+// prefix so that lifecycle rules can treat them differently.
+type splitLogger struct {
+	loggers [2]*S3Logger
+}
+
+// Log hands the message to the logger for its stream. Lines from any stream
+// other than stderr go to stdout.
+func (s *splitLogger) Log(msg *Message) error {
+	if msg.Source == splitStreams[1] {
+		return s.loggers[1].Log(msg)
+	}
+	return s.loggers[0].Log(msg)
+}
+
+func (s *splitLogger) removeState() {
+	for _, l := range s.loggers {
+		l.removeState()
+	}
+}
+
+func (s *splitLogger) abandon() {
+	for _, l := range s.loggers {
+		l.abandon()
+	}
+}
+
+func (s *splitLogger) closeManifest() {
+	for _, l := range s.loggers {
+		l.closeManifest()
+	}
+}
+
+// writeSummary writes a single summary of both streams' objects.
+func (s *splitLogger) writeSummary(exit *containerExit) {
+	sum := s.loggers[0].summary()
+	other := s.loggers[1].summary()
+	if other.Started.Before(sum.Started) {
+		sum.Started = other.Started
+	}
+	sum.RawBytes += other.RawBytes
+	sum.StoredBytes += other.StoredBytes
+	sum.Partitions = append(sum.Partitions, other.Partitions...)
+	slices.Sort(sum.Partitions)
+	sum.Partitions = slices.Compact(sum.Partitions)
+	sum.Exit = exit
+	s.loggers[0].putSummary(sum)
+}
+
+// Name returns the name of the logger.
+func (s *splitLogger) Name() string {
+	return driverName
+}
+
+// Close closes the logger of each stream.
+func (s *splitLogger) Close() error {
+	errs := make([]error, len(s.loggers))
+	for i, l := range s.loggers {
+		errs[i] = l.Close()
+	}
+	return errors.Join(errs...)
+}
+
+// ReadLogs reads both streams and merges them back into timestamp order.
+func (s *splitLogger) ReadLogs(config ReadConfig) *LogWatcher {
+	watcher := NewLogWatcher()
+	go s.readLogs(watcher, config)
+	return watcher
+}
+
+// readLogs merges the messages of both streams, emitting the oldest head of
+// the two. Each stream honours the tail on its own, which for a bounded read
+// leaves enough to take the last lines of the merged streams; when following,
+// the tail applies per stream. A followed stream may stay quiet indefinitely,
+// so a line isn't held back for longer than splitMergeDelay.
+func (s *splitLogger) readLogs(watcher *LogWatcher, config ReadConfig) {
+	defer close(watcher.Msg)
+
+	var sources [2]*LogWatcher
+	for i, l := range s.loggers {
+		sources[i] = l.ReadLogs(config)
+		defer sources[i].ConsumerGone()
+	}
+
+	var tail []*Message
+	collectTail := !config.Follow && config.Tail >= 0
+	emit := func(msg *Message) bool {
+		if collectTail {
+			tail = append(tail, msg)
+			if len(tail) > config.Tail {
+				tail = tail[1:]
+			}
+			return true
+		}
+		select {
+		case watcher.Msg <- msg:
+			return true
+		case <-watcher.WatchConsumerGone():
+			return false
+		}
+	}
+
+	var heads [2]*Message
+	open := [2]bool{true, true}
+	for open[0] || open[1] || heads[0] != nil || heads[1] != nil {
+		ready := (heads[0] != nil || !open[0]) && (heads[1] != nil || !open[1])
+		if ready {
+			if !emit(shiftOldest(&heads)) {
+				return
+			}
+			continue
+		}
+
+		var msgs [2]<-chan *Message
+		for i := range sources {
+			if heads[i] == nil && open[i] {
+				msgs[i] = sources[i].Msg
+			}
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if config.Follow && (heads[0] != nil || heads[1] != nil) {
+			timer = time.NewTimer(splitMergeDelay)
+			timeout = timer.C
+		}
+
+		select {
+		case msg, ok := <-msgs[0]:
+			heads[0], open[0] = msg, ok
+		case msg, ok := <-msgs[1]:
+			heads[1], open[1] = msg, ok
+		case err := <-sources[0].Err:
+			watcher.Err <- err
+			return
+		case err := <-sources[1].Err:
+			watcher.Err <- err
+			return
+		case <-timeout:
+			if !emit(shiftOldest(&heads)) {
+				return
+			}
+		case <-watcher.WatchConsumerGone():
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+
+	collectTail = false
+	for _, msg := range tail {
+		if !emit(msg) {
+			return
+		}
+	}
+}
+
+// shiftOldest removes and returns the older of the two heads, preferring
+// stdout on a tie.
+func shiftOldest(heads *[2]*Message) *Message {
+	i := 0
+	if heads[0] == nil || (heads[1] != nil && heads[1].Timestamp.Before(heads[0].Timestamp)) {
+		i = 1
+	}
+	msg := heads[i]
+	heads[i] = nil
+	return msg
+}
@@ -0,0 +1,462 @@
+package s3log
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	spoolDirKey      = "spool-dir"
+	spoolMaxBytesKey = "spool-max-bytes"
+
+	defaultSpoolMaxBytes = 1 << 30
+
+	spoolDrainInterval = 30 * time.Second
+	spoolFileSuffix    = ".batch"
+	// strictSpoolSuffix ends the files of ordering=strict batches, which
+	// are never evicted.
+	strictSpoolSuffix = ".strict" + spoolFileSuffix
+)
+
+// batch is a serialized set of log lines ready to be uploaded as one object.
+type batch struct {
+	Bucket            string            `json:"bucket"`
+	Key               string            `json:"key"`
+	ContentType       string            `json:"content_type,omitempty"`
+	ContentEncoding   string            `json:"content_encoding,omitempty"`
+	ContainerID       string            `json:"container_id"`
+	SSE               string            `json:"sse,omitempty"`
+	SSEKMSKeyID       string            `json:"sse_kms_key_id,omitempty"`
+	SSECKeyFile       string            `json:"sse_c_key_file,omitempty"`
+	StorageClass      string            `json:"storage_class,omitempty"`
+	ACL               string            `json:"acl,omitempty"`
+	RequestPayer      string            `json:"request_payer,omitempty"`
+	ChecksumAlgorithm string            `json:"checksum_algorithm,omitempty"`
+	ChecksumSHA256    string            `json:"checksum_sha256,omitempty"`
+	Tagging           string            `json:"tagging,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+	Retention         *retention        `json:"retention,omitempty"`
+	Client            clientConfig      `json:"client"`
+	Tenant            string            `json:"tenant,omitempty"`
+	Tag               string            `json:"tag,omitempty"`
+	Lines             int               `json:"lines,omitempty"`
+	NotifyTopic       string            `json:"notify_topic,omitempty"`
+	NotifyQueue       string            `json:"notify_queue,omitempty"`
+	Manifest          string            `json:"manifest,omitempty"`
+	FirstSeq          int64             `json:"first_seq,omitempty"`
+	First             time.Time         `json:"first"`
+	Last              time.Time         `json:"last"`
+
+	body      []byte
+	versionID string   // of the uploaded object, if its bucket is versioned
+	ssec      *sseCKey // read from SSECKeyFile
+	summary   bool     // whether b is a container's run summary
+	index     *objectIndex
+	strict    bool // whether b is from a logger with ordering=strict
+	failover  bool // whether b was written to the failover bucket
+
+	// flushed is when the flush of b started compressing it, and requestID
+	// and sdkRetries are what its uploads saw, for observeFlush.
+	flushed    time.Time
+	requestID  string
+	sdkRetries int
+
+	// size is that of an object uploaded in parts, which has no body.
+	size int64
+}
+
+// objectSize returns the size of the object b uploaded.
+func (b *batch) objectSize() int64 {
+	if b.size > 0 {
+		return b.size
+	}
+	return int64(len(b.body))
+}
+
+// spool keeps batches that couldn't be uploaded on local disk until S3 is
+// reachable again. Each container gets its own directory holding one file
+// per batch, named so that they sort in the order they were spooled. A file
+// is a line of JSON describing the batch followed by its body.
+type spool struct {
+	dir      string
+	maxBytes int64
+	upload   func(context.Context, *batch) error
+
+	mu      sync.Mutex
+	size    int64
+	batches int
+	queued  map[string]int // batches by container
+	last    int64
+
+	// loggers are the running loggers by container, which are told of
+	// their batches that are evicted.
+	loggers map[string]map[*S3Logger]struct{}
+
+	// stop ends the drainer start runs, which closes stopped as it
+	// returns.
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+func newSpool(dir string, maxBytes int64, upload func(context.Context, *batch) error) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating %s %q: %v", spoolDirKey, dir, err)
+	}
+	s := &spool{dir: dir, maxBytes: maxBytes, upload: upload, queued: map[string]int{}, loggers: map[string]map[*S3Logger]struct{}{}}
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		s.size += f.size
+		s.queued[f.container()]++
+	}
+	s.batches = len(files)
+	spoolBytes.Add(float64(s.size))
+	if len(files) > 0 {
+		logrus.WithField("dir", dir).WithField("batches", len(files)).Info("found spooled batches from a previous run")
+	}
+	return s, nil
+}
+
+// write stores b on disk, evicting the oldest spooled batches if the spool
+// would grow past its size cap. Batches of ordering=strict aren't evicted,
+// so a strict batch that doesn't fit is refused instead.
+func (s *spool) write(b *batch) error {
+	meta, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Join(s.dir, b.ContainerID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// Names must be unique and increasing even if the clock isn't.
+	n := time.Now().UnixNano()
+	if n <= s.last {
+		n = s.last + 1
+	}
+	s.last = n
+	suffix := spoolFileSuffix
+	if b.strict {
+		suffix = strictSpoolSuffix
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%020d%s", n, suffix))
+
+	var buf bytes.Buffer
+	buf.Write(meta)
+	buf.WriteByte('\n')
+	buf.Write(b.body)
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	f := spoolFile{path: name, size: int64(buf.Len())}
+	s.size += f.size
+	s.batches++
+	s.queued[b.ContainerID]++
+	spoolBytes.Add(float64(f.size))
+	if err := s.evict(); err != nil {
+		return err
+	}
+	if b.strict && s.size > s.maxBytes {
+		s.removeLocked(f)
+		return fmt.Errorf("%s is full of batches that can't be evicted", spoolDirKey)
+	}
+	return nil
+}
+
+func (s *spool) register(l *S3Logger) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := l.info.ContainerID
+	if s.loggers[id] == nil {
+		s.loggers[id] = make(map[*S3Logger]struct{})
+	}
+	s.loggers[id][l] = struct{}{}
+}
+
+func (s *spool) unregister(l *S3Logger) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := l.info.ContainerID
+	if delete(s.loggers[id], l); len(s.loggers[id]) == 0 {
+		delete(s.loggers, id)
+	}
+}
+
+// holds reports whether the spool has batches of the container waiting to
+// be uploaded. A nil spool holds none.
+func (s *spool) holds(containerID string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queued[containerID] > 0
+}
+
+// uploadTraced uploads b, a spooled batch, traced by the plugin's tracer.
+func (s *spool) uploadTraced(ctx context.Context, b *batch) error {
+	ctx, span := pluginTracer.Start(ctx, "spool drain")
+	err := s.upload(ctx, b)
+	if span.IsRecording() {
+		span.SetAttributes(semconv.ContainerID(b.ContainerID), semconv.AWSS3Bucket(b.Bucket), semconv.AWSS3Key(b.Key), attribute.Int("s3logdriver.bytes", len(b.body)))
+		if b.requestID != "" {
+			span.SetAttributes(semconv.AWSRequestID(b.requestID))
+		}
+	}
+	endSpan(span, err)
+	return err
+}
+
+// evict removes the oldest batches across all containers until the spool is
+// within its size cap, telling the running loggers of those that were
+// theirs. Callers must hold s.mu.
+func (s *spool) evict() error {
+	if s.size <= s.maxBytes {
+		return nil
+	}
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i].path) < filepath.Base(files[j].path)
+	})
+	for _, f := range files {
+		if s.size <= s.maxBytes {
+			break
+		}
+		if strings.HasSuffix(f.path, strictSpoolSuffix) {
+			continue
+		}
+		var b *batch
+		if len(s.loggers[f.container()]) > 0 {
+			b, _ = readSpoolHeader(f.path)
+		}
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+		s.forget(f)
+		spoolEvicted.Inc()
+		if b != nil {
+			for l := range s.loggers[f.container()] {
+				l.evicted(b)
+			}
+		}
+		logrus.WithField("file", f.path).Warnf("evicted spooled batch of %d bytes, %s is full", f.size, spoolDirKey)
+	}
+	return nil
+}
+
+type spoolFile struct {
+	path string
+	size int64
+}
+
+// container returns the ID of the container f was spooled by, which names
+// its directory.
+func (f spoolFile) container() string {
+	return filepath.Base(filepath.Dir(f.path))
+}
+
+// files lists every spooled batch, sorted by container and then by the
+// order they were spooled in.
+func (s *spool) files() ([]spoolFile, error) {
+	var files []spoolFile
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, spoolFileSuffix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, spoolFile{path: path, size: info.Size()})
+		return nil
+	})
+	return files, err
+}
+
+// start runs the spool's drainer until it is closed or ctx is done.
+func (s *spool) start(ctx context.Context) {
+	ctx, s.stop = context.WithCancel(ctx)
+	s.stopped = make(chan struct{})
+	go func() {
+		defer close(s.stopped)
+		s.run(ctx)
+	}()
+}
+
+// close stops the drainer and, once a drain under way has given up, drains
+// the spool one last time within ctx. It returns the batches left spooled,
+// which are drained once the plugin starts again.
+func (s *spool) close(ctx context.Context) int {
+	s.stop()
+	select {
+	case <-s.stopped:
+	case <-ctx.Done():
+		return s.count()
+	}
+	s.drain(ctx)
+	return s.count()
+}
+
+// count returns how many batches are spooled.
+func (s *spool) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches
+}
+
+// run drains the spool every spoolDrainInterval until ctx is done.
+func (s *spool) run(ctx context.Context) {
+	t := time.NewTicker(spoolDrainInterval)
+	defer t.Stop()
+	for {
+		s.drain(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// drain uploads spooled batches in order. The first failure for a container
+// and bucket stops draining that container's batches for the bucket, so they
+// are never uploaded out of order, while its other buckets carry on.
+func (s *spool) drain(ctx context.Context) {
+	s.mu.Lock()
+	files, err := s.files()
+	s.mu.Unlock()
+	if err != nil {
+		logrus.WithField("dir", s.dir).WithError(err).Error("error listing spooled batches")
+		return
+	}
+
+	type stream struct{ container, bucket string }
+	failed := make(map[stream]bool)
+	for _, f := range files {
+		if ctx.Err() != nil {
+			return
+		}
+		b, err := readSpoolFile(f.path)
+		if err != nil {
+			logrus.WithField("file", f.path).WithError(err).Error("discarding unreadable spooled batch")
+			s.remove(f)
+			continue
+		}
+		key := stream{filepath.Dir(f.path), b.Bucket}
+		if failed[key] {
+			continue
+		}
+		if err := s.uploadTraced(ctx, b); err != nil {
+			log := logrus.WithField("id", b.ContainerID).WithField("bucket", b.Bucket).WithField("key", b.Key)
+			if errors.Is(err, errOverBudget) || errors.Is(err, errBreakerOpen) {
+				log.WithError(err).Debug("error uploading spooled batch")
+			} else {
+				s3Failed(log, b.Bucket, err).Debug("error uploading spooled batch")
+			}
+			failed[key] = true
+			continue
+		}
+		spoolUploaded.Add(float64(len(b.body)))
+		logrus.WithField("id", b.ContainerID).WithField("bucket", b.Bucket).WithField("key", b.Key).WithField("bytes", len(b.body)).Debug("uploaded spooled batch")
+		s.remove(f)
+	}
+}
+
+func (s *spool) remove(f spoolFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(f)
+}
+
+// removeLocked removes f. Callers must hold s.mu.
+func (s *spool) removeLocked(f spoolFile) {
+	if err := os.Remove(f.path); err == nil {
+		s.forget(f)
+	}
+}
+
+// forget takes f, which has been removed, out of the spool's counts.
+// Callers must hold s.mu.
+func (s *spool) forget(f spoolFile) {
+	s.size -= f.size
+	s.batches--
+	spoolBytes.Sub(float64(f.size))
+	if s.queued[f.container()]--; s.queued[f.container()] <= 0 {
+		delete(s.queued, f.container())
+	}
+}
+
+func readSpoolFile(path string) (*batch, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	meta, body, ok := bytes.Cut(data, []byte{'\n'})
+	if !ok {
+		return nil, fmt.Errorf("missing batch header")
+	}
+	var b batch
+	if err := json.Unmarshal(meta, &b); err != nil {
+		return nil, err
+	}
+	b.body = body
+	return &b, nil
+}
+
+// readSpoolHeader reads the description of the batch spooled at path,
+// without its body.
+func readSpoolHeader(path string) (*batch, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	meta, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var b batch
+	if err := json.Unmarshal(meta, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
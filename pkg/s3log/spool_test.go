@@ -0,0 +1,218 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSpoolFallback(t *testing.T) {
+	fake := newFakeS3()
+	var down atomic.Bool
+	down.Store(true)
+	fake.before = func(_ context.Context, op, _, _ string) error {
+		if op == "PutObject" && down.Load() {
+			return fakeStatusError(http.StatusServiceUnavailable, "ServiceUnavailable")
+		}
+		return nil
+	}
+	dir := t.TempDir()
+	cfg := testLogOpts(t, map[string]string{spoolDirKey: dir, maxRetriesKey: "0"})
+	l, d := newTestDriverLogger(t, fake, Info{Config: cfg, ContainerID: testContainerID(t), ContainerName: "/test"})
+
+	lines := []string{"while", "S3", "is", "down"}
+	logLines(t, l, time.Now(), lines...)
+	if err := l.Close(); err != nil {
+		t.Log(err)
+	}
+	if keys := fake.logKeys(testBucket); len(keys) != 0 {
+		t.Fatalf("uploaded %q while S3 was down", keys)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, testContainerID(t), "*"+spoolFileSuffix))
+	if len(files) != 1 {
+		t.Fatalf("spooled %q, want one batch", files)
+	}
+
+	sp, err := d.spoolFor(dir, defaultSpoolMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Store(false)
+	sp.drain(context.Background())
+	if n := sp.count(); n != 0 {
+		t.Errorf("%d batches still spooled after S3 healed", n)
+	}
+	if got := uploadedLines(t, fake, s3Loggers(l)[0]); !slices.Equal(got, lines) {
+		t.Errorf("drained %q, want %q", got, lines)
+	}
+}
+
+// recordingUpload returns an upload func for a spool that records the keys
+// of the batches it uploads, failing those fail returns an error for.
+func recordingUpload(fail func(b *batch) error) (func(context.Context, *batch) error, func() []string) {
+	var mu sync.Mutex
+	var keys []string
+	upload := func(_ context.Context, b *batch) error {
+		if fail != nil {
+			if err := fail(b); err != nil {
+				return err
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, b.Key)
+		return nil
+	}
+	return upload, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(keys)
+	}
+}
+
+func spoolBatch(container, bucket, key string, size int) *batch {
+	return &batch{ContainerID: container, Bucket: bucket, Key: key, body: []byte(strings.Repeat("x", size))}
+}
+
+func TestSpoolEvict(t *testing.T) {
+	tests := []struct {
+		name    string
+		batches []*batch
+		refused []bool
+		want    []string
+	}{
+		{
+			name:    "under the cap",
+			batches: []*batch{spoolBatch("a", "b", "1", 100), spoolBatch("a", "b", "2", 100)},
+			refused: []bool{false, false},
+			want:    []string{"1", "2"},
+		},
+		{
+			name:    "oldest first",
+			batches: []*batch{spoolBatch("a", "b", "1", 300), spoolBatch("c", "b", "2", 300), spoolBatch("a", "b", "3", 300)},
+			refused: []bool{false, false, false},
+			want:    []string{"3", "2"},
+		},
+		{
+			name: "strict batches kept",
+			batches: []*batch{
+				{ContainerID: "a", Bucket: "b", Key: "1", body: make([]byte, 300), strict: true},
+				spoolBatch("a", "b", "2", 300),
+				spoolBatch("a", "b", "3", 300),
+			},
+			refused: []bool{false, false, false},
+			want:    []string{"1", "3"},
+		},
+		{
+			name: "strict batch that doesn't fit",
+			batches: []*batch{
+				{ContainerID: "a", Bucket: "b", Key: "1", body: make([]byte, 500), strict: true},
+				{ContainerID: "a", Bucket: "b", Key: "2", body: make([]byte, 500), strict: true},
+			},
+			refused: []bool{false, true},
+			want:    []string{"1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upload, uploaded := recordingUpload(nil)
+			s, err := newSpool(t.TempDir(), 1000, upload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, b := range tt.batches {
+				if err := s.write(b); (err != nil) != tt.refused[i] {
+					t.Errorf("write of %s: %v, want refused %v", b.Key, err, tt.refused[i])
+				}
+			}
+			s.drain(context.Background())
+			got := uploaded()
+			slices.Sort(got)
+			want := slices.Clone(tt.want)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("kept %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSpoolRecoverLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	upload, _ := recordingUpload(func(*batch) error { return errors.New("S3 is down") })
+	crashed, err := newSpool(dir, defaultSpoolMaxBytes, upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := range 3 {
+		key := fmt.Sprintf("a/%d", i)
+		if err := crashed.write(spoolBatch("a", "b", key, 10)); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, key)
+	}
+	crashed.drain(context.Background())
+
+	upload, uploaded := recordingUpload(nil)
+	s, err := newSpool(dir, defaultSpoolMaxBytes, upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.count(); n != 3 {
+		t.Fatalf("found %d spooled batches after a restart, want 3", n)
+	}
+	if !s.holds("a") {
+		t.Error("spool doesn't hold the container's batches from the previous run")
+	}
+	s.drain(context.Background())
+	if got := uploaded(); !slices.Equal(got, want) {
+		t.Errorf("drained %q, want %q in order", got, want)
+	}
+	if s.count() != 0 || s.holds("a") {
+		t.Errorf("%d batches left after draining", s.count())
+	}
+}
+
+func TestSpoolDrainOrder(t *testing.T) {
+	// The first batch of container a for bucket down fails, which holds
+	// back its later batches for that bucket but not its other bucket's or
+	// another container's.
+	upload, uploaded := recordingUpload(func(b *batch) error {
+		if b.Bucket == "down" && b.ContainerID == "a" {
+			return errors.New("bucket is down")
+		}
+		return nil
+	})
+	s, err := newSpool(t.TempDir(), defaultSpoolMaxBytes, upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*batch{
+		spoolBatch("a", "down", "a/down/1", 10),
+		spoolBatch("a", "up", "a/up/1", 10),
+		spoolBatch("a", "down", "a/down/2", 10),
+		spoolBatch("a", "up", "a/up/2", 10),
+		spoolBatch("c", "down", "c/down/1", 10),
+	} {
+		if err := s.write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.drain(context.Background())
+	want := []string{"a/up/1", "a/up/2", "c/down/1"}
+	if got := uploaded(); !slices.Equal(got, want) {
+		t.Errorf("drained %q, want %q", got, want)
+	}
+	if n := s.count(); n != 2 {
+		t.Errorf("%d batches left, want the two of a for the bucket that is down", n)
+	}
+}
@@ -0,0 +1,121 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	sseCKeyFileKey = "sse-c-key-file"
+
+	// sseCAlgorithm is the only algorithm S3 offers for customer-provided
+	// keys.
+	sseCAlgorithm = "AES256"
+	sseCKeySize   = 32
+)
+
+// sseCKey is a customer-provided key that objects are encrypted with by S3,
+// which never stores it. It is kept encoded as the headers carry it, and is
+// never logged or written to disk; spooled batches name the key file instead.
+type sseCKey struct {
+	key string // base64 of the key
+	md5 string // base64 of the key's MD5
+}
+
+// loadSSECKey reads the base64-encoded 256-bit key in the file at path. An
+// empty path returns a nil key. The error never quotes the file's contents.
+func loadSSECKey(path string) (*sseCKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", sseCKeyFileKey, err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(raw) != sseCKeySize {
+		return nil, fmt.Errorf("invalid %s %q: must hold a base64-encoded %d-bit key", sseCKeyFileKey, path, sseCKeySize*8)
+	}
+	sum := md5.Sum(raw)
+	return &sseCKey{
+		key: base64.StdEncoding.EncodeToString(raw),
+		md5: base64.StdEncoding.EncodeToString(sum[:]),
+	}, nil
+}
+
+// set fills in the SSE-C headers of a request. A nil key sets none.
+func (k *sseCKey) set(algorithm, key, keyMD5 **string) {
+	if k == nil {
+		return
+	}
+	*algorithm, *key, *keyMD5 = aws.String(sseCAlgorithm), aws.String(k.key), aws.String(k.md5)
+}
+
+// customerKey returns the key b is encrypted with, if any. Batches read back
+// from the spool carry only the key file, which is read again.
+func (b *batch) customerKey() (*sseCKey, error) {
+	if b.ssec != nil || b.SSECKeyFile == "" {
+		return b.ssec, nil
+	}
+	return loadSSECKey(b.SSECKeyFile)
+}
+
+// getObject gets an object from the primary bucket with the logger's
+// customer-provided key, if it has one, explaining the errors S3 gives for
+// the wrong key or a missing one.
+func (l *S3Logger) getObject(ctx context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	l.ssec.set(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	out, err := l.s3Client.GetObject(ctx, input)
+	if err != nil {
+		err = l.describeSSECError(ctx, aws.ToString(input.Key), aws.ToString(input.VersionId), err)
+	}
+	return out, err
+}
+
+// describeSSECError explains err, from reading key. S3 refuses the wrong key
+// with a 403, like any other denial, so the object is checked again without
+// the key: an object that is only refused for lacking one is a bad request.
+func (l *S3Logger) describeSSECError(ctx context.Context, key, version string, err error) error {
+	status := httpStatus(err)
+	if l.ssec == nil {
+		if status == http.StatusBadRequest {
+			return fmt.Errorf("object %q is encrypted with a customer-provided key, set %s: %w", key, sseCKeyFileKey, err)
+		}
+		return err
+	}
+	if status != http.StatusForbidden {
+		return err
+	}
+	input := &s3.HeadObjectInput{
+		Bucket:       aws.String(l.bucket),
+		Key:          aws.String(key),
+		RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+	}
+	if version != "" {
+		input.VersionId = aws.String(version)
+	}
+	if _, herr := l.s3Client.HeadObject(ctx, input); httpStatus(herr) == http.StatusBadRequest {
+		return fmt.Errorf("SSE-C key mismatch: object %q wasn't encrypted with the key in %s: %w", key, sseCKeyFileKey, err)
+	}
+	return err
+}
+
+// httpStatus returns the HTTP status of the response err is from, or 0.
+func httpStatus(err error) int {
+	var re *awshttp.ResponseError
+	if !errors.As(err, &re) {
+		return 0
+	}
+	return re.HTTPStatusCode()
+}
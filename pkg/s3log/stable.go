@@ -0,0 +1,156 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	stableKeySourceKey = "stable-key-source"
+	readPriorRunsKey   = "read-prior-runs"
+
+	stableKeyContainerName = "container-name"
+	stableKeyService       = "service"
+	stableKeyLabelPrefix   = "label:"
+
+	// runPrefix starts the key component naming a run, followed by when its
+	// container was created in runFormat, so that runs sort in that order.
+	runPrefix = "run="
+	runFormat = "20060102T150405Z"
+)
+
+// parseStableKeySource validates a stable-key-source: container-name,
+// service, label:<name>, or nothing to key objects by container ID.
+func parseStableKeySource(v string) error {
+	switch {
+	case v == "", v == stableKeyContainerName, v == stableKeyService:
+		return nil
+	case strings.HasPrefix(v, stableKeyLabelPrefix) && len(v) > len(stableKeyLabelPrefix):
+		return nil
+	}
+	return errors.New("must be container-name, service or label:<name>")
+}
+
+// stableKey returns the identity the container's objects are keyed by with
+// source, which the containers that replace it on a restart or redeploy
+// share, reporting false if the container has no value for source and its
+// name was used instead. Slashes are replaced so the key stays a single path
+// component.
+func stableKey(source string, info Info) (string, bool) {
+	var key string
+	switch {
+	case source == stableKeyService:
+		key = serviceKey(info.ContainerLabels)
+	case strings.HasPrefix(source, stableKeyLabelPrefix):
+		key = info.ContainerLabels[strings.TrimPrefix(source, stableKeyLabelPrefix)]
+	default:
+		key = info.Name()
+	}
+	ok := key != ""
+	if !ok {
+		key = info.Name()
+	}
+	return strings.ReplaceAll(key, "/", "_"), ok
+}
+
+// serviceKey returns the replica a container runs from its labels: its Swarm
+// service and task slot, else its Compose project, service and container
+// number, or "" if it has neither.
+func serviceKey(labels map[string]string) string {
+	if service := labels["com.docker.swarm.service.name"]; service != "" {
+		// Tasks are named <service>.<slot>.<task ID>, or <service>.<node
+		// ID>.<task ID> for a global service.
+		task := strings.TrimPrefix(labels["com.docker.swarm.task.name"], service+".")
+		if slot, _, ok := strings.Cut(task, "."); ok {
+			return service + "." + slot
+		}
+		return service
+	}
+	service := labels["com.docker.compose.service"]
+	if service == "" {
+		return ""
+	}
+	if project := labels["com.docker.compose.project"]; project != "" {
+		service = project + "_" + service
+	}
+	if n := labels["com.docker.compose.container-number"]; n != "" {
+		service += "_" + n
+	}
+	return service
+}
+
+// runName returns the key component of the run of a container created at
+// created.
+func runName(created time.Time) string {
+	return runPrefix + created.UTC().Format(runFormat)
+}
+
+// identityPrefix returns the part of containerKeyPrefix that every run of the
+// container's stable key shares, which is all of it without one.
+func (l *S3Logger) identityPrefix() string {
+	prefix := l.containerKeyPrefix()
+	if l.run == "" {
+		return prefix
+	}
+	if i := strings.LastIndex(prefix, "/"+l.run); i >= 0 {
+		return prefix[:i+1]
+	}
+	return prefix
+}
+
+// prefixBase returns the part of prefix, one of the container's listing
+// prefixes of any of its runs, ahead of the rendered key template: the
+// s3-prefix and the partition.
+func (l *S3Logger) prefixBase(prefix string) string {
+	if i := strings.LastIndex(prefix, l.identityPrefix()); i >= 0 {
+		return prefix[:i]
+	}
+	return prefix
+}
+
+// runPrefixes returns prefixes, as listPrefixes returns them, each followed
+// by the same prefix for every other run of the container's stable key,
+// oldest run first. Without a stable key, or if its key prefix doesn't end
+// with the run, prefixes are returned as they are.
+func (l *S3Logger) runPrefixes(ctx context.Context, prefixes []string) ([]string, error) {
+	if l.run == "" {
+		return prefixes, nil
+	}
+	var all []string
+	for _, prefix := range prefixes {
+		i := strings.LastIndex(prefix, "/"+l.run+"/")
+		if i < 0 {
+			all = append(all, prefix)
+			continue
+		}
+		parent, rest := prefix[:i+1], prefix[i+len(l.run)+2:]
+		runs := []string{prefix}
+		pages := s3.NewListObjectsV2Paginator(l.s3Client, &s3.ListObjectsV2Input{
+			Bucket:       aws.String(l.bucket),
+			Prefix:       aws.String(parent + runPrefix),
+			Delimiter:    aws.String("/"),
+			RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+		})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range page.CommonPrefixes {
+				if run := aws.ToString(p.Prefix) + rest; run != prefix {
+					runs = append(runs, run)
+				}
+			}
+		}
+		slices.Sort(runs)
+		all = append(all, runs...)
+	}
+	return all, nil
+}
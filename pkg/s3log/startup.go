@@ -0,0 +1,43 @@
+package s3log
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	startupGraceKey = "startup-grace"
+
+	// startupFlushFactor is how many times flush-bytes a logger buffers
+	// before flushing during startup-grace.
+	startupFlushFactor = 4
+)
+
+// inStartupGrace reports whether the logger is still in the startup-grace
+// after it started, when it flushes less often and at a lower priority so
+// that a container dumping its configuration as it starts doesn't crowd out
+// the uploads of the others.
+func (l *S3Logger) inStartupGrace() bool {
+	return l.opts.StartupGrace > 0 && time.Since(l.started) < l.opts.StartupGrace
+}
+
+// overFlushBytes reports whether the buffer holds enough to flush.
+func (l *S3Logger) overFlushBytes() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Len() >= l.flushBytes()
+}
+
+// priorityKey marks the context of an upload that yields to the others.
+type priorityKey struct{}
+
+// withLowPriority returns ctx with its uploads queued behind those of every
+// other context for a worker of the pool.
+func withLowPriority(ctx context.Context) context.Context {
+	return context.WithValue(ctx, priorityKey{}, true)
+}
+
+func isLowPriority(ctx context.Context) bool {
+	low, _ := ctx.Value(priorityKey{}).(bool)
+	return low
+}
@@ -0,0 +1,105 @@
+package s3log
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStartupGraceFlushBytes(t *testing.T) {
+	// During startup-grace four times flush-bytes is buffered, and once it
+	// is over what was held back is flushed without waiting for the
+	// interval.
+	fake := newFakeS3()
+	l := newTestLogger(t, fake, map[string]string{
+		flushBytesKey:    "1kb",
+		flushIntervalKey: "1h",
+		startupGraceKey:  "300ms",
+	})
+	logLines(t, l, time.Now(), strings.Repeat("x", 2048))
+	time.Sleep(100 * time.Millisecond)
+	if n := fake.count("PutObject"); n != 0 {
+		t.Fatalf("%d PUTs of twice flush-bytes during startup-grace, want none", n)
+	}
+	waitFor(t, "the flush at the end of startup-grace", func() bool { return fake.count("PutObject") == 1 })
+	if l.inStartupGrace() {
+		t.Errorf("logger in startup-grace after %s", time.Since(l.started))
+	}
+
+	l.mu.Lock()
+	n := l.flushBytes()
+	l.mu.Unlock()
+	if n != 1024 {
+		t.Errorf("flushes at %d bytes after startup-grace, want flush-bytes", n)
+	}
+}
+
+func TestStartupGraceNotStarving(t *testing.T) {
+	// Containers starting at once each flush a burst through the host's one
+	// upload worker, and a container past its startup-grace that flushes
+	// among them goes ahead of all but the upload already running.
+	const bursting = 6
+	fake := newFakeS3()
+	gate := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	fake.before = func(_ context.Context, op, _, key string) error {
+		if op != "PutObject" {
+			return nil
+		}
+		mu.Lock()
+		order = append(order, key)
+		first := len(order) == 1
+		mu.Unlock()
+		if first {
+			<-gate
+		}
+		return nil
+	}
+	opts, err := parseLogOpts(DefaultOptions(), testLogOpts(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newUploadPool(1, defaultBreakerThreshold, defaultBreakerCooldown, 0)
+	d := newDriver(newTestClients(fake), pool, newMemoryBudget(defaultMaxTotalBuffer), opts)
+	t.Cleanup(d.cancel)
+	start := func(name, grace string) *S3Logger {
+		cfg := testLogOpts(t, map[string]string{flushBytesKey: "1kb", flushIntervalKey: "1h", startupGraceKey: grace})
+		info := Info{Config: cfg, ContainerID: fmt.Sprintf("%x", sha256.Sum256([]byte(name))), ContainerName: "/" + name}
+		copts, err := parseLogOpts(opts, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cl, err := newLogger(d.clients, d.pool, d.budget, copts, info, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cl.Close() })
+		return s3Loggers(cl)[0]
+	}
+	steady := start("steady", "0s")
+	burst := strings.Repeat("x", 5000)
+	for i := range bursting {
+		l := start(fmt.Sprintf("burst%d", i), "1h")
+		logLines(t, l, time.Now(), burst)
+		if i == 0 {
+			waitFor(t, "the first burst's upload", func() bool { return fake.count("PutObject") == 1 })
+			continue
+		}
+		waitFor(t, "the burst's flush to queue", func() bool { return queued(pool) == i })
+	}
+	logLines(t, steady, time.Now(), burst)
+	waitFor(t, "the steady container's flush to queue", func() bool { return queued(pool) == bursting })
+	close(gate)
+	waitFor(t, "every flush", func() bool { return fake.count("PutObject") == bursting+1 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(order[1], "steady/") {
+		t.Errorf("uploaded %q, want the steady container's second", order)
+	}
+}
@@ -0,0 +1,119 @@
+package s3log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const stateDirKey = "state-dir"
+
+// loggerState is what a logger persists after every flush so that a
+// restarted plugin carries on where it left off for containers that are
+// still running.
+type loggerState struct {
+	Sequence     int64     `json:"sequence"`
+	LineSequence int64     `json:"line_sequence"`
+	BytesWritten int64     `json:"bytes_written"`
+	LastFlush    time.Time `json:"last_flush"`
+
+	// Stream is the multipart upload of write-mode=multipart-stream in
+	// progress, and Unfinished those whose completion failed.
+	Stream     *streamState  `json:"stream,omitempty"`
+	Unfinished []streamState `json:"unfinished,omitempty"`
+
+	// Dedupe holds the hashes of dedupe-window as of the last flush.
+	Dedupe []dedupeEntry `json:"dedupe,omitempty"`
+}
+
+// statePath returns the file the logger's state is kept in, or "" if no
+// state-dir is configured. Loggers of a split container get a file per
+// stream. With a stable key the file is named after it instead of the
+// container, so that each run carries on the numbering of the last.
+func (l *S3Logger) statePath() string {
+	if l.opts.StateDir == "" {
+		return ""
+	}
+	name := l.fileName()
+	if l.stableID != "" {
+		name = "stable-" + l.stableID
+		if l.opts.stream != "" {
+			name += "-" + l.opts.stream
+		}
+	}
+	return filepath.Join(l.opts.StateDir, name+".json")
+}
+
+// fileName names the files kept for the logger: its container, followed by
+// its stream for the loggers of a split container.
+func (l *S3Logger) fileName() string {
+	name := l.info.ContainerID
+	if l.opts.stream != "" {
+		name += "-" + l.opts.stream
+	}
+	return name
+}
+
+// loadState reads the logger's persisted state. A missing file isn't an
+// error; the zero state is returned along with false.
+func (l *S3Logger) loadState() (loggerState, bool, error) {
+	var st loggerState
+	path := l.statePath()
+	if path == "" {
+		return st, false, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, false, nil
+	}
+	if err != nil {
+		return st, false, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, false, fmt.Errorf("invalid state file %q: %v", path, err)
+	}
+	return st, true, nil
+}
+
+// saveState persists the logger's state, replacing the file atomically so a
+// crash never leaves it half written. Callers must hold l.flushMu.
+func (l *S3Logger) saveState() error {
+	path := l.statePath()
+	if path == "" {
+		return nil
+	}
+	l.state.Dedupe = l.hashes.saved()
+	data, err := json.Marshal(l.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.opts.StateDir, 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// removeState deletes the logger's state once its container has stopped.
+// The state of a stable key is kept for its next run.
+func (l *S3Logger) removeState() {
+	path := l.statePath()
+	if path == "" || l.stableID != "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		l.log().WithField("file", path).WithError(err).Warn("error removing logger state")
+	}
+}
@@ -0,0 +1,57 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateAcrossRestart(t *testing.T) {
+	fake := newFakeS3()
+	cfg := map[string]string{stateDirKey: t.TempDir()}
+
+	// The plugin dies after a flush, without closing the logger.
+	before := newTestLogger(t, fake, cfg)
+	logLines(t, before, time.Now(), "before", "restart")
+	if err := before.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(before.statePath()); err != nil {
+		t.Fatalf("no state persisted after a flush: %v", err)
+	}
+	first := fake.logKeys(testBucket)
+	before.abandon()
+
+	after := newTestLogger(t, fake, cfg)
+	if after.lineSeq != before.lineSeq {
+		t.Errorf("restarted at line %d, want %d", after.lineSeq, before.lineSeq)
+	}
+	logLines(t, after, time.Now(), "after", "restart")
+	if err := after.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := fake.logKeys(testBucket)
+	if len(first) != 1 || len(keys) != 2 {
+		t.Fatalf("uploaded %q then %q, want an object before the restart and another after", first, keys)
+	}
+	if got := objectLines(t, after, first[0]); !slices.Equal(got, []string{"before", "restart"}) {
+		t.Errorf("object from before the restart was overwritten with %q", got)
+	}
+	o, _ := fake.object(testBucket, keys[1])
+	var seqs []int64
+	for _, line := range strings.Split(strings.TrimSpace(string(o.data)), "\n") {
+		var r record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, r.Seq)
+	}
+	if !slices.Equal(seqs, []int64{3, 4}) {
+		t.Errorf("lines after the restart numbered %v, want [3 4]", seqs)
+	}
+}
@@ -0,0 +1,138 @@
+package s3log
+
+import (
+	"encoding/json"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsSnapshot is what the plugin writes to stderr on SIGUSR1.
+type statsSnapshot struct {
+	Time               time.Time        `json:"time"`
+	Goroutines         int              `json:"goroutines"`
+	TotalBufferedBytes int64            `json:"total_buffered_bytes"`
+	Containers         []containerStats `json:"containers"`
+	Spools             []spoolStats     `json:"spools"`
+	CostBudget         *costBudgetStats `json:"cost_budget,omitempty"`
+	Routines           routineStats     `json:"container_goroutines"`
+}
+
+type containerStats struct {
+	ID               string     `json:"id"`
+	Name             string     `json:"name"`
+	BufferedBytes    int64      `json:"buffered_bytes"`
+	LinesReceived    int64      `json:"lines_received"`
+	LinesUploaded    int64      `json:"lines_uploaded"`
+	LinesDropped     int64      `json:"lines_dropped"`
+	LinesSkipped     int64      `json:"lines_skipped"`
+	LinesStripped    int64      `json:"lines_ansi_stripped"`
+	ThrottledFlushes int64      `json:"throttled_flushes"`
+	FlushTargetBytes int64      `json:"flush_target_bytes"`
+	LastFlush        *time.Time `json:"last_flush,omitempty"`
+	LastError        string     `json:"last_error,omitempty"`
+	Goroutines       int        `json:"goroutines,omitempty"`
+	LinesDeduped     int64      `json:"lines_deduplicated,omitempty"`
+}
+
+type spoolStats struct {
+	Dir     string `json:"dir"`
+	Bytes   int64  `json:"bytes"`
+	Batches int    `json:"batches"`
+}
+
+// dumpStats writes a snapshot of every active logger and spool to w as a
+// line of JSON. It reads the loggers' metrics and atomics, so it never waits
+// on a flush.
+func (d *Driver) dumpStats(w io.Writer) error {
+	d.mu.Lock()
+	pairs := make([]*logPair, 0, len(d.logs))
+	for _, lf := range d.logs {
+		pairs = append(pairs, lf)
+	}
+	spools := make(map[string]*spool, len(d.spools))
+	for dir, sp := range d.spools {
+		spools[dir] = sp
+	}
+	d.mu.Unlock()
+
+	snap := statsSnapshot{
+		Time:       time.Now(),
+		Goroutines: runtime.NumGoroutine(),
+		Containers: []containerStats{},
+		Spools:     []spoolStats{},
+	}
+	if d.budget != nil {
+		snap.TotalBufferedBytes = d.budget.used.Load()
+	}
+	snap.CostBudget = d.pool.costBudget().stats()
+	var byID map[string]int
+	snap.Routines, byID = countRoutines(len(pairs))
+	for _, lf := range pairs {
+		cs := containerStats{ID: lf.info.ContainerID, Name: lf.info.Name(), Goroutines: byID[lf.info.ContainerID]}
+		l, _ := lf.logger()
+		switch l := l.(type) {
+		case *S3Logger:
+			l.addStats(&cs)
+		case *splitLogger:
+			// The loggers of both streams share the container's series, so
+			// only the last flush and error are taken from the second, along
+			// with its flush target if that is larger.
+			l.loggers[0].addStats(&cs)
+			other := containerStats{}
+			l.loggers[1].addStats(&other)
+			cs.FlushTargetBytes = max(cs.FlushTargetBytes, other.FlushTargetBytes)
+			if other.LastFlush != nil && (cs.LastFlush == nil || other.LastFlush.After(*cs.LastFlush)) {
+				cs.LastFlush = other.LastFlush
+			}
+			if cs.LastError == "" {
+				cs.LastError = other.LastError
+			}
+		}
+		snap.Containers = append(snap.Containers, cs)
+	}
+	for dir, sp := range spools {
+		sp.mu.Lock()
+		snap.Spools = append(snap.Spools, spoolStats{Dir: dir, Bytes: sp.size, Batches: sp.batches})
+		sp.mu.Unlock()
+	}
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// addStats fills in cs from the logger's metrics, adding its lines uploaded
+// to every bucket.
+func (l *S3Logger) addStats(cs *containerStats) {
+	cs.BufferedBytes = int64(metricValue(l.metrics.buffered))
+	cs.LinesReceived = int64(metricValue(l.metrics.received))
+	cs.LinesDropped = int64(metricValue(l.metrics.dropped))
+	cs.LinesSkipped = int64(metricValue(l.metrics.skipped))
+	cs.LinesStripped = int64(metricValue(l.metrics.stripped))
+	cs.ThrottledFlushes = int64(metricValue(l.metrics.throttled))
+	cs.LinesDeduped = int64(metricValue(l.metrics.deduplicated))
+	cs.FlushTargetBytes = l.flushTarget.Load()
+	for _, t := range l.targets {
+		cs.LinesUploaded += int64(metricValue(t.metrics.lines))
+	}
+	if n := l.lastFlush.Load(); n > 0 {
+		t := time.Unix(0, n)
+		cs.LastFlush = &t
+	}
+	if err := l.lastError.Load(); err != nil {
+		cs.LastError = *err
+	}
+}
+
+// metricValue returns the current value of a counter or gauge.
+func metricValue(m prometheus.Metric) float64 {
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		return 0
+	}
+	if c := pb.GetCounter(); c != nil {
+		return c.GetValue()
+	}
+	return pb.GetGauge().GetValue()
+}
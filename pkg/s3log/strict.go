@@ -0,0 +1,80 @@
+package s3log
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	strictOptsKey = "strict-opts"
+
+	// maxSuggestions caps the log-opts suggested for each unknown one.
+	maxSuggestions = 3
+)
+
+// unknownOptsError returns the error naming the unknown log-opts, each
+// followed by the log-opts it is closest to, so that a typo such as
+// s3_bucket is caught rather than sending logs to the default bucket.
+func unknownOptsError(unknown []string) error {
+	sort.Strings(unknown)
+	described := make([]string, len(unknown))
+	for i, k := range unknown {
+		described[i] = k
+		if s := suggestOpts(k); len(s) > 0 {
+			described[i] += " (did you mean " + strings.Join(s, " or ") + "?)"
+		}
+	}
+	return fmt.Errorf("unknown log opt(s) for %s log driver: %s", driverName, strings.Join(described, ", "))
+}
+
+// suggestOpts returns up to maxSuggestions log-opts within a few edits of
+// k, closest first. Underscores and case are taken as hyphens and lower
+// case, the commonest slips, before measuring.
+func suggestOpts(k string) []string {
+	norm := strings.ToLower(strings.ReplaceAll(k, "_", "-"))
+	// A third of the key's length, so that short keys only match closely.
+	limit := max(1, min(3, len(norm)/3))
+	type candidate struct {
+		key  string
+		dist int
+	}
+	var candidates []candidate
+	for opt := range logOptKeys {
+		if d := editDistance(norm, opt); d <= limit {
+			candidates = append(candidates, candidate{opt, d})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].dist != candidates[j].dist {
+			return candidates[i].dist < candidates[j].dist
+		}
+		return candidates[i].key < candidates[j].key
+	})
+	var keys []string
+	for _, c := range candidates[:min(len(candidates), maxSuggestions)] {
+		keys = append(keys, c.key)
+	}
+	return keys
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,101 @@
+package s3log
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "abc", 0},
+		{"compres", "compress", 1},
+		{"flush-intreval", "flush-interval", 2},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestSuggestOpts(t *testing.T) {
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{key: "s3_bucket", want: []string{s3BucketKey}},
+		{key: "S3-Prefix", want: []string{s3PrefixKey}},
+		{key: "FLUSH_INTERVAL", want: []string{flushIntervalKey}},
+		{key: "compres", want: []string{compressKey}},
+		{key: "flush-intreval", want: []string{flushIntervalKey}},
+		// Short keys only match closely, so as not to suggest nonsense.
+		{key: "mod", want: []string{modeKey}},
+		{key: "xyz"},
+		{key: "completely-unrelated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := suggestOpts(tt.key); !slices.Equal(got, tt.want) {
+				t.Errorf("suggestOpts(%q) = %q, want %q", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuggestOptsCapped(t *testing.T) {
+	// Of the many log-opts as close as each other, the first few by name
+	// are suggested.
+	near := []string{"zone-d", "zone-b", "zone-a", "zone-c", "zonea"}
+	for _, k := range near {
+		logOptKeys[k] = true
+	}
+	defer func() {
+		for _, k := range near {
+			delete(logOptKeys, k)
+		}
+	}()
+	if got, want := suggestOpts("zone-x"), []string{"zone-a", "zone-b", "zone-c"}; !slices.Equal(got, want) {
+		t.Errorf("suggestOpts = %q, want %q", got, want)
+	}
+	if got, want := suggestOpts("zone-dx"), []string{"zone-d", "zone-a", "zone-b"}; !slices.Equal(got, want) {
+		t.Errorf("suggestOpts = %q, want the closest first, %q", got, want)
+	}
+}
+
+func TestLenientOptsWarning(t *testing.T) {
+	// With strict-opts=false the container starts, but the warning carries
+	// the same suggestions as the error.
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	cfg := testLogOpts(t, map[string]string{"s3_bucket": "elsewhere", strictOptsKey: "false"})
+	if _, err := parseLogOpts(DefaultOptions(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	var warned bool
+	for _, e := range hook.AllEntries() {
+		if e.Level == logrus.WarnLevel && strings.Contains(e.Message, "s3_bucket (did you mean s3-bucket?)") {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Error("no warning naming the unknown log-opt and its suggestion")
+	}
+
+	cfg[strictOptsKey] = "maybe"
+	if _, err := parseLogOpts(DefaultOptions(), cfg); err == nil || !strings.Contains(err.Error(), strictOptsKey) {
+		t.Errorf("%s=maybe refused with %v, want an error naming it", strictOptsKey, err)
+	}
+}
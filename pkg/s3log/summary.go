@@ -0,0 +1,146 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	summaryKey = "summary"
+
+	summaryName = "_summary.json"
+)
+
+// runSummary describes a container's run, from when its logger started to
+// when the container stopped, so that how much it logged and when can be
+// told without reading its objects, and with exit-event how it stopped.
+type runSummary struct {
+	ContainerID   string    `json:"container_id"`
+	ContainerName string    `json:"container_name"`
+	Image         string    `json:"image,omitempty"`
+	Created       time.Time `json:"created"`
+	Started       time.Time `json:"started"`
+	Stopped       time.Time `json:"stopped"`
+	Lines         int64     `json:"lines"`
+	RawBytes      int64     `json:"raw_bytes"`
+	StoredBytes   int64     `json:"stored_bytes"`
+	Dropped       int64     `json:"dropped"`
+	Filtered      int64     `json:"filtered"`
+	Sampled       int64     `json:"sampled"`
+	Skipped       int64     `json:"skipped"`
+	Partitions    []string  `json:"partitions"`
+
+	Exit *containerExit `json:"exit,omitempty"`
+}
+
+// summaryPath returns the key of the container's run summary, or "" if the
+// logger writes none. Both loggers of a split container share one, outside
+// the stream prefixes.
+func (l *S3Logger) summaryPath() string {
+	if !l.opts.Summary {
+		return ""
+	}
+	prefix := l.containerKeyPrefix()
+	if prefix == "" {
+		prefix = l.info.ContainerID + "/"
+	}
+	s3Prefix := l.opts.S3Prefix
+	if l.opts.stream != "" {
+		s3Prefix = strings.TrimSuffix(s3Prefix, l.opts.stream+"/")
+	}
+	return s3Prefix + prefix + summaryName
+}
+
+// countObject adds an object of the flush to the run's totals: raw bytes
+// before compression and stored after, in partition. Callers must hold
+// l.flushMu.
+func (l *S3Logger) countObject(raw, stored int, partition string) {
+	l.rawBytes += int64(raw)
+	l.storedBytes += int64(stored)
+	if partition != "" {
+		if l.partitions == nil {
+			l.partitions = make(map[string]bool)
+		}
+		l.partitions[strings.TrimSuffix(partition, "/")] = true
+	}
+}
+
+// summary returns the summary of the run so far. The line counts come from
+// the container's series, which the loggers of a split container share.
+func (l *S3Logger) summary() runSummary {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+	s := runSummary{
+		ContainerID:   l.info.ContainerID,
+		ContainerName: l.info.Name(),
+		Image:         l.info.ContainerImageName,
+		Created:       l.info.ContainerCreated,
+		Started:       l.started,
+		Stopped:       time.Now(),
+		Lines:         int64(metricValue(l.metrics.received)),
+		RawBytes:      l.rawBytes,
+		StoredBytes:   l.storedBytes,
+		Dropped:       int64(metricValue(l.metrics.dropped)),
+		Filtered:      int64(metricValue(l.metrics.filtered)),
+		Sampled:       int64(metricValue(l.metrics.sampled)),
+		Skipped:       int64(metricValue(l.metrics.skipped)),
+		Partitions:    []string{},
+	}
+	for p := range l.partitions {
+		s.Partitions = append(s.Partitions, p)
+	}
+	slices.Sort(s.Partitions)
+	return s
+}
+
+// writeSummary uploads the summary of the container's run once it has
+// stopped, as exit if it isn't nil, and the logger has been closed.
+func (l *S3Logger) writeSummary(exit *containerExit) {
+	s := l.summary()
+	s.Exit = exit
+	l.putSummary(s)
+}
+
+// putSummary uploads s to the primary bucket, retrying once, and sends an
+// upload notification for it naming it as the summary. It is best effort: a
+// summary that can't be written is logged and given up on.
+func (l *S3Logger) putSummary(s runSummary) {
+	key := l.summaryPath()
+	if key == "" {
+		return
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	t := l.targets[0]
+	b := &batch{
+		Bucket:       t.bucket,
+		Key:          key,
+		ContentType:  "application/json",
+		ContainerID:  l.info.ContainerID,
+		SSE:          l.opts.SSE,
+		SSEKMSKeyID:  l.opts.SSEKMSKeyID,
+		RequestPayer: l.opts.RequestPayer,
+		Client:       t.cfg,
+		Tag:          l.keyData.Tag,
+		NotifyTopic:  l.opts.NotifyTopic,
+		NotifyQueue:  l.opts.NotifyQueue,
+		body:         data,
+		summary:      true,
+	}
+	l.retain(b)
+	ctx, cancel := context.WithTimeout(context.Background(), l.opts.ShutdownFlushTimeout)
+	defer cancel()
+	err = retry(ctx, 1, l.opts.MaxRetryDelay, func() error {
+		return uploadBatch(ctx, t.uploader, b)
+	})
+	if err != nil {
+		s3Failed(l.log().WithField("key", key), t.bucket, err).Warn("error writing run summary")
+		return
+	}
+	l.clients.notifyUpload(ctx, b)
+}
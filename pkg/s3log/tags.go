@@ -0,0 +1,110 @@
+package s3log
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+const (
+	objectTagsKey     = "object-tags"
+	objectMetadataKey = "object-metadata"
+
+	// S3 refuses a PUT with more tags, or longer tag keys and values.
+	maxObjectTags     = 10
+	maxObjectTagKey   = 128
+	maxObjectTagValue = 256
+
+	contentTypeJSONL = "application/x-ndjson"
+	contentTypeRaw   = "text/plain"
+)
+
+func init() {
+	requirePermissions(permission{"s3:PutObjectTagging", onObjects, objectTagsKey, func(s permissionScope) bool { return len(s.opts.ObjectTags) > 0 }})
+}
+
+// parsePairs parses a comma-separated list of k=v pairs.
+func parsePairs(key, v string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	if v == "" {
+		return pairs, nil
+	}
+	for _, pair := range strings.Split(v, ",") {
+		k, val, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid %s %q: must be comma-separated k=v pairs", key, pair)
+		}
+		if _, dup := pairs[k]; dup {
+			return nil, fmt.Errorf("invalid %s: %q is set twice", key, k)
+		}
+		pairs[k] = strings.TrimSpace(val)
+	}
+	return pairs, nil
+}
+
+// parseObjectTags parses the object-tags option, checking it against S3's
+// limits on tags.
+func parseObjectTags(v string) (map[string]string, error) {
+	tags, err := parsePairs(objectTagsKey, v)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) > maxObjectTags {
+		return nil, fmt.Errorf("invalid %s: S3 allows at most %d tags, got %d", objectTagsKey, maxObjectTags, len(tags))
+	}
+	for k := range tags {
+		if utf8.RuneCountInString(k) > maxObjectTagKey {
+			return nil, fmt.Errorf("invalid %s: key %q is longer than %d characters", objectTagsKey, k, maxObjectTagKey)
+		}
+	}
+	return tags, nil
+}
+
+// renderPairs executes each value as a template against the container's key
+// data, so that values can refer to fields such as {{.ContainerName}}.
+func renderPairs(key string, pairs map[string]string, data keyData) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	rendered := make(map[string]string, len(pairs))
+	for k, v := range pairs {
+		tmpl, err := template.New(key).Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value for %q: %v", key, k, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("invalid %s value for %q: %v", key, k, err)
+		}
+		rendered[k] = buf.String()
+	}
+	return rendered, nil
+}
+
+// encodeTagging encodes tags as the URL query string S3 expects in the
+// x-amz-tagging header.
+func encodeTagging(tags map[string]string) (string, error) {
+	values := make(url.Values, len(tags))
+	for k, v := range tags {
+		if utf8.RuneCountInString(v) > maxObjectTagValue {
+			return "", fmt.Errorf("invalid %s: value of %q is longer than %d characters", objectTagsKey, k, maxObjectTagValue)
+		}
+		values.Set(k, v)
+	}
+	return values.Encode(), nil
+}
+
+// contentType returns the Content-Type of objects written in format.
+func contentType(format string) string {
+	switch format {
+	case formatRaw:
+		return contentTypeRaw
+	case formatParquet:
+		return contentTypeParquet
+	}
+	return contentTypeJSONL
+}
@@ -0,0 +1,127 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// tailRangeSize is how many bytes from the end of an object readTail first
+// downloads. Each further request downloads four times as much again.
+const tailRangeSize = 64 << 10
+
+// collectFunc decodes the messages that read emits, keeping those the
+// reader wants.
+type collectFunc func(read func(emitFunc) error) ([]*Message, error)
+
+// readTail returns at least the last n messages collect keeps from obj, or
+// all of them if it holds fewer. Rather than download the whole object,
+// ranges are fetched from its end, each further back than the last, until
+// enough lines have been found. Compressed objects are downloaded in full:
+// neither gzip nor zstd can be decoded from an arbitrary offset, so there
+// is no way to find the last lines without reading every byte before them.
+func (l *S3Logger) readTail(ctx context.Context, obj logObject, n int, collect collectFunc) ([]*Message, error) {
+	full := func() ([]*Message, error) {
+		return collect(func(emit emitFunc) error { return l.readObject(ctx, obj, emit) })
+	}
+	if obj.key == "" || obj.size <= tailRangeSize || isCompressed(obj.key) {
+		return full()
+	}
+
+	// data holds the object from off to its end. prev is the byte before
+	// off, fetched along with each range so it is known whether data starts
+	// with a whole line.
+	var data []byte
+	var prev byte
+	off := obj.size
+	for grow := int64(tailRangeSize); ; grow *= 4 {
+		start := max(off-grow, 0)
+		from := max(start-1, 0)
+		chunk, encoded, err := l.getRange(ctx, obj, from, off-1)
+		if isDeleted(err) {
+			l.log().WithField("key", obj.key).Debug("object was deleted, skipping it")
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if encoded {
+			return full()
+		}
+		if start > 0 {
+			if len(chunk) == 0 {
+				return nil, fmt.Errorf("failed to read object %q: empty range", obj.key)
+			}
+			prev, chunk = chunk[0], chunk[1:]
+		}
+		data = append(chunk, data...)
+		off = start
+
+		// Unless data starts the object or follows a newline, its first
+		// line is cut short.
+		lines := data
+		if off > 0 && prev != '\n' {
+			i := bytes.IndexByte(lines, '\n')
+			if i < 0 {
+				continue
+			}
+			lines = lines[i+1:]
+		}
+		// An object compressed by another tool, without the extension or
+		// Content-Encoding that say so, can only be read in full.
+		if !isText(lines[:min(len(lines), sniffSize)]) {
+			return full()
+		}
+		msgs, err := collect(func(emit emitFunc) error { return l.decode(bytes.NewReader(lines), obj.key, obj.time, emit) })
+		if err != nil {
+			return nil, fmt.Errorf("failed to read object %q: %v", obj.key, err)
+		}
+		if len(msgs) >= n || off == 0 {
+			return msgs, nil
+		}
+	}
+}
+
+// getRange downloads bytes from through to of obj, reporting whether the
+// object turned out to be stored compressed, in which case nothing is read.
+func (l *S3Logger) getRange(ctx context.Context, obj logObject, from, to int64) ([]byte, bool, error) {
+	key := obj.key
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(l.bucket),
+		Key:          aws.String(key),
+		Range:        aws.String(fmt.Sprintf("bytes=%d-%d", from, to)),
+		RequestPayer: types.RequestPayer(l.opts.RequestPayer),
+	}
+	if obj.version != "" {
+		input.VersionId = aws.String(obj.version)
+	}
+	out, err := l.getObject(ctx, input)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get object %q from S3: %w", key, err)
+	}
+	defer out.Body.Close()
+	if encoding := aws.ToString(out.ContentEncoding); encoding != "" && encoding != "identity" {
+		return nil, true, nil
+	}
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read object %q: %v", key, err)
+	}
+	return data, false, nil
+}
+
+// isCompressed reports whether key names an object compressed on upload.
+func isCompressed(key string) bool {
+	for _, codec := range codecs {
+		if strings.HasSuffix(key, codec.ext) {
+			return true
+		}
+	}
+	return false
+}
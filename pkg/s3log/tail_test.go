@@ -0,0 +1,124 @@
+package s3log
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixedLines returns n lines numbered from first, each of size bytes once
+// stored raw with its newline.
+func fixedLines(first, n, size int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		num := fmt.Sprintf("%d ", first+i)
+		lines[i] = num + strings.Repeat("x", size-len(num)-1)
+	}
+	return lines
+}
+
+func TestReadTail(t *testing.T) {
+	type object struct {
+		codec string
+		lines []string
+	}
+	tests := []struct {
+		name    string
+		objects []object // oldest first
+		tail    int
+		ranges  int // ranged GETs, the rest being whole objects
+		whole   int
+	}{
+		{
+			// The first range starts exactly at a line, which is whole.
+			name:    "range starts at a line",
+			objects: []object{{lines: fixedLines(0, 4096, 64)}},
+			tail:    tailRangeSize / 64,
+			ranges:  1,
+		},
+		{
+			// The first range cuts a line short, which is left to the next.
+			name:    "range splits a line",
+			objects: []object{{lines: fixedLines(0, 4096, 100)}},
+			tail:    tailRangeSize / 100,
+			ranges:  1,
+		},
+		{
+			name:    "range grown for one more line",
+			objects: []object{{lines: fixedLines(0, 4096, 100)}},
+			tail:    tailRangeSize/100 + 1,
+			ranges:  2,
+		},
+		{
+			name:    "range grown past the start",
+			objects: []object{{lines: fixedLines(0, 1000, 100)}},
+			tail:    999,
+			ranges:  2,
+		},
+		{
+			name:    "line longer than the range",
+			objects: []object{{lines: append(fixedLines(0, 10, 100), strings.Repeat("z", 3*tailRangeSize))}},
+			tail:    2,
+			ranges:  2,
+		},
+		{
+			name:    "object smaller than the range",
+			objects: []object{{lines: fixedLines(0, 100, 100)}},
+			tail:    10,
+			whole:   1,
+		},
+		{
+			// The newest object is read whole and the older one from its
+			// end for the rest.
+			name:    "newest object smaller than the range",
+			objects: []object{{lines: fixedLines(0, 4096, 100)}, {lines: fixedLines(4096, 10, 100)}},
+			tail:    50,
+			ranges:  1,
+			whole:   1,
+		},
+		{
+			name:    "compressed",
+			objects: []object{{codec: compressGzip, lines: fixedLines(0, 4096, 100)}},
+			tail:    10,
+			whole:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			l := newTestLogger(t, fake, map[string]string{formatKey: formatRaw})
+			ts := time.Now().Add(-time.Hour)
+			var all []string
+			for _, o := range tt.objects {
+				codec := o.codec
+				if codec == "" {
+					codec = compressNone
+				}
+				putObject(t, fake, l, codec, "", ts, o.lines...)
+				all = append(all, o.lines...)
+				ts = ts.Add(time.Minute)
+			}
+
+			got := readLogs(t, l, ReadConfig{Tail: tt.tail})
+			if want := all[len(all)-tt.tail:]; !slices.Equal(got, want) {
+				t.Errorf("tail of %d lines read %d of them, want the last %d", len(all), len(got), len(want))
+				if len(got) > 0 && len(want) > 0 {
+					t.Errorf("read %.20q to %.20q, want %.20q to %.20q", got[0], got[len(got)-1], want[0], want[len(want)-1])
+				}
+			}
+			var ranges, whole int
+			for _, r := range fake.getRanges() {
+				if r == "" {
+					whole++
+				} else {
+					ranges++
+				}
+			}
+			if ranges != tt.ranges || whole != tt.whole {
+				t.Errorf("%d ranged and %d whole GETs, want %d and %d: %q", ranges, whole, tt.ranges, tt.whole, fake.getRanges())
+			}
+		})
+	}
+}
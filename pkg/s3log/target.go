@@ -0,0 +1,79 @@
+package s3log
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+// replica is a bucket every batch is copied to in addition to s3-bucket.
+type replica struct {
+	Bucket string
+	Region string
+}
+
+// parseBuckets splits the s3-bucket option, a comma-separated list of
+// buckets each optionally followed by @region. The first is where the
+// container's logs are read back from; the rest are replicas.
+func parseBuckets(v string) (string, string, []replica, error) {
+	var buckets []replica
+	for _, s := range strings.Split(v, ",") {
+		bucket, region, _ := strings.Cut(strings.TrimSpace(s), "@")
+		if bucket == "" {
+			return "", "", nil, fmt.Errorf("empty bucket name")
+		}
+		buckets = append(buckets, replica{Bucket: bucket, Region: region})
+	}
+	return buckets[0].Bucket, buckets[0].Region, buckets[1:], nil
+}
+
+// target is a bucket a logger uploads to, with the client for its region.
+type target struct {
+	bucket   string
+	cfg      clientConfig
+	client   s3API
+	uploader objectUploader
+	metrics  *targetMetrics
+
+	// manifest holds the objects uploaded or spooled since the manifest was
+	// last written.
+	manifest []manifestObject
+}
+
+// record notes b, uploaded or spooled, for the manifest if it keeps one.
+func (t *target) record(b *batch, spooled bool) {
+	if b.Manifest != "" {
+		t.manifest = append(t.manifest, b.manifestObject(spooled))
+	}
+}
+
+func newTarget(clients *clientFactory, opts LogOption, bucket, region string, m *containerMetrics) (*target, error) {
+	cfg := opts.clientConfig()
+	if region != "" {
+		cfg.Region = region
+	}
+	cfg, err := clients.resolve(context.Background(), bucket, cfg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := clients.client(cfg)
+	if err != nil {
+		return nil, err
+	}
+	uploader, err := clients.uploader(cfg, client, func(u *manager.Uploader) {
+		u.PartSize = opts.PartSize
+		u.Concurrency = opts.Concurrency
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &target{
+		bucket:   bucket,
+		cfg:      cfg,
+		client:   client,
+		uploader: uploader,
+		metrics:  m.target(bucket),
+	}, nil
+}
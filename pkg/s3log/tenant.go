@@ -0,0 +1,301 @@
+package s3log
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	tenantKey      = "tenant"
+	tenantLabelKey = "tenant-label"
+
+	// tenantsKey is the config file's section of tenants, by name.
+	tenantsKey = "tenants"
+	// tenantWeightKey sets a tenant's share of the upload pool's workers
+	// relative to the others'.
+	tenantWeightKey = "weight"
+
+	// defaultTenant is the tenant of the containers given none.
+	defaultTenant = "default"
+)
+
+// tenantSettings are the keys of a tenant's section of the config file that
+// aren't log-opts: its weight, and its own limits within the host's.
+var tenantSettings = map[string]bool{
+	tenantWeightKey:      true,
+	uploadWorkersKey:     true,
+	maxPutsKey:           true,
+	dailyBytesBudgetKey:  true,
+	dailyObjectBudgetKey: true,
+	overBudgetPolicyKey:  true,
+}
+
+// tenantNamePattern is what a tenant's name may be, as it goes into metric
+// labels and the name of its budget's file.
+var tenantNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+var (
+	tenantQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: driverName,
+		Name:      "tenant_upload_queue_depth",
+		Help:      "Uploads of the tenant's containers waiting for a free worker.",
+	}, []string{"tenant"})
+	tenantWorkersBusy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: driverName,
+		Name:      "tenant_upload_workers_busy",
+		Help:      "Workers of the upload pool running an upload of the tenant's containers.",
+	}, []string{"tenant"})
+	tenantUploadWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: driverName,
+		Name:      "tenant_upload_wait_seconds",
+		Help:      "How long the tenant's uploads waited for a free worker.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"tenant"})
+	tenantBudgetUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: driverName,
+		Name:      "tenant_cost_budget_used_bytes",
+		Help:      "Bytes the tenant's containers uploaded so far today (UTC), counted against its daily-bytes-budget.",
+	}, []string{"tenant"})
+	tenantBudgetUsedObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: driverName,
+		Name:      "tenant_cost_budget_used_objects",
+		Help:      "Objects the tenant's containers uploaded so far today (UTC), counted against its daily-object-budget.",
+	}, []string{"tenant"})
+	tenantBudgetExceeded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: driverName,
+		Name:      "tenant_cost_budget_exceeded",
+		Help:      "1 while a daily budget of the tenant is exceeded and its over-budget-policy is in effect, 0 otherwise.",
+	}, []string{"tenant", "policy"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(tenantQueueDepth, tenantWorkersBusy, tenantUploadWait, tenantBudgetUsedBytes, tenantBudgetUsedObjects, tenantBudgetExceeded)
+}
+
+// tenant is a group of containers, named by their tenant log-opt or the
+// label that tenant-label names, that uploads within limits of its own. The
+// config file's tenants section can give each the log-opts its containers
+// start from, such as the bucket and the role uploading to it, ahead of
+// their own; a weight for its share of the upload pool; the most of the
+// pool's workers it may have at once; and a max-puts-per-second and daily
+// budgets, which apply on top of the host's. A tenant the config file
+// doesn't list has a weight of 1 and only the host's limits.
+type tenant struct {
+	name    string
+	weight  float64
+	workers int // the most of the pool's workers it has at once, 0 for all
+	logOpts map[string]string
+	puts    *rate.Limiter // nil for no limit of its own
+	cost    *costBudget   // nil for no budget of its own
+
+	// Guarded by the pool's mu.
+	queue   []*poolJob
+	running int
+	vtime   float64 // virtual start of its next job
+}
+
+// newTenant returns the tenant name that section of the config file sets
+// up, on top of the plugin's defaults. Its budget, if it has one, follows
+// policy unless it sets its own, counts against host, and is kept under
+// stateDir if that is set.
+func newTenant(name string, section map[string]string, defaults LogOption, policy, stateDir string, host *costBudget) (*tenant, error) {
+	if !tenantNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid tenant %q: must be up to 63 letters, digits, '.', '_' or '-', starting with a letter or digit", name)
+	}
+	t := &tenant{name: name, weight: 1, logOpts: map[string]string{}}
+	for k, v := range section {
+		if !tenantSettings[k] {
+			t.logOpts[k] = v
+		}
+	}
+	for _, k := range []string{tenantKey, tenantLabelKey} {
+		if _, ok := t.logOpts[k]; ok {
+			return nil, fmt.Errorf("invalid tenant %q: its section can't set %s", name, k)
+		}
+	}
+	if err := ValidateLogOpt(t.logOpts); err != nil {
+		return nil, fmt.Errorf("invalid tenant %q: %v", name, err)
+	}
+	// Without a bucket, which its containers must set then, the values are
+	// checked as each starts.
+	if defaults.S3Bucket != "" || t.logOpts[s3BucketKey] != "" {
+		if _, err := parseLogOpts(defaults, t.logOpts); err != nil {
+			return nil, fmt.Errorf("invalid tenant %q: %v", name, err)
+		}
+	}
+	if v, ok := section[tenantWeightKey]; ok {
+		w, err := strconv.ParseFloat(v, 64)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid tenant %q: invalid %s %q: must be a positive number", name, tenantWeightKey, v)
+		}
+		t.weight = w
+	}
+	if v, ok := section[uploadWorkersKey]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid tenant %q: invalid %s %q: must be a non-negative integer", name, uploadWorkersKey, v)
+		}
+		t.workers = n
+	}
+	if v, ok := section[maxPutsKey]; ok {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid tenant %q: invalid %s %q: must be a non-negative number", name, maxPutsKey, v)
+		}
+		if n > 0 {
+			t.puts = newPutLimiter(n)
+		}
+	}
+	var maxBytes, maxObjects int64
+	for key, n := range map[string]*int64{dailyBytesBudgetKey: &maxBytes, dailyObjectBudgetKey: &maxObjects} {
+		v, ok := section[key]
+		if !ok {
+			continue
+		}
+		var err error
+		if *n, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid tenant %q: invalid %s %q: must be an integer", name, key, v)
+		}
+	}
+	if v, ok := section[overBudgetPolicyKey]; ok {
+		policy = v
+	}
+	var path string
+	if stateDir != "" {
+		path = filepath.Join(stateDir, "cost-budget-"+name+".json")
+	}
+	cost, err := newCostBudget(maxBytes, maxObjects, policy, path, name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant %q: %v", name, err)
+	}
+	if cost != nil {
+		cost.host = host
+		t.cost = cost
+	}
+	return t, nil
+}
+
+// addTenants sets up the tenants of the config file's tenants section, by
+// name, as newTenant does.
+func (p *uploadPool) addTenants(sections map[string]map[string]string, defaults LogOption, policy, stateDir string) error {
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		t, err := newTenant(name, sections[name], defaults, policy, stateDir, p.cost)
+		if err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.tenants[name] = t
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// tenant returns the tenant called name, setting up one with a weight of 1
+// and no limits of its own the first time a name the config file doesn't
+// list is seen, or nil if there is no pool. "" is defaultTenant.
+func (p *uploadPool) tenant(name string) *tenant {
+	if p == nil {
+		return nil
+	}
+	if name == "" {
+		name = defaultTenant
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.tenants[name]
+	if !ok {
+		t = &tenant{name: name, weight: 1}
+		p.tenants[name] = t
+	}
+	return t
+}
+
+// tenantBudget returns the daily budget uploads of tenant count against:
+// its own, which counts against the host's, or the host's if it has none.
+func (p *uploadPool) tenantBudget(tenant string) *costBudget {
+	if t := p.tenant(tenant); t != nil && t.cost != nil {
+		return t.cost
+	}
+	return p.costBudget()
+}
+
+// tenantPuts returns tenant's own max-puts-per-second limiter, or nil if it
+// has none.
+func (p *uploadPool) tenantPuts(tenant string) *rate.Limiter {
+	if t := p.tenant(tenant); t != nil {
+		return t.puts
+	}
+	return nil
+}
+
+// tenantCtxKey carries the tenant whose jobs a context's uploads queue as.
+type tenantCtxKey struct{}
+
+// withTenant returns ctx with its uploads queued as tenant's.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantCtxKey{}, tenant)
+}
+
+// tenantOf returns the tenant of ctx's uploads, defaultTenant if it has none.
+func tenantOf(ctx context.Context) string {
+	if t, _ := ctx.Value(tenantCtxKey{}).(string); t != "" {
+		return t
+	}
+	return defaultTenant
+}
+
+// tenantName returns the tenant of the container with info whose log-opts
+// are cfg, under defaults: its tenant, else the value of the label
+// tenant-label names, else defaultTenant.
+func tenantName(defaults LogOption, info Info, cfg map[string]string) (string, error) {
+	name, label := defaults.Tenant, defaults.TenantLabel
+	if v, ok := cfg[tenantKey]; ok {
+		name = v
+	}
+	if v, ok := cfg[tenantLabelKey]; ok {
+		label = v
+	}
+	from := tenantKey
+	if name == "" && label != "" {
+		name, from = info.ContainerLabels[label], "label "+label
+	}
+	if name == "" {
+		return defaultTenant, nil
+	}
+	if !tenantNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid tenant %q from %s: must be up to 63 letters, digits, '.', '_' or '-', starting with a letter or digit", name, from)
+	}
+	return name, nil
+}
+
+// tenantOptions returns the options of the container with info whose
+// log-opts are cfg, under defaults: the log-opts of its tenant's section of
+// the config file, if any, overridden by cfg. Tenant is set to the name of
+// its tenant.
+func (d *Driver) tenantOptions(defaults LogOption, info Info, cfg map[string]string) (LogOption, error) {
+	name, err := tenantName(defaults, info, cfg)
+	if err != nil {
+		return defaults, err
+	}
+	if t := d.pool.tenant(name); t != nil && len(t.logOpts) > 0 {
+		merged := maps.Clone(t.logOpts)
+		maps.Copy(merged, cfg)
+		cfg = merged
+	}
+	opts, err := parseLogOpts(defaults, cfg)
+	opts.Tenant = name
+	return opts, err
+}
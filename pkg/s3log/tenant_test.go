@@ -0,0 +1,357 @@
+package s3log
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// tenantPool returns a pool of workers workers with the tenants of
+// sections, closed at the end of the test.
+func tenantPool(t testing.TB, workers int, sections map[string]map[string]string) *uploadPool {
+	t.Helper()
+	p := newUploadPool(workers, defaultBreakerThreshold, defaultBreakerCooldown, 0)
+	t.Cleanup(p.close)
+	if err := p.addTenants(sections, LogOption{}, overBudgetContinue, ""); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// queueJobs queues n jobs of tenant on p, which has no workers to run them.
+func queueJobs(p *uploadPool, tenant string, n int) {
+	for range n {
+		p.enqueue(&poolJob{ctx: context.Background(), done: make(chan error, 1), tenant: p.tenant(tenant), queued: time.Now()})
+	}
+}
+
+func TestUploadPoolFairShare(t *testing.T) {
+	// With every tenant's queue full, free workers take their jobs in
+	// proportion to the tenants' weights, and a tenant that was idle gets
+	// its share from when it has jobs, not a burst for the time it had
+	// none.
+	tests := []struct {
+		name     string
+		sections map[string]map[string]string
+		idle     int // jobs of a taken before b queues any
+		takes    int
+		want     map[string]int
+	}{
+		{name: "equal", takes: 20, want: map[string]int{"a": 10, "b": 10}},
+		{name: "weighted", sections: map[string]map[string]string{"a": {tenantWeightKey: "3"}}, takes: 40, want: map[string]int{"a": 30, "b": 10}},
+		{name: "fractional", sections: map[string]map[string]string{"a": {tenantWeightKey: "0.5"}, "b": {tenantWeightKey: "1.5"}}, takes: 40, want: map[string]int{"a": 10, "b": 30}},
+		{name: "idle", idle: 20, takes: 20, want: map[string]int{"a": 10, "b": 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tenantPool(t, 0, tt.sections)
+			queueJobs(p, "a", tt.idle+tt.takes)
+			take := func() *poolJob {
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				j := p.take(time.Now())
+				// The job is done at once, so no tenant is held to its
+				// upload-workers.
+				j.tenant.running--
+				return j
+			}
+			for range tt.idle {
+				take()
+			}
+			queueJobs(p, "b", tt.takes)
+			got := map[string]int{}
+			var order []string
+			for range tt.takes {
+				j := take()
+				got[j.tenant.name]++
+				order = append(order, j.tenant.name)
+			}
+			if got["a"] != tt.want["a"] || got["b"] != tt.want["b"] {
+				t.Errorf("took %v, want %v: %s", got, tt.want, strings.Join(order, ""))
+			}
+			// No more than one past the weights' ratio in a row, so the
+			// share holds over any stretch rather than only on the whole.
+			heavy, light := "a", "b"
+			if got[heavy] < got[light] {
+				heavy, light = light, heavy
+			}
+			if run := strings.Repeat(heavy, tt.want[heavy]/tt.want[light]+2); strings.Contains(strings.Join(order, ""), run) {
+				t.Errorf("took %s in a row: %s", run, strings.Join(order, ""))
+			}
+		})
+	}
+}
+
+func TestUploadPoolTenantWorkers(t *testing.T) {
+	// A tenant at its upload-workers waits for one of its jobs to finish,
+	// while the others take the free workers, however far ahead it is.
+	p := tenantPool(t, 0, map[string]map[string]string{"a": {uploadWorkersKey: "2", tenantWeightKey: "100"}})
+	queueJobs(p, "a", 5)
+	queueJobs(p, "b", 5)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var order []string
+	for j := p.take(time.Now()); j != nil; j = p.take(time.Now()) {
+		order = append(order, j.tenant.name)
+	}
+	if got := strings.Join(order, ""); strings.Count(got, "a") != 2 || strings.Count(got, "b") != 5 {
+		t.Errorf("took %s, want a's up to its 2 workers and all of b's", got)
+	}
+	p.tenants["a"].running--
+	if j := p.take(time.Now()); j == nil || j.tenant.name != "a" {
+		t.Errorf("took %v once one of a's jobs finished, want another of a's", j)
+	}
+}
+
+// waitSamples returns how many waits tenantUploadWait has observed for
+// tenant.
+func waitSamples(t *testing.T, tenant string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := tenantUploadWait.WithLabelValues(tenant).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestUploadPoolNoisyTenant(t *testing.T) {
+	// One tenant keeps far more uploads queued than the pool has workers,
+	// or than its own upload-workers, while another flushes now and then.
+	// The noisy tenant uses every worker it may, and still the quiet
+	// tenant's uploads wait no longer for a worker than one upload takes.
+	const (
+		workers = 4
+		noisy   = 40 // uploads the noisy tenant keeps queued
+		upload  = 20 * time.Millisecond
+		flushes = 15
+	)
+	tests := []struct {
+		name      string
+		sections  map[string]map[string]string
+		wantNoisy int32 // the most of its uploads running at once
+	}{
+		{name: "weighted", sections: map[string]map[string]string{"quiet": {tenantWeightKey: "1"}}, wantNoisy: workers},
+		{name: "quota", sections: map[string]map[string]string{"noisy": {uploadWorkersKey: "2"}}, wantNoisy: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tenantPool(t, workers, tt.sections)
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			defer wg.Wait()
+			defer cancel()
+			var running, most atomic.Int32
+			for range noisy {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for ctx.Err() == nil {
+						p.do(withTenant(ctx, "noisy"), func(context.Context) error {
+							n := running.Add(1)
+							for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+							}
+							time.Sleep(upload)
+							running.Add(-1)
+							return nil
+						})
+					}
+				}()
+			}
+			waitFor(t, "the noisy tenant to saturate its workers", func() bool { return queued(p) >= noisy-workers })
+
+			samples := waitSamples(t, "quiet")
+			var waits []time.Duration
+			for range flushes {
+				queuedAt := time.Now()
+				var waited time.Duration
+				// A starved tenant fails the test rather than hanging it.
+				ctx, cancel := context.WithTimeout(withTenant(context.Background(), "quiet"), time.Second)
+				err := p.do(ctx, func(context.Context) error {
+					waited = time.Since(queuedAt)
+					time.Sleep(upload)
+					return nil
+				})
+				cancel()
+				if err != nil {
+					t.Fatalf("quiet tenant's upload: %v", err)
+				}
+				waits = append(waits, waited)
+				time.Sleep(upload)
+			}
+			cancel()
+			wg.Wait()
+
+			slices.Sort(waits)
+			// The median stays within an upload; the worst may also have
+			// waited out a slow scheduler.
+			if median, worst := waits[len(waits)/2], waits[len(waits)-1]; median > upload+10*time.Millisecond || worst > 4*upload {
+				t.Errorf("quiet tenant's uploads waited %s at the median and %s at worst, want no longer than an upload of %s", median, worst, upload)
+			}
+			if got := most.Load(); got != tt.wantNoisy {
+				t.Errorf("noisy tenant ran %d uploads at once, want %d", got, tt.wantNoisy)
+			}
+			if got := waitSamples(t, "quiet") - samples; got != flushes {
+				t.Errorf("tenant_upload_wait_seconds observed %d of the quiet tenant's waits, want %d", got, flushes)
+			}
+		})
+	}
+}
+
+func TestTenantName(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults LogOption
+		cfg      map[string]string
+		labels   map[string]string
+		want     string
+		wantErr  string
+	}{
+		{name: "none", want: defaultTenant},
+		{name: "log-opt", cfg: map[string]string{tenantKey: "team-a"}, want: "team-a"},
+		{name: "label", cfg: map[string]string{tenantLabelKey: "com.example.tenant"}, labels: map[string]string{"com.example.tenant": "team-b"}, want: "team-b"},
+		{name: "log-opt over label", cfg: map[string]string{tenantKey: "team-a", tenantLabelKey: "com.example.tenant"}, labels: map[string]string{"com.example.tenant": "team-b"}, want: "team-a"},
+		{name: "plugin's label", defaults: LogOption{TenantLabel: "com.example.tenant"}, labels: map[string]string{"com.example.tenant": "team-b"}, want: "team-b"},
+		{name: "label missing", cfg: map[string]string{tenantLabelKey: "com.example.tenant"}, want: defaultTenant},
+		{name: "bad label value", cfg: map[string]string{tenantLabelKey: "com.example.tenant"}, labels: map[string]string{"com.example.tenant": "team b"}, wantErr: `invalid tenant "team b" from label com.example.tenant`},
+		{name: "bad log-opt", cfg: map[string]string{tenantKey: "-a"}, wantErr: `invalid tenant "-a" from tenant`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tenantName(tt.defaults, Info{ContainerLabels: tt.labels}, tt.cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("tenantName returned %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("tenant %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTenantErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		tenant  string
+		section map[string]string
+		wantErr string
+	}{
+		{name: "bad name", tenant: "a/b", wantErr: `invalid tenant "a/b"`},
+		{name: "zero weight", tenant: "a", section: map[string]string{tenantWeightKey: "0"}, wantErr: "invalid weight"},
+		{name: "bad workers", tenant: "a", section: map[string]string{uploadWorkersKey: "-1"}, wantErr: "invalid upload-workers"},
+		{name: "bad puts", tenant: "a", section: map[string]string{maxPutsKey: "lots"}, wantErr: "invalid max-puts-per-second"},
+		{name: "bad budget", tenant: "a", section: map[string]string{dailyBytesBudgetKey: "1GB"}, wantErr: "invalid daily-bytes-budget"},
+		{name: "sets its tenant", tenant: "a", section: map[string]string{tenantKey: "b"}, wantErr: "can't set tenant"},
+		{name: "unknown log-opt", tenant: "a", section: map[string]string{"s3-buckett": "x"}, wantErr: "s3-buckett"},
+		{name: "bad log-opt", tenant: "a", section: map[string]string{s3BucketKey: "logs", compressKey: "lz4"}, wantErr: "compress"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTenant(tt.tenant, tt.section, DefaultOptions(), overBudgetContinue, "", nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("newTenant returned %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTenantContainers(t *testing.T) {
+	// A tenant's containers start from its section's log-opts, under their
+	// own, upload to its bucket, and have their uploads queued and counted
+	// as its.
+	fake := newFakeS3()
+	d := newTestDriver(t, fake, nil)
+	if err := d.pool.addTenants(map[string]map[string]string{
+		"team-a": {s3BucketKey: "team-a-logs", s3PrefixKey: "a/"},
+	}, d.defaults(), overBudgetContinue, ""); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		cfg        map[string]string
+		labels     map[string]string
+		wantTenant string
+		wantBucket string
+		wantPrefix string
+	}{
+		{name: "default", wantTenant: defaultTenant, wantBucket: testBucket},
+		{name: "section", cfg: map[string]string{tenantKey: "team-a"}, wantTenant: "team-a", wantBucket: "team-a-logs", wantPrefix: "a/"},
+		{name: "own log-opts first", cfg: map[string]string{tenantLabelKey: "tenant", s3PrefixKey: "mine/"}, labels: map[string]string{"tenant": "team-a"}, wantTenant: "team-a", wantBucket: "team-a-logs", wantPrefix: "mine/"},
+		{name: "unlisted", cfg: map[string]string{tenantKey: "team-b"}, wantTenant: "team-b", wantBucket: testBucket},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testLogOpts(t, tt.cfg)
+			// The section's bucket, not the one every test container has.
+			if tt.wantBucket != testBucket {
+				delete(cfg, s3BucketKey)
+			}
+			samples := waitSamples(t, tt.wantTenant)
+			c := startContainerInfo(t, d, Info{Config: cfg, ContainerID: fmt.Sprintf("%063x%d", 0, i), ContainerName: "/" + tt.name, ContainerLabels: tt.labels})
+			if c.l.opts.Tenant != tt.wantTenant {
+				t.Errorf("container of tenant %q, want %q", c.l.opts.Tenant, tt.wantTenant)
+			}
+			c.write(t, entry("stdout", "line", time.Now()))
+			c.stop(t, d)
+			keys := fake.logKeys(tt.wantBucket)
+			i := slices.IndexFunc(keys, func(k string) bool { return strings.Contains(k, c.info.ContainerID) })
+			if i < 0 {
+				t.Fatalf("nothing of the container uploaded to %s: %q", tt.wantBucket, keys)
+			}
+			if tt.wantPrefix != "" && !strings.HasPrefix(keys[i], tt.wantPrefix) {
+				t.Errorf("uploaded %s, want it under %s", keys[i], tt.wantPrefix)
+			}
+			if waitSamples(t, tt.wantTenant) == samples {
+				t.Errorf("no upload counted in tenant_upload_wait_seconds of %s", tt.wantTenant)
+			}
+		})
+	}
+}
+
+func BenchmarkUploadPoolTake(b *testing.B) {
+	// Taking the next job among the queues of many tenants.
+	for _, tenants := range []int{1, 10, 100} {
+		b.Run(fmt.Sprint(tenants), func(b *testing.B) {
+			sections := map[string]map[string]string{}
+			for i := range tenants {
+				sections[fmt.Sprintf("t%d", i)] = map[string]string{tenantWeightKey: fmt.Sprint(i%4 + 1)}
+			}
+			p := tenantPool(b, 0, sections)
+			for name := range sections {
+				queueJobs(p, name, 8)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				p.mu.Lock()
+				j := p.take(time.Now())
+				j.tenant.running--
+				p.mu.Unlock()
+				p.enqueue(j)
+			}
+		})
+	}
+}
+
+func BenchmarkUploadPoolTenants(b *testing.B) {
+	// Uploads of 8 tenants running through the pool at once.
+	p := tenantPool(b, 4, nil)
+	var n atomic.Int64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		ctx := withTenant(context.Background(), fmt.Sprintf("t%d", n.Add(1)%8))
+		for pb.Next() {
+			p.do(ctx, func(context.Context) error { return nil })
+		}
+	})
+}
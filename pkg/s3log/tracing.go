@@ -0,0 +1,189 @@
+package s3log
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	// otelEndpointKey is the plugin flag naming the OTLP/HTTP collector
+	// spans are exported to.
+	otelEndpointKey = "otel-endpoint"
+
+	// traceQueueSize bounds the spans of a container waiting to be
+	// exported. Spans past it are dropped rather than waited for.
+	traceQueueSize = 2048
+
+	// traceShutdownTimeout bounds how long a stopped container's last spans
+	// are given to export.
+	traceShutdownTimeout = 5 * time.Second
+)
+
+var (
+	// traceExporter is where every container's spans go, or nil while
+	// tracing is off, when every tracer is a no-op.
+	traceExporter sdktrace.SpanExporter
+
+	// pluginTracer traces what the plugin does for containers as a whole,
+	// such as draining the spool.
+	pluginTracer trace.Tracer = noop.NewTracerProvider().Tracer(driverName)
+
+	// traceShutdowns tracks the tracers of stopped containers still
+	// exporting their last spans, which the plugin waits for as it shuts
+	// down. Unlike with a WaitGroup, a tracer may start shutting down after
+	// a wait for the others ran out of time.
+	traceShutdowns = struct {
+		sync.Mutex
+		n    int
+		idle chan struct{} // closed while none are running
+	}{idle: closedIdle()}
+)
+
+// closedIdle returns a closed channel, for traceShutdowns' idle while no
+// tracer is shutting down.
+func closedIdle() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+// setupTracing turns tracing on, exporting to endpoint, an http:// or
+// https:// URL, or where the standard OTEL_EXPORTER_OTLP_* variables say if
+// it is empty. Tracing stays off without either, or with OTEL_SDK_DISABLED
+// or OTEL_TRACES_EXPORTER=none.
+func setupTracing(endpoint string) error {
+	if disabled, _ := strconv.ParseBool(os.Getenv("OTEL_SDK_DISABLED")); disabled || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return nil
+	}
+	var opts []otlptracehttp.Option
+	switch {
+	case endpoint != "":
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid --%s %q: must be an http:// or https:// URL", otelEndpointKey, endpoint)
+		}
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+	case os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "":
+		return nil
+	}
+	exp, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return fmt.Errorf("error creating trace exporter: %v", err)
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logrus.WithError(err).Warn("error exporting traces")
+	}))
+	traceExporter = exp
+	pluginTracer = newTracer(nil).Tracer
+	return nil
+}
+
+// containerTracer makes the spans of one container, under a resource
+// describing it. Spans are exported in the background from a queue of at
+// most traceQueueSize, so tracing never waits on the collector.
+type containerTracer struct {
+	trace.Tracer
+	provider *sdktrace.TracerProvider // nil while tracing is off
+}
+
+// newTracer returns the tracer for the container info describes, or for
+// the plugin itself if info is nil.
+func newTracer(info *Info) *containerTracer {
+	if traceExporter == nil {
+		return &containerTracer{Tracer: noop.NewTracerProvider().Tracer(driverName)}
+	}
+	attrs := []attribute.KeyValue{semconv.ServiceVersion(version)}
+	if info != nil {
+		attrs = append(attrs,
+			semconv.ContainerID(info.ContainerID),
+			semconv.ContainerName(info.Name()),
+			semconv.ContainerImageName(info.ContainerImageName))
+	}
+	// Later options win, so OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES
+	// override the service name but not the container.
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(semconv.ServiceName(driverName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(attrs...))
+	if err != nil {
+		logrus.WithError(err).Warn("error describing the trace resource")
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithBatcher(sharedExporter{traceExporter}, sdktrace.WithMaxQueueSize(traceQueueSize)))
+	return &containerTracer{Tracer: provider.Tracer(driverName), provider: provider}
+}
+
+// shutdown exports the spans still queued, in the background, and stops
+// the tracer. waitTracing waits for it.
+func (t *containerTracer) shutdown() {
+	if t.provider == nil {
+		return
+	}
+	traceShutdowns.Lock()
+	if traceShutdowns.n == 0 {
+		traceShutdowns.idle = make(chan struct{})
+	}
+	traceShutdowns.n++
+	traceShutdowns.Unlock()
+	go func() {
+		defer func() {
+			traceShutdowns.Lock()
+			if traceShutdowns.n--; traceShutdowns.n == 0 {
+				close(traceShutdowns.idle)
+			}
+			traceShutdowns.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+		defer cancel()
+		if err := t.provider.Shutdown(ctx); err != nil {
+			logrus.WithError(err).Debug("error exporting the last spans of a container")
+		}
+	}()
+}
+
+// waitTracing waits, until ctx is done, for the tracers that are shutting
+// down to export their last spans.
+func waitTracing(ctx context.Context) {
+	traceShutdowns.Lock()
+	idle := traceShutdowns.idle
+	traceShutdowns.Unlock()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+	}
+}
+
+// sharedExporter is traceExporter as each container's tracer sees it,
+// which mustn't shut down the exporter the others still use.
+type sharedExporter struct {
+	sdktrace.SpanExporter
+}
+
+func (sharedExporter) Shutdown(context.Context) error { return nil }
+
+// endSpan ends span, marking it failed with err if there is one.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
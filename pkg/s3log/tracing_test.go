@@ -0,0 +1,262 @@
+package s3log
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// blockingExporter holds up every export until release is closed.
+type blockingExporter struct {
+	*tracetest.InMemoryExporter
+	release chan struct{}
+}
+
+func (e blockingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	select {
+	case <-e.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return e.InMemoryExporter.ExportSpans(ctx, spans)
+}
+
+func TestTracerShutdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		block    bool
+		timeout  time.Duration
+		exported int
+	}{
+		{name: "drained", timeout: traceShutdownTimeout, exported: 3},
+		{name: "out of time", block: true, timeout: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := tracetest.NewInMemoryExporter()
+			exp := blockingExporter{InMemoryExporter: mem, release: make(chan struct{})}
+			if !tt.block {
+				close(exp.release)
+			}
+			prev := traceExporter
+			traceExporter = exp
+			t.Cleanup(func() {
+				traceExporter = prev
+				if tt.block {
+					close(exp.release)
+				}
+				waitTracing(context.Background())
+			})
+
+			for i := range 3 {
+				tracer := newTracer(&Info{ContainerID: testContainerID(t) + string(rune('a'+i))})
+				_, span := tracer.Start(context.Background(), "flush")
+				span.End()
+				tracer.shutdown()
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			start := time.Now()
+			waitTracing(ctx)
+			if took := time.Since(start); took > tt.timeout+time.Second {
+				t.Errorf("waited %v, past the %v timeout", took, tt.timeout)
+			}
+			if got := len(mem.GetSpans()); got != tt.exported {
+				t.Errorf("%d spans exported, want %d", got, tt.exported)
+			}
+		})
+	}
+}
+
+func TestTracerOff(t *testing.T) {
+	tracer := newTracer(&Info{ContainerID: testContainerID(t)})
+	if tracer.provider != nil {
+		t.Fatal("tracer has a provider with tracing off")
+	}
+	tracer.shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	waitTracing(ctx)
+	if ctx.Err() != nil {
+		t.Error("waited for a tracer that was never on")
+	}
+}
+
+// traceTo has spans exported to an in-memory exporter, which it returns,
+// until the end of the test. It also returns the plugin's tracer, whose
+// spans are exported once it is shut down.
+func traceTo(t *testing.T) (*tracetest.InMemoryExporter, *containerTracer) {
+	mem := tracetest.NewInMemoryExporter()
+	prevExporter, prevTracer := traceExporter, pluginTracer
+	traceExporter = mem
+	plugin := newTracer(nil)
+	pluginTracer = plugin.Tracer
+	t.Cleanup(func() {
+		plugin.shutdown()
+		waitTracing(context.Background())
+		traceExporter, pluginTracer = prevExporter, prevTracer
+	})
+	return mem, plugin
+}
+
+// exportedSpans waits for the tracers shutting down and returns the spans
+// they exported, by name.
+func exportedSpans(mem *tracetest.InMemoryExporter) map[string][]tracetest.SpanStub {
+	waitTracing(context.Background())
+	spans := make(map[string][]tracetest.SpanStub)
+	for _, s := range mem.GetSpans() {
+		spans[s.Name] = append(spans[s.Name], s)
+	}
+	return spans
+}
+
+// spanAttr returns the value of the attribute key of s.
+func spanAttr(s tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTraceUpload(t *testing.T) {
+	// A flush of two objects, the first retried once.
+	mem, _ := traceTo(t)
+	fake := newFakeS3()
+	fake.fail("PutObject", 1, fakeStatusError(http.StatusServiceUnavailable, "SlowDown"))
+	l := newTestLogger(t, fake, map[string]string{maxObjectSizeKey: "1KiB", maxRetryDelayKey: "1ms", flushIntervalKey: "1h"})
+	logLines(t, l, time.Now(), strings.Repeat("a", 800), strings.Repeat("b", 800))
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	spans := exportedSpans(mem)
+
+	flushes, uploads := spans["flush"], spans["upload"]
+	if len(flushes) != 1 || len(uploads) != 2 {
+		t.Fatalf("exported %d flush and %d upload spans, want 1 and 2", len(flushes), len(uploads))
+	}
+	flush := flushes[0]
+	if spanAttr(flush, "s3logdriver.lines").AsInt64() != 2 || spanAttr(flush, "s3logdriver.objects").AsInt64() != 2 || spanAttr(flush, "s3logdriver.bytes").AsInt64() == 0 {
+		t.Errorf("flush span with %v, want its bytes, 2 lines and 2 objects", flush.Attributes)
+	}
+	var id string
+	for _, kv := range flush.Resource.Attributes() {
+		if kv.Key == semconv.ContainerIDKey {
+			id = kv.Value.AsString()
+		}
+	}
+	if id != l.info.ContainerID {
+		t.Errorf("flush span of container %q, want %q", id, l.info.ContainerID)
+	}
+
+	keys := fake.logKeys(testBucket)
+	var retries int
+	for _, u := range uploads {
+		if u.Parent.SpanID() != flush.SpanContext.SpanID() {
+			t.Errorf("upload span isn't a child of the flush")
+		}
+		if spanAttr(u, semconv.AWSS3BucketKey).AsString() != testBucket || !strings.HasPrefix(spanAttr(u, semconv.AWSS3KeyKey).AsString(), l.keyPrefix()) {
+			t.Errorf("upload span with %v, want the bucket and key", u.Attributes)
+		}
+		if u.Status.Code != codes.Unset {
+			t.Errorf("upload span has status %v, want none", u.Status)
+		}
+		for _, e := range u.Events {
+			if e.Name == "retry" {
+				retries++
+			}
+		}
+	}
+	if len(keys) != 2 || retries != 1 {
+		t.Errorf("uploaded %q with %d retry events, want 2 objects and 1 retry", keys, retries)
+	}
+}
+
+func TestTraceSpool(t *testing.T) {
+	// The upload fails and is spooled, then drained once S3 is back.
+	mem, plugin := traceTo(t)
+	fake := newFakeS3()
+	fake.fail("PutObject", 1, fakeStatusError(http.StatusForbidden, "AccessDenied"))
+	l := newTestLogger(t, fake, map[string]string{spoolDirKey: t.TempDir(), maxRetriesKey: "0", flushIntervalKey: "1h"})
+	// The spool's drainer would race the drain below for the batch.
+	l.spool.stop()
+	<-l.spool.stopped
+	logLines(t, l, time.Now(), "spooled")
+	if err := l.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	l.spool.drain(context.Background())
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	plugin.shutdown()
+	spans := exportedSpans(mem)
+
+	uploads, writes, drains := spans["upload"], spans["spool write"], spans["spool drain"]
+	if len(uploads) != 1 || len(writes) != 1 || len(drains) != 1 {
+		t.Fatalf("exported %d upload, %d spool write and %d spool drain spans, want 1 of each", len(uploads), len(writes), len(drains))
+	}
+	var failed bool
+	for _, e := range uploads[0].Events {
+		failed = failed || e.Name == "exception"
+	}
+	if !failed {
+		t.Error("upload span doesn't record the failed attempt")
+	}
+	if writes[0].Parent.SpanID() != uploads[0].SpanContext.SpanID() {
+		t.Error("spool write span isn't a child of the upload")
+	}
+	d := drains[0]
+	if d.Status.Code != codes.Unset || spanAttr(d, semconv.ContainerIDKey).AsString() != l.info.ContainerID || spanAttr(d, semconv.AWSS3KeyKey).AsString() != fake.logKeys(testBucket)[0] {
+		t.Errorf("spool drain span with %v and status %v, want the container and key uploaded", d.Attributes, d.Status)
+	}
+}
+
+func TestSetupTracing(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		env      map[string]string
+		on       bool
+		wantErr  bool
+	}{
+		{name: "off"},
+		{name: "endpoint", endpoint: "http://collector:4318", on: true},
+		{name: "environment", env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}, on: true},
+		{name: "disabled", endpoint: "http://collector:4318", env: map[string]string{"OTEL_SDK_DISABLED": "true"}},
+		{name: "no exporter", endpoint: "http://collector:4318", env: map[string]string{"OTEL_TRACES_EXPORTER": "none"}},
+		{name: "not a URL", endpoint: "collector:4318", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"OTEL_SDK_DISABLED", "OTEL_TRACES_EXPORTER", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"} {
+				t.Setenv(k, tt.env[k])
+			}
+			prevExporter, prevTracer := traceExporter, pluginTracer
+			t.Cleanup(func() { traceExporter, pluginTracer = prevExporter, prevTracer })
+
+			err := setupTracing(tt.endpoint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setupTracing(%q) = %v, want an error: %v", tt.endpoint, err, tt.wantErr)
+			}
+			if on := traceExporter != nil; on != tt.on {
+				t.Errorf("tracing on: %v, want %v", on, tt.on)
+			}
+			tracer := newTracer(&Info{ContainerID: testContainerID(t)})
+			if on := tracer.provider != nil; on != tt.on {
+				t.Errorf("container tracer on: %v, want %v", on, tt.on)
+			}
+			tracer.shutdown()
+			waitTracing(context.Background())
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package s3log
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	caCertFileKey         = "ca-cert-file"
+	insecureSkipVerifyKey = "insecure-skip-verify"
+	allowInsecureKey      = "allow-insecure"
+	proxyURLKey           = "proxy-url"
+	noProxyKey            = "no-proxy"
+	maxIdleConnsKey       = "max-idle-conns-per-host"
+
+	// idleConnTimeout is how long an idle connection is kept for the next
+	// upload. It outlasts the default flush-interval so that a quiet
+	// container's next flush still finds one.
+	idleConnTimeout = 90 * time.Second
+)
+
+var connectionsUsed = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: driverName,
+	Name:      "http_connections_total",
+	Help:      "Connections S3 requests were sent on, by whether they were reused or newly dialed.",
+}, []string{"reused"})
+
+func init() {
+	metricsRegistry.MustRegister(connectionsUsed)
+}
+
+// countConn counts the connections requests get, to tell how often uploads
+// reuse a kept-alive connection rather than paying for a TLS handshake.
+func countConn(info httptrace.GotConnInfo) {
+	connectionsUsed.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+}
+
+// tracedClient sends requests with a trace calling countConn. It is also not
+// an *awshttp.BuildableClient, so the SDK uses it as it is instead of
+// cloning it, and its transport, for every S3 client built with it.
+type tracedClient struct {
+	client aws.HTTPClient
+}
+
+func (c tracedClient) Do(r *http.Request) (*http.Response, error) {
+	// WithClientTrace composes the trace it is given with the SDK's, already
+	// in the context, by writing to it, so every request needs its own.
+	trace := &httptrace.ClientTrace{GotConn: countConn}
+	return c.client.Do(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+}
+
+// httpConfig is how a container's S3 client reaches the endpoint: the CAs it
+// verifies the endpoint's certificate with and the proxy it goes through.
+// Without a proxy-url the proxy is taken from HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY, as with the SDK's default client. The proxy's credentials are
+// never written to disk: a spooled batch records the proxy without them, and
+// is uploaded with whatever credentials a running container last provided
+// for it.
+type httpConfig struct {
+	CACertFile         string `json:"ca_cert_file,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+	ProxyURL           string `json:"-"`
+	Proxy              string `json:"proxy,omitempty"` // ProxyURL without its password
+	NoProxy            string `json:"no_proxy,omitempty"`
+}
+
+// parseProxyURL checks a proxy-url. Errors never include the URL, since it
+// may hold a password.
+func parseProxyURL(v string) (*url.URL, error) {
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid %s: must be an http or https URL", proxyURLKey)
+	}
+	return u, nil
+}
+
+// redactURL returns v with the password of its userinfo masked, for logs and
+// for the spool.
+func redactURL(v string) string {
+	if u, err := url.Parse(v); err == nil {
+		return u.Redacted()
+	}
+	return ""
+}
+
+// httpClient returns the HTTP client S3 requests are sent with under cfg.
+// Every S3 client with the same cfg shares one, and so one pool of
+// connections, whatever its endpoint, region or credentials. Clients keep the
+// SDK's timeouts and enough idle connections per host for every upload
+// worker to upload its parts at once. Without HTTP options of its own a
+// client is built on the plugin's, which honors AWS_CA_BUNDLE; otherwise it
+// trusts the system roots along with cfg's CA bundle.
+func (f *clientFactory) httpClient(cfg httpConfig) (aws.HTTPClient, error) {
+	if cfg.InsecureSkipVerify && !f.allowInsecure {
+		return nil, fmt.Errorf("%s requires the plugin to be started with --%s", insecureSkipVerifyKey, allowInsecureKey)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.httpClients[cfg]; ok {
+		return c, nil
+	}
+	if cfg == (httpConfig{}) {
+		base, ok := f.cfg.HTTPClient.(*awshttp.BuildableClient)
+		if !ok {
+			if f.cfg.HTTPClient == nil {
+				return nil, nil
+			}
+			c := tracedClient{f.cfg.HTTPClient}
+			f.httpClients[cfg] = c
+			return c, nil
+		}
+		c := tracedClient{base.WithTransportOptions(f.tuneTransport)}
+		f.httpClients[cfg] = c
+		return c, nil
+	}
+	tc := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CACertFile != "" {
+		pem, err := os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", caCertFileKey, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid %s %q: no PEM certificates found", caCertFileKey, cfg.CACertFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	proxy := httpproxy.FromEnvironment()
+	proxyURL := cfg.ProxyURL
+	if proxyURL != "" {
+		f.proxies[cfg.Proxy] = proxyURL
+	} else if cfg.Proxy != "" {
+		proxyURL = cfg.Proxy
+		if known, ok := f.proxies[cfg.Proxy]; ok {
+			proxyURL = known
+		}
+	}
+	if proxyURL != "" {
+		proxy.HTTPProxy, proxy.HTTPSProxy = proxyURL, proxyURL
+	}
+	if cfg.NoProxy != "" {
+		proxy.NoProxy = cfg.NoProxy
+	}
+	proxyFunc := proxy.ProxyFunc()
+
+	c := tracedClient{awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.TLSClientConfig = tc
+		tr.Proxy = func(r *http.Request) (*url.URL, error) { return proxyFunc(r.URL) }
+	}, f.tuneTransport)}
+	f.httpClients[cfg] = c
+	return c, nil
+}
+
+// tuneTransport sizes tr's pool of idle connections for the upload workers,
+// and lets it negotiate HTTP/2 with endpoints that offer it, as S3-compatible
+// stores may. S3 itself speaks HTTP/1.1, where each upload in flight needs a
+// connection of its own.
+func (f *clientFactory) tuneTransport(tr *http.Transport) {
+	tr.MaxIdleConnsPerHost = f.idleConns
+	tr.MaxIdleConns = max(tr.MaxIdleConns, f.idleConns)
+	tr.IdleConnTimeout = idleConnTimeout
+	tr.ForceAttemptHTTP2 = true
+}
@@ -0,0 +1,389 @@
+package s3log
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakeProxy is an HTTP proxy that records the CONNECT requests made through
+// it and tunnels them to target, or answers them with status if it is set.
+type fakeProxy struct {
+	target string
+	status int
+
+	mu       sync.Mutex
+	connects []*http.Request
+}
+
+func (p *fakeProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.connects = append(p.connects, r)
+	p.mu.Unlock()
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is proxied", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.status != 0 {
+		w.WriteHeader(p.status)
+		return
+	}
+	upstream, err := net.Dial("tcp", p.target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	buf.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	buf.Flush()
+	go func() {
+		io.Copy(upstream, buf)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+}
+
+func (p *fakeProxy) requests() []*http.Request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.connects
+}
+
+func TestProxy(t *testing.T) {
+	endpoint := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer endpoint.Close()
+	// The stub's certificate is for example.com, which the endpoint is
+	// reached as through the proxy.
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: endpoint.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     map[string]string
+		env     bool
+		status  int
+		proxied bool
+		auth    string
+	}{
+		{name: "proxy-url", proxied: true},
+		{name: "with credentials", proxied: true, auth: "user:s3cret"},
+		{name: "HTTPS_PROXY", env: true, proxied: true},
+		{name: "no-proxy", cfg: map[string]string{noProxyKey: "example.com"}},
+		{name: "refused", status: http.StatusProxyAuthRequired, proxied: true, auth: "user:s3cret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakeProxy{target: endpoint.Listener.Addr().String(), status: tt.status}
+			srv := httptest.NewServer(p)
+			defer srv.Close()
+			proxyURL := srv.URL
+			if tt.auth != "" {
+				proxyURL = strings.Replace(proxyURL, "://", "://"+tt.auth+"@", 1)
+			}
+			cfg := testLogOpts(t, map[string]string{
+				endpointURLKey:    "https://example.com",
+				forcePathStyleKey: "true",
+				caCertFileKey:     caFile,
+			})
+			if tt.env {
+				t.Setenv("HTTPS_PROXY", proxyURL)
+			} else {
+				cfg[proxyURLKey] = proxyURL
+			}
+			maps.Copy(cfg, tt.cfg)
+			opts, err := parseLogOpts(DefaultOptions(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := newTestClients(nil)
+			f.newClient = newS3Client
+			client, err := f.client(opts.clientConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err = client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String(testBucket), Key: aws.String("key"), Body: strings.NewReader("line\n")}, func(o *s3.Options) {
+				o.RetryMaxAttempts = 1
+			})
+			if tt.status == 0 && tt.proxied && err != nil {
+				t.Fatal(err)
+			}
+			if tt.status != 0 && err == nil {
+				t.Fatalf("upload succeeded through a proxy answering %d", tt.status)
+			}
+			if err != nil && tt.auth != "" && strings.Contains(err.Error(), "s3cret") {
+				t.Errorf("error %q holds the proxy's password", err)
+			}
+
+			reqs := p.requests()
+			if !tt.proxied {
+				if len(reqs) != 0 {
+					t.Errorf("%d requests through the proxy, want none", len(reqs))
+				}
+				return
+			}
+			if len(reqs) == 0 {
+				t.Fatal("no requests through the proxy")
+			}
+			r := reqs[0]
+			if r.Method != http.MethodConnect || r.Host != "example.com:443" {
+				t.Errorf("proxy got %s %s, want CONNECT example.com:443", r.Method, r.Host)
+			}
+			want := ""
+			if tt.auth != "" {
+				want = "Basic " + base64.StdEncoding.EncodeToString([]byte(tt.auth))
+			}
+			if got := r.Header.Get("Proxy-Authorization"); got != want {
+				t.Errorf("Proxy-Authorization %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestProxyCredentialsHidden(t *testing.T) {
+	const password = "s3cret"
+	opts, err := parseLogOpts(DefaultOptions(), testLogOpts(t, map[string]string{proxyURLKey: "http://user:" + password + "@proxy.test:3128"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client config is what a spooled batch records.
+	data, err := json.Marshal(opts.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), password) {
+		t.Errorf("client config %s holds the proxy's password", data)
+	}
+	if !strings.Contains(string(data), "proxy.test:3128") {
+		t.Errorf("client config %s doesn't record the proxy", data)
+	}
+
+	_, err = parseLogOpts(DefaultOptions(), testLogOpts(t, map[string]string{proxyURLKey: "socks5://user:" + password + "@proxy.test"}))
+	if err == nil {
+		t.Fatal("socks5 proxy-url accepted")
+	}
+	if strings.Contains(err.Error(), password) {
+		t.Errorf("error %q holds the proxy's password", err)
+	}
+}
+
+// countingServer is a TLS endpoint that answers every request and counts the
+// connections clients open to it, each one a handshake.
+func countingServer(t testing.TB) (*httptest.Server, *atomic.Int64, string) {
+	t.Helper()
+	var conns atomic.Int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, &conns, caFile
+}
+
+// concurrentPuts sends n PUTs, concurrency at a time, spread across clients.
+func concurrentPuts(t testing.TB, clients []s3API, n, concurrency int) {
+	t.Helper()
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := range n {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			_, err := clients[i%len(clients)].PutObject(context.Background(), &s3.PutObjectInput{
+				Bucket: aws.String(testBucket),
+				Key:    aws.String(fmt.Sprintf("key-%d", i)),
+				Body:   strings.NewReader("line\n"),
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// transportClients returns an S3 client of the endpoint srv for each of
+// several sets of static keys, all from one factory keeping idleConns
+// connections per host.
+func transportClients(t testing.TB, srv *httptest.Server, caFile string, idleConns, keys int) []s3API {
+	t.Helper()
+	f := newTestClients(nil)
+	f.idleConns = idleConns
+	f.newClient = newS3Client
+	var clients []s3API
+	for i := range keys {
+		opts, err := parseLogOpts(DefaultOptions(), testLogOpts(t, map[string]string{
+			endpointURLKey:    srv.URL,
+			forcePathStyleKey: "true",
+			caCertFileKey:     caFile,
+			accessKeyIDKey:    fmt.Sprintf("AKIDTEST%d", i),
+			secretKeyKey:      "secret",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := f.client(opts.clientConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func TestSharedTransport(t *testing.T) {
+	const puts, concurrency = 400, 20
+	srv, conns, caFile := countingServer(t)
+	reused := connectionsUsed.WithLabelValues("true")
+	before := metricValue(reused)
+	// Clients with different credentials share one pool of connections,
+	// sized for every upload in flight, so about as many are opened as are
+	// used at once. A connection may be picked up just before another is
+	// put back, so a few more may be.
+	concurrentPuts(t, transportClients(t, srv, caFile, concurrency, 4), puts, concurrency)
+	if n := conns.Load(); n > 2*concurrency {
+		t.Errorf("%d PUTs, %d at a time, through 4 clients opened %d connections, want about %d", puts, concurrency, n, concurrency)
+	}
+	if got := metricValue(reused) - before; got < puts-concurrency {
+		t.Errorf("%v requests counted as on a reused connection, want at least %d", got, puts-concurrency)
+	}
+}
+
+func TestTracedClientTraces(t *testing.T) {
+	// Requests whose context already has a trace, as the SDK's have, get
+	// both theirs and the connection count, each once, however many have
+	// been sent before and alongside them.
+	const requests, concurrency = 50, 10
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	client := tracedClient{client: srv.Client()}
+	used := func() float64 {
+		return metricValue(connectionsUsed.WithLabelValues("true")) + metricValue(connectionsUsed.WithLabelValues("false"))
+	}
+	before := used()
+	var wg sync.WaitGroup
+	var extra atomic.Int64
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range requests / concurrency {
+				var got int64
+				ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+					GotConn: func(httptrace.GotConnInfo) { got++ },
+				})
+				req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				extra.Add(got - 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := extra.Load(); n != 0 {
+		t.Errorf("requests' own traces called %d times more than once each", n)
+	}
+	if got := used() - before; got != requests {
+		t.Errorf("%v connections counted for %d requests", got, requests)
+	}
+}
+
+func TestHTTPClientShared(t *testing.T) {
+	f := newTestClients(nil)
+	f.cfg.HTTPClient = awshttp.NewBuildableClient()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	srv.Close()
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []httpConfig{{}, {CACertFile: caFile}} {
+		a, err := f.httpClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := f.httpClient(cfg)
+		if a != b {
+			t.Errorf("%+v: got a second HTTP client", cfg)
+		}
+		// The SDK clones a BuildableClient, and its pool, for each client
+		// built with it.
+		if _, ok := a.(*awshttp.BuildableClient); ok {
+			t.Errorf("%+v: HTTP client is a BuildableClient", cfg)
+		}
+	}
+	other, _ := f.httpClient(httpConfig{NoProxy: "example.com"})
+	if plain, _ := f.httpClient(httpConfig{}); other == plain {
+		t.Error("clients with different HTTP options share one")
+	}
+}
+
+func TestTuneTransport(t *testing.T) {
+	f := newTestClients(nil)
+	f.idleConns = 64
+	tr := &http.Transport{MaxIdleConns: 100, MaxIdleConnsPerHost: 2}
+	f.tuneTransport(tr)
+	if tr.MaxIdleConnsPerHost != 64 || tr.MaxIdleConns != 100 || tr.IdleConnTimeout != idleConnTimeout || !tr.ForceAttemptHTTP2 {
+		t.Errorf("tuned transport keeps %d idle conns per host, %d in all, for %v, HTTP/2 %v", tr.MaxIdleConnsPerHost, tr.MaxIdleConns, tr.IdleConnTimeout, tr.ForceAttemptHTTP2)
+	}
+	f.idleConns = 200
+	f.tuneTransport(tr)
+	if tr.MaxIdleConns != 200 {
+		t.Errorf("%d idle conns in all, want at least the 200 per host", tr.MaxIdleConns)
+	}
+}
+
+func BenchmarkSharedTransport(b *testing.B) {
+	srv, conns, caFile := countingServer(b)
+	clients := transportClients(b, srv, caFile, 20, 4)
+	b.ResetTimer()
+	concurrentPuts(b, clients, b.N, 20)
+	b.ReportMetric(float64(conns.Load())/float64(b.N), "handshakes/op")
+}
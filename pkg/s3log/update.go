@@ -0,0 +1,251 @@
+package s3log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// updateOptionsPath is the plugin API endpoint the update command changes a
+// running container's log-opts through. It is the plugin's own: the daemon
+// only passes log-opts when a container starts.
+const updateOptionsPath = "/S3LogDriver.UpdateOptions"
+
+// mutableLogOpts are the log-opts a running container's logger can have
+// changed. They only decide what is done with lines on their way to the
+// buffer, and when it is flushed, so changing them leaves its buffered
+// lines, numbering and objects as they are. Anything else is fixed until
+// the container restarts.
+var mutableLogOpts = map[string]bool{
+	flushIntervalKey:       true,
+	flushBytesKey:          true,
+	maxLineBytesKey:        true,
+	filterIncludeKey:       true,
+	filterExcludeKey:       true,
+	stripANSIKey:           true,
+	skipEmptyKey:           true,
+	sampleRateKey:          true,
+	samplePatternKey:       true,
+	redactPatternsKey:      true,
+	redactReplacementKey:   true,
+	maxPutsPerContainerKey: true,
+}
+
+// setMutable sets the options of mutableLogOpts to those of from.
+func (o *LogOption) setMutable(from LogOption) {
+	o.FlushInterval = from.FlushInterval
+	o.FlushBytes = from.FlushBytes
+	o.MaxLineBytes = from.MaxLineBytes
+	o.FilterInclude, o.FilterExclude = from.FilterInclude, from.FilterExclude
+	o.StripANSI, o.SkipEmpty = from.StripANSI, from.SkipEmpty
+	o.SampleRate, o.SamplePattern = from.SampleRate, from.SamplePattern
+	o.RedactPatterns, o.RedactReplacement = from.RedactPatterns, from.RedactReplacement
+	o.MaxPutsPerContainer = from.MaxPutsPerContainer
+}
+
+type UpdateOptionsRequest struct {
+	ContainerID string
+	Options     map[string]string
+}
+
+// checkMutable returns an error naming the log-opts of cfg that can't be
+// changed on a running container.
+func checkMutable(cfg map[string]string) error {
+	var fixed, unknown []string
+	for k := range cfg {
+		switch {
+		case mutableLogOpts[k]:
+		case logOptKeys[k]:
+			fixed = append(fixed, k)
+		default:
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		return unknownOptsError(unknown)
+	}
+	if len(fixed) > 0 {
+		slices.Sort(fixed)
+		return fmt.Errorf("log opt(s) %s can't be changed on a running container, restart it with the new values instead", strings.Join(fixed, ", "))
+	}
+	return nil
+}
+
+// updateOptions changes the log-opts in cfg of the container whose ID is, or
+// starts with, id, as if it had been started with them. The change lasts
+// until the container or the plugin is restarted: the daemon starts loggers
+// with the log-opts the container was created with.
+func (d *Driver) updateOptions(id string, cfg map[string]string) error {
+	if len(cfg) == 0 {
+		return errors.New("must provide log opts to update")
+	}
+	if err := checkMutable(cfg); err != nil {
+		return err
+	}
+	lf, err := d.lookup(id)
+	if err != nil {
+		return err
+	}
+	// Updates of one container are applied one at a time, so that each is
+	// parsed on top of the last.
+	lf.updateMu.Lock()
+	defer lf.updateMu.Unlock()
+	merged := lf.logOpts()
+	maps.Copy(merged, cfg)
+	opts, err := d.tenantOptions(d.defaults(), lf.info, merged)
+	if err != nil {
+		return newOpError(opParseOptions, "", err)
+	}
+
+	l, _ := lf.logger()
+	loggers := s3Loggers(l)
+	if len(loggers) == 0 {
+		return fmt.Errorf("container %q has no S3 logger", id)
+	}
+	for _, l := range loggers {
+		if err := l.update(opts); err != nil {
+			return err
+		}
+	}
+	lf.mu.Lock()
+	if lf.l == l {
+		if lf.updated == nil {
+			lf.updated = map[string]string{}
+		}
+		maps.Copy(lf.updated, cfg)
+	}
+	lf.mu.Unlock()
+	var keys []string
+	for k := range cfg {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	loggers[0].log().WithField("log-opts", strings.Join(keys, ",")).Info("updated log opts")
+	return nil
+}
+
+// update swaps in the mutable log-opts of opts. Lines logged once it returns
+// are handled with them, and the rest of the logger's state is left as it
+// is.
+func (l *S3Logger) update(opts LogOption) error {
+	filter, err := newLineFilter(opts.FilterInclude, opts.FilterExclude)
+	if err != nil {
+		return fmt.Errorf("invalid line filter: %v", err)
+	}
+	redactor := newRedactor(opts.RedactPatterns, opts.RedactReplacement)
+	sampler := newSampler(opts.SampleRate, opts.SamplePattern)
+
+	l.mu.Lock()
+	l.opts.setMutable(opts)
+	l.filter, l.redactor, l.sampler = filter, redactor, sampler
+	setPutLimit(l.puts, opts.MaxPutsPerContainer)
+	if l.sizer != nil {
+		l.sizer.interval = opts.FlushInterval
+	}
+	l.flushTarget.Store(int64(l.flushBytes()))
+	if l.buf.Len() >= l.flushBytes() {
+		l.wake()
+	}
+	l.mu.Unlock()
+
+	// Have the flusher time its next flush by the new interval.
+	select {
+	case l.retime <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// flushInterval returns how long the logger goes without a flush.
+func (l *S3Logger) flushInterval() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.opts.FlushInterval
+}
+
+// logOptFlag collects repeated --log-opt key=value flags.
+type logOptFlag map[string]string
+
+func (f logOptFlag) String() string {
+	return ""
+}
+
+func (f logOptFlag) Set(v string) error {
+	k, value, ok := strings.Cut(v, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("must be key=value")
+	}
+	f[k] = value
+	return nil
+}
+
+// RunUpdate runs the update command, which asks the running plugin to change
+// log-opts of a running container's logger. It returns the exit status.
+func RunUpdate(args []string) int {
+	fs := flag.NewFlagSet(driverName+" update", flag.ExitOnError)
+	containerID := fs.String("container-id", "", "ID, or unique ID prefix, of the container whose log-opts are changed")
+	logOpts := logOptFlag{}
+	fs.Var(logOpts, "log-opt", "log-opt to change, as key=value; may be repeated")
+	socketPath := fs.String(socketPathKey, defaultSocketPath, "path of the running plugin's unix socket")
+	timeout := fs.Duration("timeout", 10*time.Second, "time the request may take")
+	fs.Parse(args)
+
+	if *containerID == "" {
+		fmt.Fprintln(os.Stderr, "--container-id is required")
+		return 2
+	}
+	if len(logOpts) == 0 {
+		fmt.Fprintln(os.Stderr, "at least one --log-opt is required")
+		return 2
+	}
+	if err := checkMutable(logOpts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := requestUpdate(ctx, *socketPath, *containerID, logOpts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// requestUpdate asks the plugin listening on socketPath to change the
+// log-opts in cfg of container id.
+func requestUpdate(ctx context.Context, socketPath, id string, cfg map[string]string) error {
+	body, err := json.Marshal(UpdateOptionsRequest{ContainerID: id, Options: cfg})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://plugin"+updateOptionsPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := socketClient(socketPath).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach plugin on %s: %v", socketPath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("plugin on %s answered %s, is it a version with the update command?", socketPath, resp.Status)
+	}
+	var res response
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("invalid response from plugin: %v", err)
+	}
+	if res.Err != "" {
+		return errors.New(res.Err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package s3log
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdateOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     map[string]string
+		wantErr string
+	}{
+		{name: "nothing", wantErr: "must provide log opts"},
+		{name: "bucket", cfg: map[string]string{s3BucketKey: "other"}, wantErr: "s3-bucket can't be changed"},
+		{
+			name:    "key template and format",
+			cfg:     map[string]string{keyTemplateKey: "{{.ID}}", formatKey: formatRaw, flushBytesKey: "1024"},
+			wantErr: "format, key-template can't be changed",
+		},
+		{name: "unknown", cfg: map[string]string{"flush-intervall": "1s"}, wantErr: "did you mean flush-interval"},
+		{name: "invalid", cfg: map[string]string{flushBytesKey: "lots", filterExcludeKey: "drop"}, wantErr: flushBytesKey},
+		{name: "bad filter", cfg: map[string]string{filterExcludeKey: "("}, wantErr: "invalid"},
+		{name: "filter", cfg: map[string]string{filterExcludeKey: "drop"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			d := newTestDriver(t, fake, nil)
+			c := startContainer(t, d, map[string]string{flushIntervalKey: "1h"})
+			before := c.l.opts
+
+			err := d.updateOptions(c.info.ContainerID, tt.cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("update returned %v, want an error containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			logLines(t, c.l, time.Now(), "keep", "drop", "keep too")
+			c.stop(t, d)
+
+			want := []string{"keep", "drop", "keep too"}
+			if tt.wantErr == "" {
+				want = []string{"keep", "keep too"}
+			} else if c.l.opts.FlushBytes != before.FlushBytes || c.l.opts.FilterExclude != before.FilterExclude {
+				// A refused update changes nothing, not even the valid
+				// options sent along with one that isn't.
+				t.Error("a refused update changed the logger's options")
+			}
+			if got := uploadedLines(t, fake, c.l); !slices.Equal(got, want) {
+				t.Errorf("uploaded %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestUpdateOptionsReported(t *testing.T) {
+	fake := newFakeS3()
+	d := newTestDriver(t, fake, nil)
+	c := startContainer(t, d, map[string]string{flushIntervalKey: "1h"})
+	defer c.stop(t, d)
+	// Each update is parsed on top of the last.
+	for _, cfg := range []map[string]string{
+		{flushIntervalKey: "30s"},
+		{filterExcludeKey: "healthz"},
+	} {
+		if err := d.updateOptions(c.info.ContainerID[:12], cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := d.config(c.info.ContainerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.FlushInterval != "30s" || cfg.LogOpts[filterExcludeKey] != "healthz" || cfg.LogOpts[flushIntervalKey] != "30s" {
+		t.Errorf("config reports flush-interval %s and log-opts %q after the updates", cfg.FlushInterval, cfg.LogOpts)
+	}
+	if got := c.l.flushInterval(); got != 30*time.Second {
+		t.Errorf("flush interval %v, want 30s", got)
+	}
+}
+
+func TestUpdateOptionsWhileLogging(t *testing.T) {
+	// Goroutines log while the options are swapped over and over. Every
+	// line is uploaded once, as a valid record, numbered without a gap.
+	const loggers, lines = 8, 2000
+	fake := newFakeS3()
+	d := newTestDriver(t, fake, nil)
+	c := startContainer(t, d, map[string]string{flushIntervalKey: "1h"})
+	updates := []map[string]string{
+		{flushBytesKey: "1024", flushIntervalKey: "20ms"},
+		{filterExcludeKey: "no line has this", redactPatternsKey: `secret-\d+`},
+		{flushBytesKey: "65536", flushIntervalKey: "1s", maxLineBytesKey: "4096"},
+		{sampleRateKey: "1", stripANSIKey: "true", skipEmptyKey: "true"},
+		{filterExcludeKey: "", redactPatternsKey: ""},
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	updated := make(chan int)
+	go func() {
+		var n int
+		defer func() { updated <- n }()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := d.updateOptions(c.info.ContainerID, updates[n%len(updates)]); err != nil {
+				t.Error(err)
+				return
+			}
+			n++
+		}
+	}()
+	for g := range loggers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range lines {
+				msg := &Message{Line: []byte(fmt.Sprintf("logger %d line %d", g, i)), Source: "stdout", Timestamp: time.Now()}
+				if err := c.l.Log(msg); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	if n := <-updated; n < len(updates) {
+		t.Errorf("only %d updates while logging", n)
+	}
+	c.stop(t, d)
+
+	recs := containerRecords(t, fake, c.info.ContainerID)
+	if len(recs) != loggers*lines {
+		t.Fatalf("uploaded %d lines, want %d", len(recs), loggers*lines)
+	}
+	seen := make(map[string]bool)
+	next := make(map[int]int)
+	for i, rec := range recs {
+		if rec.Seq != int64(i+1) {
+			t.Fatalf("record %d numbered %d", i, rec.Seq)
+		}
+		var g, n int
+		if _, err := fmt.Sscanf(rec.Log, "logger %d line %d", &g, &n); err != nil || seen[rec.Log] {
+			t.Fatalf("record %d is %q", i, rec.Log)
+		}
+		seen[rec.Log] = true
+		// Each goroutine's lines are in the order it logged them.
+		if n != next[g] {
+			t.Fatalf("logger %d line %d uploaded after line %d", g, n, next[g]-1)
+		}
+		next[g]++
+	}
+}
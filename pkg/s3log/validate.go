@@ -0,0 +1,262 @@
+package s3log
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const (
+	verifyWriteKey = "verify-write"
+
+	probeKey = "." + driverName + "-probe"
+
+	// The container the validate command checks log-opts for, unless its
+	// flags say otherwise.
+	sampleContainerID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	sampleImageID     = "sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+)
+
+func init() {
+	requirePermissions(permission{"s3:ListBucket", onBucket, "the bucket check at container start", always})
+}
+
+// validationKey identifies a bucket checked with a given client.
+type validationKey struct {
+	bucket string
+	client clientConfig
+	write  bool
+}
+
+// validate checks that the bucket exists and can be reached before any logs
+// are written to it, so that a typo or missing permission fails the container
+// start instead of every upload. With verify-write it also writes an empty
+// probe object, which catches policies that allow HeadBucket but not
+// PutObject. Successful checks are cached. An error that may go away by
+// itself, such as a timeout or throttling, is only logged: the uploads are
+// retried and spooled like any other.
+func (l *S3Logger) validate(ctx context.Context, clients *clientFactory, t *target) error {
+	key := validationKey{bucket: t.bucket, client: t.cfg, write: l.opts.VerifyWrite}
+	if clients.validated(key) {
+		return nil
+	}
+	if err := l.checkBucket(ctx, t); err != nil {
+		if isRetryable(err) {
+			l.log().WithField("bucket", t.bucket).WithError(err).Warn("error checking bucket, starting anyway")
+			return nil
+		}
+		return err
+	}
+	clients.markValidated(key)
+	return nil
+}
+
+// checkBucket calls HeadBucket on t's bucket and, with verify-write, writes
+// the probe object to it, returning the error of the first that fails.
+// Uploads to presigned URLs can only write the probe.
+func (l *S3Logger) checkBucket(ctx context.Context, t *target) error {
+	if t.cfg.Presign.Endpoint == "" {
+		if err := headBucket(ctx, t.client, t.bucket, l.opts.RequestPayer); err != nil {
+			return newOpError(opCheckBucket, t.bucket, describeAccessError(err))
+		}
+	}
+	if l.opts.VerifyWrite {
+		b := probeBatch(l.opts, t.bucket, nil)
+		b.ssec = l.ssec
+		if err := uploadBatch(ctx, t.uploader, b); err != nil {
+			return newOpError(opVerifyWrite, t.bucket, describeAccessError(err))
+		}
+	}
+	return nil
+}
+
+// headBucket checks that bucket exists and the client's credentials may use
+// it.
+func headBucket(ctx context.Context, client s3API, bucket, requestPayer string) error {
+	var optFns []func(*s3.Options)
+	if requestPayer != "" {
+		// HeadBucketInput has no RequestPayer, so the header is added by
+		// hand.
+		optFns = append(optFns, s3.WithAPIOptions(smithyhttp.AddHeaderValue("x-amz-request-payer", requestPayer)))
+	}
+	_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)}, optFns...)
+	return err
+}
+
+// probeBatch returns the probe object written to bucket, uploaded with the
+// same encryption, storage class and ACL as the container's objects so that
+// it needs the same permissions.
+func probeBatch(opts LogOption, bucket string, body []byte) *batch {
+	return &batch{
+		Bucket:       bucket,
+		Key:          opts.S3Prefix + probeKey,
+		SSE:          opts.SSE,
+		SSEKMSKeyID:  opts.SSEKMSKeyID,
+		SSECKeyFile:  opts.SSECKeyFile,
+		StorageClass: opts.StorageClass,
+		ACL:          opts.ACL,
+		RequestPayer: opts.RequestPayer,
+		body:         body,
+	}
+}
+
+// describeAccessError explains the common reasons a bucket can't be reached.
+func describeAccessError(err error) error {
+	var re *awshttp.ResponseError
+	if !errors.As(err, &re) {
+		return err
+	}
+	switch re.HTTPStatusCode() {
+	case http.StatusNotFound:
+		return fmt.Errorf("bucket does not exist: %w", err)
+	case http.StatusForbidden:
+		return fmt.Errorf("access denied, check the IAM policy of the plugin's credentials: %w", err)
+	case http.StatusMovedPermanently:
+		return fmt.Errorf("bucket is in another region than %s: %w", s3RegionKey, err)
+	}
+	return err
+}
+
+func (f *clientFactory) validated(key validationKey) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.valid[key]
+}
+
+func (f *clientFactory) markValidated(key validationKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.valid[key] = true
+}
+
+// RunValidate runs the validate command, which checks a container's log-opts
+// as the plugin does when the container starts, without starting it, and
+// prints the configuration its logger would run with, including sample keys,
+// or why it would be refused. With --probe it also checks the buckets as the
+// start does. It takes the plugin's log-opt flags as the defaults the
+// container's log-opts override, and returns the exit status: 0 if the
+// container would start.
+func RunValidate(args []string) int {
+	var opts LogOption
+	fs := flag.NewFlagSet(driverName+" validate", flag.ExitOnError)
+	logOpts := logOptFlag{}
+	fs.Var(logOpts, "log-opt", "log-opt of the container, as key=value; may be repeated")
+	containerID := fs.String("container-id", sampleContainerID, "ID of the container")
+	containerName := fs.String("container-name", "", "name of the container")
+	image := fs.String("image", "", "image the container runs")
+	imageID := fs.String("image-id", sampleImageID, "ID of the container's image")
+	labels := logOptFlag{}
+	fs.Var(labels, "label", "label of the container, as key=value; may be repeated")
+	env := logOptFlag{}
+	fs.Var(env, "env", "environment variable of the container, as KEY=value; may be repeated")
+	allowedRetention := fs.String(allowedRetentionDaysKey, "", "comma-separated retention-days the plugin allows; any when empty")
+	probe := fs.Bool("probe", false, "also check each bucket with HeadBucket, and with verify-write the probe object, as the container's start does")
+	allowInsecure := fs.Bool(allowInsecureKey, false, "allow "+insecureSkipVerifyKey)
+	timeout := fs.Duration("timeout", defaultSelftestTimeout, "time the probe may take")
+	levelVal := fs.String("log-level", "warn", "level of the plugin's own logs while validating")
+	optionFlags(fs, &opts)
+	fs.Parse(args)
+
+	setLogLevel(*levelVal)
+	info := Info{
+		Config:             logOpts,
+		ContainerID:        *containerID,
+		ContainerName:      "/" + *containerName,
+		ContainerImageID:   *imageID,
+		ContainerImageName: *image,
+		ContainerCreated:   time.Now(),
+		ContainerLabels:    labels,
+	}
+	for k, v := range env {
+		info.ContainerEnv = append(info.ContainerEnv, k+"="+v)
+	}
+	d := &Driver{opts: opts}
+	var err error
+	if d.allowedRetention, err = parseAllowedRetention(*allowedRetention); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	c, err := validateContainer(d, info, *probe, *allowInsecure, *timeout)
+	if err != nil {
+		var e *opError
+		if !errors.As(err, &e) {
+			err = newOpError(opParseOptions, "", err)
+		}
+		fmt.Fprintf(os.Stderr, "FAIL %v\n", err)
+		return 1
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s\n", data)
+	return 0
+}
+
+// validateContainer resolves the configuration of a container logging to d
+// with info as StartLogging does, and with probe checks its buckets.
+func validateContainer(d *Driver, info Info, probe, allowInsecure bool, timeout time.Duration) (*containerConfig, error) {
+	opts, err := d.containerOptions(info)
+	if err != nil {
+		return nil, err
+	}
+	var loggers []*S3Logger
+	for _, streamOpts := range streamOptions(opts) {
+		l, err := resolveLogger(streamOpts, info)
+		if err != nil {
+			return nil, err
+		}
+		loggers = append(loggers, l)
+	}
+	if probe {
+		if opts.S3Region, err = probeBuckets(loggers[0], allowInsecure, timeout); err != nil {
+			return nil, err
+		}
+	}
+	return describeConfig(loggers, opts, info.Config), nil
+}
+
+// probeBuckets checks each bucket of l as its start does, without letting
+// an error that may go away by itself through, and returns the region of
+// its primary bucket.
+func probeBuckets(l *S3Logger, allowInsecure bool, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	opts := l.opts
+	clients := newClientFactory(loadAWSConfig(), opts.Concurrency, allowInsecure)
+	metrics := newContainerMetrics(l.info.ContainerID)
+	defer metrics.unregister()
+	buckets := append([]replica{{Bucket: opts.S3Bucket, Region: opts.S3Region}}, opts.Replicas...)
+	if opts.FailoverBucket != "" {
+		buckets = append(buckets, replica{Bucket: opts.FailoverBucket, Region: opts.FailoverRegion})
+	}
+	var region string
+	for i, r := range buckets {
+		t, err := newTarget(clients, opts, r.Bucket, r.Region, metrics)
+		if err != nil {
+			if !errors.As(err, new(*opError)) {
+				err = newOpError(opLoadCreds, r.Bucket, err)
+			}
+			return "", err
+		}
+		if i == 0 {
+			region = t.cfg.Region
+		}
+		if err := l.checkBucket(ctx, t); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(os.Stderr, "ok   %s %q\n", opCheckBucket, r.Bucket)
+	}
+	return region, nil
+}
@@ -0,0 +1,132 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	verifyAfterWriteKey = "verify-after-write"
+	verifySampleRateKey = "verify-sample-rate"
+
+	// verifyAttempts is how many times an object is looked up before it is
+	// declared missing, or unverifiable, as a store may take a moment to
+	// list an object after acknowledging its upload.
+	verifyAttempts   = 4
+	verifyRetryDelay = 250 * time.Millisecond
+)
+
+var writeVerifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: driverName,
+	Name:      "write_verifications_total",
+	Help:      "Uploaded objects looked up for verify-after-write, by result: ok, mismatch, or error when the lookup itself failed.",
+}, []string{"result"})
+
+func init() {
+	metricsRegistry.MustRegister(writeVerifications)
+	verifying := func(s permissionScope) bool { return s.opts.VerifyAfterWrite }
+	requirePermissions(
+		permission{"s3:GetObject", onObjects, verifyAfterWriteKey, verifying},
+		permission{"s3:GetObjectVersion", onObjects, verifyAfterWriteKey, verifying},
+	)
+}
+
+// errWriteMismatch is returned for an object that isn't stored as it was
+// uploaded.
+var errWriteMismatch = errors.New("object isn't stored as uploaded")
+
+// verifyWrite checks, for verify-after-write and as sampled by
+// verify-sample-rate, that the object just uploaded for b is stored with b's
+// size and, for a single PUT, its checksum, as a proxy may report an upload
+// cut short as a success. An object that isn't is uploaded again with send
+// under b's key with a ULID suffix, and verified again, leaving the broken
+// one for whoever looks into it. An object that can't be looked up is only warned about.
+func (l *S3Logger) verifyWrite(ctx context.Context, t *target, b *batch, log *logrus.Entry, send func() error) error {
+	if !l.opts.VerifyAfterWrite || rand.Float64() >= l.opts.VerifySampleRate {
+		return nil
+	}
+	err := verifyObject(ctx, t.client, b)
+	if err == nil {
+		writeVerifications.WithLabelValues("ok").Inc()
+		return nil
+	}
+	if !errors.Is(err, errWriteMismatch) {
+		writeVerifications.WithLabelValues("error").Inc()
+		s3Failed(log, t.bucket, err).Warn("error verifying uploaded object")
+		return nil
+	}
+	writeVerifications.WithLabelValues("mismatch").Inc()
+	broken := b.Key
+	stem := trimCodecExt(b.Key)
+	b.Key = withUniqueSuffix(stem, newULID(time.Now())) + strings.TrimPrefix(b.Key, stem)
+	log.WithError(err).WithField("key", b.Key).Errorf("uploaded object %q failed verification, uploading it again", broken)
+	if err := send(); err != nil {
+		return err
+	}
+	err = verifyObject(ctx, t.client, b)
+	switch {
+	case err == nil:
+		writeVerifications.WithLabelValues("ok").Inc()
+	case errors.Is(err, errWriteMismatch):
+		writeVerifications.WithLabelValues("mismatch").Inc()
+		return err
+	default:
+		writeVerifications.WithLabelValues("error").Inc()
+		s3Failed(log, t.bucket, err).Warn("error verifying uploaded object")
+	}
+	return nil
+}
+
+// verifyObject looks up the object uploaded for b, retrying a lookup that
+// fails, and returns an error wrapping errWriteMismatch if it is missing or
+// isn't b's size or checksum.
+func verifyObject(ctx context.Context, client s3API, b *batch) error {
+	input := &s3.HeadObjectInput{
+		Bucket:       aws.String(b.Bucket),
+		Key:          aws.String(b.Key),
+		RequestPayer: types.RequestPayer(b.RequestPayer),
+	}
+	if b.versionID != "" {
+		input.VersionId = aws.String(b.versionID)
+	}
+	if b.ChecksumSHA256 != "" {
+		input.ChecksumMode = types.ChecksumModeEnabled
+	}
+	ssec, err := b.customerKey()
+	if err != nil {
+		return err
+	}
+	ssec.set(&input.SSECustomerAlgorithm, &input.SSECustomerKey, &input.SSECustomerKeyMD5)
+	var out *s3.HeadObjectOutput
+	for attempt := 1; ; attempt++ {
+		out, err = client.HeadObject(ctx, input)
+		if err == nil || attempt == verifyAttempts || !sleepContext(ctx, time.Duration(attempt)*verifyRetryDelay) {
+			break
+		}
+	}
+	if httpStatus(err) == http.StatusNotFound {
+		return fmt.Errorf("%w: %q not found", errWriteMismatch, b.Key)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to verify object %q: %w", b.Key, err)
+	}
+	if size := aws.ToInt64(out.ContentLength); size != int64(len(b.body)) {
+		return fmt.Errorf("%w: %q is %d bytes, not %d", errWriteMismatch, b.Key, size, len(b.body))
+	}
+	// Not every store returns the checksum it was sent.
+	if sum := aws.ToString(out.ChecksumSHA256); b.ChecksumSHA256 != "" && sum != "" && sum != b.ChecksumSHA256 {
+		return fmt.Errorf("%w: %q doesn't match its checksum", errWriteMismatch, b.Key)
+	}
+	return nil
+}
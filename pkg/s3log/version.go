@@ -0,0 +1,69 @@
+package s3log
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+)
+
+const buildInfoKey = "build-info"
+
+// The plugin's version, commit and build date, set when it is built with
+//
+//	pkg=DockerS3LogDriver/pkg/s3log
+//	go build -ldflags "-X $pkg.version=v1.2.3 -X $pkg.commit=$(git rev-parse HEAD) -X $pkg.buildDate=$(date -u +%FT%TZ)"
+//
+// A build without them takes the commit and its date from the VCS stamp Go
+// embeds, when there is one.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && commit == "":
+			commit = s.Value
+		case s.Key == "vcs.time" && buildDate == "":
+			buildDate = s.Value
+		}
+	}
+}
+
+// writeVersion writes the plugin's version to w, followed by the Go version
+// and modules it was built from if buildInfo is set.
+func writeVersion(w io.Writer, buildInfo bool) {
+	fmt.Fprintf(w, "%s %s\ncommit: %s\nbuilt: %s\n", driverName, version, orUnknown(commit), orUnknown(buildDate))
+	if !buildInfo {
+		return
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		fmt.Fprintln(w, "no build info embedded in the binary")
+		return
+	}
+	fmt.Fprint(w, info)
+}
+
+// RunVersion runs the version command.
+func RunVersion(args []string) {
+	fs := flag.NewFlagSet(driverName+" version", flag.ExitOnError)
+	buildInfo := fs.Bool(buildInfoKey, false, "also print the Go version and the modules the plugin was built from")
+	fs.Parse(args)
+	writeVersion(os.Stdout, *buildInfo)
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
@@ -0,0 +1,57 @@
+package s3log
+
+import (
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteVersion(t *testing.T) {
+	tests := []struct {
+		name                     string
+		version, commit, created string
+		want                     string
+	}{
+		{name: "stamped", version: "v1.2.3", commit: "abc123", created: "2024-05-01T00:00:00Z", want: driverName + " v1.2.3\ncommit: abc123\nbuilt: 2024-05-01T00:00:00Z\n"},
+		{name: "unstamped", version: "dev", want: driverName + " dev\ncommit: unknown\nbuilt: unknown\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, c, b := version, commit, buildDate
+			t.Cleanup(func() { version, commit, buildDate = v, c, b })
+			version, commit, buildDate = tt.version, tt.commit, tt.created
+			var buf bytes.Buffer
+			writeVersion(&buf, false)
+			if buf.String() != tt.want {
+				t.Errorf("writeVersion wrote %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+// TestVersionLDFlags builds the plugin as Dockerfile.build does and checks
+// that its version command reports what the build stamped into it.
+func TestVersionLDFlags(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the plugin")
+	}
+	bin := filepath.Join(t.TempDir(), "docker-log-driver")
+	pkg := "DockerS3LogDriver/pkg/s3log"
+	ldflags := "-X " + pkg + ".version=v9.8.7 -X " + pkg + ".commit=0123abc -X " + pkg + ".buildDate=2024-05-01T00:00:00Z"
+	build := exec.Command("go", "build", "-ldflags", ldflags, "-o", bin, "DockerS3LogDriver")
+	build.Env = append(build.Environ(), "CGO_ENABLED=0")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+	for _, args := range [][]string{{"version"}, {"--version"}} {
+		out, err := exec.Command(bin, args...).Output()
+		if err != nil {
+			t.Fatalf("%s: %v", strings.Join(args, " "), err)
+		}
+		if want := driverName + " v9.8.7\ncommit: 0123abc\nbuilt: 2024-05-01T00:00:00Z\n"; string(out) != want {
+			t.Errorf("%s printed %q, want %q", strings.Join(args, " "), out, want)
+		}
+	}
+}
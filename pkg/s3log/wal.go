@@ -0,0 +1,544 @@
+package s3log
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	walKey             = "wal"
+	walDirKey          = "wal-dir"
+	walSyncIntervalKey = "wal-sync-interval"
+	walSegmentBytesKey = "wal-segment-bytes"
+	walRetentionKey    = "wal-retention"
+
+	defaultWALSyncInterval = time.Second
+	defaultWALSegmentBytes = 16 << 20
+
+	walSegmentSuffix = ".wal"
+
+	// releasedDirName is the subdirectory of a journal's directory its
+	// segments are moved to once uploaded, with wal-retention, named for when
+	// they were released and when they expire. journalInfoName, alongside
+	// them, describes the container they are from.
+	releasedDirName = "released"
+	journalInfoName = "container.json"
+	// replayLockName is a file in wal-dir the replay command holds a shared
+	// lock on while it reads the journals, so that no released segment is
+	// deleted under it.
+	replayLockName = ".replay.lock"
+	// releasedSweepInterval is how often expired segments are looked for.
+	releasedSweepInterval = time.Minute
+
+	// walHeaderSize is the length and CRC-32C of the entry that follow in a
+	// journal record, both big endian.
+	walHeaderSize = 8
+)
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// journal is a write-ahead log of the messages handed to a logger, so that
+// lines still in memory when the plugin crashes are uploaded once it starts
+// again. Each message is appended as a record to the current segment, a file
+// in the logger's directory named so that segments sort in the order they
+// were written, and given an index numbering the records of this run. A
+// segment is deleted once every record in it has been uploaded, or kept for
+// the replay command until wal-retention has passed.
+type journal struct {
+	dir          string
+	syncInterval time.Duration
+	segmentBytes int64
+	log          *logrus.Entry
+
+	mu      sync.Mutex
+	f       *os.File // current segment, opened by the first append after a rotation
+	fFirst  int64    // index of the first record in f
+	size    int64    // bytes written to f
+	segNum  int64    // number of the last segment opened
+	next    int64    // index of the next record
+	segs    []journalSegment
+	dirty   bool // f has writes that haven't been synced
+	failing bool // the last write failed
+	buf     []byte
+	cp      journalCheckpoint // last checkpoint saved or loaded
+
+	// retention is how long released segments are kept, 0 to delete them at
+	// once; info is written along with the first.
+	retention time.Duration
+	info      *journalInfo
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// journalSegment is a segment that is no longer written to.
+type journalSegment struct {
+	path  string
+	num   int64 // number in its name
+	first int64 // index of its first record
+	last  int64 // index of its last record
+}
+
+// journalInfo is what a journal's released directory records of the
+// container its segments are from, for the replay command to name their
+// objects as the plugin did.
+type journalInfo struct {
+	Info   Info
+	Stream string `json:",omitempty"`
+}
+
+// releasedJournals are the journals open in each wal-dir, whose directories
+// a sweep leaves be, and when each wal-dir was last swept.
+var releasedJournals = struct {
+	sync.Mutex
+	open  map[string]int
+	swept map[string]time.Time
+}{open: map[string]int{}, swept: map[string]time.Time{}}
+
+// walDir returns the directory the logger's journal is kept in.
+func (l *S3Logger) walDir() string {
+	return filepath.Join(l.opts.WALDir, l.fileName())
+}
+
+// openJournal opens the journal in dir. Segments left over from a previous
+// run must be replayed before anything is appended. With a syncInterval of
+// zero every record is synced as it is written.
+func openJournal(dir string, syncInterval time.Duration, segmentBytes int64, routines *routines, log *logrus.Entry) (*journal, error) {
+	// Registered before the directory is made, so that no sweep removes it.
+	releasedJournals.Lock()
+	err := os.MkdirAll(dir, 0700)
+	if err == nil {
+		releasedJournals.open[dir]++
+	}
+	releasedJournals.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s %q: %v", walDirKey, dir, err)
+	}
+	j := &journal{
+		dir:          dir,
+		syncInterval: syncInterval,
+		segmentBytes: segmentBytes,
+		log:          log.WithField("dir", dir),
+		next:         1,
+		done:         make(chan struct{}),
+	}
+	cp, _, err := loadCheckpoint(dir)
+	if err != nil {
+		j.log.WithError(err).Warn("error loading journal checkpoint, replaying every record")
+	}
+	j.cp = cp
+	if syncInterval > 0 {
+		j.wg.Add(1)
+		routines.start("wal-sync", j.syncLoop)
+	}
+	return j, nil
+}
+
+// replay hands every record left in the journal's segments to fn, oldest
+// first, along with its index. Records up to the checkpoint were uploaded
+// before the plugin stopped and are skipped, though still numbered. A
+// segment ending in a torn or corrupt record, as left by a crash in the
+// middle of a write, is truncated before it. Segments holding no records
+// left to upload are deleted.
+func (j *journal) replay(fn func(*Message, int64)) error {
+	paths, err := filepath.Glob(filepath.Join(j.dir, "*"+walSegmentSuffix))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	var skipped int64
+	for _, path := range paths {
+		n, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), walSegmentSuffix), 10, 64)
+		if err == nil && n > j.segNum {
+			j.segNum = n
+		}
+		var skip int64
+		switch {
+		case err != nil:
+		case n < j.cp.Segment:
+			skip = math.MaxInt64
+		case n == j.cp.Segment:
+			skip = j.cp.Records
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read journal segment %q: %v", path, err)
+		}
+		first := j.next
+		replayed := 0
+		for off := 0; off < len(data); {
+			e, n, ok := decodeJournalRecord(data[off:])
+			if !ok {
+				j.log.WithField("file", path).Warnf("truncating journal segment at a torn record, dropping its last %d bytes", len(data)-off)
+				if err := os.Truncate(path, int64(off)); err != nil {
+					j.log.WithField("file", path).WithError(err).Error("error truncating journal segment")
+				}
+				break
+			}
+			if j.next-first < skip {
+				skipped++
+			} else {
+				fn(newMessage(e), j.next)
+				replayed++
+			}
+			j.next++
+			off += n
+		}
+
+		j.mu.Lock()
+		if replayed == 0 {
+			os.Remove(path)
+		} else {
+			j.segs = append(j.segs, journalSegment{path: path, num: n, first: first, last: j.next - 1})
+		}
+		j.mu.Unlock()
+	}
+	if skipped > 0 {
+		j.log.WithField("records", skipped).Info("skipped journal records uploaded before the plugin stopped")
+	}
+	return nil
+}
+
+// lineSequence returns the sequence number of the last line uploaded as of
+// the checkpoint loaded from a previous run, if there was one.
+func (j *journal) lineSequence() (int64, bool) {
+	return j.cp.LineSequence, j.cp != (journalCheckpoint{})
+}
+
+// decodeJournalRecord decodes the record at the start of data, returning its
+// length. It reports false if the record is torn or doesn't match its CRC.
+func decodeJournalRecord(data []byte) (*logdriver.LogEntry, int, bool) {
+	if len(data) < walHeaderSize {
+		return nil, 0, false
+	}
+	size := int(binary.BigEndian.Uint32(data))
+	if len(data)-walHeaderSize < size {
+		return nil, 0, false
+	}
+	payload := data[walHeaderSize : walHeaderSize+size]
+	if crc32.Checksum(payload, walCRCTable) != binary.BigEndian.Uint32(data[4:]) {
+		return nil, 0, false
+	}
+	var e logdriver.LogEntry
+	if err := e.Unmarshal(payload); err != nil {
+		return nil, 0, false
+	}
+	return &e, walHeaderSize + size, true
+}
+
+// append writes msg to the journal and returns its index. A message that
+// can't be written is still numbered, and the error is logged rather than
+// failing Log: the line isn't lost, only unprotected against a crash.
+func (j *journal) append(msg *Message) int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	i := j.next
+	j.next++
+	if err := j.write(msg); err != nil {
+		if !j.failing {
+			j.log.WithError(err).Error("error writing to journal, lines won't survive a crash until it recovers")
+		}
+		j.failing = true
+		// Start afresh rather than append past a record that may be torn.
+		j.closeSegment()
+		return i
+	}
+	if j.failing {
+		j.log.Info("journal recovered")
+		j.failing = false
+	}
+	return i
+}
+
+// write appends a record holding msg to the current segment, opening one if
+// needed. Callers must hold j.mu.
+func (j *journal) write(msg *Message) error {
+	if j.f == nil {
+		j.segNum++
+		path := filepath.Join(j.dir, fmt.Sprintf("%020d%s", j.segNum, walSegmentSuffix))
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		j.f, j.fFirst, j.size = f, j.next-1, 0
+	}
+
+	e := logdriver.LogEntry{
+		Source:   msg.Source,
+		TimeNano: msg.Timestamp.UnixNano(),
+		Line:     msg.Line,
+		Partial:  msg.PLogMetaData != nil,
+	}
+	if meta := msg.PLogMetaData; meta != nil {
+		e.PartialLogMetadata = &logdriver.PartialLogEntryMetadata{
+			Id:      meta.ID,
+			Last:    meta.Last,
+			Ordinal: int32(meta.Ordinal),
+		}
+	}
+	size := e.Size()
+	if cap(j.buf) < walHeaderSize+size {
+		j.buf = make([]byte, walHeaderSize+size)
+	}
+	j.buf = j.buf[:walHeaderSize+size]
+	if _, err := e.MarshalTo(j.buf[walHeaderSize:]); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(j.buf, uint32(size))
+	binary.BigEndian.PutUint32(j.buf[4:], crc32.Checksum(j.buf[walHeaderSize:], walCRCTable))
+	if _, err := j.f.Write(j.buf); err != nil {
+		return err
+	}
+	j.size += int64(len(j.buf))
+	j.dirty = true
+
+	if j.syncInterval == 0 {
+		if err := j.sync(); err != nil {
+			return err
+		}
+	}
+	if j.size >= j.segmentBytes {
+		j.closeSegment()
+	}
+	return nil
+}
+
+// sync flushes the current segment to disk. Callers must hold j.mu.
+func (j *journal) sync() error {
+	if j.f == nil || !j.dirty {
+		return nil
+	}
+	j.dirty = false
+	return j.f.Sync()
+}
+
+// closeSegment stops writing to the current segment, so that the next record
+// starts a new one. Callers must hold j.mu.
+func (j *journal) closeSegment() {
+	if j.f == nil {
+		return
+	}
+	if err := j.sync(); err != nil {
+		j.log.WithError(err).Warn("error syncing journal segment")
+	}
+	j.f.Close()
+	j.segs = append(j.segs, journalSegment{path: j.f.Name(), num: j.segNum, first: j.fFirst, last: j.next - 1})
+	j.f = nil
+}
+
+// rotate closes the current segment, so that it can be deleted once its
+// records have been uploaded.
+func (j *journal) rotate() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.closeSegment()
+}
+
+// retain keeps the journal's segments for retention once their records have
+// been uploaded, describing them as info's.
+func (j *journal) retain(retention time.Duration, info journalInfo) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.retention, j.info = retention, &info
+}
+
+// release checkpoints record i, whose line and every one before it have
+// been uploaded, the last of them numbered lineSeq, and deletes the segments
+// holding only records up to it, or moves them to the released directory if
+// they are retained.
+func (j *journal) release(i, lineSeq int64) {
+	j.mu.Lock()
+	j.checkpoint(i, lineSeq)
+	for len(j.segs) > 0 && j.segs[0].last <= i {
+		if err := j.dispose(j.segs[0].path); err != nil {
+			j.log.WithField("file", j.segs[0].path).WithError(err).Warn("error removing journal segment")
+		}
+		j.segs = j.segs[1:]
+	}
+	retained := j.retention > 0
+	j.mu.Unlock()
+	if retained {
+		sweepReleased(filepath.Dir(j.dir), false)
+	}
+}
+
+// dispose deletes the released segment at path, or moves it to the released
+// directory until the journal's retention has passed. Callers must hold
+// j.mu.
+func (j *journal) dispose(path string) error {
+	if j.retention <= 0 {
+		return os.Remove(path)
+	}
+	dir := filepath.Join(j.dir, releasedDirName)
+	if j.info != nil {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		data, err := json.Marshal(j.info)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, journalInfoName), data, 0600); err != nil {
+			return err
+		}
+		j.info = nil
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%020d-%020d%s", now.UnixNano(), now.Add(j.retention).UnixNano(), walSegmentSuffix)
+	return os.Rename(path, filepath.Join(dir, name))
+}
+
+// releasedExpiry returns when the released segment at path expires.
+func releasedExpiry(path string) (time.Time, bool) {
+	_, expiry, ok := strings.Cut(strings.TrimSuffix(filepath.Base(path), walSegmentSuffix), "-")
+	n, err := strconv.ParseInt(expiry, 10, 64)
+	if !ok || err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n), true
+}
+
+// sweepReleased deletes the released segments under root, a wal-dir, whose
+// retention has passed, along with the directories of the journals left
+// empty that aren't open. Unless force is set root is swept at most every
+// releasedSweepInterval. Nothing is deleted while the replay command is
+// reading the journals.
+func sweepReleased(root string, force bool) {
+	releasedJournals.Lock()
+	defer releasedJournals.Unlock()
+	if !force && time.Since(releasedJournals.swept[root]) < releasedSweepInterval {
+		return
+	}
+	releasedJournals.swept[root] = time.Now()
+	lock, err := os.OpenFile(filepath.Join(root, replayLockName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		logrus.WithField("dir", root).WithError(err).Warn("error opening the journals' replay lock, not deleting expired segments")
+		return
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		logrus.WithField("dir", root).Debug("journals are being replayed, not deleting expired segments")
+		return
+	}
+	dirs, _ := filepath.Glob(filepath.Join(root, "*", releasedDirName))
+	for _, dir := range dirs {
+		paths, _ := filepath.Glob(filepath.Join(dir, "*"+walSegmentSuffix))
+		kept := 0
+		for _, path := range paths {
+			if expiry, ok := releasedExpiry(path); ok && time.Now().After(expiry) {
+				if err := os.Remove(path); err != nil {
+					logrus.WithField("file", path).WithError(err).Warn("error removing expired journal segment")
+				}
+				continue
+			}
+			kept++
+		}
+		if kept > 0 {
+			continue
+		}
+		os.Remove(filepath.Join(dir, journalInfoName))
+		os.Remove(dir)
+		// A journal kept for its next start still holds its segments.
+		if jdir := filepath.Dir(dir); releasedJournals.open[jdir] == 0 {
+			os.Remove(jdir)
+		}
+	}
+}
+
+// syncLoop syncs the current segment every syncInterval until the journal is
+// closed.
+func (j *journal) syncLoop() {
+	defer j.wg.Done()
+	t := time.NewTicker(j.syncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-t.C:
+		}
+		j.mu.Lock()
+		if err := j.sync(); err != nil {
+			j.log.WithError(err).Warn("error syncing journal segment")
+		}
+		j.mu.Unlock()
+	}
+}
+
+// close syncs and closes the journal. Its directory is removed if every
+// segment has been released, unless some are retained; otherwise the
+// segments are kept to be replayed the next time the logger starts.
+func (j *journal) close() {
+	close(j.done)
+	j.wg.Wait()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.closeSegment()
+	releasedJournals.Lock()
+	if releasedJournals.open[j.dir]--; releasedJournals.open[j.dir] <= 0 {
+		delete(releasedJournals.open, j.dir)
+	}
+	releasedJournals.Unlock()
+	if len(j.segs) == 0 {
+		os.Remove(filepath.Join(j.dir, checkpointName))
+		os.Remove(j.dir)
+	}
+}
+
+// journaled returns the index of the last journal record whose line has made
+// it into the buffer, or been dropped on the way. Parts of a partial line and
+// lines of a multiline record that are still held back keep the records from
+// their first one on. Callers must hold l.mu.
+func (l *S3Logger) journaled() int64 {
+	i := l.walSeen
+	for _, p := range l.partials {
+		i = min(i, p.wal-1)
+	}
+	for _, g := range l.groups {
+		i = min(i, g.wal-1)
+	}
+	return i
+}
+
+// replayJournal feeds the messages left in the journal by a previous run
+// through the logger before it accepts new ones, flushing whenever
+// the flush size has accumulated so that a long journal isn't dropped for want
+// of buffer space in non-blocking mode.
+func (l *S3Logger) replayJournal() error {
+	if seq, ok := l.wal.lineSequence(); ok {
+		l.mu.Lock()
+		l.lineSeq = seq
+		l.mu.Unlock()
+	}
+	n := 0
+	err := l.wal.replay(func(msg *Message, wal int64) {
+		l.mu.Lock()
+		l.process(msg, wal)
+		full := l.bufferedLen() >= l.flushBytes()
+		l.mu.Unlock()
+		n++
+		if full {
+			if err := l.flush(l.ctx); err != nil {
+				l.log().WithError(err).Error("error flushing replayed logs")
+			}
+		}
+	})
+	if n > 0 {
+		l.log().WithField("lines", n).Info("replayed journal from a previous run")
+	}
+	return err
+}
@@ -0,0 +1,364 @@
+package s3log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// journalSegments returns the segments in dir, oldest first.
+func journalSegments(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+walSegmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// fileSize returns the length of the file at path.
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+// uploadedLog returns the lines uploaded to fake, in the order of their
+// objects.
+func uploadedLog(t *testing.T, fake *fakeS3) []string {
+	t.Helper()
+	var lines []string
+	for _, r := range uploadedRanges(t, fake) {
+		lines = append(lines, r.lines...)
+	}
+	return lines
+}
+
+func TestJournalRecovery(t *testing.T) {
+	// Lines only in memory when the plugin crashed are uploaded once the
+	// logger starts again, before any it is handed after, with a segment
+	// ending in a torn or corrupt record truncated before it.
+	lines := []string{"one", "two", "three", "four"}
+	tests := []struct {
+		name         string
+		segmentBytes string
+		// damage changes the segments the crash left, returning the size
+		// each should be truncated to, 0 for as it was.
+		damage func(t *testing.T, segments []string, sizes []int64) []int64
+		want   []string
+	}{
+		{
+			name:         "intact",
+			segmentBytes: "1m",
+			damage:       func(*testing.T, []string, []int64) []int64 { return nil },
+			want:         lines,
+		},
+		{
+			// As a crash in the middle of writing the last record leaves it.
+			name:         "torn last record",
+			segmentBytes: "1m",
+			damage: func(t *testing.T, segments []string, sizes []int64) []int64 {
+				end := fileSize(t, segments[0])
+				if err := os.Truncate(segments[0], end-3); err != nil {
+					t.Fatal(err)
+				}
+				return []int64{sizes[2]}
+			},
+			want: lines[:3],
+		},
+		{
+			name:         "corrupt last record",
+			segmentBytes: "1m",
+			damage: func(t *testing.T, segments []string, sizes []int64) []int64 {
+				data, err := os.ReadFile(segments[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				data[len(data)-1] ^= 0xff
+				if err := os.WriteFile(segments[0], data, 0600); err != nil {
+					t.Fatal(err)
+				}
+				return []int64{sizes[2]}
+			},
+			want: lines[:3],
+		},
+		{
+			name:         "header without its entry",
+			segmentBytes: "1m",
+			damage: func(t *testing.T, segments []string, sizes []int64) []int64 {
+				f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				f.Write([]byte{0, 0, 0, 40, 1, 2, 3, 4, 5})
+				return []int64{sizes[3]}
+			},
+			want: lines,
+		},
+		{
+			// Records after the torn one are in segments of their own, and
+			// only it is lost.
+			name:         "torn segment between others",
+			segmentBytes: "1", // a segment per line
+			damage: func(t *testing.T, segments []string, sizes []int64) []int64 {
+				if err := os.Truncate(segments[1], 5); err != nil {
+					t.Fatal(err)
+				}
+				return []int64{0, 0, 0, 0}
+			},
+			want: []string{"one", "three", "four"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			cfg := map[string]string{
+				walKey:             "true",
+				walDirKey:          t.TempDir(),
+				walSyncIntervalKey: "0",
+				walSegmentBytesKey: tt.segmentBytes,
+				flushIntervalKey:   "1h",
+			}
+			before := newTestLogger(t, fake, cfg)
+			// sizes are those of the last segment as each line is logged.
+			var sizes []int64
+			for _, line := range lines {
+				logLines(t, before, time.Now(), line)
+				segments := journalSegments(t, before.walDir())
+				sizes = append(sizes, fileSize(t, segments[len(segments)-1]))
+			}
+			before.abandon()
+			segments := journalSegments(t, before.walDir())
+			truncated := tt.damage(t, segments, sizes)
+
+			after := newTestLogger(t, fake, cfg)
+			for i, size := range truncated {
+				if size > 0 && fileSize(t, segments[i]) != size {
+					t.Errorf("segment %s of %d bytes after it was replayed, want it truncated to %d", segments[i], fileSize(t, segments[i]), size)
+				}
+			}
+			if tt.segmentBytes == "1" {
+				if _, err := os.Stat(segments[1]); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("segment left with no record to replay kept: %v", err)
+				}
+			}
+			logLines(t, after, time.Now(), "new")
+			if err := after.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := uploadedLog(t, fake), append(slices.Clone(tt.want), "new"); !slices.Equal(got, want) {
+				t.Errorf("uploaded %q, want %q", got, want)
+			}
+			if _, err := os.Stat(after.walDir()); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("journal directory kept once every line was uploaded: %v", err)
+			}
+		})
+	}
+}
+
+func TestJournalRelease(t *testing.T) {
+	// The segments whose records have all been uploaded are deleted, or with
+	// wal-retention moved to the released directory along with what the
+	// replay command needs of the container; those still holding lines to
+	// upload are kept.
+	tests := []struct {
+		name      string
+		retention string
+	}{
+		{name: "deleted", retention: "0"},
+		{name: "retained", retention: "1h"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3()
+			walDir := t.TempDir()
+			l := newTestLogger(t, fake, map[string]string{
+				walKey:             "true",
+				walDirKey:          walDir,
+				walSyncIntervalKey: "0",
+				walSegmentBytesKey: "1", // a segment per line
+				walRetentionKey:    tt.retention,
+				flushIntervalKey:   "1h",
+			})
+			logLines(t, l, time.Now(), "one", "two", "three")
+			if err := l.flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			logLines(t, l, time.Now(), "four", "five")
+			if n := len(journalSegments(t, l.walDir())); n != 2 {
+				t.Errorf("%d segments kept, want the 2 of the lines not uploaded", n)
+			}
+
+			released := journalSegments(t, filepath.Join(l.walDir(), releasedDirName))
+			if tt.retention == "0" {
+				if len(released) != 0 {
+					t.Errorf("released %q without wal-retention", released)
+				}
+				if err := l.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := os.Stat(l.walDir()); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("journal directory kept after the logger closed: %v", err)
+				}
+				return
+			}
+
+			if len(released) != 3 {
+				t.Fatalf("released %q, want the 3 segments uploaded", released)
+			}
+			for _, path := range released {
+				expiry, ok := releasedExpiry(path)
+				if until := time.Until(expiry); !ok || until < 59*time.Minute || until > time.Hour {
+					t.Errorf("released %s expiring in %s, want wal-retention", filepath.Base(path), until)
+				}
+			}
+			ji, err := readJournalInfo(l.walDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ji.Info.ContainerID != l.info.ContainerID {
+				t.Errorf("%s describes container %q, want %q", journalInfoName, ji.Info.ContainerID, l.info.ContainerID)
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			sweepReleased(walDir, true)
+			if got := journalSegments(t, filepath.Join(l.walDir(), releasedDirName)); len(got) != 5 {
+				t.Errorf("released %d segments once the logger closed, want all 5 kept for wal-retention", len(got))
+			}
+		})
+	}
+}
+
+func TestSweepReleased(t *testing.T) {
+	// Expired segments are deleted, and with them the directories of
+	// journals that are left with nothing and aren't open. Segments not yet
+	// expired and files that aren't released segments are kept.
+	root := t.TempDir()
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	segment := func(expiry time.Time) string {
+		return fmt.Sprintf("%020d-%020d%s", expiry.Add(-time.Hour).UnixNano(), expiry.UnixNano(), walSegmentSuffix)
+	}
+	files := map[string][]string{
+		"some expired": {segment(past), segment(future), journalInfoName},
+		"all expired":  {segment(past), segment(past), journalInfoName},
+		"open":         {segment(past), journalInfoName},
+		"unknown":      {"00000000000000000001" + walSegmentSuffix, journalInfoName},
+	}
+	for dir, names := range files {
+		released := filepath.Join(root, dir, releasedDirName)
+		if err := os.MkdirAll(released, 0700); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			if err := os.WriteFile(filepath.Join(released, name), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	open := filepath.Join(root, "open")
+	releasedJournals.Lock()
+	releasedJournals.open[open]++
+	releasedJournals.Unlock()
+	defer func() {
+		releasedJournals.Lock()
+		delete(releasedJournals.open, open)
+		releasedJournals.Unlock()
+	}()
+
+	sweepReleased(root, true)
+	tests := []struct {
+		dir  string
+		want []string // "" for the directory removed
+	}{
+		{dir: "some expired", want: []string{segment(future), journalInfoName}},
+		{dir: "all expired"},
+		{dir: "open", want: []string{}},
+		{dir: "unknown", want: []string{"00000000000000000001" + walSegmentSuffix, journalInfoName}},
+	}
+	for _, tt := range tests {
+		entries, err := os.ReadDir(filepath.Join(root, tt.dir, releasedDirName))
+		if tt.want == nil {
+			if _, err := os.Stat(filepath.Join(root, tt.dir)); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s: journal directory kept with nothing left in it: %v", tt.dir, err)
+			}
+			continue
+		}
+		if tt.dir == "open" {
+			if _, err := os.Stat(open); err != nil {
+				t.Errorf("open journal's directory removed: %v", err)
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("open: released directory kept with nothing left in it: %v", err)
+			}
+			continue
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: kept %q, want %q", tt.dir, got, tt.want)
+		}
+	}
+
+	// Within releasedSweepInterval of the last sweep only a forced one
+	// looks again.
+	late := filepath.Join(root, "some expired", releasedDirName, segment(past))
+	if err := os.WriteFile(late, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sweepReleased(root, false)
+	if _, err := os.Stat(late); err != nil {
+		t.Errorf("swept again within %s of the last sweep: %v", releasedSweepInterval, err)
+	}
+	sweepReleased(root, true)
+	if _, err := os.Stat(late); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expired segment kept by a forced sweep: %v", err)
+	}
+}
+
+func TestDecodeJournalRecord(t *testing.T) {
+	j, err := openJournal(t.TempDir(), 0, defaultWALSegmentBytes, newRoutines(testContainerID(t)), logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	j.append(&Message{Line: []byte("hello"), Source: "stderr", Timestamp: at})
+	j.rotate()
+	data, err := os.ReadFile(j.segs[0].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, n, ok := decodeJournalRecord(data)
+	if !ok || n != len(data) || string(e.Line) != "hello" || e.Source != "stderr" || e.TimeNano != at.UnixNano() {
+		t.Fatalf("decoded %+v of %d bytes, %v, want the record of %d", e, n, ok, len(data))
+	}
+	for i := range data {
+		if _, _, ok := decodeJournalRecord(data[:i]); ok {
+			t.Errorf("decoded a record torn at %d of %d bytes", i, len(data))
+		}
+	}
+	for i := range data {
+		corrupt := slices.Clone(data)
+		corrupt[i] ^= 0x01
+		if _, _, ok := decodeJournalRecord(corrupt); ok {
+			t.Errorf("decoded a record with byte %d flipped", i)
+		}
+	}
+}